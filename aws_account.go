@@ -6,9 +6,13 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 )
 
 // AWSAccount holds the AWS account name and roles
@@ -83,3 +87,132 @@ func LocateRole(awsRoles []*AWSRole, roleName string) (*AWSRole, error) {
 
 	return nil, fmt.Errorf("Supplied RoleArn not found in saml assertion: %s", roleName)
 }
+
+// PrepareAccount fills in the URN, region and STS endpoint aws_partition implies and turns a role_arn naming one of
+// the role_aliases into the role ARN, the steps every login takes before authenticating
+func PrepareAccount(account *cfg.IDPAccount, aliases map[string]string) error {
+	account.ApplyPartition()
+
+	if account.RoleARN == "" {
+		return nil
+	}
+
+	roleARN, err := ResolveRoleAlias(account.RoleARN, aliases)
+	if err != nil {
+		return err
+	}
+	account.RoleARN = roleARN
+
+	return nil
+}
+
+// ResolveRoleAlias looks the role up in the role_aliases section, a value that is already an ARN is used as is
+func ResolveRoleAlias(role string, aliases map[string]string) (string, error) {
+	if roleARN, ok := aliases[role]; ok {
+		return roleARN, nil
+	}
+
+	if strings.HasPrefix(role, "arn:") {
+		return role, nil
+	}
+
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return "", errors.Errorf("Unknown role alias %s, no role aliases are configured.", role)
+	}
+
+	return "", errors.Errorf("Unknown role alias %s, available aliases: %s.", role, strings.Join(names, ", "))
+}
+
+// ConfiguredRole the role the role_arn of the account names or, without one, the role its role_matcher matches.
+// It is nil when the account sets neither and the role has to be chosen.
+func ConfiguredRole(awsRoles []*AWSRole, account *cfg.IDPAccount) (*AWSRole, error) {
+	if account.RoleARN != "" {
+		return LocateRole(awsRoles, account.RoleARN)
+	}
+
+	if account.RoleMatcher != "" {
+		return MatchRole(awsRoles, account.RoleMatcher)
+	}
+
+	return nil, nil
+}
+
+// MatchRole picks the one role whose ARN the role_matcher regular expression matches, listing the roles to
+// choose from when it matches none or several
+func MatchRole(awsRoles []*AWSRole, matcher string) (*AWSRole, error) {
+	re, err := regexp.Compile(matcher)
+	if err != nil {
+		return nil, errors.Wrapf(err, "role_matcher %q isn't a valid regular expression", matcher)
+	}
+
+	matched := []*AWSRole{}
+	for _, role := range awsRoles {
+		if re.MatchString(role.RoleARN) {
+			matched = append(matched, role)
+		}
+	}
+
+	if len(matched) == 1 {
+		return matched[0], nil
+	}
+
+	candidates, problem := awsRoles, "matches none of the roles"
+	if len(matched) > 1 {
+		candidates, problem = matched, fmt.Sprintf("matches %d roles", len(matched))
+	}
+
+	roleARNs := make([]string, len(candidates))
+	for i, role := range candidates {
+		roleARNs[i] = role.RoleARN
+	}
+	sort.Strings(roleARNs)
+
+	return nil, fmt.Errorf("role_matcher %q %s, it has to match exactly one of:\n  %s", matcher, problem, strings.Join(roleARNs, "\n  "))
+}
+
+// FilterRoles keeps the roles whose ARN the role_filter regular expression matches, and the accounts with any of
+// them, listing the roles to choose from when it matches none
+func FilterRoles(awsRoles []*AWSRole, awsAccounts []*AWSAccount, filter string) ([]*AWSRole, []*AWSAccount, error) {
+	re, err := regexp.Compile(filter)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "role_filter %q isn't a valid regular expression", filter)
+	}
+
+	matched := []*AWSRole{}
+	for _, role := range awsRoles {
+		if re.MatchString(role.RoleARN) {
+			matched = append(matched, role)
+		}
+	}
+
+	if len(matched) == 0 {
+		roleARNs := make([]string, len(awsRoles))
+		for i, role := range awsRoles {
+			roleARNs[i] = role.RoleARN
+		}
+		sort.Strings(roleARNs)
+
+		return nil, nil, fmt.Errorf("role_filter %q matches none of the roles:\n  %s", filter, strings.Join(roleARNs, "\n  "))
+	}
+
+	filteredAccounts := []*AWSAccount{}
+	for _, awsAccount := range awsAccounts {
+		filtered := &AWSAccount{Name: awsAccount.Name}
+		for _, role := range awsAccount.Roles {
+			if re.MatchString(role.RoleARN) {
+				filtered.Roles = append(filtered.Roles, role)
+			}
+		}
+		if len(filtered.Roles) > 0 {
+			filteredAccounts = append(filteredAccounts, filtered)
+		}
+	}
+
+	return matched, filteredAccounts, nil
+}
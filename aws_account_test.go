@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 )
 
 func TestExtractAWSAccounts(t *testing.T) {
@@ -76,3 +77,125 @@ func TestLocateRole(t *testing.T) {
 
 	assert.Equal(t, "arn:aws:iam::000000000001:role/Development", role.RoleARN)
 }
+
+func TestPrepareAccount(t *testing.T) {
+	aliases := map[string]string{"admin": "arn:aws-us-gov:iam::123456789012:role/admin"}
+
+	account := &cfg.IDPAccount{Partition: "govcloud", RoleARN: "admin"}
+	err := PrepareAccount(account, aliases)
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws-us-gov:iam::123456789012:role/admin", account.RoleARN)
+	assert.Equal(t, "us-gov-west-1", account.Region)
+
+	err = PrepareAccount(&cfg.IDPAccount{RoleARN: "deploy"}, aliases)
+	assert.EqualError(t, err, "Unknown role alias deploy, available aliases: admin.")
+
+	err = PrepareAccount(&cfg.IDPAccount{}, nil)
+	assert.Nil(t, err)
+}
+
+func TestResolveRoleAlias(t *testing.T) {
+	aliases := map[string]string{
+		"admin":    "arn:aws:iam::123456789012:role/admin",
+		"readonly": "arn:aws:iam::123456789012:role/readonly",
+	}
+
+	roleARN, err := ResolveRoleAlias("admin", aliases)
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/admin", roleARN)
+
+	roleARN, err = ResolveRoleAlias("arn:aws:iam::123456789012:role/other", aliases)
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/other", roleARN)
+
+	_, err = ResolveRoleAlias("deploy", aliases)
+	assert.EqualError(t, err, "Unknown role alias deploy, available aliases: admin, readonly.")
+
+	_, err = ResolveRoleAlias("deploy", map[string]string{})
+	assert.EqualError(t, err, "Unknown role alias deploy, no role aliases are configured.")
+}
+
+func TestConfiguredRole(t *testing.T) {
+	awsRoles := []*AWSRole{
+		{RoleARN: "arn:aws:iam::123456789012:role/ReadOnly"},
+		{RoleARN: "arn:aws:iam::123456789012:role/Admin"},
+	}
+
+	role, err := ConfiguredRole(awsRoles, &cfg.IDPAccount{RoleARN: "arn:aws:iam::123456789012:role/Admin"})
+	assert.Nil(t, err)
+	assert.Equal(t, awsRoles[1], role)
+
+	// role_arn beats role_matcher
+	role, err = ConfiguredRole(awsRoles, &cfg.IDPAccount{RoleARN: "arn:aws:iam::123456789012:role/Admin", RoleMatcher: "ReadOnly"})
+	assert.Nil(t, err)
+	assert.Equal(t, awsRoles[1], role)
+
+	role, err = ConfiguredRole(awsRoles, &cfg.IDPAccount{RoleMatcher: "ReadOnly"})
+	assert.Nil(t, err)
+	assert.Equal(t, awsRoles[0], role)
+
+	role, err = ConfiguredRole(awsRoles, &cfg.IDPAccount{})
+	assert.Nil(t, err)
+	assert.Nil(t, role)
+}
+
+func TestMatchRole(t *testing.T) {
+	awsRoles := []*AWSRole{
+		{RoleARN: "arn:aws:iam::123456789012:role/AdminFull"},
+		{RoleARN: "arn:aws:iam::123456789012:role/ReadOnly"},
+		{RoleARN: "arn:aws:iam::210987654321:role/AdminSandbox"},
+	}
+
+	role, err := MatchRole(awsRoles, `arn:aws:iam::123456789012:role/Admin.*`)
+	assert.Nil(t, err)
+	assert.Equal(t, awsRoles[0], role)
+
+	// an account ID picks the role of the account when it has only one
+	role, err = MatchRole(awsRoles, "210987654321")
+	assert.Nil(t, err)
+	assert.Equal(t, awsRoles[2], role)
+
+	_, err = MatchRole(awsRoles, "role/Admin")
+	assert.EqualError(t, err, "role_matcher \"role/Admin\" matches 2 roles, it has to match exactly one of:\n  arn:aws:iam::123456789012:role/AdminFull\n  arn:aws:iam::210987654321:role/AdminSandbox")
+
+	_, err = MatchRole(awsRoles, "Developer")
+	assert.EqualError(t, err, "role_matcher \"Developer\" matches none of the roles, it has to match exactly one of:\n  arn:aws:iam::123456789012:role/AdminFull\n  arn:aws:iam::123456789012:role/ReadOnly\n  arn:aws:iam::210987654321:role/AdminSandbox")
+
+	_, err = MatchRole(awsRoles, "role/(Admin")
+	assert.ErrorContains(t, err, `role_matcher "role/(Admin" isn't a valid regular expression`)
+}
+
+func TestFilterRoles(t *testing.T) {
+	awsRoles := []*AWSRole{
+		{RoleARN: "arn:aws:iam::123456789012:role/ReadOnly"},
+		{RoleARN: "arn:aws:iam::210987654321:role/Developer"},
+		{RoleARN: "arn:aws:iam::123456789012:role/Admin"},
+		{RoleARN: "arn:aws:iam::210987654321:role/Admin"},
+	}
+	awsAccounts := []*AWSAccount{
+		{Name: "Account: production (123456789012)", Roles: []*AWSRole{awsRoles[0], awsRoles[2]}},
+		{Name: "Account: sandbox (210987654321)", Roles: []*AWSRole{awsRoles[1], awsRoles[3]}},
+	}
+
+	filtered, filteredAccounts, err := FilterRoles(awsRoles, awsAccounts, "role/Admin$")
+	assert.Nil(t, err)
+	assert.Equal(t, []*AWSRole{awsRoles[2], awsRoles[3]}, filtered)
+	assert.Len(t, filteredAccounts, 2)
+	assert.Equal(t, []*AWSRole{awsRoles[2]}, filteredAccounts[0].Roles)
+	assert.Equal(t, []*AWSRole{awsRoles[3]}, filteredAccounts[1].Roles)
+	// the accounts of the assertion are left as they are
+	assert.Len(t, awsAccounts[0].Roles, 2)
+
+	// accounts without a matching role are left out of the menu
+	filtered, filteredAccounts, err = FilterRoles(awsRoles, awsAccounts, "210987654321")
+	assert.Nil(t, err)
+	assert.Len(t, filtered, 2)
+	assert.Len(t, filteredAccounts, 1)
+	assert.Equal(t, "Account: sandbox (210987654321)", filteredAccounts[0].Name)
+
+	_, _, err = FilterRoles(awsRoles, awsAccounts, "Billing")
+	assert.EqualError(t, err, "role_filter \"Billing\" matches none of the roles:\n  arn:aws:iam::123456789012:role/Admin\n  arn:aws:iam::123456789012:role/ReadOnly\n  arn:aws:iam::210987654321:role/Admin\n  arn:aws:iam::210987654321:role/Developer")
+
+	_, _, err = FilterRoles(awsRoles, awsAccounts, "role/(Admin")
+	assert.ErrorContains(t, err, `role_filter "role/(Admin" isn't a valid regular expression`)
+}
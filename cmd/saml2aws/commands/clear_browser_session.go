@@ -0,0 +1,50 @@
+package commands
+
+import (
+	"log"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/provider/browser"
+)
+
+// ClearBrowserSession wipes the browser profile of an IDP account, so the next Browser login signs in afresh
+func ClearBrowserSession(commonFlags *flags.CommonFlags) error {
+
+	idpAccountName := commonFlags.IdpAccount
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	accounts, err := cfgm.ListIDPAccounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to load idp accounts")
+	}
+
+	account, ok := accounts[idpAccountName]
+	if !ok {
+		return cfg.ErrIdpAccountNotFound
+	}
+
+	if account.BrowserProfileDir == "" {
+		return errors.Errorf("browser_profile_dir isn't set for IDP account %s, its browser sessions aren't kept", idpAccountName)
+	}
+
+	dir, err := homedir.Expand(account.BrowserProfileDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to expand browser_profile_dir")
+	}
+
+	err = browser.ClearProfile(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to clear browser session")
+	}
+
+	log.Printf("Cleared the browser session of IDP account %s in %s", idpAccountName, dir)
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+func TestClearBrowserSession(t *testing.T) {
+	dir := t.TempDir()
+	profileDir := filepath.Join(dir, "profile")
+	configFile := filepath.Join(dir, "saml2aws")
+	config := "[browser]\nurl = https://id.example.com\nprovider = Browser\nbrowser_profile_dir = " + profileDir + "\n\n[ephemeral]\nurl = https://id.example.com\nprovider = Browser\n"
+	assert.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	assert.Nil(t, os.MkdirAll(filepath.Join(profileDir, "Default"), 0700))
+
+	err := ClearBrowserSession(&flags.CommonFlags{ConfigFile: configFile, IdpAccount: "browser"})
+	assert.Nil(t, err)
+	_, err = os.Stat(profileDir)
+	assert.True(t, os.IsNotExist(err))
+
+	err = ClearBrowserSession(&flags.CommonFlags{ConfigFile: configFile, IdpAccount: "ephemeral"})
+	assert.EqualError(t, err, "browser_profile_dir isn't set for IDP account ephemeral, its browser sessions aren't kept")
+}
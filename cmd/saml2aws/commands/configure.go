@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/versent/saml2aws/v2"
@@ -29,6 +30,9 @@ func Configure(configFlags *flags.CommonFlags) error {
 		return errors.Wrap(err, "failed to load configuration")
 	}
 
+	// keep environment variable references intact so they are saved back as written
+	cfgm.DisableInterpolation = true
+
 	account, err := cfgm.LoadIDPAccount(idpAccountName)
 	if err != nil {
 		return errors.Wrap(err, "failed to load idp account")
@@ -36,15 +40,39 @@ func Configure(configFlags *flags.CommonFlags) error {
 
 	// update username and hostname if supplied
 	flags.ApplyFlagOverrides(configFlags, account)
+	account.ApplyPartition()
+
+	prompter.SetPromptTimeout(time.Duration(account.PromptTimeout) * time.Second)
+
+	if account.DisableKeyring {
+		credentials.Disable()
+	}
+
+	if configFlags.NonInteractive {
+		err = saml2aws.CheckConfigurationDetails(account)
+		if err != nil {
+			return errors.Wrap(err, "failed to configure")
+		}
+
+		// storeCredentials gives up on OneLogin without them, better before anything is saved
+		if account.Provider == onelogin.ProviderName && credentials.SupportsStorage() && !configFlags.DisableKeychain && !account.DisableKeyring &&
+			(configFlags.ClientID == "" || configFlags.ClientSecret == "") {
+			return errors.New("failed to configure: --client-id, --client-secret required with --non-interactive for OneLogin")
+		}
 
-	// do we need to prompt for values now?
-	if !configFlags.SkipPrompt {
+		err = account.Validate()
+		if err != nil {
+			return errors.Wrap(err, "failed to validate account")
+		}
+	} else if !configFlags.SkipPrompt {
+		// do we need to prompt for values now?
 		err = saml2aws.PromptForConfigurationDetails(account)
 		if err != nil {
 			return errors.Wrap(err, "failed to input configuration")
 		}
 
-		if credentials.SupportsStorage() && idpAccountPassword == "" {
+		// IdentityCenter has no password, the sign in happens in the browser
+		if credentials.SupportsStorage() && idpAccountPassword == "" && account.Provider != "IdentityCenter" {
 			password := prompter.Password("Password")
 			if password != "" {
 				if confirmPassword := prompter.Password("Confirm"); confirmPassword == password {
@@ -60,7 +88,10 @@ func Configure(configFlags *flags.CommonFlags) error {
 	}
 
 	if credentials.SupportsStorage() {
-		if err := storeCredentials(configFlags, account, idpAccountPassword); err != nil {
+		// credentials are looked up at login using the expanded values
+		expanded := account.Clone()
+		expanded.ExpandEnv()
+		if err := storeCredentials(configFlags, expanded, idpAccountPassword); err != nil {
 			return err
 		}
 	}
@@ -79,7 +110,7 @@ func Configure(configFlags *flags.CommonFlags) error {
 }
 
 func storeCredentials(configFlags *flags.CommonFlags, account *cfg.IDPAccount, idpAccountPassword string) error {
-	if configFlags.DisableKeychain {
+	if configFlags.DisableKeychain || account.DisableKeyring {
 		return nil
 	}
 	if idpAccountPassword != "" {
@@ -100,3 +131,63 @@ func storeCredentials(configFlags *flags.CommonFlags, account *cfg.IDPAccount, i
 	}
 	return nil
 }
+
+// MigrateConfig copy the legacy ~/.saml2aws configuration file to the XDG config directory
+func MigrateConfig() error {
+
+	configPath, err := cfg.MigrateLegacyConfig()
+	if err != nil {
+		return errors.Wrap(err, "failed to migrate configuration")
+	}
+
+	log.Printf("Configuration migrated to: %s", configPath)
+
+	return nil
+}
+
+// EncryptConfig encrypt the configuration file with a passphrase taken from SAML2AWS_CONFIG_PASSPHRASE or prompted for
+func EncryptConfig(commonFlags *flags.CommonFlags) error {
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	passphrase := os.Getenv(cfg.ConfigPassphraseEnvironmentVariableName)
+	if passphrase == "" {
+		passphrase = prompter.Password("New configuration passphrase")
+		if passphrase != prompter.Password("Confirm configuration passphrase") {
+			return errors.New("passphrases do not match")
+		}
+	}
+	if passphrase == "" {
+		return errors.New("passphrase required to encrypt the configuration")
+	}
+
+	err = cfgm.EncryptConfigFile(passphrase)
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt configuration")
+	}
+
+	log.Println("Configuration encrypted, the passphrase is needed whenever it is read.")
+
+	return nil
+}
+
+// DecryptConfig replace the encrypted configuration file with its plaintext
+func DecryptConfig(commonFlags *flags.CommonFlags) error {
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	err = cfgm.DecryptConfigFile()
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt configuration")
+	}
+
+	log.Println("Configuration decrypted.")
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package commands
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/totp"
+)
+
+// ConfigureMFA saves the TOTP seed of an IDP account in the keyring, logins with mfa TOTP then generate the
+// code themselves instead of asking for it
+func ConfigureMFA(commonFlags *flags.CommonFlags, totpSecret string) error {
+
+	idpAccountName := commonFlags.IdpAccount
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	accounts, err := cfgm.ListIDPAccounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to load idp accounts")
+	}
+
+	account, ok := accounts[idpAccountName]
+	if !ok {
+		return cfg.ErrIdpAccountNotFound
+	}
+
+	if commonFlags.DisableKeychain || account.DisableKeyring || !credentials.SupportsStorage() {
+		return errors.New("no keyring to store the TOTP secret in, it can't be saved with the keyring disabled")
+	}
+
+	if totpSecret == "" {
+		totpSecret = prompter.Password("TOTP secret")
+	}
+	totpSecret = totp.NormalizeSecret(totpSecret)
+
+	// a seed that can't generate a code would only fail at the next login
+	code, err := totp.Code(totpSecret, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = credentials.SaveTOTPSecret(idpAccountName, totpSecret)
+	if err != nil {
+		return errors.Wrap(err, "error storing TOTP secret in keychain")
+	}
+
+	log.Printf("Saved the TOTP secret of IDP account %s, the current code is %s", idpAccountName, code)
+	if !strings.EqualFold(account.MFA, "TOTP") {
+		log.Println("The code is only generated at login when mfa is TOTP, set mfa = TOTP on the IDP account to use it.")
+	}
+
+	return nil
+}
+
+// totpFromKeyring the current code of the TOTP seed saved with configure-mfa, empty when there is no seed
+func totpFromKeyring(idpAccountName string) (string, error) {
+	secret, err := credentials.LookupTOTPSecret(idpAccountName)
+	if credentials.IsErrCredentialsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Error loading saved TOTP secret.")
+	}
+
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		return "", errors.Wrap(err, "Error generating TOTP code from the saved secret.")
+	}
+
+	return code, nil
+}
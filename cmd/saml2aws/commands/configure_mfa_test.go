@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+const configureMFAConfig = `[work]
+url      = https://id.example.com
+provider = Okta
+mfa      = TOTP
+`
+
+func TestConfigureMFASavesTOTPSecret(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte(configureMFAConfig), 0600))
+
+	helperMock := &mocks.Helper{}
+	helperMock.Mock.On("SupportsCredentialStorage").Return(true)
+	helperMock.Mock.On("Add", &credentials.Credentials{ServerURL: "saml2aws://totp/work", Username: "work", Secret: "JBSWY3DPEHPK3PXP"}).Return(nil).Once()
+	oldCurrentHelper := credentials.CurrentHelper
+	credentials.CurrentHelper = helperMock
+	defer func() { credentials.CurrentHelper = oldCurrentHelper }()
+
+	err := ConfigureMFA(&flags.CommonFlags{ConfigFile: configFile, IdpAccount: "work"}, "jbsw y3dp ehpk 3pxp==")
+	assert.Nil(t, err)
+	helperMock.AssertExpectations(t)
+}
+
+func TestConfigureMFARejectsInvalidSecret(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte(configureMFAConfig), 0600))
+
+	helperMock := &mocks.Helper{}
+	helperMock.Mock.On("SupportsCredentialStorage").Return(true)
+	oldCurrentHelper := credentials.CurrentHelper
+	credentials.CurrentHelper = helperMock
+	defer func() { credentials.CurrentHelper = oldCurrentHelper }()
+
+	err := ConfigureMFA(&flags.CommonFlags{ConfigFile: configFile, IdpAccount: "work"}, "not base32!")
+	assert.ErrorContains(t, err, "TOTP secret is not valid base32")
+	helperMock.AssertNotCalled(t, "Add")
+}
+
+func TestConfigureMFAKeyringDisabled(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte(configureMFAConfig), 0600))
+
+	err := ConfigureMFA(&flags.CommonFlags{ConfigFile: configFile, IdpAccount: "work", DisableKeychain: true}, "JBSWY3DPEHPK3PXP")
+	assert.EqualError(t, err, "no keyring to store the TOTP secret in, it can't be saved with the keyring disabled")
+
+	err = ConfigureMFA(&flags.CommonFlags{ConfigFile: configFile, IdpAccount: "missing"}, "JBSWY3DPEHPK3PXP")
+	assert.ErrorContains(t, err, "IDP account not found")
+}
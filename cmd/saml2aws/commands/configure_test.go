@@ -232,3 +232,50 @@ func TestStoreCredentialsOnProvidedOneLoginHandlesErrorOnSavesCredentials(t *tes
 	assert.ErrorContains(t, result, "failed again")
 	assert.ErrorContains(t, result, "error storing client_id and client_secret in keychain")
 }
+
+func TestConfigureNonInteractive(t *testing.T) {
+	oldCurrentHelper := credentials.CurrentHelper
+	defer func() { credentials.CurrentHelper = oldCurrentHelper }()
+
+	configFile := path.Join(t.TempDir(), "saml2aws")
+
+	commonFlags := &flags.CommonFlags{ConfigFile: configFile, IdpAccount: "work", IdpProvider: "OneLogin", URL: "https://id.example.com", DisableKeychain: true, NonInteractive: true}
+	err := Configure(commonFlags)
+	assert.EqualError(t, err, "failed to configure: --app-id, --subdomain required with --non-interactive")
+
+	commonFlags = &flags.CommonFlags{ConfigFile: configFile, IdpAccount: "work", IdpProvider: "KeyCloak", URL: "id.example.com", DisableKeychain: true, NonInteractive: true}
+	err = Configure(commonFlags)
+	assert.EqualError(t, err, `failed to validate account: URL "id.example.com" in idp account must be an absolute http or https URL for KeyCloak`)
+
+	cfgm, err := cfg.NewConfigManager(configFile)
+	assert.Nil(t, err)
+	names, err := cfgm.ListIDPAccountNames(false)
+	assert.Nil(t, err)
+	assert.Empty(t, names)
+
+	commonFlags = &flags.CommonFlags{ConfigFile: configFile, IdpAccount: "work", IdpProvider: "KeyCloak", URL: "https://id.example.com", Username: "wolfeidau", DisableKeychain: true, NonInteractive: true}
+	err = Configure(commonFlags)
+	assert.Nil(t, err)
+
+	account, err := cfgm.LoadIDPAccount("work")
+	assert.Nil(t, err)
+	assert.Equal(t, "KeyCloak", account.Provider)
+	assert.Equal(t, "Auto", account.MFA)
+	assert.Equal(t, "wolfeidau", account.Username)
+
+	// IdentityCenter needs neither url nor username
+	commonFlags = &flags.CommonFlags{ConfigFile: configFile, IdpAccount: "sso", IdpProvider: "IdentityCenter", DisableKeychain: true, NonInteractive: true}
+	err = Configure(commonFlags)
+	assert.EqualError(t, err, "failed to configure: --sso-start-url, --sso-region required with --non-interactive")
+
+	commonFlags = &flags.CommonFlags{ConfigFile: configFile, IdpAccount: "sso", IdpProvider: "IdentityCenter", SSOStartURL: "https://example.awsapps.com/start", SSORegion: "eu-west-1", DisableKeychain: true, NonInteractive: true}
+	err = Configure(commonFlags)
+	assert.Nil(t, err)
+
+	account, err = cfgm.LoadIDPAccount("sso")
+	assert.Nil(t, err)
+	assert.Equal(t, "IdentityCenter", account.Provider)
+	assert.Equal(t, "https://example.awsapps.com/start", account.SSOStartURL)
+	assert.Equal(t, "eu-west-1", account.SSORegion)
+	assert.Nil(t, account.Validate())
+}
@@ -16,20 +16,22 @@ import (
 	"github.com/versent/saml2aws/v2/pkg/flags"
 )
 
-const (
-	federationURL = "https://signin.aws.amazon.com/federation"
-	issuer        = "saml2aws"
-)
+const issuer = "saml2aws"
+
+// federationURL the AWS federation endpoint of the partition the credentials belong to
+func federationURL(creds *awsconfig.AWSCredentials) string {
+	return fmt.Sprintf("https://%s/federation", cfg.PartitionForARN(creds.PrincipalARN).SigninHost)
+}
 
 // Console open the aws console from the CLI
 func Console(consoleFlags *flags.ConsoleFlags) error {
 
-	account, err := buildIdpAccount(consoleFlags.LoginExecFlags)
+	account, _, err := buildIdpAccount(consoleFlags.LoginExecFlags)
 	if err != nil {
 		return errors.Wrap(err, "error building login details")
 	}
 
-	sharedCreds := awsconfig.NewSharedCredentials(account.Profile, account.CredentialsFile)
+	sharedCreds := awsconfig.NewSharedCredentials(account.CredentialsProfile(account.RoleARN), account.CredentialsFile)
 
 	// this checks if the credentials file has been created yet
 	// can only really be triggered if saml2aws exec is run on a new
@@ -61,7 +63,7 @@ func Console(consoleFlags *flags.ConsoleFlags) error {
 		}
 	}
 
-	log.Printf("Presenting credentials for %s to %s", account.Profile, federationURL)
+	log.Printf("Presenting credentials for %s to %s", account.CredentialsProfile(account.RoleARN), federationURL(awsCreds))
 	return federatedLogin(awsCreds, consoleFlags)
 }
 
@@ -88,7 +90,7 @@ func loadOrLogin(account *cfg.IDPAccount, sharedCreds *awsconfig.CredentialsProv
 		return loginRefreshCredentials(sharedCreds, execFlags.LoginExecFlags)
 	}
 
-	ok, err := checkToken(account.Profile)
+	ok, err := checkToken(account, awsCreds)
 	if err != nil {
 		return nil, errors.Wrap(err, "error validating token")
 	}
@@ -120,7 +122,7 @@ func federatedLogin(creds *awsconfig.AWSCredentials, consoleFlags *flags.Console
 		return err
 	}
 
-	req, err := http.NewRequest("GET", federationURL, nil)
+	req, err := http.NewRequest("GET", federationURL(creds), nil)
 	if err != nil {
 		return err
 	}
@@ -155,11 +157,11 @@ func federatedLogin(creds *awsconfig.AWSCredentials, consoleFlags *flags.Console
 		return err
 	}
 
-	destination := "https://console.aws.amazon.com/"
+	destination := cfg.PartitionForARN(creds.PrincipalARN).ConsoleURL
 
 	loginURL := fmt.Sprintf(
 		"%s?Action=login&Issuer=%s&Destination=%s&SigninToken=%s",
-		federationURL,
+		federationURL(creds),
 		issuer,
 		url.QueryEscape(destination),
 		url.QueryEscape(signinToken),
@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/samlcache"
+)
+
+// credentialProcessRefreshWindow cached credentials expiring sooner than this are refreshed, the AWS SDKs ask
+// the credential process again a few minutes before the credentials it printed expire
+const credentialProcessRefreshWindow = 5 * time.Minute
+
+// credentialProcessCacheName the file in the saml2aws cache directory holding the credentials printed by the
+// credential process, one section per profile
+const credentialProcessCacheName = "credential_process"
+
+// loginCredentials the credentials file the login saves the profile to. The credential process leaves the shared
+// credentials file alone, caching in its own file instead unless credentials_file names one.
+func loginCredentials(account *cfg.IDPAccount, profile string, loginFlags *flags.LoginExecFlags) (*awsconfig.CredentialsProvider, error) {
+	if !loginFlags.CredentialProcess || account.CredentialsFile != "" {
+		return awsconfig.NewSharedCredentials(profile, account.CredentialsFile), nil
+	}
+
+	filename, err := credentialProcessCacheFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return awsconfig.NewSharedCredentials(profile, filename), nil
+}
+
+// credentialProcessCacheFile the file caching the credentials printed by the credential process, next to the
+// SAML cache
+func credentialProcessCacheFile() (string, error) {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("USERPROFILE"), ".aws", samlcache.SAMLCacheDir, credentialProcessCacheName), nil
+	}
+
+	filename, err := homedir.Expand(filepath.Join("~", ".aws", samlcache.SAMLCacheDir, credentialProcessCacheName))
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to locate the credential process cache.")
+	}
+
+	return filename, nil
+}
+
+// isCredentialProcessCache reports whether the credentials are saved to the credential process cache rather than
+// a credentials file the AWS tools read
+func isCredentialProcessCache(sharedCreds *awsconfig.CredentialsProvider) bool {
+	filename, err := credentialProcessCacheFile()
+	return err == nil && sharedCreds.Filename == filename
+}
@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+func TestLoginCredentialsCredentialProcessCache(t *testing.T) {
+	account := &cfg.IDPAccount{Name: "corp"}
+	loginFlags := &flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{}, CredentialProcess: true}
+
+	sharedCreds, err := loginCredentials(account, "saml", loginFlags)
+	require.NoError(t, err)
+
+	cacheFile, err := credentialProcessCacheFile()
+	require.NoError(t, err)
+	assert.Equal(t, cacheFile, sharedCreds.Filename)
+	assert.Equal(t, "saml", sharedCreds.Profile)
+	assert.True(t, isCredentialProcessCache(sharedCreds))
+}
+
+func TestLoginCredentialsCredentialProcessCredentialsFile(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	account := &cfg.IDPAccount{Name: "corp", CredentialsFile: credentialsFile}
+	loginFlags := &flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{}, CredentialProcess: true}
+
+	sharedCreds, err := loginCredentials(account, "saml", loginFlags)
+	require.NoError(t, err)
+	assert.Equal(t, credentialsFile, sharedCreds.Filename)
+	assert.False(t, isCredentialProcessCache(sharedCreds))
+}
+
+func TestLoginCredentialsLogin(t *testing.T) {
+	account := &cfg.IDPAccount{Name: "corp"}
+	loginFlags := &flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{}}
+
+	sharedCreds, err := loginCredentials(account, "saml", loginFlags)
+	require.NoError(t, err)
+	assert.Empty(t, sharedCreds.Filename)
+	assert.False(t, isCredentialProcessCache(sharedCreds))
+}
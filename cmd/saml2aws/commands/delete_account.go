@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"log"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider/okta"
+	"github.com/versent/saml2aws/v2/pkg/samlcache"
+)
+
+// DeleteAccount removes an IDP account from the configuration and offers to purge its
+// stored credentials, TOTP seed, Okta device state and cached SAML assertion, forgetting its last role
+func DeleteAccount(commonFlags *flags.CommonFlags, force bool) error {
+
+	idpAccountName := commonFlags.IdpAccount
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	accounts, err := cfgm.ListIDPAccounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to load idp accounts")
+	}
+
+	account, ok := accounts[idpAccountName]
+	if !ok {
+		return cfg.ErrIdpAccountNotFound
+	}
+
+	ok, err = confirm("Delete IDP account "+idpAccountName+"?", force)
+	if err != nil {
+		return errors.Wrap(err, "failed to confirm delete")
+	}
+	if !ok {
+		log.Println("Delete cancelled")
+		return nil
+	}
+
+	err = cfgm.DeleteIDPAccount(idpAccountName)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete idp account")
+	}
+
+	log.Printf("Deleted IDP account: %s", idpAccountName)
+
+	err = cfgm.DeleteLastRole(idpAccountName)
+	if err != nil {
+		return errors.Wrap(err, "failed to forget the last role")
+	}
+
+	if !commonFlags.DisableKeychain && !account.DisableKeyring && account.URL != "" {
+		// credentials are keyed by URL so leave them alone if another account still needs them
+		if shared := accountsSharingURL(accounts, idpAccountName, account.URL); len(shared) > 0 {
+			log.Printf("Keeping stored credentials for %s, still used by: %v", account.URL, shared)
+		} else if ok, err := confirm("Remove stored credentials for "+account.URL+"?", force); err != nil {
+			return errors.Wrap(err, "failed to confirm credentials removal")
+		} else if ok {
+			if err := credentials.DeleteCredentials(account.URL, account.Provider); err != nil {
+				return errors.Wrap(err, "error removing password from keychain")
+			}
+			log.Printf("Removed stored credentials for %s", account.URL)
+		}
+	}
+
+	// the TOTP seed is keyed by the account name, it is of no use to any other account
+	if !commonFlags.DisableKeychain && !account.DisableKeyring {
+		if _, err := credentials.LookupTOTPSecret(idpAccountName); err == nil {
+			if ok, err := confirm("Remove stored TOTP seed?", force); err != nil {
+				return errors.Wrap(err, "failed to confirm TOTP seed removal")
+			} else if ok {
+				if err := credentials.DeleteTOTPSecret(idpAccountName); err != nil {
+					return errors.Wrap(err, "error removing TOTP seed from keychain")
+				}
+				log.Println("Removed stored TOTP seed")
+			}
+		}
+	}
+
+	// the Okta device token and session are kept per account name whichever provider it uses now
+	if statePath, err := okta.DeviceStatePath(idpAccountName); err == nil {
+		if _, err := os.Stat(statePath); err == nil {
+			if ok, err := confirm("Remove saved Okta device token and session?", force); err != nil {
+				return errors.Wrap(err, "failed to confirm Okta device state removal")
+			} else if ok {
+				if err := os.Remove(statePath); err != nil {
+					return errors.Wrap(err, "error removing Okta device state")
+				}
+				log.Println("Removed saved Okta device token and session")
+			}
+		}
+	}
+
+	cacheProvider := &samlcache.SAMLCacheProvider{
+		Account:  idpAccountName,
+		Filename: account.SAMLCacheFile,
+		Encrypt:  account.SAMLCacheEncrypt,
+	}
+	if cacheProvider.Exists() {
+		if ok, err := confirm("Remove cached SAML assertion?", force); err != nil {
+			return errors.Wrap(err, "failed to confirm cache removal")
+		} else if ok {
+			if err := cacheProvider.Remove(); err != nil {
+				return errors.Wrap(err, "error removing SAML cache")
+			}
+			log.Println("Removed cached SAML assertion")
+		}
+	}
+
+	return nil
+}
+
+// confirm asks a yes/no question defaulting to no, force answers yes without asking
+func confirm(question string, force bool) (bool, error) {
+	if force {
+		return true, nil
+	}
+
+	answer, err := prompter.ChooseWithDefault(question, "No", []string{"Yes", "No"})
+	if err != nil {
+		return false, err
+	}
+
+	return answer == "Yes", nil
+}
+
+func accountsSharingURL(accounts map[string]*cfg.IDPAccount, idpAccountName, url string) []string {
+	var names []string
+	for name, account := range accounts {
+		if name != idpAccountName && account.URL == url {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+const deleteAccountConfig = `[keep]
+url      = https://id.example.com
+provider = KeyCloak
+
+[remove]
+url      = https://other.example.com
+provider = KeyCloak
+
+[shared]
+url      = https://id.example.com
+provider = KeyCloak
+`
+
+func TestDeleteAccountPurgesCredentials(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "saml2aws")
+	cacheFile := filepath.Join(dir, "cache_remove")
+	assert.Nil(t, os.WriteFile(configFile, []byte(deleteAccountConfig+"\n[remove]\nsaml_cache_file = "+cacheFile+"\n"), 0600))
+	assert.Nil(t, os.WriteFile(cacheFile, []byte("assertion"), 0600))
+
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+
+	cfgm, err := cfg.NewConfigManager(configFile)
+	assert.Nil(t, err)
+	assert.Nil(t, cfgm.SaveLastRole("remove", "arn:aws:iam::123456789012:role/Admin"))
+	assert.Nil(t, cfgm.SaveLastRole("keep", "arn:aws:iam::123456789012:role/ReadOnly"))
+	oktaState := filepath.Join(dir, "xdg", "saml2aws", "okta", "remove.json")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(oktaState), 0700))
+	assert.Nil(t, os.WriteFile(oktaState, []byte(`{"dt":"dt-123"}`), 0600))
+
+	helperMock := &mocks.Helper{}
+	helperMock.Mock.On("Delete", "https://other.example.com").Return(nil).Once()
+	helperMock.Mock.On("Get", "saml2aws://totp/remove").Return("remove", "JBSWY3DPEHPK3PXP", nil).Once()
+	helperMock.Mock.On("Delete", "saml2aws://totp/remove").Return(nil).Once()
+	oldCurrentHelper := credentials.CurrentHelper
+	credentials.CurrentHelper = helperMock
+	defer func() { credentials.CurrentHelper = oldCurrentHelper }()
+
+	err = DeleteAccount(&flags.CommonFlags{ConfigFile: configFile, IdpAccount: "remove"}, true)
+	assert.Nil(t, err)
+	helperMock.AssertExpectations(t)
+
+	roleARN, err := cfgm.LoadLastRole("remove")
+	assert.Nil(t, err)
+	assert.Empty(t, roleARN)
+	roleARN, err = cfgm.LoadLastRole("keep")
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/ReadOnly", roleARN)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"keep", "shared"}, names)
+
+	_, err = os.Stat(cacheFile)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(oktaState)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDeleteAccountKeepsSharedCredentials(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte(deleteAccountConfig), 0600))
+
+	helperMock := &mocks.Helper{}
+	helperMock.Mock.On("Get", "saml2aws://totp/shared").Return("", "", credentials.ErrCredentialsNotFound).Once()
+	oldCurrentHelper := credentials.CurrentHelper
+	credentials.CurrentHelper = helperMock
+	defer func() { credentials.CurrentHelper = oldCurrentHelper }()
+
+	err := DeleteAccount(&flags.CommonFlags{ConfigFile: configFile, IdpAccount: "shared"}, true)
+	assert.Nil(t, err)
+	helperMock.AssertNotCalled(t, "Delete", "https://id.example.com")
+	helperMock.AssertNotCalled(t, "Delete", "saml2aws://totp/shared")
+}
+
+func TestDeleteAccountMissing(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte(deleteAccountConfig), 0600))
+
+	err := DeleteAccount(&flags.CommonFlags{ConfigFile: configFile, IdpAccount: "nope"}, true)
+	assert.Equal(t, cfg.ErrIdpAccountNotFound, err)
+}
@@ -0,0 +1,120 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+// ErrDoctorWarnings returned when the login page of at least one idp account isn't what its provider expects
+var ErrDoctorWarnings = errors.New("one or more idp accounts have warnings, their logins may fail")
+
+// Doctor fetches the login page of every IDP account and checks it still has what the provider looks for, to
+// spot an IdP upgrade the provider doesn't understand, without logging in
+func Doctor(commonFlags *flags.CommonFlags) error {
+	return doctorAccounts(commonFlags, os.Stdout)
+}
+
+func doctorAccounts(commonFlags *flags.CommonFlags, out io.Writer) error {
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	accounts, err := cfgm.ListIDPAccounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to load idp accounts")
+	}
+
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	warned := false
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tPROVIDER\tRESULT")
+
+	for _, name := range names {
+		account := accounts[name]
+
+		result, ok := checkLoginPage(account)
+		if !ok {
+			warned = true
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, account.Provider, result)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if warned {
+		return ErrDoctorWarnings
+	}
+
+	return nil
+}
+
+// checkLoginPage fetches the account URL and looks for the markers of its provider, ok is false when the result
+// is a warning
+func checkLoginPage(account *cfg.IDPAccount) (string, bool) {
+	if err := account.Validate(); err != nil {
+		return fmt.Sprintf("warn: invalid: %v", err), false
+	}
+
+	client, err := saml2aws.NewSAMLClient(account)
+	if err != nil {
+		return fmt.Sprintf("warn: %v", err), false
+	}
+
+	checker, ok := client.(provider.LoginPageChecker)
+	if !ok {
+		return fmt.Sprintf("skipped: no login page checks for %s", account.Provider), true
+	}
+
+	httpClient, err := accountHTTPClient(account)
+	if err != nil {
+		return fmt.Sprintf("warn: %v", err), false
+	}
+
+	res, err := httpClient.Get(account.URL)
+	if err != nil {
+		return fmt.Sprintf("warn: unreachable: %v", err), false
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return fmt.Sprintf("warn: login page returned HTTP %d", res.StatusCode), false
+	}
+
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		return fmt.Sprintf("warn: unable to parse the login page: %v", err), false
+	}
+
+	missing := provider.MissingMarkers(doc, checker.LoginPageMarkers())
+	if len(missing) > 0 {
+		descriptions := make([]string, len(missing))
+		for i, marker := range missing {
+			descriptions[i] = marker.Description
+		}
+		return fmt.Sprintf("warn: the login page at %s is missing the %s", res.Request.URL, strings.Join(descriptions, ", the ")), false
+	}
+
+	return "pass", true
+}
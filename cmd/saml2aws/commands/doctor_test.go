@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+func TestDoctorAccounts(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/corp", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<form action="/realms/corp/login-actions/authenticate" method="post">
+			<input name="username"><input name="password" type="password">
+		</form>`))
+	})
+	mux.HandleFunc("/idp/profile/SAML2/Unsolicited/SSO", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<div id="app"></div><script src="/login.js"></script>`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte(`[keycloak]
+url      = `+ts.URL+`/realms/corp
+provider = KeyCloak
+mfa      = Auto
+
+[shibboleth]
+url      = `+ts.URL+`/idp/profile/SAML2/Unsolicited/SSO
+provider = Shibboleth
+mfa      = Auto
+
+[okta]
+url      = https://corp.okta.com/home/amazon_aws/0oa1/272
+provider = Okta
+mfa      = Auto
+`), 0600))
+
+	var out bytes.Buffer
+	err := doctorAccounts(&flags.CommonFlags{ConfigFile: configFile}, &out)
+	assert.Equal(t, ErrDoctorWarnings, err)
+	assert.Regexp(t, `keycloak\s+KeyCloak\s+pass`, out.String())
+	assert.Regexp(t, `shibboleth\s+Shibboleth\s+warn: the login page at \S+ is missing the login form with an action, the username field, the password field`, out.String())
+	assert.Regexp(t, `okta\s+Okta\s+skipped: no login page checks for Okta`, out.String())
+}
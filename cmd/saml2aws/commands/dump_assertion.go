@@ -0,0 +1,52 @@
+package commands
+
+import (
+	b64 "encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+// dumpAssertion writes the decoded SAML assertion to --dump-assertion-file, or to stderr for --dump-assertion,
+// so the attributes the IdP sends can be checked. It does nothing unless one of them is set.
+func dumpAssertion(samlAssertion string, loginFlags *flags.LoginExecFlags) error {
+	if !loginFlags.DumpAssertion && loginFlags.DumpAssertionFile == "" {
+		return nil
+	}
+
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return errors.Wrap(err, "Error decoding SAML assertion.")
+	}
+
+	log.Println("WARNING: the SAML assertion is sensitive, until it expires it can be used to log in to AWS as you. Don't share it or commit it.")
+
+	if loginFlags.DumpAssertionFile == "" {
+		return writeAssertion(os.Stderr, data)
+	}
+
+	f, err := os.OpenFile(loginFlags.DumpAssertionFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Error creating SAML assertion dump file.")
+	}
+	defer f.Close()
+
+	err = writeAssertion(f, data)
+	if err != nil {
+		return err
+	}
+	log.Printf("SAML assertion written to %s.", loginFlags.DumpAssertionFile)
+	return nil
+}
+
+func writeAssertion(w io.Writer, data []byte) error {
+	_, err := fmt.Fprintf(w, "%s\n", data)
+	if err != nil {
+		return errors.Wrap(err, "Error writing SAML assertion.")
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package commands
+
+import (
+	b64 "encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+const dumpedAssertion = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"></samlp:Response>`
+
+func TestDumpAssertionFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "assertion.xml")
+	loginFlags := &flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{}, DumpAssertionFile: file}
+
+	err := dumpAssertion(b64.StdEncoding.EncodeToString([]byte(dumpedAssertion)), loginFlags)
+	assert.Nil(t, err)
+
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, dumpedAssertion+"\n", string(data))
+
+	info, err := os.Stat(file)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestDumpAssertionNotRequested(t *testing.T) {
+	loginFlags := &flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{}}
+
+	// not even decoded unless asked for
+	err := dumpAssertion("not base64!", loginFlags)
+	assert.Nil(t, err)
+
+	loginFlags.DumpAssertion = true
+	err = dumpAssertion("not base64!", loginFlags)
+	assert.EqualError(t, err, "Error decoding SAML assertion.: illegal base64 data at input byte 3")
+}
@@ -8,10 +8,13 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2"
 	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/flags"
 	"github.com/versent/saml2aws/v2/pkg/shell"
 )
@@ -23,12 +26,12 @@ func Exec(execFlags *flags.LoginExecFlags, cmdline []string) error {
 		return fmt.Errorf("Command to execute required")
 	}
 
-	account, err := buildIdpAccount(execFlags)
+	account, _, err := buildIdpAccount(execFlags)
 	if err != nil {
 		return errors.Wrap(err, "error building login details")
 	}
 
-	sharedCreds := awsconfig.NewSharedCredentials(account.Profile, account.CredentialsFile)
+	sharedCreds := awsconfig.NewSharedCredentials(account.CredentialsProfile(account.RoleARN), account.CredentialsFile)
 
 	// this checks if the credentials file has been created yet
 	// can only really be triggered if saml2aws exec is run on a new
@@ -51,16 +54,16 @@ func Exec(execFlags *flags.LoginExecFlags, cmdline []string) error {
 		return errors.New("error aws credentials have expired")
 	}
 
-	ok, err := checkToken(account.Profile)
+	ok, err := checkToken(account, awsCreds)
 	if err != nil {
 		return errors.Wrap(err, "error validating token")
 	}
 
 	if !ok {
-		err = Login(execFlags)
-	}
-	if err != nil {
-		return errors.Wrap(err, "error logging in")
+		awsCreds, err = loginRefreshCredentials(sharedCreds, execFlags)
+		if err != nil {
+			return err
+		}
 	}
 
 	if execFlags.ExecProfile != "" {
@@ -116,10 +119,14 @@ func assumeRoleWithProfile(targetProfile string, sessionDuration int) (*awsconfi
 	}, nil
 }
 
-func checkToken(profile string) (bool, error) {
-	sess, err := session.NewSessionWithOptions(session.Options{
-		Profile: profile,
-	})
+// checkToken asks STS who the credentials belong to, reporting false when they have expired. The credentials
+// are those loaded from the credentials file, which the AWS SDK wouldn't find when credentials_file is set.
+func checkToken(account *cfg.IDPAccount, awsCreds *awsconfig.AWSCredentials) (bool, error) {
+	account = account.Clone()
+	account.ApplyRolePartition(awsCreds.PrincipalARN)
+
+	config := saml2aws.STSConfig(account).WithCredentials(credentials.NewStaticCredentials(awsCreds.AWSAccessKey, awsCreds.AWSSecretKey, awsCreds.AWSSessionToken))
+	sess, err := session.NewSession(config)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+// ExportConfig prints the IDP account, or every account when accountName is empty, as a document that
+// ImportConfig can read
+func ExportConfig(commonFlags *flags.CommonFlags, accountName, format string) error {
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	// keep environment variable references so the export works for whoever imports it
+	cfgm.DisableInterpolation = true
+
+	accounts, err := cfgm.ListIDPAccounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to load idp accounts")
+	}
+
+	if accountName != "" {
+		account, ok := accounts[accountName]
+		if !ok {
+			return cfg.ErrIdpAccountNotFound
+		}
+		accounts = map[string]*cfg.IDPAccount{accountName: account}
+	}
+
+	out, err := cfg.MarshalAccounts(accounts, format)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling idp accounts")
+	}
+
+	fmt.Println(strings.TrimRight(string(out), "\n"))
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/provider/identitycenter"
+)
+
+// loginToIdentityCenter signs in to IAM Identity Center, picks one of the user's roles the same way as for
+// a SAML assertion and hands its credentials to save
+func loginToIdentityCenter(account *cfg.IDPAccount, sharedCreds *awsconfig.CredentialsProvider, loginFlags *flags.LoginExecFlags, save credentialsSaver) error {
+	client, err := identitycenter.New(account)
+	if err != nil {
+		return errors.Wrap(err, "Error building IdP client.")
+	}
+
+	log.Printf("Authenticating to IAM Identity Center at %s ...", account.SSOStartURL)
+
+	token, err := client.Token()
+	if err != nil {
+		return errors.Wrap(err, "Error authenticating to IAM Identity Center.")
+	}
+
+	roles, err := client.Roles(token.AccessToken)
+	if err != nil {
+		return errors.Wrap(err, "Error listing IAM Identity Center roles.")
+	}
+
+	awsRoles, awsAccounts := identityCenterAccounts(roles, account.SSORegion)
+	if len(awsRoles) == 0 {
+		return errors.New("No roles available.")
+	}
+
+	if loginFlags.DryRun {
+		log.Println("Dry run, authentication succeeded. No credentials were saved, the roles that could be assumed are:")
+		log.Println("")
+		for _, awsAccount := range awsAccounts {
+			fmt.Println(awsAccount.Name)
+			for _, role := range awsAccount.Roles {
+				fmt.Println(role.RoleARN)
+			}
+			fmt.Println("")
+		}
+		return nil
+	}
+
+	prompt := newRolePrompt(account, loginFlags)
+	role, err := chooseRole(awsRoles, awsAccounts, account, prompt)
+	if err != nil {
+		return errors.Wrap(err, "Failed to assume role. Please check whether you are permitted to assume the given role for the AWS service.")
+	}
+
+	log.Println("Selected role:", role.RoleARN)
+
+	awsCreds, err := client.RoleCredentials(token.AccessToken, roles[indexOfRole(awsRoles, role)])
+	if err != nil {
+		return errors.Wrap(err, "Error getting IAM Identity Center role credentials.")
+	}
+
+	rememberRole(account, role.RoleARN, prompt.lastRoleARN, loginFlags)
+
+	awsCreds, err = loginToRoleChain(account, awsCreds, sharedCreds, loginFlags)
+	if err != nil {
+		return err
+	}
+
+	return save(account, awsCreds, sharedCreds, loginFlags)
+}
+
+// identityCenterAccounts groups the roles by account, named like the accounts of the AWS sign in page, with
+// awsRoles in the same order as roles
+func identityCenterAccounts(roles []identitycenter.Role, region string) ([]*saml2aws.AWSRole, []*saml2aws.AWSAccount) {
+	awsRoles := make([]*saml2aws.AWSRole, len(roles))
+	awsAccounts := []*saml2aws.AWSAccount{}
+	byID := map[string]*saml2aws.AWSAccount{}
+
+	for i, role := range roles {
+		awsRoles[i] = &saml2aws.AWSRole{
+			RoleARN: role.ARN(region),
+			Name:    role.RoleName,
+		}
+
+		awsAccount, ok := byID[role.AccountID]
+		if !ok {
+			awsAccount = &saml2aws.AWSAccount{Name: fmt.Sprintf("Account: %s (%s)", role.AccountName, role.AccountID)}
+			byID[role.AccountID] = awsAccount
+			awsAccounts = append(awsAccounts, awsAccount)
+		}
+		awsAccount.Roles = append(awsAccount.Roles, awsRoles[i])
+	}
+
+	return awsRoles, awsAccounts
+}
+
+func indexOfRole(awsRoles []*saml2aws.AWSRole, role *saml2aws.AWSRole) int {
+	for i, r := range awsRoles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
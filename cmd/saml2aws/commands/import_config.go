@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"log"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+// ImportConfig saves the IDP accounts in a document written by ExportConfig, asking before overwriting
+// an existing account
+func ImportConfig(commonFlags *flags.CommonFlags, filename string, force bool) error {
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to read accounts file")
+	}
+
+	accounts, err := cfg.UnmarshalAccounts(data)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse accounts file")
+	}
+
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// check everything up front so a bad account doesn't leave the import half done
+	for _, name := range names {
+		if err := accounts[name].Validate(); err != nil {
+			return errors.Wrapf(err, "invalid idp account %s", name)
+		}
+	}
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	existing, err := cfgm.ListIDPAccountNames(false)
+	if err != nil {
+		return errors.Wrap(err, "failed to list idp accounts")
+	}
+
+	exists := map[string]bool{}
+	for _, name := range existing {
+		exists[name] = true
+	}
+
+	for _, name := range names {
+		if exists[name] {
+			ok, err := confirm("Overwrite IDP account "+name+"?", force)
+			if err != nil {
+				return errors.Wrap(err, "failed to confirm overwrite")
+			}
+			if !ok {
+				log.Printf("Skipped IDP account: %s", name)
+				continue
+			}
+		}
+
+		err = cfgm.SaveIDPAccount(name, accounts[name])
+		if err != nil {
+			return errors.Wrapf(err, "failed to save idp account %s", name)
+		}
+
+		log.Printf("Imported IDP account: %s", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+const importAccounts = `accounts:
+  keep:
+    url: https://new.example.com
+    provider: KeyCloak
+    mfa: Auto
+  added:
+    url: https://added.example.com
+    provider: KeyCloak
+    mfa: Auto
+    aws_profile: added
+`
+
+func TestImportConfig(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "saml2aws")
+	importFile := filepath.Join(dir, "accounts.yaml")
+	assert.Nil(t, os.WriteFile(configFile, []byte(deleteAccountConfig), 0600))
+	assert.Nil(t, os.WriteFile(importFile, []byte(importAccounts), 0600))
+
+	err := ImportConfig(&flags.CommonFlags{ConfigFile: configFile}, importFile, true)
+	assert.Nil(t, err)
+
+	cfgm, err := cfg.NewConfigManager(configFile)
+	assert.Nil(t, err)
+
+	account, err := cfgm.LoadIDPAccount("keep")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://new.example.com", account.URL)
+
+	account, err = cfgm.LoadIDPAccount("added")
+	assert.Nil(t, err)
+	assert.Equal(t, "added", account.Profile)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"keep", "remove", "shared", "added"}, names)
+}
+
+func TestImportConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "saml2aws")
+	importFile := filepath.Join(dir, "accounts.yaml")
+	assert.Nil(t, os.WriteFile(importFile, []byte(importAccounts+"  broken:\n    provider: KeyCloak\n"), 0600))
+
+	err := ImportConfig(&flags.CommonFlags{ConfigFile: configFile}, importFile, true)
+	assert.Error(t, err)
+
+	_, err = os.Stat(configFile)
+	assert.True(t, os.IsNotExist(err), "nothing is written when an account is invalid")
+}
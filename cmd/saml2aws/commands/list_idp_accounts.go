@@ -0,0 +1,39 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+// ListIDPAccounts will list the names of the configured IDP accounts, optionally along with their aliases
+func ListIDPAccounts(commonFlags *flags.CommonFlags, format string, includeAliases bool) error {
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	names, err := cfgm.ListIDPAccountNames(includeAliases)
+	if err != nil {
+		return errors.Wrap(err, "failed to list idp accounts")
+	}
+
+	if format == "json" {
+		out, err := json.Marshal(names)
+		if err != nil {
+			return errors.Wrap(err, "error marshalling idp account names")
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	for _, name := range names {
+		fmt.Println(name)
+	}
+
+	return nil
+}
@@ -2,9 +2,13 @@ package commands
 
 import (
 	b64 "encoding/base64"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -14,12 +18,19 @@ import (
 	"github.com/versent/saml2aws/v2/pkg/samlcache"
 )
 
-// ListRoles will list available role ARNs
-func ListRoles(loginFlags *flags.LoginExecFlags) error {
+// roleListing a role of the SAML assertion as list-roles prints it in the json and csv formats
+type roleListing struct {
+	RoleARN      string `json:"role_arn"`
+	PrincipalARN string `json:"principal_arn"`
+	AccountID    string `json:"account_id"`
+}
+
+// ListRoles will list available role ARNs, in text grouped by account or as json or csv for scripts
+func ListRoles(loginFlags *flags.LoginExecFlags, format string) error {
 
 	logger := logrus.WithField("command", "list")
 
-	account, err := buildIdpAccount(loginFlags)
+	account, _, err := buildIdpAccount(loginFlags)
 	if err != nil {
 		return errors.Wrap(err, "error building login details")
 	}
@@ -28,6 +39,7 @@ func ListRoles(loginFlags *flags.LoginExecFlags) error {
 	cacheProvider := &samlcache.SAMLCacheProvider{
 		Account:  account.Name,
 		Filename: account.SAMLCacheFile,
+		Encrypt:  account.SAMLCacheEncrypt,
 	}
 
 	loginDetails, err := resolveLoginDetails(account, loginFlags)
@@ -82,7 +94,7 @@ func ListRoles(loginFlags *flags.LoginExecFlags) error {
 		os.Exit(1)
 	}
 
-	if !loginFlags.CommonFlags.DisableKeychain {
+	if !account.DisableKeyring {
 		err = credentials.SaveCredentials(loginDetails.URL, loginDetails.Username, loginDetails.Password)
 		if err != nil {
 			return errors.Wrap(err, "error storing password in keychain")
@@ -94,7 +106,7 @@ func ListRoles(loginFlags *flags.LoginExecFlags) error {
 		return errors.Wrap(err, "error decoding saml assertion")
 	}
 
-	roles, err := saml2aws.ExtractAwsRoles(data)
+	roles, err := saml2aws.ExtractAwsRolesFromAttribute(data, account.RoleAttributeName)
 	if err != nil {
 		return errors.Wrap(err, "error parsing aws roles")
 	}
@@ -109,6 +121,10 @@ func ListRoles(loginFlags *flags.LoginExecFlags) error {
 		return errors.Wrap(err, "error parsing aws roles")
 	}
 
+	if format == "json" || format == "csv" {
+		return printRoles(os.Stdout, awsRoles, format)
+	}
+
 	if err := listRoles(awsRoles, samlAssertion, loginFlags); err != nil {
 		return errors.Wrap(err, "Failed to list roles")
 	}
@@ -149,3 +165,36 @@ func listRoles(awsRoles []*saml2aws.AWSRole, samlAssertion string, loginFlags *f
 
 	return nil
 }
+
+// printRoles writes the role and principal pairs in json or csv, without looking up the account names from AWS
+func printRoles(w io.Writer, awsRoles []*saml2aws.AWSRole, format string) error {
+	listings := make([]roleListing, 0, len(awsRoles))
+	for _, role := range awsRoles {
+		listing := roleListing{RoleARN: role.RoleARN, PrincipalARN: role.PrincipalARN}
+		if parts := strings.Split(role.RoleARN, ":"); len(parts) > 4 {
+			listing.AccountID = parts[4]
+		}
+		listings = append(listings, listing)
+	}
+
+	if format == "json" {
+		out, err := json.Marshal(listings)
+		if err != nil {
+			return errors.Wrap(err, "error marshalling roles")
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"role_arn", "principal_arn", "account_id"}); err != nil {
+		return errors.Wrap(err, "error writing roles")
+	}
+	for _, listing := range listings {
+		if err := cw.Write([]string{listing.RoleARN, listing.PrincipalARN, listing.AccountID}); err != nil {
+			return errors.Wrap(err, "error writing roles")
+		}
+	}
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "error writing roles")
+}
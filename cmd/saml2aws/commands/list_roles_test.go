@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2"
+)
+
+var listedRoles = []*saml2aws.AWSRole{
+	{RoleARN: "arn:aws:iam::123456789012:role/Ops", PrincipalARN: "arn:aws:iam::123456789012:saml-provider/Example"},
+	{RoleARN: "arn:aws-us-gov:iam::210987654321:role/ReadOnly", PrincipalARN: "arn:aws-us-gov:iam::210987654321:saml-provider/Example"},
+}
+
+func TestPrintRolesJSON(t *testing.T) {
+	var out bytes.Buffer
+	err := printRoles(&out, listedRoles, "json")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `[
+		{"role_arn":"arn:aws:iam::123456789012:role/Ops","principal_arn":"arn:aws:iam::123456789012:saml-provider/Example","account_id":"123456789012"},
+		{"role_arn":"arn:aws-us-gov:iam::210987654321:role/ReadOnly","principal_arn":"arn:aws-us-gov:iam::210987654321:saml-provider/Example","account_id":"210987654321"}
+	]`, out.String())
+}
+
+func TestPrintRolesCSV(t *testing.T) {
+	var out bytes.Buffer
+	err := printRoles(&out, listedRoles, "csv")
+	assert.Nil(t, err)
+	assert.Equal(t, "role_arn,principal_arn,account_id\n"+
+		"arn:aws:iam::123456789012:role/Ops,arn:aws:iam::123456789012:saml-provider/Example,123456789012\n"+
+		"arn:aws-us-gov:iam::210987654321:role/ReadOnly,arn:aws-us-gov:iam::210987654321:saml-provider/Example,210987654321\n", out.String())
+}
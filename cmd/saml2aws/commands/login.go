@@ -1,15 +1,23 @@
 package commands
 
 import (
+	"bytes"
 	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/pkg/errors"
@@ -20,59 +28,179 @@ import (
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/logging"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+	"github.com/versent/saml2aws/v2/pkg/provider/browser"
+	"github.com/versent/saml2aws/v2/pkg/provider/duosso"
+	"github.com/versent/saml2aws/v2/pkg/provider/identitycenter"
+	"github.com/versent/saml2aws/v2/pkg/provider/okta"
 	"github.com/versent/saml2aws/v2/pkg/samlcache"
+	"golang.org/x/term"
 )
 
+// credentialExpirySkew credentials this close to expiring are treated as expired to allow for clock skew
+const credentialExpirySkew = 2 * time.Minute
+
+// maxSessionPolicySize the most characters STS takes for the session policy and the policy ARNs together
+const maxSessionPolicySize = 2048
+
+// maxChainedSessionDuration the longest session STS grants a role assumed with the credentials of another role
+const maxChainedSessionDuration = 3600
+
+var maxSessionDurationPattern = regexp.MustCompile(`(?:MaxSessionDuration|less than or equal to)\D*(\d+)`)
+
 // Login login to ADFS
 func Login(loginFlags *flags.LoginExecFlags) error {
+	start := time.Now()
+
+	err := login(loginFlags, saveLoginCredentials)
+	logging.Completed(logrus.WithField("command", "login"), start, err)
+
+	return err
+}
+
+// credentialsSaver hands on the credentials of the role logged into, saving them to the profile for login
+type credentialsSaver func(account *cfg.IDPAccount, awsCreds *awsconfig.AWSCredentials, sharedCreds *awsconfig.CredentialsProvider, loginFlags *flags.LoginExecFlags) error
+
+func login(loginFlags *flags.LoginExecFlags, save credentialsSaver) error {
 
 	logger := logrus.WithField("command", "login")
 
-	account, err := buildIdpAccount(loginFlags)
+	account, overrides, err := buildIdpAccount(loginFlags)
 	if err != nil {
 		return errors.Wrap(err, "Error building login details.")
 	}
 
-	sharedCreds := awsconfig.NewSharedCredentials(account.Profile, account.CredentialsFile)
-	// creates a cacheProvider, only used when --cache is set
-	cacheProvider := &samlcache.SAMLCacheProvider{
-		Account:  account.Name,
-		Filename: account.SAMLCacheFile,
+	logging.SetFields(logrus.Fields{"account": account.Name, "provider": account.Provider})
+
+	if account.SessionDuration > cfg.DefaultSessionDuration {
+		logger.Warnf("Session duration of %d seconds exceeds %d, the role's maximum session duration may cap it", account.SessionDuration, cfg.DefaultSessionDuration)
 	}
 
-	logger.Debug("Check if creds exist.")
+	// a session policy STS would reject is reported before authenticating
+	_, err = sessionPolicy(account, loginFlags.CommonFlags.Policy)
+	if err != nil {
+		return err
+	}
 
-	// this checks if the credentials file has been created yet
-	exist, err := sharedCreds.CredsExists()
+	roleTargets, err := account.RoleTargets()
 	if err != nil {
-		return errors.Wrap(err, "Error loading credentials.")
+		return errors.Wrap(err, "Error building login details.")
 	}
-	if !exist {
-		log.Println("Unable to load credentials. Login required to create them.")
-		return nil
+	if len(roleTargets) > 0 && loginFlags.CredentialProcess {
+		return errors.New("role_arns can't be used with --credential-process, which prints credentials for a single role.")
+	}
+	if loginFlags.AllRoles {
+		switch {
+		case len(roleTargets) > 0:
+			return errors.New("--all-roles can't be used with role_arns.")
+		case loginFlags.CredentialProcess:
+			return errors.New("--all-roles can't be used with --credential-process, which prints credentials for a single role.")
+		case account.Provider == identitycenter.ProviderName:
+			return errors.New("--all-roles needs the roles of a SAML assertion, it can't be used with IdentityCenter.")
+		}
+	}
+	if loginFlags.UseEnvBase {
+		switch {
+		case len(account.RoleChainARNs()) == 0:
+			return errors.New("SAML2AWS_USE_ENV_BASE starts role_chain from the AWS credentials of the environment, set role_chain on the IDP account.")
+		case loginFlags.AllRoles:
+			return errors.New("--all-roles needs the roles of a SAML assertion, it can't be used with SAML2AWS_USE_ENV_BASE.")
+		case loginFlags.DryRun:
+			return errors.New("--dry-run lists the roles of a SAML assertion, it can't be used with SAML2AWS_USE_ENV_BASE.")
+		}
 	}
 
-	if !sharedCreds.Expired() && !loginFlags.Force {
-		logger.Debug("Credentials are not expired. Skipping.")
-		previousCreds, err := sharedCreds.Load()
+	profile := account.CredentialsProfile(account.RoleARN)
+	if len(roleTargets) > 0 {
+		// every role is logged in together so the first stands in for the others
+		profile = roleTargets[0].Profile
+	}
+
+	sharedCreds, err := loginCredentials(account, profile, loginFlags)
+	if err != nil {
+		return err
+	}
+	// creates a cacheProvider, only used when --cache is set
+	cacheProvider := &samlcache.SAMLCacheProvider{
+		Account:   account.Name,
+		Filename:  account.SAMLCacheFile,
+		Encrypt:   account.SAMLCacheEncrypt,
+		ClockSkew: time.Duration(account.AssertionClockSkew) * time.Second,
+	}
+
+	// profile_template names the profile after the role, only known once it is picked when role_arn isn't set
+	profilePending := account.ProfileTemplate != "" && account.RoleARN == "" && len(account.RoleChainARNs()) == 0
+
+	// a dry run always authenticates and leaves the credentials file untouched, --all-roles writes profiles
+	// only known once the assertion is in
+	if !loginFlags.DryRun && !loginFlags.AllRoles && !profilePending {
+		reuseThreshold := time.Duration(account.CredentialReuseThreshold) * time.Second
+		// the AWS SDKs run the credential process often, so it reuses what it printed until it is about to expire
+		if loginFlags.CredentialProcess && reuseThreshold == 0 {
+			reuseThreshold = credentialProcessRefreshWindow
+		}
+		if reuseThreshold > 0 && !loginFlags.Force {
+			if previousCreds := reusableCredentials(sharedCreds, reuseThreshold); previousCreds != nil {
+				log.Printf("Reusing credentials for profile %s, they expire at %v, use --force to login again.", sharedCreds.Profile, previousCreds.Expires)
+				if loginFlags.CredentialProcess {
+					return PrintCredentialProcess(previousCreds)
+				}
+				return nil
+			}
+			logger.Debug("Credentials expire within the reuse threshold, logging in again.")
+		}
+
+		if !loginFlags.Force && !loginFlags.CredentialProcess && reuseThreshold == 0 {
+			if remaining := credentialsValidFor(loginFlags.CommonFlags.ConfigFile, sharedCreds, account.RoleARN); remaining > 0 {
+				log.Printf("Credentials still valid for %d minutes, use --force to login again.", int(remaining.Minutes()))
+				return nil
+			}
+		}
+
+		logger.Debug("Check if creds exist.")
+
+		// this checks if the credentials file has been created yet
+		exist, err := sharedCreds.CredsExists()
 		if err != nil {
-			log.Println("Unable to load cached credentials.")
-		} else {
-			logger.Debug("Credentials will expire at ", previousCreds.Expires)
+			return errors.Wrap(err, "Error loading credentials.")
 		}
-		if loginFlags.CredentialProcess {
-			err = PrintCredentialProcess(previousCreds)
+		if !exist && !loginFlags.CredentialProcess {
+			log.Println("Unable to load credentials. Login required to create them.")
+			return nil
+		}
+
+		if !sharedCreds.Expired() && !loginFlags.Force && reuseThreshold == 0 {
+			logger.Debug("Credentials are not expired. Skipping.")
+			previousCreds, err := sharedCreds.Load()
 			if err != nil {
-				return err
+				log.Println("Unable to load cached credentials.")
+			} else {
+				logger.Debug("Credentials will expire at ", previousCreds.Expires)
 			}
+			if loginFlags.CredentialProcess {
+				err = PrintCredentialProcess(previousCreds)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
 		}
-		return nil
+	}
+
+	if loginFlags.UseEnvBase {
+		return loginFromEnvBase(account, sharedCreds, loginFlags, save)
+	}
+
+	// Identity Center hands out role credentials without a SAML assertion or a password
+	if account.Provider == identitycenter.ProviderName {
+		return loginToIdentityCenter(account, sharedCreds, loginFlags, save)
 	}
 
 	loginDetails, err := resolveLoginDetails(account, loginFlags)
 	if err != nil {
-		log.Printf("%+v", err)
-		os.Exit(1)
+		return errors.Wrap(err, "Error resolving login details.")
 	}
 
 	logger.WithField("idpAccount", account).Debug("building provider")
@@ -87,13 +215,17 @@ func Login(loginFlags *flags.LoginExecFlags) error {
 		return errors.Wrap(err, "Error validating login details.")
 	}
 
-	var samlAssertion string
-	if account.SAMLCache {
+	var result *saml2aws.AuthenticationResult
+	if account.SAMLCache && !loginFlags.DryRun {
 		if cacheProvider.IsValid() {
-			samlAssertion, err = cacheProvider.ReadRaw()
+			samlAssertion, err := cacheProvider.ReadRaw()
 			if err != nil {
 				return errors.Wrap(err, "Could not read SAML cache.")
 			}
+			result, err = saml2aws.NewAuthenticationResult(samlAssertion, account.RoleAttributeName)
+			if err != nil {
+				return errors.Wrap(err, "Could not parse the cached SAML assertion.")
+			}
 		} else {
 			logger.Debug("Cache is invalid")
 			log.Printf("Authenticating as %s ...", loginDetails.Username)
@@ -102,20 +234,33 @@ func Login(loginFlags *flags.LoginExecFlags) error {
 		log.Printf("Authenticating as %s ...", loginDetails.Username)
 	}
 
-	if samlAssertion == "" {
+	if result == nil || result.SAMLAssertion == "" {
 		// samlAssertion was not cached
-		samlAssertion, err = provider.Authenticate(loginDetails)
+		result, err = authenticateWithRetries(provider, loginDetails, account.RoleAttributeName, account.PasswordRetries, !loginFlags.CredentialProcess && !loginFlags.CommonFlags.Quiet)
 		if err != nil {
+			var timeoutErr *okta.MfaTimeoutError
+			if errors.As(err, &timeoutErr) {
+				log.Println("The MFA request was not answered in time, run the login again to send a new one.")
+			}
+			var browserTimeoutErr *browser.TimeoutError
+			if errors.As(err, &browserTimeoutErr) {
+				log.Println("The login wasn't finished in the browser in time, raise browser_timeout on the IDP account to wait longer.")
+			}
+			var enrollErr *duosso.EnrollmentRequiredError
+			if errors.As(err, &enrollErr) {
+				log.Println("Duo needs a device enrolled before you can log in, enroll one in a browser and run the login again.")
+			}
 			return errors.Wrap(err, "Error authenticating to IdP.")
 		}
-		if account.SAMLCache {
-			err = cacheProvider.WriteRaw(samlAssertion)
+		if account.SAMLCache && !loginFlags.DryRun {
+			err = cacheProvider.WriteRaw(result.SAMLAssertion)
 			if err != nil {
 				return errors.Wrap(err, "Could not write SAML cache.")
 			}
 		}
 	}
 
+	samlAssertion := result.SAMLAssertion
 	if samlAssertion == "" {
 		log.Println("Response did not contain a valid SAML assertion.")
 		log.Println("Please check that your username and password is correct.")
@@ -123,28 +268,192 @@ func Login(loginFlags *flags.LoginExecFlags) error {
 		os.Exit(1)
 	}
 
-	if !loginFlags.CommonFlags.DisableKeychain {
+	err = dumpAssertion(samlAssertion, loginFlags)
+	if err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"nameID":         result.NameID,
+		"sourceIdentity": result.SourceIdentity,
+		"principalTags":  result.PrincipalTags,
+	}).Debug("identity in the SAML assertion")
+
+	if account.AssertionClockSkew > 0 {
+		err = checkAssertionConditions(samlAssertion, time.Duration(account.AssertionClockSkew)*time.Second)
+		if err != nil {
+			return errors.Wrap(err, "Error validating SAML assertion.")
+		}
+	}
+
+	if loginFlags.DryRun {
+		return printDryRunRoles(result, loginFlags)
+	}
+
+	if !account.DisableKeyring {
 		err = credentials.SaveCredentials(loginDetails.URL, loginDetails.Username, loginDetails.Password)
 		if err != nil {
 			return errors.Wrap(err, "Error storing password in keychain.")
 		}
 	}
 
-	role, err := selectAwsRole(samlAssertion, account)
+	assertions := newRoleAssertions(account, overrides, result, loginDetails, loginFlags)
+
+	if len(roleTargets) > 0 {
+		return loginToRoles(account, roleTargets, assertions, loginFlags)
+	}
+
+	if loginFlags.AllRoles {
+		return loginToAllRoles(account, assertions, loginFlags)
+	}
+
+	// the credential process can't prompt so the role has to be configured unless there is only one
+	prompt := newRolePrompt(account, loginFlags)
+	role, err := selectAwsRole(result, account, prompt)
 	if err != nil {
 		return errors.Wrap(err, "Failed to assume role. Please check whether you are permitted to assume the given role for the AWS service.")
 	}
 
 	log.Println("Selected role:", role.RoleARN)
 
-	awsCreds, err := loginToStsUsingRole(account, role, samlAssertion)
+	// a GovCloud or China role is assumed through the STS endpoint and region of its partition
+	account.ApplyRolePartition(role.RoleARN)
+
+	if profilePending {
+		sharedCreds, err = loginCredentials(account, account.CredentialsProfile(role.RoleARN), loginFlags)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err = assertions.forRole(role)
+	if err != nil {
+		return errors.Wrap(err, "Error authenticating to IdP.")
+	}
+
+	awsCreds, err := loginToStsUsingRole(account, role, result, loginFlags)
 	if err != nil {
 		return errors.Wrap(err, "Error logging into AWS role using SAML assertion.")
 	}
 
+	rememberRole(account, role.RoleARN, prompt.lastRoleARN, loginFlags)
+
+	awsCreds, err = loginToRoleChain(account, awsCreds, sharedCreds, loginFlags)
+	if err != nil {
+		return err
+	}
+
+	return save(account, awsCreds, sharedCreds, loginFlags)
+}
+
+// authenticateWithRetries asks for the password again when the IdP rejects it, up to retries times. Any other error,
+// network failures included, is returned straight away.
+func authenticateWithRetries(client saml2aws.SAMLClient, loginDetails *creds.LoginDetails, roleAttributeName string, retries int, interactive bool) (*saml2aws.AuthenticationResult, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := saml2aws.AuthenticateDetailed(client, loginDetails, roleAttributeName)
+		if err == nil || !interactive || attempt > retries || !errors.Is(err, provider.ErrInvalidCredentials) {
+			return result, err
+		}
+
+		log.Printf("%s, try again (%d of %d retries).", err, attempt, retries)
+		loginDetails.Password = prompter.Password("Password")
+	}
+}
+
+// roleAssertions hands out the assertion to assume each role with. A role whose SAML provider urn_overrides maps
+// to another URN than the account's aws_urn needs an assertion issued for that URN, the login is done once more
+// for it and kept for the other roles of the same URN.
+type roleAssertions struct {
+	result    *saml2aws.AuthenticationResult
+	urn       string
+	overrides []cfg.URNOverride
+	byURN     map[string]*saml2aws.AuthenticationResult
+	// authenticate logs in again with the account's URN replaced by urn
+	authenticate func(urn string) (*saml2aws.AuthenticationResult, error)
+}
+
+func newRoleAssertions(account *cfg.IDPAccount, overrides []cfg.URNOverride, result *saml2aws.AuthenticationResult, loginDetails *creds.LoginDetails, loginFlags *flags.LoginExecFlags) *roleAssertions {
+	return &roleAssertions{
+		result:    result,
+		urn:       account.AmazonWebservicesURN,
+		overrides: overrides,
+		byURN:     map[string]*saml2aws.AuthenticationResult{account.AmazonWebservicesURN: result},
+		authenticate: func(urn string) (*saml2aws.AuthenticationResult, error) {
+			urnAccount := *account
+			urnAccount.AmazonWebservicesURN = urn
+
+			client, err := saml2aws.NewSAMLClient(&urnAccount)
+			if err != nil {
+				return nil, errors.Wrap(err, "Error building IdP client.")
+			}
+
+			return authenticateWithRetries(client, loginDetails, account.RoleAttributeName, account.PasswordRetries, !loginFlags.CredentialProcess && !loginFlags.CommonFlags.Quiet)
+		},
+	}
+}
+
+// forRole the assertion issued for the URN of the role's SAML provider, the first one unless urn_overrides
+// says otherwise
+func (ra *roleAssertions) forRole(role *saml2aws.AWSRole) (*saml2aws.AuthenticationResult, error) {
+	urn := cfg.URNForPrincipal(ra.overrides, role.PrincipalARN, ra.urn)
+	if result, ok := ra.byURN[urn]; ok {
+		return result, nil
+	}
+
+	log.Printf("Authenticating again for %s, urn_overrides maps %s to it ...", urn, role.PrincipalARN)
+
+	result, err := ra.authenticate(urn)
+	if err != nil {
+		return nil, err
+	}
+	if result.SAMLAssertion == "" {
+		return nil, fmt.Errorf("the IdP returned no SAML assertion for %s", urn)
+	}
+
+	ra.byURN[urn] = result
+	return result, nil
+}
+
+// lastRole the role picked from the menu last time for the account, empty when it isn't remembered
+func lastRole(account *cfg.IDPAccount, loginFlags *flags.LoginExecFlags) string {
+	if loginFlags.NoRememberRole || account.DisableRememberRole || account.RoleARN != "" || account.RoleMatcher != "" {
+		return ""
+	}
+
+	cfgm, err := cfg.NewConfigManager(loginFlags.CommonFlags.ConfigFile)
+	if err != nil {
+		return ""
+	}
+
+	roleARN, err := cfgm.LoadLastRole(account.Name)
+	if err != nil {
+		logrus.WithError(err).Debug("Unable to load the last role.")
+		return ""
+	}
+
+	return roleARN
+}
+
+// rememberRole records the role picked from the menu once it has been assumed, so it is offered first next time
+func rememberRole(account *cfg.IDPAccount, roleARN, lastRoleARN string, loginFlags *flags.LoginExecFlags) {
+	if loginFlags.NoRememberRole || account.DisableRememberRole || account.RoleARN != "" || account.RoleMatcher != "" || roleARN == lastRoleARN {
+		return
+	}
+
+	cfgm, err := cfg.NewConfigManager(loginFlags.CommonFlags.ConfigFile)
+	if err == nil {
+		err = cfgm.SaveLastRole(account.Name, roleARN)
+	}
+	if err != nil {
+		logrus.WithError(err).Warn("Unable to remember the selected role.")
+	}
+}
+
+// saveLoginCredentials saves the credentials to the profile, or prints them for --credential-process
+func saveLoginCredentials(account *cfg.IDPAccount, awsCreds *awsconfig.AWSCredentials, sharedCreds *awsconfig.CredentialsProvider, loginFlags *flags.LoginExecFlags) error {
 	// print credential process if needed
 	if loginFlags.CredentialProcess {
-		err = PrintCredentialProcess(awsCreds)
+		err := PrintCredentialProcess(awsCreds)
 		if err != nil {
 			return err
 		}
@@ -159,14 +468,27 @@ func Login(loginFlags *flags.LoginExecFlags) error {
 			if err != nil {
 				return err
 			}
+			// the expiry lets login skip the IdP for the profile, which the credential process cache doesn't hold
+			if !isCredentialProcessCache(sharedCreds) {
+				recordCredentialExpiry(loginFlags.CommonFlags.ConfigFile, sharedCreds, awsCreds.Expires)
+			}
 		}
 	} else {
-		err = saveCredentials(awsCreds, sharedCreds)
+		err := saveCredentials(awsCreds, sharedCreds)
+		if err != nil {
+			return err
+		}
+		recordCredentialExpiry(loginFlags.CommonFlags.ConfigFile, sharedCreds, awsCreds.Expires)
+
+		err = writeProfileConfig(account, sharedCreds.Profile, loginFlags)
 		if err != nil {
 			return err
 		}
 
 		log.Println("Logged in as:", awsCreds.PrincipalARN)
+		if awsCreds.SourceIdentity != "" {
+			log.Println("Source identity:", awsCreds.SourceIdentity)
+		}
 		log.Println("")
 		log.Println("Your new access key pair has been stored in the AWS configuration.")
 		log.Printf("Note that it will expire at %v", awsCreds.Expires)
@@ -178,26 +500,187 @@ func Login(loginFlags *flags.LoginExecFlags) error {
 	return nil
 }
 
-func buildIdpAccount(loginFlags *flags.LoginExecFlags) (*cfg.IDPAccount, error) {
+// loginToRoles assumes each of the role_arns with the one SAML assertion, a role that can't be assumed is
+// skipped with a warning so the others are still logged in
+func loginToRoles(account *cfg.IDPAccount, roleTargets []cfg.RoleTarget, assertions *roleAssertions, loginFlags *flags.LoginExecFlags) error {
+	loggedIn := 0
+	for _, target := range roleTargets {
+		role, err := saml2aws.LocateRole(assertions.result.Roles, target.RoleARN)
+		if err != nil {
+			logrus.Warnf("Skipping role %s: %v", target.RoleARN, err)
+			continue
+		}
+
+		result, err := assertions.forRole(role)
+		if err != nil {
+			logrus.Warnf("Skipping role %s: %v", target.RoleARN, err)
+			continue
+		}
+
+		// the roles may be in different partitions, each is assumed through the STS endpoint of its own
+		roleAccount := account.Clone()
+		roleAccount.ApplyRolePartition(role.RoleARN)
+
+		awsCreds, err := loginToStsUsingRole(roleAccount, role, result, loginFlags)
+		if err != nil {
+			logrus.Warnf("Skipping role %s: %v", target.RoleARN, err)
+			continue
+		}
+
+		sharedCreds := awsconfig.NewSharedCredentials(target.Profile, account.CredentialsFile)
+		err = saveCredentials(awsCreds, sharedCreds)
+		if err != nil {
+			return err
+		}
+		recordCredentialExpiry(loginFlags.CommonFlags.ConfigFile, sharedCreds, awsCreds.Expires)
+
+		err = writeProfileConfig(roleAccount, target.Profile, loginFlags)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Logged in as: %s, saved to profile %s, expires at %v", awsCreds.PrincipalARN, target.Profile, awsCreds.Expires)
+		loggedIn++
+	}
+
+	if loggedIn == 0 {
+		return errors.New("None of the roles could be assumed.")
+	}
+
+	log.Printf("Logged in to %d of %d roles.", loggedIn, len(roleTargets))
+
+	return nil
+}
+
+// loginToAllRoles assumes every role in the SAML assertion, each saved to its own profile
+func loginToAllRoles(account *cfg.IDPAccount, assertions *roleAssertions, loginFlags *flags.LoginExecFlags) error {
+	if len(assertions.result.Roles) == 0 {
+		return errors.New("No roles available.")
+	}
+
+	tmpl, err := account.AllRolesProfileTemplate()
+	if err != nil {
+		return errors.Wrap(err, "Error parsing all_roles_profile.")
+	}
+
+	roleTargets, err := allRoleTargets(assertions.result.Roles, tmpl, account.Profile)
+	if err != nil {
+		return err
+	}
+
+	return loginToRoles(account, roleTargets, assertions, loginFlags)
+}
+
+// allRolesProfileData the fields all_roles_profile can use to name the profile of a role
+type allRolesProfileData struct {
+	RoleName  string
+	AccountID string
+	Profile   string
+}
+
+// allRoleTargets names a profile for each role, after the role or with the template. Roles are taken in ARN
+// order so a name two roles share is resolved the same way every login: each gets its account ID appended,
+// then a counter from 2 if it is still taken.
+func allRoleTargets(awsRoles []*saml2aws.AWSRole, tmpl *template.Template, profile string) ([]cfg.RoleTarget, error) {
+	sorted := make([]*saml2aws.AWSRole, len(awsRoles))
+	copy(sorted, awsRoles)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].RoleARN < sorted[j].RoleARN })
+
+	names := make([]string, len(sorted))
+	accountIDs := make([]string, len(sorted))
+	counts := map[string]int{}
+	for i, role := range sorted {
+		roleName := role.RoleARN[strings.LastIndex(role.RoleARN, "/")+1:]
+		if parts := strings.Split(role.RoleARN, ":"); len(parts) > 4 {
+			accountIDs[i] = parts[4]
+		}
+
+		name := roleName
+		if tmpl != nil {
+			var buf strings.Builder
+			err := tmpl.Execute(&buf, allRolesProfileData{RoleName: roleName, AccountID: accountIDs[i], Profile: profile})
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error naming the profile of role %s with all_roles_profile.", role.RoleARN)
+			}
+			name = buf.String()
+		}
+		names[i] = cfg.SanitizeProfileName(name)
+		if names[i] == "" {
+			return nil, errors.Errorf("The profile name of role %s is empty.", role.RoleARN)
+		}
+		counts[names[i]]++
+	}
+
+	taken := map[string]bool{}
+	targets := make([]cfg.RoleTarget, len(sorted))
+	for i, role := range sorted {
+		name := names[i]
+		if counts[name] > 1 {
+			name = fmt.Sprintf("%s-%s", name, accountIDs[i])
+		}
+		unique := name
+		for n := 2; taken[unique]; n++ {
+			unique = fmt.Sprintf("%s-%d", name, n)
+		}
+		taken[unique] = true
+		targets[i] = cfg.RoleTarget{RoleARN: role.RoleARN, Profile: unique}
+	}
+
+	return targets, nil
+}
+
+// printDryRunRoles lists the roles the SAML assertion would allow without assuming any of them
+func printDryRunRoles(result *saml2aws.AuthenticationResult, loginFlags *flags.LoginExecFlags) error {
+	log.Println("Dry run, authentication succeeded. No credentials were saved, the roles that could be assumed are:")
+
+	return listRoles(result.Roles, result.SAMLAssertion, loginFlags)
+}
+
+// buildIdpAccount loads the account along with the urn_overrides of the configuration, both with the same
+// ConfigManager so an encrypted configuration asks for its passphrase once
+func buildIdpAccount(loginFlags *flags.LoginExecFlags) (*cfg.IDPAccount, []cfg.URNOverride, error) {
 	cfgm, err := cfg.NewConfigManager(loginFlags.CommonFlags.ConfigFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to load configuration.")
+		return nil, nil, errors.Wrap(err, "Failed to load configuration.")
 	}
 
 	account, err := cfgm.LoadIDPAccount(loginFlags.CommonFlags.IdpAccount)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to load IdP account.")
+		return nil, nil, errors.Wrap(err, "Failed to load IdP account.")
 	}
 
 	// update username and hostname if supplied
 	flags.ApplyFlagOverrides(loginFlags.CommonFlags, account)
 
+	var aliases map[string]string
+	if account.RoleARN != "" {
+		aliases, err = cfgm.LoadRoleAliases()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to load role aliases.")
+		}
+	}
+	err = saml2aws.PrepareAccount(account, aliases)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	err = account.Validate()
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to validate account.")
+		return nil, nil, errors.Wrap(err, "Failed to validate account.")
 	}
 
-	return account, nil
+	overrides, err := cfgm.LoadURNOverrides()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to load urn_overrides.")
+	}
+
+	prompter.SetPromptTimeout(time.Duration(account.PromptTimeout) * time.Second)
+
+	if account.DisableKeyring {
+		credentials.Disable()
+	}
+
+	return account, overrides, nil
 }
 
 func resolveLoginDetails(account *cfg.IDPAccount, loginFlags *flags.LoginExecFlags) (*creds.LoginDetails, error) {
@@ -208,14 +691,24 @@ func resolveLoginDetails(account *cfg.IDPAccount, loginFlags *flags.LoginExecFla
 
 	log.Printf("Using IdP Account %s to access %s %s", loginFlags.CommonFlags.IdpAccount, account.Provider, account.URL)
 
+	keyringDisabled := account.DisableKeyring || loginFlags.CommonFlags.DisableKeychain
+
 	var err error
-	if !loginFlags.CommonFlags.DisableKeychain {
+	if !keyringDisabled {
 		err = credentials.LookupCredentials(loginDetails, account.Provider)
 		if err != nil {
 			if !credentials.IsErrCredentialsNotFound(err) {
 				return nil, errors.Wrap(err, "Error loading saved password.")
 			}
 		}
+
+		// a TOTP seed saved with configure-mfa answers the MFA without asking
+		if loginDetails.MFAToken == "" && strings.EqualFold(account.MFA, "TOTP") {
+			loginDetails.MFAToken, err = totpFromKeyring(loginFlags.CommonFlags.IdpAccount)
+			if err != nil {
+				return nil, err
+			}
+		}
 	} else { // if user disabled keychain, dont use Okta sessions & dont remember Okta MFA device
 		if strings.ToLower(account.Provider) == "okta" {
 			account.DisableSessions = true
@@ -230,8 +723,15 @@ func resolveLoginDetails(account *cfg.IDPAccount, loginFlags *flags.LoginExecFla
 		loginDetails.Username = loginFlags.CommonFlags.Username
 	}
 
-	// if you supply a password in a flag it takes precedence
-	if loginFlags.CommonFlags.Password != "" {
+	// if you supply a password in a flag it takes precedence, then a password file over SAML2AWS_PASSWORD and the keychain
+	if passwordFlagSet(loginFlags.CommonFlags) {
+		loginDetails.Password = loginFlags.CommonFlags.Password
+	} else if loginFlags.CommonFlags.PasswordFile != "" {
+		loginDetails.Password, err = creds.ReadPasswordFile(loginFlags.CommonFlags.PasswordFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error loading password file.")
+		}
+	} else if loginFlags.CommonFlags.Password != "" {
 		loginDetails.Password = loginFlags.CommonFlags.Password
 	}
 
@@ -260,8 +760,21 @@ func resolveLoginDetails(account *cfg.IDPAccount, loginFlags *flags.LoginExecFla
 
 	// log.Printf("loginDetails %+v", loginDetails)
 
+	// the credential process runs without a terminal so everything has to come from the keychain, flags or environment
+	if loginFlags.CredentialProcess {
+		if passwordRequired(account.Provider) && (loginDetails.Username == "" || loginDetails.Password == "") {
+			return nil, errors.New("Username and password must be saved in the keychain or set with SAML2AWS_USERNAME and SAML2AWS_PASSWORD or SAML2AWS_PASSWORD_FILE when using --credential-process.")
+		}
+		return loginDetails, nil
+	}
+
+	// without the keyring and a prompt the password has to be given now rather than failing deep in the login
+	if keyringDisabled && (loginFlags.CommonFlags.SkipPrompt || loginFlags.CommonFlags.Quiet) && passwordRequired(account.Provider) && loginDetails.Password == "" {
+		return nil, errors.New("The keyring is disabled and prompting is off, set the password with --password, SAML2AWS_PASSWORD or --password-file.")
+	}
+
 	// if skip prompt was passed just pass back the flag values
-	if loginFlags.CommonFlags.SkipPrompt || loginFlags.CredentialProcess {
+	if loginFlags.CommonFlags.SkipPrompt {
 		return loginDetails, nil
 	}
 
@@ -275,33 +788,32 @@ func resolveLoginDetails(account *cfg.IDPAccount, loginFlags *flags.LoginExecFla
 	return loginDetails, nil
 }
 
-func selectAwsRole(samlAssertion string, account *cfg.IDPAccount) (*saml2aws.AWSRole, error) {
-	data, err := b64.StdEncoding.DecodeString(samlAssertion)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error decoding SAML assertion.")
-	}
+// passwordRequired whether the provider signs in with a password rather than a browser or a command
+func passwordRequired(provider string) bool {
+	return provider != "Browser" && provider != "Shell"
+}
 
-	roles, err := saml2aws.ExtractAwsRoles(data)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error parsing AWS roles.")
-	}
+// passwordFlagSet whether the password was given with --password rather than SAML2AWS_PASSWORD, which
+// kingpin folds into the same flag
+func passwordFlagSet(commonFlags *flags.CommonFlags) bool {
+	return commonFlags.Password != "" && commonFlags.Password != os.Getenv("SAML2AWS_PASSWORD")
+}
 
-	if len(roles) == 0 {
+func selectAwsRole(result *saml2aws.AuthenticationResult, account *cfg.IDPAccount, prompt rolePrompt) (*saml2aws.AWSRole, error) {
+	if len(result.Roles) == 0 {
 		log.Println("No roles to assume.")
 		log.Println("Please check you are permitted to assume roles for the AWS service.")
 		os.Exit(1)
 	}
 
-	awsRoles, err := saml2aws.ParseAWSRoles(roles)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error parsing AWS roles.")
-	}
-
-	return resolveRole(awsRoles, samlAssertion, account)
+	return resolveRole(result.Roles, result.SAMLAssertion, account, prompt)
 }
 
-func resolveRole(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *cfg.IDPAccount) (*saml2aws.AWSRole, error) {
-	var role = new(saml2aws.AWSRole)
+func resolveRole(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *cfg.IDPAccount, prompt rolePrompt) (*saml2aws.AWSRole, error) {
+	// role_matcher needs nothing from the AWS sign in page, the ARNs are enough
+	if account.RoleARN == "" && account.RoleMatcher != "" {
+		return saml2aws.MatchRole(awsRoles, account.RoleMatcher)
+	}
 
 	if len(awsRoles) == 1 {
 		if account.RoleARN != "" {
@@ -332,42 +844,99 @@ func resolveRole(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *cf
 
 	saml2aws.AssignPrincipals(awsRoles, awsAccounts)
 
-	if account.RoleARN != "" {
-		return saml2aws.LocateRole(awsRoles, account.RoleARN)
+	return chooseRole(awsRoles, awsAccounts, account, prompt)
+}
+
+// rolePrompt how the role menu is shown
+type rolePrompt struct {
+	// interactive false when nobody is there to answer the menu
+	interactive bool
+	// simple numbers the roles instead of listing them to filter as you type
+	simple bool
+	// lastRoleARN the role picked last time, selected to start with when it is still offered
+	lastRoleARN string
+}
+
+func newRolePrompt(account *cfg.IDPAccount, loginFlags *flags.LoginExecFlags) rolePrompt {
+	return rolePrompt{
+		interactive: !loginFlags.CredentialProcess && !loginFlags.CommonFlags.Quiet && !loginFlags.CommonFlags.SkipPrompt,
+		simple:      loginFlags.SimplePrompt || !term.IsTerminal(int(os.Stdout.Fd())),
+		lastRoleARN: lastRole(account, loginFlags),
+	}
+}
+
+// chooseRole picks the configured role_arn, the role role_matcher matches, or the only role, and otherwise asks
+// which account and role to use among those role_filter leaves
+func chooseRole(awsRoles []*saml2aws.AWSRole, awsAccounts []*saml2aws.AWSAccount, account *cfg.IDPAccount, prompt rolePrompt) (*saml2aws.AWSRole, error) {
+	role, err := saml2aws.ConfiguredRole(awsRoles, account)
+	if role != nil || err != nil {
+		return role, err
+	}
+
+	if account.RoleFilter != "" {
+		awsRoles, awsAccounts, err = saml2aws.FilterRoles(awsRoles, awsAccounts, account.RoleFilter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(awsRoles) == 1 {
+		return awsRoles[0], nil
+	}
+
+	if !prompt.interactive {
+		return nil, errors.New("Multiple roles available, set role_arn or role_matcher in the IdP account or use --role to pick one.")
 	}
 
 	for {
-		role, err = saml2aws.PromptForAWSRoleSelection(awsAccounts)
+		selectRole := saml2aws.PromptForAWSRoleSelectionWithDefault
+		if prompt.simple {
+			selectRole = saml2aws.PromptForAWSRoleSelectionNumbered
+		}
+
+		role, err := selectRole(awsAccounts, prompt.lastRoleARN)
 		if err == nil {
-			break
+			return role, nil
 		}
 		log.Println("Error selecting role. Try again.")
 	}
-
-	return role, nil
 }
 
-func loginToStsUsingRole(account *cfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string) (*awsconfig.AWSCredentials, error) {
+func loginToStsUsingRole(account *cfg.IDPAccount, role *saml2aws.AWSRole, result *saml2aws.AuthenticationResult, loginFlags *flags.LoginExecFlags) (*awsconfig.AWSCredentials, error) {
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: &account.Region,
-	})
+	sess, err := session.NewSession(saml2aws.STSConfig(account))
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to create session.")
 	}
 
 	svc := sts.New(sess)
 
+	policy, err := sessionPolicy(account, loginFlags.CommonFlags.Policy)
+	if err != nil {
+		return nil, err
+	}
+
 	params := &sts.AssumeRoleWithSAMLInput{
-		PrincipalArn:    aws.String(role.PrincipalARN), // Required
-		RoleArn:         aws.String(role.RoleARN),      // Required
-		SAMLAssertion:   aws.String(samlAssertion),     // Required
-		DurationSeconds: aws.Int64(int64(account.SessionDuration)),
+		PrincipalArn:    aws.String(role.PrincipalARN),    // Required
+		RoleArn:         aws.String(role.RoleARN),         // Required
+		SAMLAssertion:   aws.String(result.SAMLAssertion), // Required
+		DurationSeconds: aws.Int64(sessionDuration(account, result)),
+		PolicyArns:      policyDescriptors(account.PolicyARNList()),
+	}
+	if policy != "" {
+		params.Policy = aws.String(policy)
 	}
 
 	log.Println("Requesting AWS credentials using SAML assertion.")
 
 	resp, err := svc.AssumeRoleWithSAML(params)
+	if err != nil && clampSessionDuration(account, loginFlags) {
+		if duration, ok := retrySessionDuration(aws.Int64Value(params.DurationSeconds), err); ok {
+			logrus.Warnf("STS rejected a session of %d seconds for %s, retrying with %d seconds. Lower aws_session_duration of the IDP account to %d or use --session-duration to skip the retry.", aws.Int64Value(params.DurationSeconds), role.RoleARN, duration, duration)
+			params.DurationSeconds = aws.Int64(duration)
+			resp, err = svc.AssumeRoleWithSAML(params)
+		}
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "Error retrieving STS credentials using SAML.")
 	}
@@ -380,9 +949,428 @@ func loginToStsUsingRole(account *cfg.IDPAccount, role *saml2aws.AWSRole, samlAs
 		PrincipalARN:     aws.StringValue(resp.AssumedRoleUser.Arn),
 		Expires:          resp.Credentials.Expiration.Local(),
 		Region:           account.Region,
+		SourceIdentity:   aws.StringValue(resp.SourceIdentity),
+		SAMLSubject:      result.NameID,
 	}, nil
 }
 
+// sessionPolicy the session policy of --policy, or else of policy_file, with the whitespace STS would count removed.
+// Along with the policy ARNs it has to fit in the characters STS takes, which is checked here as STS only reports
+// a packed size percentage.
+func sessionPolicy(account *cfg.IDPAccount, inline string) (string, error) {
+	source := "--policy"
+	document := []byte(inline)
+	if inline == "" {
+		if account.PolicyFile == "" {
+			return "", checkSessionPolicySize("", account.PolicyARNList())
+		}
+
+		data, err := os.ReadFile(account.PolicyFile)
+		if err != nil {
+			return "", errors.Wrap(err, "Failed to read policy_file.")
+		}
+		source, document = account.PolicyFile, data
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(document, &fields); err != nil {
+		return "", errors.Wrapf(err, "Session policy of %s isn't a JSON object.", source)
+	}
+
+	var policy bytes.Buffer
+	if err := json.Compact(&policy, document); err != nil {
+		return "", errors.Wrapf(err, "Session policy of %s isn't a JSON object.", source)
+	}
+
+	return policy.String(), checkSessionPolicySize(policy.String(), account.PolicyARNList())
+}
+
+// checkSessionPolicySize rejects a session policy and policy ARNs longer than STS takes
+func checkSessionPolicySize(policy string, policyARNs []string) error {
+	size := len(policy)
+	for _, policyARN := range policyARNs {
+		size += len(policyARN)
+	}
+	if size > maxSessionPolicySize {
+		return errors.Errorf("The session policy and policy ARNs are %d characters without whitespace, %d more than the %d STS takes. Shorten the policy or use fewer policy ARNs.", size, size-maxSessionPolicySize, maxSessionPolicySize)
+	}
+	return nil
+}
+
+// policyDescriptors the managed policies to pass STS, nil when there are none
+func policyDescriptors(policyARNs []string) []*sts.PolicyDescriptorType {
+	var descriptors []*sts.PolicyDescriptorType
+	for _, policyARN := range policyARNs {
+		descriptors = append(descriptors, &sts.PolicyDescriptorType{Arn: aws.String(policyARN)})
+	}
+	return descriptors
+}
+
+// sessionDuration the configured session duration, cut short by the SessionDuration attribute of the assertion
+// or the end of the IdP session, so a lower --session-duration still wins
+func sessionDuration(account *cfg.IDPAccount, result *saml2aws.AuthenticationResult) int64 {
+	requested := int64(account.SessionDuration)
+	if requested <= 0 {
+		requested = cfg.DefaultSessionDuration
+	}
+
+	duration := result.SessionDuration(account.SessionDuration, time.Now())
+	if duration < requested {
+		log.Printf("The SAML assertion limits the session to %d seconds, requesting it instead of %d seconds.", duration, requested)
+	}
+	return duration
+}
+
+// clampSessionDuration whether a session duration STS rejects as too long is retried with the role maximum, which
+// auto_clamp_session_duration turns on and --no-duration-fallback off
+func clampSessionDuration(account *cfg.IDPAccount, loginFlags *flags.LoginExecFlags) bool {
+	return account.AutoClampSessionDuration && !loginFlags.NoDurationFallback
+}
+
+// retrySessionDuration the duration to ask for once more when STS rejected the one requested as too long, the
+// role maximum when the error has it and otherwise an hour, which every role allows
+func retrySessionDuration(requested int64, err error) (int64, bool) {
+	maxDuration, ok := maxSessionDurationFromError(err)
+	if !ok {
+		return 0, false
+	}
+	return maxDuration, maxDuration < requested
+}
+
+// roleAssumer is used to mock out STS when chaining roles
+type roleAssumer interface {
+	AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error)
+}
+
+// chainedSTSClient an STS client signing with the credentials of the previous role in the chain
+func chainedSTSClient(account *cfg.IDPAccount, creds *awsconfig.AWSCredentials) (roleAssumer, error) {
+	config := saml2aws.STSConfig(account).WithCredentials(awscredentials.NewStaticCredentials(creds.AWSAccessKey, creds.AWSSecretKey, creds.AWSSessionToken))
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create session.")
+	}
+
+	return sts.New(sess), nil
+}
+
+// chainedSessionDuration the session duration asked for each role in role_chain, role_chain_session_duration or
+// the hour STS caps chained roles at, independent of aws_session_duration
+func chainedSessionDuration(account *cfg.IDPAccount) int64 {
+	if account.RoleChainSessionDuration <= 0 || account.RoleChainSessionDuration > maxChainedSessionDuration {
+		return maxChainedSessionDuration
+	}
+	return int64(account.RoleChainSessionDuration)
+}
+
+// roleChainOptions what is asked for when assuming each role_chain role
+type roleChainOptions struct {
+	duration    int64
+	externalID  string
+	sessionName string
+}
+
+// newRoleChainOptions the role_chain options of the IdP account
+func newRoleChainOptions(account *cfg.IDPAccount) roleChainOptions {
+	return roleChainOptions{
+		duration:    chainedSessionDuration(account),
+		externalID:  account.RoleChainExternalID,
+		sessionName: account.RoleChainSessionName,
+	}
+}
+
+// loginToRoleChain assumes the role_chain roles of the IdP account starting from the credentials of the role
+// logged into, first saving those to <profile>-source when role_chain_source_profile is set
+func loginToRoleChain(account *cfg.IDPAccount, awsCreds *awsconfig.AWSCredentials, sharedCreds *awsconfig.CredentialsProvider, loginFlags *flags.LoginExecFlags) (*awsconfig.AWSCredentials, error) {
+	roleARNs := account.RoleChainARNs()
+	if len(roleARNs) > 0 && account.RoleChainSourceProfile && !loginFlags.CredentialProcess {
+		sourceCreds := awsconfig.NewSharedCredentials(sourceProfile(sharedCreds.Profile), sharedCreds.Filename)
+		err := saveCredentials(awsCreds, sourceCreds)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error saving the credentials role_chain starts from.")
+		}
+		recordCredentialExpiry(loginFlags.CommonFlags.ConfigFile, sourceCreds, awsCreds.Expires)
+		log.Printf("Saved the credentials of %s to profile %s.", awsCreds.PrincipalARN, sourceCreds.Profile)
+	}
+
+	return assumeRoleChain(roleARNs, awsCreds, newRoleChainOptions(account), func(creds *awsconfig.AWSCredentials) (roleAssumer, error) {
+		return chainedSTSClient(account, creds)
+	})
+}
+
+// sourceProfile the profile the credentials role_chain starts from are saved to
+func sourceProfile(profile string) string {
+	return profile + "-source"
+}
+
+// assumeRoleChain assumes each of the role_chain roles in turn with the credentials of the one before, starting
+// from the credentials of the SAML role, and returns the credentials of the last
+func assumeRoleChain(roleARNs []string, awsCreds *awsconfig.AWSCredentials, opts roleChainOptions, newClient func(*awsconfig.AWSCredentials) (roleAssumer, error)) (*awsconfig.AWSCredentials, error) {
+	for i, roleARN := range roleARNs {
+		log.Printf("Assuming role %s (%d of %d in role_chain).", roleARN, i+1, len(roleARNs))
+
+		svc, err := newClient(awsCreds)
+		if err != nil {
+			return nil, err
+		}
+
+		sessionName := opts.sessionName
+		if sessionName == "" {
+			sessionName = roleSessionName(awsCreds.PrincipalARN)
+		}
+
+		input := &sts.AssumeRoleInput{
+			RoleArn:         aws.String(roleARN),
+			RoleSessionName: aws.String(sessionName),
+			DurationSeconds: aws.Int64(opts.duration),
+		}
+		if opts.externalID != "" {
+			input.ExternalId = aws.String(opts.externalID)
+		}
+
+		resp, err := svc.AssumeRole(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error assuming role %s, %d of %d in role_chain, with the credentials of %s.", roleARN, i+1, len(roleARNs), awsCreds.PrincipalARN)
+		}
+
+		awsCreds = &awsconfig.AWSCredentials{
+			AWSAccessKey:     aws.StringValue(resp.Credentials.AccessKeyId),
+			AWSSecretKey:     aws.StringValue(resp.Credentials.SecretAccessKey),
+			AWSSessionToken:  aws.StringValue(resp.Credentials.SessionToken),
+			AWSSecurityToken: aws.StringValue(resp.Credentials.SessionToken),
+			PrincipalARN:     aws.StringValue(resp.AssumedRoleUser.Arn),
+			Expires:          resp.Credentials.Expiration.Local(),
+			Region:           awsCreds.Region,
+			// the source identity carries over to chained sessions
+			SourceIdentity: awsCreds.SourceIdentity,
+			SAMLSubject:    awsCreds.SAMLSubject,
+		}
+	}
+
+	return awsCreds, nil
+}
+
+// loginFromEnvBase assumes the role_chain roles starting from the ambient AWS credentials, the environment
+// variables or an instance profile, rather than a SAML role
+func loginFromEnvBase(account *cfg.IDPAccount, sharedCreds *awsconfig.CredentialsProvider, loginFlags *flags.LoginExecFlags, save credentialsSaver) error {
+	sess, err := session.NewSession(saml2aws.STSConfig(account))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create session.")
+	}
+
+	awsCreds, err := envBaseCredentials(sess.Config.Credentials, account.Region)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Using the AWS credentials of the environment as the base of role_chain.")
+
+	awsCreds, err = assumeRoleChain(account.RoleChainARNs(), awsCreds, newRoleChainOptions(account), func(creds *awsconfig.AWSCredentials) (roleAssumer, error) {
+		return chainedSTSClient(account, creds)
+	})
+	if err != nil {
+		return err
+	}
+
+	return save(account, awsCreds, sharedCreds, loginFlags)
+}
+
+// envBaseCredentials resolves the ambient credentials up front so a missing key pair or instance profile is
+// reported before any role is assumed
+func envBaseCredentials(ambient *awscredentials.Credentials, region string) (*awsconfig.AWSCredentials, error) {
+	if ambient == nil {
+		return nil, errors.New("SAML2AWS_USE_ENV_BASE is set but no AWS credentials were found, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or run where an instance profile is attached.")
+	}
+
+	value, err := ambient.Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "SAML2AWS_USE_ENV_BASE is set but no AWS credentials were found, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or run where an instance profile is attached.")
+	}
+
+	return &awsconfig.AWSCredentials{
+		AWSAccessKey:     value.AccessKeyID,
+		AWSSecretKey:     value.SecretAccessKey,
+		AWSSessionToken:  value.SessionToken,
+		AWSSecurityToken: value.SessionToken,
+		Region:           region,
+	}, nil
+}
+
+// roleSessionName keeps the session name of the assumed role ARN so CloudTrail shows the same user at every hop
+func roleSessionName(principalARN string) string {
+	if i := strings.LastIndex(principalARN, "/"); i >= 0 && i < len(principalARN)-1 {
+		return principalARN[i+1:]
+	}
+	return "saml2aws"
+}
+
+// checkAssertionConditions rejects an assertion outside its validity window widened by skew, leaving STS to
+// judge assertions that are inside it
+func checkAssertionConditions(samlAssertion string, skew time.Duration) error {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return errors.Wrap(err, "error decoding SAML assertion")
+	}
+
+	rescued, err := saml2aws.ValidateAssertionConditions(data, time.Now(), skew)
+	if err != nil {
+		return err
+	}
+	if rescued {
+		log.Printf("SAML assertion is outside its validity window, accepted with %s of clock skew tolerance", skew)
+	}
+
+	return nil
+}
+
+// maxSessionDurationFromError works out the longest session duration STS will accept when it
+// rejected the requested DurationSeconds, returning false for any other error.
+func maxSessionDurationFromError(err error) (int64, bool) {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return 0, false
+	}
+
+	msg := aerr.Message()
+	lower := strings.ToLower(msg)
+	if !strings.Contains(lower, "maxsessionduration") && !strings.Contains(lower, "durationseconds") {
+		return 0, false
+	}
+
+	if m := maxSessionDurationPattern.FindStringSubmatch(msg); m != nil {
+		if maxDuration, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+			return maxDuration, true
+		}
+	}
+
+	// STS doesn't always include the role maximum in the message, every role
+	// allows at least one hour so fall back to that.
+	if strings.Contains(lower, "maxsessionduration") || strings.Contains(lower, "durationseconds exceeds") {
+		return cfg.DefaultSessionDuration, true
+	}
+
+	return 0, false
+}
+
+// credentialsValidFor returns how long the credentials last issued for the profile of the credentials file remain
+// valid, or zero when that isn't known, they are within credentialExpirySkew of expiring, or the credentials file no
+// longer holds them, having been removed, overwritten or issued for a role other than roleARN
+func credentialsValidFor(configFile string, sharedCreds *awsconfig.CredentialsProvider, roleARN string) time.Duration {
+	cfgm, err := cfg.NewConfigManager(configFile)
+	if err != nil {
+		return 0
+	}
+
+	credentialsFile, err := sharedCreds.Path()
+	if err != nil {
+		return 0
+	}
+
+	expires, err := cfgm.LoadCredentialExpiry(credentialsFile, sharedCreds.Profile)
+	if err != nil {
+		logrus.WithError(err).Debug("Unable to load credential expiry.")
+		return 0
+	}
+
+	remaining := time.Until(expires)
+	if remaining <= credentialExpirySkew {
+		return 0
+	}
+
+	savedCreds, err := sharedCreds.Load()
+	if err != nil {
+		logrus.WithError(err).Debug("Unable to load saved credentials.")
+		return 0
+	}
+	if !savedCreds.Expires.Truncate(time.Second).Equal(expires) {
+		logrus.Debug("Saved credentials aren't the ones saml2aws issued.")
+		return 0
+	}
+	if roleARN != "" && !assumedRole(savedCreds.PrincipalARN, roleARN) {
+		logrus.Debugf("Saved credentials are for %s, not %s.", savedCreds.PrincipalARN, roleARN)
+		return 0
+	}
+
+	return remaining
+}
+
+// assumedRole whether the assumed role session principalARN, arn:aws:sts::<account>:assumed-role/<name>/<session>,
+// is of the role roleARN, arn:aws:iam::<account>:role/<path><name>
+func assumedRole(principalARN, roleARN string) bool {
+	principal, err := arn.Parse(principalARN)
+	if err != nil {
+		return false
+	}
+	role, err := arn.Parse(roleARN)
+	if err != nil {
+		return false
+	}
+
+	principalParts := strings.Split(principal.Resource, "/")
+	roleParts := strings.Split(role.Resource, "/")
+	if len(principalParts) < 2 || principalParts[0] != "assumed-role" || roleParts[0] != "role" {
+		return false
+	}
+
+	return principal.Partition == role.Partition && principal.AccountID == role.AccountID &&
+		principalParts[1] == roleParts[len(roleParts)-1]
+}
+
+// reusableCredentials returns the saved credentials of the profile when they stay valid for longer than the
+// threshold, or nil when they have to be refreshed
+func reusableCredentials(sharedCreds *awsconfig.CredentialsProvider, threshold time.Duration) *awsconfig.AWSCredentials {
+	previousCreds, err := sharedCreds.Load()
+	if err != nil {
+		logrus.WithError(err).Debug("Unable to load saved credentials.")
+		return nil
+	}
+
+	if time.Until(previousCreds.Expires) <= threshold {
+		return nil
+	}
+
+	return previousCreds
+}
+
+// writeProfileConfig saves the account's region to the profile in the AWS config file when --write-region is set,
+// and its region and aws_output when write_aws_config is
+func writeProfileConfig(account *cfg.IDPAccount, profile string, loginFlags *flags.LoginExecFlags) error {
+	profileConfig := awsconfig.ProfileConfig{}
+	if loginFlags.WriteRegion || account.WriteAWSConfig {
+		profileConfig.Region = account.Region
+	}
+	if account.WriteAWSConfig {
+		profileConfig.Output = account.AWSOutput
+	}
+	if profileConfig == (awsconfig.ProfileConfig{}) {
+		return nil
+	}
+
+	err := awsconfig.SaveProfileConfig("", profile, profileConfig)
+	if err != nil {
+		return errors.Wrap(err, "Error saving profile settings to AWS config.")
+	}
+
+	return nil
+}
+
+// recordCredentialExpiry remembers when the saved credentials expire so later logins can skip the IdP
+func recordCredentialExpiry(configFile string, sharedCreds *awsconfig.CredentialsProvider, expires time.Time) {
+	cfgm, err := cfg.NewConfigManager(configFile)
+	if err != nil {
+		logrus.WithError(err).Warn("Unable to record credential expiry.")
+		return
+	}
+
+	credentialsFile, err := sharedCreds.Path()
+	if err == nil {
+		err = cfgm.SaveCredentialExpiry(credentialsFile, sharedCreds.Profile, expires)
+	}
+	if err != nil {
+		logrus.WithError(err).Warn("Unable to record credential expiry.")
+	}
+}
+
 func saveCredentials(awsCreds *awsconfig.AWSCredentials, sharedCreds *awsconfig.CredentialsProvider) error {
 	err := sharedCreds.Save(awsCreds)
 	if err != nil {
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"os"
+	"sync"
 
 	"github.com/versent/saml2aws/v2/helper/credentials"
 	"github.com/versent/saml2aws/v2/helper/linuxkeyring"
@@ -9,11 +10,47 @@ import (
 )
 
 func init() {
-	c := linuxkeyring.Configuration{
-		Backend: os.Getenv(cfg.KeyringBackEnvironmentVariableName),
+	credentials.CurrentHelper = &lazyKeyringHelper{
+		config: linuxkeyring.Configuration{
+			Backend: os.Getenv(cfg.KeyringBackEnvironmentVariableName),
+		},
+		fallback: credentials.CurrentHelper,
 	}
+}
 
-	if keyringHelper, err := linuxkeyring.NewKeyringHelper(c); err == nil {
-		credentials.CurrentHelper = keyringHelper
-	}
+// lazyKeyringHelper opens the keyring on first use, so it is never opened when disable_keyring replaces the
+// helper, falling back to storing nothing when no keyring backend is available
+type lazyKeyringHelper struct {
+	once     sync.Once
+	config   linuxkeyring.Configuration
+	fallback credentials.Helper
+	helper   credentials.Helper
+}
+
+func (h *lazyKeyringHelper) open() credentials.Helper {
+	h.once.Do(func() {
+		keyringHelper, err := linuxkeyring.NewKeyringHelper(h.config)
+		if err != nil {
+			h.helper = h.fallback
+			return
+		}
+		h.helper = keyringHelper
+	})
+	return h.helper
+}
+
+func (h *lazyKeyringHelper) Add(creds *credentials.Credentials) error {
+	return h.open().Add(creds)
+}
+
+func (h *lazyKeyringHelper) Delete(serverURL string) error {
+	return h.open().Delete(serverURL)
+}
+
+func (h *lazyKeyringHelper) Get(serverURL string) (string, string, error) {
+	return h.open().Get(serverURL)
+}
+
+func (h *lazyKeyringHelper) SupportsCredentialStorage() bool {
+	return h.open().SupportsCredentialStorage()
 }
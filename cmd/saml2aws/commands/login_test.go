@@ -1,17 +1,34 @@
 package commands
 
 import (
+	b64 "encoding/base64"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"text/template"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/stretchr/testify/assert"
 	"github.com/versent/saml2aws/v2"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/mocks"
 	"github.com/versent/saml2aws/v2/pkg/awsconfig"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+	"github.com/versent/saml2aws/v2/pkg/provider/identitycenter"
+	"github.com/versent/saml2aws/v2/pkg/totp"
 )
 
 func TestResolveLoginDetailsWithFlags(t *testing.T) {
@@ -64,6 +81,103 @@ func TestOktaResolveLoginDetailsWithFlags(t *testing.T) {
 
 }
 
+func TestResolveLoginDetailsCredentialProcess(t *testing.T) {
+
+	commonFlags := &flags.CommonFlags{URL: "https://id.example.com", Username: "wolfeidau", DisableKeychain: true, SkipPrompt: true}
+	loginFlags := &flags.LoginExecFlags{CommonFlags: commonFlags, CredentialProcess: true}
+
+	idpa := &cfg.IDPAccount{
+		URL:      "https://id.example.com",
+		MFA:      "none",
+		Provider: "Ping",
+		Username: "wolfeidau",
+	}
+
+	_, err := resolveLoginDetails(idpa, loginFlags)
+	assert.Error(t, err)
+
+	commonFlags.Password = "testtestlol"
+
+	loginDetails, err := resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+	assert.Equal(t, &creds.LoginDetails{Username: "wolfeidau", Password: "testtestlol", URL: "https://id.example.com"}, loginDetails)
+
+	commonFlags.Password = ""
+	idpa.Provider = "Browser"
+
+	_, err = resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+}
+
+func TestResolveLoginDetailsKeyringDisabled(t *testing.T) {
+
+	commonFlags := &flags.CommonFlags{URL: "https://id.example.com", Username: "wolfeidau", SkipPrompt: true}
+	loginFlags := &flags.LoginExecFlags{CommonFlags: commonFlags}
+
+	idpa := &cfg.IDPAccount{
+		URL:            "https://id.example.com",
+		MFA:            "none",
+		Provider:       "Ping",
+		Username:       "wolfeidau",
+		DisableKeyring: true,
+	}
+
+	_, err := resolveLoginDetails(idpa, loginFlags)
+	assert.EqualError(t, err, "The keyring is disabled and prompting is off, set the password with --password, SAML2AWS_PASSWORD or --password-file.")
+
+	commonFlags.Password = "testtestlol"
+
+	loginDetails, err := resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+	assert.Equal(t, &creds.LoginDetails{Username: "wolfeidau", Password: "testtestlol", URL: "https://id.example.com"}, loginDetails)
+
+	commonFlags.Password = ""
+	idpa.Provider = "Browser"
+
+	_, err = resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+}
+
+func TestResolveLoginDetailsPasswordFile(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, os.WriteFile(passwordFile, []byte("fromfile\n"), 0600))
+
+	commonFlags := &flags.CommonFlags{URL: "https://id.example.com", Username: "wolfeidau", PasswordFile: passwordFile, DisableKeychain: true, SkipPrompt: true}
+	loginFlags := &flags.LoginExecFlags{CommonFlags: commonFlags}
+
+	idpa := &cfg.IDPAccount{
+		URL:      "https://id.example.com",
+		MFA:      "none",
+		Provider: "Ping",
+		Username: "wolfeidau",
+	}
+
+	loginDetails, err := resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+	assert.Equal(t, "fromfile", loginDetails.Password)
+
+	// the password file beats SAML2AWS_PASSWORD, which kingpin hands over as the flag value
+	t.Setenv("SAML2AWS_PASSWORD", "fromenv")
+	commonFlags.Password = "fromenv"
+
+	loginDetails, err = resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+	assert.Equal(t, "fromfile", loginDetails.Password)
+
+	// an explicit --password beats the password file
+	commonFlags.Password = "fromflag"
+
+	loginDetails, err = resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+	assert.Equal(t, "fromflag", loginDetails.Password)
+
+	commonFlags.Password = ""
+	commonFlags.PasswordFile = filepath.Join(t.TempDir(), "missing")
+
+	_, err = resolveLoginDetails(idpa, loginFlags)
+	assert.Error(t, err)
+}
+
 func TestResolveRoleSingleEntry(t *testing.T) {
 
 	adminRole := &saml2aws.AWSRole{
@@ -76,7 +190,7 @@ func TestResolveRoleSingleEntry(t *testing.T) {
 		adminRole,
 	}
 
-	got, err := resolveRole(awsRoles, "", cfg.NewIDPAccount())
+	got, err := resolveRole(awsRoles, "", cfg.NewIDPAccount(), rolePrompt{interactive: true})
 	assert.Empty(t, err)
 	assert.Equal(t, got, adminRole)
 }
@@ -125,3 +239,717 @@ func TestCustomCredentialsFile(t *testing.T) {
 		t.Errorf("got %t, wanted %t", got, want)
 	}
 }
+
+func TestMaxSessionDurationFromError(t *testing.T) {
+	maxDuration, ok := maxSessionDurationFromError(awserr.New("ValidationError", "1 validation error detected: Value '50000' at 'durationSeconds' failed to satisfy constraint: Member must have value less than or equal to 43200", nil))
+	assert.True(t, ok)
+	assert.Equal(t, int64(43200), maxDuration)
+
+	maxDuration, ok = maxSessionDurationFromError(awserr.New("ValidationError", "The requested DurationSeconds exceeds the MaxSessionDuration set for this role.", nil))
+	assert.True(t, ok)
+	assert.Equal(t, int64(cfg.DefaultSessionDuration), maxDuration)
+
+	_, ok = maxSessionDurationFromError(awserr.New("AccessDenied", "Not authorized to perform sts:AssumeRoleWithSAML", nil))
+	assert.False(t, ok)
+
+	_, ok = maxSessionDurationFromError(fmt.Errorf("boom"))
+	assert.False(t, ok)
+}
+
+func TestSessionPolicy(t *testing.T) {
+	account := cfg.NewIDPAccount()
+
+	policy, err := sessionPolicy(account, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "", policy)
+
+	policy, err = sessionPolicy(account, `{
+  "Version": "2012-10-17",
+  "Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "*"}]
+}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`, policy)
+
+	_, err = sessionPolicy(account, `{"Version": "2012-10-17",`)
+	assert.ErrorContains(t, err, "Session policy of --policy isn't a JSON object.")
+
+	_, err = sessionPolicy(account, `["s3:GetObject"]`)
+	assert.ErrorContains(t, err, "Session policy of --policy isn't a JSON object.")
+
+	account.PolicyFile = filepath.Join(t.TempDir(), "policy.json")
+	err = os.WriteFile(account.PolicyFile, []byte(`{"Version": "2012-10-17", "Statement": []}`), 0600)
+	assert.Nil(t, err)
+
+	policy, err = sessionPolicy(account, "")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Version":"2012-10-17","Statement":[]}`, policy)
+
+	// --policy wins over policy_file
+	policy, err = sessionPolicy(account, `{"Statement": []}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Statement":[]}`, policy)
+
+	// whitespace doesn't count towards the size
+	statement := `{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bucket/*"}`
+	large := `{"Version": "2012-10-17", "Statement": [` + strings.Repeat(statement+",\n  ", 24) + statement + `]}`
+	assert.Greater(t, len(large), maxSessionPolicySize)
+	policy, err = sessionPolicy(account, large)
+	assert.Nil(t, err)
+	assert.Len(t, policy, 1988)
+
+	// the policy ARNs count too
+	account.PolicyARNs = "arn:aws:iam::aws:policy/ReadOnlyAccess, arn:aws:iam::aws:policy/SecurityAudit"
+	_, err = sessionPolicy(account, large)
+	assert.EqualError(t, err, "The session policy and policy ARNs are 2063 characters without whitespace, 15 more than the 2048 STS takes. Shorten the policy or use fewer policy ARNs.")
+
+	_, err = sessionPolicy(account, "")
+	assert.Nil(t, err)
+
+	account.PolicyFile = filepath.Join(t.TempDir(), "missing.json")
+	_, err = sessionPolicy(account, "")
+	assert.ErrorContains(t, err, "Failed to read policy_file.")
+}
+
+func TestPolicyDescriptors(t *testing.T) {
+	assert.Nil(t, policyDescriptors(nil))
+
+	descriptors := policyDescriptors([]string{"arn:aws:iam::aws:policy/ReadOnlyAccess", "arn:aws:iam::123456789012:policy/deny-iam"})
+	assert.Len(t, descriptors, 2)
+	assert.Equal(t, "arn:aws:iam::aws:policy/ReadOnlyAccess", aws.StringValue(descriptors[0].Arn))
+	assert.Equal(t, "arn:aws:iam::123456789012:policy/deny-iam", aws.StringValue(descriptors[1].Arn))
+}
+
+func TestClampSessionDuration(t *testing.T) {
+	account := cfg.NewIDPAccount()
+	loginFlags := &flags.LoginExecFlags{}
+
+	// off by default, the STS error fails the login
+	assert.False(t, clampSessionDuration(account, loginFlags))
+
+	account.AutoClampSessionDuration = true
+	assert.True(t, clampSessionDuration(account, loginFlags))
+
+	loginFlags.NoDurationFallback = true
+	assert.False(t, clampSessionDuration(account, loginFlags))
+}
+
+func TestRetrySessionDuration(t *testing.T) {
+	// the classic message doesn't say what the role allows
+	rejected := awserr.New("ValidationError", "The requested DurationSeconds exceeds the MaxSessionDuration set for this role.", nil)
+
+	duration, ok := retrySessionDuration(14400, rejected)
+	assert.True(t, ok)
+	assert.Equal(t, int64(3600), duration)
+
+	// nothing shorter to retry with
+	_, ok = retrySessionDuration(3600, rejected)
+	assert.False(t, ok)
+
+	_, ok = retrySessionDuration(14400, awserr.New("AccessDenied", "Not authorized to perform sts:AssumeRoleWithSAML", nil))
+	assert.False(t, ok)
+
+	// the constraint validation message has the maximum
+	duration, ok = retrySessionDuration(50000, awserr.New("ValidationError", "1 validation error detected: Value '50000' at 'durationSeconds' failed to satisfy constraint: Member must have value less than or equal to 43200", nil))
+	assert.True(t, ok)
+	assert.Equal(t, int64(43200), duration)
+
+	duration, ok = retrySessionDuration(28800, fmt.Errorf("error retrieving STS credentials using SAML: %w", awserr.New("ValidationError", "The requested DurationSeconds exceeds the 1 hour session limit for roles assumed by role chaining.", nil)))
+	assert.True(t, ok)
+	assert.Equal(t, int64(3600), duration)
+}
+
+func TestRoleAssertionsForRole(t *testing.T) {
+	first := &saml2aws.AuthenticationResult{SAMLAssertion: "first"}
+	logins := []string{}
+
+	assertions := &roleAssertions{
+		result: first,
+		urn:    cfg.DefaultAmazonWebservicesURN,
+		overrides: []cfg.URNOverride{
+			{Pattern: "arn:aws:iam::*:saml-provider/Billing", URN: "urn:amazon:webservices:billing"},
+			{Pattern: "arn:aws:iam::*:saml-provider/Empty", URN: "urn:amazon:webservices:empty"},
+		},
+		byURN: map[string]*saml2aws.AuthenticationResult{cfg.DefaultAmazonWebservicesURN: first},
+		authenticate: func(urn string) (*saml2aws.AuthenticationResult, error) {
+			logins = append(logins, urn)
+			if urn == "urn:amazon:webservices:empty" {
+				return &saml2aws.AuthenticationResult{}, nil
+			}
+			return &saml2aws.AuthenticationResult{SAMLAssertion: urn}, nil
+		},
+	}
+
+	result, err := assertions.forRole(&saml2aws.AWSRole{PrincipalARN: "arn:aws:iam::111122223333:saml-provider/Okta"})
+	assert.Nil(t, err)
+	assert.Same(t, first, result)
+
+	result, err = assertions.forRole(&saml2aws.AWSRole{PrincipalARN: "arn:aws:iam::111122223333:saml-provider/Billing"})
+	assert.Nil(t, err)
+	assert.Equal(t, "urn:amazon:webservices:billing", result.SAMLAssertion)
+
+	// the assertion of a URN is reused for the other roles it covers
+	_, err = assertions.forRole(&saml2aws.AWSRole{PrincipalARN: "arn:aws:iam::444455556666:saml-provider/Billing"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"urn:amazon:webservices:billing"}, logins)
+
+	_, err = assertions.forRole(&saml2aws.AWSRole{PrincipalARN: "arn:aws:iam::111122223333:saml-provider/Empty"})
+	assert.EqualError(t, err, "the IdP returned no SAML assertion for urn:amazon:webservices:empty")
+}
+
+func TestCredentialsValidFor(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "saml2aws")
+	sharedCreds := awsconfig.NewSharedCredentials("saml", filepath.Join(dir, "credentials"))
+	roleARN := "arn:aws:iam::123456789012:role/Admin"
+
+	assert.Zero(t, credentialsValidFor(configFile, sharedCreds, roleARN))
+
+	saml2awsCreds := &awsconfig.AWSCredentials{
+		AWSAccessKey:    "AKIA",
+		AWSSecretKey:    "secret",
+		AWSSessionToken: "token",
+		PrincipalARN:    "arn:aws:sts::123456789012:assumed-role/Admin/user@example.com",
+		Expires:         time.Now().Add(43 * time.Minute),
+	}
+	assert.Nil(t, sharedCreds.Save(saml2awsCreds))
+	recordCredentialExpiry(configFile, sharedCreds, saml2awsCreds.Expires)
+
+	remaining := credentialsValidFor(configFile, sharedCreds, roleARN)
+	assert.True(t, remaining > 42*time.Minute && remaining <= 43*time.Minute, remaining)
+	assert.Equal(t, remaining.Round(time.Minute), credentialsValidFor(configFile, sharedCreds, "").Round(time.Minute))
+
+	// credentials of another role in the profile
+	assert.Zero(t, credentialsValidFor(configFile, sharedCreds, "arn:aws:iam::123456789012:role/ReadOnly"))
+
+	// the same profile in another credentials file
+	assert.Zero(t, credentialsValidFor(configFile, awsconfig.NewSharedCredentials("saml", filepath.Join(dir, "other")), roleARN))
+
+	// the credentials were overwritten by something else
+	assert.Nil(t, sharedCreds.Save(&awsconfig.AWSCredentials{AWSAccessKey: "AKIB", AWSSecretKey: "secret", PrincipalARN: saml2awsCreds.PrincipalARN, Expires: time.Now().Add(2 * time.Hour)}))
+	assert.Zero(t, credentialsValidFor(configFile, sharedCreds, roleARN))
+
+	// the credentials were removed
+	assert.Nil(t, os.Remove(sharedCreds.Filename))
+	assert.Zero(t, credentialsValidFor(configFile, sharedCreds, roleARN))
+
+	// within the clock skew allowance counts as expired
+	saml2awsCreds.Expires = time.Now().Add(time.Minute)
+	assert.Nil(t, sharedCreds.Save(saml2awsCreds))
+	recordCredentialExpiry(configFile, sharedCreds, saml2awsCreds.Expires)
+	assert.Zero(t, credentialsValidFor(configFile, sharedCreds, roleARN))
+
+	assert.Zero(t, credentialsValidFor(configFile, awsconfig.NewSharedCredentials("other", sharedCreds.Filename), roleARN))
+}
+
+func TestAssumedRole(t *testing.T) {
+	assert.True(t, assumedRole("arn:aws:sts::123456789012:assumed-role/Admin/user", "arn:aws:iam::123456789012:role/Admin"))
+	assert.True(t, assumedRole("arn:aws:sts::123456789012:assumed-role/Admin/user", "arn:aws:iam::123456789012:role/team/Admin"))
+	assert.True(t, assumedRole("arn:aws-us-gov:sts::123456789012:assumed-role/Admin/user", "arn:aws-us-gov:iam::123456789012:role/Admin"))
+	assert.False(t, assumedRole("arn:aws:sts::123456789012:assumed-role/Admin/user", "arn:aws:iam::210987654321:role/Admin"))
+	assert.False(t, assumedRole("arn:aws:sts::123456789012:assumed-role/ReadOnly/user", "arn:aws:iam::123456789012:role/Admin"))
+	assert.False(t, assumedRole("", "arn:aws:iam::123456789012:role/Admin"))
+}
+
+func TestReusableCredentials(t *testing.T) {
+	sharedCreds := awsconfig.NewSharedCredentials("saml", filepath.Join(t.TempDir(), "credentials"))
+
+	assert.Nil(t, reusableCredentials(sharedCreds, 10*time.Minute))
+
+	err := sharedCreds.Save(&awsconfig.AWSCredentials{AWSAccessKey: "AKIA", AWSSecretKey: "secret", AWSSessionToken: "token", Expires: time.Now().Add(50 * time.Minute)})
+	assert.Nil(t, err)
+
+	previousCreds := reusableCredentials(sharedCreds, 10*time.Minute)
+	if assert.NotNil(t, previousCreds) {
+		assert.Equal(t, "AKIA", previousCreds.AWSAccessKey)
+	}
+
+	// expiring within the threshold means logging in again
+	assert.Nil(t, reusableCredentials(sharedCreds, time.Hour))
+}
+
+func TestSTSConfig(t *testing.T) {
+	account := cfg.NewIDPAccount()
+	account.Region = "us-east-1"
+
+	config := saml2aws.STSConfig(account)
+	assert.Equal(t, "us-east-1", aws.StringValue(config.Region))
+	assert.Equal(t, endpoints.UnsetSTSEndpoint, config.STSRegionalEndpoint)
+
+	account.STSRegion = "us-gov-west-1"
+
+	config = saml2aws.STSConfig(account)
+	assert.Equal(t, "us-gov-west-1", aws.StringValue(config.Region))
+	assert.Equal(t, endpoints.RegionalSTSEndpoint, config.STSRegionalEndpoint)
+}
+
+func TestRolePartitionEndpoints(t *testing.T) {
+	tests := []struct {
+		roleARN     string
+		stsEndpoint string
+		federation  string
+		console     string
+	}{
+		{"arn:aws:iam::123456789012:role/Admin", "https://sts.amazonaws.com", "https://signin.aws.amazon.com/federation", "https://console.aws.amazon.com/"},
+		{"arn:aws-us-gov:iam::123456789012:role/Admin", "https://sts.us-gov-west-1.amazonaws.com", "https://signin.amazonaws-us-gov.com/federation", "https://console.amazonaws-us-gov.com/"},
+		{"arn:aws-cn:iam::123456789012:role/Admin", "https://sts.cn-north-1.amazonaws.com.cn", "https://signin.amazonaws.cn/federation", "https://console.amazonaws.cn/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.roleARN, func(t *testing.T) {
+			account := cfg.NewIDPAccount()
+			account.Region = "us-east-1"
+			account.ApplyRolePartition(tt.roleARN)
+
+			config := saml2aws.STSConfig(account)
+			endpoint, err := endpoints.DefaultResolver().EndpointFor("sts", aws.StringValue(config.Region), func(o *endpoints.Options) {
+				o.STSRegionalEndpoint = config.STSRegionalEndpoint
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, tt.stsEndpoint, endpoint.URL)
+
+			creds := &awsconfig.AWSCredentials{PrincipalARN: tt.roleARN}
+			assert.Equal(t, tt.federation, federationURL(creds))
+			assert.Equal(t, tt.console, cfg.PartitionForARN(creds.PrincipalARN).ConsoleURL)
+		})
+	}
+}
+
+type fakeRoleAssumer struct {
+	keyID  string
+	inputs *[]*sts.AssumeRoleInput
+	err    error
+}
+
+func (f *fakeRoleAssumer) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	*f.inputs = append(*f.inputs, input)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String(f.keyID + "-next"),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+		AssumedRoleUser: &sts.AssumedRoleUser{
+			Arn: aws.String(fmt.Sprintf("%s/jane@example.com", aws.StringValue(input.RoleArn))),
+		},
+	}, nil
+}
+
+func TestAssumeRoleChain(t *testing.T) {
+	samlCreds := &awsconfig.AWSCredentials{
+		AWSAccessKey:   "saml",
+		PrincipalARN:   "arn:aws:sts::123456789012:assumed-role/landing/jane@example.com",
+		Region:         "ap-southeast-2",
+		SourceIdentity: "jane@example.com",
+	}
+	roleARNs := []string{"arn:aws:iam::123456789012:role/hop", "arn:aws:iam::210987654321:role/workload"}
+
+	var inputs []*sts.AssumeRoleInput
+	var signedWith []string
+	newClient := func(creds *awsconfig.AWSCredentials) (roleAssumer, error) {
+		signedWith = append(signedWith, creds.AWSAccessKey)
+		return &fakeRoleAssumer{keyID: creds.AWSAccessKey, inputs: &inputs}, nil
+	}
+
+	awsCreds, err := assumeRoleChain(roleARNs, samlCreds, roleChainOptions{duration: 3600}, newClient)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"saml", "saml-next"}, signedWith)
+	assert.Equal(t, "saml-next-next", awsCreds.AWSAccessKey)
+	assert.Equal(t, "arn:aws:iam::210987654321:role/workload/jane@example.com", awsCreds.PrincipalARN)
+	assert.Equal(t, "ap-southeast-2", awsCreds.Region)
+	assert.Equal(t, "jane@example.com", awsCreds.SourceIdentity)
+	assert.Len(t, inputs, 2)
+	assert.Equal(t, "jane@example.com", aws.StringValue(inputs[0].RoleSessionName))
+	assert.Equal(t, int64(3600), aws.Int64Value(inputs[1].DurationSeconds))
+
+	// no chain leaves the SAML credentials alone
+	awsCreds, err = assumeRoleChain(nil, samlCreds, roleChainOptions{duration: 3600}, newClient)
+	assert.Nil(t, err)
+	assert.Equal(t, samlCreds, awsCreds)
+
+	inputs = nil
+	failing := func(creds *awsconfig.AWSCredentials) (roleAssumer, error) {
+		if creds.AWSAccessKey == "saml" {
+			return &fakeRoleAssumer{keyID: creds.AWSAccessKey, inputs: &inputs}, nil
+		}
+		return &fakeRoleAssumer{inputs: &inputs, err: awserr.New("AccessDenied", "not authorized to perform sts:AssumeRole", nil)}, nil
+	}
+	_, err = assumeRoleChain(roleARNs, samlCreds, roleChainOptions{duration: 3600}, failing)
+	assert.EqualError(t, err, "Error assuming role arn:aws:iam::210987654321:role/workload, 2 of 2 in role_chain, with the credentials of arn:aws:iam::123456789012:role/hop/jane@example.com.: AccessDenied: not authorized to perform sts:AssumeRole")
+
+	// the external ID and session name are passed at every hop
+	inputs = nil
+	_, err = assumeRoleChain(roleARNs, samlCreds, roleChainOptions{duration: 900, externalID: "landing-zone", sessionName: "deploy"}, newClient)
+	assert.Nil(t, err)
+	assert.Len(t, inputs, 2)
+	for _, input := range inputs {
+		assert.Equal(t, "landing-zone", aws.StringValue(input.ExternalId))
+		assert.Equal(t, "deploy", aws.StringValue(input.RoleSessionName))
+		assert.Equal(t, int64(900), aws.Int64Value(input.DurationSeconds))
+	}
+}
+
+func TestEnvBaseCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+
+	awsCreds, err := envBaseCredentials(awscredentials.NewEnvCredentials(), "ap-southeast-2")
+	assert.Nil(t, err)
+	assert.Equal(t, &awsconfig.AWSCredentials{
+		AWSAccessKey:     "AKIDEXAMPLE",
+		AWSSecretKey:     "secret",
+		AWSSessionToken:  "token",
+		AWSSecurityToken: "token",
+		Region:           "ap-southeast-2",
+	}, awsCreds)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_ACCESS_KEY", "")
+	_, err = envBaseCredentials(awscredentials.NewEnvCredentials(), "ap-southeast-2")
+	assert.EqualError(t, err, "SAML2AWS_USE_ENV_BASE is set but no AWS credentials were found, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or run where an instance profile is attached.: EnvAccessKeyNotFound: AWS_ACCESS_KEY_ID or AWS_ACCESS_KEY not found in environment")
+}
+
+func TestLoginUseEnvBaseNeedsRoleChain(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte("[default]\nurl = https://id.example.com\nprovider = Okta\nmfa = Auto\n"), 0600))
+
+	loginFlags := &flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{ConfigFile: configFile, IdpAccount: "default"}, UseEnvBase: true}
+	err := Login(loginFlags)
+	assert.EqualError(t, err, "SAML2AWS_USE_ENV_BASE starts role_chain from the AWS credentials of the environment, set role_chain on the IDP account.")
+}
+
+func TestChainedSessionDuration(t *testing.T) {
+	account := cfg.NewIDPAccount()
+
+	account.RoleChainSessionDuration = 900
+	assert.Equal(t, int64(900), chainedSessionDuration(account))
+
+	account.RoleChainSessionDuration = 43200
+	assert.Equal(t, int64(maxChainedSessionDuration), chainedSessionDuration(account))
+
+	// aws_session_duration is for the SAML role only
+	account.RoleChainSessionDuration = 0
+	account.SessionDuration = 900
+	assert.Equal(t, int64(maxChainedSessionDuration), chainedSessionDuration(account))
+}
+
+func TestBuildIdpAccountPromptTimeout(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte("[work]\nurl = https://id.example.com\nprovider = KeyCloak\nmfa = Auto\nprompt_timeout = 30\n"), 0600))
+
+	defer prompter.SetPrompter(prompter.ActivePrompter)
+	prompter.SetPrompter(&mocks.Prompter{})
+
+	account, _, err := buildIdpAccount(&flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{ConfigFile: configFile, IdpAccount: "work"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 30, account.PromptTimeout)
+
+	timeoutPrompter, ok := prompter.ActivePrompter.(*prompter.TimeoutPrompter)
+	if assert.True(t, ok) {
+		assert.Equal(t, 30*time.Second, timeoutPrompter.Timeout)
+	}
+}
+
+func TestBuildIdpAccountURNOverrides(t *testing.T) {
+	account, overrides, err := buildIdpAccount(&flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{ConfigFile: "../../../pkg/cfg/example/saml2aws.urn_overrides.ini", IdpAccount: "work"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "work", account.Name)
+	assert.Equal(t, []cfg.URNOverride{
+		{Pattern: "arn:aws:iam::111122223333:saml-provider/Billing", URN: "urn:amazon:webservices:billing"},
+		{Pattern: "arn:aws:iam::*:saml-provider/Legacy*", URN: "urn:amazon:webservices:legacy"},
+	}, overrides)
+}
+
+func TestWriteProfileConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config")
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+
+	account := cfg.NewIDPAccount()
+	account.Region = "eu-west-1"
+	account.AWSOutput = "json"
+
+	err := writeProfileConfig(account, "saml", &flags.LoginExecFlags{})
+	assert.Nil(t, err)
+	_, err = os.Stat(configFile)
+	assert.True(t, os.IsNotExist(err))
+
+	err = writeProfileConfig(account, "saml", &flags.LoginExecFlags{WriteRegion: true})
+	assert.Nil(t, err)
+	data, err := os.ReadFile(configFile)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "[profile saml]")
+	assert.Contains(t, string(data), "eu-west-1")
+	assert.NotContains(t, string(data), "output")
+
+	account.WriteAWSConfig = true
+	err = writeProfileConfig(account, "saml", &flags.LoginExecFlags{})
+	assert.Nil(t, err)
+	data, err = os.ReadFile(configFile)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "eu-west-1")
+	assert.Contains(t, string(data), "json")
+}
+
+func TestIdentityCenterAccounts(t *testing.T) {
+	roles := []identitycenter.Role{
+		{AccountID: "123456789012", AccountName: "production", RoleName: "ReadOnly"},
+		{AccountID: "210987654321", AccountName: "sandbox", RoleName: "Developer"},
+		{AccountID: "123456789012", AccountName: "production", RoleName: "Admin"},
+	}
+
+	awsRoles, awsAccounts := identityCenterAccounts(roles, "us-east-1")
+	assert.Len(t, awsRoles, 3)
+	assert.Equal(t, "arn:aws:iam::210987654321:role/Developer", awsRoles[1].RoleARN)
+	assert.Len(t, awsAccounts, 2)
+	assert.Equal(t, "Account: production (123456789012)", awsAccounts[0].Name)
+	assert.Equal(t, []*saml2aws.AWSRole{awsRoles[0], awsRoles[2]}, awsAccounts[0].Roles)
+	assert.Equal(t, "Account: sandbox (210987654321)", awsAccounts[1].Name)
+
+	account := &cfg.IDPAccount{RoleARN: "arn:aws:iam::123456789012:role/Admin"}
+	role, err := chooseRole(awsRoles, awsAccounts, account, rolePrompt{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, indexOfRole(awsRoles, role))
+
+	_, err = chooseRole(awsRoles, awsAccounts, &cfg.IDPAccount{}, rolePrompt{})
+	assert.EqualError(t, err, "Multiple roles available, set role_arn or role_matcher in the IdP account or use --role to pick one.")
+
+	// role_arn beats role_matcher
+	account.RoleMatcher = "ReadOnly"
+	role, err = chooseRole(awsRoles, awsAccounts, account, rolePrompt{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, indexOfRole(awsRoles, role))
+
+	role, err = chooseRole(awsRoles, awsAccounts, &cfg.IDPAccount{RoleMatcher: "ReadOnly"}, rolePrompt{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, indexOfRole(awsRoles, role))
+}
+
+func TestChooseRoleFilter(t *testing.T) {
+	roles := []identitycenter.Role{
+		{AccountID: "123456789012", AccountName: "production", RoleName: "ReadOnly"},
+		{AccountID: "210987654321", AccountName: "sandbox", RoleName: "Developer"},
+		{AccountID: "123456789012", AccountName: "production", RoleName: "Admin"},
+		{AccountID: "210987654321", AccountName: "sandbox", RoleName: "Admin"},
+	}
+	awsRoles, awsAccounts := identityCenterAccounts(roles, "us-east-1")
+
+	// a filter leaving one role picks it without asking
+	role, err := chooseRole(awsRoles, awsAccounts, &cfg.IDPAccount{RoleFilter: "Developer"}, rolePrompt{})
+	assert.Nil(t, err)
+	assert.Equal(t, awsRoles[1], role)
+
+	defer prompter.SetPrompter(prompter.ActivePrompter)
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	options := []string{"Account: production (123456789012) / Admin", "Account: sandbox (210987654321) / Admin"}
+	pr.Mock.On("ChooseWithDefault", "Please choose the role", options[0], options).Return(options[1], nil).Once()
+
+	role, err = chooseRole(awsRoles, awsAccounts, &cfg.IDPAccount{RoleFilter: "Admin"}, rolePrompt{interactive: true})
+	assert.Nil(t, err)
+	assert.Equal(t, awsRoles[3], role)
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestChooseRoleRemembered(t *testing.T) {
+	roles := []identitycenter.Role{
+		{AccountID: "123456789012", AccountName: "production", RoleName: "ReadOnly"},
+		{AccountID: "210987654321", AccountName: "sandbox", RoleName: "Developer"},
+	}
+	awsRoles, awsAccounts := identityCenterAccounts(roles, "us-east-1")
+	options := []string{"Account: production (123456789012) / ReadOnly", "Account: sandbox (210987654321) / Developer"}
+
+	defer prompter.SetPrompter(prompter.ActivePrompter)
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("ChooseWithDefault", "Please choose the role", options[1], options).Return(options[1], nil).Once()
+	pr.Mock.On("ChooseWithDefault", "Please choose the role", options[0], options).Return(options[0], nil).Once()
+
+	role, err := chooseRole(awsRoles, awsAccounts, &cfg.IDPAccount{}, rolePrompt{interactive: true, lastRoleARN: "arn:aws:iam::210987654321:role/Developer"})
+	assert.Nil(t, err)
+	assert.Equal(t, awsRoles[1], role)
+
+	// a remembered role no longer in the list leaves the menu as it is
+	role, err = chooseRole(awsRoles, awsAccounts, &cfg.IDPAccount{}, rolePrompt{interactive: true, lastRoleARN: "arn:aws:iam::999999999999:role/Gone"})
+	assert.Nil(t, err)
+	assert.Equal(t, awsRoles[0], role)
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestRememberRole(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	account := &cfg.IDPAccount{Name: "work"}
+	loginFlags := &flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{ConfigFile: configFile}}
+
+	assert.Empty(t, lastRole(account, loginFlags))
+
+	rememberRole(account, "arn:aws:iam::123456789012:role/Admin", "", loginFlags)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/Admin", lastRole(account, loginFlags))
+
+	loginFlags.NoRememberRole = true
+	assert.Empty(t, lastRole(account, loginFlags))
+	rememberRole(account, "arn:aws:iam::123456789012:role/ReadOnly", "", loginFlags)
+
+	loginFlags.NoRememberRole = false
+	account.DisableRememberRole = true
+	assert.Empty(t, lastRole(account, loginFlags))
+
+	account.DisableRememberRole = false
+	assert.Equal(t, "arn:aws:iam::123456789012:role/Admin", lastRole(account, loginFlags))
+
+	// role_arn picks the role so there is nothing to remember
+	account.RoleARN = "arn:aws:iam::123456789012:role/ReadOnly"
+	assert.Empty(t, lastRole(account, loginFlags))
+}
+
+func TestAllRoleTargets(t *testing.T) {
+	awsRoles := []*saml2aws.AWSRole{
+		{RoleARN: "arn:aws:iam::210987654321:role/Admin"},
+		{RoleARN: "arn:aws:iam::123456789012:role/Admin"},
+		{RoleARN: "arn:aws:iam::123456789012:role/teams/Data+Science"},
+	}
+
+	targets, err := allRoleTargets(awsRoles, nil, "saml")
+	assert.Nil(t, err)
+	assert.Equal(t, []cfg.RoleTarget{
+		{RoleARN: "arn:aws:iam::123456789012:role/Admin", Profile: "Admin-123456789012"},
+		{RoleARN: "arn:aws:iam::123456789012:role/teams/Data+Science", Profile: "Data-Science"},
+		{RoleARN: "arn:aws:iam::210987654321:role/Admin", Profile: "Admin-210987654321"},
+	}, targets)
+
+	tmpl := template.Must(template.New("all_roles_profile").Parse("{{.Profile}}-{{.AccountID}}-{{.RoleName}}"))
+	targets, err = allRoleTargets(awsRoles, tmpl, "saml")
+	assert.Nil(t, err)
+	assert.Equal(t, "saml-123456789012-Admin", targets[0].Profile)
+	assert.Equal(t, "saml-210987654321-Admin", targets[2].Profile)
+
+	// the account ID doesn't tell apart roles the template names the same in one account
+	tmpl = template.Must(template.New("all_roles_profile").Parse("{{.Profile}}"))
+	targets, err = allRoleTargets(awsRoles, tmpl, "saml")
+	assert.Nil(t, err)
+	assert.Equal(t, "saml-123456789012", targets[0].Profile)
+	assert.Equal(t, "saml-123456789012-2", targets[1].Profile)
+	assert.Equal(t, "saml-210987654321", targets[2].Profile)
+}
+
+func TestResolveLoginDetailsTOTPFromKeyring(t *testing.T) {
+	helperMock := &mocks.Helper{}
+	helperMock.Mock.On("Get", "https://id.example.com").Return("", "", credentials.ErrCredentialsNotFound)
+	helperMock.Mock.On("Get", "saml2aws://totp/work").Return("work", "JBSWY3DPEHPK3PXP", nil).Once()
+	oldCurrentHelper := credentials.CurrentHelper
+	defer func() {
+		credentials.CurrentHelper = oldCurrentHelper
+	}()
+	credentials.CurrentHelper = helperMock
+
+	commonFlags := &flags.CommonFlags{IdpAccount: "work", Username: "wolfeidau", Password: "testtestlol", SkipPrompt: true}
+	loginFlags := &flags.LoginExecFlags{CommonFlags: commonFlags}
+
+	idpa := &cfg.IDPAccount{
+		URL:      "https://id.example.com",
+		MFA:      "TOTP",
+		Provider: "Okta",
+		Username: "wolfeidau",
+	}
+
+	before, err := totp.Code("JBSWY3DPEHPK3PXP", time.Now())
+	assert.Nil(t, err)
+	loginDetails, err := resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+	after, err := totp.Code("JBSWY3DPEHPK3PXP", time.Now())
+	assert.Nil(t, err)
+	assert.Contains(t, []string{before, after}, loginDetails.MFAToken)
+
+	// a code given on the command line is used as is
+	commonFlags.MFAToken = "123456"
+	loginDetails, err = resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+	assert.Equal(t, "123456", loginDetails.MFAToken)
+
+	// other MFAs never look for a seed
+	commonFlags.MFAToken = ""
+	idpa.MFA = "PUSH"
+	loginDetails, err = resolveLoginDetails(idpa, loginFlags)
+	assert.Nil(t, err)
+	assert.Equal(t, "", loginDetails.MFAToken)
+	helperMock.AssertExpectations(t)
+}
+
+// passwordAssertion the assertion passwordClient returns for the right password, without any roles
+var passwordAssertion = b64.StdEncoding.EncodeToString([]byte(`<Response><Assertion><AttributeStatement></AttributeStatement></Assertion></Response>`))
+
+// passwordClient rejects every password but the right one
+type passwordClient struct {
+	password string
+	err      error
+	attempts int
+}
+
+func (pc *passwordClient) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	pc.attempts++
+	if pc.err != nil {
+		return "", pc.err
+	}
+	if loginDetails.Password != pc.password {
+		return "", provider.InvalidCredentials("Invalid username or password.")
+	}
+	return passwordAssertion, nil
+}
+
+func (pc *passwordClient) Validate(loginDetails *creds.LoginDetails) error {
+	return nil
+}
+
+func TestAuthenticateWithRetries(t *testing.T) {
+	defer prompter.SetPrompter(prompter.ActivePrompter)
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Password", "Password").Return("wrong again").Once()
+	pr.Mock.On("Password", "Password").Return("secret").Once()
+
+	client := &passwordClient{password: "secret"}
+	loginDetails := &creds.LoginDetails{Username: "alice", Password: "wrong"}
+
+	result, err := authenticateWithRetries(client, loginDetails, "", 2, true)
+	assert.Nil(t, err)
+	assert.Equal(t, passwordAssertion, result.SAMLAssertion)
+	assert.Equal(t, 3, client.attempts)
+	assert.Equal(t, "secret", loginDetails.Password)
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestAuthenticateWithRetriesGivesUp(t *testing.T) {
+	defer prompter.SetPrompter(prompter.ActivePrompter)
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Password", "Password").Return("wrong again").Once()
+
+	client := &passwordClient{password: "secret"}
+
+	_, err := authenticateWithRetries(client, &creds.LoginDetails{Password: "wrong"}, "", 1, true)
+	assert.True(t, errors.Is(err, provider.ErrInvalidCredentials))
+	assert.Equal(t, 2, client.attempts)
+	pr.Mock.AssertExpectations(t)
+
+	// nobody to ask, no retries
+	client = &passwordClient{password: "secret"}
+	_, err = authenticateWithRetries(client, &creds.LoginDetails{Password: "wrong"}, "", 3, false)
+	assert.EqualError(t, err, "Invalid username or password.")
+	assert.Equal(t, 1, client.attempts)
+}
+
+func TestAuthenticateWithRetriesOtherErrors(t *testing.T) {
+	defer prompter.SetPrompter(prompter.ActivePrompter)
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+
+	client := &passwordClient{err: fmt.Errorf("error retrieving page: %w", &url.Error{Op: "Get", URL: "https://id.example.com", Err: errors.New("connection refused")})}
+
+	_, err := authenticateWithRetries(client, &creds.LoginDetails{Password: "secret"}, "", 3, true)
+	assert.ErrorContains(t, err, "connection refused")
+	assert.Equal(t, 1, client.attempts)
+	pr.Mock.AssertNotCalled(t, "Password", "Password")
+}
@@ -0,0 +1,176 @@
+package commands
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+const (
+	// refreshMargin how long before the credentials expire the watch logs in again
+	refreshMargin = 5 * time.Minute
+	// refreshMinBackoff the wait after the first failed refresh, doubled after each failure in a row
+	refreshMinBackoff = 30 * time.Second
+	// refreshMaxBackoff the longest wait between failed refreshes, so a broken login doesn't hammer the IdP
+	refreshMaxBackoff = 15 * time.Minute
+	// refreshMinWait the shortest wait after a successful refresh, for sessions shorter than refreshMargin
+	refreshMinWait = time.Minute
+)
+
+// refreshWatch keeps credentials fresh, logging in again shortly before they expire
+type refreshWatch struct {
+	login func() error
+	// expiry when the credentials saved by the last login expire
+	expiry     func() (time.Time, error)
+	margin     time.Duration
+	minWait    time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Refresh logs in, and with watch keeps logging in again without prompting shortly before the credentials expire,
+// updating the profile in place until interrupted
+func Refresh(loginFlags *flags.LoginExecFlags, watch bool) error {
+	err := Login(loginFlags)
+	if err != nil || !watch {
+		return err
+	}
+
+	account, _, err := buildIdpAccount(loginFlags)
+	if err != nil {
+		return errors.Wrap(err, "Error building login details.")
+	}
+
+	profile := account.CredentialsProfile(account.RoleARN)
+	roleTargets, err := account.RoleTargets()
+	if err != nil {
+		return errors.Wrap(err, "Error building login details.")
+	}
+	if len(roleTargets) > 0 {
+		profile = roleTargets[0].Profile
+	}
+	if account.ProfileTemplate != "" && account.RoleARN == "" && len(roleTargets) == 0 {
+		return errors.New("refresh --watch needs role_arn set when profile_template names the profile after the role.")
+	}
+
+	// the role picked from the menu is picked again without asking
+	if account.RoleARN == "" && account.RoleMatcher == "" && len(roleTargets) == 0 {
+		loginFlags.CommonFlags.RoleArn = lastRole(account, loginFlags)
+	}
+
+	// nobody is there to answer, the password and MFA have to come from the keychain, flags or environment
+	loginFlags.Force = true
+	loginFlags.CommonFlags.SkipPrompt = true
+	prompter.SetPrompter(prompter.NewNonInteractivePrompter())
+
+	sharedCreds, err := loginCredentials(account, profile, loginFlags)
+	if err != nil {
+		return err
+	}
+
+	w := &refreshWatch{
+		login: func() error { return Login(loginFlags) },
+		expiry: func() (time.Time, error) {
+			creds, err := sharedCreds.Load()
+			if err != nil {
+				return time.Time{}, err
+			}
+			return creds.Expires, nil
+		},
+		margin:     refreshMargin,
+		minWait:    refreshMinWait,
+		minBackoff: refreshMinBackoff,
+		maxBackoff: refreshMaxBackoff,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w.run(ctx)
+
+	log.Println("Stopped refreshing credentials.")
+	return nil
+}
+
+// run logs in shortly before each expiry until the context is done, backing off after failed logins. A login
+// that leaves the expiry where it was counts as failed, and after a successful one the watch waits at least
+// minWait, so a session shorter than the margin doesn't have it log in again straight away.
+func (w *refreshWatch) run(ctx context.Context) {
+	backoff := w.minBackoff
+	retrying := false
+
+	for {
+		wait := backoff
+		expires, expiryErr := w.expiry()
+		if expiryErr != nil {
+			log.Printf("Unable to load the credentials, logging in again in %v: %v", wait, expiryErr)
+		} else {
+			wait = time.Until(expires) - w.margin
+			// after a failure the backoff has already been waited
+			if !retrying && wait < w.minWait {
+				wait = w.minWait
+			}
+			log.Printf("Credentials expire at %v, refreshing them in %v.", expires.Local().Format(time.RFC1123), wait.Round(time.Second))
+		}
+
+		if !sleepContext(ctx, wait) {
+			return
+		}
+
+		err := w.login()
+		if err == nil && expiryErr == nil {
+			err = w.checkRenewed(expires)
+		}
+		if err == nil {
+			backoff = w.minBackoff
+			retrying = false
+			continue
+		}
+
+		log.Printf("Unable to refresh the credentials, trying again in %v: %v", backoff, err)
+		if !sleepContext(ctx, backoff) {
+			return
+		}
+		retrying = true
+		backoff *= 2
+		if backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// checkRenewed fails when the credentials saved by the login don't expire later than previous
+func (w *refreshWatch) checkRenewed(previous time.Time) error {
+	expires, err := w.expiry()
+	if err != nil {
+		return err
+	}
+	if !expires.After(previous) {
+		return errors.Errorf("the login didn't renew the credentials, they still expire at %v", expires.Local().Format(time.RFC1123))
+	}
+	return nil
+}
+
+// sleepContext waits for d, returning false if the context is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
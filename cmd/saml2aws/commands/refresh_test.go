@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshWatchLogsInBeforeExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	expires := time.Now().Add(50 * time.Millisecond)
+	logins := 0
+	w := &refreshWatch{
+		login: func() error {
+			logins++
+			if logins == 2 {
+				cancel()
+			}
+			expires = time.Now().Add(50 * time.Millisecond)
+			return nil
+		},
+		expiry:     func() (time.Time, error) { return expires, nil },
+		margin:     40 * time.Millisecond,
+		minWait:    5 * time.Millisecond,
+		minBackoff: time.Second,
+		maxBackoff: time.Second,
+	}
+
+	start := time.Now()
+	w.run(ctx)
+
+	assert.Equal(t, 2, logins)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRefreshWatchBacksOff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var attempts []time.Time
+	w := &refreshWatch{
+		login: func() error {
+			attempts = append(attempts, time.Now())
+			if len(attempts) == 4 {
+				cancel()
+			}
+			return errors.New("password rejected")
+		},
+		expiry:     func() (time.Time, error) { return time.Now().Add(-time.Minute), nil },
+		margin:     time.Minute,
+		minWait:    time.Millisecond,
+		minBackoff: 20 * time.Millisecond,
+		maxBackoff: 40 * time.Millisecond,
+	}
+
+	w.run(ctx)
+
+	assert.Len(t, attempts, 4)
+	assert.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), 20*time.Millisecond)
+	assert.GreaterOrEqual(t, attempts[2].Sub(attempts[1]), 40*time.Millisecond)
+	// the backoff stops growing at the maximum
+	assert.Less(t, attempts[3].Sub(attempts[2]), 80*time.Millisecond)
+}
+
+func TestRefreshWatchStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	logins := 0
+	w := &refreshWatch{
+		login:      func() error { logins++; return nil },
+		expiry:     func() (time.Time, error) { return time.Now().Add(time.Hour), nil },
+		margin:     time.Minute,
+		minWait:    time.Second,
+		minBackoff: time.Second,
+		maxBackoff: time.Second,
+	}
+
+	w.run(ctx)
+
+	assert.Equal(t, 0, logins)
+}
+
+func TestRefreshWatchWaitsAfterShortSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the session is shorter than the margin
+	expires := time.Now().Add(10 * time.Millisecond)
+	var logins []time.Time
+	w := &refreshWatch{
+		login: func() error {
+			logins = append(logins, time.Now())
+			if len(logins) == 3 {
+				cancel()
+			}
+			expires = time.Now().Add(10 * time.Millisecond)
+			return nil
+		},
+		expiry:     func() (time.Time, error) { return expires, nil },
+		margin:     time.Minute,
+		minWait:    30 * time.Millisecond,
+		minBackoff: time.Second,
+		maxBackoff: time.Second,
+	}
+
+	w.run(ctx)
+
+	assert.Len(t, logins, 3)
+	assert.GreaterOrEqual(t, logins[1].Sub(logins[0]), 30*time.Millisecond)
+	assert.GreaterOrEqual(t, logins[2].Sub(logins[1]), 30*time.Millisecond)
+}
+
+func TestRefreshWatchBacksOffWhenExpiryStays(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the login succeeds but the credentials it saves don't move on
+	expires := time.Now().Add(time.Second)
+	var logins []time.Time
+	w := &refreshWatch{
+		login: func() error {
+			logins = append(logins, time.Now())
+			if len(logins) == 3 {
+				cancel()
+			}
+			return nil
+		},
+		expiry:     func() (time.Time, error) { return expires, nil },
+		margin:     time.Minute,
+		minWait:    time.Millisecond,
+		minBackoff: 20 * time.Millisecond,
+		maxBackoff: time.Second,
+	}
+
+	w.run(ctx)
+
+	assert.Len(t, logins, 3)
+	assert.GreaterOrEqual(t, logins[1].Sub(logins[0]), 20*time.Millisecond)
+	assert.GreaterOrEqual(t, logins[2].Sub(logins[1]), 40*time.Millisecond)
+}
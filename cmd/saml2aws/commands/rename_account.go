@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/provider/okta"
+	"github.com/versent/saml2aws/v2/pkg/samlcache"
+)
+
+// RenameAccount renames an IDP account along with the last role, SAML cache file, Okta device state and TOTP seed keyed by its name, stored
+// credentials are keyed by the account URL so they carry over unchanged
+func RenameAccount(commonFlags *flags.CommonFlags, oldName, newName string) error {
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	accounts, err := cfgm.ListIDPAccounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to load idp accounts")
+	}
+
+	account, ok := accounts[oldName]
+	if !ok {
+		return cfg.ErrIdpAccountNotFound
+	}
+
+	err = cfgm.RenameIDPAccount(oldName, newName)
+	if err != nil {
+		return errors.Wrap(err, "failed to rename idp account")
+	}
+
+	log.Printf("Renamed IDP account %s to %s", oldName, newName)
+
+	err = cfgm.RenameLastRole(oldName, newName)
+	if err != nil {
+		return errors.Wrap(err, "failed to rename the last role")
+	}
+
+	cacheProvider := &samlcache.SAMLCacheProvider{
+		Account:  oldName,
+		Filename: account.SAMLCacheFile,
+		Encrypt:  account.SAMLCacheEncrypt,
+	}
+	if err := cacheProvider.Rename(newName); err != nil {
+		return errors.Wrap(err, "error renaming SAML cache")
+	}
+
+	if err := okta.RenameDeviceState(oldName, newName); err != nil {
+		return errors.Wrap(err, "error renaming Okta device state")
+	}
+
+	// unlike the password the TOTP seed is keyed by the account name
+	if !commonFlags.DisableKeychain && !account.DisableKeyring {
+		if err := credentials.RenameTOTPSecret(oldName, newName); err != nil {
+			return errors.Wrap(err, "error moving TOTP seed in keychain")
+		}
+	}
+
+	return nil
+}
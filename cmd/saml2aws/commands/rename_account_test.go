@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+func TestRenameAccount(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "saml2aws")
+	cacheFile := filepath.Join(dir, "cache_remove")
+	assert.Nil(t, os.WriteFile(configFile, []byte(deleteAccountConfig+"\n[remove]\nsaml_cache_file = "+cacheFile+"\n"), 0600))
+
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+	oktaState := filepath.Join(dir, "xdg", "saml2aws", "okta", "remove.json")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(oktaState), 0700))
+	assert.Nil(t, os.WriteFile(oktaState, []byte(`{"dt":"dt-123"}`), 0600))
+
+	cfgm, err := cfg.NewConfigManager(configFile)
+	assert.Nil(t, err)
+	assert.Nil(t, cfgm.SaveLastRole("remove", "arn:aws:iam::123456789012:role/Admin"))
+
+	err = RenameAccount(&flags.CommonFlags{ConfigFile: configFile}, "remove", "renamed")
+	assert.Nil(t, err)
+
+	roleARN, err := cfgm.LoadLastRole("renamed")
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/Admin", roleARN)
+	roleARN, err = cfgm.LoadLastRole("remove")
+	assert.Nil(t, err)
+	assert.Empty(t, roleARN)
+
+	account, err := cfgm.LoadIDPAccount("renamed")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://other.example.com", account.URL)
+	assert.Equal(t, cacheFile, account.SAMLCacheFile)
+
+	_, err = os.Stat(oktaState)
+	assert.True(t, os.IsNotExist(err))
+	data, err := os.ReadFile(filepath.Join(dir, "xdg", "saml2aws", "okta", "renamed.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"dt":"dt-123"}`, string(data))
+
+	err = RenameAccount(&flags.CommonFlags{ConfigFile: configFile}, "remove", "again")
+	assert.Equal(t, cfg.ErrIdpAccountNotFound, err)
+}
+
+func TestRenameAccountMovesTOTPSecret(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte(deleteAccountConfig), 0600))
+
+	helperMock := &mocks.Helper{}
+	helperMock.Mock.On("Get", "saml2aws://totp/remove").Return("remove", "JBSWY3DPEHPK3PXP", nil).Once()
+	helperMock.Mock.On("Add", &credentials.Credentials{ServerURL: "saml2aws://totp/renamed", Username: "renamed", Secret: "JBSWY3DPEHPK3PXP"}).Return(nil).Once()
+	helperMock.Mock.On("Delete", "saml2aws://totp/remove").Return(nil).Once()
+	oldCurrentHelper := credentials.CurrentHelper
+	credentials.CurrentHelper = helperMock
+	defer func() { credentials.CurrentHelper = oldCurrentHelper }()
+
+	err := RenameAccount(&flags.CommonFlags{ConfigFile: configFile}, "remove", "renamed")
+	assert.Nil(t, err)
+	helperMock.AssertExpectations(t)
+
+	// an account without a seed has nothing to move
+	helperMock.Mock.On("Get", "saml2aws://totp/keep").Return("", "", credentials.ErrCredentialsNotFound).Once()
+
+	err = RenameAccount(&flags.CommonFlags{ConfigFile: configFile}, "keep", "kept")
+	assert.Nil(t, err)
+	helperMock.AssertNotCalled(t, "Add", &credentials.Credentials{ServerURL: "saml2aws://totp/kept", Username: "kept", Secret: ""})
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"os"
+	"runtime"
+	"strings"
 	"text/template"
 	"time"
 
@@ -18,7 +21,8 @@ export AWS_SESSION_TOKEN={{ .AWSSessionToken }}
 export AWS_SECURITY_TOKEN={{ .AWSSecurityToken }}
 export SAML2AWS_PROFILE={{ .ProfileName }}
 export AWS_CREDENTIAL_EXPIRATION={{ .Expires.Format "2006-01-02T15:04:05Z07:00" }}
-`
+{{ if .SourceIdentity }}export AWS_SOURCE_IDENTITY={{ .SourceIdentity }}
+{{ end }}`
 
 const shTmpl = `export AWS_ACCESS_KEY_ID={{ .AWSAccessKey }}
 export AWS_SECRET_ACCESS_KEY={{ .AWSSecretKey }}
@@ -26,7 +30,8 @@ export AWS_SESSION_TOKEN={{ .AWSSessionToken }}
 export AWS_SECURITY_TOKEN={{ .AWSSecurityToken }}
 export SAML2AWS_PROFILE={{ .ProfileName }}
 export AWS_CREDENTIAL_EXPIRATION={{ .Expires.Format "2006-01-02T15:04:05Z07:00" }}
-`
+{{ if .SourceIdentity }}export AWS_SOURCE_IDENTITY={{ .SourceIdentity }}
+{{ end }}`
 
 const fishTmpl = `set -gx AWS_ACCESS_KEY_ID {{ .AWSAccessKey }}
 set -gx AWS_SECRET_ACCESS_KEY {{ .AWSSecretKey }}
@@ -34,7 +39,8 @@ set -gx AWS_SESSION_TOKEN {{ .AWSSessionToken }}
 set -gx AWS_SECURITY_TOKEN {{ .AWSSecurityToken }}
 set -gx SAML2AWS_PROFILE {{ .ProfileName }}
 set -gx AWS_CREDENTIAL_EXPIRATION '{{ .Expires.Format "2006-01-02T15:04:05Z07:00" }}'
-`
+{{ if .SourceIdentity }}set -gx AWS_SOURCE_IDENTITY {{ .SourceIdentity }}
+{{ end }}`
 
 const powershellTmpl = `$env:AWS_ACCESS_KEY_ID='{{ .AWSAccessKey }}'
 $env:AWS_SECRET_ACCESS_KEY='{{ .AWSSecretKey }}'
@@ -42,23 +48,38 @@ $env:AWS_SESSION_TOKEN='{{ .AWSSessionToken }}'
 $env:AWS_SECURITY_TOKEN='{{ .AWSSecurityToken }}'
 $env:SAML2AWS_PROFILE='{{ .ProfileName }}'
 $env:AWS_CREDENTIAL_EXPIRATION='{{ .Expires.Format "2006-01-02T15:04:05Z07:00" }}'
-`
+{{ if .SourceIdentity }}$env:AWS_SOURCE_IDENTITY='{{ .SourceIdentity }}'
+{{ end }}`
+
+const cmdTmpl = `set AWS_ACCESS_KEY_ID={{ .AWSAccessKey }}
+set AWS_SECRET_ACCESS_KEY={{ .AWSSecretKey }}
+set AWS_SESSION_TOKEN={{ .AWSSessionToken }}
+set AWS_SECURITY_TOKEN={{ .AWSSecurityToken }}
+set SAML2AWS_PROFILE={{ .ProfileName }}
+set AWS_CREDENTIAL_EXPIRATION={{ .Expires.Format "2006-01-02T15:04:05Z07:00" }}
+{{ if .SourceIdentity }}set AWS_SOURCE_IDENTITY={{ .SourceIdentity }}
+{{ end }}`
 
 const envTmpl = `AWS_ACCESS_KEY_ID={{ .AWSAccessKey }}
 AWS_SECRET_ACCESS_KEY={{ .AWSSecretKey }}
 AWS_SESSION_TOKEN={{ .AWSSessionToken }}
 AWS_SECURITY_TOKEN={{ .AWSSecurityToken }}
 SAML2AWS_PROFILE={{ .ProfileName }}
-`
+{{ if .SourceIdentity }}AWS_SOURCE_IDENTITY={{ .SourceIdentity }}
+{{ end }}`
 
 // Script will emit a bash script that will export environment variables
 func Script(execFlags *flags.LoginExecFlags, shell string) error {
-	account, err := buildIdpAccount(execFlags)
+	if shell == "" {
+		shell = detectShell()
+	}
+
+	account, _, err := buildIdpAccount(execFlags)
 	if err != nil {
 		return errors.Wrap(err, "error building login details")
 	}
 
-	sharedCreds := awsconfig.NewSharedCredentials(account.Profile, account.CredentialsFile)
+	sharedCreds := awsconfig.NewSharedCredentials(account.CredentialsProfile(account.RoleARN), account.CredentialsFile)
 
 	// this checks if the credentials file has been created yet
 	// can only really be triggered if saml2aws exec is run on a new
@@ -86,7 +107,7 @@ func Script(execFlags *flags.LoginExecFlags, shell string) error {
 		ProfileName string
 		*awsconfig.AWSCredentials
 	}{
-		account.Profile,
+		account.CredentialsProfile(account.RoleARN),
 		awsCreds,
 	}
 
@@ -113,6 +134,8 @@ func buildTmpl(shell string, data interface{}) (string, error) {
 		t, err = t.Parse(powershellTmpl)
 	case "fish":
 		t, err = t.Parse(fishTmpl)
+	case "cmd":
+		t, err = t.Parse(cmdTmpl)
 	case "env":
 		t, err = t.Parse(envTmpl)
 	}
@@ -128,3 +151,59 @@ func buildTmpl(shell string, data interface{}) (string, error) {
 	return buf.String(), err
 
 }
+
+// detectShell works out which shell script was run from when --shell isn't given, from the parent process where
+// it can be read and otherwise the environment, falling back to bash
+func detectShell() string {
+	return shellFromEnv(runtime.GOOS, os.Getenv, parentProcessName())
+}
+
+func shellFromEnv(goos string, getenv func(string) string, parent string) string {
+	if shell := shellName(parent); shell != "" {
+		return shell
+	}
+
+	if goos == "windows" {
+		// cmd.exe sets PROMPT for the programs it runs, PowerShell doesn't
+		if getenv("PROMPT") != "" {
+			return "cmd"
+		}
+		return "powershell"
+	}
+
+	if shell := shellName(getenv("SHELL")); shell != "" {
+		return shell
+	}
+
+	return "bash"
+}
+
+// shellName maps the name of a shell's executable to the --shell option emitting its syntax
+func shellName(executable string) string {
+	// windows paths are split on either separator whatever saml2aws is running on
+	name := strings.ToLower(strings.TrimSpace(executable))
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = strings.TrimPrefix(strings.TrimSuffix(name, ".exe"), "-")
+	switch name {
+	case "fish":
+		return "fish"
+	case "pwsh", "powershell":
+		return "powershell"
+	case "cmd":
+		return "cmd"
+	case "bash", "zsh", "ksh":
+		return "bash"
+	case "sh", "dash", "ash":
+		return "/bin/sh"
+	}
+	return ""
+}
+
+// parentProcessName the name of the process that ran saml2aws, only known where /proc is
+func parentProcessName() string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", os.Getppid()))
+	if err != nil {
+		return ""
+	}
+	return string(comm)
+}
@@ -139,3 +139,126 @@ func TestBuildTmplEnv(t *testing.T) {
 	}
 
 }
+
+func TestBuildTmplPowershell(t *testing.T) {
+
+	data := struct {
+		ProfileName string
+		*awsconfig.AWSCredentials
+	}{
+		"test_profile",
+		&awsconfig.AWSCredentials{
+			AWSSecretKey:     "secret_key",
+			AWSAccessKey:     "access_key",
+			AWSSessionToken:  "session_token",
+			AWSSecurityToken: "security_token",
+			Expires:          time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+		},
+	}
+
+	st, err := buildTmpl("powershell", data)
+	assert.Nil(t, err)
+
+	expected := []string{
+		"$env:AWS_ACCESS_KEY_ID='access_key'",
+		"$env:AWS_SECRET_ACCESS_KEY='secret_key'",
+		"$env:AWS_SESSION_TOKEN='session_token'",
+		"$env:AWS_SECURITY_TOKEN='security_token'",
+		"$env:SAML2AWS_PROFILE='test_profile'",
+		"$env:AWS_CREDENTIAL_EXPIRATION='2026-10-16T12:00:00Z'",
+	}
+
+	for _, test_string := range expected {
+		assert.Contains(t, st, test_string)
+	}
+
+}
+
+func TestBuildTmplCmd(t *testing.T) {
+
+	data := struct {
+		ProfileName string
+		*awsconfig.AWSCredentials
+	}{
+		"test_profile",
+		&awsconfig.AWSCredentials{
+			AWSSecretKey:     "secret_key",
+			AWSAccessKey:     "access_key",
+			AWSSessionToken:  "session_token",
+			AWSSecurityToken: "security_token",
+			Expires:          time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+		},
+	}
+
+	st, err := buildTmpl("cmd", data)
+	assert.Nil(t, err)
+
+	expected := []string{
+		"set AWS_ACCESS_KEY_ID=access_key",
+		"set AWS_SECRET_ACCESS_KEY=secret_key",
+		"set AWS_SESSION_TOKEN=session_token",
+		"set AWS_SECURITY_TOKEN=security_token",
+		"set SAML2AWS_PROFILE=test_profile",
+		"set AWS_CREDENTIAL_EXPIRATION=2026-10-16T12:00:00Z",
+	}
+
+	for _, test_string := range expected {
+		assert.Contains(t, st, test_string)
+	}
+
+}
+
+func TestBuildTmplSourceIdentity(t *testing.T) {
+	awsCreds := &awsconfig.AWSCredentials{
+		AWSAccessKey: "access_key",
+		Expires:      time.Now(),
+	}
+	data := struct {
+		ProfileName string
+		*awsconfig.AWSCredentials
+	}{"test_profile", awsCreds}
+
+	st, err := buildTmpl("bash", data)
+	assert.Nil(t, err)
+	assert.NotContains(t, st, "AWS_SOURCE_IDENTITY")
+
+	awsCreds.SourceIdentity = "jane@example.com"
+	expected := map[string]string{
+		"bash":       "export AWS_SOURCE_IDENTITY=jane@example.com\n",
+		"/bin/sh":    "export AWS_SOURCE_IDENTITY=jane@example.com\n",
+		"fish":       "set -gx AWS_SOURCE_IDENTITY jane@example.com\n",
+		"powershell": "$env:AWS_SOURCE_IDENTITY='jane@example.com'\n",
+		"cmd":        "set AWS_SOURCE_IDENTITY=jane@example.com\n",
+		"env":        "AWS_SOURCE_IDENTITY=jane@example.com\n",
+	}
+	for shell, line := range expected {
+		st, err := buildTmpl(shell, data)
+		assert.Nil(t, err)
+		assert.Contains(t, st, line, shell)
+	}
+}
+
+func TestShellFromEnv(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+
+	// the parent process wins over $SHELL, which is only the login shell
+	assert.Equal(t, "fish", shellFromEnv("linux", env(map[string]string{"SHELL": "/bin/bash"}), "fish\n"))
+	assert.Equal(t, "bash", shellFromEnv("linux", env(map[string]string{"SHELL": "/bin/bash"}), "sudo\n"))
+	assert.Equal(t, "/bin/sh", shellFromEnv("linux", env(map[string]string{"SHELL": "/bin/dash"}), ""))
+	assert.Equal(t, "powershell", shellFromEnv("linux", env(nil), "pwsh"))
+	assert.Equal(t, "bash", shellFromEnv("darwin", env(map[string]string{"SHELL": "/bin/zsh"}), ""))
+	assert.Equal(t, "bash", shellFromEnv("linux", env(nil), ""))
+
+	assert.Equal(t, "cmd", shellFromEnv("windows", env(map[string]string{"PROMPT": "$P$G"}), ""))
+	assert.Equal(t, "powershell", shellFromEnv("windows", env(nil), ""))
+}
+
+func TestShellName(t *testing.T) {
+	assert.Equal(t, "powershell", shellName(`C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`))
+	assert.Equal(t, "cmd", shellName("CMD.EXE"))
+	assert.Equal(t, "bash", shellName("-bash"))
+	assert.Equal(t, "fish", shellName("/usr/local/bin/fish"))
+	assert.Equal(t, "", shellName("sudo"))
+}
@@ -0,0 +1,223 @@
+package commands
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+// serveShutdownTimeout how long requests in flight get to finish once serve is interrupted
+const serveShutdownTimeout = 5 * time.Second
+
+// containerCredentials the response of the ECS container credentials endpoint the AWS SDKs read when
+// AWS_CONTAINER_CREDENTIALS_FULL_URI is set
+type containerCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+	RoleArn         string `json:",omitempty"`
+}
+
+// serveTokenBytes the random bytes of the authorization token serve generates when none is set
+const serveTokenBytes = 32
+
+// credentialsServer serves the credentials of a login, logging in again when they are about to expire
+type credentialsServer struct {
+	// host the Host header requests must carry, the address listened on, so a web page can't reach the server
+	// through a name it rebinds to the loopback address
+	host string
+	// token the Authorization header requests must carry
+	token string
+	// refreshWindow credentials expiring sooner than this are refreshed before being served
+	refreshWindow time.Duration
+	login         func() (*awsconfig.AWSCredentials, error)
+
+	mu    sync.Mutex
+	creds *awsconfig.AWSCredentials
+}
+
+// Serve runs a loopback HTTP server implementing the ECS container credentials endpoint, logging in on the first
+// request and again shortly before the credentials expire, until interrupted. The credentials are only held in
+// memory.
+func Serve(loginFlags *flags.LoginExecFlags, listen string) error {
+	err := checkLoopback(listen)
+	if err != nil {
+		return err
+	}
+
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	generated := token == ""
+	if generated {
+		token, err = serveToken()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the login is the credential process one, which never prompts and logs in to a single role, and always
+	// authenticates as serve holds the credentials itself
+	loginFlags.CredentialProcess = true
+	loginFlags.Force = true
+	prompter.SetPrompter(prompter.NewNonInteractivePrompter())
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return errors.Wrapf(err, "Error listening on %s.", listen)
+	}
+
+	server := &credentialsServer{
+		host:          listener.Addr().String(),
+		token:         token,
+		refreshWindow: credentialProcessRefreshWindow,
+		login: func() (*awsconfig.AWSCredentials, error) {
+			return loginInMemory(loginFlags)
+		},
+	}
+
+	httpServer := &http.Server{Handler: server, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+		_ = httpServer.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving credentials, set AWS_CONTAINER_CREDENTIALS_FULL_URI=http://%s/ for the AWS tools.", server.host)
+	if generated {
+		log.Printf("AWS_CONTAINER_AUTHORIZATION_TOKEN isn't set, set AWS_CONTAINER_AUTHORIZATION_TOKEN=%s for the AWS tools.", token)
+	}
+
+	err = httpServer.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "Error serving credentials.")
+	}
+
+	log.Println("Stopped serving credentials.")
+	return nil
+}
+
+// loginInMemory logs in the same way as login, returning the credentials instead of saving them
+func loginInMemory(loginFlags *flags.LoginExecFlags) (*awsconfig.AWSCredentials, error) {
+	var creds *awsconfig.AWSCredentials
+
+	err := login(loginFlags, func(_ *cfg.IDPAccount, awsCreds *awsconfig.AWSCredentials, _ *awsconfig.CredentialsProvider, _ *flags.LoginExecFlags) error {
+		creds = awsCreds
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil {
+		return nil, errors.New("the login returned no credentials")
+	}
+
+	return creds, nil
+}
+
+// serveToken a random authorization token
+func serveToken() (string, error) {
+	b := make([]byte, serveTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "Error generating the authorization token.")
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// checkLoopback rejects a listen address that isn't on a loopback interface, the credentials must not be
+// reachable from other hosts
+func checkLoopback(listen string) error {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid listen address %s.", listen)
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("serve only listens on a loopback address such as 127.0.0.1, not %q", host)
+	}
+
+	return nil
+}
+
+func (s *credentialsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Host != s.host {
+		logrus.WithFields(logrus.Fields{"remote": r.RemoteAddr, "host": r.Host}).Warn("Rejected a credentials request for another host.")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// an empty token would let requests without the header through
+	if s.token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.token)) != 1 {
+		logrus.WithField("remote", r.RemoteAddr).Warn("Rejected a credentials request without the authorization token.")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	creds, err := s.credentials()
+	if err != nil {
+		log.Printf("Unable to refresh the credentials, run saml2aws login interactively to fix the login: %v", err)
+		http.Error(w, "unable to refresh the credentials", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(containerCredentials{
+		AccessKeyId:     creds.AWSAccessKey,
+		SecretAccessKey: creds.AWSSecretKey,
+		Token:           creds.AWSSessionToken,
+		Expiration:      creds.Expires.UTC().Format(time.RFC3339),
+		RoleArn:         creds.PrincipalARN,
+	})
+}
+
+// credentials the credentials held in memory, logging in again first when there are none yet or they expire
+// within the refresh window
+func (s *credentialsServer) credentials() (*awsconfig.AWSCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.creds != nil && time.Until(s.creds.Expires) > s.refreshWindow {
+		return s.creds, nil
+	}
+
+	creds, err := s.login()
+	if err != nil {
+		return nil, err
+	}
+
+	s.creds = creds
+	return s.creds, nil
+}
@@ -0,0 +1,151 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	assert.NoError(t, checkLoopback("127.0.0.1:9099"))
+	assert.NoError(t, checkLoopback("[::1]:9099"))
+	assert.NoError(t, checkLoopback("localhost:9099"))
+
+	assert.Error(t, checkLoopback("0.0.0.0:9099"))
+	assert.Error(t, checkLoopback(":9099"))
+	assert.Error(t, checkLoopback("192.168.1.10:9099"))
+	assert.Error(t, checkLoopback("127.0.0.1"))
+}
+
+const testServeHost = "127.0.0.1:9099"
+
+func newTestCredentialsServer(expires time.Time) (*credentialsServer, *int) {
+	logins := 0
+	server := &credentialsServer{
+		host:          testServeHost,
+		token:         "s3cret",
+		refreshWindow: 5 * time.Minute,
+		login: func() (*awsconfig.AWSCredentials, error) {
+			logins++
+			return &awsconfig.AWSCredentials{
+				AWSAccessKey:    "AKIAEXAMPLE",
+				AWSSecretKey:    "secret",
+				AWSSessionToken: "token",
+				PrincipalARN:    "arn:aws:sts::123456789012:assumed-role/Developer/user",
+				Expires:         expires,
+			}, nil
+		},
+	}
+	return server, &logins
+}
+
+// newCredentialsRequest a request the way the AWS SDKs send it, to the address listened on with the token
+func newCredentialsRequest(host, token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = host
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return req
+}
+
+func TestCredentialsServerServesAndCaches(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	server, logins := newTestCredentialsServer(expires)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, newCredentialsRequest(testServeHost, "s3cret"))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var creds containerCredentials
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &creds))
+		assert.Equal(t, "AKIAEXAMPLE", creds.AccessKeyId)
+		assert.Equal(t, "secret", creds.SecretAccessKey)
+		assert.Equal(t, "token", creds.Token)
+		assert.Equal(t, expires.Format(time.RFC3339), creds.Expiration)
+	}
+
+	assert.Equal(t, 1, *logins)
+}
+
+func TestCredentialsServerRefreshesBeforeExpiry(t *testing.T) {
+	server, logins := newTestCredentialsServer(time.Now().Add(2 * time.Minute))
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, newCredentialsRequest(testServeHost, "s3cret"))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	assert.Equal(t, 2, *logins)
+}
+
+func TestCredentialsServerAuthorizationToken(t *testing.T) {
+	server, logins := newTestCredentialsServer(time.Now().Add(time.Hour))
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, newCredentialsRequest(testServeHost, ""))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, newCredentialsRequest(testServeHost, "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// without a token nothing is served
+	server.token = ""
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, newCredentialsRequest(testServeHost, ""))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, 0, *logins)
+
+	server.token = "s3cret"
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, newCredentialsRequest(testServeHost, "s3cret"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestCredentialsServerHost(t *testing.T) {
+	server, logins := newTestCredentialsServer(time.Now().Add(time.Hour))
+
+	// a page on a name rebound to the loopback address sends its own name
+	for _, host := range []string{"attacker.example.com:9099", "localhost:9099", "127.0.0.1", ""} {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, newCredentialsRequest(host, "s3cret"))
+		assert.Equal(t, http.StatusForbidden, rec.Code, host)
+	}
+	assert.Equal(t, 0, *logins)
+}
+
+func TestServeToken(t *testing.T) {
+	token, err := serveToken()
+	require.NoError(t, err)
+	assert.Len(t, token, 2*serveTokenBytes)
+
+	other, err := serveToken()
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other)
+}
+
+func TestCredentialsServerLoginFailure(t *testing.T) {
+	server := &credentialsServer{
+		host:          testServeHost,
+		token:         "s3cret",
+		refreshWindow: 5 * time.Minute,
+		login: func() (*awsconfig.AWSCredentials, error) {
+			return nil, errors.New("password rejected")
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, newCredentialsRequest(testServeHost, "s3cret"))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "password rejected")
+}
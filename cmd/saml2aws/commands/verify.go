@@ -0,0 +1,125 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+// defaultVerifyTimeout how long to wait for an IdP to answer when the account has no timeout set
+const defaultVerifyTimeout = 10 * time.Second
+
+// ErrVerifyFailed returned when at least one idp account failed validation
+var ErrVerifyFailed = errors.New("one or more idp accounts failed validation")
+
+// Verify checks every IDP account is valid and its URL can be reached, without authenticating
+func Verify(commonFlags *flags.CommonFlags) error {
+	return verifyAccounts(commonFlags, os.Stdout)
+}
+
+func verifyAccounts(commonFlags *flags.CommonFlags, out io.Writer) error {
+
+	cfgm, err := cfg.NewConfigManager(commonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load configuration")
+	}
+
+	accounts, err := cfgm.ListIDPAccounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to load idp accounts")
+	}
+
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failed := false
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tSTATUS")
+
+	for _, name := range names {
+		account := accounts[name]
+
+		if err := account.Validate(); err != nil {
+			failed = true
+			fmt.Fprintf(w, "%s\tinvalid: %v\n", name, err)
+			continue
+		}
+
+		status, err := checkReachable(account)
+		if err != nil {
+			fmt.Fprintf(w, "%s\tunreachable: %v\n", name, err)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\tok (HTTP %d)\n", name, status)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if failed {
+		return ErrVerifyFailed
+	}
+
+	return nil
+}
+
+// checkReachable sends a HEAD request to the account URL, any response at all means the IdP is reachable
+func checkReachable(account *cfg.IDPAccount) (int, error) {
+
+	client, err := accountHTTPClient(account)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodHead, account.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// accountHTTPClient an HTTP client with the proxy and TLS settings of the account, giving up on an IdP that
+// doesn't answer in time
+func accountHTTPClient(account *cfg.IDPAccount) (*provider.HTTPClient, error) {
+
+	opts, err := provider.BuildHttpClientOpts(account)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(provider.NewDefaultTransport(account.SkipVerify), opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building http client")
+	}
+
+	// timeout is in milliseconds as for the Browser provider
+	client.Timeout = defaultVerifyTimeout
+	if account.Timeout > 0 {
+		client.Timeout = time.Duration(account.Timeout) * time.Millisecond
+	}
+
+	return client, nil
+}
@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+func TestVerifyAccounts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer ts.Close()
+
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte(`[good]
+url      = `+ts.URL+`
+provider = KeyCloak
+mfa      = Auto
+
+[down]
+url      = http://127.0.0.1:1
+provider = KeyCloak
+mfa      = Auto
+`), 0600))
+
+	var out bytes.Buffer
+	err := verifyAccounts(&flags.CommonFlags{ConfigFile: configFile}, &out)
+	assert.Nil(t, err)
+	assert.Regexp(t, `good\s+ok \(HTTP 405\)`, out.String())
+	assert.Regexp(t, `down\s+unreachable: `, out.String())
+
+	assert.Nil(t, os.WriteFile(configFile, []byte(`[good]
+url      = `+ts.URL+`
+provider = KeyCloak
+mfa      = Auto
+
+[bad]
+provider = KeyCloak
+mfa      = Auto
+`), 0600))
+
+	out.Reset()
+	err = verifyAccounts(&flags.CommonFlags{ConfigFile: configFile}, &out)
+	assert.Equal(t, ErrVerifyFailed, err)
+	assert.Regexp(t, `bad\s+invalid: URL empty in idp account`, out.String())
+}
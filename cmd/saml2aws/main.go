@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -10,8 +11,11 @@ import (
 
 	"github.com/alecthomas/kingpin"
 	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2"
 	"github.com/versent/saml2aws/v2/cmd/saml2aws/commands"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/logging"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 )
 
@@ -20,6 +24,11 @@ var (
 	Version = "1.0.0"
 )
 
+// idpProviders the providers --idp-provider accepts, every one NewSAMLClient knows so none is left out as they are added
+func idpProviders() []string {
+	return append(saml2aws.MFAsByProvider.Names(), "Shell")
+}
+
 // The `cmdLineList` type is used to make a `[]string` meet the requirements
 // of the kingpin.Value interface
 type cmdLineList []string
@@ -63,7 +72,8 @@ func main() {
 
 	// Settings not related to commands
 	verbose := app.Flag("verbose", "Enable verbose logging").Bool()
-	quiet := app.Flag("quiet", "silences logs").Bool()
+	quiet := app.Flag("quiet", "Silences all output except errors and the requested credentials, failing instead of prompting").Bool()
+	logFormat := app.Flag("log-format", "The format of the logs, text or json. (env: SAML2AWS_LOG_FORMAT)").Envar("SAML2AWS_LOG_FORMAT").Default(logging.FormatText).Enum(logging.Formats...)
 
 	provider := app.Flag("provider", "This flag is obsolete. See: https://github.com/Versent/saml2aws#configuring-idp-accounts").Short('i').Enum("Akamai", "AzureAD", "ADFS", "ADFS2", "Browser", "Ping", "JumpCloud", "Okta", "OneLogin", "PSU", "KeyCloak")
 
@@ -71,7 +81,7 @@ func main() {
 	commonFlags := new(flags.CommonFlags)
 	app.Flag("config", "Path/filename of saml2aws config file (env: SAML2AWS_CONFIGFILE)").Envar("SAML2AWS_CONFIGFILE").StringVar(&commonFlags.ConfigFile)
 	app.Flag("idp-account", "The name of the configured IDP account. (env: SAML2AWS_IDP_ACCOUNT)").Envar("SAML2AWS_IDP_ACCOUNT").Short('a').Default("default").StringVar(&commonFlags.IdpAccount)
-	app.Flag("idp-provider", "The configured IDP provider. (env: SAML2AWS_IDP_PROVIDER)").Envar("SAML2AWS_IDP_PROVIDER").EnumVar(&commonFlags.IdpProvider, "Akamai", "AzureAD", "ADFS", "ADFS2", "Browser", "GoogleApps", "Ping", "JumpCloud", "Okta", "OneLogin", "PSU", "KeyCloak", "F5APM", "Shibboleth", "ShibbolethECP", "NetIQ", "Auth0")
+	app.Flag("idp-provider", "The configured IDP provider. (env: SAML2AWS_IDP_PROVIDER)").Envar("SAML2AWS_IDP_PROVIDER").EnumVar(&commonFlags.IdpProvider, idpProviders()...)
 	app.Flag("browser-type", "The configured browser type when the IDP provider is set to Browser. if not set 'chromium' will be used. (env: SAML2AWS_BROWSER_TYPE)").Envar("SAML2AWS_BROWSER_TYPE").EnumVar(&commonFlags.BrowserType, "chromium", "firefox", "webkit", "chrome", "chrome-beta", "chrome-dev", "chrome-canary", "msedge", "msedge-beta", "msedge-dev", "msedge-canary")
 	app.Flag("browser-executable-path", "The configured browser full path when the IDP provider is set to Browser. If set, no browser download will be performed and the executable path will be used instead. (env: SAML2AWS_BROWSER_EXECUTABLE_PATH)").Envar("SAML2AWS_BROWSER_EXECUTABLE_PATH").StringVar(&commonFlags.BrowserExecutablePath)
 	app.Flag("browser-autofill", "Configures browser to autofill the username and password. (env: SAML2AWS_BROWSER_AUTOFILL)").Envar("SAML2AWS_BROWSER_AUTOFILL").BoolVar(&commonFlags.BrowserAutoFill)
@@ -80,12 +90,16 @@ func main() {
 	app.Flag("url", "The URL of the SAML IDP server used to login. (env: SAML2AWS_URL)").Envar("SAML2AWS_URL").StringVar(&commonFlags.URL)
 	app.Flag("username", "The username used to login. (env: SAML2AWS_USERNAME)").Envar("SAML2AWS_USERNAME").StringVar(&commonFlags.Username)
 	app.Flag("password", "The password used to login. (env: SAML2AWS_PASSWORD)").Envar("SAML2AWS_PASSWORD").StringVar(&commonFlags.Password)
+	app.Flag("password-file", "Read the password used to login from a file, keeping it out of the environment. (env: SAML2AWS_PASSWORD_FILE)").Envar("SAML2AWS_PASSWORD_FILE").StringVar(&commonFlags.PasswordFile)
 	app.Flag("mfa-token", "The current MFA token (supported in Keycloak, ADFS, GoogleApps). (env: SAML2AWS_MFA_TOKEN)").Envar("SAML2AWS_MFA_TOKEN").StringVar(&commonFlags.MFAToken)
-	app.Flag("role", "The ARN of the role to assume. (env: SAML2AWS_ROLE)").Envar("SAML2AWS_ROLE").StringVar(&commonFlags.RoleArn)
+	app.Flag("role", "The ARN of the role to assume, or its alias from the role_aliases section. (env: SAML2AWS_ROLE)").Envar("SAML2AWS_ROLE").StringVar(&commonFlags.RoleArn)
+	app.Flag("role-matcher", "Regular expression picking the one role whose ARN it matches, failing if it matches none or several. (env: SAML2AWS_ROLE_MATCHER)").Envar("SAML2AWS_ROLE_MATCHER").StringVar(&commonFlags.RoleMatcher)
+	app.Flag("role-filter", "Regular expression narrowing the role menu to the roles whose ARN it matches, picking the role when only one does. (env: SAML2AWS_ROLE_FILTER)").Envar("SAML2AWS_ROLE_FILTER").StringVar(&commonFlags.RoleFilter)
 	app.Flag("aws-urn", "The URN used by SAML when you login. (env: SAML2AWS_AWS_URN)").Envar("SAML2AWS_AWS_URN").StringVar(&commonFlags.AmazonWebservicesURN)
 	app.Flag("skip-prompt", "Skip prompting for parameters during login.").BoolVar(&commonFlags.SkipPrompt)
 	app.Flag("session-duration", "The duration of your AWS Session. (env: SAML2AWS_SESSION_DURATION)").Envar("SAML2AWS_SESSION_DURATION").IntVar(&commonFlags.SessionDuration)
 	app.Flag("disable-keychain", "Do not use keychain at all. This will also disable Okta sessions & remembering MFA device. (env: SAML2AWS_DISABLE_KEYCHAIN)").Envar("SAML2AWS_DISABLE_KEYCHAIN").BoolVar(&commonFlags.DisableKeychain)
+	app.Flag("disable-keyring", "Same as --disable-keychain, never open the OS keyring. (env: SAML2AWS_DISABLE_KEYRING)").Envar("SAML2AWS_DISABLE_KEYRING").BoolVar(&commonFlags.DisableKeychain)
 	app.Flag("region", "AWS region to use for API requests, e.g. us-east-1, us-gov-west-1, cn-north-1 (env: SAML2AWS_REGION)").Envar("SAML2AWS_REGION").Short('r').StringVar(&commonFlags.Region)
 	app.Flag("prompter", "The prompter to use for user input (default, pinentry)").StringVar(&commonFlags.Prompter)
 
@@ -98,11 +112,21 @@ func main() {
 	cmdConfigure.Flag("mfa-ip-address", "IP address whitelisting defined in OneLogin MFA policies. (env: ONELOGIN_MFA_IP_ADDRESS)").Envar("ONELOGIN_MFA_IP_ADDRESS").StringVar(&commonFlags.MFAIPAddress)
 	cmdConfigure.Flag("profile", "The AWS profile to save the temporary credentials. (env: SAML2AWS_PROFILE)").Envar("SAML2AWS_PROFILE").Short('p').StringVar(&commonFlags.Profile)
 	cmdConfigure.Flag("resource-id", "F5APM SAML resource ID of your company account. (env: SAML2AWS_F5APM_RESOURCE_ID)").Envar("SAML2AWS_F5APM_RESOURCE_ID").StringVar(&commonFlags.ResourceID)
+	cmdConfigure.Flag("sso-start-url", "IdentityCenter AWS access portal URL, e.g. https://example.awsapps.com/start. (env: SAML2AWS_SSO_START_URL)").Envar("SAML2AWS_SSO_START_URL").StringVar(&commonFlags.SSOStartURL)
+	cmdConfigure.Flag("sso-region", "IdentityCenter region, the one IAM Identity Center is enabled in. (env: SAML2AWS_SSO_REGION)").Envar("SAML2AWS_SSO_REGION").StringVar(&commonFlags.SSORegion)
+	cmdConfigure.Flag("aws-partition", "The AWS partition of the accounts, govcloud or china set the SAML URN, region and STS endpoint to suit. (env: SAML2AWS_AWS_PARTITION)").Envar("SAML2AWS_AWS_PARTITION").EnumVar(&commonFlags.Partition, cfg.PartitionNames()...)
 	cmdConfigure.Flag("credentials-file", "The file that will cache the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
 	cmdConfigure.Flag("cache-saml", "Caches the SAML response (env: SAML2AWS_CACHE_SAML)").Envar("SAML2AWS_CACHE_SAML").BoolVar(&commonFlags.SAMLCache)
 	cmdConfigure.Flag("cache-file", "The location of the SAML cache file (env: SAML2AWS_SAML_CACHE_FILE)").Envar("SAML2AWS_SAML_CACHE_FILE").StringVar(&commonFlags.SAMLCacheFile)
 	cmdConfigure.Flag("disable-sessions", "Do not use Okta sessions. Uses Okta sessions by default. (env: SAML2AWS_OKTA_DISABLE_SESSIONS)").Envar("SAML2AWS_OKTA_DISABLE_SESSIONS").BoolVar(&commonFlags.DisableSessions)
 	cmdConfigure.Flag("disable-remember-device", "Do not remember Okta MFA device. Remembers MFA device by default. (env: SAML2AWS_OKTA_DISABLE_REMEMBER_DEVICE)").Envar("SAML2AWS_OKTA_DISABLE_REMEMBER_DEVICE").BoolVar(&commonFlags.DisableRememberDevice)
+	cmdConfigure.Flag("disable-device-token", "Do not keep the Okta device token and session between logins, which lets Okta skip MFA on a known device. (env: SAML2AWS_OKTA_DISABLE_DEVICE_TOKEN)").Envar("SAML2AWS_OKTA_DISABLE_DEVICE_TOKEN").BoolVar(&commonFlags.DisableDeviceToken)
+	var migrateConfig bool
+	cmdConfigure.Flag("non-interactive", "Configure from the flags alone, failing on anything required that isn't set instead of prompting.").BoolVar(&commonFlags.NonInteractive)
+	cmdConfigure.Flag("migrate-config", "Copy the legacy ~/.saml2aws configuration file to the XDG config directory and exit.").BoolVar(&migrateConfig)
+	var encryptConfig, decryptConfig bool
+	cmdConfigure.Flag("encrypt-config", "Encrypt the configuration file with a passphrase and exit. (env: SAML2AWS_CONFIG_PASSPHRASE)").BoolVar(&encryptConfig)
+	cmdConfigure.Flag("decrypt-config", "Decrypt an encrypted configuration file and exit.").BoolVar(&decryptConfig)
 	configFlags := commonFlags
 
 	// `login` command and settings
@@ -110,18 +134,68 @@ func main() {
 	loginFlags := new(flags.LoginExecFlags)
 	loginFlags.CommonFlags = commonFlags
 	cmdLogin.Flag("profile", "The AWS profile to save the temporary credentials. (env: SAML2AWS_PROFILE)").Short('p').Envar("SAML2AWS_PROFILE").StringVar(&commonFlags.Profile)
-	cmdLogin.Flag("duo-mfa-option", "The MFA option you want to use to authenticate with (supported providers: okta). (env: SAML2AWS_DUO_MFA_OPTION)").Envar("SAML2AWS_DUO_MFA_OPTION").EnumVar(&loginFlags.DuoMFAOption, "Passcode", "Duo Push")
+	cmdLogin.Flag("duo-mfa-option", "The MFA option you want to use to authenticate with (supported providers: okta, jumpcloud, adfs, shibboleth). (env: SAML2AWS_DUO_MFA_OPTION)").Envar("SAML2AWS_DUO_MFA_OPTION").EnumVar(&loginFlags.DuoMFAOption, "Passcode", "Duo Push", "Phone Call")
 	cmdLogin.Flag("client-id", "OneLogin client id, used to generate API access token. (env: ONELOGIN_CLIENT_ID)").Envar("ONELOGIN_CLIENT_ID").StringVar(&commonFlags.ClientID)
 	cmdLogin.Flag("client-secret", "OneLogin client secret, used to generate API access token. (env: ONELOGIN_CLIENT_SECRET)").Envar("ONELOGIN_CLIENT_SECRET").StringVar(&commonFlags.ClientSecret)
 	cmdLogin.Flag("mfa-ip-address", "IP address whitelisting defined in OneLogin MFA policies. (env: ONELOGIN_MFA_IP_ADDRESS)").Envar("ONELOGIN_MFA_IP_ADDRESS").StringVar(&commonFlags.MFAIPAddress)
 	cmdLogin.Flag("force", "Refresh credentials even if not expired.").BoolVar(&loginFlags.Force)
 	cmdLogin.Flag("credential-process", "Enables AWS Credential Process support by outputting credentials to STDOUT in a JSON message.").BoolVar(&loginFlags.CredentialProcess)
+	cmdLogin.Flag("dry-run", "Authenticate and list the roles that could be assumed without calling AWS or saving credentials.").BoolVar(&loginFlags.DryRun)
+	cmdLogin.Flag("all-roles", "Assume every role in the SAML assertion, saving each to a profile named after the role or all_roles_profile.").BoolVar(&loginFlags.AllRoles)
+	cmdLogin.Flag("use-env-base", "Skip the IdP and assume the role_chain roles starting from the AWS credentials of the environment or instance profile. (env: SAML2AWS_USE_ENV_BASE)").Envar("SAML2AWS_USE_ENV_BASE").BoolVar(&loginFlags.UseEnvBase)
+	cmdLogin.Flag("dump-assertion", "Write the decoded SAML assertion to stderr to debug the attributes the IdP sends. The assertion is sensitive, don't share it.").BoolVar(&loginFlags.DumpAssertion)
+	cmdLogin.Flag("dump-assertion-file", "Write the decoded SAML assertion to this file, readable only by you, rather than stderr.").StringVar(&loginFlags.DumpAssertionFile)
+	cmdLogin.Flag("no-duration-fallback", "Fail when STS rejects the session duration instead of retrying with the role maximum, even with auto_clamp_session_duration set.").BoolVar(&loginFlags.NoDurationFallback)
+	cmdLogin.Flag("no-remember-role", "Don't offer the role picked last time first, or record the one picked now.").BoolVar(&loginFlags.NoRememberRole)
+	cmdLogin.Flag("simple-prompt", "Pick the role by number instead of from a list filtered as you type, the default when stdout isn't a terminal.").BoolVar(&loginFlags.SimplePrompt)
+	cmdLogin.Flag("policy", "Inline JSON session policy narrowing the permissions of the credentials, in place of the policy file. (env: SAML2AWS_POLICY)").Envar("SAML2AWS_POLICY").StringVar(&commonFlags.Policy)
+	cmdLogin.Flag("policy-file", "File of the JSON session policy narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_FILE)").Envar("SAML2AWS_POLICY_FILE").StringVar(&commonFlags.PolicyFile)
+	cmdLogin.Flag("policy-arns", "Comma separated managed policy ARNs narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_ARNS)").Envar("SAML2AWS_POLICY_ARNS").StringVar(&commonFlags.PolicyARNs)
+	cmdLogin.Flag("write-region", "Also write the IDP account's region into the profile in the AWS config file.").BoolVar(&loginFlags.WriteRegion)
 	cmdLogin.Flag("credentials-file", "The file that will cache the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
 	cmdLogin.Flag("cache-saml", "Caches the SAML response (env: SAML2AWS_CACHE_SAML)").Envar("SAML2AWS_CACHE_SAML").BoolVar(&commonFlags.SAMLCache)
 	cmdLogin.Flag("cache-file", "The location of the SAML cache file (env: SAML2AWS_SAML_CACHE_FILE)").Envar("SAML2AWS_SAML_CACHE_FILE").StringVar(&commonFlags.SAMLCacheFile)
 	cmdLogin.Flag("download-browser-driver", "Automatically download browsers for Browser IDP. (env: SAML2AWS_AUTO_BROWSER_DOWNLOAD)").Envar("SAML2AWS_AUTO_BROWSER_DOWNLOAD").BoolVar(&loginFlags.DownloadBrowser)
 	cmdLogin.Flag("disable-sessions", "Do not use Okta sessions. Uses Okta sessions by default. (env: SAML2AWS_OKTA_DISABLE_SESSIONS)").Envar("SAML2AWS_OKTA_DISABLE_SESSIONS").BoolVar(&commonFlags.DisableSessions)
 	cmdLogin.Flag("disable-remember-device", "Do not remember Okta MFA device. Remembers MFA device by default. (env: SAML2AWS_OKTA_DISABLE_REMEMBER_DEVICE)").Envar("SAML2AWS_OKTA_DISABLE_REMEMBER_DEVICE").BoolVar(&commonFlags.DisableRememberDevice)
+	cmdLogin.Flag("disable-device-token", "Do not keep the Okta device token and session between logins, which lets Okta skip MFA on a known device. (env: SAML2AWS_OKTA_DISABLE_DEVICE_TOKEN)").Envar("SAML2AWS_OKTA_DISABLE_DEVICE_TOKEN").BoolVar(&commonFlags.DisableDeviceToken)
+
+	// `credential-process` command and settings
+	cmdCredentialProcess := app.Command("credential-process", "Print credentials as the JSON of an AWS credential_process, reusing cached ones until they are about to expire, without writing the AWS credentials file.")
+	credentialProcessFlags := new(flags.LoginExecFlags)
+	credentialProcessFlags.CommonFlags = commonFlags
+	credentialProcessFlags.CredentialProcess = true
+	cmdCredentialProcess.Flag("profile", "The profile the credentials are cached under. (env: SAML2AWS_PROFILE)").Short('p').Envar("SAML2AWS_PROFILE").StringVar(&commonFlags.Profile)
+	cmdCredentialProcess.Flag("force", "Authenticate again even if the cached credentials are still valid.").BoolVar(&credentialProcessFlags.Force)
+	cmdCredentialProcess.Flag("credentials-file", "Cache the credentials in this credentials file rather than the saml2aws cache directory. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
+	cmdCredentialProcess.Flag("cache-saml", "Caches the SAML response (env: SAML2AWS_CACHE_SAML)").Envar("SAML2AWS_CACHE_SAML").BoolVar(&commonFlags.SAMLCache)
+	cmdCredentialProcess.Flag("cache-file", "The location of the SAML cache file (env: SAML2AWS_SAML_CACHE_FILE)").Envar("SAML2AWS_SAML_CACHE_FILE").StringVar(&commonFlags.SAMLCacheFile)
+	cmdCredentialProcess.Flag("policy", "Inline JSON session policy narrowing the permissions of the credentials, in place of the policy file. (env: SAML2AWS_POLICY)").Envar("SAML2AWS_POLICY").StringVar(&commonFlags.Policy)
+	cmdCredentialProcess.Flag("policy-file", "File of the JSON session policy narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_FILE)").Envar("SAML2AWS_POLICY_FILE").StringVar(&commonFlags.PolicyFile)
+	cmdCredentialProcess.Flag("policy-arns", "Comma separated managed policy ARNs narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_ARNS)").Envar("SAML2AWS_POLICY_ARNS").StringVar(&commonFlags.PolicyARNs)
+	cmdCredentialProcess.Flag("download-browser-driver", "Automatically download browsers for Browser IDP. (env: SAML2AWS_AUTO_BROWSER_DOWNLOAD)").Envar("SAML2AWS_AUTO_BROWSER_DOWNLOAD").BoolVar(&credentialProcessFlags.DownloadBrowser)
+
+	// `serve` command and settings
+	cmdServe := app.Command("serve", "Serve credentials to the AWS tools over the ECS container credentials endpoint, logging in again before they expire.")
+	serveFlags := new(flags.LoginExecFlags)
+	serveFlags.CommonFlags = commonFlags
+	var serveListen string
+	cmdServe.Flag("listen", "The loopback address and port to listen on. (env: SAML2AWS_SERVE_LISTEN)").Envar("SAML2AWS_SERVE_LISTEN").Default("127.0.0.1:9099").StringVar(&serveListen)
+	cmdServe.Flag("policy", "Inline JSON session policy narrowing the permissions of the credentials, in place of the policy file. (env: SAML2AWS_POLICY)").Envar("SAML2AWS_POLICY").StringVar(&commonFlags.Policy)
+	cmdServe.Flag("policy-file", "File of the JSON session policy narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_FILE)").Envar("SAML2AWS_POLICY_FILE").StringVar(&commonFlags.PolicyFile)
+	cmdServe.Flag("policy-arns", "Comma separated managed policy ARNs narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_ARNS)").Envar("SAML2AWS_POLICY_ARNS").StringVar(&commonFlags.PolicyARNs)
+
+	// `refresh` command and settings
+	cmdRefresh := app.Command("refresh", "Login, and with --watch keep logging in again without prompting shortly before the credentials expire.")
+	refreshFlags := new(flags.LoginExecFlags)
+	refreshFlags.CommonFlags = commonFlags
+	var refreshWatch bool
+	cmdRefresh.Flag("watch", "Keep running, logging in again shortly before the credentials expire, until interrupted. The password and MFA have to be saved in the keychain or set with flags or the environment.").BoolVar(&refreshWatch)
+	cmdRefresh.Flag("profile", "The AWS profile to save the temporary credentials. (env: SAML2AWS_PROFILE)").Short('p').Envar("SAML2AWS_PROFILE").StringVar(&commonFlags.Profile)
+	cmdRefresh.Flag("force", "Refresh credentials even if not expired.").BoolVar(&refreshFlags.Force)
+	cmdRefresh.Flag("credentials-file", "The file that will cache the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
+	cmdRefresh.Flag("cache-saml", "Caches the SAML response (env: SAML2AWS_CACHE_SAML)").Envar("SAML2AWS_CACHE_SAML").BoolVar(&commonFlags.SAMLCache)
+	cmdRefresh.Flag("cache-file", "The location of the SAML cache file (env: SAML2AWS_SAML_CACHE_FILE)").Envar("SAML2AWS_SAML_CACHE_FILE").StringVar(&commonFlags.SAMLCacheFile)
 
 	// `exec` command and settings
 	cmdExec := app.Command("exec", "Exec the supplied command with env vars from STS token.")
@@ -130,6 +204,9 @@ func main() {
 	cmdExec.Flag("profile", "The AWS profile to save the temporary credentials. (env: SAML2AWS_PROFILE)").Envar("SAML2AWS_PROFILE").Short('p').StringVar(&commonFlags.Profile)
 	cmdExec.Flag("exec-profile", "The AWS profile to utilize for command execution. Useful to allow the aws cli to perform secondary role assumption. (env: SAML2AWS_EXEC_PROFILE)").Envar("SAML2AWS_EXEC_PROFILE").StringVar(&execFlags.ExecProfile)
 	cmdExec.Flag("credentials-file", "The file that will cache the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
+	cmdExec.Flag("policy", "Inline JSON session policy narrowing the permissions of the credentials, in place of the policy file. (env: SAML2AWS_POLICY)").Envar("SAML2AWS_POLICY").StringVar(&commonFlags.Policy)
+	cmdExec.Flag("policy-file", "File of the JSON session policy narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_FILE)").Envar("SAML2AWS_POLICY_FILE").StringVar(&commonFlags.PolicyFile)
+	cmdExec.Flag("policy-arns", "Comma separated managed policy ARNs narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_ARNS)").Envar("SAML2AWS_POLICY_ARNS").StringVar(&commonFlags.PolicyARNs)
 	cmdLine := buildCmdList(cmdExec.Arg("command", "The command to execute."))
 
 	// `console` command and settings
@@ -140,6 +217,9 @@ func main() {
 	cmdConsole.Flag("exec-profile", "The AWS profile to utilize for console execution. (env: SAML2AWS_EXEC_PROFILE)").Envar("SAML2AWS_EXEC_PROFILE").StringVar(&consoleFlags.LoginExecFlags.ExecProfile)
 	cmdConsole.Flag("profile", "The AWS profile to save the temporary credentials. (env: SAML2AWS_PROFILE)").Envar("SAML2AWS_PROFILE").Short('p').StringVar(&commonFlags.Profile)
 	cmdConsole.Flag("force", "Refresh credentials even if not expired.").BoolVar(&consoleFlags.LoginExecFlags.Force)
+	cmdConsole.Flag("policy", "Inline JSON session policy narrowing the permissions of the credentials, in place of the policy file. (env: SAML2AWS_POLICY)").Envar("SAML2AWS_POLICY").StringVar(&commonFlags.Policy)
+	cmdConsole.Flag("policy-file", "File of the JSON session policy narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_FILE)").Envar("SAML2AWS_POLICY_FILE").StringVar(&commonFlags.PolicyFile)
+	cmdConsole.Flag("policy-arns", "Comma separated managed policy ARNs narrowing the permissions of the credentials. (env: SAML2AWS_POLICY_ARNS)").Envar("SAML2AWS_POLICY_ARNS").StringVar(&commonFlags.PolicyARNs)
 	cmdConsole.Flag("link", "Present link to AWS console instead of opening browser").BoolVar(&consoleFlags.Link)
 	cmdConsole.Flag("credentials-file", "The file that will cache the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
 
@@ -147,9 +227,62 @@ func main() {
 	cmdListRoles := app.Command("list-roles", "List available role ARNs.")
 	cmdListRoles.Flag("cache-saml", "Caches the SAML response (env: SAML2AWS_CACHE_SAML)").Envar("SAML2AWS_CACHE_SAML").BoolVar(&commonFlags.SAMLCache)
 	cmdListRoles.Flag("cache-file", "The location of the SAML cache file (env: SAML2AWS_SAML_CACHE_FILE)").Envar("SAML2AWS_SAML_CACHE_FILE").StringVar(&commonFlags.SAMLCacheFile)
+	var listRolesFormat string
+	cmdListRoles.
+		Flag("format", "Output format. Options include: text, json, csv").
+		Default("text").
+		EnumVar(&listRolesFormat, "text", "json", "csv")
 	listRolesFlags := new(flags.LoginExecFlags)
 	listRolesFlags.CommonFlags = commonFlags
 
+	// `list-idp-accounts` command and settings
+	cmdListIDPAccounts := app.Command("list-idp-accounts", "List the configured IDP account names.").Alias("list-accounts")
+	var listFormat string
+	cmdListIDPAccounts.
+		Flag("format", "Output format. Options include: text, json").
+		Default("text").
+		EnumVar(&listFormat, "text", "json")
+	listAliases := cmdListIDPAccounts.Flag("aliases", "Include the aliases of each IDP account.").Bool()
+
+	// `verify` command
+	cmdVerify := app.Command("verify", "Check every IDP account is valid and its URL can be reached, without logging in.")
+
+	// `doctor` command
+	cmdDoctor := app.Command("doctor", "Fetch the login page of every IDP account and warn when it isn't what the provider expects, without logging in.")
+
+	// `configure-mfa` command and settings
+	cmdConfigureMFA := app.Command("configure-mfa", "Save the TOTP secret of an IDP account in the keyring, so logins with mfa TOTP generate the code.")
+	var totpSecret string
+	cmdConfigureMFA.Flag("totp-secret", "The base32 TOTP secret, asked for when not set. (env: SAML2AWS_TOTP_SECRET)").Envar("SAML2AWS_TOTP_SECRET").StringVar(&totpSecret)
+
+	// `clear-browser-session` command
+	cmdClearBrowserSession := app.Command("clear-browser-session", "Wipe the browser profile of an IDP account, signing the Browser provider out of the IdP.")
+
+	// `delete-account` command and settings
+	cmdDeleteAccount := app.Command("delete-account", "Delete an IDP account, its stored credentials, TOTP seed, Okta device token and cached SAML assertion.")
+	var deleteForce bool
+	cmdDeleteAccount.Flag("force", "Delete everything without asking for confirmation.").BoolVar(&deleteForce)
+
+	// `rename-idp-account` command and settings
+	cmdRenameIDPAccount := app.Command("rename-idp-account", "Rename an IDP account, keeping its stored credentials, TOTP seed, Okta device token and cached SAML assertion.")
+	renameFrom := cmdRenameIDPAccount.Arg("old", "The current name of the IDP account.").Required().String()
+	renameTo := cmdRenameIDPAccount.Arg("new", "The new name for the IDP account.").Required().String()
+
+	// `exportconfig` command and settings
+	cmdExportConfig := app.Command("exportconfig", "Export IDP accounts so they can be shared and imported with importconfig.")
+	var exportAccount, exportFormat string
+	cmdExportConfig.Flag("account", "The IDP account to export, all accounts are exported when not set.").StringVar(&exportAccount)
+	cmdExportConfig.
+		Flag("format", "Output format. Options include: yaml, json").
+		Default("yaml").
+		EnumVar(&exportFormat, "yaml", "json")
+
+	// `importconfig` command and settings
+	cmdImportConfig := app.Command("importconfig", "Import IDP accounts exported with exportconfig.")
+	importFile := cmdImportConfig.Arg("file", "The yaml or json file holding the accounts.").Required().String()
+	var importForce bool
+	cmdImportConfig.Flag("force", "Overwrite existing accounts without asking for confirmation.").BoolVar(&importForce)
+
 	// `script` command and settings
 	cmdScript := app.Command("script", "Emit a script that will export environment variables.")
 	scriptFlags := new(flags.LoginExecFlags)
@@ -158,9 +291,8 @@ func main() {
 	cmdScript.Flag("credentials-file", "The file that will cache the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
 	var shell string
 	cmdScript.
-		Flag("shell", "Type of shell environment. Options include: bash, /bin/sh, powershell, fish, env").
-		Default("bash").
-		EnumVar(&shell, "bash", "/bin/sh", "powershell", "fish", "env")
+		Flag("shell", "Type of shell environment, defaults to the shell script is run from. Options include: bash, /bin/sh, powershell, fish, cmd, env").
+		EnumVar(&shell, "bash", "/bin/sh", "powershell", "fish", "cmd", "env")
 
 	// Trigger the parsing of the command line inputs via kingpin
 	command := kingpin.MustParse(app.Parse(os.Args[1:]))
@@ -177,10 +309,22 @@ func main() {
 		errtpl = "%+v\n"
 	}
 
-	if *quiet || (command == cmdLogin.FullCommand() && loginFlags.CredentialProcess) {
+	err := logging.Configure(*logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	commonFlags.Quiet = *quiet
+
+	credentialProcess := command == cmdCredentialProcess.FullCommand() || (command == cmdLogin.FullCommand() && loginFlags.CredentialProcess)
+	if commonFlags.Quiet || credentialProcess {
 		log.SetOutput(io.Discard)
 		logrus.SetOutput(io.Discard)
 	}
+	// the AWS SDK runs the credential process without a terminal, nobody would answer a prompt
+	if commonFlags.Quiet || credentialProcess {
+		prompter.SetPrompter(prompter.NewNonInteractivePrompter())
+	}
 
 	// Set the default transport settings so all http clients will pick them up.
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: commonFlags.SkipVerify}
@@ -188,24 +332,63 @@ func main() {
 
 	logrus.WithField("command", command).Debug("Running")
 
-	var err error
 	switch command {
 	case cmdScript.FullCommand():
 		err = commands.Script(scriptFlags, shell)
 	case cmdLogin.FullCommand():
 		err = commands.Login(loginFlags)
+	case cmdCredentialProcess.FullCommand():
+		err = commands.Login(credentialProcessFlags)
+	case cmdRefresh.FullCommand():
+		err = commands.Refresh(refreshFlags, refreshWatch)
+	case cmdServe.FullCommand():
+		err = commands.Serve(serveFlags, serveListen)
 	case cmdExec.FullCommand():
 		err = commands.Exec(execFlags, *cmdLine)
 	case cmdConsole.FullCommand():
 		err = commands.Console(consoleFlags)
 	case cmdListRoles.FullCommand():
-		err = commands.ListRoles(listRolesFlags)
+		err = commands.ListRoles(listRolesFlags, listRolesFormat)
+	case cmdListIDPAccounts.FullCommand():
+		err = commands.ListIDPAccounts(commonFlags, listFormat, *listAliases)
+	case cmdConfigureMFA.FullCommand():
+		err = commands.ConfigureMFA(commonFlags, totpSecret)
+	case cmdClearBrowserSession.FullCommand():
+		err = commands.ClearBrowserSession(commonFlags)
+	case cmdDeleteAccount.FullCommand():
+		err = commands.DeleteAccount(commonFlags, deleteForce)
+	case cmdRenameIDPAccount.FullCommand():
+		err = commands.RenameAccount(commonFlags, *renameFrom, *renameTo)
+	case cmdVerify.FullCommand():
+		err = commands.Verify(commonFlags)
+	case cmdDoctor.FullCommand():
+		err = commands.Doctor(commonFlags)
+	case cmdExportConfig.FullCommand():
+		err = commands.ExportConfig(commonFlags, exportAccount, exportFormat)
+	case cmdImportConfig.FullCommand():
+		err = commands.ImportConfig(commonFlags, *importFile, importForce)
 	case cmdConfigure.FullCommand():
-		err = commands.Configure(configFlags)
+		switch {
+		case migrateConfig:
+			err = commands.MigrateConfig()
+		case encryptConfig:
+			err = commands.EncryptConfig(configFlags)
+		case decryptConfig:
+			err = commands.DecryptConfig(configFlags)
+		default:
+			err = commands.Configure(configFlags)
+		}
 	}
 
 	if err != nil {
-		log.Printf(errtpl, err)
+		// the aws cli shows the credential process stderr, so report the failure there even though logging is silenced
+		if commonFlags.Quiet || credentialProcess {
+			fmt.Fprintf(os.Stderr, errtpl, err)
+		} else if *logFormat == logging.FormatJSON {
+			logrus.Error(err)
+		} else {
+			log.Printf(errtpl, err)
+		}
 		os.Exit(1)
 	}
 }
@@ -37,6 +37,11 @@ type Helper interface {
 	SupportsCredentialStorage() bool
 }
 
+// Disable stops saml2aws using the native credentials store, lookups find nothing and saves are dropped
+func Disable() {
+	CurrentHelper = &defaultHelper{}
+}
+
 // IsErrCredentialsNotFound returns true if the error
 // was caused by not having a set of credentials in a store.
 func IsErrCredentialsNotFound(err error) bool {
@@ -1,6 +1,7 @@
 package credentials
 
 import (
+	"net/url"
 	"path"
 
 	"github.com/versent/saml2aws/v2/pkg/creds"
@@ -52,3 +53,76 @@ func SaveCredentials(url, username, password string) error {
 func SupportsStorage() bool {
 	return CurrentHelper.SupportsCredentialStorage()
 }
+
+// DeleteCredentials remove the user credentials along with any provider specific entries.
+func DeleteCredentials(url, provider string) error {
+
+	err := CurrentHelper.Delete(url)
+	if err != nil && !IsErrCredentialsNotFound(err) {
+		return err
+	}
+
+	switch provider {
+	case "Okta":
+		err = CurrentHelper.Delete(url + "/sessionCookie")
+	case "OneLogin":
+		err = CurrentHelper.Delete(path.Join(url, "/auth/oauth2/v2/token"))
+	default:
+		return nil
+	}
+
+	if err != nil && !IsErrCredentialsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// totpSecretURL the keyring entry of the TOTP seed of an IDP account, seeds belong to the account rather than the
+// URL it shares with others
+func totpSecretURL(idpAccount string) string {
+	return "saml2aws://totp/" + url.PathEscape(idpAccount)
+}
+
+// LookupTOTPSecret the TOTP seed saved for the IDP account
+func LookupTOTPSecret(idpAccount string) (string, error) {
+	_, secret, err := CurrentHelper.Get(totpSecretURL(idpAccount))
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// SaveTOTPSecret save the TOTP seed of the IDP account.
+func SaveTOTPSecret(idpAccount, secret string) error {
+	return CurrentHelper.Add(&Credentials{
+		ServerURL: totpSecretURL(idpAccount),
+		Username:  idpAccount,
+		Secret:    secret,
+	})
+}
+
+// DeleteTOTPSecret remove the TOTP seed of the IDP account, there being none isn't an error
+func DeleteTOTPSecret(idpAccount string) error {
+	err := CurrentHelper.Delete(totpSecretURL(idpAccount))
+	if err != nil && !IsErrCredentialsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// RenameTOTPSecret move the TOTP seed of the IDP account to its new name, there being none isn't an error
+func RenameTOTPSecret(oldName, newName string) error {
+	secret, err := LookupTOTPSecret(oldName)
+	if IsErrCredentialsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := SaveTOTPSecret(newName, secret); err != nil {
+		return err
+	}
+
+	return DeleteTOTPSecret(oldName)
+}
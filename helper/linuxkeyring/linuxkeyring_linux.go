@@ -60,7 +60,11 @@ func (kr *KeyringHelper) Add(creds *credentials.Credentials) error {
 }
 
 func (kr *KeyringHelper) Delete(serverURL string) error {
-	return kr.keyring.Remove(serverURL)
+	err := kr.keyring.Remove(serverURL)
+	if err == keyring.ErrKeyNotFound {
+		return credentials.ErrCredentialsNotFound
+	}
+	return err
 }
 
 func (kr *KeyringHelper) Get(serverURL string) (string, string, error) {
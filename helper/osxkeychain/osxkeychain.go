@@ -54,6 +54,9 @@ func (h Osxkeychain) Delete(serverURL string) error {
 	}
 
 	err = keychain.DeleteItem(item)
+	if err == keychain.ErrorItemNotFound {
+		return credentials.ErrCredentialsNotFound
+	}
 	if err != nil {
 		return err
 	}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"log"
 	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
@@ -39,10 +42,16 @@ func PromptForConfigurationDetails(idpAccount *cfg.IDPAccount) error {
 
 	idpAccount.Profile = prompter.String("AWS Profile", idpAccount.Profile)
 
-	idpAccount.URL = prompter.String("URL", idpAccount.URL)
-	idpAccount.Username = prompter.String("Username", idpAccount.Username)
+	// IdentityCenter signs in at sso_start_url in the browser, without a username
+	if idpAccount.Provider != "IdentityCenter" {
+		idpAccount.URL = prompter.String("URL", idpAccount.URL)
+		idpAccount.Username = prompter.String("Username", idpAccount.Username)
+	}
 
 	switch idpAccount.Provider {
+	case "IdentityCenter":
+		idpAccount.SSOStartURL = prompter.String("AWS access portal URL", idpAccount.SSOStartURL)
+		idpAccount.SSORegion = prompter.String("Identity Center region", idpAccount.SSORegion)
 	case "OneLogin":
 		idpAccount.AppID = prompter.String("App ID", idpAccount.AppID)
 		log.Println("")
@@ -58,6 +67,63 @@ func PromptForConfigurationDetails(idpAccount *cfg.IDPAccount) error {
 	return nil
 }
 
+// CheckConfigurationDetails the counterpart of PromptForConfigurationDetails for configure --non-interactive,
+// which fails on what it would have asked for instead, naming the flags to set, and picks the provider's first
+// MFA when none is set
+func CheckConfigurationDetails(idpAccount *cfg.IDPAccount) error {
+
+	var missing []string
+
+	if idpAccount.Provider == "" {
+		missing = append(missing, "--idp-provider")
+	} else if _, ok := MFAsByProvider[idpAccount.Provider]; !ok {
+		return errors.Errorf("provider %q is not one of: %s", idpAccount.Provider, strings.Join(MFAsByProvider.Names(), ", "))
+	}
+
+	// IdentityCenter signs in at sso_start_url instead
+	if idpAccount.URL == "" && idpAccount.Provider != "IdentityCenter" {
+		missing = append(missing, "--url")
+	}
+
+	switch idpAccount.Provider {
+	case "OneLogin":
+		if idpAccount.AppID == "" {
+			missing = append(missing, "--app-id")
+		}
+		if idpAccount.Subdomain == "" {
+			missing = append(missing, "--subdomain")
+		}
+	case "F5APM":
+		if idpAccount.ResourceID == "" {
+			missing = append(missing, "--resource-id")
+		}
+	case "AzureAD":
+		if idpAccount.AppID == "" {
+			missing = append(missing, "--app-id")
+		}
+	case "IdentityCenter":
+		if idpAccount.SSOStartURL == "" {
+			missing = append(missing, "--sso-start-url")
+		}
+		if idpAccount.SSORegion == "" {
+			missing = append(missing, "--sso-region")
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.Errorf("%s required with --non-interactive", strings.Join(missing, ", "))
+	}
+
+	mfas := MFAsByProvider.Mfas(idpAccount.Provider)
+	if idpAccount.MFA == "" {
+		idpAccount.MFA = mfas[0]
+	} else if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
+		return errors.Errorf("mfa %q is not one of the %s MFAs: %s", idpAccount.MFA, idpAccount.Provider, strings.Join(mfas, ", "))
+	}
+
+	return nil
+}
+
 // PromptForLoginDetails prompt the user to present their username, password
 func PromptForLoginDetails(loginDetails *creds.LoginDetails, provider string) error {
 
@@ -89,24 +155,112 @@ func PromptForLoginDetails(loginDetails *creds.LoginDetails, provider string) er
 
 // PromptForAWSRoleSelection present a list of roles to the user for selection
 func PromptForAWSRoleSelection(accounts []*AWSAccount) (*AWSRole, error) {
+	return PromptForAWSRoleSelectionWithDefault(accounts, "")
+}
+
+// PromptForAWSRoleSelectionWithDefault present a list of roles to the user for selection, with the role of
+// defaultRoleARN selected to start with, or the first one when it isn't in the list. The roles are listed under
+// their account and typing narrows the list to the roles whose name, ARN, account alias or ID match.
+func PromptForAWSRoleSelectionWithDefault(accounts []*AWSAccount, defaultRoleARN string) (*AWSRole, error) {
 
 	roles := map[string]*AWSRole{}
+	searchText := map[string]string{}
 	var roleOptions []string
 
 	for _, account := range accounts {
 		for _, role := range account.Roles {
 			name := fmt.Sprintf("%s / %s", account.Name, role.Name)
 			roles[name] = role
+			searchText[name] = roleSearchText(account, role)
 			roleOptions = append(roleOptions, name)
 		}
 	}
 
 	sort.Strings(roleOptions)
 
-	selectedRole, err := prompter.ChooseWithDefault("Please choose the role", roleOptions[0], roleOptions)
+	defaultOption := roleOptions[0]
+	for _, option := range roleOptions {
+		if roles[option].RoleARN == defaultRoleARN {
+			defaultOption = option
+			break
+		}
+	}
+
+	filter := func(filter string, option string, index int) bool {
+		return roleMatches(filter, searchText[option])
+	}
+
+	selectedRole, err := prompter.ChooseWithFilter("Please choose the role", defaultOption, roleOptions, filter)
 	if err != nil {
 		return nil, errors.Wrap(err, "Role selection failed")
 	}
 
 	return roles[selectedRole], nil
 }
+
+// PromptForAWSRoleSelectionNumbered print the roles numbered under their account and ask for the number of one,
+// for terminals the interactive list doesn't work in
+func PromptForAWSRoleSelectionNumbered(accounts []*AWSAccount, defaultRoleARN string) (*AWSRole, error) {
+
+	sorted := make([]*AWSAccount, len(accounts))
+	copy(sorted, accounts)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var numbered []*AWSRole
+	defaultNumber := 1
+
+	for _, account := range sorted {
+		accountRoles := make([]*AWSRole, len(account.Roles))
+		copy(accountRoles, account.Roles)
+		sort.SliceStable(accountRoles, func(i, j int) bool { return accountRoles[i].Name < accountRoles[j].Name })
+
+		prompter.Display(account.Name)
+		for _, role := range accountRoles {
+			numbered = append(numbered, role)
+			if role.RoleARN == defaultRoleARN {
+				defaultNumber = len(numbered)
+			}
+			prompter.Display(fmt.Sprintf("  [%d] %s", len(numbered), role.Name))
+		}
+	}
+
+	if len(numbered) == 0 {
+		return nil, errors.New("Role selection failed: no roles to choose from")
+	}
+
+	answer := prompter.String("Please choose the role number", strconv.Itoa(defaultNumber))
+	number, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || number < 1 || number > len(numbered) {
+		return nil, fmt.Errorf("Role selection failed: %q isn't a role number between 1 and %d", answer, len(numbered))
+	}
+
+	return numbered[number-1], nil
+}
+
+// roleSearchText the text the role filter looks in, the account name with its alias and ID, and the role name and ARN
+func roleSearchText(account *AWSAccount, role *AWSRole) string {
+	return strings.ToLower(strings.Join([]string{account.Name, role.Name, role.RoleARN}, " "))
+}
+
+// roleMatches reports whether every word of the filter is found in the lower case search text of a role, in
+// order though not necessarily together, so "prodadm" finds production / Admin
+func roleMatches(filter, searchText string) bool {
+	for _, word := range strings.Fields(strings.ToLower(filter)) {
+		if !fuzzyContains(searchText, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// fuzzyContains reports whether the characters of word appear in text in the same order
+func fuzzyContains(text, word string) bool {
+	for _, r := range word {
+		i := strings.IndexRune(text, r)
+		if i < 0 {
+			return false
+		}
+		text = text[i+utf8.RuneLen(r):]
+	}
+	return true
+}
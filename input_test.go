@@ -0,0 +1,112 @@
+package saml2aws
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+func TestRoleMatches(t *testing.T) {
+	account := &AWSAccount{Name: "Account: production (123456789012)"}
+	role := &AWSRole{Name: "Administrator", RoleARN: "arn:aws:iam::123456789012:role/Administrator"}
+	searchText := roleSearchText(account, role)
+
+	// role name
+	assert.True(t, roleMatches("admin", searchText))
+	assert.True(t, roleMatches("ADMIN", searchText))
+	assert.True(t, roleMatches("adm str", searchText))
+	assert.False(t, roleMatches("readonly", searchText))
+
+	// account id
+	assert.True(t, roleMatches("123456789012", searchText))
+	assert.True(t, roleMatches("1234 admin", searchText))
+	assert.False(t, roleMatches("210987654321", searchText))
+
+	// account alias
+	assert.True(t, roleMatches("production", searchText))
+	assert.True(t, roleMatches("prodadm", searchText))
+	assert.False(t, roleMatches("sandbox", searchText))
+
+	assert.True(t, roleMatches("", searchText))
+}
+
+func TestPromptForAWSRoleSelectionNumbered(t *testing.T) {
+	accounts := []*AWSAccount{
+		{Name: "Account: sandbox (210987654321)", Roles: []*AWSRole{
+			{Name: "Developer", RoleARN: "arn:aws:iam::210987654321:role/Developer"},
+		}},
+		{Name: "Account: production (123456789012)", Roles: []*AWSRole{
+			{Name: "ReadOnly", RoleARN: "arn:aws:iam::123456789012:role/ReadOnly"},
+			{Name: "Admin", RoleARN: "arn:aws:iam::123456789012:role/Admin"},
+		}},
+	}
+
+	defer prompter.SetPrompter(prompter.ActivePrompter)
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Display", "Account: production (123456789012)").Return()
+	pr.Mock.On("Display", "  [1] Admin").Return()
+	pr.Mock.On("Display", "  [2] ReadOnly").Return()
+	pr.Mock.On("Display", "Account: sandbox (210987654321)").Return()
+	pr.Mock.On("Display", "  [3] Developer").Return()
+	pr.Mock.On("String", "Please choose the role number", "3").Return("2").Once()
+	pr.Mock.On("String", "Please choose the role number", "1").Return("4").Once()
+
+	role, err := PromptForAWSRoleSelectionNumbered(accounts, "arn:aws:iam::210987654321:role/Developer")
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/ReadOnly", role.RoleARN)
+
+	_, err = PromptForAWSRoleSelectionNumbered(accounts, "")
+	assert.EqualError(t, err, `Role selection failed: "4" isn't a role number between 1 and 3`)
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestCheckConfigurationDetails(t *testing.T) {
+	account := &cfg.IDPAccount{}
+	assert.EqualError(t, CheckConfigurationDetails(account), "--idp-provider, --url required with --non-interactive")
+
+	account = &cfg.IDPAccount{Provider: "Nope", URL: "https://id.example.com"}
+	assert.ErrorContains(t, CheckConfigurationDetails(account), `provider "Nope" is not one of: `)
+
+	account = &cfg.IDPAccount{Provider: "F5APM", URL: "https://id.example.com"}
+	assert.EqualError(t, CheckConfigurationDetails(account), "--resource-id required with --non-interactive")
+
+	account = &cfg.IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", MFA: "Push"}
+	assert.ErrorContains(t, CheckConfigurationDetails(account), `mfa "Push" is not one of the KeyCloak MFAs: `)
+
+	// the first MFA of the provider is the one the prompt would start on
+	account = &cfg.IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com"}
+	assert.Nil(t, CheckConfigurationDetails(account))
+	assert.Equal(t, "Auto", account.MFA)
+
+	account = &cfg.IDPAccount{Provider: "IdentityCenter"}
+	assert.EqualError(t, CheckConfigurationDetails(account), "--sso-start-url, --sso-region required with --non-interactive")
+
+	account = &cfg.IDPAccount{Provider: "IdentityCenter", SSOStartURL: "https://example.awsapps.com/start", SSORegion: "us-east-1"}
+	assert.Nil(t, CheckConfigurationDetails(account))
+}
+
+func TestPromptForConfigurationDetailsIdentityCenter(t *testing.T) {
+	defer prompter.SetPrompter(prompter.ActivePrompter)
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("ChooseWithDefault", "Please choose a provider:", "IdentityCenter", MFAsByProvider.Names()).Return("IdentityCenter", nil)
+	pr.Mock.On("String", "AWS Profile", "saml").Return("saml")
+	pr.Mock.On("String", "AWS access portal URL", "").Return("https://example.awsapps.com/start")
+	pr.Mock.On("String", "Identity Center region", "").Return("eu-west-1")
+
+	account := cfg.NewIDPAccount()
+	account.Profile = "saml"
+	account.Provider = "IdentityCenter"
+	assert.Nil(t, PromptForConfigurationDetails(account))
+	pr.Mock.AssertExpectations(t)
+
+	assert.Equal(t, "IdentityCenter", account.Provider)
+	assert.Equal(t, "Auto", account.MFA)
+	assert.Equal(t, "https://example.awsapps.com/start", account.SSOStartURL)
+	assert.Equal(t, "eu-west-1", account.SSORegion)
+	assert.Nil(t, account.Validate())
+}
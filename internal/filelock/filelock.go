@@ -0,0 +1,106 @@
+// Package filelock guards the files saml2aws shares with other saml2aws processes, the configuration, the AWS
+// credentials and config files and the browser profile, with an advisory lock on a lock file next to them.
+package filelock
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrLocked returned when another process holds the lock on a file, for longer than the lock timeout when waiting
+var ErrLocked = errors.New("timed out waiting for another saml2aws process to finish with the file")
+
+var (
+	logger = logrus.WithField("pkg", "filelock")
+
+	timeout        = 10 * time.Second
+	initialBackoff = 10 * time.Millisecond
+	maxBackoff     = 500 * time.Millisecond
+)
+
+// Lock takes the lock on the lock file next to filename, exclusive for writers and shared for readers, backing
+// off exponentially while another process holds it. The lock belongs to the open file so the OS drops it when the
+// process exits, a signal included, and the unlock returned is deferred so a panic releases it as well.
+func Lock(filename string, exclusive bool) (func(), error) {
+	f, err := open(filename, exclusive)
+	if err != nil || f == nil {
+		return func() {}, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	backoff := initialBackoff
+	for {
+		locked, err := tryLockFile(f, exclusive)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "unable to lock %s", filename)
+		}
+		if locked {
+			return release(f), nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			f.Close()
+			return nil, errors.Wrapf(ErrLocked, "%s", filename)
+		}
+
+		logger.WithField("filename", filename).WithField("backoff", backoff).Debug("File locked, retrying")
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// TryLock takes the exclusive lock on the lock file next to filename, failing with ErrLocked straight away rather
+// than waiting when another process holds it
+func TryLock(filename string) (func(), error) {
+	f, err := open(filename, true)
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := tryLockFile(f, true)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "unable to lock %s", filename)
+	}
+	if !locked {
+		f.Close()
+		return nil, errors.Wrapf(ErrLocked, "%s", filename)
+	}
+
+	return release(f), nil
+}
+
+// open the lock file, readers only wait on a lock file a writer has already created, which keeps reading working
+// when the directory is missing or read only, so a reader gets no file and no error when it can't be opened
+func open(filename string, exclusive bool) (*os.File, error) {
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_CREATE | os.O_RDWR
+	}
+
+	f, err := os.OpenFile(filename+".lock", flag, 0600)
+	if err != nil {
+		if !exclusive {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "unable to open lock file for %s", filename)
+	}
+
+	return f, nil
+}
+
+func release(f *os.File) func() {
+	return func() {
+		// closing the file releases the lock regardless
+		_ = unlockFile(f)
+		f.Close()
+	}
+}
@@ -0,0 +1,67 @@
+package filelock
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	defer func(d time.Duration) { timeout = d }(timeout)
+	timeout = 100 * time.Millisecond
+
+	filename := filepath.Join(t.TempDir(), "credentials")
+
+	unlock, err := Lock(filename, true)
+	assert.Nil(t, err)
+
+	_, err = Lock(filename, true)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	_, err = Lock(filename, false)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	unlock()
+
+	unlock, err = Lock(filename, false)
+	assert.Nil(t, err)
+
+	// readers share the lock
+	unlockReader, err := Lock(filename, false)
+	assert.Nil(t, err)
+	unlockReader()
+
+	_, err = Lock(filename, true)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	unlock()
+}
+
+func TestLockReaderWithoutLockFile(t *testing.T) {
+	unlock, err := Lock(filepath.Join(t.TempDir(), "missing", "saml2aws"), false)
+	assert.Nil(t, err)
+	unlock()
+
+	_, err = Lock(filepath.Join(t.TempDir(), "missing", "saml2aws"), true)
+	assert.Error(t, err)
+}
+
+func TestTryLock(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "profile")
+
+	unlock, err := TryLock(filename)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, err = TryLock(filename)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.Less(t, time.Since(start), time.Second)
+
+	unlock()
+
+	unlock, err = TryLock(filename)
+	assert.Nil(t, err)
+	unlock()
+}
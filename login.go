@@ -0,0 +1,212 @@
+package saml2aws
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+// RolePicker chooses the role to log in with from those in the SAML assertion
+type RolePicker func(ctx context.Context, roles []*AWSRole) (*AWSRole, error)
+
+// LoginOptions how Login talks to the IdP and the user, the zero value uses the account's settings and the terminal
+type LoginOptions struct {
+	// LoginDetails the username, password and MFA token to log in with, the URL defaults to the account's
+	LoginDetails *creds.LoginDetails
+	// Prompter answers the questions providers ask during login, such as MFA codes, in place of the terminal.
+	// It is handed to the provider with the login details, the active prompter is left alone.
+	Prompter prompter.Prompter
+	// RoleAliases the role_aliases section, used when the role_arn of the account names one of them
+	RoleAliases map[string]string
+	// RolePicker chooses the role when the assertion has several and the account has neither role_arn nor
+	// role_matcher, it is offered the roles role_filter leaves
+	RolePicker RolePicker
+}
+
+// stsAPI is used to mock out STS
+type stsAPI interface {
+	AssumeRoleWithSAMLWithContext(ctx aws.Context, input *sts.AssumeRoleWithSAMLInput, opts ...request.Option) (*sts.AssumeRoleWithSAMLOutput, error)
+}
+
+// newSAMLClient and newSTSClient are replaced in tests
+var (
+	newSAMLClient = NewSAMLClient
+	newSTSClient  = func(account *cfg.IDPAccount) (stsAPI, error) {
+		sess, err := session.NewSession(STSConfig(account))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create session")
+		}
+		return sts.New(sess), nil
+	}
+)
+
+// Login authenticates to the IdP of the account, picks a role and returns its STS credentials, without reading or
+// writing the saml2aws config, the keyring or the AWS credentials file. The account is left as it is, the
+// partition and role alias are applied to a copy.
+func Login(ctx context.Context, account *cfg.IDPAccount, opts LoginOptions) (*awsconfig.AWSCredentials, error) {
+	prepared := *account
+	account = &prepared
+
+	if err := PrepareAccount(account, opts.RoleAliases); err != nil {
+		return nil, err
+	}
+
+	if err := account.Validate(); err != nil {
+		return nil, errors.Wrap(err, "failed to validate account")
+	}
+
+	loginDetails := &creds.LoginDetails{}
+	if opts.LoginDetails != nil {
+		details := *opts.LoginDetails
+		loginDetails = &details
+	}
+	if loginDetails.URL == "" {
+		loginDetails.URL = account.URL
+	}
+
+	if opts.Prompter != nil {
+		loginDetails.Prompter = opts.Prompter
+	}
+
+	provider, err := newSAMLClient(account)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create SAML client")
+	}
+
+	if err := provider.Validate(loginDetails); err != nil {
+		return nil, errors.Wrap(err, "failed to validate login details")
+	}
+
+	result, err := authenticateContext(ctx, provider, loginDetails, account.RoleAttributeName)
+	if err != nil {
+		return nil, errors.Wrap(err, "error authenticating to IdP")
+	}
+	if result.SAMLAssertion == "" {
+		return nil, errors.New("no SAML assertion received from the IdP")
+	}
+
+	role, err := pickRole(ctx, account, result.Roles, opts.RolePicker)
+	if err != nil {
+		return nil, err
+	}
+
+	account.ApplyRolePartition(role.RoleARN)
+
+	return assumeRoleWithSAML(ctx, account, role, result)
+}
+
+// authenticateContext authenticates to the IdP, giving up when the context is done. Providers can't be
+// cancelled, one still running is left to finish on its own and its result dropped.
+func authenticateContext(ctx context.Context, provider SAMLClient, loginDetails *creds.LoginDetails, roleAttributeName string) (*AuthenticationResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type authentication struct {
+		result *AuthenticationResult
+		err    error
+	}
+
+	done := make(chan authentication, 1)
+	go func() {
+		result, err := AuthenticateDetailed(provider, loginDetails, roleAttributeName)
+		done <- authentication{result, err}
+	}()
+
+	select {
+	case auth := <-done:
+		return auth.result, auth.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pickRole the role role_arn or role_matcher of the account name, the only role in the assertion role_filter
+// leaves or the one the picker chooses
+func pickRole(ctx context.Context, account *cfg.IDPAccount, awsRoles []*AWSRole, picker RolePicker) (*AWSRole, error) {
+	if len(awsRoles) == 0 {
+		return nil, errors.New("no roles available in the SAML assertion")
+	}
+
+	role, err := ConfiguredRole(awsRoles, account)
+	if role != nil || err != nil {
+		return role, err
+	}
+
+	if account.RoleFilter != "" {
+		awsRoles, _, err = FilterRoles(awsRoles, nil, account.RoleFilter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(awsRoles) == 1 {
+		return awsRoles[0], nil
+	}
+
+	if picker == nil {
+		return nil, errors.New("multiple roles available, set role_arn or role_matcher on the account or a RolePicker in the options")
+	}
+
+	role, err = picker(ctx, awsRoles)
+	if err != nil {
+		return nil, errors.Wrap(err, "role selection failed")
+	}
+	if role == nil {
+		return nil, errors.New("role selection failed, no role chosen")
+	}
+
+	return role, nil
+}
+
+func assumeRoleWithSAML(ctx context.Context, account *cfg.IDPAccount, role *AWSRole, result *AuthenticationResult) (*awsconfig.AWSCredentials, error) {
+	svc, err := newSTSClient(account)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := svc.AssumeRoleWithSAMLWithContext(ctx, &sts.AssumeRoleWithSAMLInput{
+		PrincipalArn:    aws.String(role.PrincipalARN),
+		RoleArn:         aws.String(role.RoleARN),
+		SAMLAssertion:   aws.String(result.SAMLAssertion),
+		DurationSeconds: aws.Int64(result.SessionDuration(account.SessionDuration, time.Now())),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving STS credentials using SAML")
+	}
+
+	return &awsconfig.AWSCredentials{
+		AWSAccessKey:     aws.StringValue(resp.Credentials.AccessKeyId),
+		AWSSecretKey:     aws.StringValue(resp.Credentials.SecretAccessKey),
+		AWSSessionToken:  aws.StringValue(resp.Credentials.SessionToken),
+		AWSSecurityToken: aws.StringValue(resp.Credentials.SessionToken),
+		PrincipalARN:     aws.StringValue(resp.AssumedRoleUser.Arn),
+		Expires:          resp.Credentials.Expiration.Local(),
+		Region:           account.Region,
+	}, nil
+}
+
+// STSConfig builds the session config for the STS client, sts_region pins the regional STS endpoint
+// without changing the region the credentials are saved with
+func STSConfig(account *cfg.IDPAccount) *aws.Config {
+	if account.STSRegion != "" {
+		return &aws.Config{
+			Region:              aws.String(account.STSRegion),
+			STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+		}
+	}
+
+	return &aws.Config{
+		Region: &account.Region,
+	}
+}
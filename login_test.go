@@ -0,0 +1,268 @@
+package saml2aws
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+type fakeSAMLClient struct {
+	assertion    string
+	loginDetails *creds.LoginDetails
+	// release when set holds the authentication until it is closed
+	release chan struct{}
+}
+
+func (fc *fakeSAMLClient) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	if fc.release != nil {
+		<-fc.release
+	}
+	fc.loginDetails = loginDetails
+	// providers ask for MFA codes through the prompter of the login
+	loginDetails.MFAToken = loginDetails.Asker().RequestSecurityCode("000000")
+	return fc.assertion, nil
+}
+
+func (fc *fakeSAMLClient) Validate(loginDetails *creds.LoginDetails) error {
+	return nil
+}
+
+type fakeSTS struct {
+	account *cfg.IDPAccount
+	input   *sts.AssumeRoleWithSAMLInput
+}
+
+func (fs *fakeSTS) AssumeRoleWithSAMLWithContext(ctx aws.Context, input *sts.AssumeRoleWithSAMLInput, opts ...request.Option) (*sts.AssumeRoleWithSAMLOutput, error) {
+	fs.input = input
+	return &sts.AssumeRoleWithSAMLOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("AKIAEXAMPLE"),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+		AssumedRoleUser: &sts.AssumedRoleUser{
+			Arn: aws.String(aws.StringValue(input.RoleArn) + "/user"),
+		},
+	}, nil
+}
+
+func setupLogin(t *testing.T) (*fakeSAMLClient, *fakeSTS) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	samlClient := &fakeSAMLClient{assertion: b64.StdEncoding.EncodeToString(data)}
+	stsClient := &fakeSTS{}
+
+	oldSAMLClient, oldSTSClient := newSAMLClient, newSTSClient
+	t.Cleanup(func() { newSAMLClient, newSTSClient = oldSAMLClient, oldSTSClient })
+
+	newSAMLClient = func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return samlClient, nil }
+	newSTSClient = func(account *cfg.IDPAccount) (stsAPI, error) {
+		stsClient.account = account
+		return stsClient, nil
+	}
+
+	return samlClient, stsClient
+}
+
+func loginAccount() *cfg.IDPAccount {
+	account := cfg.NewIDPAccount()
+	account.Provider = "KeyCloak"
+	account.MFA = "Auto"
+	account.URL = "https://id.example.com"
+	account.Region = "us-east-1"
+	return account
+}
+
+func TestLoginRolePicker(t *testing.T) {
+	samlClient, stsClient := setupLogin(t)
+
+	active := prompter.ActivePrompter
+
+	pr := &mocks.Prompter{}
+	pr.Mock.On("RequestSecurityCode", "000000").Return("123456")
+
+	var offered []*AWSRole
+	awsCreds, err := Login(context.Background(), loginAccount(), LoginOptions{
+		LoginDetails: &creds.LoginDetails{Username: "alice", Password: "secret"},
+		Prompter:     pr,
+		RolePicker: func(ctx context.Context, roles []*AWSRole) (*AWSRole, error) {
+			offered = roles
+			return roles[1], nil
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Len(t, offered, 2)
+	assert.Equal(t, "arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSNonProd", aws.StringValue(stsClient.input.RoleArn))
+	assert.Equal(t, "arn:aws:iam::123123123123:saml-provider/ExampleADFS", aws.StringValue(stsClient.input.PrincipalArn))
+	assert.Equal(t, int64(cfg.DefaultSessionDuration), aws.Int64Value(stsClient.input.DurationSeconds))
+
+	assert.Equal(t, "AKIAEXAMPLE", awsCreds.AWSAccessKey)
+	assert.Equal(t, "token", awsCreds.AWSSessionToken)
+	assert.Equal(t, "us-east-1", awsCreds.Region)
+
+	// the URL defaults to the account's and the caller's prompter answered the MFA question
+	assert.Equal(t, "https://id.example.com", samlClient.loginDetails.URL)
+	assert.Equal(t, "alice", samlClient.loginDetails.Username)
+	assert.Equal(t, "123456", samlClient.loginDetails.MFAToken)
+	pr.Mock.AssertExpectations(t)
+
+	// the prompter goes to the provider with the login details, the active prompter is left alone
+	assert.Equal(t, pr, samlClient.loginDetails.Prompter)
+	assert.Equal(t, active, prompter.ActivePrompter)
+}
+
+func TestLoginRoleARN(t *testing.T) {
+	_, stsClient := setupLogin(t)
+
+	account := loginAccount()
+	account.RoleARN = "arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSBuild"
+
+	pr := &mocks.Prompter{}
+	pr.Mock.On("RequestSecurityCode", "000000").Return("")
+
+	_, err := Login(context.Background(), account, LoginOptions{
+		RolePicker: func(ctx context.Context, roles []*AWSRole) (*AWSRole, error) {
+			t.Fatal("role_arn is set, the picker shouldn't be asked")
+			return nil, nil
+		},
+		Prompter: pr,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, account.RoleARN, aws.StringValue(stsClient.input.RoleArn))
+}
+
+func TestLoginMultipleRolesWithoutPicker(t *testing.T) {
+	_, stsClient := setupLogin(t)
+
+	pr := &mocks.Prompter{}
+	pr.Mock.On("RequestSecurityCode", "000000").Return("")
+
+	_, err := Login(context.Background(), loginAccount(), LoginOptions{Prompter: pr})
+	assert.EqualError(t, err, "multiple roles available, set role_arn or role_matcher on the account or a RolePicker in the options")
+	assert.Nil(t, stsClient.input)
+}
+
+func TestLoginRolePickerError(t *testing.T) {
+	setupLogin(t)
+
+	pr := &mocks.Prompter{}
+	pr.Mock.On("RequestSecurityCode", "000000").Return("")
+
+	_, err := Login(context.Background(), loginAccount(), LoginOptions{
+		Prompter: pr,
+		RolePicker: func(ctx context.Context, roles []*AWSRole) (*AWSRole, error) {
+			return nil, errors.New("cancelled")
+		},
+	})
+	assert.EqualError(t, err, "role selection failed: cancelled")
+}
+
+func TestLoginCancelled(t *testing.T) {
+	samlClient, _ := setupLogin(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := Login(ctx, loginAccount(), LoginOptions{Prompter: &mocks.Prompter{}})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, samlClient.loginDetails)
+}
+
+func TestLoginCancelledWhileAuthenticating(t *testing.T) {
+	samlClient, stsClient := setupLogin(t)
+	samlClient.release = make(chan struct{})
+	defer close(samlClient.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// the provider left running still asks once it is released
+	pr := &mocks.Prompter{}
+	pr.Mock.On("RequestSecurityCode", "000000").Return("").Maybe()
+
+	_, err := Login(ctx, loginAccount(), LoginOptions{Prompter: pr})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Nil(t, stsClient.input)
+}
+
+func TestLoginRoleAlias(t *testing.T) {
+	_, stsClient := setupLogin(t)
+
+	account := loginAccount()
+	account.RoleARN = "build"
+
+	pr := &mocks.Prompter{}
+	pr.Mock.On("RequestSecurityCode", "000000").Return("")
+
+	_, err := Login(context.Background(), account, LoginOptions{
+		Prompter:    pr,
+		RoleAliases: map[string]string{"build": "arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSBuild"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSBuild", aws.StringValue(stsClient.input.RoleArn))
+
+	// the alias is resolved on a copy of the account
+	assert.Equal(t, "build", account.RoleARN)
+
+	_, err = Login(context.Background(), account, LoginOptions{Prompter: pr})
+	assert.EqualError(t, err, "Unknown role alias build, no role aliases are configured.")
+}
+
+func TestLoginRoleMatcherAndFilter(t *testing.T) {
+	_, stsClient := setupLogin(t)
+
+	pr := &mocks.Prompter{}
+	pr.Mock.On("RequestSecurityCode", "000000").Return("")
+
+	account := loginAccount()
+	account.RoleMatcher = "CloudOPSBuild$"
+	_, err := Login(context.Background(), account, LoginOptions{Prompter: pr})
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSBuild", aws.StringValue(stsClient.input.RoleArn))
+
+	// a filter leaving one role picks it without the picker
+	account = loginAccount()
+	account.RoleFilter = "NonProd"
+	_, err = Login(context.Background(), account, LoginOptions{Prompter: pr})
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSNonProd", aws.StringValue(stsClient.input.RoleArn))
+}
+
+func TestLoginRolePartition(t *testing.T) {
+	samlClient, stsClient := setupLogin(t)
+
+	data, err := b64.StdEncoding.DecodeString(samlClient.assertion)
+	assert.Nil(t, err)
+	samlClient.assertion = b64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(string(data), "arn:aws:", "arn:aws-us-gov:")))
+
+	pr := &mocks.Prompter{}
+	pr.Mock.On("RequestSecurityCode", "000000").Return("")
+
+	account := loginAccount()
+	account.RoleARN = "arn:aws-us-gov:iam::123123123123:role/AWS-Admin-CloudOPSBuild"
+
+	awsCreds, err := Login(context.Background(), account, LoginOptions{Prompter: pr})
+	assert.Nil(t, err)
+
+	// a GovCloud role is assumed through the GovCloud STS, not the commercial region of the account
+	assert.Equal(t, "us-gov-west-1", stsClient.account.Region)
+	assert.Equal(t, "us-gov-west-1", stsClient.account.STSRegion)
+	assert.Equal(t, "us-gov-west-1", awsCreds.Region)
+	assert.Equal(t, "us-east-1", account.Region)
+}
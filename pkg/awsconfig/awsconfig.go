@@ -10,6 +10,7 @@ import (
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/internal/filelock"
 	ini "gopkg.in/ini.v1"
 )
 
@@ -32,8 +33,14 @@ type AWSCredentials struct {
 	PrincipalARN     string    `ini:"x_principal_arn"`
 	Expires          time.Time `ini:"x_security_token_expires"`
 	Region           string    `ini:"region,omitempty"`
+	SourceIdentity   string    `ini:"x_source_identity,omitempty"` // source identity of the role session, set by the IdP
+	SAMLSubject      string    `ini:"x_saml_subject,omitempty"`    // NameID of the SAML assertion the credentials came from
 }
 
+// auditKeys the keys saved only when the login sets them, dropped otherwise so a profile doesn't keep those of
+// an earlier login
+var auditKeys = []string{"x_source_identity", "x_saml_subject"}
+
 // CredentialsProvider loads aws credentials file
 type CredentialsProvider struct {
 	Filename string
@@ -73,6 +80,21 @@ func (p *CredentialsProvider) Save(awsCreds *AWSCredentials) error {
 		return err
 	}
 
+	dirPath := filepath.Dir(filename)
+
+	err = os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create %s directory", dirPath)
+	}
+
+	// another login may be saving a different profile, without the lock one of them would be lost, it is held
+	// from creating the file to saving the profile so a file another login has just written isn't emptied again
+	unlock, err := filelock.Lock(filename, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	err = p.ensureConfigExists()
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -111,6 +133,16 @@ func (p *CredentialsProvider) Load() (*AWSCredentials, error) {
 	return awsCreds, nil
 }
 
+// Path the absolute path of the credentials file
+func (p *CredentialsProvider) Path() (string, error) {
+	filename, err := p.resolveFilename()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(filename)
+}
+
 // Expired checks if the current credentials are expired
 func (p *CredentialsProvider) Expired() bool {
 	creds, err := p.Load()
@@ -156,6 +188,8 @@ func (p *CredentialsProvider) ensureConfigExists() error {
 	return nil
 }
 
+// resolveFilename the credentials file, Filename when it is set, with ~ expanded to the home directory, otherwise
+// AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials
 func (p *CredentialsProvider) resolveFilename() (string, error) {
 	if p.Filename == "" {
 		filename, err := locateConfigFile()
@@ -166,6 +200,12 @@ func (p *CredentialsProvider) resolveFilename() (string, error) {
 		p.Filename = filename
 	}
 
+	filename, err := homedir.Expand(p.Filename)
+	if err != nil {
+		return "", ErrCredentialsHomeNotFound
+	}
+	p.Filename = filename
+
 	return p.Filename, nil
 }
 
@@ -214,19 +254,13 @@ func resolveSymlink(filename string) (string, error) {
 	return sympath, nil
 }
 
+// createAndSaveProfile and saveProfile are called with the lock on the credentials file held
 func createAndSaveProfile(filename, profile string, awsCreds *AWSCredentials) error {
-
-	dirPath := filepath.Dir(filename)
-
-	err := os.Mkdir(dirPath, 0700)
-	if err != nil {
-		return errors.Wrapf(err, "unable to create %s directory", dirPath)
-	}
-
-	_, err = os.Create(filename)
+	f, err := os.Create(filename)
 	if err != nil {
 		return errors.Wrapf(err, "unable to create configuration")
 	}
+	f.Close()
 
 	return saveProfile(filename, profile, awsCreds)
 }
@@ -241,6 +275,10 @@ func saveProfile(filename, profile string, awsCreds *AWSCredentials) error {
 		return err
 	}
 
+	for _, key := range auditKeys {
+		iniProfile.DeleteKey(key)
+	}
+
 	err = iniProfile.ReflectFrom(awsCreds)
 	if err != nil {
 		return err
@@ -248,3 +286,80 @@ func saveProfile(filename, profile string, awsCreds *AWSCredentials) error {
 
 	return config.SaveTo(filename)
 }
+
+// ProfileConfig the settings saved to a profile in the AWS CLI config file, empty ones are left as they are
+type ProfileConfig struct {
+	Region string
+	Output string
+}
+
+// SaveProfileRegion set the region of the profile in the AWS CLI config file, which is where the CLI and SDKs
+// look for it, unlike the region saved alongside the credentials
+func SaveProfileRegion(filename, profile, region string) error {
+	return SaveProfileConfig(filename, profile, ProfileConfig{Region: region})
+}
+
+// SaveProfileConfig set the region and output of the profile in the AWS CLI config file, creating the file when
+// there isn't one and keeping the other profiles and settings
+func SaveProfileConfig(filename, profile string, profileConfig ProfileConfig) error {
+	if filename == "" {
+		var err error
+		filename, err = locateAWSConfigFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create %s directory", filepath.Dir(filename))
+	}
+
+	unlock, err := filelock.Lock(filename, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	config, err := ini.LoadSources(ini.LoadOptions{Loose: true}, filename)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load file %s", filename)
+	}
+
+	// apart from default the config file prefixes profile sections with "profile"
+	section := profile
+	if profile != "default" {
+		section = "profile " + profile
+	}
+
+	if profileConfig.Region != "" {
+		config.Section(section).Key("region").SetValue(profileConfig.Region)
+	}
+	if profileConfig.Output != "" {
+		config.Section(section).Key("output").SetValue(profileConfig.Output)
+	}
+
+	return config.SaveTo(filename)
+}
+
+func locateAWSConfigFile() (string, error) {
+
+	filename := os.Getenv("AWS_CONFIG_FILE")
+
+	if filename != "" {
+		return filename, nil
+	}
+
+	var name string
+	var err error
+	if runtime.GOOS == "windows" {
+		name = path.Join(os.Getenv("USERPROFILE"), ".aws", "config")
+	} else {
+		name, err = homedir.Expand("~/.aws/config")
+		if err != nil {
+			return "", ErrCredentialsHomeNotFound
+		}
+	}
+
+	return resolveSymlink(name)
+}
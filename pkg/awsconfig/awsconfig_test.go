@@ -1,12 +1,17 @@
 package awsconfig
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/sirupsen/logrus"
 
 	"github.com/stretchr/testify/assert"
+	ini "gopkg.in/ini.v1"
 )
 
 func TestUpdateSamlConfig(t *testing.T) {
@@ -37,4 +42,155 @@ func TestUpdateSamlConfig(t *testing.T) {
 	assert.Equal(t, "testtoken", awsCreds.AWSSessionToken)
 
 	os.Remove(".credentials")
+	os.Remove(".credentials.lock")
+}
+
+func TestSaveProfileRegion(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), ".aws", "config")
+
+	err := SaveProfileRegion(filename, "saml", "us-west-2")
+	assert.Nil(t, err)
+
+	err = SaveProfileRegion(filename, "default", "eu-west-1")
+	assert.Nil(t, err)
+
+	err = SaveProfileRegion(filename, "saml", "ap-southeast-2")
+	assert.Nil(t, err)
+
+	config, err := ini.Load(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "ap-southeast-2", config.Section("profile saml").Key("region").String())
+	assert.Equal(t, "eu-west-1", config.Section("default").Key("region").String())
+}
+
+func TestSaveProfileConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), ".aws", "config")
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	assert.Nil(t, err)
+	err = os.WriteFile(filename, []byte("[profile other]\nregion = us-east-1\ncli_pager =\n\n[profile saml]\nregion = us-west-2\nsso_session = corp\n"), 0600)
+	assert.Nil(t, err)
+
+	err = SaveProfileConfig(filename, "saml", ProfileConfig{Region: "eu-west-1", Output: "json"})
+	assert.Nil(t, err)
+
+	// an empty setting leaves the saved one
+	err = SaveProfileConfig(filename, "saml", ProfileConfig{Output: "table"})
+	assert.Nil(t, err)
+
+	config, err := ini.Load(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "eu-west-1", config.Section("profile saml").Key("region").String())
+	assert.Equal(t, "table", config.Section("profile saml").Key("output").String())
+	assert.Equal(t, "corp", config.Section("profile saml").Key("sso_session").String())
+	assert.Equal(t, "us-east-1", config.Section("profile other").Key("region").String())
+	assert.True(t, config.Section("profile other").HasKey("cli_pager"))
+}
+
+func TestSaveConcurrentProfiles(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+	assert.Nil(t, os.WriteFile(filename, nil, 0600))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(profile string) {
+			defer wg.Done()
+			assert.Nil(t, NewSharedCredentials(profile, filename).Save(&AWSCredentials{AWSAccessKey: profile}))
+		}(fmt.Sprintf("profile%d", i))
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		awsCreds, err := NewSharedCredentials(fmt.Sprintf("profile%d", i), filename).Load()
+		if assert.Nil(t, err) {
+			assert.Equal(t, fmt.Sprintf("profile%d", i), awsCreds.AWSAccessKey)
+		}
+	}
+}
+
+func TestSaveConcurrentProfilesNewFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "aws", "credentials")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(profile string) {
+			defer wg.Done()
+			assert.Nil(t, NewSharedCredentials(profile, filename).Save(&AWSCredentials{AWSAccessKey: profile}))
+		}(fmt.Sprintf("profile%d", i))
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		awsCreds, err := NewSharedCredentials(fmt.Sprintf("profile%d", i), filename).Load()
+		if assert.Nil(t, err) {
+			assert.Equal(t, fmt.Sprintf("profile%d", i), awsCreds.AWSAccessKey)
+		}
+	}
+}
+
+func TestSaveAuditKeys(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+	assert.Nil(t, os.WriteFile(filename, nil, 0600))
+	sharedCreds := NewSharedCredentials("saml", filename)
+
+	err := sharedCreds.Save(&AWSCredentials{AWSAccessKey: "first", SourceIdentity: "jane@example.com", SAMLSubject: "EXAMPLE\\jane"})
+	assert.Nil(t, err)
+
+	awsCreds, err := sharedCreds.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "jane@example.com", awsCreds.SourceIdentity)
+	assert.Equal(t, "EXAMPLE\\jane", awsCreds.SAMLSubject)
+
+	// a login without them doesn't keep those of the one before
+	err = sharedCreds.Save(&AWSCredentials{AWSAccessKey: "second"})
+	assert.Nil(t, err)
+
+	awsCreds, err = sharedCreds.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "second", awsCreds.AWSAccessKey)
+	assert.Equal(t, "", awsCreds.SourceIdentity)
+	assert.Equal(t, "", awsCreds.SAMLSubject)
+}
+
+func TestSaveCustomCredentialsFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(home, "shared", "credentials"))
+	homedir.DisableCache = true
+	defer func() { homedir.DisableCache = false }()
+
+	sharedCreds := NewSharedCredentials("saml", "~/custom/nested/credentials")
+
+	// the file and the directories it is in are created
+	exist, err := sharedCreds.CredsExists()
+	assert.Nil(t, err)
+	assert.True(t, exist)
+
+	err = sharedCreds.Save(&AWSCredentials{AWSAccessKey: "testid", AWSSecretKey: "testsecret"})
+	assert.Nil(t, err)
+
+	filename := filepath.Join(home, "custom", "nested", "credentials")
+	assert.Equal(t, filename, sharedCreds.Filename)
+
+	config, err := ini.Load(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "testid", config.Section("saml").Key("aws_access_key_id").String())
+
+	// credentials_file takes precedence over AWS_SHARED_CREDENTIALS_FILE and the default location
+	assert.NoFileExists(t, filepath.Join(home, "shared", "credentials"))
+	assert.NoFileExists(t, filepath.Join(home, ".aws", "credentials"))
+}
+
+func TestSharedCredentialsFileEnv(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filename)
+
+	sharedCreds := NewSharedCredentials("saml", "")
+
+	err := sharedCreds.Save(&AWSCredentials{AWSAccessKey: "testid", AWSSecretKey: "testsecret"})
+	assert.Nil(t, err)
+	assert.Equal(t, filename, sharedCreds.Filename)
+	assert.FileExists(t, filename)
 }
@@ -1,11 +1,26 @@
 package cfg
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
 
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/internal/filelock"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 	ini "gopkg.in/ini.v1"
 )
@@ -13,10 +28,31 @@ import (
 // ErrIdpAccountNotFound returned if the idp account is not found in the configuration file
 var ErrIdpAccountNotFound = errors.New("IDP account not found, run configure to set it up")
 
+// ErrIdpAccountExists returned if the idp account already exists in the configuration file
+var ErrIdpAccountExists = errors.New("IDP account already exists")
+
+var (
+	logger = logrus.WithField("pkg", "cfg")
+
+	envVarPattern = regexp.MustCompile(`\$\{(\w+)\}|\$(\w+)`)
+
+	roleARNPattern = regexp.MustCompile(`^arn:aws[-a-z]*:iam::\d{12}:role/`)
+
+	policyARNPattern = regexp.MustCompile(`^arn:aws[-a-z]*:iam::(\d{12}|aws):policy/`)
+
+	profileNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+	profilePlaceholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+)
+
 const (
-	// DefaultConfigPath the default saml2aws configuration path
+	// DefaultConfigPath the legacy saml2aws configuration path, still used when it exists and there is no
+	// configuration file in the XDG config directory
 	DefaultConfigPath = "~/.saml2aws"
 
+	// ConfigFileEnvironmentVariableName Environment Variable used to override the configuration path
+	ConfigFileEnvironmentVariableName = "SAML2AWS_CONFIGFILE"
+
 	// DefaultAmazonWebservicesURN URN used when authenticating to aws using SAML
 	// NOTE: This only needs to be changed to log into GovCloud
 	DefaultAmazonWebservicesURN = "urn:amazon:webservices"
@@ -25,71 +61,145 @@ const (
 	// see https://aws.amazon.com/blogs/security/enable-federated-api-access-to-your-aws-resources-for-up-to-12-hours-using-iam-roles/
 	DefaultSessionDuration = 3600
 
+	// MinSessionDuration the shortest session duration STS will issue credentials for
+	MinSessionDuration = 900
+
+	// MaxSessionDuration the longest session duration STS will issue credentials for, a role's own
+	// maximum can be lower
+	MaxSessionDuration = 43200
+
+	// MaxPolicyARNs the most managed policies STS takes as session policies
+	MaxPolicyARNs = 10
+
+	// MaxAssertionClockSkew the most seconds the validity window of a SAML assertion can be widened by
+	MaxAssertionClockSkew = 300
+
 	// DefaultProfile this is the default profile name used to save the credentials in the aws cli
 	DefaultProfile = "saml"
 
+	// ConfigFilePermissions the permissions the configuration file is saved with, it can hold sensitive
+	// usernames and URLs so it is readable by the owner only
+	ConfigFilePermissions = 0600
+
+	// GlobalSectionName the configuration section holding defaults shared by every idp account
+	GlobalSectionName = "global"
+
+	// RoleAliasesSectionName the configuration section mapping short role names to role ARNs
+	RoleAliasesSectionName = "role_aliases"
+
+	// URNOverridesSectionName the configuration section mapping SAML provider ARN patterns to the URN their
+	// assertions are requested for
+	URNOverridesSectionName = "urn_overrides"
+
 	// Environment Variable used to define the Keyring Backend for Linux based distro
 	KeyringBackEnvironmentVariableName = "SAML2AWS_KEYRING_BACKEND"
 )
 
 // IDPAccount saml IDP account
 type IDPAccount struct {
-	Name                  string `ini:"name"`
-	AppID                 string `ini:"app_id"` // used by OneLogin and AzureAD
-	URL                   string `ini:"url"`
-	Username              string `ini:"username"`
-	Provider              string `ini:"provider"`
-	BrowserType           string `ini:"browser_type,omitempty"`            // used by 'Browser' Provider
-	BrowserExecutablePath string `ini:"browser_executable_path,omitempty"` // used by 'Browser' Provider
-	BrowserAutoFill       bool   `ini:"browser_autofill,omitempty"`        // used by 'Browser' Provider
-	MFA                   string `ini:"mfa"`
-	MFAIPAddress          string `ini:"mfa_ip_address"` // used by OneLogin
-	SkipVerify            bool   `ini:"skip_verify"`
-	Timeout               int    `ini:"timeout"`
-	AmazonWebservicesURN  string `ini:"aws_urn"`
-	SessionDuration       int    `ini:"aws_session_duration"`
-	Profile               string `ini:"aws_profile"`
-	ResourceID            string `ini:"resource_id"` // used by F5APM
-	Subdomain             string `ini:"subdomain"`   // used by OneLogin
-	RoleARN               string `ini:"role_arn"`
-	Region                string `ini:"region"`
-	HttpAttemptsCount     string `ini:"http_attempts_count"`
-	HttpRetryDelay        string `ini:"http_retry_delay"`
-	CredentialsFile       string `ini:"credentials_file"`
-	SAMLCache             bool   `ini:"saml_cache"`
-	SAMLCacheFile         string `ini:"saml_cache_file"`
-	TargetURL             string `ini:"target_url"`
-	DisableRememberDevice bool   `ini:"disable_remember_device"`      // used by Okta
-	DisableSessions       bool   `ini:"disable_sessions"`             // used by Okta
-	DownloadBrowser       bool   `ini:"download_browser_driver"`      // used by browser
-	BrowserDriverDir      string `ini:"browser_driver_dir,omitempty"` // used by browser; hide from user if not set
-	Headless              bool   `ini:"headless"`                     // used by browser
-	Prompter              string `ini:"prompter"`
-	KCAuthErrorMessage    string `ini:"kc_auth_error_message,omitempty"` // used by KeyCloak; hide from user if not set
-	KCAuthErrorElement    string `ini:"kc_auth_error_element,omitempty"` // used by KeyCloak; hide from user if not set
+	Name                     string `ini:"name"`
+	AppID                    string `ini:"app_id"` // used by OneLogin and AzureAD
+	URL                      string `ini:"url"`
+	Username                 string `ini:"username"`
+	Provider                 string `ini:"provider"`
+	Aliases                  string `ini:"aliases,omitempty"`                 // comma separated other names the account can be loaded by
+	BrowserType              string `ini:"browser_type,omitempty"`            // used by 'Browser' Provider
+	BrowserExecutablePath    string `ini:"browser_executable_path,omitempty"` // used by 'Browser' Provider
+	BrowserAutoFill          bool   `ini:"browser_autofill,omitempty"`        // used by 'Browser' Provider
+	MFA                      string `ini:"mfa"`
+	MFAFallback              string `ini:"mfa_fallback,omitempty"` // used by Okta; comma separated MFAs tried after MFA times out or is rejected
+	MFAIPAddress             string `ini:"mfa_ip_address"`         // used by OneLogin
+	SkipVerify               bool   `ini:"skip_verify"`
+	Timeout                  int    `ini:"timeout"`
+	AmazonWebservicesURN     string `ini:"aws_urn"`
+	SessionDuration          int    `ini:"aws_session_duration"`
+	AutoClampSessionDuration bool   `ini:"auto_clamp_session_duration"`
+	Profile                  string `ini:"aws_profile"`
+	ResourceID               string `ini:"resource_id"` // used by F5APM
+	Subdomain                string `ini:"subdomain"`   // used by OneLogin
+	RoleARN                  string `ini:"role_arn"`
+	RoleARNs                 string `ini:"role_arns,omitempty"`                   // comma separated roles all assumed by one login
+	RoleMatcher              string `ini:"role_matcher,omitempty"`                // regular expression picking the one role whose ARN it matches when role_arn isn't set
+	RoleFilter               string `ini:"role_filter,omitempty"`                 // regular expression narrowing the role menu to the ARNs it matches
+	RoleProfiles             string `ini:"role_profiles,omitempty"`               // comma separated profiles for role_arns, in the same order
+	RoleAttributeName        string `ini:"role_attribute_name,omitempty"`         // SAML attribute holding the role and principal pairs, when not the standard AWS one
+	RoleChain                string `ini:"role_chain,omitempty"`                  // comma separated roles assumed in turn with the credentials of the role before
+	RoleChainSessionDuration int    `ini:"role_chain_session_duration,omitempty"` // seconds asked for each role_chain role, 900 to 3600, defaults to 3600
+	RoleChainExternalID      string `ini:"role_chain_external_id,omitempty"`      // external ID passed when assuming each role_chain role
+	RoleChainSessionName     string `ini:"role_chain_session_name,omitempty"`     // session name of the role_chain roles, defaults to that of the SAML role
+	RoleChainSourceProfile   bool   `ini:"role_chain_source_profile,omitempty"`   // also saves the credentials the chain starts from to <profile>-source
+	PolicyFile               string `ini:"policy_file,omitempty"`                 // JSON session policy narrowing the permissions of the SAML role's credentials
+	PolicyARNs               string `ini:"policy_arns,omitempty"`                 // comma separated managed policies narrowing the permissions of the SAML role's credentials
+	AllRolesProfile          string `ini:"all_roles_profile,omitempty"`           // template naming the profile of each role saved by login --all-roles
+	ProfileTemplate          string `ini:"profile_template,omitempty"`            // profile credentials are saved to, with {account_id} and {role_name} of the assumed role
+	Region                   string `ini:"region"`
+	STSRegion                string `ini:"sts_region,omitempty"`            // pins the regional STS endpoint, independent of Region
+	Partition                string `ini:"aws_partition,omitempty"`         // aws, govcloud or china; defaults aws_urn, region and sts_region to suit
+	WriteAWSConfig           bool   `ini:"write_aws_config,omitempty"`      // also writes region and aws_output to the profile in the AWS config file
+	AWSOutput                string `ini:"aws_output,omitempty"`            // output format of the AWS CLI written with write_aws_config, e.g. json
+	DisableRememberRole      bool   `ini:"disable_remember_role,omitempty"` // don't record the role picked from the menu to offer it first next time
+	HttpAttemptsCount        string `ini:"http_attempts_count"`
+	HttpRetryDelay           string `ini:"http_retry_delay"`
+	HttpProxy                string `ini:"http_proxy,omitempty"`   // overrides HTTP_PROXY for this account
+	HttpsProxy               string `ini:"https_proxy,omitempty"`  // overrides HTTPS_PROXY for this account
+	CACertFile               string `ini:"ca_cert_file,omitempty"` // PEM bundle of CAs trusted for this account's requests, along with the system ones
+	CredentialsFile          string `ini:"credentials_file"`
+	SAMLCache                bool   `ini:"saml_cache"`
+	SAMLCacheFile            string `ini:"saml_cache_file"`
+	SAMLCacheEncrypt         bool   `ini:"saml_cache_encrypt,omitempty"`         // encrypts the SAML cache with a key held in the keychain
+	AssertionClockSkew       int    `ini:"assertion_clock_skew,omitempty"`       // seconds of clock drift from the IdP tolerated when checking the assertion's validity
+	CredentialReuseThreshold int    `ini:"credential_reuse_threshold,omitempty"` // seconds of validity the saved credentials need left for login to reuse them, 0 disables
+	TargetURL                string `ini:"target_url"`
+	DisableRememberDevice    bool   `ini:"disable_remember_device"`              // used by Okta
+	DisableSessions          bool   `ini:"disable_sessions"`                     // used by Okta
+	DisableDeviceToken       bool   `ini:"disable_device_token,omitempty"`       // used by Okta; don't keep the device token and session between logins
+	OktaPushPollInterval     int    `ini:"okta_push_poll_interval,omitempty"`    // used by Okta; seconds between checks for a push approval
+	OktaPushTimeout          int    `ini:"okta_push_timeout,omitempty"`          // used by Okta; seconds to wait for a push approval
+	OneLoginPushTimeout      int    `ini:"onelogin_push_timeout,omitempty"`      // used by OneLogin; seconds to wait for a OneLogin Protect approval before asking for a code
+	MFAPollMax               int    `ini:"mfa_poll_max,omitempty"`               // used by OneLogin; most seconds between checks for a OneLogin Protect approval
+	ADFSMFAAdapter           string `ini:"adfs_mfa_adapter,omitempty"`           // used by ADFS; AuthMethod of the MFA adapter picked when ADFS offers several
+	SSOStartURL              string `ini:"sso_start_url,omitempty"`              // used by IdentityCenter; the AWS access portal URL
+	SSORegion                string `ini:"sso_region,omitempty"`                 // used by IdentityCenter; the region Identity Center is enabled in
+	PingDevice               string `ini:"ping_device,omitempty"`                // used by Ping; name, nickname or id of the PingID device to authenticate with
+	DuoDevice                string `ini:"duo_device,omitempty"`                 // used by DuoSSO, ADFS and Shibboleth; name of the Duo device to authenticate with
+	ECPURL                   string `ini:"ecp_url,omitempty"`                    // used by ShibbolethECP; the SAML2 ECP endpoint, when it isn't url
+	AzureADKmsi              bool   `ini:"azuread_kmsi,omitempty"`               // used by AzureAD; answer yes to "Stay signed in?"
+	AzureADAuthMethod        string `ini:"azuread_auth_method,omitempty"`        // used by AzureAD; pins the sign in method instead of asking when the account has several
+	GoogleAuthMethod         string `ini:"google_auth_method,omitempty"`         // used by GoogleApps; challenge picked when Google offers several
+	DownloadBrowser          bool   `ini:"download_browser_driver"`              // used by browser
+	BrowserDriverDir         string `ini:"browser_driver_dir,omitempty"`         // used by browser; hide from user if not set
+	Headless                 bool   `ini:"headless"`                             // used by browser
+	BrowserProfileDir        string `ini:"browser_profile_dir,omitempty"`        // used by browser; persistent profile keeping IdP sessions between logins
+	BrowserCDPEndpoint       string `ini:"browser_cdp_endpoint,omitempty"`       // used by browser; DevTools endpoint of a running Chrome to log in with instead of launching one
+	BrowserTimeout           int    `ini:"browser_timeout,omitempty"`            // used by browser; seconds to wait for the IdP login to finish in the browser
+	BrowserKeepOpenOnError   bool   `ini:"browser_keep_open_on_error,omitempty"` // used by browser; leaves the browser open after a failed login until Enter is pressed
+	Prompter                 string `ini:"prompter"`
+	DisableKeyring           bool   `ini:"disable_keyring,omitempty"`       // never read or write the OS keyring, credentials come from flags, environment or prompts
+	PromptTimeout            int    `ini:"prompt_timeout,omitempty"`        // seconds to wait for an answer to a prompt before failing, 0 waits forever
+	PasswordRetries          int    `ini:"password_retries,omitempty"`      // times to ask for the password again when the IdP rejects it, 0 fails straight away
+	KCAuthErrorMessage       string `ini:"kc_auth_error_message,omitempty"` // used by KeyCloak; hide from user if not set
+	KCAuthErrorElement       string `ini:"kc_auth_error_element,omitempty"` // used by KeyCloak; hide from user if not set
+	KCBroker                 string `ini:"kc_broker,omitempty"`             // used by KeyCloak; alias of the identity provider KeyCloak brokers the login to
+	KCOTPElement             string `ini:"kc_otp_element,omitempty"`        // used by KeyCloak; hide from user if not set
+	KCBrokerProvider         string `ini:"kc_broker_provider,omitempty"`    // used by KeyCloak; ADFS or AzureAD, the kind of IdP kc_broker is
 }
 
 func (ia IDPAccount) String() string {
-	var appID string
-	var policyID string
-	var oktaCfg string
-	switch ia.Provider {
-	case "OneLogin":
-		appID = fmt.Sprintf(`
-  AppID: %s
-  Subdomain: %s`, ia.AppID, ia.Subdomain)
-	case "F5APM":
-		policyID = fmt.Sprintf("\n  ResourceID: %s", ia.ResourceID)
-	case "AzureAD":
-		appID = fmt.Sprintf(`
-  AppID: %s`, ia.AppID)
-	case "Okta":
-		oktaCfg = fmt.Sprintf(`
-  DisableSessions: %v
-  DisableRememberDevice: %v`, ia.DisableSessions, ia.DisableSessions)
+	fields := ia.optionalFields()
+	labels := make([]string, 0, len(fields))
+	for label, value := range fields {
+		if !reflect.ValueOf(value).IsZero() {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	var optional strings.Builder
+	for _, label := range labels {
+		fmt.Fprintf(&optional, "\n  %s: %v", label, fields[label])
 	}
 
-	return fmt.Sprintf(`account {%s%s%s
+	return fmt.Sprintf(`account {%s
   URL: %s
   Username: %s
   Provider: %s
@@ -100,7 +210,264 @@ func (ia IDPAccount) String() string {
   Profile: %s
   RoleARN: %s
   Region: %s
-}`, appID, policyID, oktaCfg, ia.URL, ia.Username, ia.Provider, ia.MFA, ia.SkipVerify, ia.AmazonWebservicesURN, ia.SessionDuration, ia.Profile, ia.RoleARN, ia.Region)
+}`, optional.String(), ia.URL, ia.Username, ia.Provider, ia.MFA, ia.SkipVerify, ia.AmazonWebservicesURN, ia.SessionDuration, ia.Profile, ia.RoleARN, ia.Region)
+}
+
+// optionalFields maps the label of each setting String only shows when set to its value, covering the settings
+// shared by every provider along with those used by the account's provider
+func (ia IDPAccount) optionalFields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"Aliases":                  ia.Aliases,
+		"TargetURL":                ia.TargetURL,
+		"STSRegion":                ia.STSRegion,
+		"Partition":                ia.Partition,
+		"RoleARNs":                 ia.RoleARNs,
+		"RoleMatcher":              ia.RoleMatcher,
+		"RoleFilter":               ia.RoleFilter,
+		"RoleProfiles":             ia.RoleProfiles,
+		"RoleAttributeName":        ia.RoleAttributeName,
+		"RoleChain":                ia.RoleChain,
+		"RoleChainSessionDuration": ia.RoleChainSessionDuration,
+		"RoleChainExternalID":      ia.RoleChainExternalID,
+		"RoleChainSessionName":     ia.RoleChainSessionName,
+		"RoleChainSourceProfile":   ia.RoleChainSourceProfile,
+		"PolicyFile":               ia.PolicyFile,
+		"PolicyARNs":               ia.PolicyARNs,
+		"AllRolesProfile":          ia.AllRolesProfile,
+		"ProfileTemplate":          ia.ProfileTemplate,
+		"CredentialsFile":          ia.CredentialsFile,
+		"SAMLCache":                ia.SAMLCache,
+		"SAMLCacheFile":            ia.SAMLCacheFile,
+		"SAMLCacheEncrypt":         ia.SAMLCacheEncrypt,
+		"AssertionClockSkew":       ia.AssertionClockSkew,
+		"CredentialReuseThreshold": ia.CredentialReuseThreshold,
+		"PromptTimeout":            ia.PromptTimeout,
+		"PasswordRetries":          ia.PasswordRetries,
+		"DisableKeyring":           ia.DisableKeyring,
+		"WriteAWSConfig":           ia.WriteAWSConfig,
+		"AWSOutput":                ia.AWSOutput,
+		"DisableRememberRole":      ia.DisableRememberRole,
+		"HttpProxy":                ia.HttpProxy,
+		"HttpsProxy":               ia.HttpsProxy,
+		"CACertFile":               ia.CACertFile,
+	}
+
+	var providerFields map[string]interface{}
+	switch ia.Provider {
+	case "OneLogin":
+		providerFields = map[string]interface{}{
+			"AppID":               ia.AppID,
+			"Subdomain":           ia.Subdomain,
+			"MFAIPAddress":        ia.MFAIPAddress,
+			"OneLoginPushTimeout": ia.OneLoginPushTimeout,
+			"MFAPollMax":          ia.MFAPollMax,
+		}
+	case "F5APM":
+		providerFields = map[string]interface{}{
+			"ResourceID": ia.ResourceID,
+		}
+	case "ADFS":
+		providerFields = map[string]interface{}{
+			"ADFSMFAAdapter": ia.ADFSMFAAdapter,
+			"DuoDevice":      ia.DuoDevice,
+		}
+	case "Shibboleth":
+		providerFields = map[string]interface{}{
+			"DuoDevice": ia.DuoDevice,
+		}
+	case "ShibbolethECP":
+		providerFields = map[string]interface{}{
+			"ECPURL": ia.ECPURL,
+		}
+	case "IdentityCenter":
+		providerFields = map[string]interface{}{
+			"SSOStartURL": ia.SSOStartURL,
+			"SSORegion":   ia.SSORegion,
+		}
+	case "Ping":
+		providerFields = map[string]interface{}{
+			"PingDevice": ia.PingDevice,
+		}
+	case "DuoSSO":
+		providerFields = map[string]interface{}{
+			"DuoDevice": ia.DuoDevice,
+		}
+	case "AzureAD":
+		providerFields = map[string]interface{}{
+			"AppID":             ia.AppID,
+			"AzureADKmsi":       ia.AzureADKmsi,
+			"AzureADAuthMethod": ia.AzureADAuthMethod,
+		}
+	case "Okta":
+		providerFields = map[string]interface{}{
+			"DisableSessions":       ia.DisableSessions,
+			"DisableRememberDevice": ia.DisableRememberDevice,
+			"MFAFallback":           ia.MFAFallback,
+			"DisableDeviceToken":    ia.DisableDeviceToken,
+			"OktaPushPollInterval":  ia.OktaPushPollInterval,
+			"OktaPushTimeout":       ia.OktaPushTimeout,
+		}
+	case "Browser":
+		providerFields = map[string]interface{}{
+			"BrowserType":            ia.BrowserType,
+			"BrowserExecutablePath":  ia.BrowserExecutablePath,
+			"BrowserAutoFill":        ia.BrowserAutoFill,
+			"DownloadBrowser":        ia.DownloadBrowser,
+			"BrowserDriverDir":       ia.BrowserDriverDir,
+			"Headless":               ia.Headless,
+			"BrowserProfileDir":      ia.BrowserProfileDir,
+			"BrowserCDPEndpoint":     ia.BrowserCDPEndpoint,
+			"BrowserTimeout":         ia.BrowserTimeout,
+			"BrowserKeepOpenOnError": ia.BrowserKeepOpenOnError,
+		}
+	case "GoogleApps":
+		providerFields = map[string]interface{}{
+			"GoogleAuthMethod": ia.GoogleAuthMethod,
+		}
+	case "KeyCloak":
+		providerFields = map[string]interface{}{
+			"KCAuthErrorMessage": ia.KCAuthErrorMessage,
+			"KCAuthErrorElement": ia.KCAuthErrorElement,
+			"KCBroker":           ia.KCBroker,
+			"KCOTPElement":       ia.KCOTPElement,
+			"KCBrokerProvider":   ia.KCBrokerProvider,
+		}
+	}
+
+	for label, value := range providerFields {
+		fields[label] = value
+	}
+
+	return fields
+}
+
+// RoleTarget a role assumed by a login along with the profile its credentials are saved to
+type RoleTarget struct {
+	RoleARN string
+	Profile string
+}
+
+// RoleTargets pairs each of the role_arns with its profile, taken from role_profiles when set and otherwise
+// numbered after the account's profile as profile, profile-2, profile-3 and so on
+func (ia *IDPAccount) RoleTargets() ([]RoleTarget, error) {
+	roleARNs := splitList(ia.RoleARNs)
+	if len(roleARNs) == 0 {
+		return nil, nil
+	}
+
+	profiles := splitList(ia.RoleProfiles)
+	if len(profiles) != 0 && len(profiles) != len(roleARNs) {
+		return nil, errors.Errorf("role_profiles in idp account lists %d profiles for %d role_arns", len(profiles), len(roleARNs))
+	}
+
+	targets := make([]RoleTarget, len(roleARNs))
+	for i, roleARN := range roleARNs {
+		targets[i].RoleARN = roleARN
+		switch {
+		case len(profiles) != 0:
+			targets[i].Profile = profiles[i]
+		case ia.ProfileTemplate != "":
+			targets[i].Profile = ia.CredentialsProfile(roleARN)
+		case i == 0:
+			targets[i].Profile = ia.Profile
+		default:
+			targets[i].Profile = fmt.Sprintf("%s-%d", ia.Profile, i+1)
+		}
+	}
+
+	return targets, nil
+}
+
+// CredentialsProfile the profile the credentials of a role are saved to, profile_template rendered with the account ID
+// and name of the role, or of the last role_chain role the credentials end up for. Falls back to aws_profile without
+// a template or a role, or when the rendered name is empty.
+func (ia *IDPAccount) CredentialsProfile(roleARN string) string {
+	if chain := ia.RoleChainARNs(); len(chain) > 0 {
+		roleARN = chain[len(chain)-1]
+	}
+	if ia.ProfileTemplate == "" || roleARN == "" {
+		return ia.Profile
+	}
+
+	var accountID string
+	if parts := strings.Split(roleARN, ":"); len(parts) > 4 {
+		accountID = parts[4]
+	}
+	roleName := roleARN[strings.LastIndex(roleARN, "/")+1:]
+
+	name := strings.NewReplacer("{account_id}", accountID, "{role_name}", roleName).Replace(ia.ProfileTemplate)
+	if name = SanitizeProfileName(name); name == "" {
+		return ia.Profile
+	}
+	return name
+}
+
+// SanitizeProfileName replaces the characters AWS profile names shouldn't have with -
+func SanitizeProfileName(name string) string {
+	return strings.Trim(profileNameUnsafe.ReplaceAllString(name, "-"), "-")
+}
+
+// CACertPool the system CAs along with those of ca_cert_file, nil when it isn't set
+func (ia *IDPAccount) CACertPool() (*x509.CertPool, error) {
+	if ia.CACertFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(ia.CACertFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ca_cert_file %q in idp account can't be read", ia.CACertFile)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	count := 0
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ca_cert_file %q in idp account has certificate %d that doesn't parse", ia.CACertFile, count+1)
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	if count == 0 {
+		return nil, errors.Errorf("ca_cert_file %q in idp account has no PEM certificates", ia.CACertFile)
+	}
+
+	return pool, nil
+}
+
+// RoleChainARNs the role_chain roles in the order they are assumed
+func (ia *IDPAccount) RoleChainARNs() []string {
+	return splitList(ia.RoleChain)
+}
+
+// PolicyARNList the policy_arns managed policies
+func (ia *IDPAccount) PolicyARNList() []string {
+	return splitList(ia.PolicyARNs)
+}
+
+// AllRolesProfileTemplate parses all_roles_profile, nil when it isn't set
+func (ia *IDPAccount) AllRolesProfileTemplate() (*template.Template, error) {
+	if ia.AllRolesProfile == "" {
+		return nil, nil
+	}
+	return template.New("all_roles_profile").Option("missingkey=error").Parse(ia.AllRolesProfile)
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 // Validate validate the required / expected fields are set
@@ -121,21 +488,205 @@ func (ia *IDPAccount) Validate() error {
 		if ia.AppID == "" {
 			return errors.New("app ID empty in idp account")
 		}
+	case "KeyCloak":
+		if ia.KCBrokerProvider != "" && ia.KCBroker == "" {
+			return errors.New("kc_broker_provider in idp account requires kc_broker")
+		}
+	case "Browser":
+		if ia.BrowserTimeout < 0 {
+			return errors.Errorf("browser_timeout %d in idp account can't be negative", ia.BrowserTimeout)
+		}
+		if err := ia.validateBrowser(); err != nil {
+			return err
+		}
+		if ia.BrowserCDPEndpoint != "" {
+			u, err := url.Parse(ia.BrowserCDPEndpoint)
+			if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ws" && u.Scheme != "wss") {
+				return errors.Errorf("browser_cdp_endpoint %q in idp account must be an http or ws URL, e.g. http://localhost:9222", ia.BrowserCDPEndpoint)
+			}
+			if ia.BrowserProfileDir != "" {
+				return errors.New("browser_cdp_endpoint and browser_profile_dir in idp account can't both be set, the running browser keeps its own profile")
+			}
+		}
+	case "IdentityCenter":
+		if ia.SSOStartURL == "" {
+			return errors.New("sso_start_url empty in idp account")
+		}
+		if ia.SSORegion == "" {
+			return errors.New("sso_region empty in idp account")
+		}
+		if ia.RoleARNs != "" {
+			return errors.New("role_arns in idp account can't be used with IdentityCenter")
+		}
 	}
 
-	if ia.URL == "" {
+	// IdentityCenter signs in at sso_start_url instead
+	if ia.URL == "" && ia.Provider != "IdentityCenter" {
 		return errors.New("URL empty in idp account")
 	}
 
-	_, err := url.Parse(ia.URL)
+	u, err := url.Parse(ia.URL)
 	if err != nil {
 		return errors.New("URL parse failed")
 	}
 
+	// these providers fail deep inside authentication with a confusing error when the URL is wrong
+	switch ia.Provider {
+	case "Okta":
+		if u.Scheme != "https" || u.Host == "" {
+			return errors.Errorf("URL %q in idp account must be an https URL for Okta", ia.URL)
+		}
+	case "KeyCloak":
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("URL %q in idp account must be an absolute http or https URL for KeyCloak", ia.URL)
+		}
+	case "miniOrange":
+		if u.Scheme != "https" || u.Host == "" {
+			return errors.Errorf("URL %q in idp account must be an https URL for miniOrange", ia.URL)
+		}
+	case "ADFSWSTrust":
+		if u.Scheme != "https" || u.Host == "" {
+			return errors.Errorf("URL %q in idp account must be an https URL for ADFSWSTrust, the password is sent in the request", ia.URL)
+		}
+	}
+
 	if ia.Provider == "" {
 		return errors.New("Provider empty in idp account")
 	}
 
+	if err := validateProxyURL(ia.HttpProxy); err != nil {
+		return errors.Wrap(err, "http_proxy invalid in idp account")
+	}
+
+	if err := validateProxyURL(ia.HttpsProxy); err != nil {
+		return errors.Wrap(err, "https_proxy invalid in idp account")
+	}
+
+	if _, err := ia.CACertPool(); err != nil {
+		return err
+	}
+
+	if ia.DisableKeyring && ia.SAMLCacheEncrypt {
+		return errors.New("saml_cache_encrypt in idp account keeps its key in the keyring, it can't be used with disable_keyring")
+	}
+
+	if ia.PromptTimeout < 0 {
+		return errors.Errorf("prompt_timeout %d in idp account can't be negative", ia.PromptTimeout)
+	}
+
+	if ia.PasswordRetries < 0 {
+		return errors.Errorf("password_retries %d in idp account can't be negative", ia.PasswordRetries)
+	}
+
+	if ia.CredentialReuseThreshold < 0 {
+		return errors.Errorf("credential_reuse_threshold %d in idp account can't be negative", ia.CredentialReuseThreshold)
+	}
+
+	if ia.OktaPushPollInterval < 0 {
+		return errors.Errorf("okta_push_poll_interval %d in idp account can't be negative", ia.OktaPushPollInterval)
+	}
+
+	if ia.OktaPushTimeout < 0 {
+		return errors.Errorf("okta_push_timeout %d in idp account can't be negative", ia.OktaPushTimeout)
+	}
+
+	if ia.OneLoginPushTimeout < 0 {
+		return errors.Errorf("onelogin_push_timeout %d in idp account can't be negative", ia.OneLoginPushTimeout)
+	}
+
+	if ia.RoleARN != "" && !roleARNPattern.MatchString(ia.RoleARN) {
+		return errors.Errorf("role_arn %q in idp account is not an IAM role ARN", ia.RoleARN)
+	}
+
+	if ia.RoleMatcher != "" {
+		if _, err := regexp.Compile(ia.RoleMatcher); err != nil {
+			return errors.Errorf("role_matcher %q in idp account isn't a valid regular expression: %v", ia.RoleMatcher, err)
+		}
+	}
+
+	if ia.RoleFilter != "" {
+		if _, err := regexp.Compile(ia.RoleFilter); err != nil {
+			return errors.Errorf("role_filter %q in idp account isn't a valid regular expression: %v", ia.RoleFilter, err)
+		}
+	}
+
+	if ia.RoleARNs != "" {
+		if ia.RoleARN != "" {
+			return errors.New("role_arn and role_arns in idp account can't both be set")
+		}
+		roles, err := ia.RoleTargets()
+		if err != nil {
+			return err
+		}
+		for _, role := range roles {
+			if !roleARNPattern.MatchString(role.RoleARN) {
+				return errors.Errorf("role_arns entry %q in idp account is not an IAM role ARN", role.RoleARN)
+			}
+		}
+	} else if ia.RoleProfiles != "" {
+		return errors.New("role_profiles in idp account requires role_arns")
+	}
+
+	if ia.RoleChain != "" {
+		if ia.RoleARNs != "" {
+			return errors.New("role_chain and role_arns in idp account can't both be set")
+		}
+		for _, roleARN := range ia.RoleChainARNs() {
+			if !roleARNPattern.MatchString(roleARN) {
+				return errors.Errorf("role_chain entry %q in idp account is not an IAM role ARN", roleARN)
+			}
+		}
+	}
+
+	if ia.RoleChain == "" && (ia.RoleChainSessionDuration != 0 || ia.RoleChainExternalID != "" || ia.RoleChainSessionName != "" || ia.RoleChainSourceProfile) {
+		return errors.New("role_chain_session_duration, role_chain_external_id, role_chain_session_name and role_chain_source_profile in idp account require role_chain")
+	}
+
+	if ia.RoleChainSessionDuration != 0 && (ia.RoleChainSessionDuration < MinSessionDuration || ia.RoleChainSessionDuration > DefaultSessionDuration) {
+		return errors.Errorf("role_chain_session_duration %d in idp account is outside %d to %d seconds, the most AWS allows for chained roles", ia.RoleChainSessionDuration, MinSessionDuration, DefaultSessionDuration)
+	}
+
+	policyARNs := ia.PolicyARNList()
+	for _, policyARN := range policyARNs {
+		if !policyARNPattern.MatchString(policyARN) {
+			return errors.Errorf("policy_arns entry %q in idp account is not an IAM policy ARN", policyARN)
+		}
+	}
+	if len(policyARNs) > MaxPolicyARNs {
+		return errors.Errorf("policy_arns in idp account has %d policies, AWS allows at most %d", len(policyARNs), MaxPolicyARNs)
+	}
+
+	for _, placeholder := range profilePlaceholderPattern.FindAllString(ia.ProfileTemplate, -1) {
+		if placeholder != "{account_id}" && placeholder != "{role_name}" {
+			return errors.Errorf("profile_template %q in idp account has unknown placeholder %s, expected {account_id} or {role_name}", ia.ProfileTemplate, placeholder)
+		}
+	}
+
+	if _, err := ia.AllRolesProfileTemplate(); err != nil {
+		return errors.Wrapf(err, "all_roles_profile %q in idp account is not a valid template", ia.AllRolesProfile)
+	}
+
+	if ia.STSRegion != "" && !isSTSRegion(ia.STSRegion) {
+		return errors.Errorf("sts_region %s in idp account is not a region hosting STS", ia.STSRegion)
+	}
+
+	if ia.Partition != "" {
+		partition, ok := Partitions[ia.Partition]
+		if !ok {
+			return errors.Errorf("aws_partition %q in idp account is not one of %s", ia.Partition, strings.Join(PartitionNames(), ", "))
+		}
+		if ia.Region != "" && !inPartition(ia.Region, partition.ID) {
+			return errors.Errorf("region %s in idp account is not in the %s partition", ia.Region, ia.Partition)
+		}
+		if ia.STSRegion != "" && !inPartition(ia.STSRegion, partition.ID) {
+			return errors.Errorf("sts_region %s in idp account is not in the %s partition", ia.STSRegion, ia.Partition)
+		}
+	}
+
+	if ia.AWSOutput != "" && !validAWSOutput(ia.AWSOutput) {
+		return errors.Errorf("aws_output %q in idp account is not one of %s", ia.AWSOutput, strings.Join(AWSOutputs, ", "))
+	}
+
 	if ia.Provider != "Browser" {
 		if ia.MFA == "" {
 			return errors.New("MFA empty in idp account")
@@ -146,6 +697,17 @@ func (ia *IDPAccount) Validate() error {
 		return errors.New("Profile empty in idp account")
 	}
 
+	// zero means the duration was never set
+	if ia.SessionDuration != 0 {
+		if ia.SessionDuration < MinSessionDuration || ia.SessionDuration > MaxSessionDuration {
+			return errors.Errorf("Session duration %d in idp account must be between %d and %d seconds", ia.SessionDuration, MinSessionDuration, MaxSessionDuration)
+		}
+	}
+
+	if ia.AssertionClockSkew < 0 || ia.AssertionClockSkew > MaxAssertionClockSkew {
+		return errors.Errorf("Assertion clock skew %d in idp account must be between 0 and %d seconds", ia.AssertionClockSkew, MaxAssertionClockSkew)
+	}
+
 	if err := prompter.ValidateAndSetPrompter(ia.Prompter); err != nil {
 		return err
 	}
@@ -153,95 +715,861 @@ func (ia *IDPAccount) Validate() error {
 	return nil
 }
 
-// NewIDPAccount Create an idp account and fill in any default fields with sane values
-func NewIDPAccount() *IDPAccount {
-	return &IDPAccount{
-		AmazonWebservicesURN: DefaultAmazonWebservicesURN,
-		SessionDuration:      DefaultSessionDuration,
-		Profile:              DefaultProfile,
+// validateBrowser checks the browser settings of a Browser account work together, nothing renders when headless
+// so the user can't answer an MFA in the window
+func (ia *IDPAccount) validateBrowser() error {
+	if ia.BrowserType != "" {
+		valid := false
+		for _, browserType := range BrowserTypes {
+			if strings.EqualFold(ia.BrowserType, browserType) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return errors.Errorf("browser_type %q in idp account is not one of %s", ia.BrowserType, strings.Join(BrowserTypes, ", "))
+		}
 	}
-}
-
-// ConfigManager manage the various IDP account settings
-type ConfigManager struct {
-	configPath string
-}
 
-// NewConfigManager build a new config manager and optionally override the config path
-func NewConfigManager(configFile string) (*ConfigManager, error) {
-
-	if configFile == "" {
-		configFile = DefaultConfigPath
+	if ia.BrowserExecutablePath != "" {
+		info, err := os.Stat(ia.BrowserExecutablePath)
+		if err != nil {
+			return errors.Errorf("browser_executable_path %q in idp account doesn't exist", ia.BrowserExecutablePath)
+		}
+		if info.IsDir() {
+			return errors.Errorf("browser_executable_path %q in idp account is a directory, set it to the browser executable", ia.BrowserExecutablePath)
+		}
 	}
 
-	configPath, err := homedir.Expand(configFile)
-	if err != nil {
-		return nil, err
+	if ia.Headless && ia.MFA != "" && ia.MFA != "Auto" {
+		return errors.Errorf("headless in idp account hides the browser window the %s MFA is answered in, unset headless or set mfa to Auto", ia.MFA)
 	}
 
-	return &ConfigManager{configPath}, nil
+	return nil
 }
 
-// SaveIDPAccount save idp account
-func (cm *ConfigManager) SaveIDPAccount(idpAccountName string, account *IDPAccount) error {
-
-	if err := account.Validate(); err != nil {
-		return errors.Wrap(err, "Account validation failed")
+func validateProxyURL(proxy string) error {
+	if proxy == "" {
+		return nil
 	}
 
-	cfg, err := ini.LoadSources(ini.LoadOptions{Loose: true}, cm.configPath)
-	if err != nil {
-		return errors.Wrap(err, "Unable to load configuration file")
+	// as with HTTP_PROXY a bare host:port is treated as an http proxy
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
 	}
 
-	newSec, err := cfg.NewSection(idpAccountName)
+	u, err := url.Parse(proxy)
 	if err != nil {
-		return errors.Wrap(err, "Unable to build a new section in configuration file")
+		return err
 	}
 
-	err = newSec.ReflectFrom(account)
-	if err != nil {
-		return errors.Wrap(err, "Unable to save account to configuration file")
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return errors.Errorf("unsupported proxy scheme %s", u.Scheme)
 	}
 
-	err = cfg.SaveTo(cm.configPath)
-	if err != nil {
-		return errors.Wrap(err, "Failed to save configuration file")
+	if u.Hostname() == "" {
+		return errors.Errorf("%s has no host", proxy)
 	}
+
 	return nil
 }
 
-// LoadIDPAccount load the idp account and default to an empty one if it doesn't exist
-func (cm *ConfigManager) LoadIDPAccount(idpAccountName string) (*IDPAccount, error) {
+// isSTSRegion reports whether the region hosts an STS endpoint in any of the known partitions
+func isSTSRegion(region string) bool {
+	for _, partition := range endpoints.DefaultPartitions() {
+		if service, ok := partition.Services()[endpoints.StsServiceID]; ok {
+			if _, ok := service.Regions()[region]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	cfg, err := ini.LoadSources(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true}, cm.configPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "Unable to load configuration file")
+// inPartition reports whether the region belongs to the partition with the endpoints ID
+func inPartition(region, id string) bool {
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	return ok && partition.ID() == id
+}
+
+// ApplyPartition fills in the SAML URN, region and STS endpoint of aws_partition, leaving a region or STS
+// region already set alone and only replacing the URN when it is the default of a partition
+func (ia *IDPAccount) ApplyPartition() {
+	partition, ok := Partitions[ia.Partition]
+	if !ok {
+		return
 	}
 
-	// attempt to map a specific idp account by name
-	// this will return an empty account if one is not found by the given name
-	account, err := readAccount(idpAccountName, cfg)
-	if err != nil {
-		return nil, errors.Wrap(err, "Unable to read idp account")
+	if ia.AmazonWebservicesURN == "" || isPartitionURN(ia.AmazonWebservicesURN) {
+		ia.AmazonWebservicesURN = partition.URN
+	}
+	if ia.Region == "" {
+		ia.Region = partition.Region
 	}
+	if ia.STSRegion == "" {
+		ia.STSRegion = ia.Region
+	}
+}
 
-	// adding Name at Load time for the IdpAccount to have awareness of "self"
-	account.Name = idpAccountName
+func isPartitionURN(urn string) bool {
+	for _, partition := range Partitions {
+		if partition.URN == urn {
+			return true
+		}
+	}
+	return false
+}
 
-	return account, nil
+// MFAFallbackMethods the MFAs to try, in order, when the configured MFA fails
+func (ia *IDPAccount) MFAFallbackMethods() []string {
+	return splitList(ia.MFAFallback)
 }
 
-func readAccount(idpAccountName string, cfg *ini.File) (*IDPAccount, error) {
+// Clone returns a copy of the account that can be changed without affecting the original. Every field
+// is a value type so copying the struct is enough, a field holding a slice, map or pointer has to be
+// copied here as well
+func (ia *IDPAccount) Clone() *IDPAccount {
+	clone := *ia
+	return &clone
+}
 
-	account := NewIDPAccount()
+// AWSOutputs the output formats of the AWS CLI aws_output can be set to
+var AWSOutputs = []string{"json", "yaml", "yaml-stream", "text", "table"}
 
-	sec := cfg.Section(idpAccountName)
+func validAWSOutput(output string) bool {
+	for _, o := range AWSOutputs {
+		if o == output {
+			return true
+		}
+	}
+	return false
+}
 
-	err := sec.MapTo(account)
-	if err != nil {
-		return nil, errors.Wrap(err, "Unable to map account")
+// BrowserTypes the browsers browser_type can be set to, the engines Playwright bundles and the Chrome and Edge
+// channels it drives
+var BrowserTypes = []string{"chromium", "firefox", "webkit", "chrome", "chrome-beta", "chrome-dev", "chrome-canary", "msedge", "msedge-beta", "msedge-dev", "msedge-canary"}
+
+// Partition the settings an aws_partition implies
+type Partition struct {
+	ID         string // the partition in the AWS endpoints, also the partition of its ARNs
+	URN        string // the URN of the AWS SAML service provider
+	Region     string // the region used when none is set
+	SigninHost string // the host of the AWS sign-in and federation endpoints
+	ConsoleURL string // the AWS console
+}
+
+// Partitions the partitions aws_partition can be set to
+var Partitions = map[string]Partition{
+	"aws": {ID: endpoints.AwsPartitionID, URN: DefaultAmazonWebservicesURN, Region: endpoints.UsEast1RegionID,
+		SigninHost: "signin.aws.amazon.com", ConsoleURL: "https://console.aws.amazon.com/"},
+	"govcloud": {ID: endpoints.AwsUsGovPartitionID, URN: "urn:amazon:webservices:govcloud", Region: endpoints.UsGovWest1RegionID,
+		SigninHost: "signin.amazonaws-us-gov.com", ConsoleURL: "https://console.amazonaws-us-gov.com/"},
+	"china": {ID: endpoints.AwsCnPartitionID, URN: "urn:amazon:webservices:cn-north-1", Region: endpoints.CnNorth1RegionID,
+		SigninHost: "signin.amazonaws.cn", ConsoleURL: "https://console.amazonaws.cn/"},
+}
+
+// PartitionForARN the partition of an ARN such as arn:aws-us-gov:iam::123456789012:role/Admin, the commercial
+// one when the ARN names no partition that is known
+func PartitionForARN(arn string) Partition {
+	parts := strings.SplitN(arn, ":", 3)
+	if len(parts) == 3 && parts[0] == "arn" {
+		for _, partition := range Partitions {
+			if partition.ID == parts[1] {
+				return partition
+			}
+		}
 	}
+	return Partitions["aws"]
+}
+
+// ApplyRolePartition points the region and STS endpoint at the partition of the role about to be assumed, so
+// a GovCloud or China role isn't requested from the commercial STS. A region set in the role's partition is kept.
+func (ia *IDPAccount) ApplyRolePartition(roleARN string) {
+	partition := PartitionForARN(roleARN)
+	if partition.ID == endpoints.AwsPartitionID {
+		return
+	}
+
+	if ia.Region == "" || !inPartition(ia.Region, partition.ID) {
+		ia.Region = partition.Region
+	}
+	if ia.STSRegion == "" || !inPartition(ia.STSRegion, partition.ID) {
+		ia.STSRegion = ia.Region
+	}
+}
+
+// PartitionNames the names aws_partition accepts, sorted
+func PartitionNames() []string {
+	names := make([]string, 0, len(Partitions))
+	for name := range Partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewIDPAccount Create an idp account and fill in any default fields with sane values
+func NewIDPAccount() *IDPAccount {
+	return &IDPAccount{
+		AmazonWebservicesURN: DefaultAmazonWebservicesURN,
+		SessionDuration:      DefaultSessionDuration,
+		Profile:              DefaultProfile,
+	}
+}
+
+// ConfigManager manage the various IDP account settings
+type ConfigManager struct {
+	configPath string
+
+	// DisableInterpolation load ${VAR} and $VAR references in account values as written instead of expanding them
+	DisableInterpolation bool
+
+	// AllowSharedConfig keep the existing permissions of a configuration file that is intentionally
+	// shared with other users, rather than restricting it to the owner and warning about it
+	AllowSharedConfig bool
+
+	// Passphrase of an encrypted configuration file, when empty it is read from SAML2AWS_CONFIG_PASSPHRASE
+	// or prompted for
+	Passphrase string
+
+	encrypted bool
+}
+
+// NewConfigManager build a new config manager and optionally override the config path
+func NewConfigManager(configFile string) (*ConfigManager, error) {
+
+	if configFile == "" {
+		configPath, err := defaultConfigPath()
+		if err != nil {
+			return nil, err
+		}
+		return newConfigManager(configPath), nil
+	}
+
+	configPath, err := homedir.Expand(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConfigManager(configPath), nil
+}
+
+func newConfigManager(configPath string) *ConfigManager {
+	cm := &ConfigManager{configPath: configPath}
+
+	// the passphrase is only asked for once the file is read
+	if f, err := os.Open(configPath); err == nil {
+		header := make([]byte, len(encryptedConfigHeader))
+		n, _ := io.ReadFull(f, header)
+		f.Close()
+		cm.encrypted = isEncryptedConfig(header[:n])
+	}
+
+	return cm
+}
+
+// Encrypted reports whether the configuration file is encrypted
+func (cm *ConfigManager) Encrypted() bool {
+	return cm.encrypted
+}
+
+// XDGConfigPath the saml2aws configuration path in the XDG config directory, which is
+// $XDG_CONFIG_HOME or ~/.config when that is not set
+func XDGConfigPath() (string, error) {
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return "", err
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+
+	return filepath.Join(configHome, "saml2aws", "config"), nil
+}
+
+// defaultConfigPath pick the configuration path from the environment, then the XDG config directory
+// and the legacy path if either file exists, falling back to the XDG config directory for new files
+func defaultConfigPath() (string, error) {
+
+	if configFile := os.Getenv(ConfigFileEnvironmentVariableName); configFile != "" {
+		return homedir.Expand(configFile)
+	}
+
+	xdgPath, err := XDGConfigPath()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(xdgPath); err == nil {
+		return xdgPath, nil
+	}
+
+	legacyPath, err := homedir.Expand(DefaultConfigPath)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(legacyPath); err == nil {
+		return legacyPath, nil
+	}
+
+	return xdgPath, nil
+}
+
+// MigrateLegacyConfig copy the legacy configuration file to the XDG config directory, leaving a comment in the
+// legacy file pointing at the new one, and return the new path. An encrypted file has to start with its header so
+// it is copied without the comment.
+func MigrateLegacyConfig() (string, error) {
+
+	legacyPath, err := homedir.Expand(DefaultConfigPath)
+	if err != nil {
+		return "", err
+	}
+
+	xdgPath, err := XDGConfigPath()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(filepath.Dir(xdgPath), 0700)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to create configuration directory")
+	}
+
+	unlock, err := filelock.Lock(xdgPath, true)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(xdgPath); err == nil {
+		return "", errors.Errorf("Configuration file already exists at %s", xdgPath)
+	}
+
+	unlockLegacy, err := filelock.Lock(legacyPath, true)
+	if err != nil {
+		return "", err
+	}
+	defer unlockLegacy()
+
+	data, err := os.ReadFile(legacyPath)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to read legacy configuration file")
+	}
+
+	err = writeConfigFile(data, xdgPath, false)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to write configuration file")
+	}
+
+	if isEncryptedConfig(data) {
+		return xdgPath, nil
+	}
+
+	note := fmt.Sprintf("# this configuration has been migrated to %s and is no longer read unless passed with --config\n", xdgPath)
+
+	err = writeConfigFile(append([]byte(note), data...), legacyPath, false)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to update legacy configuration file")
+	}
+
+	return xdgPath, nil
+}
+
+// SaveIDPAccount save idp account
+func (cm *ConfigManager) SaveIDPAccount(idpAccountName string, account *IDPAccount) error {
+
+	if err := account.Validate(); err != nil {
+		return errors.Wrap(err, "Account validation failed")
+	}
+
+	// the XDG config directory may not exist yet on a fresh install
+	err := os.MkdirAll(filepath.Dir(cm.configPath), 0700)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create configuration directory")
+	}
+
+	unlock, err := filelock.Lock(cm.configPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true})
+	if err != nil {
+		return errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	err = validateAliases(cfg, idpAccountName, account)
+	if err != nil {
+		return errors.Wrap(err, "Account validation failed")
+	}
+
+	newSec, err := cfg.NewSection(idpAccountName)
+	if err != nil {
+		return errors.Wrap(err, "Unable to build a new section in configuration file")
+	}
+
+	err = newSec.ReflectFrom(account)
+	if err != nil {
+		return errors.Wrap(err, "Unable to save account to configuration file")
+	}
+
+	// leave out values inherited from the global section so they keep following it
+	if cfg.HasSection(GlobalSectionName) {
+		for _, key := range cfg.Section(GlobalSectionName).Keys() {
+			if newSec.HasKey(key.Name()) && newSec.Key(key.Name()).Value() == key.Value() {
+				newSec.DeleteKey(key.Name())
+			}
+		}
+	}
+
+	err = cm.saveConfigFile(cfg, cm.configPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to save configuration file")
+	}
+	return nil
+}
+
+// DeleteIDPAccount remove the idp account from the configuration file
+func (cm *ConfigManager) DeleteIDPAccount(idpAccountName string) error {
+
+	unlock, err := filelock.Lock(cm.configPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true})
+	if err != nil {
+		return errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	if reservedSection(idpAccountName) || !cfg.HasSection(idpAccountName) {
+		return ErrIdpAccountNotFound
+	}
+
+	cfg.DeleteSection(idpAccountName)
+
+	err = cm.saveConfigFile(cfg, cm.configPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to save configuration file")
+	}
+	return nil
+}
+
+// RenameIDPAccount move the idp account to a new name, keeping its settings and comments
+func (cm *ConfigManager) RenameIDPAccount(oldName, newName string) error {
+
+	if newName == "" || reservedSection(newName) {
+		return errors.Errorf("Invalid idp account name: %q", newName)
+	}
+
+	unlock, err := filelock.Lock(cm.configPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true})
+	if err != nil {
+		return errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	if reservedSection(oldName) || !cfg.HasSection(oldName) {
+		return ErrIdpAccountNotFound
+	}
+
+	if cfg.HasSection(newName) {
+		return ErrIdpAccountExists
+	}
+
+	if owner, ok := aliasOwner(cfg, newName); ok && owner != oldName {
+		return errors.Errorf("Invalid idp account name: %q is an alias of %s", newName, owner)
+	}
+
+	oldSec := cfg.Section(oldName)
+
+	newSec, err := cfg.NewSection(newName)
+	if err != nil {
+		return errors.Wrap(err, "Unable to build a new section in configuration file")
+	}
+	newSec.Comment = oldSec.Comment
+
+	for _, key := range oldSec.Keys() {
+		newKey, err := newSec.NewKey(key.Name(), key.Value())
+		if err != nil {
+			return errors.Wrapf(err, "Unable to copy %s to the renamed account", key.Name())
+		}
+		newKey.Comment = key.Comment
+	}
+
+	cfg.DeleteSection(oldName)
+
+	err = cm.saveConfigFile(cfg, cm.configPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to save configuration file")
+	}
+	return nil
+}
+
+// LoadIDPAccount load the idp account and default to an empty one if it doesn't exist
+func (cm *ConfigManager) LoadIDPAccount(idpAccountName string) (*IDPAccount, error) {
+
+	unlock, err := filelock.Lock(cm.configPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	cm.checkPermissions()
+
+	if !cfg.HasSection(idpAccountName) {
+		if owner, ok := aliasOwner(cfg, idpAccountName); ok {
+			idpAccountName = owner
+		}
+	}
+
+	// attempt to map a specific idp account by name
+	// this will return an empty account if one is not found by the given name
+	account, err := readAccount(idpAccountName, cfg, !cm.DisableInterpolation)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read idp account")
+	}
+
+	// adding Name at Load time for the IdpAccount to have awareness of "self"
+	account.Name = idpAccountName
 
 	return account, nil
 }
+
+func readAccount(idpAccountName string, cfg *ini.File, interpolate bool) (*IDPAccount, error) {
+
+	account := NewIDPAccount()
+
+	// the global section overrides the built in defaults, and is in turn overridden by the account section
+	if cfg.HasSection(GlobalSectionName) {
+		err := cfg.Section(GlobalSectionName).MapTo(account)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to map global section")
+		}
+	}
+
+	sec := cfg.Section(idpAccountName)
+
+	err := sec.MapTo(account)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to map account")
+	}
+
+	if interpolate {
+		account.ExpandEnv()
+	}
+
+	return account, nil
+}
+
+// ExpandEnv replace ${VAR} and $VAR references in the string fields of the account with the
+// value of the environment variable, references to unset variables are left untouched
+func (ia *IDPAccount) ExpandEnv() {
+
+	v := reflect.ValueOf(ia).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.String || v.Type().Field(i).Name == "Name" {
+			continue
+		}
+		field.SetString(expandEnv(field.String()))
+	}
+}
+
+func expandEnv(value string) string {
+	return envVarPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		name := strings.Trim(ref, "${}")
+		if val, ok := os.LookupEnv(name); ok {
+			return val
+		}
+		logger.WithField("var", name).Warn("environment variable referenced in configuration is not set")
+		return ref
+	})
+}
+
+// ListIDPAccountNames list the names of all the idp accounts in the configuration file, in file order, with
+// each account's aliases following its name when includeAliases is set
+func (cm *ConfigManager) ListIDPAccountNames(includeAliases bool) ([]string, error) {
+
+	unlock, err := filelock.Lock(cm.configPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	if !includeAliases {
+		return accountNames(cfg), nil
+	}
+
+	names := []string{}
+	for _, name := range accountNames(cfg) {
+		names = append(names, name)
+		names = append(names, splitList(cfg.Section(name).Key("aliases").String())...)
+	}
+
+	return names, nil
+}
+
+// ListIDPAccounts load all the idp accounts in the configuration file keyed by name
+func (cm *ConfigManager) ListIDPAccounts() (map[string]*IDPAccount, error) {
+
+	unlock, err := filelock.Lock(cm.configPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	accounts := map[string]*IDPAccount{}
+
+	for _, name := range accountNames(cfg) {
+		account, err := readAccount(name, cfg, !cm.DisableInterpolation)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read idp account %s", name)
+		}
+
+		account.Name = name
+		accounts[name] = account
+	}
+
+	return accounts, nil
+}
+
+func accountNames(cfg *ini.File) []string {
+
+	names := []string{}
+
+	for _, name := range cfg.SectionStrings() {
+		if reservedSection(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// aliasOwner finds the idp account that lists name among its aliases
+func aliasOwner(cfg *ini.File, name string) (string, bool) {
+	for _, owner := range accountNames(cfg) {
+		for _, alias := range splitList(cfg.Section(owner).Key("aliases").String()) {
+			if alias == name {
+				return owner, true
+			}
+		}
+	}
+	return "", false
+}
+
+// validateAliases checks neither the account name nor its aliases are already claimed by another account,
+// whether as a section name or an alias
+func validateAliases(cfg *ini.File, idpAccountName string, account *IDPAccount) error {
+	if owner, ok := aliasOwner(cfg, idpAccountName); ok && owner != idpAccountName {
+		return errors.Errorf("idp account name %s is already an alias of %s", idpAccountName, owner)
+	}
+
+	for _, alias := range splitList(account.Aliases) {
+		if alias == idpAccountName {
+			continue
+		}
+		if reservedSection(alias) {
+			return errors.Errorf("alias %s is a reserved section name", alias)
+		}
+		if cfg.HasSection(alias) {
+			return errors.Errorf("alias %s collides with the idp account of the same name", alias)
+		}
+		if owner, ok := aliasOwner(cfg, alias); ok && owner != idpAccountName {
+			return errors.Errorf("alias %s is already an alias of %s", alias, owner)
+		}
+	}
+
+	return nil
+}
+
+// reservedSection reports whether the section is one that never holds an idp account, the DEFAULT section
+// is always present and the others hold settings shared by every account
+func reservedSection(name string) bool {
+	return name == ini.DefaultSection || name == GlobalSectionName || name == RoleAliasesSectionName || name == URNOverridesSectionName
+}
+
+// LoadRoleAliases load the role_aliases section mapping short role names to role ARNs, empty if there is none
+func (cm *ConfigManager) LoadRoleAliases() (map[string]string, error) {
+
+	unlock, err := filelock.Lock(cm.configPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	aliases := map[string]string{}
+	if cfg.HasSection(RoleAliasesSectionName) {
+		for _, key := range cfg.Section(RoleAliasesSectionName).Keys() {
+			aliases[key.Name()] = key.Value()
+		}
+	}
+
+	return aliases, nil
+}
+
+// URNOverride the URN to request the assertion for when the SAML provider of the role matches Pattern
+type URNOverride struct {
+	// Pattern the SAML provider ARN, * matches any run of characters
+	Pattern string
+	URN     string
+}
+
+// Matches reports whether the SAML provider ARN matches the pattern of the override
+func (o URNOverride) Matches(principalARN string) bool {
+	pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(o.Pattern), `\*`, ".*") + "$"
+	return regexp.MustCompile(pattern).MatchString(principalARN)
+}
+
+// URNForPrincipal the URN of the first override matching the SAML provider ARN, defaultURN when none does
+func URNForPrincipal(overrides []URNOverride, principalARN, defaultURN string) string {
+	for _, override := range overrides {
+		if override.Matches(principalARN) {
+			return override.URN
+		}
+	}
+	return defaultURN
+}
+
+// LoadURNOverrides load the urn_overrides section in the order it is written, empty if there is none. The keys
+// are ARNs so they are quoted to keep their colons.
+func (cm *ConfigManager) LoadURNOverrides() ([]URNOverride, error) {
+
+	unlock, err := filelock.Lock(cm.configPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	overrides := []URNOverride{}
+	if cfg.HasSection(URNOverridesSectionName) {
+		for _, key := range cfg.Section(URNOverridesSectionName).Keys() {
+			if key.Value() == "" {
+				return nil, errors.Errorf("urn_overrides entry %q has no URN", key.Name())
+			}
+			overrides = append(overrides, URNOverride{Pattern: key.Name(), URN: key.Value()})
+		}
+	}
+
+	return overrides, nil
+}
+
+// checkPermissions warn when the configuration file can be read by users other than the owner
+func (cm *ConfigManager) checkPermissions() {
+
+	if cm.AllowSharedConfig || runtime.GOOS == "windows" {
+		return
+	}
+
+	fi, err := os.Stat(cm.configPath)
+	if err != nil {
+		return
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		logger.WithField("path", cm.configPath).Warnf("configuration file is accessible by other users (mode %#o), it will be restricted to %#o when next saved", fi.Mode().Perm(), ConfigFilePermissions)
+	}
+}
+
+// saveConfigFile write the configuration to a temporary file alongside the target
+// and rename it into place so readers never observe a partially written file
+func (cm *ConfigManager) saveConfigFile(cfg *ini.File, configPath string) error {
+
+	var buf bytes.Buffer
+	_, err := cfg.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	// encrypt before anything touches the disk so the temp file never holds the plaintext, the state
+	// file alongside holds nothing sensitive and is left as is
+	if cm.encrypted && configPath == cm.configPath {
+		data, err = cm.encryptConfig(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeConfigFile(data, configPath, cm.AllowSharedConfig)
+}
+
+// writeConfigFile write data to a temporary file alongside configPath and rename it into place, keepMode keeps
+// the permissions of the file replaced rather than restricting them to the owner
+func writeConfigFile(data []byte, configPath string, keepMode bool) error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), filepath.Base(configPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// permissions don't map onto windows ACLs so leave them alone there
+	if runtime.GOOS != "windows" {
+		mode := os.FileMode(ConfigFilePermissions)
+		if fi, err := os.Stat(configPath); err == nil && keepMode {
+			mode = fi.Mode().Perm()
+		}
+		if err := tmp.Chmod(mode); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), configPath)
+}
@@ -1,10 +1,20 @@
 package cfg
 
 import (
+	"encoding/pem"
+	"fmt"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/mitchellh/go-homedir"
 	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	ini "gopkg.in/ini.v1"
 )
 
 const throwAwayConfig = "example/saml2aws.test.ini"
@@ -28,10 +38,96 @@ func TestIDPAccountString(t *testing.T) {
 	require.Contains(t, s, "urn:amazon:webservices\n")
 }
 
+func TestIDPAccountStringProviders(t *testing.T) {
+	const common = `
+  URL: https://id.example.com
+  Username: user@example.com
+  Provider: %s
+  MFA: Auto
+  SkipVerify: false
+  AmazonWebservicesURN: urn:amazon:webservices
+  SessionDuration: 3600
+  Profile: saml
+  RoleARN: arn:aws:iam::123456789012:role/admin
+  Region: us-east-1
+}`
+
+	tests := []struct {
+		name    string
+		account IDPAccount
+		want    string
+	}{
+		{
+			name:    "ADFS",
+			account: IDPAccount{Provider: "ADFS", SAMLCache: true, TargetURL: "https://signin.aws.amazon.com/saml"},
+			want: `account {
+  SAMLCache: true
+  TargetURL: https://signin.aws.amazon.com/saml`,
+		},
+		{
+			name:    "AzureAD",
+			account: IDPAccount{Provider: "AzureAD", AppID: "app-123"},
+			want: `account {
+  AppID: app-123`,
+		},
+		{
+			name:    "Browser",
+			account: IDPAccount{Provider: "Browser", BrowserType: "chrome", Headless: true, DownloadBrowser: true},
+			want: `account {
+  BrowserType: chrome
+  DownloadBrowser: true
+  Headless: true`,
+		},
+		{
+			name:    "F5APM",
+			account: IDPAccount{Provider: "F5APM", ResourceID: "/Common/aws"},
+			want: `account {
+  ResourceID: /Common/aws`,
+		},
+		{
+			name:    "KeyCloak",
+			account: IDPAccount{Provider: "KeyCloak", KCAuthErrorElement: "span#input-error"},
+			want: `account {
+  KCAuthErrorElement: span#input-error`,
+		},
+		{
+			name:    "Okta",
+			account: IDPAccount{Provider: "Okta", DisableRememberDevice: true, MFAFallback: "TOTP"},
+			want: `account {
+  DisableRememberDevice: true
+  MFAFallback: TOTP`,
+		},
+		{
+			name:    "OneLogin",
+			account: IDPAccount{Provider: "OneLogin", AppID: "123", Subdomain: "example", SAMLCacheEncrypt: true},
+			want: `account {
+  AppID: 123
+  SAMLCacheEncrypt: true
+  Subdomain: example`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.account.URL = "https://id.example.com"
+			tt.account.Username = "user@example.com"
+			tt.account.MFA = "Auto"
+			tt.account.AmazonWebservicesURN = DefaultAmazonWebservicesURN
+			tt.account.SessionDuration = DefaultSessionDuration
+			tt.account.Profile = DefaultProfile
+			tt.account.RoleARN = "arn:aws:iam::123456789012:role/admin"
+			tt.account.Region = "us-east-1"
+
+			require.Equal(t, tt.want+fmt.Sprintf(common, tt.account.Provider), tt.account.String())
+		})
+	}
+}
+
 func TestNewConfigManagerDefaultEmpty(t *testing.T) {
+	fakeHome(t)
+
 	cfgm, err := NewConfigManager("")
 	require.Nil(t, err)
-	require.Contains(t, cfgm.configPath, ".saml2aws")
+	require.Contains(t, cfgm.configPath, filepath.Join(".config", "saml2aws", "config"))
 	idpAccount, err := cfgm.LoadIDPAccount("foo")
 	require.Nil(t, err)
 	require.Equal(t, idpAccount.URL, "")
@@ -92,5 +188,1010 @@ func TestNewConfigManagerSave(t *testing.T) {
 	}, idpAccount)
 
 	os.Remove(throwAwayConfig)
+	os.Remove(throwAwayConfig + ".lock")
+
+}
+
+func TestListIDPAccountNames(t *testing.T) {
+
+	cfgm, err := NewConfigManager("example/saml2aws.ini")
+	require.Nil(t, err)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"wolfeidau", "test123"}, names)
+}
+
+func TestListIDPAccountNamesMissingFile(t *testing.T) {
+
+	cfgm, err := NewConfigManager("example/does-not-exist.ini")
+	require.Nil(t, err)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.NotNil(t, names)
+	require.Empty(t, names)
+}
+
+func TestListIDPAccounts(t *testing.T) {
+
+	cfgm, err := NewConfigManager("example/saml2aws.ini")
+	require.Nil(t, err)
+
+	accounts, err := cfgm.ListIDPAccounts()
+	require.Nil(t, err)
+	require.Len(t, accounts, 2)
+	require.Equal(t, "test123", accounts["test123"].Name)
+	require.Equal(t, "https://id.whatever.com/#/hash", accounts["test123"].URL)
+	require.Equal(t, "totp", accounts["wolfeidau"].MFA)
+}
+
+func TestDeleteIDPAccount(t *testing.T) {
+
+	cfgm, err := NewConfigManager(throwAwayConfig)
+	require.Nil(t, err)
+	defer os.Remove(throwAwayConfig)
+	defer os.Remove(throwAwayConfig + ".lock")
+
+	for _, name := range []string{"keep", "remove"} {
+		err = cfgm.SaveIDPAccount(name, &IDPAccount{
+			URL:      "https://id.whatever.com",
+			MFA:      "none",
+			Provider: "keycloak",
+			Profile:  "saml",
+		})
+		require.Nil(t, err)
+	}
+
+	err = cfgm.DeleteIDPAccount("remove")
+	require.Nil(t, err)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"keep"}, names)
+
+	err = cfgm.DeleteIDPAccount("remove")
+	require.Equal(t, ErrIdpAccountNotFound, err)
+}
+
+func TestRenameIDPAccount(t *testing.T) {
+
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	data, err := os.ReadFile("example/saml2aws.ini")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(configFile, data, 0600))
+
+	cfgm, err := NewConfigManager(configFile)
+	require.Nil(t, err)
+
+	before, err := cfgm.LoadIDPAccount("test123")
+	require.Nil(t, err)
+
+	err = cfgm.RenameIDPAccount("test123", "renamed")
+	require.Nil(t, err)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.NotContains(t, names, "test123")
+	require.Contains(t, names, "renamed")
+
+	after, err := cfgm.LoadIDPAccount("renamed")
+	require.Nil(t, err)
+	before.Name = "renamed"
+	require.Equal(t, before, after)
+
+	err = cfgm.RenameIDPAccount("test123", "other")
+	require.Equal(t, ErrIdpAccountNotFound, err)
+
+	err = cfgm.RenameIDPAccount("renamed", "wolfeidau")
+	require.Equal(t, ErrIdpAccountExists, err)
+
+	err = cfgm.RenameIDPAccount("renamed", GlobalSectionName)
+	require.Error(t, err)
+}
+
+const aliasesConfig = `[work]
+url      = https://id.whatever.com
+username = abc@whatever.com
+provider = keycloak
+mfa      = totp
+aliases  = w, corp
+
+[play]
+url      = https://id.whatever.com
+username = abc@whatever.com
+provider = keycloak
+mfa      = totp
+`
+
+func TestLoadIDPAccountAlias(t *testing.T) {
+
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	require.Nil(t, os.WriteFile(configFile, []byte(aliasesConfig), 0600))
+
+	cfgm, err := NewConfigManager(configFile)
+	require.Nil(t, err)
+
+	idpAccount, err := cfgm.LoadIDPAccount("corp")
+	require.Nil(t, err)
+	require.Equal(t, "work", idpAccount.Name)
+	require.Equal(t, "https://id.whatever.com", idpAccount.URL)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"work", "play"}, names)
+
+	names, err = cfgm.ListIDPAccountNames(true)
+	require.Nil(t, err)
+	require.Equal(t, []string{"work", "w", "corp", "play"}, names)
+}
+
+func TestSaveIDPAccountAliasCollisions(t *testing.T) {
+
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	require.Nil(t, os.WriteFile(configFile, []byte(aliasesConfig), 0600))
+
+	cfgm, err := NewConfigManager(configFile)
+	require.Nil(t, err)
+
+	idpAccount, err := cfgm.LoadIDPAccount("play")
+	require.Nil(t, err)
+
+	idpAccount.Aliases = "work"
+	require.EqualError(t, cfgm.SaveIDPAccount("play", idpAccount), "Account validation failed: alias work collides with the idp account of the same name")
+
+	idpAccount.Aliases = "p,corp"
+	require.EqualError(t, cfgm.SaveIDPAccount("play", idpAccount), "Account validation failed: alias corp is already an alias of work")
+
+	idpAccount.Aliases = GlobalSectionName
+	require.Error(t, cfgm.SaveIDPAccount("play", idpAccount))
+
+	idpAccount.Aliases = ""
+	require.EqualError(t, cfgm.SaveIDPAccount("w", idpAccount), "Account validation failed: idp account name w is already an alias of work")
+
+	idpAccount.Aliases = "p"
+	require.Nil(t, cfgm.SaveIDPAccount("play", idpAccount))
+
+	// saving an account again keeps its own aliases
+	work, err := cfgm.LoadIDPAccount("work")
+	require.Nil(t, err)
+	require.Nil(t, cfgm.SaveIDPAccount("work", work))
+
+	require.Error(t, cfgm.RenameIDPAccount("play", "corp"))
+}
+
+func TestIDPAccountClone(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.Name = "original"
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.SkipVerify = true
+
+	clone := idpAccount.Clone()
+	require.Equal(t, idpAccount, clone)
+
+	clone.Name = "clone"
+	clone.URL = "https://other.whatever.com"
+	clone.SkipVerify = false
+	clone.SessionDuration = MaxSessionDuration
+
+	require.Equal(t, "original", idpAccount.Name)
+	require.Equal(t, "https://id.whatever.com", idpAccount.URL)
+	require.True(t, idpAccount.SkipVerify)
+	require.Equal(t, DefaultSessionDuration, idpAccount.SessionDuration)
+}
+
+func TestMFAFallbackMethods(t *testing.T) {
+	idpAccount := &IDPAccount{MFAFallback: " PUSH, TOTP ,,SMS"}
+	require.Equal(t, []string{"PUSH", "TOTP", "SMS"}, idpAccount.MFAFallbackMethods())
+
+	idpAccount = &IDPAccount{}
+	require.Empty(t, idpAccount.MFAFallbackMethods())
+}
+
+func TestValidateProxy(t *testing.T) {
+	idpAccount := &IDPAccount{
+		URL:      "https://id.whatever.com",
+		MFA:      "none",
+		Provider: "keycloak",
+		Profile:  "saml",
+	}
+
+	for _, proxy := range []string{"http://proxy.corp:3128", "proxy.corp:3128", "socks5://127.0.0.1:1080"} {
+		idpAccount.HttpsProxy = proxy
+		require.Nil(t, idpAccount.Validate(), proxy)
+	}
+
+	for _, proxy := range []string{"ftp://proxy.corp", "http://", "http://%zz"} {
+		idpAccount.HttpsProxy = proxy
+		require.Error(t, idpAccount.Validate(), proxy)
+	}
+}
+
+func TestValidateProviders(t *testing.T) {
+	tests := []struct {
+		name    string
+		account IDPAccount
+		wantErr string
+	}{
+		{name: "OneLogin", account: IDPAccount{Provider: "OneLogin", URL: "https://app.onelogin.com", AppID: "123", Subdomain: "corp"}},
+		{name: "OneLogin missing app id", account: IDPAccount{Provider: "OneLogin", URL: "https://app.onelogin.com", Subdomain: "corp"}, wantErr: "app ID empty"},
+		{name: "OneLogin missing subdomain", account: IDPAccount{Provider: "OneLogin", URL: "https://app.onelogin.com", AppID: "123"}, wantErr: "subdomain empty"},
+		{name: "F5APM", account: IDPAccount{Provider: "F5APM", URL: "https://f5.example.com", ResourceID: "/Common/aws"}},
+		{name: "F5APM missing resource id", account: IDPAccount{Provider: "F5APM", URL: "https://f5.example.com"}, wantErr: "Resource ID empty"},
+		{name: "AzureAD", account: IDPAccount{Provider: "AzureAD", URL: "https://account.activedirectory.windowsazure.com", AppID: "123"}},
+		{name: "AzureAD missing app id", account: IDPAccount{Provider: "AzureAD", URL: "https://account.activedirectory.windowsazure.com"}, wantErr: "app ID empty"},
+		{name: "Okta", account: IDPAccount{Provider: "Okta", URL: "https://corp.okta.com/home/amazon_aws/0oa1/272"}},
+		{name: "Okta http", account: IDPAccount{Provider: "Okta", URL: "http://corp.okta.com/home/amazon_aws/0oa1/272"}, wantErr: `URL "http://corp.okta.com/home/amazon_aws/0oa1/272" in idp account must be an https URL`},
+		{name: "Okta no host", account: IDPAccount{Provider: "Okta", URL: "corp.okta.com/home/amazon_aws/0oa1/272"}, wantErr: "must be an https URL"},
+		{name: "KeyCloak", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com/auth/realms/corp/protocol/saml/clients/amazon-aws"}},
+		{name: "KeyCloak broker", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com/auth/realms/corp", KCBroker: "corp-adfs", KCBrokerProvider: "ADFS"}},
+		{name: "KeyCloak broker provider without broker", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com/auth/realms/corp", KCBrokerProvider: "ADFS"}, wantErr: "kc_broker_provider in idp account requires kc_broker"},
+		{name: "KeyCloak relative", account: IDPAccount{Provider: "KeyCloak", URL: "/auth/realms/corp"}, wantErr: `URL "/auth/realms/corp" in idp account must be an absolute http or https URL`},
+		{name: "miniOrange", account: IDPAccount{Provider: "miniOrange", URL: "https://login.xecurify.com/moas/broker/login/saml/123456/amazon_web_services"}},
+		{name: "miniOrange http", account: IDPAccount{Provider: "miniOrange", URL: "http://login.xecurify.com/moas/broker/login/saml/123456/amazon_web_services"}, wantErr: "must be an https URL for miniOrange"},
+		{name: "ADFSWSTrust", account: IDPAccount{Provider: "ADFSWSTrust", URL: "https://adfs.example.com"}},
+		{name: "ADFSWSTrust http", account: IDPAccount{Provider: "ADFSWSTrust", URL: "http://adfs.example.com"}, wantErr: "must be an https URL for ADFSWSTrust"},
+		{name: "Browser cdp endpoint", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserCDPEndpoint: "http://localhost:9222"}},
+		{name: "Browser cdp websocket", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserCDPEndpoint: "ws://localhost:9222/devtools/browser/abc"}},
+		{name: "Browser cdp without scheme", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserCDPEndpoint: "localhost:9222"}, wantErr: `browser_cdp_endpoint "localhost:9222" in idp account must be an http or ws URL`},
+		{name: "Browser timeout", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserTimeout: 120}},
+		{name: "Browser negative timeout", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserTimeout: -1}, wantErr: "browser_timeout -1 in idp account can't be negative"},
+		{name: "Browser cdp with profile", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserCDPEndpoint: "http://localhost:9222", BrowserProfileDir: "~/.aws/saml2aws/browser/work"}, wantErr: "browser_cdp_endpoint and browser_profile_dir in idp account can't both be set"},
+		{name: "Browser type", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserType: "MSEdge"}},
+		{name: "Browser unknown type", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserType: "safari"}, wantErr: `browser_type "safari" in idp account is not one of chromium, firefox`},
+		{name: "Browser missing executable", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserExecutablePath: "/nonexistent/chrome"}, wantErr: `browser_executable_path "/nonexistent/chrome" in idp account doesn't exist`},
+		{name: "Browser executable is a directory", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", BrowserExecutablePath: os.TempDir()}, wantErr: "is a directory"},
+		{name: "Browser headless", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", Headless: true, BrowserType: "chrome"}},
+		{name: "Browser headless with interactive MFA", account: IDPAccount{Provider: "Browser", URL: "https://id.example.com", Headless: true, MFA: "PUSH"}, wantErr: "headless in idp account hides the browser window the PUSH MFA is answered in"},
+		{name: "aws output", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", WriteAWSConfig: true, AWSOutput: "yaml"}},
+		{name: "unknown aws output", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", AWSOutput: "xml"}, wantErr: `aws_output "xml" in idp account is not one of json, yaml, yaml-stream, text, table`},
+		{name: "role arn", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", RoleARN: "arn:aws:iam::123456789012:role/admin"}},
+		{name: "govcloud role arn", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", RoleARN: "arn:aws-us-gov:iam::123456789012:role/admin"}},
+		{name: "role arn with short account", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", RoleARN: "arn:aws:iam::1234:role/admin"}, wantErr: `role_arn "arn:aws:iam::1234:role/admin" in idp account is not an IAM role ARN`},
+		{name: "role arn for a user", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", RoleARN: "arn:aws:iam::123456789012:user/admin"}, wantErr: "is not an IAM role ARN"},
+		{name: "role matcher", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", RoleMatcher: `^arn:aws:iam::123456789012:role/Admin.*`}},
+		{name: "invalid role matcher", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", RoleMatcher: "role/(Admin"}, wantErr: `role_matcher "role/(Admin" in idp account isn't a valid regular expression`},
+		{name: "invalid role filter", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", RoleFilter: "role/(Admin"}, wantErr: `role_filter "role/(Admin" in idp account isn't a valid regular expression`},
+		{name: "negative prompt timeout", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", PromptTimeout: -5}, wantErr: "prompt_timeout -5 in idp account can't be negative"},
+		{name: "password retries", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", PasswordRetries: 2}},
+		{name: "negative password retries", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", PasswordRetries: -1}, wantErr: "password_retries -1 in idp account can't be negative"},
+		{name: "credential reuse threshold", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", CredentialReuseThreshold: 600}},
+		{name: "negative credential reuse threshold", account: IDPAccount{Provider: "KeyCloak", URL: "https://id.example.com", CredentialReuseThreshold: -1}, wantErr: "credential_reuse_threshold -1 in idp account can't be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account := tt.account
+			if account.MFA == "" {
+				account.MFA = "Auto"
+			}
+			account.Profile = DefaultProfile
+			account.SessionDuration = DefaultSessionDuration
+
+			err := account.Validate()
+			if tt.wantErr == "" {
+				require.Nil(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestValidateSessionDuration(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	for _, duration := range []int{0, MinSessionDuration, DefaultSessionDuration, 28800, MaxSessionDuration} {
+		idpAccount.SessionDuration = duration
+		require.Nil(t, idpAccount.Validate(), duration)
+	}
+
+	for _, duration := range []int{-1, 899, 43201, 36000000} {
+		idpAccount.SessionDuration = duration
+		err := idpAccount.Validate()
+		require.Error(t, err, duration)
+		require.Contains(t, err.Error(), "between 900 and 43200 seconds")
+	}
+}
+
+func TestValidateAssertionClockSkew(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	for _, skew := range []int{0, 30, MaxAssertionClockSkew} {
+		idpAccount.AssertionClockSkew = skew
+		require.Nil(t, idpAccount.Validate(), skew)
+	}
+
+	for _, skew := range []int{-1, 301, 3600} {
+		idpAccount.AssertionClockSkew = skew
+		err := idpAccount.Validate()
+		require.Error(t, err, skew)
+		require.Contains(t, err.Error(), "between 0 and 300 seconds")
+	}
+}
+
+func TestRoleTargets(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.Profile = "dev"
+
+	targets, err := idpAccount.RoleTargets()
+	require.Nil(t, err)
+	require.Empty(t, targets)
+
+	idpAccount.RoleARNs = "arn:aws:iam::123456789012:role/admin, arn:aws:iam::123456789012:role/read,arn:aws:iam::123456789012:role/deploy"
+	targets, err = idpAccount.RoleTargets()
+	require.Nil(t, err)
+	require.Equal(t, []RoleTarget{
+		{RoleARN: "arn:aws:iam::123456789012:role/admin", Profile: "dev"},
+		{RoleARN: "arn:aws:iam::123456789012:role/read", Profile: "dev-2"},
+		{RoleARN: "arn:aws:iam::123456789012:role/deploy", Profile: "dev-3"},
+	}, targets)
+
+	idpAccount.RoleProfiles = "admin,read,deploy"
+	targets, err = idpAccount.RoleTargets()
+	require.Nil(t, err)
+	require.Equal(t, "read", targets[1].Profile)
+
+	idpAccount.RoleProfiles = "admin,read"
+	_, err = idpAccount.RoleTargets()
+	require.EqualError(t, err, "role_profiles in idp account lists 2 profiles for 3 role_arns")
+}
+
+func TestValidateRoleARNs(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	idpAccount.RoleARNs = "arn:aws:iam::123456789012:role/admin,arn:aws:iam::123456789012:role/read"
+	require.Nil(t, idpAccount.Validate())
+
+	idpAccount.RoleARN = "arn:aws:iam::123456789012:role/admin"
+	require.EqualError(t, idpAccount.Validate(), "role_arn and role_arns in idp account can't both be set")
+
+	idpAccount.RoleARN = ""
+	idpAccount.RoleARNs = "arn:aws:iam::123456789012:role/admin,admin"
+	require.EqualError(t, idpAccount.Validate(), `role_arns entry "admin" in idp account is not an IAM role ARN`)
+
+	idpAccount.RoleARNs = ""
+	idpAccount.RoleProfiles = "admin"
+	require.EqualError(t, idpAccount.Validate(), "role_profiles in idp account requires role_arns")
+}
+
+func TestValidateRoleChain(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	idpAccount.RoleChain = "arn:aws:iam::123456789012:role/landing, arn:aws:iam::210987654321:role/workload"
+	require.Nil(t, idpAccount.Validate())
+	require.Equal(t, []string{"arn:aws:iam::123456789012:role/landing", "arn:aws:iam::210987654321:role/workload"}, idpAccount.RoleChainARNs())
+
+	idpAccount.RoleChain = "arn:aws:iam::123456789012:role/landing,workload"
+	require.EqualError(t, idpAccount.Validate(), `role_chain entry "workload" in idp account is not an IAM role ARN`)
+
+	idpAccount.RoleChain = "arn:aws:iam::210987654321:role/workload"
+	idpAccount.RoleARNs = "arn:aws:iam::123456789012:role/admin"
+	require.EqualError(t, idpAccount.Validate(), "role_chain and role_arns in idp account can't both be set")
+
+	idpAccount.RoleARNs = ""
+	idpAccount.RoleChainSessionDuration = 900
+	idpAccount.RoleChainExternalID = "landing-zone"
+	idpAccount.RoleChainSourceProfile = true
+	require.Nil(t, idpAccount.Validate())
+
+	idpAccount.RoleChainSessionDuration = 7200
+	require.EqualError(t, idpAccount.Validate(), "role_chain_session_duration 7200 in idp account is outside 900 to 3600 seconds, the most AWS allows for chained roles")
+
+	idpAccount.RoleChainSessionDuration = 0
+	idpAccount.RoleChain = ""
+	require.EqualError(t, idpAccount.Validate(), "role_chain_session_duration, role_chain_external_id, role_chain_session_name and role_chain_source_profile in idp account require role_chain")
+}
+
+func TestCACertPool(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	pool, err := idpAccount.CACertPool()
+	require.Nil(t, err)
+	require.Nil(t, pool)
+
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	idpAccount.CACertFile = filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(idpAccount.CACertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	require.Nil(t, err)
+	require.Nil(t, idpAccount.Validate())
+
+	pool, err = idpAccount.CACertPool()
+	require.Nil(t, err)
+	require.NotNil(t, pool)
+
+	err = os.WriteFile(idpAccount.CACertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a certificate")}), 0600)
+	require.Nil(t, err)
+	require.ErrorContains(t, idpAccount.Validate(), fmt.Sprintf("ca_cert_file %q in idp account has certificate 1 that doesn't parse", idpAccount.CACertFile))
+
+	err = os.WriteFile(idpAccount.CACertFile, []byte("not PEM"), 0600)
+	require.Nil(t, err)
+	require.EqualError(t, idpAccount.Validate(), fmt.Sprintf("ca_cert_file %q in idp account has no PEM certificates", idpAccount.CACertFile))
+
+	idpAccount.CACertFile = filepath.Join(t.TempDir(), "missing.pem")
+	require.ErrorContains(t, idpAccount.Validate(), fmt.Sprintf("ca_cert_file %q in idp account can't be read", idpAccount.CACertFile))
+}
+
+func TestValidatePolicyARNs(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	idpAccount.PolicyARNs = " arn:aws:iam::aws:policy/ReadOnlyAccess,, arn:aws:iam::123456789012:policy/deny-iam "
+	require.Nil(t, idpAccount.Validate())
+	require.Equal(t, []string{"arn:aws:iam::aws:policy/ReadOnlyAccess", "arn:aws:iam::123456789012:policy/deny-iam"}, idpAccount.PolicyARNList())
+
+	idpAccount.PolicyARNs = "arn:aws:iam::aws:policy/ReadOnlyAccess,arn:aws:iam::123456789012:role/admin"
+	require.EqualError(t, idpAccount.Validate(), `policy_arns entry "arn:aws:iam::123456789012:role/admin" in idp account is not an IAM policy ARN`)
+
+	idpAccount.PolicyARNs = strings.Repeat("arn:aws:iam::aws:policy/ReadOnlyAccess,", 11)
+	require.EqualError(t, idpAccount.Validate(), "policy_arns in idp account has 11 policies, AWS allows at most 10")
+}
+
+func TestValidateAllRolesProfile(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	idpAccount.AllRolesProfile = "{{.AccountID}}-{{.RoleName}}"
+	require.Nil(t, idpAccount.Validate())
+
+	idpAccount.AllRolesProfile = "{{.AccountID"
+	require.ErrorContains(t, idpAccount.Validate(), `all_roles_profile "{{.AccountID" in idp account is not a valid template`)
+}
+
+func TestCredentialsProfile(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.Profile = "saml"
+
+	require.Equal(t, "saml", idpAccount.CredentialsProfile("arn:aws:iam::123456789012:role/admin"))
+
+	idpAccount.ProfileTemplate = "{account_id}-{role_name}"
+	require.Equal(t, "123456789012-admin", idpAccount.CredentialsProfile("arn:aws:iam::123456789012:role/admin"))
+	require.Equal(t, "123456789012-Deploy", idpAccount.CredentialsProfile("arn:aws:iam::123456789012:role/ci/Deploy"))
+	require.Equal(t, "saml", idpAccount.CredentialsProfile(""))
+
+	idpAccount.ProfileTemplate = "team {role_name}!"
+	require.Equal(t, "team-admin", idpAccount.CredentialsProfile("arn:aws:iam::123456789012:role/admin"))
+
+	idpAccount.ProfileTemplate = "{role_name}"
+	idpAccount.RoleChain = "arn:aws:iam::210987654321:role/workload"
+	require.Equal(t, "workload", idpAccount.CredentialsProfile("arn:aws:iam::123456789012:role/admin"))
+
+	idpAccount.RoleChain = ""
+	idpAccount.ProfileTemplate = "!!!"
+	require.Equal(t, "saml", idpAccount.CredentialsProfile("arn:aws:iam::123456789012:role/admin"))
+
+	idpAccount.ProfileTemplate = "sso-{role_name}"
+	idpAccount.RoleARNs = "arn:aws:iam::123456789012:role/admin,arn:aws:iam::123456789012:role/read"
+	targets, err := idpAccount.RoleTargets()
+	require.Nil(t, err)
+	require.Equal(t, "sso-admin", targets[0].Profile)
+	require.Equal(t, "sso-read", targets[1].Profile)
+}
+
+func TestValidateProfileTemplate(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	idpAccount.ProfileTemplate = "{account_id}-{role_name}"
+	require.Nil(t, idpAccount.Validate())
+
+	idpAccount.ProfileTemplate = "{account}-{role_name}"
+	require.EqualError(t, idpAccount.Validate(), `profile_template "{account}-{role_name}" in idp account has unknown placeholder {account}, expected {account_id} or {role_name}`)
+}
+
+func TestValidateDisableKeyring(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	idpAccount.DisableKeyring = true
+	require.Nil(t, idpAccount.Validate())
+
+	idpAccount.SAMLCacheEncrypt = true
+	require.EqualError(t, idpAccount.Validate(), "saml_cache_encrypt in idp account keeps its key in the keyring, it can't be used with disable_keyring")
+}
+
+func TestValidateIdentityCenter(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.MFA = "Auto"
+	idpAccount.Provider = "IdentityCenter"
+
+	require.EqualError(t, idpAccount.Validate(), "sso_start_url empty in idp account")
+
+	idpAccount.SSOStartURL = "https://example.awsapps.com/start"
+	require.EqualError(t, idpAccount.Validate(), "sso_region empty in idp account")
 
+	// url isn't needed, Identity Center signs in at sso_start_url
+	idpAccount.SSORegion = "us-east-1"
+	require.Nil(t, idpAccount.Validate())
+
+	idpAccount.RoleARNs = "arn:aws:iam::123456789012:role/admin"
+	require.EqualError(t, idpAccount.Validate(), "role_arns in idp account can't be used with IdentityCenter")
+}
+
+func TestValidateSTSRegion(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	for _, region := range []string{"", "us-east-1", "us-gov-west-1", "cn-north-1"} {
+		idpAccount.STSRegion = region
+		require.Nil(t, idpAccount.Validate(), region)
+	}
+
+	for _, region := range []string{"mars-east-1", "us-east"} {
+		idpAccount.STSRegion = region
+		require.Error(t, idpAccount.Validate(), region)
+	}
+}
+
+func TestValidatePartition(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.URL = "https://id.whatever.com"
+	idpAccount.MFA = "none"
+	idpAccount.Provider = "keycloak"
+
+	for _, partition := range []string{"", "aws", "govcloud", "china"} {
+		idpAccount.Partition = partition
+		require.Nil(t, idpAccount.Validate(), partition)
+	}
+
+	idpAccount.Partition = "aws-iso"
+	require.EqualError(t, idpAccount.Validate(), `aws_partition "aws-iso" in idp account is not one of aws, china, govcloud`)
+
+	idpAccount.Partition = "govcloud"
+	idpAccount.Region = "us-east-1"
+	require.EqualError(t, idpAccount.Validate(), "region us-east-1 in idp account is not in the govcloud partition")
+
+	idpAccount.Region = "us-gov-east-1"
+	idpAccount.STSRegion = "cn-north-1"
+	require.EqualError(t, idpAccount.Validate(), "sts_region cn-north-1 in idp account is not in the govcloud partition")
+}
+
+func TestApplyPartition(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.Partition = "govcloud"
+	idpAccount.ApplyPartition()
+	require.Equal(t, "urn:amazon:webservices:govcloud", idpAccount.AmazonWebservicesURN)
+	require.Equal(t, "us-gov-west-1", idpAccount.Region)
+	require.Equal(t, "us-gov-west-1", idpAccount.STSRegion)
+
+	// a region or URN chosen for the account is kept
+	idpAccount = NewIDPAccount()
+	idpAccount.Partition = "govcloud"
+	idpAccount.AmazonWebservicesURN = "urn:amazon:webservices:custom"
+	idpAccount.Region = "us-gov-east-1"
+	idpAccount.ApplyPartition()
+	require.Equal(t, "urn:amazon:webservices:custom", idpAccount.AmazonWebservicesURN)
+	require.Equal(t, "us-gov-east-1", idpAccount.Region)
+	require.Equal(t, "us-gov-east-1", idpAccount.STSRegion)
+
+	// switching partition replaces the URN of the old one
+	idpAccount = NewIDPAccount()
+	idpAccount.Partition = "china"
+	idpAccount.AmazonWebservicesURN = "urn:amazon:webservices:govcloud"
+	idpAccount.ApplyPartition()
+	require.Equal(t, "urn:amazon:webservices:cn-north-1", idpAccount.AmazonWebservicesURN)
+	require.Equal(t, "cn-north-1", idpAccount.Region)
+
+	idpAccount = NewIDPAccount()
+	idpAccount.ApplyPartition()
+	require.Equal(t, DefaultAmazonWebservicesURN, idpAccount.AmazonWebservicesURN)
+	require.Equal(t, "", idpAccount.Region)
+	require.Equal(t, "", idpAccount.STSRegion)
+}
+
+func TestValidateLeavesPromptTimeout(t *testing.T) {
+	active := prompter.ActivePrompter
+	defer prompter.SetPrompter(active)
+
+	idpAccount := NewIDPAccount()
+	idpAccount.Provider = "KeyCloak"
+	idpAccount.URL = "https://id.example.com"
+	idpAccount.MFA = "Auto"
+	idpAccount.PromptTimeout = 30
+
+	// the timeout applies to the account a command uses, not every account that is checked
+	require.Nil(t, idpAccount.Validate())
+	require.Equal(t, active, prompter.ActivePrompter)
+}
+
+func TestPartitionForARN(t *testing.T) {
+	require.Equal(t, Partitions["aws"], PartitionForARN("arn:aws:iam::123456789012:role/Admin"))
+	require.Equal(t, Partitions["govcloud"], PartitionForARN("arn:aws-us-gov:iam::123456789012:role/Admin"))
+	require.Equal(t, Partitions["china"], PartitionForARN("arn:aws-cn:iam::123456789012:role/Admin"))
+	require.Equal(t, Partitions["aws"], PartitionForARN("arn:aws-iso:iam::123456789012:role/Admin"))
+	require.Equal(t, Partitions["aws"], PartitionForARN(""))
+}
+
+func TestApplyRolePartition(t *testing.T) {
+	idpAccount := NewIDPAccount()
+	idpAccount.Region = "eu-west-1"
+	idpAccount.ApplyRolePartition("arn:aws:iam::123456789012:role/Admin")
+	require.Equal(t, "eu-west-1", idpAccount.Region)
+	require.Equal(t, "", idpAccount.STSRegion)
+
+	idpAccount = NewIDPAccount()
+	idpAccount.Region = "eu-west-1"
+	idpAccount.ApplyRolePartition("arn:aws-us-gov:iam::123456789012:role/Admin")
+	require.Equal(t, "us-gov-west-1", idpAccount.Region)
+	require.Equal(t, "us-gov-west-1", idpAccount.STSRegion)
+
+	idpAccount = NewIDPAccount()
+	idpAccount.ApplyRolePartition("arn:aws-cn:iam::123456789012:role/Admin")
+	require.Equal(t, "cn-north-1", idpAccount.Region)
+	require.Equal(t, "cn-north-1", idpAccount.STSRegion)
+
+	// a region chosen in the role's partition is kept
+	idpAccount = NewIDPAccount()
+	idpAccount.Region = "us-gov-east-1"
+	idpAccount.ApplyRolePartition("arn:aws-us-gov:iam::123456789012:role/Admin")
+	require.Equal(t, "us-gov-east-1", idpAccount.Region)
+	require.Equal(t, "us-gov-east-1", idpAccount.STSRegion)
+}
+
+func TestLoadIDPAccountGlobalSection(t *testing.T) {
+
+	cfgm, err := NewConfigManager("example/saml2aws.global.ini")
+	require.Nil(t, err)
+
+	// global section overrides the built in defaults
+	idpAccount, err := cfgm.LoadIDPAccount("inherits")
+	require.Nil(t, err)
+	require.Equal(t, "urn:amazon:webservices:govcloud-us", idpAccount.AmazonWebservicesURN)
+	require.Equal(t, 7200, idpAccount.SessionDuration)
+	require.Equal(t, "us-gov-west-1", idpAccount.Region)
+	require.True(t, idpAccount.SkipVerify)
+	require.Equal(t, DefaultProfile, idpAccount.Profile)
+
+	// account section overrides the global section
+	idpAccount, err = cfgm.LoadIDPAccount("overrides")
+	require.Nil(t, err)
+	require.Equal(t, "urn:amazon:webservices:govcloud-us", idpAccount.AmazonWebservicesURN)
+	require.Equal(t, 3600, idpAccount.SessionDuration)
+	require.Equal(t, "us-east-1", idpAccount.Region)
+	require.False(t, idpAccount.SkipVerify)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"inherits", "overrides"}, names)
+}
+
+func TestLoadRoleAliases(t *testing.T) {
+
+	cfgm, err := NewConfigManager("example/saml2aws.aliases.ini")
+	require.Nil(t, err)
+
+	aliases, err := cfgm.LoadRoleAliases()
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{
+		"admin":    "arn:aws:iam::123456789012:role/admin",
+		"readonly": "arn:aws:iam::123456789012:role/readonly",
+	}, aliases)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"work"}, names)
+
+	cfgm, err = NewConfigManager("example/saml2aws.ini")
+	require.Nil(t, err)
+
+	aliases, err = cfgm.LoadRoleAliases()
+	require.Nil(t, err)
+	require.Empty(t, aliases)
+}
+
+func TestLoadURNOverrides(t *testing.T) {
+
+	cfgm, err := NewConfigManager("example/saml2aws.urn_overrides.ini")
+	require.Nil(t, err)
+
+	overrides, err := cfgm.LoadURNOverrides()
+	require.Nil(t, err)
+	require.Equal(t, []URNOverride{
+		{Pattern: "arn:aws:iam::111122223333:saml-provider/Billing", URN: "urn:amazon:webservices:billing"},
+		{Pattern: "arn:aws:iam::*:saml-provider/Legacy*", URN: "urn:amazon:webservices:legacy"},
+	}, overrides)
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"work"}, names)
+
+	require.Equal(t, "urn:amazon:webservices:billing", URNForPrincipal(overrides, "arn:aws:iam::111122223333:saml-provider/Billing", DefaultAmazonWebservicesURN))
+	require.Equal(t, "urn:amazon:webservices:legacy", URNForPrincipal(overrides, "arn:aws:iam::444455556666:saml-provider/LegacyADFS", DefaultAmazonWebservicesURN))
+	require.Equal(t, DefaultAmazonWebservicesURN, URNForPrincipal(overrides, "arn:aws:iam::444455556666:saml-provider/Billing", DefaultAmazonWebservicesURN))
+
+	cfgm, err = NewConfigManager("example/saml2aws.ini")
+	require.Nil(t, err)
+
+	overrides, err = cfgm.LoadURNOverrides()
+	require.Nil(t, err)
+	require.Empty(t, overrides)
+}
+
+func TestSaveIDPAccountGlobalSection(t *testing.T) {
+
+	data, err := os.ReadFile("example/saml2aws.global.ini")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(throwAwayConfig, data, 0600))
+	defer os.Remove(throwAwayConfig)
+	defer os.Remove(throwAwayConfig + ".lock")
+
+	cfgm, err := NewConfigManager(throwAwayConfig)
+	require.Nil(t, err)
+
+	idpAccount, err := cfgm.LoadIDPAccount("inherits")
+	require.Nil(t, err)
+
+	idpAccount.Profile = "changed"
+	err = cfgm.SaveIDPAccount("inherits", idpAccount)
+	require.Nil(t, err)
+
+	cfg, err := ini.Load(throwAwayConfig)
+	require.Nil(t, err)
+	sec := cfg.Section("inherits")
+	require.Equal(t, "changed", sec.Key("aws_profile").String())
+	require.False(t, sec.HasKey("aws_urn"))
+	require.False(t, sec.HasKey("aws_session_duration"))
+	require.False(t, sec.HasKey("region"))
+	require.False(t, sec.HasKey("skip_verify"))
+}
+
+func TestSaveIDPAccountConcurrent(t *testing.T) {
+
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+
+	cfgm, err := NewConfigManager(configFile)
+	require.Nil(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- cfgm.SaveIDPAccount(fmt.Sprintf("account%d", i), &IDPAccount{
+				URL:      "https://id.whatever.com",
+				MFA:      "none",
+				Provider: "keycloak",
+				Profile:  "saml",
+			})
+			_, err := ini.Load(configFile)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.Len(t, names, 20)
+}
+
+func TestLoadIDPAccountInterpolation(t *testing.T) {
+
+	t.Setenv("SAML2AWS_TEST_HOST", "id.whatever.com")
+	t.Setenv("SAML2AWS_TEST_PATH", "saml")
+	t.Setenv("SAML2AWS_TEST_USER", "abc")
+
+	cfgm, err := NewConfigManager("example/saml2aws.env.ini")
+	require.Nil(t, err)
+
+	idpAccount, err := cfgm.LoadIDPAccount("interpolated")
+	require.Nil(t, err)
+	require.Equal(t, "https://id.whatever.com/saml", idpAccount.URL)
+	require.Equal(t, "abc@whatever.com", idpAccount.Username)
+	require.Equal(t, "${SAML2AWS_TEST_UNSET}", idpAccount.Profile)
+	require.Equal(t, "interpolated", idpAccount.Name)
+
+	cfgm.DisableInterpolation = true
+
+	idpAccount, err = cfgm.LoadIDPAccount("interpolated")
+	require.Nil(t, err)
+	require.Equal(t, "https://${SAML2AWS_TEST_HOST}/$SAML2AWS_TEST_PATH", idpAccount.URL)
+	require.Equal(t, "${SAML2AWS_TEST_USER}@whatever.com", idpAccount.Username)
+}
+
+func TestSaveIDPAccountPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not enforced on windows")
+	}
+
+	account := &IDPAccount{
+		URL:      "https://id.whatever.com",
+		MFA:      "none",
+		Provider: "keycloak",
+		Profile:  "saml",
+	}
+
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+
+	cfgm, err := NewConfigManager(configFile)
+	require.Nil(t, err)
+
+	// new files are created readable by the owner only
+	require.Nil(t, cfgm.SaveIDPAccount("testing", account))
+	fi, err := os.Stat(configFile)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// existing files are restricted when saved
+	require.Nil(t, os.Chmod(configFile, 0644))
+	require.Nil(t, cfgm.SaveIDPAccount("testing", account))
+	fi, err = os.Stat(configFile)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// shared files keep their permissions
+	cfgm.AllowSharedConfig = true
+	require.Nil(t, os.Chmod(configFile, 0644))
+	require.Nil(t, cfgm.SaveIDPAccount("testing", account))
+	fi, err = os.Stat(configFile)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+}
+
+// fakeHome point the home directory at an empty temporary directory for the duration of the test
+func fakeHome(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv(ConfigFileEnvironmentVariableName, "")
+
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+
+	return home
+}
+
+func TestNewConfigManagerDefaultPath(t *testing.T) {
+	home := fakeHome(t)
+
+	legacyPath := filepath.Join(home, ".saml2aws")
+	xdgPath := filepath.Join(home, ".config", "saml2aws", "config")
+
+	// nothing exists yet so new files go to the XDG config directory
+	cfgm, err := NewConfigManager("")
+	require.Nil(t, err)
+	require.Equal(t, xdgPath, cfgm.configPath)
+
+	// an existing legacy file keeps being used
+	require.Nil(t, os.WriteFile(legacyPath, []byte("[default]\n"), 0600))
+	cfgm, err = NewConfigManager("")
+	require.Nil(t, err)
+	require.Equal(t, legacyPath, cfgm.configPath)
+
+	// the XDG config directory wins once it has a file
+	require.Nil(t, os.MkdirAll(filepath.Dir(xdgPath), 0700))
+	require.Nil(t, os.WriteFile(xdgPath, []byte("[default]\n"), 0600))
+	cfgm, err = NewConfigManager("")
+	require.Nil(t, err)
+	require.Equal(t, xdgPath, cfgm.configPath)
+
+	// XDG_CONFIG_HOME moves the XDG config directory
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "xdg"))
+	cfgm, err = NewConfigManager("")
+	require.Nil(t, err)
+	require.Equal(t, legacyPath, cfgm.configPath)
+
+	// the environment variable overrides everything
+	t.Setenv(ConfigFileEnvironmentVariableName, filepath.Join(home, "custom"))
+	cfgm, err = NewConfigManager("")
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(home, "custom"), cfgm.configPath)
+}
+
+func TestSaveIDPAccountCreatesXDGConfig(t *testing.T) {
+	home := fakeHome(t)
+
+	cfgm, err := NewConfigManager("")
+	require.Nil(t, err)
+
+	err = cfgm.SaveIDPAccount("testing", &IDPAccount{
+		URL:      "https://id.whatever.com",
+		MFA:      "none",
+		Provider: "keycloak",
+		Profile:  "saml",
+	})
+	require.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join(home, ".config", "saml2aws", "config"))
+	require.Nil(t, err)
+}
+
+func TestMigrateLegacyConfig(t *testing.T) {
+	home := fakeHome(t)
+
+	legacyPath := filepath.Join(home, ".saml2aws")
+	data, err := os.ReadFile("example/saml2aws.ini")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(legacyPath, data, 0600))
+
+	xdgPath, err := MigrateLegacyConfig()
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(home, ".config", "saml2aws", "config"), xdgPath)
+
+	migrated, err := os.ReadFile(xdgPath)
+	require.Nil(t, err)
+	require.Equal(t, data, migrated)
+
+	legacy, err := os.ReadFile(legacyPath)
+	require.Nil(t, err)
+	require.Contains(t, string(legacy), "migrated to "+xdgPath)
+
+	cfgm, err := NewConfigManager("")
+	require.Nil(t, err)
+	idpAccount, err := cfgm.LoadIDPAccount("test123")
+	require.Nil(t, err)
+	require.Equal(t, "https://id.whatever.com/#/hash", idpAccount.URL)
+
+	_, err = MigrateLegacyConfig()
+	require.NotNil(t, err)
+}
+
+func TestMigrateLegacyConfigEncrypted(t *testing.T) {
+	home := fakeHome(t)
+
+	legacyPath := filepath.Join(home, ".saml2aws")
+	data, err := os.ReadFile("example/saml2aws.ini")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(legacyPath, data, 0600))
+
+	cfgm, err := NewConfigManager(legacyPath)
+	require.Nil(t, err)
+	require.Nil(t, cfgm.EncryptConfigFile("correct horse"))
+
+	encrypted, err := os.ReadFile(legacyPath)
+	require.Nil(t, err)
+
+	xdgPath, err := MigrateLegacyConfig()
+	require.Nil(t, err)
+
+	// the header has to stay on the first line, so neither file gets the migration comment
+	migrated, err := os.ReadFile(xdgPath)
+	require.Nil(t, err)
+	require.Equal(t, encrypted, migrated)
+
+	legacy, err := os.ReadFile(legacyPath)
+	require.Nil(t, err)
+	require.Equal(t, encrypted, legacy)
+
+	t.Setenv(ConfigPassphraseEnvironmentVariableName, "correct horse")
+
+	cfgm, err = NewConfigManager("")
+	require.Nil(t, err)
+	idpAccount, err := cfgm.LoadIDPAccount("test123")
+	require.Nil(t, err)
+	require.Equal(t, "https://id.whatever.com/#/hash", idpAccount.URL)
 }
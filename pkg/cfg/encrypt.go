@@ -0,0 +1,222 @@
+package cfg
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/internal/filelock"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"golang.org/x/crypto/scrypt"
+	ini "gopkg.in/ini.v1"
+)
+
+const (
+	// ConfigPassphraseEnvironmentVariableName Environment Variable used to supply the passphrase of an encrypted configuration file
+	ConfigPassphraseEnvironmentVariableName = "SAML2AWS_CONFIG_PASSPHRASE"
+
+	// encryptedConfigHeader the first line of an encrypted configuration file, followed by the base64 encoded
+	// salt, nonce and AES-GCM sealed ini payload
+	encryptedConfigHeader = "# saml2aws-encrypted-config:v1\n"
+
+	configSaltSize = 16
+	configKeySize  = 32
+)
+
+var (
+	// ErrWrongPassphrase returned when an encrypted configuration file can't be decrypted with the passphrase
+	// given, callers can prompt for it again
+	ErrWrongPassphrase = errors.New("Unable to decrypt configuration file, wrong passphrase")
+
+	// ErrConfigEncrypted returned when encrypting a configuration file that already is
+	ErrConfigEncrypted = errors.New("Configuration file is already encrypted")
+
+	// ErrConfigNotEncrypted returned when decrypting a configuration file that isn't encrypted
+	ErrConfigNotEncrypted = errors.New("Configuration file is not encrypted")
+)
+
+func isEncryptedConfig(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedConfigHeader))
+}
+
+// loadConfigFile load the configuration file, decrypting it first if it is encrypted
+func (cm *ConfigManager) loadConfigFile(options ini.LoadOptions) (*ini.File, error) {
+
+	data, err := os.ReadFile(cm.configPath)
+	if os.IsNotExist(err) {
+		// leave a missing file to the ini options, Loose treats it as empty
+		return ini.LoadSources(options, cm.configPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if isEncryptedConfig(data) {
+		cm.encrypted = true
+		data, err = cm.decryptConfig(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ini.LoadSources(options, data)
+}
+
+// configPassphrase the passphrase of the encrypted configuration file, taken from the environment or
+// prompted for the first time it is needed
+func (cm *ConfigManager) configPassphrase() (string, error) {
+
+	if cm.Passphrase == "" {
+		cm.Passphrase = os.Getenv(ConfigPassphraseEnvironmentVariableName)
+	}
+	if cm.Passphrase == "" {
+		cm.Passphrase = prompter.Password("Configuration passphrase")
+	}
+	if cm.Passphrase == "" {
+		return "", errors.New("Passphrase required for the encrypted configuration file")
+	}
+
+	return cm.Passphrase, nil
+}
+
+func configKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, configKeySize)
+}
+
+func newConfigGCM(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := configKey(passphrase, salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to derive configuration key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptConfig seals the ini payload with a key derived from the passphrase and a fresh salt
+func (cm *ConfigManager) encryptConfig(plaintext []byte) ([]byte, error) {
+
+	passphrase, err := cm.configPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, configSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "Unable to generate salt")
+	}
+
+	gcm, err := newConfigGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "Unable to generate nonce")
+	}
+
+	sealed := append(salt, gcm.Seal(nonce, nonce, plaintext, nil)...)
+
+	return []byte(encryptedConfigHeader + b64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// decryptConfig opens an encrypted configuration file, a passphrase that fails to is forgotten so asking
+// again prompts for a new one
+func (cm *ConfigManager) decryptConfig(data []byte) ([]byte, error) {
+
+	sealed, err := b64.StdEncoding.DecodeString(string(bytes.TrimSpace(data[len(encryptedConfigHeader):])))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to decode encrypted configuration file")
+	}
+
+	passphrase, err := cm.configPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < configSaltSize {
+		return nil, errors.New("Encrypted configuration file is truncated")
+	}
+
+	gcm, err := newConfigGCM(passphrase, sealed[:configSaltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	sealed = sealed[configSaltSize:]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("Encrypted configuration file is truncated")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		cm.Passphrase = ""
+		return nil, ErrWrongPassphrase
+	}
+
+	return plaintext, nil
+}
+
+// EncryptConfigFile encrypt the configuration file in place with the passphrase
+func (cm *ConfigManager) EncryptConfigFile(passphrase string) error {
+
+	unlock, err := filelock.Lock(cm.configPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true})
+	if err != nil {
+		return errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	if cm.encrypted {
+		return ErrConfigEncrypted
+	}
+
+	cm.encrypted = true
+	cm.Passphrase = passphrase
+
+	err = cm.saveConfigFile(cfg, cm.configPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to save configuration file")
+	}
+	return nil
+}
+
+// DecryptConfigFile replace the encrypted configuration file with its plaintext
+func (cm *ConfigManager) DecryptConfigFile() error {
+
+	unlock, err := filelock.Lock(cm.configPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := cm.loadConfigFile(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true})
+	if err != nil {
+		return errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	if !cm.encrypted {
+		return ErrConfigNotEncrypted
+	}
+
+	cm.encrypted = false
+
+	err = cm.saveConfigFile(cfg, cm.configPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to save configuration file")
+	}
+	return nil
+}
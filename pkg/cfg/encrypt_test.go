@@ -0,0 +1,81 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptConfigFile(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	data, err := os.ReadFile("example/saml2aws.ini")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(configFile, data, 0600))
+
+	cfgm, err := NewConfigManager(configFile)
+	require.Nil(t, err)
+	require.False(t, cfgm.Encrypted())
+
+	require.Nil(t, cfgm.EncryptConfigFile("correct horse"))
+	require.Equal(t, ErrConfigEncrypted, cfgm.EncryptConfigFile("correct horse"))
+
+	encrypted, err := os.ReadFile(configFile)
+	require.Nil(t, err)
+	require.True(t, isEncryptedConfig(encrypted))
+	require.NotContains(t, string(encrypted), "id.whatever.com")
+
+	t.Setenv(ConfigPassphraseEnvironmentVariableName, "correct horse")
+
+	cfgm, err = NewConfigManager(configFile)
+	require.Nil(t, err)
+	require.True(t, cfgm.Encrypted())
+
+	idpAccount, err := cfgm.LoadIDPAccount("test123")
+	require.Nil(t, err)
+	require.Equal(t, "https://id.whatever.com/#/hash", idpAccount.URL)
+
+	// saving keeps the file encrypted
+	idpAccount.Username = "changed@whatever.com"
+	require.Nil(t, cfgm.SaveIDPAccount("test123", idpAccount))
+	encrypted, err = os.ReadFile(configFile)
+	require.Nil(t, err)
+	require.True(t, isEncryptedConfig(encrypted))
+	require.NotContains(t, string(encrypted), "changed@whatever.com")
+
+	require.Nil(t, cfgm.DecryptConfigFile())
+	require.Equal(t, ErrConfigNotEncrypted, cfgm.DecryptConfigFile())
+
+	cfgm, err = NewConfigManager(configFile)
+	require.Nil(t, err)
+	require.False(t, cfgm.Encrypted())
+
+	idpAccount, err = cfgm.LoadIDPAccount("test123")
+	require.Nil(t, err)
+	require.Equal(t, "changed@whatever.com", idpAccount.Username)
+}
+
+func TestLoadEncryptedConfigWrongPassphrase(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "saml2aws")
+	data, err := os.ReadFile("example/saml2aws.ini")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(configFile, data, 0600))
+
+	cfgm, err := NewConfigManager(configFile)
+	require.Nil(t, err)
+	require.Nil(t, cfgm.EncryptConfigFile("correct horse"))
+
+	cfgm, err = NewConfigManager(configFile)
+	require.Nil(t, err)
+	cfgm.Passphrase = "battery staple"
+
+	_, err = cfgm.LoadIDPAccount("test123")
+	require.True(t, errors.Is(err, ErrWrongPassphrase), err)
+	require.Empty(t, cfgm.Passphrase)
+
+	cfgm.Passphrase = "correct horse"
+	_, err = cfgm.LoadIDPAccount("test123")
+	require.Nil(t, err)
+}
@@ -0,0 +1,126 @@
+package cfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	ini "gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// AccountDocument the portable form of idp accounts used to share them, keyed by account name with each
+// account's settings keyed by the names used in the configuration file
+type AccountDocument struct {
+	Accounts map[string]map[string]interface{} `json:"accounts" yaml:"accounts"`
+}
+
+// MarshalAccounts serialise the accounts as a json or yaml AccountDocument, leaving out unset values
+func MarshalAccounts(accounts map[string]*IDPAccount, format string) ([]byte, error) {
+
+	doc := AccountDocument{Accounts: map[string]map[string]interface{}{}}
+
+	for name, account := range accounts {
+		settings := map[string]interface{}{}
+
+		v := reflect.ValueOf(account).Elem()
+		for i, key := range accountKeys() {
+			if key == "" || v.Field(i).IsZero() {
+				continue
+			}
+			settings[key] = v.Field(i).Interface()
+		}
+
+		doc.Accounts[name] = settings
+	}
+
+	switch format {
+	case "json":
+		return json.MarshalIndent(doc, "", "  ")
+	case "yaml":
+		return yaml.Marshal(doc)
+	}
+
+	return nil, errors.Errorf("Unsupported format: %s", format)
+}
+
+// UnmarshalAccounts parse a json or yaml AccountDocument, rejecting settings that are not idp account fields
+func UnmarshalAccounts(data []byte) (map[string]*IDPAccount, error) {
+
+	// yaml is a superset of json so one decoder handles both
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	var doc AccountDocument
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse accounts document")
+	}
+
+	known := map[string]bool{}
+	for _, key := range accountKeys() {
+		if key != "" {
+			known[key] = true
+		}
+	}
+
+	accounts := map[string]*IDPAccount{}
+
+	for name, settings := range doc.Accounts {
+		if name == "" || reservedSection(name) {
+			return nil, errors.Errorf("Invalid idp account name: %q", name)
+		}
+
+		sec, err := ini.Empty().NewSection(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read idp account %s", name)
+		}
+
+		keys := make([]string, 0, len(settings))
+		for key := range settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if !known[key] {
+				return nil, errors.Errorf("Unknown field %q in idp account %s", key, name)
+			}
+			if _, err := sec.NewKey(key, fmt.Sprint(settings[key])); err != nil {
+				return nil, errors.Wrapf(err, "Unable to read %s in idp account %s", key, name)
+			}
+		}
+
+		account := NewIDPAccount()
+		err = sec.StrictMapTo(account)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read idp account %s", name)
+		}
+		account.Name = name
+
+		accounts[name] = account
+	}
+
+	return accounts, nil
+}
+
+// accountKeys the configuration file name of each IDPAccount field by field index, empty for the
+// account name which is the document key rather than a setting
+func accountKeys() []string {
+
+	t := reflect.TypeOf(IDPAccount{})
+
+	keys := make([]string, t.NumField())
+	for i := range keys {
+		key := strings.Split(t.Field(i).Tag.Get("ini"), ",")[0]
+		if key != "name" {
+			keys[i] = key
+		}
+	}
+
+	return keys
+}
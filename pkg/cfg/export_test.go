@@ -0,0 +1,63 @@
+package cfg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalAccountsRoundTrip(t *testing.T) {
+
+	cfgm, err := NewConfigManager("example/saml2aws.ini")
+	require.Nil(t, err)
+
+	accounts, err := cfgm.ListIDPAccounts()
+	require.Nil(t, err)
+
+	for _, format := range []string{"yaml", "json"} {
+		data, err := MarshalAccounts(accounts, format)
+		require.Nil(t, err)
+		require.Contains(t, string(data), "https://id.whatever.com/#/hash")
+		require.NotContains(t, string(data), "skip_verify", "unset values are left out")
+
+		imported, err := UnmarshalAccounts(data)
+		require.Nil(t, err, format)
+		require.Equal(t, accounts, imported, format)
+	}
+
+	_, err = MarshalAccounts(accounts, "toml")
+	require.Error(t, err)
+}
+
+func TestUnmarshalAccounts(t *testing.T) {
+
+	accounts, err := UnmarshalAccounts([]byte(`
+accounts:
+  dev:
+    url: https://id.whatever.com
+    provider: Okta
+    mfa: PUSH
+    aws_session_duration: 7200
+    skip_verify: true
+  test:
+    url: https://id.whatever.com
+    provider: KeyCloak
+    mfa: totp
+`))
+	require.Nil(t, err)
+	require.Len(t, accounts, 2)
+	require.Equal(t, "dev", accounts["dev"].Name)
+	require.Equal(t, 7200, accounts["dev"].SessionDuration)
+	require.True(t, accounts["dev"].SkipVerify)
+	require.Equal(t, DefaultSessionDuration, accounts["test"].SessionDuration)
+	require.Equal(t, DefaultProfile, accounts["test"].Profile)
+
+	_, err = UnmarshalAccounts([]byte("accounts:\n  dev:\n    url: https://id.whatever.com\n    pasword: secret\n"))
+	require.EqualError(t, err, `Unknown field "pasword" in idp account dev`)
+
+	_, err = UnmarshalAccounts([]byte("acounts:\n  dev:\n    url: https://id.whatever.com\n"))
+	require.Error(t, err)
+
+	_, err = UnmarshalAccounts([]byte("accounts:\n  dev:\n    timeout: soon\n"))
+	require.Error(t, err)
+}
@@ -0,0 +1,150 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/internal/filelock"
+	ini "gopkg.in/ini.v1"
+)
+
+const (
+	credentialExpirySection = "credential_expiry"
+	lastRoleSection         = "last_role"
+)
+
+// statePath the file alongside the configuration holding state saml2aws updates on every login, kept
+// separate so logging in doesn't rewrite the configuration
+func (cm *ConfigManager) statePath() string {
+	return cm.configPath + ".state"
+}
+
+// SaveCredentialExpiry record when the credentials last issued for the aws profile of the credentials file expire
+func (cm *ConfigManager) SaveCredentialExpiry(credentialsFile, profile string, expires time.Time) error {
+	return cm.saveState(credentialExpirySection, credentialExpiryKey(credentialsFile, profile), expires.UTC().Format(time.RFC3339))
+}
+
+// LoadCredentialExpiry load when the credentials last issued for the aws profile of the credentials file expire,
+// returning the zero time if nothing has been recorded
+func (cm *ConfigManager) LoadCredentialExpiry(credentialsFile, profile string) (time.Time, error) {
+	value, err := cm.loadState(credentialExpirySection, credentialExpiryKey(credentialsFile, profile))
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "Unable to parse credential expiry for profile %s", profile)
+	}
+
+	return expires, nil
+}
+
+// credentialExpiryKey the key of the expiry, a profile of the same name in another credentials file being
+// another profile
+func credentialExpiryKey(credentialsFile, profile string) string {
+	return credentialsFile + "|" + profile
+}
+
+// SaveLastRole record the role last picked from the menu for the idp account
+func (cm *ConfigManager) SaveLastRole(idpAccountName, roleARN string) error {
+	return cm.saveState(lastRoleSection, idpAccountName, roleARN)
+}
+
+// LoadLastRole load the role last picked from the menu for the idp account, empty if none has been recorded
+func (cm *ConfigManager) LoadLastRole(idpAccountName string) (string, error) {
+	return cm.loadState(lastRoleSection, idpAccountName)
+}
+
+// DeleteLastRole forget the role remembered for a deleted idp account
+func (cm *ConfigManager) DeleteLastRole(idpAccountName string) error {
+	return cm.updateExistingState(func(state *ini.File) {
+		if sec, err := state.GetSection(lastRoleSection); err == nil {
+			sec.DeleteKey(idpAccountName)
+		}
+	})
+}
+
+// RenameLastRole move the role remembered for a renamed idp account to its new name
+func (cm *ConfigManager) RenameLastRole(oldName, newName string) error {
+	return cm.updateExistingState(func(state *ini.File) {
+		sec, err := state.GetSection(lastRoleSection)
+		if err != nil || !sec.HasKey(oldName) {
+			return
+		}
+		sec.Key(newName).SetValue(sec.Key(oldName).String())
+		sec.DeleteKey(oldName)
+	})
+}
+
+func (cm *ConfigManager) saveState(section, key, value string) error {
+
+	statePath := cm.statePath()
+
+	err := os.MkdirAll(filepath.Dir(statePath), 0700)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create configuration directory")
+	}
+
+	return cm.updateState(func(state *ini.File) {
+		state.Section(section).Key(key).SetValue(value)
+	})
+}
+
+// updateExistingState update the state file if there is one, there being nothing to change otherwise
+func (cm *ConfigManager) updateExistingState(update func(state *ini.File)) error {
+	if _, err := os.Stat(cm.statePath()); os.IsNotExist(err) {
+		return nil
+	}
+
+	return cm.updateState(update)
+}
+
+func (cm *ConfigManager) updateState(update func(state *ini.File)) error {
+
+	statePath := cm.statePath()
+
+	unlock, err := filelock.Lock(statePath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := ini.LoadSources(ini.LoadOptions{Loose: true}, statePath)
+	if err != nil {
+		return errors.Wrap(err, "Unable to load state file")
+	}
+
+	update(state)
+
+	err = cm.saveConfigFile(state, statePath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to save state file")
+	}
+	return nil
+}
+
+func (cm *ConfigManager) loadState(section, key string) (string, error) {
+
+	statePath := cm.statePath()
+
+	unlock, err := filelock.Lock(statePath, false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	state, err := ini.LoadSources(ini.LoadOptions{Loose: true}, statePath)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to load state file")
+	}
+
+	sec, err := state.GetSection(section)
+	if err != nil || !sec.HasKey(key) {
+		return "", nil
+	}
+
+	return sec.Key(key).String(), nil
+}
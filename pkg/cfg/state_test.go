@@ -0,0 +1,100 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialExpiry(t *testing.T) {
+
+	cfgm, err := NewConfigManager(filepath.Join(t.TempDir(), "saml2aws"))
+	require.Nil(t, err)
+
+	expires, err := cfgm.LoadCredentialExpiry("/home/user/.aws/credentials", "saml")
+	require.Nil(t, err)
+	require.True(t, expires.IsZero())
+
+	now := time.Now().Truncate(time.Second)
+	require.Nil(t, cfgm.SaveCredentialExpiry("/home/user/.aws/credentials", "saml", now.Add(time.Hour)))
+	require.Nil(t, cfgm.SaveCredentialExpiry("/home/user/.aws/credentials", "other", now.Add(2*time.Hour)))
+
+	expires, err = cfgm.LoadCredentialExpiry("/home/user/.aws/credentials", "saml")
+	require.Nil(t, err)
+	require.True(t, now.Add(time.Hour).Equal(expires))
+
+	expires, err = cfgm.LoadCredentialExpiry("/home/user/.aws/credentials", "other")
+	require.Nil(t, err)
+	require.True(t, now.Add(2*time.Hour).Equal(expires))
+
+	// the same profile in another credentials file has nothing recorded
+	expires, err = cfgm.LoadCredentialExpiry(`C:\Users\user\.aws\credentials`, "saml")
+	require.Nil(t, err)
+	require.True(t, expires.IsZero())
+
+	// the state file is separate from the configuration
+	names, err := cfgm.ListIDPAccountNames(false)
+	require.Nil(t, err)
+	require.Empty(t, names)
+}
+
+func TestLastRole(t *testing.T) {
+
+	cfgm, err := NewConfigManager(filepath.Join(t.TempDir(), "saml2aws"))
+	require.Nil(t, err)
+
+	roleARN, err := cfgm.LoadLastRole("work")
+	require.Nil(t, err)
+	require.Empty(t, roleARN)
+
+	require.Nil(t, cfgm.SaveCredentialExpiry("/home/user/.aws/credentials", "work", time.Now()))
+	require.Nil(t, cfgm.SaveLastRole("work", "arn:aws:iam::123456789012:role/admin"))
+	require.Nil(t, cfgm.SaveLastRole("home", "arn:aws:iam::210987654321:role/readonly"))
+
+	roleARN, err = cfgm.LoadLastRole("work")
+	require.Nil(t, err)
+	require.Equal(t, "arn:aws:iam::123456789012:role/admin", roleARN)
+
+	roleARN, err = cfgm.LoadLastRole("home")
+	require.Nil(t, err)
+	require.Equal(t, "arn:aws:iam::210987654321:role/readonly", roleARN)
+}
+
+func TestDeleteAndRenameLastRole(t *testing.T) {
+
+	configPath := filepath.Join(t.TempDir(), "saml2aws")
+	cfgm, err := NewConfigManager(configPath)
+	require.Nil(t, err)
+
+	// without a state file there is nothing to do, and none is created
+	require.Nil(t, cfgm.DeleteLastRole("work"))
+	require.Nil(t, cfgm.RenameLastRole("work", "office"))
+	_, err = os.Stat(configPath + ".state")
+	require.True(t, os.IsNotExist(err))
+
+	require.Nil(t, cfgm.SaveLastRole("work", "arn:aws:iam::123456789012:role/admin"))
+	require.Nil(t, cfgm.SaveLastRole("home", "arn:aws:iam::210987654321:role/readonly"))
+
+	require.Nil(t, cfgm.RenameLastRole("work", "office"))
+
+	roleARN, err := cfgm.LoadLastRole("work")
+	require.Nil(t, err)
+	require.Empty(t, roleARN)
+
+	roleARN, err = cfgm.LoadLastRole("office")
+	require.Nil(t, err)
+	require.Equal(t, "arn:aws:iam::123456789012:role/admin", roleARN)
+
+	require.Nil(t, cfgm.DeleteLastRole("home"))
+
+	roleARN, err = cfgm.LoadLastRole("home")
+	require.Nil(t, err)
+	require.Empty(t, roleARN)
+
+	roleARN, err = cfgm.LoadLastRole("office")
+	require.Nil(t, err)
+	require.Equal(t, "arn:aws:iam::123456789012:role/admin", roleARN)
+}
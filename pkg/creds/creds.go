@@ -1,5 +1,7 @@
 package creds
 
+import "github.com/versent/saml2aws/v2/pkg/prompter"
+
 // LoginDetails used to authenticate
 type LoginDetails struct {
 	ClientID          string // used by OneLogin
@@ -13,4 +15,11 @@ type LoginDetails struct {
 	URL               string
 	StateToken        string // used by Okta
 	OktaSessionCookie string // used by Okta
+	// Prompter asks the user for MFA codes and choices during the login, the active prompter when nil
+	Prompter prompter.Prompter
+}
+
+// Asker asks the user through the prompter of the login
+func (ld *LoginDetails) Asker() prompter.Asker {
+	return prompter.Asker{Prompter: ld.Prompter}
 }
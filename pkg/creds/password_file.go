@@ -0,0 +1,43 @@
+package creds
+
+import (
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.WithField("pkg", "creds")
+
+// ReadPasswordFile reads the IdP password from a file, dropping the trailing newline most editors add.
+// A file other users can read is used but warned about.
+func ReadPasswordFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read password file")
+	}
+	if info.IsDir() {
+		return "", errors.Errorf("password file %s is a directory", path)
+	}
+
+	// permission bits don't describe who can read a file on windows
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		logger.Warnf("password file %s is readable by other users (mode %04o), restrict it with: chmod 600 %s", path, info.Mode().Perm(), path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read password file")
+	}
+
+	password := strings.TrimSuffix(string(data), "\n")
+	password = strings.TrimSuffix(password, "\r")
+
+	if password == "" {
+		return "", errors.Errorf("password file %s is empty", path)
+	}
+
+	return password, nil
+}
@@ -0,0 +1,50 @@
+package creds
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPasswordFile(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := map[string]string{
+		"plain":    "s3cret",
+		"newline":  "s3cret\n",
+		"crlf":     "s3cret\r\n",
+		"trailing": "s3cret \n\n",
+	}
+	expected := map[string]string{
+		"plain":    "s3cret",
+		"newline":  "s3cret",
+		"crlf":     "s3cret",
+		"trailing": "s3cret \n",
+	}
+
+	for name, content := range cases {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+
+		password, err := ReadPasswordFile(path)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected[name], password, name)
+	}
+}
+
+func TestReadPasswordFileErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := ReadPasswordFile(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+
+	_, err = ReadPasswordFile(dir)
+	assert.EqualError(t, err, "password file "+dir+" is a directory")
+
+	empty := filepath.Join(dir, "empty")
+	assert.Nil(t, os.WriteFile(empty, []byte("\n"), 0600))
+	_, err = ReadPasswordFile(empty)
+	assert.EqualError(t, err, "password file "+empty+" is empty")
+}
@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+
+	"github.com/versent/saml2aws/v2/pkg/logging"
 )
 
 // RequestString helper method to dump the http request
@@ -28,7 +30,7 @@ func ResponseString(res *http.Response) string {
 	return string(data)
 }
 
-// ContentEnable enable dumping of request / response content
+// ContentEnable enable dumping of request / response content, never with JSON logs as the content can't be redacted
 func ContentEnable() bool {
-	return os.Getenv("DUMP_CONTENT") == "true"
+	return os.Getenv("DUMP_CONTENT") == "true" && !logging.JSON()
 }
@@ -0,0 +1,277 @@
+// Package duo answers the Duo prompt providers are sent to for MFA, both the traditional iframe and the
+// Universal Prompt that replaced it
+package duo
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+// The factors Duo offers, as the prompt names them
+const (
+	FactorPush     = "Duo Push"
+	FactorCall     = "Phone Call"
+	FactorPasscode = "Passcode"
+)
+
+var logger = logrus.WithField("pkg", "duo")
+
+// StatusPollInterval the wait between checks for a push or phone call to be answered
+var StatusPollInterval = 2 * time.Second
+
+// factorsByMFA the factor for each of the mfa settings that name one
+var factorsByMFA = map[string]string{
+	"PUSH":     FactorPush,
+	"CALL":     FactorCall,
+	"PASSCODE": FactorPasscode,
+}
+
+// FactorForMFA the factor an mfa setting of PUSH, CALL or PASSCODE names, empty for any other setting
+func FactorForMFA(mfa string) string {
+	return factorsByMFA[strings.ToUpper(mfa)]
+}
+
+// EnrollmentRequiredError returned when Duo wants the user to enroll a device before they can log in
+type EnrollmentRequiredError struct {
+	URL string
+}
+
+func (e *EnrollmentRequiredError) Error() string {
+	return fmt.Sprintf("Duo account requires enrollment, finish enrolling at %s", e.URL)
+}
+
+// Options pick the device and factor, and give the passcode, without asking the user
+type Options struct {
+	// Device the name or key of the device to authenticate with, from duo_device
+	Device string
+	// Factor one of FactorPush, FactorCall or FactorPasscode, from the mfa setting or --duo-mfa-option
+	Factor string
+	// Passcode the code used when the factor is FactorPasscode, from --mfa-token
+	Passcode string
+	// Prompter asks the user what the options don't answer, the active prompter when nil
+	Prompter prompter.Prompter
+}
+
+// Client answers a Duo prompt with the HTTP client of the provider that was sent to it, so the cookies set on
+// the way are kept
+type Client struct {
+	client *provider.HTTPClient
+	opts   Options
+}
+
+// New create a Duo client sharing the HTTP client of a provider
+func New(client *provider.HTTPClient, opts Options) *Client {
+	return &Client{
+		client: client,
+		opts:   opts,
+	}
+}
+
+// device a phone or token the user has enrolled, along with the factors it offers
+type device struct {
+	Key     string
+	Name    string
+	Factors []string
+}
+
+// selectDevice picks the configured device, by name, key or its number in the order Duo lists them, the only
+// device offering the configured factor, or asks the user to choose between those that offer it
+func selectDevice(ask prompter.Asker, devices []device, configured, factor string) (device, error) {
+	if configured != "" {
+		names := make([]string, len(devices))
+		for i, d := range devices {
+			if strings.EqualFold(d.Name, configured) || d.Key == configured {
+				return d, nil
+			}
+			names[i] = d.Name
+		}
+		// a device named after a number is matched by name first
+		if n, err := strconv.Atoi(configured); err == nil && n >= 1 && n <= len(devices) {
+			return devices[n-1], nil
+		}
+		return device{}, errors.Errorf("duo_device %q is not one of the Duo devices: %s", configured, strings.Join(names, ", "))
+	}
+
+	candidates := devices
+	if factor != "" {
+		var offering []device
+		for _, d := range devices {
+			for _, f := range d.Factors {
+				if f == factor {
+					offering = append(offering, d)
+					break
+				}
+			}
+		}
+		if len(offering) > 0 {
+			candidates = offering
+		}
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	names := make([]string, len(candidates))
+	for i, d := range candidates {
+		names[i] = d.Name
+	}
+	return candidates[ask.Choose("Select a Duo device", names)], nil
+}
+
+// selectFactor picks the configured factor, the only factor of the device, or asks the user
+func selectFactor(ask prompter.Asker, devices []device, d device, configured string) (string, error) {
+	if configured != "" {
+		for _, f := range d.Factors {
+			if f == configured {
+				return f, nil
+			}
+		}
+		// a passcode can be typed whichever device was picked
+		if configured == FactorPasscode {
+			for _, other := range devices {
+				for _, f := range other.Factors {
+					if f == FactorPasscode {
+						return f, nil
+					}
+				}
+			}
+		}
+		return "", errors.Errorf("Duo device %s doesn't offer %s, it offers: %s", d.Name, configured, strings.Join(d.Factors, ", "))
+	}
+
+	if len(d.Factors) == 1 {
+		return d.Factors[0], nil
+	}
+	return d.Factors[ask.Choose("Select a Duo factor", d.Factors)], nil
+}
+
+// asker asks the user through the prompter of the options
+func (c *Client) asker() prompter.Asker {
+	return prompter.Asker{Prompter: c.opts.Prompter}
+}
+
+// passcode the configured passcode, used once, or the one the user types
+func (c *Client) passcode() string {
+	passcode := c.opts.Passcode
+	c.opts.Passcode = ""
+	if passcode == "" {
+		passcode = c.asker().RequestSecurityCode("000000")
+	}
+	return passcode
+}
+
+// waitForResult polls the transaction until the user answers, printing the code to type into Duo Mobile when
+// the push asks for one, and returns the last status. The traditional prompt may hand out a new sid while
+// polling, which replaces the one in the form.
+func (c *Client) waitForResult(statusURL string, form url.Values, factor string, d device) (string, error) {
+	switch factor {
+	case FactorPush:
+		log.Printf("Sent a Duo Push to %s, approve it in Duo Mobile ...", d.Name)
+	case FactorCall:
+		log.Printf("Calling %s, answer and follow the instructions ...", d.Name)
+	}
+
+	verificationCode := ""
+	for {
+		status, err := c.postForm(statusURL, form)
+		if err != nil {
+			return "", errors.Wrap(err, "error polling Duo status")
+		}
+		if err := checkStat(status, statusURL); err != nil {
+			return "", err
+		}
+
+		if sid := gjson.Get(status, "response.sid").String(); sid != "" {
+			form.Set("sid", sid)
+		}
+
+		if code := gjson.Get(status, "response.verification_code").String(); code != "" && code != verificationCode {
+			verificationCode = code
+			log.Printf("Enter %s in Duo Mobile to verify the push ...", code)
+		}
+
+		switch gjson.Get(status, "response.result").String() {
+		case "SUCCESS":
+			return status, nil
+		case "FAILURE":
+			reason := gjson.Get(status, "response.reason").String()
+			if reason == "" {
+				reason = gjson.Get(status, "response.status").String()
+			}
+			if reason == "" {
+				reason = gjson.Get(status, "response.status_code").String()
+			}
+			return "", errors.Errorf("%s was not approved: %s", factor, reason)
+		}
+
+		logger.WithField("status", gjson.Get(status, "response.status_code").String()).Debug("waiting for Duo")
+		time.Sleep(StatusPollInterval)
+	}
+}
+
+func (c *Client) getJSON(u string) (string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	return c.doJSON(req)
+}
+
+func (c *Client) postForm(u string, form url.Values) (string, error) {
+	req, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.doJSON(req)
+}
+
+func (c *Client) doJSON(req *http.Request) (string, error) {
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// checkStat turns a failed Duo response into an error, an enrollment one when that is the reason
+func checkStat(resp string, pageURL string) error {
+	if gjson.Get(resp, "stat").String() == "OK" {
+		return nil
+	}
+
+	message := gjson.Get(resp, "message").String()
+	if strings.Contains(strings.ToLower(message), "enroll") || gjson.Get(resp, "code").String() == "enrollment_required" {
+		return &EnrollmentRequiredError{URL: pageURL}
+	}
+	return errors.Errorf("Duo request failed: %s", message)
+}
+
+// resolveURL resolves a link or form action against the page it came from
+func resolveURL(base *url.URL, ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
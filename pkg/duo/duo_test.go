@@ -0,0 +1,283 @@
+package duo
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+// duoServer serves the traditional and Universal Prompt endpoints of Duo from the example directory
+type duoServer struct {
+	*httptest.Server
+
+	authPage string
+	statuses []string
+	forms    map[string]url.Values
+}
+
+func newDuoServer(t *testing.T, statuses ...string) *duoServer {
+	ds := &duoServer{authPage: "example/frame_auth.html", statuses: statuses, forms: map[string]url.Values{}}
+
+	serve := func(file string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			require.Nil(t, r.ParseForm())
+			ds.forms[r.URL.Path] = r.Form
+			http.ServeFile(w, r, file)
+		}
+	}
+	status := func(w http.ResponseWriter, r *http.Request) {
+		file := ds.statuses[0]
+		if len(ds.statuses) > 1 {
+			ds.statuses = ds.statuses[1:]
+		}
+		serve(file)(w, r)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/frame/web/v1/auth", func(w http.ResponseWriter, r *http.Request) {
+		serve(ds.authPage)(w, r)
+	})
+	mux.Handle("/frame/prompt", serve("example/prompt.json"))
+	mux.HandleFunc("/frame/status", status)
+	mux.Handle("/frame/status/txid-example", serve("example/frame_result.json"))
+	mux.HandleFunc("/frame/frameless/v4/auth", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			serve("example/plugin_form.html")(w, r)
+			return
+		}
+		require.Nil(t, r.ParseForm())
+		ds.forms[r.URL.Path] = r.Form
+		http.Redirect(w, r, "/frame/v4/auth/prompt?sid=frameless-example-sid", http.StatusFound)
+	})
+	mux.Handle("/frame/v4/auth/prompt", serve("example/universal_prompt.html"))
+	mux.Handle("/frame/v4/auth/prompt/data", serve("example/prompt_data.json"))
+	mux.Handle("/frame/v4/prompt", serve("example/prompt.json"))
+	mux.HandleFunc("/frame/v4/status", status)
+	mux.HandleFunc("/frame/v4/oidc/exit", func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		ds.forms[r.URL.Path] = r.Form
+		http.Redirect(w, r, "https://idp.example.com/duo/callback?duo_code=code-example&state=state-example", http.StatusFound)
+	})
+
+	ds.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(ds.Close)
+	return ds
+}
+
+func (ds *duoServer) frame() *Frame {
+	return &Frame{Host: ds.Listener.Addr().String(), SigRequest: "TX|tx-example:APP|app-example"}
+}
+
+func newTestClient(t *testing.T, opts Options) *Client {
+	StatusPollInterval = 0
+
+	httpOpts, err := provider.BuildHttpClientOpts(&cfg.IDPAccount{})
+	require.Nil(t, err)
+	client, err := provider.NewHTTPClient(provider.NewDefaultTransport(true), httpOpts)
+	require.Nil(t, err)
+	return New(client, opts)
+}
+
+func loadDocument(t *testing.T, file string) *goquery.Document {
+	data, err := os.ReadFile(file)
+	require.Nil(t, err)
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+	return doc
+}
+
+func TestFrameFromDocument(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewBufferString(`<form id="duo_form" method="post">
+		<iframe id="duo_iframe" data-host="api-example.duosecurity.com" data-sig-request="TX|tx:APP|app" data-post-action="/idp/profile/duo"></iframe>
+	</form>`))
+	require.Nil(t, err)
+
+	frame, ok := FrameFromDocument(doc)
+	require.True(t, ok)
+	require.Equal(t, &Frame{Host: "api-example.duosecurity.com", SigRequest: "TX|tx:APP|app", PostAction: "/idp/profile/duo", PostArgument: "sig_response"}, frame)
+
+	_, ok = FrameFromDocument(loadDocument(t, "example/universal_prompt.html"))
+	require.False(t, ok)
+}
+
+func TestIsUniversalPrompt(t *testing.T) {
+	doc := loadDocument(t, "example/universal_prompt.html")
+	doc.Url, _ = url.Parse("https://api-example.duosecurity.com/frame/v4/auth/prompt?sid=frameless-example-sid")
+	require.True(t, IsUniversalPrompt(doc))
+
+	doc = loadDocument(t, "example/plugin_form.html")
+	doc.Url, _ = url.Parse("https://api-example.duosecurity.com/frame/frameless/v4/auth?sid=frameless-example-sid&tx=tx-example")
+	require.True(t, IsUniversalPrompt(doc))
+
+	doc.Url, _ = url.Parse("https://idp.example.com/idp/profile/SAML2/Unsolicited/SSO")
+	require.False(t, IsUniversalPrompt(doc))
+}
+
+func TestVerifyFramePush(t *testing.T) {
+	ds := newDuoServer(t, "example/frame_status_pushed.json", "example/frame_status_allow.json")
+	client := newTestClient(t, Options{Device: "phone2", Factor: FactorPush})
+
+	sigResponse, err := client.VerifyFrame(ds.frame(), "https://idp.example.com/login")
+	require.Nil(t, err)
+	require.Equal(t, "AUTH|frame-cookie:APP|app-example", sigResponse)
+
+	require.Equal(t, "TX|tx-example", ds.forms["/frame/web/v1/auth"].Get("tx"))
+	require.Equal(t, "https://idp.example.com/login", ds.forms["/frame/web/v1/auth"].Get("parent"))
+	require.Equal(t, "phone2", ds.forms["/frame/prompt"].Get("device"))
+	require.Equal(t, "Duo Push", ds.forms["/frame/prompt"].Get("factor"))
+	require.Equal(t, "txid-example", ds.forms["/frame/status"].Get("txid"))
+	// the sid handed out while polling is the one the result is fetched with
+	require.Equal(t, "frame-sid-2", ds.forms["/frame/status/txid-example"].Get("sid"))
+}
+
+func TestVerifyFramePromptsForDeviceFactorAndPasscode(t *testing.T) {
+	ds := newDuoServer(t, "example/frame_status_allow.json")
+	client := newTestClient(t, Options{})
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Choose", "Select a Duo device", []string{"iOS (XXX-XXX-1234)", "Landline (XXX-XXX-5678)"}).Return(0)
+	pr.Mock.On("Choose", "Select a Duo factor", []string{"Duo Push", "Phone Call", "Passcode"}).Return(2)
+	pr.Mock.On("RequestSecurityCode", "000000").Return("123456")
+
+	_, err := client.VerifyFrame(ds.frame(), "https://idp.example.com/login")
+	require.Nil(t, err)
+	require.Equal(t, "phone1", ds.forms["/frame/prompt"].Get("device"))
+	require.Equal(t, "Passcode", ds.forms["/frame/prompt"].Get("factor"))
+	require.Equal(t, "123456", ds.forms["/frame/prompt"].Get("passcode"))
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestVerifyFrameBypass(t *testing.T) {
+	ds := newDuoServer(t)
+	ds.authPage = "example/frame_bypass.html"
+	client := newTestClient(t, Options{})
+
+	sigResponse, err := client.VerifyFrame(ds.frame(), "https://idp.example.com/login")
+	require.Nil(t, err)
+	require.Equal(t, "AUTH|bypass-cookie:APP|app-example", sigResponse)
+}
+
+func TestVerifyFrameSigRequestError(t *testing.T) {
+	client := newTestClient(t, Options{})
+
+	_, err := client.VerifyFrame(&Frame{Host: "api-example.duosecurity.com", SigRequest: "ERR|The username passed to sign_request() is invalid."}, "https://idp.example.com/login")
+	require.EqualError(t, err, "Duo rejected the request of the IdP: The username passed to sign_request() is invalid.")
+}
+
+func TestVerifyUniversalPromptPush(t *testing.T) {
+	ds := newDuoServer(t, "example/status_pushed.json", "example/status_allow.json")
+	client := newTestClient(t, Options{Device: "iphone", Factor: FactorForMFA("push")})
+
+	doc := fetchDocument(t, client, ds.URL+"/frame/frameless/v4/auth?sid=frameless-example-sid&tx=tx-example")
+	require.True(t, IsUniversalPrompt(doc))
+
+	callback, err := client.VerifyUniversalPrompt(doc)
+	require.Nil(t, err)
+	require.Equal(t, &Callback{
+		URL:   "https://idp.example.com/duo/callback?duo_code=code-example&state=state-example",
+		Code:  "code-example",
+		State: "state-example",
+	}, callback)
+
+	require.Equal(t, "tx-example", ds.forms["/frame/frameless/v4/auth"].Get("tx"))
+	require.Equal(t, "DPPHONE1", ds.forms["/frame/v4/prompt"].Get("device"))
+	require.Equal(t, "Duo Push", ds.forms["/frame/v4/prompt"].Get("factor"))
+	require.Equal(t, "txid-example", ds.forms["/frame/v4/oidc/exit"].Get("txid"))
+	require.Equal(t, "prompt-xsrf", ds.forms["/frame/v4/oidc/exit"].Get("_xsrf"))
+}
+
+func TestVerifyUniversalPromptDenied(t *testing.T) {
+	ds := newDuoServer(t, "example/status_pushed.json", "example/status_deny.json")
+	client := newTestClient(t, Options{Device: "iPhone", Factor: FactorPush})
+
+	_, err := client.VerifyUniversalPrompt(fetchDocument(t, client, ds.URL+"/frame/v4/auth/prompt?sid=frameless-example-sid"))
+	require.EqualError(t, err, "Duo Push was not approved: User marked as fraud")
+}
+
+func TestSelectDeviceUnknown(t *testing.T) {
+	devices := []device{{Key: "DPPHONE1", Name: "iPhone", Factors: []string{FactorPush}}}
+
+	_, err := selectDevice(prompter.Asker{}, devices, "Android", "")
+	require.EqualError(t, err, `duo_device "Android" is not one of the Duo devices: iPhone`)
+}
+
+func TestSelectDeviceByNumber(t *testing.T) {
+	devices := []device{
+		{Key: "DPPHONE1", Name: "iPhone", Factors: []string{FactorPush}},
+		{Key: "DPPHONE2", Name: "Desk phone", Factors: []string{FactorCall}},
+		{Key: "DPTOKEN3", Name: "3", Factors: []string{FactorPasscode}},
+	}
+
+	d, err := selectDevice(prompter.Asker{}, devices, "2", "")
+	require.Nil(t, err)
+	require.Equal(t, "DPPHONE2", d.Key)
+
+	// the name wins over the number
+	d, err = selectDevice(prompter.Asker{}, devices, "3", "")
+	require.Nil(t, err)
+	require.Equal(t, "DPTOKEN3", d.Key)
+
+	_, err = selectDevice(prompter.Asker{}, devices, "4", "")
+	require.EqualError(t, err, `duo_device "4" is not one of the Duo devices: iPhone, Desk phone, 3`)
+
+	_, err = selectDevice(prompter.Asker{}, devices, "0", "")
+	require.Error(t, err)
+}
+
+func TestSelectDeviceOfferingFactor(t *testing.T) {
+	devices := []device{
+		{Key: "DPPHONE1", Name: "iPhone", Factors: []string{FactorPush, FactorCall}},
+		{Key: "DPPHONE2", Name: "Desk phone", Factors: []string{FactorCall}},
+		{Name: "Passcode", Factors: []string{FactorPasscode}},
+	}
+
+	d, err := selectDevice(prompter.Asker{}, devices, "", FactorPush)
+	require.Nil(t, err)
+	require.Equal(t, "DPPHONE1", d.Key)
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Choose", "Select a Duo device", []string{"iPhone", "Desk phone"}).Return(1)
+
+	d, err = selectDevice(prompter.Asker{}, devices, "", FactorCall)
+	require.Nil(t, err)
+	require.Equal(t, "DPPHONE2", d.Key)
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestSelectFactorPasscodeFromAnotherDevice(t *testing.T) {
+	devices := []device{
+		{Key: "DPPHONE1", Name: "iPhone", Factors: []string{FactorPush}},
+		{Name: "Passcode", Factors: []string{FactorPasscode}},
+	}
+
+	factor, err := selectFactor(prompter.Asker{}, devices, devices[0], FactorPasscode)
+	require.Nil(t, err)
+	require.Equal(t, FactorPasscode, factor)
+
+	_, err = selectFactor(prompter.Asker{}, devices, devices[0], FactorCall)
+	require.EqualError(t, err, "Duo device iPhone doesn't offer Phone Call, it offers: Duo Push")
+}
+
+func fetchDocument(t *testing.T, client *Client, u string) *goquery.Document {
+	res, err := client.client.Get(u)
+	require.Nil(t, err)
+	defer res.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	require.Nil(t, err)
+	doc.Url = res.Request.URL
+	return doc
+}
@@ -0,0 +1,177 @@
+package duo
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+// Frame the traditional Duo prompt an IdP embeds in an iframe, signing the request with its integration
+type Frame struct {
+	// Host the API hostname of the Duo integration
+	Host string
+	// SigRequest the signed TX:APP request, the APP half is returned in the sig_response
+	SigRequest string
+	// PostAction where the page posts the sig_response, relative to the page
+	PostAction string
+	// PostArgument the name the sig_response is posted with
+	PostArgument string
+}
+
+// FrameFromDocument the Duo iframe of the page, false when there isn't one
+func FrameFromDocument(doc *goquery.Document) (*Frame, bool) {
+	sel := doc.Find("[data-sig-request]").First()
+	if sel.Size() == 0 {
+		return nil, false
+	}
+
+	frame := &Frame{
+		Host:         sel.AttrOr("data-host", ""),
+		SigRequest:   sel.AttrOr("data-sig-request", ""),
+		PostAction:   sel.AttrOr("data-post-action", ""),
+		PostArgument: sel.AttrOr("data-post-argument", "sig_response"),
+	}
+	return frame, frame.Host != "" && frame.SigRequest != ""
+}
+
+// VerifyFrame answers the traditional Duo prompt and returns the sig_response the IdP checks, parent is the
+// URL of the page that embeds the iframe
+func (c *Client) VerifyFrame(frame *Frame, parent string) (string, error) {
+	if strings.HasPrefix(frame.SigRequest, "ERR|") {
+		return "", errors.Errorf("Duo rejected the request of the IdP: %s", strings.TrimPrefix(frame.SigRequest, "ERR|"))
+	}
+	signatures := strings.Split(frame.SigRequest, ":")
+	if len(signatures) != 2 {
+		return "", errors.New("unable to parse the Duo sig_request, expected TX and APP signatures")
+	}
+	tx, app := signatures[0], signatures[1]
+
+	base := &url.URL{Scheme: "https", Host: frame.Host}
+
+	// initiate the prompt to get a sid
+	authForm := url.Values{}
+	authForm.Add("parent", parent)
+	authForm.Add("java_version", "")
+	authForm.Add("flash_version", "")
+	authForm.Add("screen_resolution_width", "3008")
+	authForm.Add("screen_resolution_height", "1692")
+	authForm.Add("color_depth", "24")
+
+	req, err := http.NewRequest("POST", resolveURL(base, "/frame/web/v1/auth?tx="+url.QueryEscape(tx)), strings.NewReader(authForm.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "error building authentication request")
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept-Language", "en-us,en;q=0.5")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "error retrieving the Duo prompt")
+	}
+	defer res.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "error parsing the Duo prompt")
+	}
+
+	// the cookie is handed out straight away when Duo lets the user bypass MFA
+	if cookie, ok := doc.Find("input[name=\"js_cookie\"]").Attr("value"); ok {
+		if cookie == "" {
+			return "", errors.New("Duo bypassed MFA without a response cookie")
+		}
+		return cookie + ":" + app, nil
+	}
+
+	sid, ok := doc.Find("input[name=\"sid\"]").Attr("value")
+	if !ok {
+		return "", errors.New("unable to locate the Duo session in the Duo prompt")
+	}
+	sid = html.UnescapeString(sid)
+
+	devices := frameDevices(doc)
+	d, err := selectDevice(c.asker(), devices, c.opts.Device, c.opts.Factor)
+	if err != nil {
+		return "", err
+	}
+
+	factor, err := selectFactor(c.asker(), devices, d, c.opts.Factor)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("sid", sid)
+	form.Set("device", d.Key)
+	form.Set("factor", factor)
+	form.Set("out_of_date", "false")
+	if factor == FactorPasscode {
+		form.Set("passcode", c.passcode())
+	}
+
+	prompt, err := c.postForm(resolveURL(base, "/frame/prompt"), form)
+	if err != nil {
+		return "", errors.Wrap(err, "error starting Duo authentication")
+	}
+	if err := checkStat(prompt, base.String()); err != nil {
+		return "", err
+	}
+
+	status := url.Values{}
+	status.Set("sid", sid)
+	status.Set("txid", gjson.Get(prompt, "response.txid").String())
+
+	result, err := c.waitForResult(resolveURL(base, "/frame/status"), status, factor, d)
+	if err != nil {
+		return "", err
+	}
+
+	resultURL := gjson.Get(result, "response.result_url").String()
+	if resultURL == "" {
+		return "", errors.New("Duo approved the request without a result URL")
+	}
+
+	resp, err := c.postForm(resolveURL(base, resultURL), status)
+	if err != nil {
+		return "", errors.Wrap(err, "error retrieving Duo result")
+	}
+	if err := checkStat(resp, base.String()); err != nil {
+		return "", err
+	}
+
+	cookie := gjson.Get(resp, "response.cookie").String()
+	if cookie == "" {
+		return "", errors.New("unable to locate the response cookie in the Duo result")
+	}
+
+	return fmt.Sprintf("%s:%s", cookie, app), nil
+}
+
+// frameDevices the devices the traditional prompt lists, the prompt doesn't say which factors each offers so
+// every one is assumed
+func frameDevices(doc *goquery.Document) []device {
+	factors := []string{FactorPush, FactorCall, FactorPasscode}
+
+	var devices []device
+	doc.Find("select[name=\"device\"] option").Each(func(i int, s *goquery.Selection) {
+		key, ok := s.Attr("value")
+		if !ok || key == "" {
+			return
+		}
+		name := strings.TrimSpace(s.Text())
+		if name == "" {
+			name = key
+		}
+		devices = append(devices, device{Key: key, Name: name, Factors: factors})
+	})
+	if len(devices) == 0 {
+		devices = append(devices, device{Key: "phone1", Name: "phone1", Factors: factors})
+	}
+	return devices
+}
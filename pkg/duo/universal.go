@@ -0,0 +1,194 @@
+package duo
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+	"github.com/versent/saml2aws/v2/pkg/page"
+)
+
+// maxPromptPages the most pages followed on the way into the Universal Prompt
+const maxPromptPages = 5
+
+// Callback where the Universal Prompt sends the user back to once they are verified, for OIDC style
+// integrations the URL carries the duo_code and state the IdP redeems
+type Callback struct {
+	URL   string
+	Code  string
+	State string
+}
+
+// IsUniversalPrompt whether the page is the Universal Prompt, or the form Duo posts on the way into it, which
+// providers land on after following the redirect of the IdP to Duo
+func IsUniversalPrompt(doc *goquery.Document) bool {
+	if doc.Url == nil || !strings.Contains(doc.Url.Path, "/frame/") {
+		return false
+	}
+	return isPromptPage(doc) || doc.Find("form#plugin_form").Size() == 1
+}
+
+func isPromptPage(doc *goquery.Document) bool {
+	return strings.Contains(doc.Url.Path, "/frame/v4/") && doc.Find("input[name=\"sid\"]").Size() > 0
+}
+
+// VerifyUniversalPrompt drives the factor picked through the Universal Prompt's JSON endpoints and returns
+// where Duo sends the user back to, without following it so the caller continues with its own client
+func (c *Client) VerifyUniversalPrompt(doc *goquery.Document) (*Callback, error) {
+	for i := 0; !isPromptPage(doc); i++ {
+		if i == maxPromptPages || doc.Find("form#plugin_form").Size() != 1 {
+			return nil, errors.Errorf("unable to locate the Duo Universal Prompt at %s", doc.Url)
+		}
+
+		form, err := page.NewFormFromDocument(doc, "form#plugin_form")
+		if err != nil {
+			return nil, errors.Wrap(err, "error extracting Duo plugin form")
+		}
+		form.URL = resolveURL(doc.Url, form.URL)
+
+		doc, err = c.fetch(form)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sid, _ := doc.Find("input[name=\"sid\"]").Attr("value")
+	xsrf, _ := doc.Find("input[name=\"_xsrf\"]").Attr("value")
+
+	data, err := c.getJSON(resolveURL(doc.Url, "/frame/v4/auth/prompt/data?post_auth_action=OIDC_EXIT&sid="+url.QueryEscape(sid)))
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving prompt data")
+	}
+	if err := checkStat(data, doc.Url.String()); err != nil {
+		return nil, err
+	}
+
+	devices := promptDevices(data)
+	if len(devices) == 0 {
+		return nil, &EnrollmentRequiredError{URL: doc.Url.String()}
+	}
+
+	d, err := selectDevice(c.asker(), devices, c.opts.Device, c.opts.Factor)
+	if err != nil {
+		return nil, err
+	}
+
+	factor, err := selectFactor(c.asker(), devices, d, c.opts.Factor)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("sid", sid)
+	form.Set("device", d.Key)
+	form.Set("factor", factor)
+	form.Set("postAuthDestination", "OIDC_EXIT")
+	if factor == FactorPasscode {
+		form.Set("passcode", c.passcode())
+	}
+
+	prompt, err := c.postForm(resolveURL(doc.Url, "/frame/v4/prompt"), form)
+	if err != nil {
+		return nil, errors.Wrap(err, "error starting Duo authentication")
+	}
+	if err := checkStat(prompt, doc.Url.String()); err != nil {
+		return nil, err
+	}
+	txid := gjson.Get(prompt, "response.txid").String()
+
+	status := url.Values{}
+	status.Set("sid", sid)
+	status.Set("txid", txid)
+
+	if _, err := c.waitForResult(resolveURL(doc.Url, "/frame/v4/status"), status, factor, d); err != nil {
+		return nil, err
+	}
+
+	exit := url.Values{}
+	exit.Set("sid", sid)
+	exit.Set("txid", txid)
+	exit.Set("factor", factor)
+	exit.Set("device_key", d.Key)
+	exit.Set("_xsrf", xsrf)
+	exit.Set("dampen_choice", "true")
+
+	return c.exit(resolveURL(doc.Url, "/frame/v4/oidc/exit"), exit)
+}
+
+// exit posts the exit of the prompt and reads where Duo redirects to, rather than following it
+func (c *Client) exit(exitURL string, form url.Values) (*Callback, error) {
+	req, err := http.NewRequest("POST", exitURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "error building request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := *c.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error leaving the Duo Universal Prompt")
+	}
+	defer res.Body.Close()
+
+	location, err := res.Location()
+	if err != nil {
+		return nil, errors.Errorf("Duo didn't redirect back after the Universal Prompt, status %d", res.StatusCode)
+	}
+
+	return &Callback{
+		URL:   location.String(),
+		Code:  location.Query().Get("duo_code"),
+		State: location.Query().Get("state"),
+	}, nil
+}
+
+func (c *Client) fetch(form *page.Form) (*goquery.Document, error) {
+	res, err := form.Submit(c.client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build document from response")
+	}
+	doc.Url = res.Request.URL
+	return doc, nil
+}
+
+// promptDevices the devices offered in the prompt data, in Duo's preferred order
+func promptDevices(data string) []device {
+	names := map[string]string{}
+	gjson.Get(data, "response.phones").ForEach(func(_, phone gjson.Result) bool {
+		names[phone.Get("key").String()] = phone.Get("name").String()
+		return true
+	})
+
+	devices := []device{}
+	index := map[string]int{}
+	gjson.Get(data, "response.auth_method_order").ForEach(func(_, method gjson.Result) bool {
+		key := method.Get("deviceKey").String()
+		i, ok := index[key]
+		if !ok {
+			name := names[key]
+			if name == "" {
+				// passcodes from a hardware token or Duo Mobile aren't tied to a phone
+				name = "Passcode"
+			}
+			devices = append(devices, device{Key: key, Name: name})
+			i = len(devices) - 1
+			index[key] = i
+		}
+		devices[i].Factors = append(devices[i].Factors, method.Get("factor").String())
+		return true
+	})
+	return devices
+}
@@ -21,14 +21,24 @@ type CommonFlags struct {
 	URL                   string
 	Username              string
 	Password              string
+	PasswordFile          string
 	RoleArn               string
+	RoleMatcher           string
+	RoleFilter            string
 	AmazonWebservicesURN  string
+	Partition             string
 	SessionDuration       int
+	Policy                string
+	PolicyFile            string
+	PolicyARNs            string
 	SkipPrompt            bool
+	NonInteractive        bool
 	SkipVerify            bool
 	Profile               string
 	Subdomain             string
 	ResourceID            string
+	SSOStartURL           string
+	SSORegion             string
 	DisableKeychain       bool
 	Region                string
 	CredentialsFile       string
@@ -36,17 +46,28 @@ type CommonFlags struct {
 	SAMLCacheFile         string
 	DisableRememberDevice bool
 	DisableSessions       bool
+	DisableDeviceToken    bool
 	Prompter              string
+	Quiet                 bool
 }
 
 // LoginExecFlags flags for the Login / Exec commands
 type LoginExecFlags struct {
-	CommonFlags       *CommonFlags
-	DownloadBrowser   bool
-	Force             bool
-	DuoMFAOption      string
-	ExecProfile       string
-	CredentialProcess bool
+	CommonFlags        *CommonFlags
+	DownloadBrowser    bool
+	Force              bool
+	DuoMFAOption       string
+	ExecProfile        string
+	CredentialProcess  bool
+	DryRun             bool
+	WriteRegion        bool
+	NoDurationFallback bool
+	NoRememberRole     bool
+	SimplePrompt       bool
+	AllRoles           bool
+	UseEnvBase         bool
+	DumpAssertion      bool
+	DumpAssertionFile  string
 }
 
 type ConsoleFlags struct {
@@ -100,10 +121,22 @@ func ApplyFlagOverrides(commonFlags *CommonFlags, account *cfg.IDPAccount) {
 		account.AmazonWebservicesURN = commonFlags.AmazonWebservicesURN
 	}
 
+	if commonFlags.Partition != "" {
+		account.Partition = commonFlags.Partition
+	}
+
 	if commonFlags.SessionDuration != 0 {
 		account.SessionDuration = commonFlags.SessionDuration
 	}
 
+	if commonFlags.PolicyFile != "" {
+		account.PolicyFile = commonFlags.PolicyFile
+	}
+
+	if commonFlags.PolicyARNs != "" {
+		account.PolicyARNs = commonFlags.PolicyARNs
+	}
+
 	if commonFlags.Profile != "" {
 		account.Profile = commonFlags.Profile
 	}
@@ -113,11 +146,29 @@ func ApplyFlagOverrides(commonFlags *CommonFlags, account *cfg.IDPAccount) {
 	}
 
 	if commonFlags.RoleArn != "" {
+		// --role picks a single role over any configured role_arns
 		account.RoleARN = commonFlags.RoleArn
+		account.RoleARNs = ""
+		account.RoleProfiles = ""
+	} else if commonFlags.RoleMatcher != "" {
+		// --role-matcher picks a single role over any configured role_arn or role_arns
+		account.RoleMatcher = commonFlags.RoleMatcher
+		account.RoleARN = ""
+		account.RoleARNs = ""
+		account.RoleProfiles = ""
+	}
+	if commonFlags.RoleFilter != "" {
+		account.RoleFilter = commonFlags.RoleFilter
 	}
 	if commonFlags.ResourceID != "" {
 		account.ResourceID = commonFlags.ResourceID
 	}
+	if commonFlags.SSOStartURL != "" {
+		account.SSOStartURL = commonFlags.SSOStartURL
+	}
+	if commonFlags.SSORegion != "" {
+		account.SSORegion = commonFlags.SSORegion
+	}
 	if commonFlags.Region != "" {
 		account.Region = commonFlags.Region
 	}
@@ -133,9 +184,15 @@ func ApplyFlagOverrides(commonFlags *CommonFlags, account *cfg.IDPAccount) {
 	if commonFlags.DisableRememberDevice {
 		account.DisableRememberDevice = commonFlags.DisableRememberDevice
 	}
+	if commonFlags.DisableKeychain {
+		account.DisableKeyring = commonFlags.DisableKeychain
+	}
 	if commonFlags.DisableSessions {
 		account.DisableSessions = commonFlags.DisableSessions
 	}
+	if commonFlags.DisableDeviceToken {
+		account.DisableDeviceToken = commonFlags.DisableDeviceToken
+	}
 	if commonFlags.Prompter != "" {
 		account.Prompter = commonFlags.Prompter
 	}
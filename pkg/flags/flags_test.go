@@ -16,8 +16,15 @@ func TestOverrideAllFlags(t *testing.T) {
 		URL:                  "https://id.example.com",
 		Username:             "myuser",
 		AmazonWebservicesURN: "urn:amazon:webservices",
+		Partition:            "govcloud",
 		SessionDuration:      3600,
+		PolicyFile:           "policy.json",
+		PolicyARNs:           "arn:aws:iam::aws:policy/ReadOnlyAccess",
+		RoleFilter:           "Admin",
 		Profile:              "saml",
+		SSOStartURL:          "https://example.awsapps.com/start",
+		SSORegion:            "eu-west-1",
+		DisableKeychain:      true,
 	}
 	idpa := &cfg.IDPAccount{
 		Provider:             "Ping",
@@ -35,8 +42,15 @@ func TestOverrideAllFlags(t *testing.T) {
 		URL:                  "https://id.example.com",
 		Username:             "myuser",
 		AmazonWebservicesURN: "urn:amazon:webservices",
+		Partition:            "govcloud",
 		SessionDuration:      3600,
+		PolicyFile:           "policy.json",
+		PolicyARNs:           "arn:aws:iam::aws:policy/ReadOnlyAccess",
+		RoleFilter:           "Admin",
 		Profile:              "saml",
+		SSOStartURL:          "https://example.awsapps.com/start",
+		SSORegion:            "eu-west-1",
+		DisableKeyring:       true,
 	}
 	ApplyFlagOverrides(commonFlags, idpa)
 
@@ -74,3 +88,15 @@ func TestNoOverrides(t *testing.T) {
 
 	assert.Equal(t, expected, idpa)
 }
+
+func TestRoleOverridePrecedence(t *testing.T) {
+
+	idpa := &cfg.IDPAccount{RoleARN: "arn:aws:iam::123456789012:role/admin", RoleMatcher: "ReadOnly"}
+	ApplyFlagOverrides(&CommonFlags{RoleMatcher: "Developer"}, idpa)
+	assert.Equal(t, &cfg.IDPAccount{RoleMatcher: "Developer"}, idpa)
+
+	// --role beats --role-matcher
+	idpa = &cfg.IDPAccount{RoleMatcher: "ReadOnly"}
+	ApplyFlagOverrides(&CommonFlags{RoleArn: "arn:aws:iam::123456789012:role/admin", RoleMatcher: "Developer"}, idpa)
+	assert.Equal(t, &cfg.IDPAccount{RoleARN: "arn:aws:iam::123456789012:role/admin", RoleMatcher: "ReadOnly"}, idpa)
+}
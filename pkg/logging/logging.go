@@ -0,0 +1,143 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FormatText the human readable log format, the default
+	FormatText = "text"
+
+	// FormatJSON one JSON object per line, for log aggregators
+	FormatJSON = "json"
+
+	redacted = "[REDACTED]"
+)
+
+// Formats the values accepted by --log-format
+var Formats = []string{FormatText, FormatJSON}
+
+// sensitiveFields matches the field names whose values are never written out in JSON logs
+var sensitiveFields = regexp.MustCompile(`(?i)password|passcode|secret|token|credential|cookie|saml|assertion|otp`)
+
+// sensitivePairs matches a sensitive name followed by = or : and its value in free text, such as
+// password=hunter2 in a message or "SessionToken":"..." in a dumped response, the value being the second group
+var sensitivePairs = regexp.MustCompile(`(?i)("?[\w.-]*(?:password|passcode|secret|token|credential|cookie|saml|assertion|otp)[\w.-]*"?\s*[:=]\s*)("[^"]*"|[^\s,;&"]+)`)
+
+// opaqueBlobs matches runs of base64 long enough to be a SAML response, session token or cookie rather than
+// anything a person reads
+var opaqueBlobs = regexp.MustCompile(`[A-Za-z0-9+/_-]{200,}={0,2}`)
+
+var (
+	jsonFormat bool
+
+	// fields added to every entry, such as the account and provider of the login, commonFieldsMu guards them
+	// as providers log from their own goroutines
+	commonFields   = logrus.Fields{}
+	commonFieldsMu sync.RWMutex
+)
+
+// Configure switches the logs to the given format, JSON also sends the log package's output through logrus
+// so every line is structured
+func Configure(format string) error {
+	switch format {
+	case "", FormatText:
+		jsonFormat = false
+		return nil
+	case FormatJSON:
+		jsonFormat = true
+		logrus.SetFormatter(&redactingFormatter{formatter: &logrus.JSONFormatter{TimestampFormat: time.RFC3339}})
+		log.SetFlags(0)
+		log.SetOutput(logWriter{})
+		return nil
+	}
+
+	return fmt.Errorf("unknown log format %s, expected one of %s", format, strings.Join(Formats, ", "))
+}
+
+// JSON whether the logs are written as JSON
+func JSON() bool {
+	return jsonFormat
+}
+
+// SetFields adds the fields to every following entry
+func SetFields(fields logrus.Fields) {
+	commonFieldsMu.Lock()
+	defer commonFieldsMu.Unlock()
+
+	for k, v := range fields {
+		commonFields[k] = v
+	}
+}
+
+// Completed logs how long a command took, as info in JSON so it reaches the aggregator and as debug otherwise
+// so the text output is unchanged
+func Completed(logger *logrus.Entry, start time.Time, err error) {
+	entry := logger.WithField("duration_ms", time.Since(start).Milliseconds())
+	level := logrus.DebugLevel
+	if jsonFormat {
+		level = logrus.InfoLevel
+	}
+
+	if err != nil {
+		entry.WithError(err).Log(level, "command failed")
+		return
+	}
+	entry.Log(level, "command completed")
+}
+
+// logWriter logs each line written by the log package as an info entry, synchronously so nothing is lost on exit
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	logrus.Info(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// redactingFormatter adds the common fields and blanks the sensitive ones before formatting. The message and the
+// text of the other fields are scrubbed of sensitive name=value or name: value pairs and of long base64 blobs. A
+// secret that appears on its own, with no name in front of it and short enough to read, is written as it is.
+type redactingFormatter struct {
+	formatter logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	commonFieldsMu.RLock()
+	data := make(logrus.Fields, len(commonFields)+len(entry.Data))
+	for k, v := range commonFields {
+		data[k] = v
+	}
+	commonFieldsMu.RUnlock()
+
+	for k, v := range entry.Data {
+		switch value := v.(type) {
+		case string:
+			v = scrub(value)
+		case error:
+			v = scrub(value.Error())
+		}
+		if sensitiveFields.MatchString(k) {
+			v = redacted
+		}
+		data[k] = v
+	}
+
+	redactedEntry := *entry
+	redactedEntry.Data = data
+	redactedEntry.Message = scrub(entry.Message)
+
+	return f.formatter.Format(&redactedEntry)
+}
+
+// scrub blanks the values of sensitive pairs and the base64 blobs in free text
+func scrub(text string) string {
+	text = sensitivePairs.ReplaceAllString(text, "${1}"+redacted)
+	return opaqueBlobs.ReplaceAllString(text, redacted)
+}
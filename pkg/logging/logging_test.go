@@ -0,0 +1,122 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	t.Cleanup(func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetFormatter(&logrus.TextFormatter{})
+		log.SetOutput(os.Stderr)
+		jsonFormat = false
+		commonFields = logrus.Fields{}
+	})
+
+	require.Nil(t, Configure(FormatJSON))
+	SetFields(logrus.Fields{"account": "default", "provider": "Okta"})
+
+	logrus.WithFields(logrus.Fields{"password": "hunter2", "saml-response": "PHNhbWw+", "user": "alice"}).Warn("checking")
+
+	var entry map[string]interface{}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "warning", entry["level"])
+	require.Equal(t, "checking", entry["msg"])
+	require.Equal(t, "default", entry["account"])
+	require.Equal(t, "Okta", entry["provider"])
+	require.Equal(t, "alice", entry["user"])
+	require.Equal(t, redacted, entry["password"])
+	require.Equal(t, redacted, entry["saml-response"])
+
+	buf.Reset()
+	log.Println("Authenticating as alice ...")
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "info", entry["level"])
+	require.Equal(t, "Authenticating as alice ...", entry["msg"])
+
+	buf.Reset()
+	Completed(logrus.WithField("command", "login"), time.Now().Add(-time.Second), errors.New("boom"))
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "command failed", entry["msg"])
+	require.Equal(t, "boom", entry["error"])
+	require.GreaterOrEqual(t, entry["duration_ms"], float64(1000))
+}
+
+func TestSetFieldsConcurrently(t *testing.T) {
+	formatter := &redactingFormatter{formatter: &logrus.JSONFormatter{}}
+	t.Cleanup(func() {
+		commonFields = logrus.Fields{}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				SetFields(logrus.Fields{"account": i})
+				if _, err := formatter.Format(logrus.WithField("user", "alice")); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, ok := commonFields["account"]
+	require.True(t, ok)
+}
+
+func TestScrub(t *testing.T) {
+	blob := strings.Repeat("PHNhbWxwOlJlc3BvbnNl", 12)
+
+	require.Equal(t, "login with password=[REDACTED] as alice", scrub("login with password=hunter2 as alice"))
+	require.Equal(t, "otp: [REDACTED], device: phone", scrub("otp: 123456, device: phone"))
+	require.Equal(t, `{"AccessKeyId":"ASIA123","SessionToken":[REDACTED]}`, scrub(`{"AccessKeyId":"ASIA123","SessionToken":"FwoGZXIvYXdzE"}`))
+	require.Equal(t, "POST SAMLResponse=[REDACTED]&RelayState=x", scrub("POST SAMLResponse="+blob+"&RelayState=x"))
+	require.Equal(t, "response [REDACTED] received", scrub("response "+blob+" received"))
+
+	// a short secret without a name in front of it can't be told from any other word
+	require.Equal(t, "the password hunter2 was rejected", scrub("the password hunter2 was rejected"))
+}
+
+func TestConfigureJSONScrubsMessages(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	t.Cleanup(func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetFormatter(&logrus.TextFormatter{})
+		log.SetOutput(os.Stderr)
+		jsonFormat = false
+	})
+
+	require.Nil(t, Configure(FormatJSON))
+
+	log.Printf("Retrying with token=%s", "abc123")
+
+	var entry map[string]interface{}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "Retrying with token=[REDACTED]", entry["msg"])
+
+	buf.Reset()
+	logrus.WithError(errors.New("bad response password=hunter2")).Error("login failed")
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "bad response password=[REDACTED]", entry["error"])
+}
+
+func TestConfigureUnknownFormat(t *testing.T) {
+	require.EqualError(t, Configure("xml"), "unknown log format xml, expected one of text, json")
+}
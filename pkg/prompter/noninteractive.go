@@ -0,0 +1,67 @@
+package prompter
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// NonInteractivePrompter is a concrete implementation of the Prompter interface
+// used by --quiet and the credential process. Nobody is there to answer, so any
+// prompt needing input fails the command instead of waiting on a terminal, and
+// displays are dropped.
+type NonInteractivePrompter struct {
+	Output io.Writer
+	Exit   func(int)
+}
+
+// NewNonInteractivePrompter builds a prompter that reports to stderr and exits
+func NewNonInteractivePrompter() *NonInteractivePrompter {
+	return &NonInteractivePrompter{Output: os.Stderr, Exit: os.Exit}
+}
+
+// fail reports the input which was required and exits with an error
+func (p *NonInteractivePrompter) fail(pr string) {
+	fmt.Fprintf(p.Output, "input required for %q but prompting is disabled\n", pr)
+	p.Exit(1)
+}
+
+// RequestSecurityCode fails, the code can't be entered
+func (p *NonInteractivePrompter) RequestSecurityCode(pattern string) string {
+	p.fail(fmt.Sprintf("Security Token [%s]", pattern))
+	return ""
+}
+
+// ChooseWithDefault fails, nothing can be chosen
+func (p *NonInteractivePrompter) ChooseWithDefault(pr string, defaultValue string, options []string) (string, error) {
+	p.fail(pr)
+	return "", fmt.Errorf("input required for %q", pr)
+}
+
+// Choose fails, nothing can be chosen
+func (p *NonInteractivePrompter) Choose(pr string, options []string) int {
+	p.fail(pr)
+	return 0
+}
+
+// StringRequired fails, the string can't be entered
+func (p *NonInteractivePrompter) StringRequired(pr string) string {
+	p.fail(pr)
+	return ""
+}
+
+// String fails, the string can't be entered
+func (p *NonInteractivePrompter) String(pr string, defaultValue string) string {
+	p.fail(pr)
+	return defaultValue
+}
+
+// Password fails, the password can't be entered
+func (p *NonInteractivePrompter) Password(pr string) string {
+	p.fail(pr)
+	return ""
+}
+
+// Display is silenced, no user input required
+func (p *NonInteractivePrompter) Display(pr string) {
+}
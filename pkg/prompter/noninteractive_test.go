@@ -0,0 +1,32 @@
+package prompter
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonInteractivePrompterFails(t *testing.T) {
+	output := &bytes.Buffer{}
+	code := -1
+	p := &NonInteractivePrompter{Output: output, Exit: func(c int) { code = c }}
+
+	p.Display("Approve the push")
+	assert.Equal(t, -1, code)
+	assert.Empty(t, output.String())
+
+	p.Password("Password")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "input required for \"Password\" but prompting is disabled\n", output.String())
+}
+
+func TestValidateAndSetPrompterKeepsNonInteractive(t *testing.T) {
+	defer SetPrompter(NewCli())
+
+	p := NewNonInteractivePrompter()
+	SetPrompter(p)
+
+	assert.Nil(t, ValidateAndSetPrompter("pinentry"))
+	assert.Equal(t, p, ActivePrompter)
+}
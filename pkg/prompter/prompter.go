@@ -19,6 +19,14 @@ type Prompter interface {
 	Display(string)
 }
 
+// Filter reports whether the option at index matches what has been typed to narrow the list
+type Filter func(filter string, option string, index int) bool
+
+// FilteringPrompter implemented by prompters whose lists narrow as the user types
+type FilteringPrompter interface {
+	ChooseWithFilter(string, string, []string, Filter) (string, error)
+}
+
 // SetPrompter configure an aternate prompter to the default one
 func SetPrompter(prmpt Prompter) {
 	ActivePrompter = prmpt
@@ -28,6 +36,11 @@ func SetPrompter(prmpt Prompter) {
 // a concrete prompter based on this configuration
 func ValidateAndSetPrompter(prmptCfg string) error {
 
+	// --quiet can't be overridden, the configured prompter would still ask for input
+	if _, ok := ActivePrompter.(*NonInteractivePrompter); ok {
+		return nil
+	}
+
 	if prmptCfg == "" || prmptCfg == "survey" || prmptCfg == "default" {
 		// nothing to do; the default prompter is the survey one.
 		return nil
@@ -43,13 +56,67 @@ func ValidateAndSetPrompter(prmptCfg string) error {
 	return fmt.Errorf("Prompter %s is not valid.", prmptCfg)
 }
 
+// Asker asks through the prompter it holds rather than the active one, so each login can be handed the prompter
+// its user answers without changing it for every other caller. The zero value asks through the active prompter.
+type Asker struct {
+	Prompter Prompter
+}
+
+func (a Asker) prompter() Prompter {
+	if a.Prompter != nil {
+		return a.Prompter
+	}
+	return ActivePrompter
+}
+
 // RequestSecurityCode request a security code to be entered by the user
 func RequestSecurityCode(pattern string) string {
-	return ActivePrompter.RequestSecurityCode(pattern)
+	return Asker{}.RequestSecurityCode(pattern)
 }
 
 // ChooseWithDefault given the choice return the option selected with a default
 func ChooseWithDefault(pr string, defaultValue string, options []string) (string, error) {
+	return Asker{}.ChooseWithDefault(pr, defaultValue, options)
+}
+
+// ChooseWithFilter given the choice return the option selected with a default, narrowing the options with the
+// filter as the user types when the prompter can
+func ChooseWithFilter(pr string, defaultValue string, options []string, filter Filter) (string, error) {
+	return Asker{}.ChooseWithFilter(pr, defaultValue, options, filter)
+}
+
+// Choose given the choice return the option selected
+func Choose(pr string, options []string) int {
+	return Asker{}.Choose(pr, options)
+}
+
+// StringRequired prompt for string which is required
+func StringRequired(pr string) string {
+	return Asker{}.StringRequired(pr)
+}
+
+// String prompt for string which is required
+func String(pr string, defaultValue string) string {
+	return Asker{}.String(pr, defaultValue)
+}
+
+// Password prompt for password which is required
+func Password(pr string) string {
+	return Asker{}.Password(pr)
+}
+
+// Display prompt, no user input required
+func Display(pr string) {
+	Asker{}.Display(pr)
+}
+
+// RequestSecurityCode request a security code to be entered by the user
+func (a Asker) RequestSecurityCode(pattern string) string {
+	return a.prompter().RequestSecurityCode(pattern)
+}
+
+// ChooseWithDefault given the choice return the option selected with a default
+func (a Asker) ChooseWithDefault(pr string, defaultValue string, options []string) (string, error) {
 
 	// ensure the default is not empty and avoid bad input error
 	if defaultValue == "" {
@@ -58,30 +125,47 @@ func ChooseWithDefault(pr string, defaultValue string, options []string) (string
 		}
 	}
 
-	return ActivePrompter.ChooseWithDefault(pr, defaultValue, options)
+	return a.prompter().ChooseWithDefault(pr, defaultValue, options)
+}
+
+// ChooseWithFilter given the choice return the option selected with a default, narrowing the options with the
+// filter as the user types when the prompter can
+func (a Asker) ChooseWithFilter(pr string, defaultValue string, options []string, filter Filter) (string, error) {
+	return chooseWithFilter(a.prompter(), pr, defaultValue, options, filter)
+}
+
+func chooseWithFilter(prmpt Prompter, pr string, defaultValue string, options []string, filter Filter) (string, error) {
+	if defaultValue == "" && len(options) > 0 {
+		defaultValue = options[0]
+	}
+
+	if fp, ok := prmpt.(FilteringPrompter); ok {
+		return fp.ChooseWithFilter(pr, defaultValue, options, filter)
+	}
+	return prmpt.ChooseWithDefault(pr, defaultValue, options)
 }
 
 // Choose given the choice return the option selected
-func Choose(pr string, options []string) int {
-	return ActivePrompter.Choose(pr, options)
+func (a Asker) Choose(pr string, options []string) int {
+	return a.prompter().Choose(pr, options)
 }
 
 // StringRequired prompt for string which is required
-func StringRequired(pr string) string {
-	return ActivePrompter.StringRequired(pr)
+func (a Asker) StringRequired(pr string) string {
+	return a.prompter().StringRequired(pr)
 }
 
 // String prompt for string which is required
-func String(pr string, defaultValue string) string {
-	return ActivePrompter.String(pr, defaultValue)
+func (a Asker) String(pr string, defaultValue string) string {
+	return a.prompter().String(pr, defaultValue)
 }
 
 // Password prompt for password which is required
-func Password(pr string) string {
-	return ActivePrompter.Password(pr)
+func (a Asker) Password(pr string) string {
+	return a.prompter().Password(pr)
 }
 
 // Display prompt, no user input required
-func Display(pr string) {
-	ActivePrompter.Display(pr)
+func (a Asker) Display(pr string) {
+	a.prompter().Display(pr)
 }
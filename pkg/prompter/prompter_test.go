@@ -0,0 +1,26 @@
+package prompter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// answeringPrompter gives the same answer to every question
+type answeringPrompter struct {
+	NonInteractivePrompter
+	answer string
+}
+
+func (p *answeringPrompter) StringRequired(pr string) string {
+	return p.answer
+}
+
+func TestAsker(t *testing.T) {
+	defer SetPrompter(ActivePrompter)
+	SetPrompter(&answeringPrompter{answer: "active"})
+
+	assert.Equal(t, "given", Asker{Prompter: &answeringPrompter{answer: "given"}}.StringRequired("Enter passcode"))
+	assert.Equal(t, "active", Asker{}.StringRequired("Enter passcode"))
+	assert.Equal(t, "active", StringRequired("Enter passcode"))
+}
@@ -60,6 +60,26 @@ func (cli *CliPrompter) ChooseWithDefault(pr string, defaultValue string, option
 	return "", errors.New("bad input")
 }
 
+// ChooseWithFilter given the choice return the option selected with a default, typing narrows the options to
+// those the filter matches
+func (cli *CliPrompter) ChooseWithFilter(pr string, defaultValue string, options []string, filter Filter) (string, error) {
+	selected := ""
+	prompt := &survey.Select{
+		Message:  pr,
+		Options:  options,
+		Default:  defaultValue,
+		PageSize: 15,
+	}
+	_ = survey.AskOne(prompt, &selected, survey.WithValidator(survey.Required), survey.WithFilter(filter), stdioOption())
+
+	for i, option := range options {
+		if selected == option {
+			return options[i], nil
+		}
+	}
+	return "", errors.New("bad input")
+}
+
 // Choose given the choice return the option selected
 func (cli *CliPrompter) Choose(pr string, options []string) int {
 	selected := ""
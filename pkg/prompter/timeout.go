@@ -0,0 +1,121 @@
+package prompter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// TimeoutPrompter wraps another prompter so that a prompt nobody answers fails
+// the command once Timeout passes, rather than waiting forever on a terminal
+// nobody is watching, such as a CI job.
+type TimeoutPrompter struct {
+	Prompter
+	Timeout time.Duration
+	Output  io.Writer
+	Exit    func(int)
+}
+
+// NewTimeoutPrompter wraps the prompter, reporting timeouts to stderr and exiting
+func NewTimeoutPrompter(prmpt Prompter, timeout time.Duration) *TimeoutPrompter {
+	return &TimeoutPrompter{Prompter: prmpt, Timeout: timeout, Output: os.Stderr, Exit: os.Exit}
+}
+
+// SetPromptTimeout wraps the active prompter so prompts time out, 0 waits forever
+func SetPromptTimeout(timeout time.Duration) {
+	if p, ok := ActivePrompter.(*TimeoutPrompter); ok {
+		ActivePrompter = p.Prompter
+	}
+
+	// --quiet never waits for input in the first place
+	if _, ok := ActivePrompter.(*NonInteractivePrompter); ok || timeout <= 0 {
+		return
+	}
+
+	SetPrompter(NewTimeoutPrompter(ActivePrompter, timeout))
+}
+
+// wait runs the prompt, reporting the timeout and exiting if it isn't answered in time
+func (p *TimeoutPrompter) wait(pr string, prompt func()) bool {
+	done := make(chan struct{})
+	go func() {
+		prompt()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(p.Timeout):
+		fmt.Fprintf(p.Output, "prompt %q timed out after %s without an answer, see prompt_timeout\n", pr, p.Timeout)
+		p.Exit(1)
+		return false
+	}
+}
+
+// RequestSecurityCode request a security code, failing after the timeout
+func (p *TimeoutPrompter) RequestSecurityCode(pattern string) string {
+	var code string
+	if !p.wait(fmt.Sprintf("Security Token [%s]", pattern), func() { code = p.Prompter.RequestSecurityCode(pattern) }) {
+		return ""
+	}
+	return code
+}
+
+// ChooseWithDefault given the choice return the option selected with a default, failing after the timeout
+func (p *TimeoutPrompter) ChooseWithDefault(pr string, defaultValue string, options []string) (string, error) {
+	var value string
+	var err error
+	if !p.wait(pr, func() { value, err = p.Prompter.ChooseWithDefault(pr, defaultValue, options) }) {
+		return "", fmt.Errorf("prompt %q timed out after %s", pr, p.Timeout)
+	}
+	return value, err
+}
+
+// ChooseWithFilter given the choice return the option selected with a default, narrowed by the filter when the
+// wrapped prompter can, failing after the timeout
+func (p *TimeoutPrompter) ChooseWithFilter(pr string, defaultValue string, options []string, filter Filter) (string, error) {
+	var value string
+	var err error
+	if !p.wait(pr, func() { value, err = chooseWithFilter(p.Prompter, pr, defaultValue, options, filter) }) {
+		return "", fmt.Errorf("prompt %q timed out after %s", pr, p.Timeout)
+	}
+	return value, err
+}
+
+// Choose given the choice return the option selected, failing after the timeout
+func (p *TimeoutPrompter) Choose(pr string, options []string) int {
+	var index int
+	if !p.wait(pr, func() { index = p.Prompter.Choose(pr, options) }) {
+		return 0
+	}
+	return index
+}
+
+// StringRequired prompt for string which is required, failing after the timeout
+func (p *TimeoutPrompter) StringRequired(pr string) string {
+	var value string
+	if !p.wait(pr, func() { value = p.Prompter.StringRequired(pr) }) {
+		return ""
+	}
+	return value
+}
+
+// String prompt for string, failing after the timeout
+func (p *TimeoutPrompter) String(pr string, defaultValue string) string {
+	var value string
+	if !p.wait(pr, func() { value = p.Prompter.String(pr, defaultValue) }) {
+		return defaultValue
+	}
+	return value
+}
+
+// Password prompt for password, failing after the timeout
+func (p *TimeoutPrompter) Password(pr string) string {
+	var value string
+	if !p.wait(pr, func() { value = p.Prompter.Password(pr) }) {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,76 @@
+package prompter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingPrompter answers once unblocked, like a user who walked away from the terminal
+type blockingPrompter struct {
+	NonInteractivePrompter
+	unblock chan struct{}
+}
+
+func (p *blockingPrompter) Password(pr string) string {
+	<-p.unblock
+	return "secret"
+}
+
+func TestTimeoutPrompterAnswered(t *testing.T) {
+	inner := &blockingPrompter{unblock: make(chan struct{})}
+	close(inner.unblock)
+
+	output := &bytes.Buffer{}
+	code := -1
+	p := &TimeoutPrompter{Prompter: inner, Timeout: time.Second, Output: output, Exit: func(c int) { code = c }}
+
+	assert.Equal(t, "secret", p.Password("Password"))
+	assert.Equal(t, -1, code)
+	assert.Empty(t, output.String())
+}
+
+func TestTimeoutPrompterTimesOut(t *testing.T) {
+	inner := &blockingPrompter{unblock: make(chan struct{})}
+	defer close(inner.unblock)
+
+	output := &bytes.Buffer{}
+	code := -1
+	p := &TimeoutPrompter{Prompter: inner, Timeout: 10 * time.Millisecond, Output: output, Exit: func(c int) { code = c }}
+
+	assert.Equal(t, "", p.Password("Password"))
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "prompt \"Password\" timed out after 10ms without an answer, see prompt_timeout\n", output.String())
+}
+
+func TestSetPromptTimeout(t *testing.T) {
+	defer SetPrompter(NewCli())
+
+	cli := NewCli()
+	SetPrompter(cli)
+
+	SetPromptTimeout(time.Minute)
+	assert.Equal(t, &TimeoutPrompter{Prompter: cli, Timeout: time.Minute}, withoutIO(ActivePrompter))
+
+	// validating the account again replaces the timeout rather than wrapping twice
+	SetPromptTimeout(2 * time.Minute)
+	assert.Equal(t, &TimeoutPrompter{Prompter: cli, Timeout: 2 * time.Minute}, withoutIO(ActivePrompter))
+
+	SetPromptTimeout(0)
+	assert.Equal(t, cli, ActivePrompter)
+
+	quiet := NewNonInteractivePrompter()
+	SetPrompter(quiet)
+	SetPromptTimeout(time.Minute)
+	assert.Equal(t, quiet, ActivePrompter)
+}
+
+func withoutIO(p Prompter) Prompter {
+	tp, ok := p.(*TimeoutPrompter)
+	if !ok {
+		return p
+	}
+	return &TimeoutPrompter{Prompter: tp.Prompter, Timeout: tp.Timeout}
+}
@@ -23,12 +23,65 @@ import (
 
 var logger = logrus.WithField("provider", "AzureAD")
 
+// the ids, from the pgid of the page's $Config, of the interrupts not recognised by their content
+const (
+	pageTermsOfUse     = "ConvergedTOU"
+	pageConvergedError = "ConvergedError"
+)
+
+// the LoginOptions answering the KMSI "Stay signed in?" interrupt
+const (
+	kmsiStaySignedIn     = "1"
+	kmsiDontStaySignedIn = "3"
+)
+
+const mfaRegistrationSetupURL = "https://aka.ms/mfasetup"
+
+// the sign in methods offered by GetCredentialType, named like the MFA methods they resemble
+const (
+	authMethodPassword             = "Password"
+	authMethodPhoneAppNotification = "PhoneAppNotification"
+	authMethodFIDO                 = "FIDO"
+)
+
+// authMethods the sign in methods saml2aws can complete, in the order they're offered
+var authMethods = []string{authMethodPassword, authMethodPhoneAppNotification}
+
+// the AuthorizationState of a passwordless phone sign in, polled from urlSessionState
+const (
+	remoteNgcApproved = 2
+	remoteNgcRejected = 3
+)
+
+// the form type posting a passwordless phone sign in, instead of a password
+const loginTypeRemoteNgc = "22"
+
+var (
+	// sessionStatePollInterval time between checks for the approval of a passwordless phone sign in
+	sessionStatePollInterval = 2 * time.Second
+
+	// sessionStateTimeout how long the approval is waited for, the Authenticator request expires after it
+	sessionStateTimeout = 2 * time.Minute
+)
+
+// interruptErrors the errors of the interrupts saml2aws can't answer, by AADSTS error code
+var interruptErrors = map[string]string{
+	"50072": "AzureAD requires you to register a multi-factor authentication method, register one at " + mfaRegistrationSetupURL + " and login again",
+	"50079": "AzureAD requires you to register a multi-factor authentication method, register one at " + mfaRegistrationSetupURL + " and login again",
+	"50097": "a Conditional Access policy requires device authentication, which saml2aws can't provide",
+	"50158": "a Conditional Access policy requires an external security challenge, complete the sign in once in a browser and login again",
+	"53000": "a Conditional Access policy requires a compliant or registered device, which saml2aws can't provide",
+	"53001": "a Conditional Access policy requires a domain joined device, which saml2aws can't provide",
+	"53003": "access was blocked by a Conditional Access policy",
+}
+
 // Client wrapper around AzureAD enabling authentication and retrieval of assertions
 type Client struct {
 	provider.ValidateBase
 
 	client     *provider.HTTPClient
 	idpAccount *cfg.IDPAccount
+	ask        prompter.Asker // asks the user through the prompter of the login being authenticated
 }
 
 // Autogenrated Converged Response struct
@@ -37,6 +90,8 @@ type ConvergedResponse struct {
 	URLGetCredentialType    string             `json:"urlGetCredentialType"`
 	ArrUserProofs           []userProof        `json:"arrUserProofs"`
 	URLSkipMfaRegistration  string             `json:"urlSkipMfaRegistration"`
+	URLTermsOfUse           string             `json:"urlTermsOfUse"`
+	URLSessionState         string             `json:"urlSessionState"`
 	OPerAuthPollingInterval map[string]float64 `json:"oPerAuthPollingInterval"`
 	URLBeginAuth            string             `json:"urlBeginAuth"`
 	URLEndAuth              string             `json:"urlEndAuth"`
@@ -85,21 +140,39 @@ type GetCredentialTypeResponse struct {
 	IsUnmanaged    bool   `json:"IsUnmanaged"`
 	ThrottleStatus int    `json:"ThrottleStatus"`
 	Credentials    struct {
-		PrefCredential        int         `json:"PrefCredential"`
-		HasPassword           bool        `json:"HasPassword"`
-		RemoteNgcParams       interface{} `json:"RemoteNgcParams"`
-		FidoParams            interface{} `json:"FidoParams"`
-		SasParams             interface{} `json:"SasParams"`
-		CertAuthParams        interface{} `json:"CertAuthParams"`
-		GoogleParams          interface{} `json:"GoogleParams"`
-		FacebookParams        interface{} `json:"FacebookParams"`
-		FederationRedirectURL string      `json:"FederationRedirectUrl"`
+		PrefCredential        int              `json:"PrefCredential"`
+		HasPassword           bool             `json:"HasPassword"`
+		RemoteNgcParams       *remoteNgcParams `json:"RemoteNgcParams"`
+		FidoParams            interface{}      `json:"FidoParams"`
+		SasParams             interface{}      `json:"SasParams"`
+		CertAuthParams        interface{}      `json:"CertAuthParams"`
+		GoogleParams          interface{}      `json:"GoogleParams"`
+		FacebookParams        interface{}      `json:"FacebookParams"`
+		FederationRedirectURL string           `json:"FederationRedirectUrl"`
 	} `json:"Credentials"`
 	FlowToken          string `json:"FlowToken"`
 	IsSignupDisallowed bool   `json:"IsSignupDisallowed"`
 	APICanary          string `json:"apiCanary"`
 }
 
+// The passwordless phone sign in started by GetCredentialType, Entropy is the number to match in the Authenticator app
+type remoteNgcParams struct {
+	SessionIdentifier string `json:"SessionIdentifier"`
+	Entropy           int    `json:"Entropy"`
+	DefaultType       int    `json:"DefaultType"`
+}
+
+// Session State Request struct
+type sessionStateRequest struct {
+	DeviceCode string `json:"DeviceCode"`
+}
+
+// Session State Response struct
+type sessionStateResponse struct {
+	SessionState       int `json:"SessionState"`
+	AuthorizationState int `json:"AuthorizationState"`
+}
+
 // MFA Request struct
 type mfaRequest struct {
 	AuthMethodID       string `json:"AuthMethodId"`
@@ -137,12 +210,21 @@ type userProof struct {
 // New create a new AzureAD client
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
+	if idpAccount.AzureADAuthMethod != "" && !contains(authMethods, idpAccount.AzureADAuthMethod) {
+		return nil, fmt.Errorf("unsupported azuread_auth_method %s, expected one of %s", idpAccount.AzureADAuthMethod, strings.Join(authMethods, ", "))
+	}
+
 	tr := &http.Transport{
 		Proxy:           http.ProxyFromEnvironment,
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: idpAccount.SkipVerify, Renegotiation: tls.RenegotiateFreelyAsClient},
 	}
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -153,25 +235,51 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 	}, nil
 }
 
+// NewBrokered create an AzureAD client continuing a login another IdP brokered to AzureAD, sharing its HTTP
+// client so the cookies set on the way to the AzureAD sign in page are sent back
+func NewBrokered(idpAccount *cfg.IDPAccount, client *provider.HTTPClient) (*Client, error) {
+
+	if idpAccount.AzureADAuthMethod != "" && !contains(authMethods, idpAccount.AzureADAuthMethod) {
+		return nil, fmt.Errorf("unsupported azuread_auth_method %s, expected one of %s", idpAccount.AzureADAuthMethod, strings.Join(authMethods, ", "))
+	}
+
+	return &Client{
+		client:     client,
+		idpAccount: idpAccount,
+	}, nil
+}
+
 // Authenticate to AzureAD and return the data from the body of the SAML assertion.
 func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
-	var samlAssertion string
-	var res *http.Response
-	var err error
-	var resBody []byte
-	var resBodyStr string
-	var convergedResponse *ConvergedResponse
 
 	// idpAccount.URL = https://account.activedirectory.windowsazure.com
 
 	// startSAML
 	startURL := fmt.Sprintf("%s/applications/redirecttofederatedapplication.aspx?Operation=LinkedSignIn&applicationId=%s", ac.idpAccount.URL, ac.idpAccount.AppID)
 
-	res, err = ac.client.Get(startURL)
+	res, err := ac.client.Get(startURL)
 	if err != nil {
-		return samlAssertion, errors.Wrap(err, "error retrieving entry URL")
+		return "", errors.Wrap(err, "error retrieving entry URL")
 	}
 
+	return ac.authenticate(res, loginDetails)
+}
+
+// AuthenticateBrokered signs into AzureAD from the sign in page another IdP redirected to, returning the SAML
+// response AzureAD sends back to that IdP
+func (ac *Client) AuthenticateBrokered(res *http.Response, loginDetails *creds.LoginDetails) (string, error) {
+	return ac.authenticate(res, loginDetails)
+}
+
+func (ac *Client) authenticate(res *http.Response, loginDetails *creds.LoginDetails) (string, error) {
+	ac.ask = loginDetails.Asker()
+
+	var samlAssertion string
+	var err error
+	var resBody []byte
+	var resBodyStr string
+	var convergedResponse *ConvergedResponse
+
 AuthProcessor:
 	for {
 		resBody, _ = io.ReadAll(res.Body)
@@ -179,7 +287,15 @@ AuthProcessor:
 		// reset res.Body so it can be read again later if required
 		res.Body = io.NopCloser(bytes.NewBuffer(resBody))
 
+		pgid := ac.pageID(resBodyStr)
+
 		switch {
+		case pgid == pageConvergedError:
+			logger.Debug("processing ConvergedError")
+			return samlAssertion, ac.interruptError(resBodyStr)
+		case pgid == pageTermsOfUse:
+			logger.Debug("processing ConvergedTOU")
+			res, err = ac.processTermsOfUse(res, resBodyStr)
 		case strings.Contains(resBodyStr, "ConvergedSignIn"):
 			logger.Debug("processing ConvergedSignIn")
 			res, err = ac.processConvergedSignIn(res, resBodyStr, loginDetails)
@@ -208,6 +324,10 @@ AuthProcessor:
 					return samlAssertion, errors.Wrap(err, "unmarshal error")
 				}
 				logger.Debug("unknown process step found:", convergedResponse.Pgid)
+				if convergedResponse.SErrorCode != "" {
+					return samlAssertion, interruptError(convergedResponse)
+				}
+				return samlAssertion, fmt.Errorf("unsupported AzureAD page %s", convergedResponse.Pgid)
 			} else {
 				logger.Debug("reached an unknown page within the authentication process")
 			}
@@ -245,16 +365,79 @@ func (ac *Client) processConvergedSignIn(res *http.Response, srcBodyStr string,
 		if err != nil {
 			return res, err
 		}
-	} else {
+		return res, nil
+	}
+
+	authMethod, err := ac.chooseAuthMethod(getCredentialTypeResponse)
+	if err != nil {
+		return res, err
+	}
+
+	switch authMethod {
+	case authMethodPhoneAppNotification:
+		res, err = ac.processRemoteNgcAuthentication(loginRequestUrl, refererUrl, loginDetails, convergedResponse, getCredentialTypeResponse)
+	default:
 		res, err = ac.processAuthentication(loginRequestUrl, refererUrl, loginDetails, convergedResponse)
-		if err != nil {
-			return res, err
-		}
+	}
+	if err != nil {
+		return res, err
 	}
 
 	return res, nil
 }
 
+// availableAuthMethods the sign in methods of the account, from the credentials GetCredentialType found for it
+func availableAuthMethods(getCredentialTypeResponse GetCredentialTypeResponse) []string {
+	var methods []string
+
+	credentials := getCredentialTypeResponse.Credentials
+	if credentials.HasPassword {
+		methods = append(methods, authMethodPassword)
+	}
+	if credentials.RemoteNgcParams != nil {
+		methods = append(methods, authMethodPhoneAppNotification)
+	}
+	if credentials.FidoParams != nil {
+		methods = append(methods, authMethodFIDO)
+	}
+
+	return methods
+}
+
+// chooseAuthMethod picks the sign in method, the one pinned by azuread_auth_method, the only one the account has
+// or the one the user chooses
+func (ac *Client) chooseAuthMethod(getCredentialTypeResponse GetCredentialTypeResponse) (string, error) {
+	available := availableAuthMethods(getCredentialTypeResponse)
+
+	// accounts only GetCredentialType knows nothing about still get the password sign in they always had
+	if len(available) == 0 {
+		return authMethodPassword, nil
+	}
+
+	if ac.idpAccount.AzureADAuthMethod != "" {
+		if !contains(available, ac.idpAccount.AzureADAuthMethod) {
+			return "", fmt.Errorf("azuread_auth_method %s isn't available for the account, it can sign in with %s", ac.idpAccount.AzureADAuthMethod, strings.Join(available, ", "))
+		}
+		return ac.idpAccount.AzureADAuthMethod, nil
+	}
+
+	var supported []string
+	for _, method := range available {
+		if contains(authMethods, method) {
+			supported = append(supported, method)
+		}
+	}
+
+	switch len(supported) {
+	case 0:
+		return "", errors.New("the account only signs in with a security key, which saml2aws doesn't support with AzureAD")
+	case 1:
+		return supported[0], nil
+	}
+
+	return supported[ac.ask.Choose("Select an AzureAD sign in method", supported)], nil
+}
+
 func (ac *Client) requestGetCredentialType(refererUrl string, loginDetails *creds.LoginDetails, convergedResponse *ConvergedResponse) (GetCredentialTypeResponse, *http.Response, error) {
 	var res *http.Response
 	var getCredentialTypeResponse GetCredentialTypeResponse
@@ -263,9 +446,9 @@ func (ac *Client) requestGetCredentialType(refererUrl string, loginDetails *cred
 		Username:             loginDetails.Username,
 		IsOtherIdpSupported:  true,
 		CheckPhones:          false,
-		IsRemoteNGCSupported: false,
+		IsRemoteNGCSupported: ac.idpAccount.AzureADAuthMethod != authMethodPassword,
 		IsCookieBannerShown:  false,
-		IsFidoSupported:      false,
+		IsFidoSupported:      ac.idpAccount.AzureADAuthMethod != authMethodPassword,
 		OriginalRequest:      convergedResponse.SCtx,
 		FlowToken:            convergedResponse.SFT,
 	}
@@ -349,7 +532,7 @@ func (ac *Client) processAuthentication(loginUrl string, refererUrl string, logi
 
 	// 50058: user is not signed in (yet)
 	if convergedResponse.SErrorCode != "" && convergedResponse.SErrorCode != "50058" {
-		return res, fmt.Errorf("login error %s", convergedResponse.SErrorCode)
+		return res, interruptError(convergedResponse)
 	}
 
 	formValues := url.Values{}
@@ -377,6 +560,107 @@ func (ac *Client) processAuthentication(loginUrl string, refererUrl string, logi
 	return res, nil
 }
 
+// processRemoteNgcAuthentication signs in without a password, with the request GetCredentialType sent to the Authenticator app
+func (ac *Client) processRemoteNgcAuthentication(loginUrl string, refererUrl string, loginDetails *creds.LoginDetails, convergedResponse *ConvergedResponse, getCredentialTypeResponse GetCredentialTypeResponse) (*http.Response, error) {
+	var res *http.Response
+	var err error
+	var req *http.Request
+
+	params := getCredentialTypeResponse.Credentials.RemoteNgcParams
+
+	if params.Entropy == 0 {
+		ac.ask.Display("Approve the sign in request in your Authenticator app.")
+	} else {
+		ac.ask.Display(fmt.Sprintf("Approve the sign in request in your Authenticator app, entering the number: %d", params.Entropy))
+	}
+
+	err = ac.waitRemoteNgcApproval(convergedResponse, params)
+	if err != nil {
+		return res, err
+	}
+
+	flowToken := convergedResponse.SFT
+	if getCredentialTypeResponse.FlowToken != "" {
+		flowToken = getCredentialTypeResponse.FlowToken
+	}
+
+	formValues := url.Values{}
+	formValues.Set("canary", convergedResponse.Canary)
+	formValues.Set("hpgrequestid", convergedResponse.SessionID)
+	formValues.Set(convergedResponse.SFTName, flowToken)
+	formValues.Set("ctx", convergedResponse.SCtx)
+	formValues.Set("login", loginDetails.Username)
+	formValues.Set("loginfmt", loginDetails.Username)
+	formValues.Set("type", loginTypeRemoteNgc)
+	formValues.Set("psRNGCSLK", params.SessionIdentifier)
+	formValues.Set("psRNGCDefaultType", fmt.Sprint(params.DefaultType))
+	formValues.Set("psRNGCEntropy", fmt.Sprint(params.Entropy))
+
+	req, err = http.NewRequest("POST", loginUrl, strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return res, errors.Wrap(err, "error building passwordless login request")
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Referer", refererUrl)
+
+	res, err = ac.client.Do(req)
+	if err != nil {
+		return res, errors.Wrap(err, "error retrieving passwordless login results")
+	}
+
+	return res, nil
+}
+
+// waitRemoteNgcApproval polls the session state until the passwordless sign in is approved, rejected or expires
+func (ac *Client) waitRemoteNgcApproval(convergedResponse *ConvergedResponse, params *remoteNgcParams) error {
+	if convergedResponse.URLSessionState == "" {
+		return errors.New("unable to locate the AzureAD session state URL for the passwordless sign in")
+	}
+
+	reqBodyJson, err := json.Marshal(sessionStateRequest{DeviceCode: params.SessionIdentifier})
+	if err != nil {
+		return errors.Wrap(err, "failed to build session state request JSON")
+	}
+
+	deadline := time.Now().Add(sessionStateTimeout)
+	for {
+		req, err := http.NewRequest("POST", convergedResponse.URLSessionState, bytes.NewReader(reqBodyJson))
+		if err != nil {
+			return errors.Wrap(err, "error building session state request")
+		}
+
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("canary", convergedResponse.APICanary)
+		req.Header.Add("client-request-id", convergedResponse.CorrelationID)
+		req.Header.Add("hpgrequestid", convergedResponse.SessionID)
+
+		res, err := ac.client.Do(req)
+		if err != nil {
+			return errors.Wrap(err, "error retrieving session state")
+		}
+
+		var sessionState sessionStateResponse
+		err = json.NewDecoder(res.Body).Decode(&sessionState)
+		res.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "error decoding session state")
+		}
+
+		switch sessionState.AuthorizationState {
+		case remoteNgcApproved:
+			return nil
+		case remoteNgcRejected:
+			return errors.New("the sign in request was rejected in the Authenticator app")
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("the sign in request wasn't approved in the Authenticator app in time")
+		}
+		time.Sleep(sessionStatePollInterval)
+	}
+}
+
 func (ac *Client) processKmsiInterrupt(res *http.Response, srcBodyStr string) (*http.Response, error) {
 	var convergedResponse *ConvergedResponse
 	var err error
@@ -388,7 +672,12 @@ func (ac *Client) processKmsiInterrupt(res *http.Response, srcBodyStr string) (*
 	formValues := url.Values{}
 	formValues.Set(convergedResponse.SFTName, convergedResponse.SFT)
 	formValues.Set("ctx", convergedResponse.SCtx)
-	formValues.Set("LoginOptions", "1")
+	// saml2aws doesn't keep the AzureAD cookies between logins, so staying signed in only matters to the tenant's sign in logs
+	if ac.idpAccount.AzureADKmsi {
+		formValues.Set("LoginOptions", kmsiStaySignedIn)
+	} else {
+		formValues.Set("LoginOptions", kmsiDontStaySignedIn)
+	}
 
 	req, err := http.NewRequest("POST", ac.fullUrl(res, convergedResponse.URLPost), strings.NewReader(formValues.Encode()))
 	if err != nil {
@@ -457,14 +746,14 @@ func (ac *Client) processMfa(mfas []userProof, convergedResponse *ConvergedRespo
 			SessionID:    mfaResp.SessionID,
 		}
 		if mfaReq.AuthMethodID == "PhoneAppOTP" || mfaReq.AuthMethodID == "OneWaySMS" {
-			verifyCode := prompter.StringRequired("Enter verification code")
+			verifyCode := ac.ask.StringRequired("Enter verification code")
 			mfaReq.AdditionalAuthData = verifyCode
 		}
 		if mfaReq.AuthMethodID == "PhoneAppNotification" && i == 0 {
 			if mfaResp.Entropy == 0 {
-				prompter.Display("Phone approval required.")
+				ac.ask.Display("Phone approval required.")
 			} else {
-				prompter.Display(fmt.Sprintf("Phone approval required. Entropy is: %d", mfaResp.Entropy))
+				ac.ask.Display(fmt.Sprintf("Phone approval required. Entropy is: %d", mfaResp.Entropy))
 			}
 		}
 
@@ -654,11 +943,12 @@ func (ac *Client) processConvergedProofUpRedirect(res *http.Response, srcBodyStr
 
 	// 50058: user is not signed in (yet)
 	if convergedResponse.SErrorCode != "" && convergedResponse.SErrorCode != "50058" {
-		return res, fmt.Errorf("login error %s", convergedResponse.SErrorCode)
+		return res, interruptError(convergedResponse)
 	}
 
+	// "More information required" can only be postponed for a while, after that the registration has to be done
 	if convergedResponse.URLSkipMfaRegistration == "" {
-		return res, errors.Wrap(err, "skip MFA not possible")
+		return res, fmt.Errorf("AzureAD requires more information to keep your account secure, register it at %s and login again", mfaRegistrationSetupURL)
 	}
 
 	res, err = ac.client.Get(convergedResponse.URLSkipMfaRegistration)
@@ -669,6 +959,77 @@ func (ac *Client) processConvergedProofUpRedirect(res *http.Response, srcBodyStr
 	return res, nil
 }
 
+// processTermsOfUse asks to accept the terms of use a Conditional Access policy requires before continuing
+func (ac *Client) processTermsOfUse(res *http.Response, srcBodyStr string) (*http.Response, error) {
+	var convergedResponse *ConvergedResponse
+
+	if err := ac.unmarshalEmbeddedJson(srcBodyStr, &convergedResponse); err != nil {
+		return res, errors.Wrap(err, "terms of use response unmarshal error")
+	}
+
+	if convergedResponse.URLTermsOfUse != "" {
+		ac.ask.Display(fmt.Sprintf("Your organisation requires you to accept its terms of use: %s", convergedResponse.URLTermsOfUse))
+	}
+	if ac.ask.Choose("Accept the terms of use?", []string{"Accept", "Decline"}) != 0 {
+		return res, errors.New("the terms of use were declined, they have to be accepted to login")
+	}
+
+	formValues := url.Values{}
+	formValues.Set(convergedResponse.SFTName, convergedResponse.SFT)
+	formValues.Set("ctx", convergedResponse.SCtx)
+	formValues.Set("canary", convergedResponse.Canary)
+	formValues.Set("acceptConsent", "true")
+
+	req, err := http.NewRequest("POST", ac.fullUrl(res, convergedResponse.URLPost), strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return res, errors.Wrap(err, "error building terms of use request")
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err = ac.client.Do(req)
+	if err != nil {
+		return res, errors.Wrap(err, "error retrieving terms of use results")
+	}
+
+	return res, nil
+}
+
+// interruptError the error of an interrupt page, which can't be answered
+func (ac *Client) interruptError(srcBodyStr string) error {
+	var convergedResponse *ConvergedResponse
+
+	if err := ac.unmarshalEmbeddedJson(srcBodyStr, &convergedResponse); err != nil {
+		return errors.Wrap(err, "ConvergedError response unmarshal error")
+	}
+
+	return interruptError(convergedResponse)
+}
+
+func interruptError(convergedResponse *ConvergedResponse) error {
+	if msg, ok := interruptErrors[convergedResponse.SErrorCode]; ok {
+		return fmt.Errorf("login error %s: %s", convergedResponse.SErrorCode, msg)
+	}
+	if convergedResponse.SErrTxt != "" {
+		return fmt.Errorf("login error %s: %s", convergedResponse.SErrorCode, convergedResponse.SErrTxt)
+	}
+	return fmt.Errorf("login error %s", convergedResponse.SErrorCode)
+}
+
+// pageID the pgid of the page's $Config, empty when the page has none
+func (ac *Client) pageID(resBodyStr string) string {
+	var convergedResponse *ConvergedResponse
+
+	if !strings.Contains(resBodyStr, "$Config=") {
+		return ""
+	}
+	if err := ac.unmarshalEmbeddedJson(resBodyStr, &convergedResponse); err != nil || convergedResponse == nil {
+		return ""
+	}
+
+	return convergedResponse.Pgid
+}
+
 func (ac *Client) unmarshalEmbeddedJson(resBodyStr string, v any) error {
 	/*
 	 * data is embedded in a javascript object
@@ -780,3 +1141,12 @@ func (ac *Client) getSamlAssertion(resBodyStr string) (string, error) {
 
 	return samlAssertion, nil
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -13,6 +13,7 @@ import (
 	mrand "math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
 	"sync"
@@ -59,6 +60,7 @@ type FixtureData struct {
 	UrlProcessAuth                        string // https://login.microsoftonline.com/common/SAS/ProcessAuth
 	UrlHiddenForm                         string // https://account.activedirectory.windowsazure.com/
 	UrlSamlRequest                        string // https://login.microsoftonline.com/{{.ApplicationId}}/saml2?SAMLRequest={{.SAMLRequestPayload}}
+	UrlSessionState                       string // https://login.microsoftonline.com/common/DeviceCodeStatus
 	TenantId                              string // 0cfbdd7a-1d78-47ea-b458-8aa3c2558727
 	SosId                                 string // 7f55cb4c-c904-4255-8d26-faa8da77c492
 	ProofUpToken                          string // UVrFbiiZj6kdD6oWm4k87CkipgjEbKhlq_dKoMTo8p0TRCf4utimEAnOizRQ7qAoHaotT08os5kctHfJhXw7dkactSsYjtYo9Lt_1vlPPmZ8i0FtfrwjMeztp0sMY6PHkfRO_sWIHR2bsvIpjaKqqNTJ8PZCuwNmfR8Tx2Jdud3F1FcUgkF3-MG5omxJR7oaueRn1SvnjR-sWEleKptBqLTFnVwNeY8kVfpiKV4liNACZkWc9N5CJRC7HO4aLHVUkKcWaCERUZWeaHh0Bdk_aHSZFll1C6yBv0v4IIJfTQuCOdRMXmqvSpxpRUcwgZ7vdY6krAYUAV8SG926Fptr3if69AM5GHxKN4AlyNNJZ5ghv0yqwI4aGTg1vsanq0q8ZE80TOCBZdMz39Tr_J5MKMW2HO7lEMPtZYBCYwz3Z4nzbgWo9aB65GcxNcnzXgBMeiwjgxQphpFahbj89Rc8H0PWbN4Yhh-aDlv_UMwd2lp1I98hxdEn-8uA56xCE4l1647RuwSiCIfzE_6dYxXm8Q
@@ -566,6 +568,11 @@ func responseFixtures(host string, variableFixture FixtureData) *FixtureData {
 	} else {
 		fixtureData.UrlSamlRequest = ""
 	}
+	if variableFixture.UrlSessionState != "" {
+		fixtureData.UrlSessionState = scheme + host + variableFixture.UrlSessionState
+	} else {
+		fixtureData.UrlSessionState = ""
+	}
 	if variableFixture.AuthMethodId != "" {
 		fixtureData.AuthMethodId = variableFixture.AuthMethodId
 	}
@@ -637,3 +644,238 @@ func TestAad_unmarshalEmbeddedJson(t *testing.T) {
 		})
 	}
 }
+
+func Test_AuthenticateInterrupts(t *testing.T) {
+	// serves the sign in, answering the password with the interrupt page and the rest of the flow after it
+	newServer := func(t *testing.T, interrupt string, interruptFixture FixtureData, interruptAnswer func(r *http.Request)) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, interrupt, interruptFixture)
+			case "/interruptAnswer":
+				require.Nil(t, r.ParseForm())
+				interruptAnswer(r)
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+	}
+
+	for _, kmsi := range []bool{true, false} {
+		t.Run(fmt.Sprintf("KMSI answered with azuread_kmsi %v", kmsi), func(t *testing.T) {
+			var loginOptions string
+			ts := newServer(t, "KmsiInterrupt.html", FixtureData{UrlPost: "/interruptAnswer"}, func(r *http.Request) {
+				loginOptions = r.PostForm.Get("LoginOptions")
+			})
+			defer ts.Close()
+
+			ac, loginDetails := setupTestClient(t, ts)
+			ac.idpAccount.AzureADKmsi = kmsi
+			got, err := ac.Authenticate(loginDetails)
+			require.Nil(t, err)
+			require.NotEmpty(t, got)
+			if kmsi {
+				require.Equal(t, kmsiStaySignedIn, loginOptions)
+			} else {
+				require.Equal(t, kmsiDontStaySignedIn, loginOptions)
+			}
+		})
+	}
+	t.Run("Terms of use accepted", func(t *testing.T) {
+		var accepted string
+		ts := newServer(t, "ConvergedTOU.html", FixtureData{UrlPost: "/interruptAnswer"}, func(r *http.Request) {
+			accepted = r.PostForm.Get("acceptConsent")
+		})
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("Display", mock.Anything).Return()
+		pr.Mock.On("Choose", "Accept the terms of use?", []string{"Accept", "Decline"}).Return(0)
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.Equal(t, "true", accepted)
+	})
+	t.Run("Terms of use declined", func(t *testing.T) {
+		ts := newServer(t, "ConvergedTOU.html", FixtureData{UrlPost: "/interruptAnswer"}, func(r *http.Request) {
+			t.Fatal("declined terms of use were submitted")
+		})
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("Display", mock.Anything).Return()
+		pr.Mock.On("Choose", "Accept the terms of use?", []string{"Accept", "Decline"}).Return(1)
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.EqualError(t, err, "the terms of use were declined, they have to be accepted to login")
+	})
+	t.Run("More information required can't be skipped", func(t *testing.T) {
+		ts := newServer(t, "ConvergedProofUpRedirect.html", FixtureData{}, nil)
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.EqualError(t, err, "AzureAD requires more information to keep your account secure, register it at https://aka.ms/mfasetup and login again")
+	})
+	t.Run("Conditional Access block", func(t *testing.T) {
+		ts := newServer(t, "ConvergedError.html", FixtureData{SErrorCode: "53003"}, nil)
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.EqualError(t, err, "login error 53003: access was blocked by a Conditional Access policy")
+	})
+	t.Run("Unknown interrupt error", func(t *testing.T) {
+		ts := newServer(t, "ConvergedError.html", FixtureData{SErrorCode: "90000"}, nil)
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.EqualError(t, err, "login error 90000: AADSTS90000: The sign in was interrupted.")
+	})
+}
+
+func Test_AuthenticateSignInMethods(t *testing.T) {
+	sessionStatePollInterval = 0
+
+	// serves a sign in offering the password and the passwordless phone sign in, which is approved after the
+	// authorization states polled
+	newServer := func(t *testing.T, authorizationStates []int, login func(r *http.Request)) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+					UrlSessionState:      "/sessionState",
+				})
+			case "/getCredentialType":
+				var reqBody GetCredentialTypeRequest
+				require.Nil(t, json.NewDecoder(r.Body).Decode(&reqBody))
+				if reqBody.IsRemoteNGCSupported {
+					writeFixtureBytes(t, w, r, "GetCredentialType_remoteNgc.json", FixtureData{Entropy: "42"})
+				} else {
+					writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+				}
+			case "/sessionState":
+				var reqBody sessionStateRequest
+				require.Nil(t, json.NewDecoder(r.Body).Decode(&reqBody))
+				require.Equal(t, genFixtureData().SessionState, reqBody.DeviceCode)
+				state := authorizationStates[0]
+				authorizationStates = authorizationStates[1:]
+				_, _ = fmt.Fprintf(w, `{"SessionState":1,"AuthorizationState":%d}`, state)
+			case "/defaultLogin":
+				require.Nil(t, r.ParseForm())
+				login(r)
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+	}
+
+	t.Run("Passwordless phone sign in chosen", func(t *testing.T) {
+		var form url.Values
+		ts := newServer(t, []int{0, 1, remoteNgcApproved}, func(r *http.Request) {
+			form = r.PostForm
+		})
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("Choose", "Select an AzureAD sign in method", []string{"Password", "PhoneAppNotification"}).Return(1)
+		pr.Mock.On("Display", "Approve the sign in request in your Authenticator app, entering the number: 42").Return()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.Equal(t, loginTypeRemoteNgc, form.Get("type"))
+		require.Equal(t, genFixtureData().SessionState, form.Get("psRNGCSLK"))
+		require.Equal(t, "42", form.Get("psRNGCEntropy"))
+		require.Empty(t, form.Get("passwd"))
+		pr.AssertExpectations(t)
+	})
+	t.Run("Passwordless phone sign in rejected", func(t *testing.T) {
+		ts := newServer(t, []int{remoteNgcRejected}, func(r *http.Request) {
+			t.Fatal("rejected sign in was submitted")
+		})
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("Display", mock.Anything).Return()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		ac.idpAccount.AzureADAuthMethod = authMethodPhoneAppNotification
+		_, err := ac.Authenticate(loginDetails)
+		require.EqualError(t, err, "the sign in request was rejected in the Authenticator app")
+	})
+	t.Run("Password pinned", func(t *testing.T) {
+		var form url.Values
+		ts := newServer(t, nil, func(r *http.Request) {
+			form = r.PostForm
+		})
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		ac.idpAccount.AzureADAuthMethod = authMethodPassword
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.Equal(t, "test123", form.Get("passwd"))
+	})
+}
+
+func Test_chooseAuthMethod(t *testing.T) {
+	passwordOnly := GetCredentialTypeResponse{}
+	passwordOnly.Credentials.HasPassword = true
+
+	securityKeyOnly := GetCredentialTypeResponse{}
+	securityKeyOnly.Credentials.FidoParams = map[string]interface{}{}
+
+	ac := Client{idpAccount: &cfg.IDPAccount{}}
+
+	method, err := ac.chooseAuthMethod(passwordOnly)
+	require.Nil(t, err)
+	require.Equal(t, authMethodPassword, method)
+
+	_, err = ac.chooseAuthMethod(securityKeyOnly)
+	require.EqualError(t, err, "the account only signs in with a security key, which saml2aws doesn't support with AzureAD")
+
+	ac.idpAccount.AzureADAuthMethod = authMethodPhoneAppNotification
+	_, err = ac.chooseAuthMethod(passwordOnly)
+	require.EqualError(t, err, "azuread_auth_method PhoneAppNotification isn't available for the account, it can sign in with Password")
+
+	_, err = New(&cfg.IDPAccount{AzureADAuthMethod: "Fingerprint"})
+	require.EqualError(t, err, "unsupported azuread_auth_method Fingerprint, expected one of Password, PhoneAppNotification")
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/duo"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 	"github.com/versent/saml2aws/v2/pkg/provider"
 )
@@ -33,8 +35,39 @@ const (
 	MFA_PROMPT
 	AZURE_MFA_WAIT
 	AZURE_MFA_SERVER_WAIT
+	AZURE_MFA_SERVER_OTP
+	MFA_CHOICE
+	DUO_FRAME
+	DUO_UNIVERSAL
 )
 
+// the AuthMethod of the MFA adapters saml2aws handles
+const (
+	adapterAzureMFA              = "AzureMfaAuthentication"
+	adapterAzureMFAServer        = "AzureMfaServerAuthentication"
+	adapterVIPWindowsAccountName = "VIPAuthenticationProviderWindowsAccountName"
+	adapterVIPUPN                = "VIPAuthenticationProviderUPN"
+	adapterDefender              = "Defender AD FS Adapter"
+)
+
+// codeInputSelector the fields an adapter asks for a code in
+const codeInputSelector = "input[type=text], input[type=tel], input[type=number], input[type=password]"
+
+// azureMFAPollInterval how often the Azure MFA pages are resubmitted while waiting for the user
+var azureMFAPollInterval = 1 * time.Second
+
+var selectOptionPattern = regexp.MustCompile(`SelectOption\(\s*['"]([^'"]+)['"]`)
+
+// mfaContext the state carried between the MFA pages
+type mfaContext struct {
+	token        string         // the --mfa-token, used for the first code asked for
+	pageURL      string         // the ADFS page relative form actions resolve against
+	submitURL    string         // where the adapter's forms are posted
+	instructions string         // the instructions last shown while waiting for Azure MFA
+	duoFactor    string         // the --duo-mfa-option, the Duo factor used without asking
+	ask          prompter.Asker // asks the user through the prompter of the login
+}
+
 // New create a new ADFS client
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
@@ -43,7 +76,12 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: idpAccount.SkipVerify, Renegotiation: tls.RenegotiateFreelyAsClient},
 	}
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -54,24 +92,52 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 	}, nil
 }
 
+// NewBrokered create an ADFS client continuing a login another IdP brokered to ADFS, sharing its HTTP client
+// so the cookies set on the way to the ADFS login page are sent back
+func NewBrokered(idpAccount *cfg.IDPAccount, client *provider.HTTPClient) *Client {
+	return &Client{
+		client:     client,
+		idpAccount: idpAccount,
+	}
+}
+
+// LoginPageMarkers the sign in form the login posts the username and password to
+func (ac *Client) LoginPageMarkers() []provider.PageMarker {
+	return provider.UsernamePasswordMarkers
+}
+
 // Authenticate to ADFS and return the data from the body of the SAML assertion.
 func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
 
-	var authSubmitURL string
-	var samlAssertion string
-	var instructions string
-
 	awsURN := url.QueryEscape(ac.idpAccount.AmazonWebservicesURN)
 
 	adfsURL := fmt.Sprintf("%s/adfs/ls/IdpInitiatedSignOn.aspx?loginToRp=%s", loginDetails.URL, awsURN)
 
-	mfaToken := loginDetails.MFAToken
-
 	doc, err := ac.get(adfsURL)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to get adfs page")
 	}
 
+	return ac.authenticate(doc, adfsURL, loginDetails)
+}
+
+// AuthenticateBrokered logs into ADFS from the login page another IdP redirected to, returning the SAML
+// response ADFS sends back to that IdP
+func (ac *Client) AuthenticateBrokered(res *http.Response, loginDetails *creds.LoginDetails) (string, error) {
+	defer res.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to build document from response")
+	}
+
+	return ac.authenticate(doc, res.Request.URL.String(), loginDetails)
+}
+
+func (ac *Client) authenticate(doc *goquery.Document, adfsURL string, loginDetails *creds.LoginDetails) (string, error) {
+
+	var authSubmitURL string
+
 	authForm := url.Values{}
 
 	doc.Find("input").Each(func(i int, s *goquery.Selection) {
@@ -100,84 +166,258 @@ func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 	}
 
 	if authSubmitURL == "" {
-		return samlAssertion, fmt.Errorf("unable to locate IDP authentication form submit URL")
-	} else if strings.HasPrefix(authSubmitURL, "/") {
-		//
-		// The server returned a relative URL. Make it absolute.
-		//
-		parsedUrl, err := url.Parse(adfsURL)
-		if err != nil {
-			return "", errors.Wrap(err, "failed to parse ADFS URL")
-		}
-		parsedPath, err := url.Parse(authSubmitURL)
-		if err != nil {
-			return "", errors.Wrap(err, "failed to parse authSubmitURL fragment")
-		}
-		authSubmitURL = parsedUrl.ResolveReference(parsedPath).String()
+		return "", fmt.Errorf("unable to locate IDP authentication form submit URL")
+	}
+	authSubmitURL, err := resolveURL(adfsURL, authSubmitURL)
+	if err != nil {
+		return "", err
 	}
 
 	doc, err = ac.submit(authSubmitURL, authForm)
 	if err != nil {
-		return samlAssertion, errors.Wrap(err, "failed to submit adfs auth form")
+		return "", errors.Wrap(err, "failed to submit adfs auth form")
+	}
+
+	mfa := &mfaContext{
+		token:     loginDetails.MFAToken,
+		pageURL:   adfsURL,
+		submitURL: authSubmitURL,
+		duoFactor: loginDetails.DuoMFAOption,
+		ask:       loginDetails.Asker(),
 	}
 
 	for {
 		responseType, samlAssertion, err := checkResponse(doc)
+		if err != nil {
+			return "", err
+		}
 
 		switch responseType {
 		case SAML_RESPONSE:
-			return samlAssertion, err
+			return samlAssertion, nil
+		case MFA_CHOICE:
+			doc, err = ac.chooseMFAAdapter(doc, mfa)
 		case MFA_PROMPT:
-			otpForm := url.Values{}
-			if mfaToken == "" {
-				mfaToken = prompter.RequestSecurityCode("000000")
-			}
+			doc, err = ac.submitOTP(doc, mfa, updateOTPFormData)
+		case AZURE_MFA_SERVER_OTP:
+			doc, err = ac.submitOTP(doc, mfa, updateCodeFormData)
+		case AZURE_MFA_SERVER_WAIT, AZURE_MFA_WAIT:
+			doc, err = ac.waitAzureMFA(doc, mfa, responseType)
+		case DUO_FRAME:
+			doc, err = ac.verifyDuoFrame(doc, mfa)
+		case DUO_UNIVERSAL:
+			doc, err = ac.verifyDuoUniversalPrompt(doc, mfa)
+		case UNKNOWN:
+			return "", errors.New("unable to classify response from auth server")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
 
-			doc.Find("input").Each(func(i int, s *goquery.Selection) {
-				updateOTPFormData(otpForm, s, mfaToken)
-			})
-			doc, err = ac.submit(authSubmitURL, otpForm)
-			if err != nil {
-				return samlAssertion, errors.Wrap(err, "error retrieving mfa form results")
-			}
-			mfaToken = ""
-		case AZURE_MFA_SERVER_WAIT:
-			fallthrough
-		case AZURE_MFA_WAIT:
-			azureForm := url.Values{}
-			doc.Find("input").Each(func(i int, s *goquery.Selection) {
-				updatePassthroughFormData(azureForm, s)
-			})
-			sel := doc.Find("p#validEntropyNumber")
-			if sel.Index() != -1 {
-				if instructions != sel.Text() {
-					instructions = sel.Text()
-					log.Println("Open your Microsoft Authenticator app and tap the number you see below to sign in.")
-					log.Println(instructions)
-				}
-			}
-			sel = doc.Find("p#instructions")
-			if sel.Index() != -1 {
-				if instructions != sel.Text() {
-					instructions = sel.Text()
-					log.Println(instructions)
-				}
-			}
-			time.Sleep(1 * time.Second)
-			doc, err = ac.submit(authSubmitURL, azureForm)
-			if err != nil {
-				return samlAssertion, errors.Wrap(err, "error retrieving mfa form results")
+// chooseMFAAdapter picks one of the MFA adapters ADFS offers when several are enabled for the user, the one set
+// with adfs_mfa_adapter or otherwise the one the user chooses
+func (ac *Client) chooseMFAAdapter(doc *goquery.Document, mfa *mfaContext) (*goquery.Document, error) {
+	adapter, err := selectMFAAdapter(mfa.ask, offeredMFAAdapters(doc), ac.idpAccount.ADFSMFAAdapter)
+	if err != nil {
+		return nil, err
+	}
+
+	optionsForm := doc.Find("form#options")
+	action, ok := optionsForm.Attr("action")
+	if !ok {
+		return nil, errors.New("unable to locate MFA choice form submit URL")
+	}
+	submitURL, err := resolveURL(mfa.pageURL, action)
+	if err != nil {
+		return nil, err
+	}
+
+	choiceForm := url.Values{}
+	optionsForm.Find("input").Each(func(i int, s *goquery.Selection) {
+		updatePassthroughFormData(choiceForm, s)
+	})
+	choiceForm.Set("AuthMethod", adapter)
+
+	// the adapter's own forms are posted where the choice was
+	mfa.submitURL = submitURL
+
+	doc, err = ac.submit(submitURL, choiceForm)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error choosing MFA adapter %s", adapter)
+	}
+	return doc, nil
+}
+
+// submitOTP asks for the code the adapter wants, unless one was given with --mfa-token, and submits it
+func (ac *Client) submitOTP(doc *goquery.Document, mfa *mfaContext, updateForm func(url.Values, *goquery.Selection, string)) (*goquery.Document, error) {
+	if errorText := strings.TrimSpace(doc.Find("label#errorText").Text()); errorText != "" {
+		log.Println(errorText)
+	}
+
+	if mfa.token == "" {
+		mfa.token = mfa.ask.RequestSecurityCode("000000")
+	}
+
+	otpForm := url.Values{}
+	doc.Find("input").Each(func(i int, s *goquery.Selection) {
+		updateForm(otpForm, s, mfa.token)
+	})
+	mfa.token = ""
+
+	doc, err := ac.submit(mfa.submitURL, otpForm)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving mfa form results")
+	}
+	return doc, nil
+}
+
+// waitAzureMFA resubmits the page while the Azure MFA adapter waits for the user to answer the phone call or
+// approve the notification
+func (ac *Client) waitAzureMFA(doc *goquery.Document, mfa *mfaContext, responseType AuthResponseType) (*goquery.Document, error) {
+	azureForm := url.Values{}
+	doc.Find("input").Each(func(i int, s *goquery.Selection) {
+		updatePassthroughFormData(azureForm, s)
+	})
+	sel := doc.Find("p#validEntropyNumber")
+	if sel.Index() != -1 {
+		if mfa.instructions != sel.Text() {
+			mfa.instructions = sel.Text()
+			log.Println("Open your Microsoft Authenticator app and tap the number you see below to sign in.")
+			log.Println(mfa.instructions)
+		}
+	}
+	sel = doc.Find("p#instructions")
+	if sel.Index() != -1 {
+		if mfa.instructions != sel.Text() {
+			mfa.instructions = sel.Text()
+			log.Println(mfa.instructions)
+		}
+	}
+	time.Sleep(azureMFAPollInterval)
+	doc, err := ac.submit(mfa.submitURL, azureForm)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving mfa form results")
+	}
+	if responseType == AZURE_MFA_SERVER_WAIT {
+		if errorText := strings.TrimSpace(doc.Find("label#errorText").Text()); errorText != "" {
+			return nil, errors.New(errorText)
+		}
+	}
+	return doc, nil
+}
+
+// duoPrompt a Duo client answering with the HTTP client of ADFS, using the --mfa-token as the passcode
+func (ac *Client) duoPrompt(mfa *mfaContext) *duo.Client {
+	prompt := duo.New(ac.client, duo.Options{
+		Device:   ac.idpAccount.DuoDevice,
+		Factor:   mfa.duoFactor,
+		Passcode: mfa.token,
+		Prompter: mfa.ask.Prompter,
+	})
+	mfa.token = ""
+	return prompt
+}
+
+// verifyDuoFrame answers the traditional Duo prompt the Duo adapter embeds and posts its sig_response back
+// with the adapter's form
+func (ac *Client) verifyDuoFrame(doc *goquery.Document, mfa *mfaContext) (*goquery.Document, error) {
+	frame, _ := duo.FrameFromDocument(doc)
+
+	sigResponse, err := ac.duoPrompt(mfa).VerifyFrame(frame, doc.Url.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "error when interacting with Duo iframe")
+	}
+
+	duoForm := doc.Find("form#duo_form")
+	if duoForm.Length() == 0 {
+		duoForm = doc.Find("form").First()
+	}
+
+	submitURL := mfa.submitURL
+	if action := duoForm.AttrOr("action", frame.PostAction); action != "" {
+		if submitURL, err = resolveURL(doc.Url.String(), action); err != nil {
+			return nil, err
+		}
+	}
+
+	sigForm := url.Values{}
+	duoForm.Find("input").Each(func(i int, s *goquery.Selection) {
+		updatePassthroughFormData(sigForm, s)
+	})
+	sigForm.Set(frame.PostArgument, sigResponse)
+
+	doc, err = ac.submit(submitURL, sigForm)
+	if err != nil {
+		return nil, errors.Wrap(err, "error submitting Duo response")
+	}
+	return doc, nil
+}
+
+// verifyDuoUniversalPrompt answers the Universal Prompt the Duo adapter redirects to and follows Duo back to
+// ADFS with the duo_code
+func (ac *Client) verifyDuoUniversalPrompt(doc *goquery.Document, mfa *mfaContext) (*goquery.Document, error) {
+	callback, err := ac.duoPrompt(mfa).VerifyUniversalPrompt(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "error when interacting with Duo Universal Prompt")
+	}
+
+	doc, err = ac.get(callback.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "error returning to ADFS from Duo")
+	}
+	return doc, nil
+}
+
+// offeredMFAAdapters the adapters listed on the page ADFS shows to choose between them, each one's option calls
+// SelectOption with the adapter's AuthMethod
+func offeredMFAAdapters(doc *goquery.Document) []string {
+	var adapters []string
+	doc.Find("[onclick]").Each(func(i int, s *goquery.Selection) {
+		onclick, _ := s.Attr("onclick")
+		m := selectOptionPattern.FindStringSubmatch(onclick)
+		if m == nil {
+			return
+		}
+		for _, adapter := range adapters {
+			if adapter == m[1] {
+				return
 			}
-			if responseType == AZURE_MFA_SERVER_WAIT {
-				sel := doc.Find("label#errorText")
-				if sel.Index() != -1 {
-					return samlAssertion, errors.New(sel.Text())
-				}
+		}
+		adapters = append(adapters, m[1])
+	})
+	return adapters
+}
+
+func selectMFAAdapter(ask prompter.Asker, adapters []string, configured string) (string, error) {
+	switch {
+	case len(adapters) == 0:
+		return "", errors.New("no MFA adapters offered on the ADFS choice page")
+	case configured != "":
+		for _, adapter := range adapters {
+			if strings.EqualFold(adapter, configured) {
+				return adapter, nil
 			}
-		case UNKNOWN:
-			return samlAssertion, errors.New("unable to classify response from auth server")
 		}
+		return "", fmt.Errorf("adfs_mfa_adapter %s is not offered by ADFS, expected one of %s", configured, strings.Join(adapters, ", "))
+	case len(adapters) == 1:
+		return adapters[0], nil
+	}
+	return adapters[ask.Choose("Select an MFA method", adapters)], nil
+}
+
+// resolveURL makes a form action relative to the page it is on absolute
+func resolveURL(pageURL, action string) (string, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse ADFS URL")
 	}
+	ref, err := url.Parse(action)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse form action")
+	}
+	return base.ResolveReference(ref).String(), nil
 }
 
 func (ac *Client) get(url string) (*goquery.Document, error) {
@@ -192,6 +432,7 @@ func (ac *Client) get(url string) (*goquery.Document, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to build document from response")
 	}
+	doc.Url = res.Request.URL
 	return doc, nil
 }
 
@@ -214,6 +455,7 @@ func (ac *Client) submit(url string, form url.Values) (*goquery.Document, error)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to build document from response")
 	}
+	doc.Url = res.Request.URL
 	return doc, nil
 }
 
@@ -221,6 +463,14 @@ func checkResponse(doc *goquery.Document) (AuthResponseType, string, error) {
 	samlAssertion := ""
 	responseType := UNKNOWN
 
+	// the Duo adapter's pages are answered by the duo package
+	if duo.IsUniversalPrompt(doc) {
+		return DUO_UNIVERSAL, "", nil
+	}
+	if _, ok := duo.FrameFromDocument(doc); ok {
+		return DUO_FRAME, "", nil
+	}
+
 	doc.Find("input").Each(func(i int, s *goquery.Selection) {
 		name, ok := s.Attr("name")
 		if !ok {
@@ -234,25 +484,44 @@ func checkResponse(doc *goquery.Document) (AuthResponseType, string, error) {
 			samlAssertion = val
 			responseType = SAML_RESPONSE
 		}
-		if name == "OathCode" {
+		if name == "OathCode" || name == "VerificationCode" {
 			responseType = MFA_PROMPT
 		}
-		if name == "AuthMethod" {
-			val, _ := s.Attr("value")
-			switch val {
-			case "VIPAuthenticationProviderWindowsAccountName", "VIPAuthenticationProviderUPN", "Defender AD FS Adapter":
-				responseType = MFA_PROMPT
-			case "AzureMfaAuthentication":
-				responseType = AZURE_MFA_WAIT
-			case "AzureMfaServerAuthentication":
-				responseType = AZURE_MFA_SERVER_WAIT
-			}
+	})
+	if responseType == SAML_RESPONSE {
+		return responseType, samlAssertion, nil
+	}
+
+	// the choice page leaves AuthMethod empty for the option picked
+	if doc.Find("input#optionSelection").Length() != 0 {
+		return MFA_CHOICE, "", nil
+	}
+
+	switch authMethod(doc) {
+	case adapterVIPWindowsAccountName, adapterVIPUPN, adapterDefender:
+		responseType = MFA_PROMPT
+	case adapterAzureMFA:
+		responseType = AZURE_MFA_WAIT
+	case adapterAzureMFAServer:
+		// the MFA Server adapter asks for a code for OATH tokens and text messages and waits for phone calls
+		if doc.Find(codeInputSelector).Length() != 0 {
+			responseType = AZURE_MFA_SERVER_OTP
+		} else {
+			responseType = AZURE_MFA_SERVER_WAIT
 		}
-		if name == "VerificationCode" {
-			responseType = MFA_PROMPT
+	}
+	return responseType, samlAssertion, nil
+}
+
+// authMethod the MFA adapter a page belongs to, from the AuthMethod hidden field ADFS posts back
+func authMethod(doc *goquery.Document) string {
+	var method string
+	doc.Find("input[name=AuthMethod]").Each(func(i int, s *goquery.Selection) {
+		if val, ok := s.Attr("value"); ok && val != "" {
+			method = val
 		}
 	})
-	return responseType, samlAssertion, nil
+	return method
 }
 
 func updateFormData(authForm url.Values, s *goquery.Selection, user *creds.LoginDetails) {
@@ -314,3 +583,14 @@ func updatePassthroughFormData(otpForm url.Values, s *goquery.Selection) {
 	otpForm.Add(name, val)
 
 }
+
+// updateCodeFormData fills the code into the visible field of an adapter's page, passing the hidden ones through
+func updateCodeFormData(otpForm url.Values, s *goquery.Selection, token string) {
+	if s.Is(codeInputSelector) {
+		if name, ok := s.Attr("name"); ok {
+			otpForm.Add(name, token)
+		}
+		return
+	}
+	updatePassthroughFormData(otpForm, s)
+}
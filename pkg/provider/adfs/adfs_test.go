@@ -0,0 +1,287 @@
+package adfs
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/duo"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+func loadFixture(t *testing.T, name string) []byte {
+	data, err := os.ReadFile("example/" + name)
+	require.Nil(t, err)
+	return data
+}
+
+func loadDocument(t *testing.T, name string) *goquery.Document {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(loadFixture(t, name)))
+	require.Nil(t, err)
+	return doc
+}
+
+// mfaServer serves the login page, answers the credentials with the first page and each form posted after with
+// the next page handler
+func mfaServer(t *testing.T, pages ...func(r *http.Request) []byte) *httptest.Server {
+	loginPage := loadFixture(t, "loginpage.html")
+	next := 0
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		if r.Method == "GET" {
+			_, _ = w.Write(loginPage)
+			return
+		}
+		if r.PostForm.Get("UserName") != "" {
+			require.Equal(t, "test", r.PostForm.Get("UserName"))
+			require.Equal(t, "test123", r.PostForm.Get("Password"))
+		}
+		require.Less(t, next, len(pages), "unexpected request %s %s", r.Method, r.URL)
+		_, _ = w.Write(pages[next](r))
+		next++
+	}))
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		fixture      string
+		responseType AuthResponseType
+	}{
+		{fixture: "loginpage.html", responseType: UNKNOWN},
+		{fixture: "mfachoice.html", responseType: MFA_CHOICE},
+		{fixture: "azureMfaServerOTP.html", responseType: AZURE_MFA_SERVER_OTP},
+		{fixture: "azureMfaServerCall.html", responseType: AZURE_MFA_SERVER_WAIT},
+		{fixture: "vipWindowsAccountName.html", responseType: MFA_PROMPT},
+		{fixture: "samlresponse.html", responseType: SAML_RESPONSE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			responseType, _, err := checkResponse(loadDocument(t, tt.fixture))
+			require.Nil(t, err)
+			require.Equal(t, tt.responseType, responseType)
+		})
+	}
+}
+
+func TestOfferedMFAAdapters(t *testing.T) {
+	adapters := offeredMFAAdapters(loadDocument(t, "mfachoice.html"))
+	require.Equal(t, []string{adapterAzureMFAServer, adapterVIPWindowsAccountName}, adapters)
+}
+
+func TestSelectMFAAdapter(t *testing.T) {
+	adapters := []string{adapterAzureMFAServer, adapterVIPWindowsAccountName}
+
+	adapter, err := selectMFAAdapter(prompter.Asker{}, adapters, "vipauthenticationproviderwindowsaccountname")
+	require.Nil(t, err)
+	require.Equal(t, adapterVIPWindowsAccountName, adapter)
+
+	_, err = selectMFAAdapter(prompter.Asker{}, adapters, "AzureMfaAuthentication")
+	require.EqualError(t, err, "adfs_mfa_adapter AzureMfaAuthentication is not offered by ADFS, expected one of AzureMfaServerAuthentication, VIPAuthenticationProviderWindowsAccountName")
+
+	adapter, err = selectMFAAdapter(prompter.Asker{}, adapters[:1], "")
+	require.Nil(t, err)
+	require.Equal(t, adapterAzureMFAServer, adapter)
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Choose", "Select an MFA method", adapters).Return(1)
+
+	adapter, err = selectMFAAdapter(prompter.Asker{}, adapters, "")
+	require.Nil(t, err)
+	require.Equal(t, adapterVIPWindowsAccountName, adapter)
+	pr.AssertExpectations(t)
+
+	_, err = selectMFAAdapter(prompter.Asker{}, nil, "")
+	require.EqualError(t, err, "no MFA adapters offered on the ADFS choice page")
+}
+
+func TestAuthenticateAzureMFAServerOTP(t *testing.T) {
+	ts := mfaServer(t,
+		func(r *http.Request) []byte { return loadFixture(t, "mfachoice.html") },
+		func(r *http.Request) []byte {
+			require.Equal(t, "/adfs/ls/", r.URL.Path)
+			require.Equal(t, adapterAzureMFAServer, r.PostForm.Get("AuthMethod"))
+			require.Equal(t, "ADFS-2019-CONTEXT", r.PostForm.Get("Context"))
+			return loadFixture(t, "azureMfaServerOTP.html")
+		},
+		func(r *http.Request) []byte {
+			require.Equal(t, "123456", r.PostForm.Get("OneTimePasscode"))
+			require.Equal(t, adapterAzureMFAServer, r.PostForm.Get("AuthMethod"))
+			return loadFixture(t, "samlresponse.html")
+		},
+	)
+	defer ts.Close()
+
+	idpAccount := cfg.NewIDPAccount()
+	idpAccount.ADFSMFAAdapter = adapterAzureMFAServer
+	ac, err := New(idpAccount)
+	require.Nil(t, err)
+
+	samlAssertion, err := ac.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "test", Password: "test123", MFAToken: "123456"})
+	require.Nil(t, err)
+	require.Equal(t, "abc123", samlAssertion)
+}
+
+func TestAuthenticateAzureMFAServerCall(t *testing.T) {
+	azureMFAPollInterval = 0
+
+	ts := mfaServer(t,
+		func(r *http.Request) []byte { return loadFixture(t, "azureMfaServerCall.html") },
+		func(r *http.Request) []byte {
+			require.Equal(t, "ADFS-2019-CONTEXT", r.PostForm.Get("Context"))
+			return loadFixture(t, "azureMfaServerCall.html")
+		},
+		func(r *http.Request) []byte { return loadFixture(t, "samlresponse.html") },
+	)
+	defer ts.Close()
+
+	ac, err := New(cfg.NewIDPAccount())
+	require.Nil(t, err)
+
+	samlAssertion, err := ac.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "test", Password: "test123"})
+	require.Nil(t, err)
+	require.Equal(t, "abc123", samlAssertion)
+}
+
+func TestAuthenticateVIPWindowsAccountName(t *testing.T) {
+	ts := mfaServer(t,
+		func(r *http.Request) []byte { return loadFixture(t, "mfachoice.html") },
+		func(r *http.Request) []byte {
+			require.Equal(t, adapterVIPWindowsAccountName, r.PostForm.Get("AuthMethod"))
+			return loadFixture(t, "vipWindowsAccountName.html")
+		},
+		func(r *http.Request) []byte {
+			require.Equal(t, "654321", r.PostForm.Get("security_code"))
+			require.Equal(t, adapterVIPWindowsAccountName, r.PostForm.Get("AuthMethod"))
+			return loadFixture(t, "samlresponse.html")
+		},
+	)
+	defer ts.Close()
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("RequestSecurityCode", "000000").Return("654321")
+
+	idpAccount := cfg.NewIDPAccount()
+	idpAccount.ADFSMFAAdapter = adapterVIPWindowsAccountName
+	ac, err := New(idpAccount)
+	require.Nil(t, err)
+
+	samlAssertion, err := ac.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "test", Password: "test123"})
+	require.Nil(t, err)
+	require.Equal(t, "abc123", samlAssertion)
+	pr.AssertExpectations(t)
+}
+
+// duoServer serves the Duo endpoints the Duo adapter sends the user to, returning to callbackURL from the
+// Universal Prompt
+type duoServer struct {
+	*httptest.Server
+
+	callbackURL string
+	forms       map[string]url.Values
+}
+
+func newDuoServer(t *testing.T) *duoServer {
+	ds := &duoServer{forms: map[string]url.Values{}}
+
+	serve := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			require.Nil(t, r.ParseForm())
+			ds.forms[r.URL.Path] = r.Form
+			_, _ = w.Write([]byte(body))
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/frame/web/v1/auth", serve(`<form><input type="hidden" name="sid" value="frame-sid"></form>`))
+	mux.Handle("/frame/prompt", serve(`{"stat": "OK", "response": {"txid": "txid-example"}}`))
+	mux.Handle("/frame/status", serve(`{"stat": "OK", "response": {"result": "SUCCESS", "result_url": "/frame/status/txid-example"}}`))
+	mux.Handle("/frame/status/txid-example", serve(`{"stat": "OK", "response": {"cookie": "AUTH|frame-cookie"}}`))
+	mux.Handle("/frame/v4/auth/prompt", serve(`<form><input type="hidden" name="sid" value="prompt-sid"><input type="hidden" name="_xsrf" value="prompt-xsrf"></form>`))
+	mux.Handle("/frame/v4/auth/prompt/data", serve(`{"stat": "OK", "response": {"phones": [{"key": "DPPHONE1", "name": "iPhone"}], "auth_method_order": [{"factor": "Duo Push", "deviceKey": "DPPHONE1"}, {"factor": "Passcode"}]}}`))
+	mux.Handle("/frame/v4/prompt", serve(`{"stat": "OK", "response": {"txid": "txid-example"}}`))
+	mux.Handle("/frame/v4/status", serve(`{"stat": "OK", "response": {"result": "SUCCESS", "status_code": "allow"}}`))
+	mux.HandleFunc("/frame/v4/oidc/exit", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, ds.callbackURL, http.StatusFound)
+	})
+
+	duo.StatusPollInterval = 0
+	ds.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(ds.Close)
+	return ds
+}
+
+func TestAuthenticateDuoFrame(t *testing.T) {
+	ds := newDuoServer(t)
+
+	ts := mfaServer(t,
+		func(r *http.Request) []byte {
+			return []byte(strings.ReplaceAll(string(loadFixture(t, "duoFrame.html")), "DUO_HOST", ds.Listener.Addr().String()))
+		},
+		func(r *http.Request) []byte {
+			require.Equal(t, "/adfs/ls/", r.URL.Path)
+			require.Equal(t, "AUTH|frame-cookie:APP|app-example", r.PostForm.Get("sig_response"))
+			require.Equal(t, "DuoAdfsAdapter", r.PostForm.Get("AuthMethod"))
+			require.Equal(t, "ADFS-2019-CONTEXT", r.PostForm.Get("Context"))
+			return loadFixture(t, "samlresponse.html")
+		},
+	)
+	defer ts.Close()
+
+	idpAccount := cfg.NewIDPAccount()
+	idpAccount.SkipVerify = true
+	ac, err := New(idpAccount)
+	require.Nil(t, err)
+
+	samlAssertion, err := ac.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "test", Password: "test123", DuoMFAOption: "Phone Call"})
+	require.Nil(t, err)
+	require.Equal(t, "abc123", samlAssertion)
+	require.Equal(t, "TX|tx-example", ds.forms["/frame/web/v1/auth"].Get("tx"))
+	require.Equal(t, "Phone Call", ds.forms["/frame/prompt"].Get("factor"))
+}
+
+func TestAuthenticateDuoUniversalPrompt(t *testing.T) {
+	ds := newDuoServer(t)
+
+	var callback url.Values
+	mux := http.NewServeMux()
+	mux.HandleFunc("/adfs/ls/IdpInitiatedSignOn.aspx", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			_, _ = w.Write(loadFixture(t, "loginpage.html"))
+			return
+		}
+		// the Duo adapter sends the user to the Universal Prompt once the password is checked
+		http.Redirect(w, r, ds.URL+"/frame/v4/auth/prompt?sid=prompt-sid", http.StatusFound)
+	})
+	mux.HandleFunc("/adfs/ls/duo/callback", func(w http.ResponseWriter, r *http.Request) {
+		callback = r.URL.Query()
+		_, _ = w.Write(loadFixture(t, "samlresponse.html"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	ds.callbackURL = ts.URL + "/adfs/ls/duo/callback?duo_code=code-example&state=state-example"
+
+	idpAccount := cfg.NewIDPAccount()
+	idpAccount.SkipVerify = true
+	ac, err := New(idpAccount)
+	require.Nil(t, err)
+
+	samlAssertion, err := ac.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "test", Password: "test123", MFAToken: "123456", DuoMFAOption: "Passcode"})
+	require.Nil(t, err)
+	require.Equal(t, "abc123", samlAssertion)
+	require.Equal(t, "Passcode", ds.forms["/frame/v4/prompt"].Get("factor"))
+	require.Equal(t, "123456", ds.forms["/frame/v4/prompt"].Get("passcode"))
+	require.Equal(t, "code-example", callback.Get("duo_code"))
+	require.Equal(t, "state-example", callback.Get("state"))
+}
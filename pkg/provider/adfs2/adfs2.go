@@ -29,10 +29,16 @@ type Client struct {
 
 // New new adfs2 client with ntlmssp configured
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
+	tlsConfig, err := provider.NewTLSConfig(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Renegotiation = tls.RenegotiateFreelyAsClient
+
 	transport := &ntlmssp.Negotiator{
 		RoundTripper: &http.Transport{
-			Proxy:           http.ProxyFromEnvironment,
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: idpAccount.SkipVerify, Renegotiation: tls.RenegotiateFreelyAsClient},
+			Proxy:           provider.ProxyFromAccount(idpAccount),
+			TLSClientConfig: tlsConfig,
 		},
 	}
 
@@ -1,9 +1,12 @@
 package adfs2
 
 import (
+	"encoding/pem"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -67,3 +70,26 @@ func TestADFS2RSA(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, resp, "saml1")
 }
+
+func TestNewTrustsCACertFile(t *testing.T) {
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	idpAccount := cfg.NewIDPAccount()
+	idpAccount.CACertFile = filepath.Join(t.TempDir(), "ca.pem")
+
+	_, err := New(idpAccount)
+	assert.ErrorContains(t, err, "can't be read")
+
+	err = os.WriteFile(idpAccount.CACertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svr.Certificate().Raw}), 0600)
+	assert.Nil(t, err)
+
+	client, err := New(idpAccount)
+	assert.Nil(t, err)
+
+	res, err := client.client.Get(svr.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
@@ -12,7 +12,6 @@ import (
 	"github.com/pkg/errors"
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/dump"
-	"github.com/versent/saml2aws/v2/pkg/prompter"
 )
 
 // Authenticate authenticate the user using the supplied login details
@@ -50,7 +49,7 @@ func (ac *Client) authenticateRsa(loginDetails *creds.LoginDetails) (string, err
 		return "", errors.Wrap(err, "error extracting mfa form data")
 	}
 
-	token := prompter.Password("Enter passcode")
+	token := loginDetails.Asker().Password("Enter passcode")
 
 	passcodeForm.Set("ChallengeQuestionAnswer", token)
 	passcodeForm.Set("Passcode", token)
@@ -67,7 +66,7 @@ func (ac *Client) authenticateRsa(loginDetails *creds.LoginDetails) (string, err
 	}
 
 	if rsaForm.Get("SAMLResponse") == "" {
-		nextCode := prompter.Password("Enter nextCode")
+		nextCode := loginDetails.Asker().Password("Enter nextCode")
 
 		rsaForm.Set("ChallengeQuestionAnswer", token)
 		rsaForm.Set("NextCode", nextCode)
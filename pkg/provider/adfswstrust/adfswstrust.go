@@ -0,0 +1,306 @@
+package adfswstrust
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/dump"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+// ProviderName constant for the ADFS WS-Trust provider
+const ProviderName = "ADFSWSTrust"
+
+// defaultTrustPath where ADFS serves the WS-Trust 1.3 username and password endpoint
+const defaultTrustPath = "/adfs/services/trust/13/usernamemixed"
+
+// tokenLifetime how long the WS-Security timestamp of the request is good for
+const tokenLifetime = 5 * time.Minute
+
+const samlSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+
+// errNotWSTrust ADFS answered with something other than a SOAP envelope
+var errNotWSTrust = errors.New("IDP response is not a SOAP envelope")
+
+// errMFARequired ADFS refused the token because its access control policy asks for a second factor
+var errMFARequired = errors.New("ADFS requires MFA for this login")
+
+// mfaFaultMarkers the parts of the fault ADFS answers with when the policy wants more than the password, MSIS7068
+// being the error of a relying party that requires additional authentication
+var mfaFaultMarkers = []string{"msis7068", "additional authentication", "multi-factor", "multifactor"}
+
+var logger = logrus.WithField("provider", "adfswstrust")
+
+// Client wrapper around the ADFS WS-Trust endpoint enabling authentication and retrieval of assertions
+type Client struct {
+	provider.ValidateBase
+
+	client     *provider.HTTPClient
+	idpAccount *cfg.IDPAccount
+}
+
+const rstTpl = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"
+    xmlns:a="http://www.w3.org/2005/08/addressing"
+    xmlns:u="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">
+    <s:Header>
+        <a:Action s:mustUnderstand="1">http://docs.oasis-open.org/ws-sx/ws-trust/200512/RST/Issue</a:Action>
+        <a:MessageID>urn:uuid:{{.MessageID}}</a:MessageID>
+        <a:ReplyTo><a:Address>http://www.w3.org/2005/08/addressing/anonymous</a:Address></a:ReplyTo>
+        <a:To s:mustUnderstand="1">{{.To}}</a:To>
+        <o:Security s:mustUnderstand="1" xmlns:o="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">
+            <u:Timestamp u:Id="_0">
+                <u:Created>{{.Created}}</u:Created>
+                <u:Expires>{{.Expires}}</u:Expires>
+            </u:Timestamp>
+            <o:UsernameToken u:Id="uuid-{{.MessageID}}">
+                <o:Username>{{.Username}}</o:Username>
+                <o:Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordText">{{.Password}}</o:Password>
+            </o:UsernameToken>
+        </o:Security>
+    </s:Header>
+    <s:Body>
+        <trust:RequestSecurityToken xmlns:trust="http://docs.oasis-open.org/ws-sx/ws-trust/200512">
+            <wsp:AppliesTo xmlns:wsp="http://schemas.xmlsoap.org/ws/2004/09/policy">
+                <a:EndpointReference><a:Address>{{.AppliesTo}}</a:Address></a:EndpointReference>
+            </wsp:AppliesTo>
+            <trust:KeyType>http://docs.oasis-open.org/ws-sx/ws-trust/200512/Bearer</trust:KeyType>
+            <trust:RequestType>http://docs.oasis-open.org/ws-sx/ws-trust/200512/Issue</trust:RequestType>
+            <trust:TokenType>urn:oasis:names:tc:SAML:2.0:assertion</trust:TokenType>
+        </trust:RequestSecurityToken>
+    </s:Body>
+</s:Envelope>`
+
+// rstData the values of the RequestSecurityToken, escaped for XML
+type rstData struct {
+	MessageID string
+	To        string
+	Created   string
+	Expires   string
+	Username  string
+	Password  string
+	AppliesTo string
+}
+
+// New create a new ADFS WS-Trust client
+func New(idpAccount *cfg.IDPAccount) (*Client, error) {
+	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
+
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building http client")
+	}
+
+	return &Client{
+		client:     client,
+		idpAccount: idpAccount,
+	}, nil
+}
+
+// Authenticate requests a SAML token for AWS from the ADFS WS-Trust endpoint with the username and password, and
+// returns it wrapped in the SAML response STS expects
+func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	endpoint, err := trustEndpoint(loginDetails.URL)
+	if err != nil {
+		return "", err
+	}
+
+	if loginDetails.MFAToken != "" {
+		logger.Warn("The WS-Trust endpoint takes no MFA token, ignoring --mfa-token.")
+	}
+
+	body, err := requestSecurityToken(endpoint, loginDetails.Username, loginDetails.Password, ac.idpAccount.AmazonWebservicesURN, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, body)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error creating new http request for %s", endpoint)
+	}
+	req.Header.Set("Content-Type", "application/soap+xml; charset=utf-8")
+
+	res, err := ac.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "Sending RequestSecurityToken")
+	}
+	defer res.Body.Close()
+
+	bodyBytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "Reading IDP response")
+	}
+	if dump.ContentEnable() {
+		logger.Debugf("IDP Response: %s", bodyBytes)
+	}
+
+	// ADFS answers a SOAP fault with a 500, so the body is checked whatever the status
+	samlResponse, err := extractResponse(bytes.NewReader(bodyBytes), acsURL(ac.idpAccount.TargetURL), time.Now())
+	if errors.Is(err, errNotWSTrust) {
+		return "", errors.Errorf("ADFS didn't answer %s with a SOAP envelope (%s), the WS-Trust 1.3 usernamemixed endpoint doesn't look to be enabled. "+
+			"Enable it in the ADFS endpoints, or use the ADFS provider to log in through the login page", endpoint, res.Status)
+	}
+	if errors.Is(err, errMFARequired) {
+		return "", errors.Errorf("%v. The WS-Trust endpoint only logs in with a username and password, use the ADFS provider, "+
+			"which logs in through the login page and answers MFA, or exempt the usernamemixed endpoint from MFA in the ADFS access control policy",
+			strings.TrimSuffix(err.Error(), "."))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if dump.ContentEnable() {
+		logger.Debugf("SAML Response: %s", samlResponse)
+	}
+
+	// saml2aws expects the assertion to be base64 encoded
+	return base64.StdEncoding.EncodeToString([]byte(samlResponse)), nil
+}
+
+// trustEndpoint the url, with the path ADFS serves WS-Trust on added when the url is just the host of ADFS
+func trustEndpoint(loginURL string) (string, error) {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error parsing url %s", loginURL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = defaultTrustPath
+	}
+	return u.String(), nil
+}
+
+// acsURL the assertion consumer service the SAML response is addressed to
+func acsURL(target string) string {
+	if target == "" {
+		return "https://signin.aws.amazon.com/saml"
+	}
+	return target
+}
+
+// requestSecurityToken a WS-Trust 1.3 RequestSecurityToken for a bearer SAML 2.0 token for appliesTo, carrying the
+// username and password in a WS-Security UsernameToken
+func requestSecurityToken(endpoint, username, password, appliesTo string, now time.Time) (io.Reader, error) {
+	// created from a template, due to fragility in xml/encoding when handling namespaces
+	t, err := template.New("rst").Parse(rstTpl)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing RequestSecurityToken template")
+	}
+
+	data := rstData{
+		MessageID: uuid.New().String(),
+		To:        escape(endpoint),
+		Created:   now.UTC().Format(time.RFC3339),
+		Expires:   now.Add(tokenLifetime).UTC().Format(time.RFC3339),
+		Username:  escape(username),
+		Password:  escape(password),
+		AppliesTo: escape(appliesTo),
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, errors.Wrap(err, "Creating RequestSecurityToken from template")
+	}
+
+	return &buf, nil
+}
+
+// escape s as XML character data
+func escape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// extractResponse pulls the SAML assertion out of the RequestSecurityTokenResponse and wraps it in a SAML
+// response addressed to acs, which is what STS takes
+func extractResponse(body io.Reader, acs string, now time.Time) (string, error) {
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(body); err != nil {
+		return "", errNotWSTrust
+	}
+
+	root := doc.Root()
+	if root == nil || root.Tag != "Envelope" {
+		return "", errNotWSTrust
+	}
+
+	if fault := root.FindElement("Body/Fault"); fault != nil {
+		return "", faultError(fault)
+	}
+
+	assertion := root.FindElement("//RequestedSecurityToken/Assertion")
+	if assertion == nil {
+		return "", errors.New("Unable to find the SAML 2.0 Assertion in the RequestSecurityTokenResponse")
+	}
+
+	response := etree.NewDocument()
+	samlp := response.CreateElement("samlp:Response")
+	samlp.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	samlp.CreateAttr("ID", "_"+uuid.New().String())
+	samlp.CreateAttr("Version", "2.0")
+	samlp.CreateAttr("IssueInstant", now.UTC().Format(time.RFC3339))
+	samlp.CreateAttr("Destination", acs)
+	if issuer := assertion.FindElement("Issuer"); issuer != nil {
+		samlIssuer := samlp.CreateElement("saml:Issuer")
+		samlIssuer.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+		samlIssuer.SetText(issuer.Text())
+	}
+	status := samlp.CreateElement("samlp:Status")
+	status.CreateElement("samlp:StatusCode").CreateAttr("Value", samlSuccess)
+
+	// the assertion is copied as it is, ADFS declares its namespace on it and its signature covers it alone
+	samlp.AddChild(assertion.Copy())
+
+	samlResponse, err := response.WriteToString()
+	if err != nil {
+		return "", errors.Wrap(err, "Could not serialize Response to string")
+	}
+
+	return samlResponse, nil
+}
+
+// faultError the error for a SOAP fault of ADFS, a rejected password is reported as invalid credentials and a
+// policy asking for MFA as errMFARequired
+func faultError(fault *etree.Element) error {
+	subcode := ""
+	if value := fault.FindElement("Code/Subcode/Value"); value != nil {
+		subcode = strings.TrimSpace(value.Text())
+	}
+
+	message := "unknown"
+	if reason := fault.FindElement("Reason/Text"); reason != nil {
+		message = strings.TrimSpace(reason.Text())
+	}
+
+	// the subcode is a QName such as a:FailedAuthentication
+	if strings.HasSuffix(subcode, "FailedAuthentication") {
+		return provider.InvalidCredentials("ADFS rejected the username or password: %s", message)
+	}
+
+	lower := strings.ToLower(message)
+	for _, marker := range mfaFaultMarkers {
+		if strings.Contains(lower, marker) {
+			return fmt.Errorf("%w: %s", errMFARequired, message)
+		}
+	}
+
+	return errors.Errorf("IDP returned a SOAP fault: %s", message)
+}
@@ -0,0 +1,149 @@
+package adfswstrust
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+func TestRequestSecurityToken(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	result, err := requestSecurityToken("https://adfs.example.com/adfs/services/trust/13/usernamemixed", `EXAMPLE\user`, "p<a>ss&word", "urn:amazon:webservices", now)
+	assert.NoError(t, err)
+
+	doc := etree.NewDocument()
+	_, err = doc.ReadFrom(result)
+	assert.NoError(t, err)
+
+	root := doc.Root()
+	assert.Equal(t, `EXAMPLE\user`, root.FindElement("//o:Username").Text())
+	assert.Equal(t, "p<a>ss&word", root.FindElement("//o:Password").Text())
+	assert.Equal(t, "urn:amazon:webservices", root.FindElement("//wsp:AppliesTo/a:EndpointReference/a:Address").Text())
+	assert.Equal(t, "2024-01-01T00:00:00Z", root.FindElement("//u:Created").Text())
+	assert.Equal(t, "2024-01-01T00:05:00Z", root.FindElement("//u:Expires").Text())
+	assert.Equal(t, "http://docs.oasis-open.org/ws-sx/ws-trust/200512/Bearer", root.FindElement("//trust:KeyType").Text())
+}
+
+func TestExtractResponse(t *testing.T) {
+	data, err := os.Open("testdata/rstr_success.xml")
+	assert.Nil(t, err)
+	defer data.Close()
+
+	samlResponse, err := extractResponse(data, "https://signin.aws.amazon.com/saml", time.Now())
+	assert.Nil(t, err)
+
+	doc := etree.NewDocument()
+	assert.Nil(t, doc.ReadFromString(samlResponse))
+
+	root := doc.Root()
+	assert.Equal(t, "Response", root.Tag)
+	assert.Equal(t, "https://signin.aws.amazon.com/saml", root.SelectAttrValue("Destination", ""))
+	assert.Equal(t, "http://adfs.example.com/adfs/services/trust", root.FindElement("Issuer").Text())
+	assert.Equal(t, samlSuccess, root.FindElement("Status/StatusCode").SelectAttrValue("Value", ""))
+
+	// the signed assertion is handed on with its namespace and signature
+	assertion := root.FindElement("Assertion")
+	if assert.NotNil(t, assertion) {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:assertion", assertion.SelectAttrValue("xmlns", ""))
+		assert.Equal(t, "c2lnbmF0dXJl", assertion.FindElement("Signature/SignatureValue").Text())
+		assert.Equal(t, "arn:aws:iam::123456789012:saml-provider/ADFS,arn:aws:iam::123456789012:role/Admin",
+			assertion.FindElement("AttributeStatement/Attribute[@Name='https://aws.amazon.com/SAML/Attributes/Role']/AttributeValue").Text())
+	}
+}
+
+func TestExtractResponseFailures(t *testing.T) {
+	extract := func(file string) error {
+		data, err := os.Open(file)
+		assert.Nil(t, err)
+		defer data.Close()
+
+		_, err = extractResponse(data, "https://signin.aws.amazon.com/saml", time.Now())
+		return err
+	}
+
+	err := extract("testdata/rstr_fault_credentials.xml")
+	assert.EqualError(t, err, "ADFS rejected the username or password: ID3242: The security token could not be authenticated or authorized.")
+	assert.True(t, errors.Is(err, provider.ErrInvalidCredentials))
+
+	err = extract("testdata/rstr_fault_mfa.xml")
+	assert.EqualError(t, err, "ADFS requires MFA for this login: MSIS7068: Access denied.")
+	assert.True(t, errors.Is(err, errMFARequired))
+
+	_, err = extractResponse(bytes.NewBufferString("<html><body>Not Found</body></html>"), "https://signin.aws.amazon.com/saml", time.Now())
+	assert.True(t, errors.Is(err, errNotWSTrust))
+}
+
+func TestTrustEndpoint(t *testing.T) {
+	endpoint, err := trustEndpoint("https://adfs.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://adfs.example.com/adfs/services/trust/13/usernamemixed", endpoint)
+
+	endpoint, err = trustEndpoint("https://adfs.example.com/adfs/services/trust/2005/usernamemixed")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://adfs.example.com/adfs/services/trust/2005/usernamemixed", endpoint)
+}
+
+func TestAuthenticate(t *testing.T) {
+	fixture := "testdata/rstr_success.xml"
+
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, defaultTrustPath, r.URL.Path)
+		assert.True(t, strings.HasPrefix(r.Header.Get("Content-Type"), "application/soap+xml"))
+
+		body, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Contains(t, string(body), "<o:Password Type=\"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordText\">abc123</o:Password>")
+
+		data, err := os.ReadFile(fixture)
+		assert.Nil(t, err)
+		if fixture != "testdata/rstr_success.xml" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, err = w.Write(data)
+		assert.Nil(t, err)
+	}))
+	defer svr.Close()
+
+	idpAccount := cfg.NewIDPAccount()
+	idpAccount.URL = svr.URL
+	idpAccount.SkipVerify = true
+
+	loginDetails := &creds.LoginDetails{
+		Username: `EXAMPLE\user`,
+		Password: "abc123",
+		URL:      idpAccount.URL,
+	}
+
+	ac, err := New(idpAccount)
+	assert.Nil(t, err)
+
+	resp, err := ac.Authenticate(loginDetails)
+	assert.Nil(t, err)
+
+	samlResponse, err := base64.StdEncoding.DecodeString(resp)
+	assert.Nil(t, err)
+	assert.Contains(t, string(samlResponse), "<samlp:Response")
+	assert.Contains(t, string(samlResponse), "arn:aws:iam::123456789012:role/Admin")
+
+	fixture = "testdata/rstr_fault_mfa.xml"
+	_, err = ac.Authenticate(loginDetails)
+	assert.ErrorContains(t, err, "ADFS requires MFA for this login: MSIS7068: Access denied. The WS-Trust endpoint only logs in with a username and password, use the ADFS provider")
+
+	fixture = "testdata/rstr_fault_credentials.xml"
+	_, err = ac.Authenticate(loginDetails)
+	assert.True(t, errors.Is(err, provider.ErrInvalidCredentials))
+}
@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"github.com/versent/saml2aws/v2/pkg/prompter"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/pkg/errors"
@@ -84,7 +83,12 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -322,7 +326,7 @@ func verifyMfa(oc *Client, akamaiOrgHost string, loginDetails *creds.LoginDetail
 
 		mfaDisplayNum := len(mfaDisplayOptions)
 		if mfaDisplayNum > 1 {
-			mfaOption = prompter.Choose("Select which MFA option to use", mfaDisplayOptions)
+			mfaOption = loginDetails.Asker().Choose("Select which MFA option to use", mfaDisplayOptions)
 			mfaUserOption = mfaOptions[mfaOption].UserMfaOption
 		} else if mfaDisplayNum == 1 {
 			mfaUserOption = mfaOptions[1].UserMfaOption
@@ -390,7 +394,7 @@ func verifyMfa(oc *Client, akamaiOrgHost string, loginDetails *creds.LoginDetail
 		}
 		/* 3. Verify MFA */
 
-		verifyCode := prompter.StringRequired("Enter MFA verification code")
+		verifyCode := loginDetails.Asker().StringRequired("Enter MFA verification code")
 
 		mfaVerifyURL := fmt.Sprintf("https://%s/api/v1/mfa/user/%s/token/verify", akamaiOrgHost, mfaApi)
 		mfaVerifyData := MfaTokenVerify{Category: mfa, Token: verifyCode, Uuid: uuidMfa}
@@ -491,12 +495,12 @@ func verifyMfa(oc *Client, akamaiOrgHost string, loginDetails *creds.LoginDetail
 		} else if loginDetails.DuoMFAOption == "Passcode" {
 			duoMfaOption = 1
 		} else {
-			duoMfaOption = prompter.Choose("Select a DUO MFA Option", duoMfaOptions)
+			duoMfaOption = loginDetails.Asker().Choose("Select a DUO MFA Option", duoMfaOptions)
 		}
 
 		if duoMfaOptions[duoMfaOption] == "Passcode" {
 			//get users DUO MFA Token
-			token = prompter.StringRequired("Enter passcode")
+			token = loginDetails.Asker().StringRequired("Enter passcode")
 		}
 
 		// send mfa auth request
@@ -18,6 +18,7 @@ import (
 	"github.com/tidwall/gjson"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/dump"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 	"github.com/versent/saml2aws/v2/pkg/provider"
 )
@@ -34,8 +35,6 @@ var (
 	authURLPattern        = regexp.MustCompile(`https://([^.]+)\.auth0\.com/samlp/(.+)`)
 	connectionInfoPattern = regexp.MustCompile(`Auth0\.setClient\((.*)\)`)
 	sessionInfoPattern    = regexp.MustCompile(`window\.atob\('(.*)'\)`)
-
-	defaultPrompter = prompter.NewCli()
 )
 
 // Client wrapper around Auth0.
@@ -106,7 +105,12 @@ func defaultAuthInfoOptions() authInfoOption {
 // New create a new Auth0 Client
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -121,7 +125,7 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 // Authenticate logs into Auth0 and returns a SAML response
 func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
 	logger.Debug("Get connections and session tokens")
-	authInfo, err := ac.buildAuthInfo(loginDetails.URL, defaultPrompter)
+	authInfo, err := ac.buildAuthInfo(loginDetails.URL, loginDetails.Asker())
 	if err != nil {
 		return "", errors.Wrap(err, "error failed to build authentication info")
 	}
@@ -137,7 +141,9 @@ func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 	if err != nil {
 		return "", errors.Wrap(err, "error failed to parse SAML")
 	}
-	logger.WithField("data", samlAssertion).Debug("SAML Assertion (base64 encoded)")
+	if dump.ContentEnable() {
+		logger.WithField("data", samlAssertion).Debug("SAML Assertion (base64 encoded)")
+	}
 
 	return samlAssertion, nil
 }
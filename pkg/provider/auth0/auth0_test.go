@@ -24,7 +24,8 @@ func newTestProviderHTTPClientHelper(t *testing.T) *Client {
 	t.Helper()
 
 	tr := provider.NewDefaultTransport(false)
-	httpClient, _ := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(&cfg.IDPAccount{}))
+	opts, _ := provider.BuildHttpClientOpts(&cfg.IDPAccount{})
+	httpClient, _ := provider.NewHTTPClient(tr, opts)
 	httpClient.CheckResponseStatus = provider.SuccessOrRedirectResponseValidator
 
 	return &Client{
@@ -1,13 +1,20 @@
 package browser
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/mitchellh/go-homedir"
 	"github.com/playwright-community/playwright-go"
 	"github.com/sirupsen/logrus"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
@@ -18,6 +25,21 @@ var logger = logrus.WithField("provider", "browser")
 
 const DEFAULT_TIMEOUT float64 = 300000
 
+// progressInterval how often to say the login is still waiting on the browser
+var progressInterval = 30 * time.Second
+
+// TimeoutError the IdP login wasn't finished in the browser before browser_timeout
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("no SAML response from the browser after %s, the IdP login wasn't finished in time", e.Timeout)
+}
+
+// cdpCheckTimeout how long to wait for the browser at browser_cdp_endpoint to answer
+var cdpCheckTimeout = 5 * time.Second
+
 // Client client for browser based Identity Provider
 type Client struct {
 	BrowserType           string
@@ -27,10 +49,25 @@ type Client struct {
 	BrowserDriverDir string
 	Timeout          int
 	BrowserAutoFill  bool
+	// keeps cookies and remembered devices between logins when set, otherwise each login starts afresh
+	BrowserProfileDir string
+	// DevTools endpoint of a running Chrome to log in with instead of launching a browser
+	BrowserCDPEndpoint string
+	// how long to wait for the IdP login to finish, the legacy millisecond Timeout when zero
+	BrowserTimeout time.Duration
+	// the AWS sign-in hosts of the account's partition, a SAML response posted anywhere else is rejected
+	SigninHosts []string
+	// leaves the browser open after a failed login until Enter is pressed, ignored when headless
+	KeepOpenOnError bool
 }
 
 // New create new browser based client
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
+	profileDir, err := homedir.Expand(idpAccount.BrowserProfileDir)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Client{
 		Headless:              idpAccount.Headless,
 		BrowserDriverDir:      idpAccount.BrowserDriverDir,
@@ -38,6 +75,11 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 		BrowserExecutablePath: idpAccount.BrowserExecutablePath,
 		Timeout:               idpAccount.Timeout,
 		BrowserAutoFill:       idpAccount.BrowserAutoFill,
+		BrowserProfileDir:     profileDir,
+		BrowserCDPEndpoint:    idpAccount.BrowserCDPEndpoint,
+		BrowserTimeout:        time.Duration(idpAccount.BrowserTimeout) * time.Second,
+		SigninHosts:           signinHosts(idpAccount.AmazonWebservicesURN, idpAccount.Region),
+		KeepOpenOnError:       idpAccount.BrowserKeepOpenOnError,
 	}, nil
 }
 
@@ -52,6 +94,21 @@ func contains(s []string, str string) bool {
 	return false
 }
 func (cl *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	if cl.BrowserCDPEndpoint != "" {
+		if err := checkCDPEndpoint(cl.BrowserCDPEndpoint); err != nil {
+			return "", err
+		}
+	}
+
+	// a second login on the same profile would fail inside the browser, so fail before starting it
+	if cl.BrowserProfileDir != "" && cl.BrowserCDPEndpoint == "" {
+		unlock, err := LockProfile(cl.BrowserProfileDir)
+		if err != nil {
+			return "", err
+		}
+		defer unlock()
+	}
+
 	runOptions := playwright.RunOptions{}
 	if cl.BrowserDriverDir != "" {
 		runOptions.DriverDirectory = cl.BrowserDriverDir
@@ -70,14 +127,17 @@ func (cl *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 		return "", err
 	}
 
+	if cl.BrowserCDPEndpoint != "" {
+		return cl.authenticateOverCDP(pw, loginDetails)
+	}
+
 	// TODO: provide some overrides for this window
 	launchOptions := playwright.BrowserTypeLaunchOptions{
 		Headless: playwright.Bool(cl.Headless),
 	}
 
-	validBrowserTypes := []string{"chromium", "firefox", "webkit", "chrome", "chrome-beta", "chrome-dev", "chrome-canary", "msedge", "msedge-beta", "msedge-dev", "msedge-canary"}
-	if len(cl.BrowserType) > 0 && !contains(validBrowserTypes, cl.BrowserType) {
-		return "", fmt.Errorf("invalid browser-type: '%s', only %s are allowed", cl.BrowserType, validBrowserTypes)
+	if len(cl.BrowserType) > 0 && !contains(cfg.BrowserTypes, cl.BrowserType) {
+		return "", fmt.Errorf("invalid browser-type: '%s', only %s are allowed", cl.BrowserType, cfg.BrowserTypes)
 	}
 
 	if cl.BrowserType != "" {
@@ -102,6 +162,10 @@ func (cl *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 		launchOptions.ExecutablePath = &cl.BrowserExecutablePath
 	}
 
+	if cl.BrowserProfileDir != "" {
+		return cl.authenticateWithProfile(pw, browserType, launchOptions, loginDetails)
+	}
+
 	// currently using the main browsers supported by Playwright: Chromium, Firefox or Webkit
 	//
 	// this is a sandboxed browser window so password managers and addons are separate
@@ -152,13 +216,145 @@ func (cl *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 		}
 	}()
 
-	return getSAMLResponse(page, loginDetails, cl)
+	samlResponse, err := getSAMLResponse(page, loginDetails, cl)
+	cl.pauseOnError(err)
+
+	return samlResponse, err
 }
 
-var getSAMLResponse = func(page playwright.Page, loginDetails *creds.LoginDetails, client *Client) (string, error) {
-	var data string
-	var dataErr error
+// authenticateOverCDP logs in with a new tab of the browser at the CDP endpoint, which already has the IdP session,
+// closing only that tab afterwards
+func (cl *Client) authenticateOverCDP(pw *playwright.Playwright, loginDetails *creds.LoginDetails) (string, error) {
+	logger.WithField("endpoint", cl.BrowserCDPEndpoint).Info("connecting to browser")
+
+	browser, err := pw.Chromium.ConnectOverCDP(cl.BrowserCDPEndpoint)
+	if err != nil {
+		if err := pw.Stop(); err != nil {
+			logger.Info("Error when stopping pm", err)
+		}
+		return "", fmt.Errorf("unable to connect to the browser at browser_cdp_endpoint %s: %w", cl.BrowserCDPEndpoint, err)
+	}
+
+	// the browser's own context holds its cookies, a new context would start without the IdP session
+	var context playwright.BrowserContext
+	if contexts := browser.Contexts(); len(contexts) > 0 {
+		context = contexts[0]
+	} else {
+		context, err = browser.NewContext()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	page, err := context.NewPage()
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		logger.Info("closing tab")
+		if err := page.Close(); err != nil {
+			logger.Info("Error when closing tab", err)
+		}
+		// stopping the driver drops the connection, leaving the browser and its other tabs running
+		if err := pw.Stop(); err != nil {
+			logger.Info("Error when stopping pm", err)
+		}
+	}()
+
+	samlResponse, err := getSAMLResponse(page, loginDetails, cl)
+	cl.pauseOnError(err)
+
+	return samlResponse, err
+}
+
+// waitForEnter blocks until Enter is pressed
+var waitForEnter = func() {
+	_, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+// pauseOnError keeps the browser open on the page the login failed at until Enter is pressed, so its DOM and
+// console can be inspected, when KeepOpenOnError is set. There's no window to look at when headless.
+func (cl *Client) pauseOnError(err error) bool {
+	if err == nil || !cl.KeepOpenOnError || cl.Headless {
+		return false
+	}
+
+	log.Printf("The browser login failed: %v", err)
+	log.Println("The browser is left open to inspect the page, press Enter to close it.")
+	waitForEnter()
+
+	return true
+}
+
+// checkCDPEndpoint fails with a clear error when no browser answers at the endpoint, rather than after playwright
+// gives up connecting
+func checkCDPEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("browser_cdp_endpoint %s is not a valid URL: %w", endpoint, err)
+	}
+
+	// a websocket endpoint is the browser's own, there is no version document to check it with
+	if u.Scheme == "ws" || u.Scheme == "wss" {
+		return nil
+	}
+
+	client := &http.Client{Timeout: cdpCheckTimeout}
+	res, err := client.Get(strings.TrimRight(endpoint, "/") + "/json/version")
+	if err != nil {
+		return fmt.Errorf("unable to reach the browser at browser_cdp_endpoint %s, is Chrome running with --remote-debugging-port? %w", endpoint, err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("browser_cdp_endpoint %s is not a Chrome DevTools endpoint, /json/version returned %s", endpoint, res.Status)
+	}
+	return nil
+}
+
+// authenticateWithProfile logs in with a persistent context in the browser profile, so the IdP session cookies
+// survive for the next login
+func (cl *Client) authenticateWithProfile(pw *playwright.Playwright, browserType playwright.BrowserType, launchOptions playwright.BrowserTypeLaunchOptions, loginDetails *creds.LoginDetails) (string, error) {
+	logger.WithField("dir", cl.BrowserProfileDir).Info("using browser profile")
 
+	context, err := browserType.LaunchPersistentContext(cl.BrowserProfileDir, playwright.BrowserTypeLaunchPersistentContextOptions{
+		Headless:       launchOptions.Headless,
+		Channel:        launchOptions.Channel,
+		ExecutablePath: launchOptions.ExecutablePath,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		logger.Info("clean up browser")
+		if err := context.Close(); err != nil {
+			logger.Info("Error when closing context", err)
+		}
+		if err := pw.Stop(); err != nil {
+			logger.Info("Error when stopping pm", err)
+		}
+	}()
+
+	// the persistent context opens with a blank page of its own
+	var page playwright.Page
+	if pages := context.Pages(); len(pages) > 0 {
+		page = pages[0]
+	} else {
+		page, err = context.NewPage()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	samlResponse, err := getSAMLResponse(page, loginDetails, cl)
+	cl.pauseOnError(err)
+
+	return samlResponse, err
+}
+
+var getSAMLResponse = func(page playwright.Page, loginDetails *creds.LoginDetails, client *Client) (string, error) {
 	logger.WithField("URL", loginDetails.URL).Info("opening browser")
 
 	signin_re, err := signinRegex()
@@ -166,11 +362,22 @@ var getSAMLResponse = func(page playwright.Page, loginDetails *creds.LoginDetail
 		return "", err
 	}
 
-	page.OnRequest(func(request playwright.Request) {
-		if signin_re.Match([]byte(request.URL())) {
-			data, dataErr = request.PostData()
+	// the SAML response is taken from the request as the browser posts it, before it goes anywhere
+	results := make(chan samlResult, 1)
+	err = page.Route(signin_re, func(route playwright.Route) {
+		result, ok := client.interceptSAMLResponse(route)
+		if !ok {
+			return
+		}
+		select {
+		case results <- result:
+		default:
 		}
 	})
+	if err != nil {
+		return "", err
+	}
+
 	if _, err := page.Goto(loginDetails.URL); err != nil {
 		return "", err
 	}
@@ -183,23 +390,135 @@ var getSAMLResponse = func(page playwright.Page, loginDetails *creds.LoginDetail
 	}
 
 	logger.Info("waiting ...")
-	if data == "" {
-		r, err := page.ExpectRequest(signin_re, nil, client.expectRequestTimeout())
-		if err != nil {
-			logger.Error(err)
+	return client.waitForSAMLResponse(results)
+}
+
+// samlResult what was intercepted on its way to the AWS sign-in page
+type samlResult struct {
+	samlResponse string
+	err          error
+}
+
+// interceptSAMLResponse answers a request to a sign-in page, returning false for those that don't carry a SAML
+// response, which carry on as normal
+func (cl *Client) interceptSAMLResponse(route playwright.Route) (samlResult, bool) {
+	request := route.Request()
+
+	signinURL, err := url.Parse(request.URL())
+	if err != nil || !cl.allowedSigninHost(signinURL.Host) {
+		if err := route.Abort(); err != nil {
+			logger.Info("Error when aborting request", err)
 		}
-		data, dataErr = r.PostData()
+		return samlResult{err: fmt.Errorf("SAML response posted to %s, only %s are allowed for this account's aws_urn and region", request.URL(), strings.Join(cl.SigninHosts, ", "))}, true
 	}
-	if dataErr != nil {
-		return "", err
+
+	data, err := request.PostData()
+	if err != nil || data == "" {
+		if err := route.Continue(); err != nil {
+			logger.Info("Error when continuing request", err)
+		}
+		return samlResult{}, false
 	}
 
 	values, err := url.ParseQuery(data)
+	if err != nil || values.Get("SAMLResponse") == "" {
+		if err := route.Continue(); err != nil {
+			logger.Info("Error when continuing request", err)
+		}
+		return samlResult{}, false
+	}
+	samlResponse := values.Get("SAMLResponse")
+
+	// the response itself names where it is meant for, even when the assertion in it is encrypted
+	if destination := samlDestination(samlResponse); destination != "" {
+		destinationURL, err := url.Parse(destination)
+		if err != nil || !cl.allowedSigninHost(destinationURL.Host) {
+			if err := route.Abort(); err != nil {
+				logger.Info("Error when aborting request", err)
+			}
+			return samlResult{err: fmt.Errorf("SAML response is for %s, only %s are allowed for this account's aws_urn and region", destination, strings.Join(cl.SigninHosts, ", "))}, true
+		}
+	}
+
+	err = route.Fulfill(playwright.RouteFulfillOptions{
+		Status:      playwright.Int(http.StatusOK),
+		ContentType: playwright.String("text/html"),
+		Body:        "<html><body><p>Logged in, return to saml2aws to continue.</p></body></html>",
+	})
 	if err != nil {
-		return "", err
+		logger.Info("Error when answering request", err)
+	}
+
+	return samlResult{samlResponse: samlResponse}, true
+}
+
+// waitForSAMLResponse waits for the login to finish in the browser, saying so every progressInterval so it
+// doesn't look hung, and gives up after the browser timeout
+func (cl *Client) waitForSAMLResponse(results <-chan samlResult) (string, error) {
+	timeout := cl.browserTimeout()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	progress := time.NewTicker(progressInterval)
+	defer progress.Stop()
+
+	started := time.Now()
+	for {
+		select {
+		case result := <-results:
+			return result.samlResponse, result.err
+		case <-progress.C:
+			log.Printf("Still waiting for the IdP login to finish in the browser, %s left.", (timeout - time.Since(started)).Round(time.Second))
+		case <-deadline.C:
+			return "", &TimeoutError{Timeout: timeout}
+		}
+	}
+}
+
+// browserTimeout browser_timeout when set, otherwise the timeout the login always had
+func (cl *Client) browserTimeout() time.Duration {
+	if cl.BrowserTimeout > 0 {
+		return cl.BrowserTimeout
 	}
+	return time.Duration(*cl.expectRequestTimeout().Timeout) * time.Millisecond
+}
 
-	return values.Get("SAMLResponse"), nil
+// allowedSigninHost the host is one of the sign-in hosts, or a regional one of them
+func (cl *Client) allowedSigninHost(host string) bool {
+	for _, signinHost := range cl.SigninHosts {
+		if host == signinHost || strings.HasSuffix(host, "."+signinHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// signinHosts the AWS sign-in host of the partition the aws_urn or region belong to
+func signinHosts(urn, region string) []string {
+	// https://docs.aws.amazon.com/general/latest/gr/signin-service.html
+	switch {
+	case strings.Contains(urn, "govcloud") || strings.HasPrefix(region, "us-gov-"):
+		return []string{"signin.amazonaws-us-gov.com"}
+	case strings.Contains(urn, ":cn-") || strings.HasPrefix(region, "cn-"):
+		return []string{"signin.amazonaws.cn"}
+	default:
+		return []string{"signin.aws.amazon.com"}
+	}
+}
+
+// samlDestination the Destination of the SAML response, empty when it can't be read
+func samlDestination(samlResponse string) string {
+	data, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return ""
+	}
+
+	var response struct {
+		Destination string `xml:"Destination,attr"`
+	}
+	if err := xml.Unmarshal(data, &response); err != nil {
+		return ""
+	}
+	return response.Destination
 }
 
 var autoFill = func(page playwright.Page, loginDetails *creds.LoginDetails) error {
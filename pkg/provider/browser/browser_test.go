@@ -1,11 +1,14 @@
 package browser
 
 import (
+	"encoding/base64"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/playwright-community/playwright-go"
 	"github.com/stretchr/testify/assert"
@@ -237,3 +240,161 @@ func TestAutoFill(t *testing.T) {
 		assert.Equal(t, "golang:gopher", result)
 	}
 }
+
+// fakeRoute records what the provider did with an intercepted request
+type fakeRoute struct {
+	playwright.Route
+	request   playwright.Request
+	aborted   bool
+	continued bool
+	fulfilled bool
+}
+
+func (r *fakeRoute) Request() playwright.Request { return r.request }
+
+func (r *fakeRoute) Abort(errorCode ...string) error {
+	r.aborted = true
+	return nil
+}
+
+func (r *fakeRoute) Continue(options ...playwright.RouteContinueOptions) error {
+	r.continued = true
+	return nil
+}
+
+func (r *fakeRoute) Fulfill(options ...playwright.RouteFulfillOptions) error {
+	r.fulfilled = true
+	return nil
+}
+
+func samlPost(destination string) string {
+	samlResponse := base64.StdEncoding.EncodeToString([]byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" Destination="` + destination + `"></samlp:Response>`))
+	return url.Values{"SAMLResponse": {samlResponse}, "RelayState": {""}}.Encode()
+}
+
+func newFakeRoute(signinURL, postData string) *fakeRoute {
+	req := &mocks.Request{}
+	req.Mock.On("URL").Return(signinURL)
+	req.Mock.On("PostData").Return(postData, nil)
+	return &fakeRoute{request: req}
+}
+
+func TestSigninHosts(t *testing.T) {
+	assert.Equal(t, []string{"signin.aws.amazon.com"}, signinHosts("urn:amazon:webservices", "us-east-1"))
+	assert.Equal(t, []string{"signin.aws.amazon.com"}, signinHosts("", ""))
+	assert.Equal(t, []string{"signin.amazonaws-us-gov.com"}, signinHosts("urn:amazon:webservices:govcloud", "us-gov-west-1"))
+	assert.Equal(t, []string{"signin.amazonaws-us-gov.com"}, signinHosts("urn:amazon:webservices", "us-gov-east-1"))
+	assert.Equal(t, []string{"signin.amazonaws.cn"}, signinHosts("urn:amazon:webservices:cn-north-1", "cn-north-1"))
+	assert.Equal(t, []string{"signin.amazonaws.cn"}, signinHosts("urn:amazon:webservices", "cn-northwest-1"))
+}
+
+func TestInterceptSAMLResponse(t *testing.T) {
+	client, err := New(&cfg.IDPAccount{AmazonWebservicesURN: "urn:amazon:webservices", Region: "us-east-1"})
+	require.Nil(t, err)
+
+	postData := samlPost("https://signin.aws.amazon.com/saml")
+	route := newFakeRoute("https://signin.aws.amazon.com/saml", postData)
+	result, ok := client.interceptSAMLResponse(route)
+	require.True(t, ok)
+	require.Nil(t, result.err)
+	values, _ := url.ParseQuery(postData)
+	assert.Equal(t, values.Get("SAMLResponse"), result.samlResponse)
+	assert.True(t, route.fulfilled)
+
+	// regional sign-in endpoints are the same partition
+	route = newFakeRoute("https://us-west-2.signin.aws.amazon.com/saml", samlPost("https://us-west-2.signin.aws.amazon.com/saml"))
+	result, ok = client.interceptSAMLResponse(route)
+	require.True(t, ok)
+	require.Nil(t, result.err)
+
+	// visiting the sign-in page without a SAML response isn't the login finishing
+	route = newFakeRoute("https://signin.aws.amazon.com/saml", "")
+	_, ok = client.interceptSAMLResponse(route)
+	assert.False(t, ok)
+	assert.True(t, route.continued)
+}
+
+func TestInterceptSAMLResponseWrongPartition(t *testing.T) {
+	client, err := New(&cfg.IDPAccount{AmazonWebservicesURN: "urn:amazon:webservices:govcloud", Region: "us-gov-west-1"})
+	require.Nil(t, err)
+
+	route := newFakeRoute("https://signin.aws.amazon.com/saml", samlPost("https://signin.aws.amazon.com/saml"))
+	result, ok := client.interceptSAMLResponse(route)
+	require.True(t, ok)
+	assert.EqualError(t, result.err, "SAML response posted to https://signin.aws.amazon.com/saml, only signin.amazonaws-us-gov.com are allowed for this account's aws_urn and region")
+	assert.True(t, route.aborted)
+	assert.False(t, route.fulfilled)
+}
+
+func TestInterceptSAMLResponseWrongDestination(t *testing.T) {
+	client, err := New(&cfg.IDPAccount{})
+	require.Nil(t, err)
+
+	route := newFakeRoute("https://signin.aws.amazon.com/saml", samlPost("https://sp.example.com/acs"))
+	result, ok := client.interceptSAMLResponse(route)
+	require.True(t, ok)
+	assert.EqualError(t, result.err, "SAML response is for https://sp.example.com/acs, only signin.aws.amazon.com are allowed for this account's aws_urn and region")
+	assert.True(t, route.aborted)
+}
+
+func TestWaitForSAMLResponse(t *testing.T) {
+	client, err := New(&cfg.IDPAccount{BrowserTimeout: 5})
+	require.Nil(t, err)
+
+	results := make(chan samlResult, 1)
+	results <- samlResult{samlResponse: "assertion"}
+
+	samlResponse, err := client.waitForSAMLResponse(results)
+	require.Nil(t, err)
+	assert.Equal(t, "assertion", samlResponse)
+}
+
+func TestWaitForSAMLResponseTimeout(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = 10 * time.Millisecond
+
+	client := &Client{BrowserTimeout: 50 * time.Millisecond}
+
+	_, err := client.waitForSAMLResponse(make(chan samlResult))
+	var timeoutErr *TimeoutError
+	require.True(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, 50*time.Millisecond, timeoutErr.Timeout)
+	assert.EqualError(t, err, "no SAML response from the browser after 50ms, the IdP login wasn't finished in time")
+}
+
+func TestBrowserTimeoutDefault(t *testing.T) {
+	client, err := New(&cfg.IDPAccount{Timeout: 100000})
+	require.Nil(t, err)
+	assert.Equal(t, 100*time.Second, client.browserTimeout())
+
+	client, err = New(&cfg.IDPAccount{})
+	require.Nil(t, err)
+	assert.Equal(t, 300*time.Second, client.browserTimeout())
+}
+
+func TestPauseOnError(t *testing.T) {
+	waited := 0
+	currentWaitForEnter := waitForEnter
+	defer func() {
+		waitForEnter = currentWaitForEnter
+	}()
+	waitForEnter = func() {
+		waited++
+	}
+
+	client, err := New(&cfg.IDPAccount{BrowserKeepOpenOnError: true})
+	require.Nil(t, err)
+	assert.False(t, client.pauseOnError(nil))
+	assert.True(t, client.pauseOnError(errors.New("no SAML response")))
+	assert.Equal(t, 1, waited)
+
+	// there's no window to inspect when headless
+	client, err = New(&cfg.IDPAccount{BrowserKeepOpenOnError: true, Headless: true})
+	require.Nil(t, err)
+	assert.False(t, client.pauseOnError(errors.New("no SAML response")))
+
+	client, err = New(&cfg.IDPAccount{})
+	require.Nil(t, err)
+	assert.False(t, client.pauseOnError(errors.New("no SAML response")))
+	assert.Equal(t, 1, waited)
+}
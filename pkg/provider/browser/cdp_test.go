@@ -0,0 +1,40 @@
+package browser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+)
+
+func TestCheckCDPEndpoint(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/json/version" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"Browser": "Chrome/120.0.0.0", "webSocketDebuggerUrl": "ws://localhost/devtools/browser/abc"}`))
+	}))
+	defer ts.Close()
+
+	require.Nil(t, checkCDPEndpoint(ts.URL))
+	require.Nil(t, checkCDPEndpoint(ts.URL+"/"))
+	require.Nil(t, checkCDPEndpoint("ws://localhost:9222/devtools/browser/abc"))
+
+	require.ErrorContains(t, checkCDPEndpoint(ts.URL+"/other"), "is not a Chrome DevTools endpoint, /json/version returned 404")
+}
+
+func TestAuthenticateCDPEndpointUnreachable(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	endpoint := ts.URL
+	ts.Close()
+
+	client, err := New(&cfg.IDPAccount{Headless: true, BrowserCDPEndpoint: endpoint})
+	require.Nil(t, err)
+
+	_, err = client.Authenticate(&creds.LoginDetails{URL: "https://id.example.com"})
+	require.ErrorContains(t, err, "unable to reach the browser at browser_cdp_endpoint "+endpoint+", is Chrome running with --remote-debugging-port?")
+}
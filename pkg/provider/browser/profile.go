@@ -0,0 +1,39 @@
+package browser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/versent/saml2aws/v2/internal/filelock"
+)
+
+// LockProfile takes the browser profile for this saml2aws alone, failing straight away rather than waiting when
+// another login is using it. The lock file sits next to the profile so clearing the profile leaves it alone.
+func LockProfile(dir string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create the browser profile directory: %w", err)
+	}
+
+	unlock, err := filelock.TryLock(dir)
+	if errors.Is(err, filelock.ErrLocked) {
+		return nil, fmt.Errorf("browser profile %s is in use by another saml2aws login, wait for it to finish", dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock the browser profile: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// ClearProfile removes the browser profile along with the IdP sessions and remembered devices it holds
+func ClearProfile(dir string) error {
+	unlock, err := LockProfile(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,59 @@
+package browser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+)
+
+func TestLockProfileFailsWhenInUse(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "profiles", "work")
+
+	unlock, err := LockProfile(dir)
+	require.Nil(t, err)
+
+	_, err = LockProfile(dir)
+	require.EqualError(t, err, "browser profile "+dir+" is in use by another saml2aws login, wait for it to finish")
+
+	unlock()
+
+	unlock, err = LockProfile(dir)
+	require.Nil(t, err)
+	unlock()
+}
+
+func TestAuthenticateProfileInUse(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "work")
+
+	unlock, err := LockProfile(dir)
+	require.Nil(t, err)
+	defer unlock()
+
+	client, err := New(&cfg.IDPAccount{Headless: true, BrowserProfileDir: dir})
+	require.Nil(t, err)
+
+	_, err = client.Authenticate(&creds.LoginDetails{URL: "https://id.example.com"})
+	require.ErrorContains(t, err, "is in use by another saml2aws login")
+}
+
+func TestClearProfile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "work")
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "Default"), 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "Default", "Cookies"), []byte("session"), 0600))
+
+	require.Nil(t, ClearProfile(dir))
+	_, err := os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+
+	// clearing a profile that was never used is fine
+	require.Nil(t, ClearProfile(dir))
+
+	unlock, err := LockProfile(dir)
+	require.Nil(t, err)
+	defer unlock()
+	require.ErrorContains(t, ClearProfile(dir), "is in use by another saml2aws login")
+}
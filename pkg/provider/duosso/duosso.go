@@ -0,0 +1,185 @@
+package duosso
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/duo"
+	"github.com/versent/saml2aws/v2/pkg/page"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+// ProviderName constant for Duo SSO provider
+const ProviderName = "DuoSSO"
+
+// maxPages the most pages followed before giving up, Duo SSO normally takes half a dozen
+const maxPages = 20
+
+var logger = logrus.WithField("provider", "duosso")
+
+// EnrollmentRequiredError returned when Duo wants the user to enroll a device before they can log in
+type EnrollmentRequiredError = duo.EnrollmentRequiredError
+
+// Client wrapper around Duo SSO enabling authentication and retrieval of assertions
+type Client struct {
+	provider.ValidateBase
+
+	client     *provider.HTTPClient
+	idpAccount *cfg.IDPAccount
+}
+
+// New create a new Duo SSO client
+func New(idpAccount *cfg.IDPAccount) (*Client, error) {
+	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
+
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building http client")
+	}
+
+	// assign a response validator to ensure all responses are either success or a redirect
+	client.CheckResponseStatus = provider.SuccessOrRedirectResponseValidator
+
+	return &Client{
+		client:     client,
+		idpAccount: idpAccount,
+	}, nil
+}
+
+// Authenticate logs in to Duo SSO and returns the SAML assertion it posts to AWS
+func (dc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	req, err := http.NewRequest("GET", loginDetails.URL, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error building request")
+	}
+
+	for i := 0; i < maxPages; i++ {
+		res, err := dc.client.Do(req)
+		if err != nil {
+			return "", errors.Wrap(err, "error retrieving page")
+		}
+
+		doc, err := goquery.NewDocumentFromReader(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return "", errors.Wrap(err, "failed to build document from response")
+		}
+		doc.Url = res.Request.URL
+
+		if samlResponse, ok := doc.Find("input[name=\"SAMLResponse\"]").Attr("value"); ok {
+			logger.WithField("type", "saml-response").Debug("doc detect")
+			return samlResponse, nil
+		}
+
+		switch {
+		case docIsEnrollment(doc):
+			logger.WithField("type", "enrollment").Debug("doc detect")
+			return "", &EnrollmentRequiredError{URL: doc.Url.String()}
+		case docIsPluginForm(doc):
+			logger.WithField("type", "plugin-form").Debug("doc detect")
+			req, err = buildFormRequest(doc, "#plugin_form")
+		case duo.IsUniversalPrompt(doc):
+			logger.WithField("type", "universal-prompt").Debug("doc detect")
+			req, err = dc.handleUniversalPrompt(doc, loginDetails)
+		case docIsLogin(doc):
+			logger.WithField("type", "login").Debug("doc detect")
+			req, err = dc.handleLogin(doc, loginDetails)
+		case docIsAutoSubmit(doc):
+			logger.WithField("type", "auto-submit").Debug("doc detect")
+			req, err = buildFormRequest(doc, "form")
+		default:
+			html, _ := doc.Selection.Html()
+			logger.WithField("doc", html).Debug("Unknown document type")
+			return "", errors.Errorf("unknown document type at %s", doc.Url)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "", errors.New("too many pages without reaching a SAML response")
+}
+
+func (dc *Client) handleLogin(doc *goquery.Document, loginDetails *creds.LoginDetails) (*http.Request, error) {
+	form, err := page.NewFormFromDocument(doc, "form:has(input[name=\"username\"]), form:has(input[name=\"password\"])")
+	if err != nil {
+		return nil, errors.Wrap(err, "error extracting login form")
+	}
+
+	// the username and password may be asked for on one page or on two
+	if doc.Find("input[name=\"username\"]").Size() > 0 {
+		form.Values.Set("username", loginDetails.Username)
+	}
+	if doc.Find("input[name=\"password\"]").Size() > 0 {
+		form.Values.Set("password", loginDetails.Password)
+	}
+	form.URL = resolveURL(doc.Url, form.URL)
+
+	return form.BuildRequest()
+}
+
+// handleUniversalPrompt answers the Universal Prompt with the factor picked, then requests where Duo sends
+// the user back to in Duo SSO
+func (dc *Client) handleUniversalPrompt(doc *goquery.Document, loginDetails *creds.LoginDetails) (*http.Request, error) {
+	prompt := duo.New(dc.client, duo.Options{
+		Device:   dc.idpAccount.DuoDevice,
+		Factor:   duo.FactorForMFA(dc.idpAccount.MFA),
+		Passcode: loginDetails.MFAToken,
+		Prompter: loginDetails.Prompter,
+	})
+
+	callback, err := prompt.VerifyUniversalPrompt(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.NewRequest("GET", callback.URL, nil)
+}
+
+func buildFormRequest(doc *goquery.Document, selector string) (*http.Request, error) {
+	form, err := page.NewFormFromDocument(doc, selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "error extracting form")
+	}
+	form.URL = resolveURL(doc.Url, form.URL)
+	return form.BuildRequest()
+}
+
+// resolveURL resolves a link or form action against the page it came from
+func resolveURL(base *url.URL, ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+func docIsLogin(doc *goquery.Document) bool {
+	return doc.Find("form input[name=\"username\"], form input[name=\"password\"]").Size() > 0
+}
+
+func docIsPluginForm(doc *goquery.Document) bool {
+	return doc.Find("form#plugin_form").Size() == 1
+}
+
+func docIsEnrollment(doc *goquery.Document) bool {
+	return strings.Contains(doc.Url.Path, "/enroll")
+}
+
+// docIsAutoSubmit a form of hidden fields the page's script posts straight away
+func docIsAutoSubmit(doc *goquery.Document) bool {
+	form := doc.Find("form").First()
+	method, _ := form.Attr("method")
+	return strings.EqualFold(method, "post") && form.Find("input:not([type=\"hidden\"]):not([type=\"submit\"])").Size() == 0
+}
@@ -0,0 +1,187 @@
+package duosso
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/duo"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+var docTests = []struct {
+	fn       func(*goquery.Document) bool
+	file     string
+	expected bool
+}{
+	{docIsLogin, "example/login.html", true},
+	{docIsLogin, "example/plugin_form.html", false},
+	{docIsLogin, "example/universal_prompt.html", false},
+	{docIsPluginForm, "example/login.html", false},
+	{docIsPluginForm, "example/plugin_form.html", true},
+	{docIsPluginForm, "example/saml_response.html", false},
+	{docIsAutoSubmit, "example/login.html", false},
+	{docIsAutoSubmit, "example/plugin_form.html", true},
+	{docIsAutoSubmit, "example/saml_response.html", true},
+}
+
+func TestDocTypes(t *testing.T) {
+	for _, tt := range docTests {
+		data, err := os.ReadFile(tt.file)
+		require.Nil(t, err)
+
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+		require.Nil(t, err)
+
+		require.Equal(t, tt.expected, tt.fn(doc), "%s of %s", "doc type", tt.file)
+	}
+}
+
+// duoServer serves the pages and Universal Prompt responses of a Duo SSO login from the example directory
+type duoServer struct {
+	*httptest.Server
+
+	promptData string
+	statuses   []string
+	forms      map[string]url.Values
+}
+
+func newDuoServer(t *testing.T, statuses ...string) *duoServer {
+	ds := &duoServer{promptData: "example/prompt_data.json", statuses: statuses, forms: map[string]url.Values{}}
+
+	serve := func(file string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			require.Nil(t, r.ParseForm())
+			ds.forms[r.URL.Path] = r.Form
+			http.ServeFile(w, r, file)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/saml2/sp/DIEXAMPLE/sso", serve("example/login.html"))
+	mux.Handle("/saml2/sp/DIEXAMPLE/login", serve("example/plugin_form.html"))
+	mux.HandleFunc("/frame/frameless/v4/auth", func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		ds.forms[r.URL.Path] = r.Form
+		http.Redirect(w, r, "/frame/v4/auth/prompt?sid=frameless-example-sid", http.StatusFound)
+	})
+	mux.Handle("/frame/v4/auth/prompt", serve("example/universal_prompt.html"))
+	mux.HandleFunc("/frame/v4/auth/prompt/data", func(w http.ResponseWriter, r *http.Request) {
+		serve(ds.promptData)(w, r)
+	})
+	mux.Handle("/frame/v4/prompt", serve("example/prompt.json"))
+	mux.HandleFunc("/frame/v4/status", func(w http.ResponseWriter, r *http.Request) {
+		status := ds.statuses[0]
+		if len(ds.statuses) > 1 {
+			ds.statuses = ds.statuses[1:]
+		}
+		serve(status)(w, r)
+	})
+	mux.HandleFunc("/frame/v4/oidc/exit", func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		ds.forms[r.URL.Path] = r.Form
+		http.Redirect(w, r, "/saml2/sp/DIEXAMPLE/response", http.StatusFound)
+	})
+	mux.Handle("/saml2/sp/DIEXAMPLE/response", serve("example/saml_response.html"))
+	mux.Handle("/frame/v4/enroll", serve("example/enroll.html"))
+
+	ds.Server = httptest.NewServer(mux)
+	t.Cleanup(ds.Close)
+	return ds
+}
+
+func newTestClient(t *testing.T, idpAccount *cfg.IDPAccount) *Client {
+	duo.StatusPollInterval = 0
+
+	client, err := New(idpAccount)
+	require.Nil(t, err)
+	return client
+}
+
+func TestAuthenticatePush(t *testing.T) {
+	ds := newDuoServer(t, "example/status_pushed.json", "example/status_allow.json")
+	client := newTestClient(t, &cfg.IDPAccount{MFA: "PUSH", DuoDevice: "iphone"})
+
+	loginDetails := &creds.LoginDetails{URL: ds.URL + "/saml2/sp/DIEXAMPLE/sso", Username: "user@example.com", Password: "secret"}
+	samlResponse, err := client.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.Equal(t, "PHNhbWxwOlJlc3BvbnNlPjwvc2FtbHA6UmVzcG9uc2U+", samlResponse)
+
+	require.Equal(t, "user@example.com", ds.forms["/saml2/sp/DIEXAMPLE/login"].Get("username"))
+	require.Equal(t, "secret", ds.forms["/saml2/sp/DIEXAMPLE/login"].Get("password"))
+	require.Equal(t, "tx-example", ds.forms["/frame/frameless/v4/auth"].Get("tx"))
+	require.Equal(t, "DPPHONE1", ds.forms["/frame/v4/prompt"].Get("device"))
+	require.Equal(t, "Duo Push", ds.forms["/frame/v4/prompt"].Get("factor"))
+	require.Equal(t, "txid-example", ds.forms["/frame/v4/status"].Get("txid"))
+	require.Equal(t, "txid-example", ds.forms["/frame/v4/oidc/exit"].Get("txid"))
+	require.Equal(t, "prompt-xsrf", ds.forms["/frame/v4/oidc/exit"].Get("_xsrf"))
+}
+
+func TestAuthenticatePromptsForDeviceAndFactor(t *testing.T) {
+	ds := newDuoServer(t, "example/status_allow.json")
+	client := newTestClient(t, &cfg.IDPAccount{MFA: "Auto"})
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Choose", "Select a Duo device", []string{"iPhone", "Desk phone", "Passcode"}).Return(0)
+	pr.Mock.On("Choose", "Select a Duo factor", []string{"Duo Push", "Phone Call"}).Return(1)
+
+	loginDetails := &creds.LoginDetails{URL: ds.URL + "/saml2/sp/DIEXAMPLE/sso", Username: "user@example.com", Password: "secret"}
+	_, err := client.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.Equal(t, "DPPHONE1", ds.forms["/frame/v4/prompt"].Get("device"))
+	require.Equal(t, "Phone Call", ds.forms["/frame/v4/prompt"].Get("factor"))
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestAuthenticatePasscode(t *testing.T) {
+	ds := newDuoServer(t, "example/status_allow.json")
+	client := newTestClient(t, &cfg.IDPAccount{MFA: "PASSCODE", DuoDevice: "Passcode"})
+
+	loginDetails := &creds.LoginDetails{URL: ds.URL + "/saml2/sp/DIEXAMPLE/sso", Username: "user@example.com", Password: "secret", MFAToken: "123456"}
+	_, err := client.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.Equal(t, "Passcode", ds.forms["/frame/v4/prompt"].Get("factor"))
+	require.Equal(t, "123456", ds.forms["/frame/v4/prompt"].Get("passcode"))
+}
+
+func TestAuthenticateDenied(t *testing.T) {
+	ds := newDuoServer(t, "example/status_pushed.json", "example/status_deny.json")
+	client := newTestClient(t, &cfg.IDPAccount{MFA: "PUSH", DuoDevice: "iPhone"})
+
+	loginDetails := &creds.LoginDetails{URL: ds.URL + "/saml2/sp/DIEXAMPLE/sso", Username: "user@example.com", Password: "secret"}
+	_, err := client.Authenticate(loginDetails)
+	require.EqualError(t, err, "Duo Push was not approved: User marked as fraud")
+}
+
+func TestAuthenticateEnrollmentRequired(t *testing.T) {
+	ds := newDuoServer(t, "example/status_allow.json")
+	ds.promptData = "example/prompt_data_enroll.json"
+	client := newTestClient(t, &cfg.IDPAccount{MFA: "Auto"})
+
+	loginDetails := &creds.LoginDetails{URL: ds.URL + "/saml2/sp/DIEXAMPLE/sso", Username: "user@example.com", Password: "secret"}
+	_, err := client.Authenticate(loginDetails)
+
+	var enrollErr *EnrollmentRequiredError
+	require.ErrorAs(t, err, &enrollErr)
+	require.Contains(t, enrollErr.URL, "/frame/v4/auth/prompt")
+}
+
+func TestAuthenticateEnrollmentPage(t *testing.T) {
+	ds := newDuoServer(t)
+	client := newTestClient(t, &cfg.IDPAccount{MFA: "Auto"})
+
+	_, err := client.Authenticate(&creds.LoginDetails{URL: ds.URL + "/frame/v4/enroll"})
+
+	var enrollErr *EnrollmentRequiredError
+	require.ErrorAs(t, err, &enrollErr)
+	require.Equal(t, ds.URL+"/frame/v4/enroll", enrollErr.URL)
+}
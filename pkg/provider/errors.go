@@ -0,0 +1,28 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidCredentials providers return this, through InvalidCredentials, when the IdP rejected the username or
+// password as opposed to failing for any other reason, so the login can ask for the password again
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// invalidCredentialsError keeps the IdP's own message while matching ErrInvalidCredentials
+type invalidCredentialsError struct {
+	message string
+}
+
+func (e *invalidCredentialsError) Error() string {
+	return e.message
+}
+
+func (e *invalidCredentialsError) Is(target error) bool {
+	return target == ErrInvalidCredentials
+}
+
+// InvalidCredentials an error with the given message that errors.Is matches to ErrInvalidCredentials
+func InvalidCredentials(format string, args ...interface{}) error {
+	return &invalidCredentialsError{message: fmt.Sprintf(format, args...)}
+}
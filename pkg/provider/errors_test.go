@@ -0,0 +1,18 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidCredentials(t *testing.T) {
+	err := InvalidCredentials("login failed: %s", "Invalid username or password.")
+	require.EqualError(t, err, "login failed: Invalid username or password.")
+	require.True(t, errors.Is(err, ErrInvalidCredentials))
+	require.True(t, errors.Is(fmt.Errorf("error authenticating: %w", err), ErrInvalidCredentials))
+
+	require.False(t, errors.Is(errors.New("Invalid username or password."), ErrInvalidCredentials))
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -14,7 +15,6 @@ import (
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/dump"
-	"github.com/versent/saml2aws/v2/pkg/prompter"
 
 	"github.com/pkg/errors"
 	"github.com/versent/saml2aws/v2/pkg/provider"
@@ -24,6 +24,22 @@ import (
 
 var logger = logrus.WithField("provider", "f5apm")
 
+// The RSA SecurID challenges of an access policy, after the password
+const (
+	challengeNone      = ""
+	challengeNextToken = "next tokencode"
+	challengeNewPIN    = "new PIN"
+)
+
+const (
+	// challengeField the field APM asks for the tokencode or new PIN in
+	challengeField = "_F5_challenge"
+	// verifyField the field APM asks for the new PIN again in
+	verifyField = "_F5_verify_password"
+	// maxChallenges the most challenges answered before giving up, a new PIN is followed by a next tokencode
+	maxChallenges = 5
+)
+
 // Client client for F5 APM
 type Client struct {
 	provider.ValidateBase
@@ -36,7 +52,12 @@ type Client struct {
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error building HTTP client")
 	}
@@ -73,13 +94,13 @@ func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 		logger.Debug(mfaMethods)
 		mfaAuthForm := url.Values{}
 		var mfaToken string
-		mfaMethod, err := prompter.ChooseWithDefault("MFA Method", mfaMethods[0], mfaMethods)
+		mfaMethod, err := loginDetails.Asker().ChooseWithDefault("MFA Method", mfaMethods[0], mfaMethods)
 		if err != nil {
 			return "", errors.Wrap(err, "Error selecting MFA method")
 		}
 		switch mfaMethod {
 		case "token":
-			mfaToken = prompter.RequestSecurityCode("000000")
+			mfaToken = loginDetails.Asker().RequestSecurityCode("000000")
 		case "push":
 			mfaToken = ""
 		}
@@ -89,10 +110,20 @@ func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 		mfaAuthForm.Add("mfa_retry", "")
 		logger.Debug("Post Token Form")
 		debugAuthForm(mfaAuthForm)
-		_, err = ac.postLoginForm(loginDetails, mfaAuthForm)
+		mfaData, err := ac.postLoginForm(loginDetails, mfaAuthForm)
 		if err != nil {
 			return "", errors.Wrap(err, "Error submitting MFA login form")
 		}
+		upDoc, err = goquery.NewDocumentFromReader(bytes.NewBuffer(mfaData))
+		if err != nil {
+			return "", errors.Wrap(err, "Error reading MFA data")
+		}
+	}
+
+	// Answer the RSA SecurID challenges the policy may follow up with
+	err = ac.answerChallenges(loginDetails, upDoc)
+	if err != nil {
+		return "", err
 	}
 
 	// Post to saml endpoint
@@ -135,6 +166,9 @@ func (ac *Client) getSAMLAssertion(loginDetails *creds.LoginDetails) (string, er
 	if err != nil {
 		return "", errors.Wrap(err, "Error reading SAML data")
 	}
+	if message, denied := deniedMessage(doc); denied {
+		return "", errors.Errorf("F5 APM denied access: %s", message)
+	}
 	doc.Find("input").Each(func(i int, s *goquery.Selection) {
 		name, ok := s.Attr("name")
 		if !ok {
@@ -249,6 +283,100 @@ func debugHTTPResponse(ac *Client, res *http.Response) {
 	}
 }
 
+// answerChallenges prompts for the next tokencode or a new PIN while the access policy asks for one, posting each
+// answer back to the policy with the session cookies
+func (ac *Client) answerChallenges(loginDetails *creds.LoginDetails, doc *goquery.Document) error {
+	for i := 0; ; i++ {
+		if message, denied := deniedMessage(doc); denied {
+			return errors.Errorf("F5 APM denied access: %s", message)
+		}
+
+		challenge := challengeType(doc)
+		if challenge == challengeNone {
+			return nil
+		}
+		if i == maxChallenges {
+			return errors.New("F5 APM kept asking for RSA SecurID challenges, giving up")
+		}
+
+		if header := pageHeader(doc); header != "" {
+			log.Println(header)
+		}
+
+		authForm := policyForm(doc)
+		switch challenge {
+		case challengeNextToken:
+			authForm.Set(challengeField, loginDetails.Asker().StringRequired("Next tokencode"))
+		case challengeNewPIN:
+			pin := loginDetails.Asker().Password("New PIN")
+			if loginDetails.Asker().Password("Confirm new PIN") != pin {
+				return errors.New("the new PINs entered don't match")
+			}
+			authForm.Set(challengeField, pin)
+			authForm.Set(verifyField, pin)
+		}
+
+		logger.WithField("challenge", challenge).Debug("Post Challenge Form")
+		data, err := ac.postLoginForm(loginDetails, authForm)
+		if err != nil {
+			return errors.Wrap(err, "Error submitting RSA SecurID challenge")
+		}
+		doc, err = goquery.NewDocumentFromReader(bytes.NewBuffer(data))
+		if err != nil {
+			return errors.Wrap(err, "Error reading challenge data")
+		}
+	}
+}
+
+// challengeType the RSA SecurID challenge the policy page asks for, telling the new PIN page apart by its field
+// to verify the PIN
+func challengeType(doc *goquery.Document) string {
+	if doc.Find(fmt.Sprintf("input[name=%q]", challengeField)).Size() == 0 {
+		return challengeNone
+	}
+	if doc.Find(fmt.Sprintf("input[name=%q]", verifyField)).Size() > 0 || strings.Contains(strings.ToLower(pageHeader(doc)), "new pin") {
+		return challengeNewPIN
+	}
+	return challengeNextToken
+}
+
+// policyForm the fields of the policy page's form, with the values the page gives them
+func policyForm(doc *goquery.Document) url.Values {
+	authForm := url.Values{}
+	doc.Find("form#auth_form input").Each(func(i int, s *goquery.Selection) {
+		name, ok := s.Attr("name")
+		if !ok {
+			return
+		}
+		inputType, _ := s.Attr("type")
+		if strings.EqualFold(inputType, "submit") {
+			return
+		}
+		authForm.Set(name, s.AttrOr("value", ""))
+	})
+	return authForm
+}
+
+// pageHeader the instructions the policy page shows above its fields
+func pageHeader(doc *goquery.Document) string {
+	return strings.Join(strings.Fields(doc.Find("#credentials_table_header").Text()), " ")
+}
+
+// deniedMessage the message of the logout page APM shows when the access policy ends in deny
+func deniedMessage(doc *goquery.Document) (string, bool) {
+	if doc.Find("table.logout_page").Size() == 0 {
+		return "", false
+	}
+	message := strings.Join(strings.Fields(doc.Find(".logout").First().Text()), " ")
+	if message == "" {
+		message = strings.Join(strings.Fields(doc.Find("#main_table_info_cell").Text()), " ")
+	}
+	if message == "" {
+		message = "the access policy ended in deny"
+	}
+	return message, true
+}
+
 func containsMFAForm(doc *goquery.Document) (bool, []string) {
 	containsMFA := false
 	var mfaMethods []string
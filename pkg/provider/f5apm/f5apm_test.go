@@ -10,7 +10,10 @@ import (
 	"testing"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
 
 	"github.com/versent/saml2aws/v2/pkg/provider"
 
@@ -86,3 +89,85 @@ func TestClient_containsMFAForm_False(t *testing.T) {
 	require.False(t, mfaFound)
 	require.Equal(t, []string(nil), mfaMethods)
 }
+
+// newPolicyServer serves an access policy asking for a new PIN and then the next tokencode after the password
+func newPolicyServer(t *testing.T, forms *[]url.Values) *httptest.Server {
+	serve := func(w http.ResponseWriter, file string) {
+		data, err := os.ReadFile(file)
+		require.Nil(t, err)
+		_, _ = w.Write(data)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			serve(w, "example/loginpage.html")
+		case "/my.policy":
+			require.Nil(t, r.ParseForm())
+			*forms = append(*forms, r.PostForm)
+			switch {
+			case r.PostForm.Get("password") == "wrong":
+				serve(w, "example/denied.html")
+			case r.PostForm.Get("username") != "":
+				serve(w, "example/newpin.html")
+			case r.PostForm.Get("_F5_verify_password") != "":
+				serve(w, "example/nexttoken.html")
+			default:
+				_, _ = w.Write([]byte("<html><body>Logged in</body></html>"))
+			}
+		case "/saml/idp/res":
+			_, _ = w.Write([]byte(`<html><body><form><input type="hidden" name="SAMLResponse" value="PHNhbWxwOlJlc3BvbnNlPjwvc2FtbHA6UmVzcG9uc2U+"></form></body></html>`))
+		}
+	}))
+}
+
+func TestClient_AuthenticateSecurIDChallenges(t *testing.T) {
+	var forms []url.Values
+	ts := newPolicyServer(t, &forms)
+	defer ts.Close()
+
+	ac, err := New(&cfg.IDPAccount{ResourceID: "/Common/example-aws-account"})
+	require.Nil(t, err)
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Password", "New PIN").Return("1234")
+	pr.Mock.On("Password", "Confirm new PIN").Return("1234")
+	pr.Mock.On("StringRequired", "Next tokencode").Return("654321")
+
+	samlAssertion, err := ac.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "groundcontrol", Password: "majortom"})
+	require.Nil(t, err)
+	require.Equal(t, "PHNhbWxwOlJlc3BvbnNlPjwvc2FtbHA6UmVzcG9uc2U+", samlAssertion)
+
+	require.Len(t, forms, 3)
+	require.Equal(t, url.Values{"_F5_challenge": {"1234"}, "_F5_verify_password": {"1234"}, "vhost": {"standard"}}, forms[1])
+	require.Equal(t, url.Values{"_F5_challenge": {"654321"}, "vhost": {"standard"}}, forms[2])
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestClient_AuthenticateDenied(t *testing.T) {
+	var forms []url.Values
+	ts := newPolicyServer(t, &forms)
+	defer ts.Close()
+
+	ac, err := New(&cfg.IDPAccount{ResourceID: "/Common/example-aws-account"})
+	require.Nil(t, err)
+
+	_, err = ac.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "groundcontrol", Password: "wrong"})
+	require.EqualError(t, err, "F5 APM denied access: Access was denied by the access policy. This may be due to a failure to meet access policy requirements.")
+}
+
+func TestChallengeType(t *testing.T) {
+	for file, challenge := range map[string]string{
+		"example/loginpage.html": challengeNone,
+		"example/mfapage.html":   challengeNone,
+		"example/newpin.html":    challengeNewPIN,
+		"example/nexttoken.html": challengeNextToken,
+	} {
+		data, err := os.ReadFile(file)
+		require.Nil(t, err)
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+		require.Nil(t, err)
+		require.Equal(t, challenge, challengeType(doc), file)
+	}
+}
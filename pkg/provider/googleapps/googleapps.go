@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/pkg/errors"
@@ -20,35 +21,80 @@ import (
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 	"github.com/versent/saml2aws/v2/pkg/provider"
+	"github.com/versent/saml2aws/v2/pkg/provider/okta"
 )
 
 var logger = logrus.WithField("provider", "googleapps")
 
+// authMethods the values of google_auth_method, in the order they are listed in errors
+var authMethods = []string{"TOTP", "SMS", "PROMPT", "SECURITY_KEY", "SECURITY_KEY_OTP"}
+
+// authMethodChallenges the challenge form actions each google_auth_method picks, e.g. /signin/challenge/totp/2
+var authMethodChallenges = map[string][]string{
+	"TOTP":             {"challenge/totp/"},
+	"SMS":              {"challenge/ipp/"},
+	"PROMPT":           {"challenge/az/", "challenge/dp/"},
+	"SECURITY_KEY":     {"challenge/sk/", "challenge/pk/"},
+	"SECURITY_KEY_OTP": {"challenge/skotp/"},
+}
+
+var (
+	// devicePushPollInterval and devicePushTimeout how often and how long the phone prompt is polled for an answer
+	devicePushPollInterval = 2 * time.Second
+	devicePushTimeout      = 2 * time.Minute
+
+	// challengeWebAuthn signs the security key and passkey challenges, replaced in tests
+	challengeWebAuthn = func(challenge *okta.WebAuthnChallenge) (*okta.WebAuthnAssertion, error) {
+		authenticator, err := okta.NewFIDO2Authenticator()
+		if err != nil {
+			return nil, err
+		}
+		return okta.ChallengeWebAuthn(authenticator, challenge)
+	}
+)
+
 // Client wrapper around Google Apps.
 type Client struct {
 	provider.ValidateBase
 
 	client *provider.HTTPClient
+
+	// authMethod the google_auth_method challenge to ask Google for instead of the one it starts with
+	authMethod string
+	// pickerVisited set once the "Try another way" list was used, so a missing authMethod doesn't loop back to it
+	pickerVisited bool
 }
 
 // New create a new Google Apps Client
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
+	if idpAccount.GoogleAuthMethod != "" && authMethodChallenges[idpAccount.GoogleAuthMethod] == nil {
+		return nil, fmt.Errorf("unsupported google_auth_method %s, expected one of %s", idpAccount.GoogleAuthMethod, strings.Join(authMethods, ", "))
+	}
+
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
 
 	return &Client{
-		client: client,
+		client:     client,
+		authMethod: idpAccount.GoogleAuthMethod,
 	}, nil
 }
 
 // Authenticate logs into Google Apps and returns a SAML response
 func (kc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
 
+	kc.pickerVisited = false
+
 	// Get the first page
 	authURL, authForm, err := kc.loadFirstPage(loginDetails)
 	if err != nil {
@@ -119,7 +165,7 @@ func (kc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 			return "", errors.Wrap(err, "error generating captcha image URL")
 		}
 
-		captcha, err := kc.tryDisplayCaptcha(captchaPictureURL)
+		captcha, err := kc.tryDisplayCaptcha(loginDetails.Asker(), captchaPictureURL)
 		if err != nil {
 			return "", err
 		}
@@ -184,18 +230,18 @@ func isMissing2StepSetup(responseDoc *goquery.Document) error {
 	return nil
 }
 
-func (kc *Client) tryDisplayCaptcha(captchaPictureURL string) (string, error) {
+func (kc *Client) tryDisplayCaptcha(ask prompter.Asker, captchaPictureURL string) (string, error) {
 	// TODO: check for user flag for easy captcha presentation
 
 	if os.Getenv("TERM_PROGRAM") == "iTerm.app" {
 		// Use iTerm to show the image if available
-		return kc.iTermCaptchaPrompt(captchaPictureURL)
+		return kc.iTermCaptchaPrompt(ask, captchaPictureURL)
 	} else {
-		return simpleCaptchaPrompt(captchaPictureURL), nil
+		return simpleCaptchaPrompt(ask, captchaPictureURL), nil
 	}
 }
 
-func (kc *Client) iTermCaptchaPrompt(captchaPictureURL string) (string, error) {
+func (kc *Client) iTermCaptchaPrompt(ask prompter.Asker, captchaPictureURL string) (string, error) {
 	log.Printf("Detected iTerm, displaying URL: %s\n", captchaPictureURL)
 	imgResp, err := kc.client.Get(captchaPictureURL)
 	if err != nil {
@@ -208,16 +254,16 @@ func (kc *Client) iTermCaptchaPrompt(captchaPictureURL string) (string, error) {
 
 	if os.Getenv("TERM") == "screen" {
 		log.Println("Detected tmux, using specific workaround...")
-		fmt.Printf("\033Ptmux;\033\033]1337;File=width=40;preserveAspectRatio=1;inline=1;:%s\a\033\\\n", buf.String())
+		fmt.Fprintf(os.Stderr, "\033Ptmux;\033\033]1337;File=width=40;preserveAspectRatio=1;inline=1;:%s\a\033\\\n", buf.String())
 	} else {
-		fmt.Printf("\033]1337;File=width=40;preserveAspectRatio=1;inline=1;:%s\a\n", buf.String())
+		fmt.Fprintf(os.Stderr, "\033]1337;File=width=40;preserveAspectRatio=1;inline=1;:%s\a\n", buf.String())
 	}
-	return prompter.String("Captcha", ""), nil
+	return ask.String("Captcha", ""), nil
 }
 
-func simpleCaptchaPrompt(captchaPictureURL string) string {
+func simpleCaptchaPrompt(ask prompter.Asker, captchaPictureURL string) string {
 	log.Println("Open this link in a browser:\n", captchaPictureURL)
-	return prompter.String("Captcha", "")
+	return ask.String("Captcha", "")
 }
 
 func (kc *Client) loadFirstPage(loginDetails *creds.LoginDetails) (string, url.Values, error) {
@@ -318,7 +364,7 @@ func (kc *Client) loadChallengePage(submitURL string, referer string, authForm u
 	errMsg := mustFindErrorMsg(doc)
 
 	if errMsg != "" {
-		return nil, errors.New("Invalid username or password")
+		return nil, provider.InvalidCredentials("Invalid username or password")
 	}
 
 	secondFactorHeader := "This extra step shows it’s really you trying to sign in"
@@ -339,12 +385,17 @@ func (kc *Client) loadChallengePage(submitURL string, referer string, authForm u
 
 		logger.Debugf("secondActionURL: %s", secondActionURL)
 
+		if kc.authMethod != "" && !kc.pickerVisited && !isAuthMethodChallenge(kc.authMethod, secondActionURL) {
+			logger.Debugf("google_auth_method %s asks for another challenge", kc.authMethod)
+			return kc.skipChallengePage(doc, submitURL, secondActionURL, loginDetails)
+		}
+
 		switch {
 		case strings.Contains(secondActionURL, "challenge/totp"): // handle TOTP challenge
 
 			var token = loginDetails.MFAToken
 			if token == "" {
-				token = prompter.RequestSecurityCode("000000")
+				token = loginDetails.Asker().RequestSecurityCode("000000")
 			}
 
 			responseForm.Set("Pin", token)
@@ -373,36 +424,15 @@ func (kc *Client) loadChallengePage(submitURL string, referer string, authForm u
 				logger.Debugf("After sms request secondActionURL: %s", secondActionURL)
 			}
 
-			var token = prompter.StringRequired("Enter SMS token: G-")
+			var token = loginDetails.Asker().StringRequired("Enter SMS token: G-")
 
 			responseForm.Set("Pin", token)
 			responseForm.Set("TrustDevice", "on") // Don't ask again on this computer
 
 			return kc.loadResponsePage(secondActionURL, submitURL, responseForm)
 
-		case strings.Contains(secondActionURL, "challenge/sk"): // handle u2f challenge
-			facetComponents, err := url.Parse(secondActionURL)
-			if err != nil {
-				return nil, errors.Wrap(err, "unable to parse action URL for U2F challenge")
-			}
-			facet := facetComponents.Scheme + "://" + facetComponents.Host
-			challengeNonce := responseForm.Get("id-challenge")
-			appID, data := extractKeyHandles(doc, challengeNonce)
-			u2fClient, err := NewU2FClient(challengeNonce, appID, facet, data[0], &U2FDeviceFinder{})
-			if err != nil {
-				return nil, errors.Wrap(err, "Failed to prompt for second factor.")
-			}
-
-			response, err := u2fClient.ChallengeU2F()
-			if err != nil {
-				logger.WithError(err).Error("Second factor failed.")
-				return kc.skipChallengePage(doc, submitURL, secondActionURL, loginDetails)
-			}
-
-			responseForm.Set("id-assertion", response)
-			responseForm.Set("TrustDevice", "on")
-
-			return kc.loadResponsePage(secondActionURL, submitURL, responseForm)
+		case strings.Contains(secondActionURL, "challenge/sk/"), strings.Contains(secondActionURL, "challenge/pk/"): // handle security key and passkey challenges
+			return kc.loadSecurityKeyChallenge(doc, responseForm, submitURL, secondActionURL, loginDetails)
 		case strings.Contains(secondActionURL, "challenge/az"): // handle phone challenge
 
 			dataAttrs := extractDataAttributes(doc, "div[data-context]", []string{"data-context", "data-gapi-url", "data-tx-id", "data-api-key", "data-tx-lifetime"})
@@ -426,24 +456,42 @@ func (kc *Client) loadChallengePage(submitURL string, referer string, authForm u
 			return kc.loadResponsePage(secondActionURL, submitURL, responseForm)
 
 		case strings.Contains(secondActionURL, "challenge/dp"): // handle device push challenge
-			if extraNumber := extractDevicePushExtraNumber(doc); extraNumber != "" {
+			pollURL, polling := doc.Find("[data-poll-url]").Attr("data-poll-url")
+
+			extraNumber := extractDevicePushExtraNumber(doc)
+			switch {
+			case extraNumber != "":
 				log.Println("Check your phone and tap 'Yes' on the prompt, then tap the number:")
 				log.Printf("\t%v\n", extraNumber)
-				log.Println("Then press ENTER to continue.")
-			} else {
+				if !polling {
+					log.Println("Then press ENTER to continue.")
+				}
+			case polling:
+				log.Println("Check your phone and tap 'Yes' on the prompt.")
+			default:
 				log.Print("Check your phone and tap 'Yes' on the prompt. Then press ENTER to continue.")
 			}
 
-			_, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
-			if err != nil {
-				return nil, errors.Wrap(err, "error reading new line \\n")
+			if polling {
+				pollURL, err = generateFullURLIfRelative(pollURL, submitURL)
+				if err != nil {
+					return nil, err
+				}
+				if err := kc.waitForDevicePush(pollURL, submitURL); err != nil {
+					return nil, err
+				}
+			} else {
+				_, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
+				if err != nil {
+					return nil, errors.Wrap(err, "error reading new line \\n")
+				}
 			}
 			responseForm.Set("TrustDevice", "on") // Don't ask again on this computer
 			return kc.loadResponsePage(secondActionURL, submitURL, responseForm)
 
 		case strings.Contains(secondActionURL, "challenge/skotp"): // handle one-time HOTP challenge
 			log.Println("Get a one-time code by visiting https://g.co/sc on another device where you can use your security key")
-			var token = prompter.RequestSecurityCode("000 000")
+			var token = loginDetails.Asker().RequestSecurityCode("000 000")
 
 			responseForm.Set("Pin", token)
 			responseForm.Set("TrustDevice", "on") // Don't ask again on this computer
@@ -475,6 +523,200 @@ func (kc *Client) skipChallengePage(doc *goquery.Document, submitURL string, sec
 	return kc.loadAlternateChallengePage(skipActionURL, submitURL, skipResponseForm, loginDetails)
 }
 
+// loadSecurityKeyChallenge answers the security key and passkey pages with a FIDO2 assertion, or for the older
+// pages without a WebAuthn request, a U2F signature. A missing or failing key skips to another challenge.
+func (kc *Client) loadSecurityKeyChallenge(doc *goquery.Document, responseForm url.Values, submitURL string, secondActionURL string, loginDetails *creds.LoginDetails) (*goquery.Document, error) {
+	actionURL, err := url.Parse(secondActionURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse action URL for security key challenge")
+	}
+	facet := actionURL.Scheme + "://" + actionURL.Host
+
+	request, err := extractWebAuthnRequest(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if request == nil {
+		challengeNonce := responseForm.Get("id-challenge")
+		appID, data := extractKeyHandles(doc, challengeNonce)
+		u2fClient, err := NewU2FClient(challengeNonce, appID, facet, data[0], &U2FDeviceFinder{})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to prompt for second factor.")
+		}
+
+		response, err := u2fClient.ChallengeU2F()
+		if err != nil {
+			logger.WithError(err).Error("Second factor failed.")
+			return kc.skipChallengePage(doc, submitURL, secondActionURL, loginDetails)
+		}
+
+		responseForm.Set("id-assertion", response)
+		responseForm.Set("TrustDevice", "on")
+
+		return kc.loadResponsePage(secondActionURL, submitURL, responseForm)
+	}
+
+	// browsers use the host of the page when the request leaves the RP ID out
+	if request.RPID == "" {
+		request.RPID = actionURL.Hostname()
+	}
+
+	credentialIDs := make([]string, 0, len(request.AllowCredentials))
+	for _, credential := range request.AllowCredentials {
+		credentialIDs = append(credentialIDs, credential.ID)
+	}
+
+	log.Println("Touch your security key to sign in")
+
+	assertion, err := challengeWebAuthn(&okta.WebAuthnChallenge{
+		Challenge:        request.Challenge,
+		Origin:           facet,
+		RPID:             request.RPID,
+		CredentialIDs:    credentialIDs,
+		UserVerification: request.UserVerification == "required",
+		Prompter:         loginDetails.Prompter,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Security key failed.")
+		return kc.skipChallengePage(doc, submitURL, secondActionURL, loginDetails)
+	}
+
+	credential, err := json.Marshal(webAuthnCredential{
+		ID:    assertion.CredentialID,
+		RawID: assertion.CredentialID,
+		Type:  "public-key",
+		Response: webAuthnCredentialResponse{
+			ClientDataJSON:    assertion.ClientDataJSON,
+			AuthenticatorData: assertion.AuthenticatorData,
+			Signature:         assertion.Signature,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding security key assertion")
+	}
+
+	responseForm.Set("id-assertion", string(credential))
+	responseForm.Set("TrustDevice", "on") // Don't ask again on this computer
+
+	return kc.loadResponsePage(secondActionURL, submitURL, responseForm)
+}
+
+// webAuthnRequest the options Google passes to navigator.credentials.get, embedded in the challenge page
+type webAuthnRequest struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	AllowCredentials []struct {
+		ID string `json:"id"`
+	} `json:"allowCredentials"`
+	UserVerification string `json:"userVerification"`
+}
+
+// webAuthnCredential the PublicKeyCredential the page posts back, each value base64url encoded
+type webAuthnCredential struct {
+	ID       string                     `json:"id"`
+	RawID    string                     `json:"rawId"`
+	Type     string                     `json:"type"`
+	Response webAuthnCredentialResponse `json:"response"`
+}
+
+type webAuthnCredentialResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+}
+
+// extractWebAuthnRequest the WebAuthn request of a security key or passkey page, nil for the U2F only pages
+func extractWebAuthnRequest(doc *goquery.Document) (*webAuthnRequest, error) {
+	data, ok := doc.Find("[data-webauthn-request]").Attr("data-webauthn-request")
+	if !ok {
+		return nil, nil
+	}
+
+	request := &webAuthnRequest{}
+	if err := json.Unmarshal([]byte(data), request); err != nil {
+		return nil, errors.Wrap(err, "error parsing WebAuthn request of security key challenge")
+	}
+
+	if request.Challenge == "" {
+		return nil, errors.New("WebAuthn request of security key challenge has no challenge")
+	}
+
+	return request, nil
+}
+
+// waitForDevicePush polls the phone prompt until it is approved on the phone, denied or left unanswered
+func (kc *Client) waitForDevicePush(pollURL string, referer string) error {
+	deadline := time.Now().Add(devicePushTimeout)
+
+	for {
+		status, err := kc.devicePushStatus(pollURL, referer)
+		if err != nil {
+			return err
+		}
+
+		logger.Debugf("device push status: %s", status)
+
+		switch status {
+		case "APPROVED":
+			return nil
+		case "DENIED", "REJECTED":
+			return errors.New("the sign in was denied on your phone")
+		case "EXPIRED":
+			return errors.New("the prompt on your phone expired before it was answered")
+		}
+
+		if time.Now().After(deadline) {
+			return errors.Errorf("no answer to the prompt on your phone after %s", devicePushTimeout)
+		}
+
+		time.Sleep(devicePushPollInterval)
+	}
+}
+
+func (kc *Client) devicePushStatus(pollURL string, referer string) (string, error) {
+	req, err := http.NewRequest("GET", pollURL, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error building phone prompt poll request")
+	}
+
+	req.Header.Set("Accept-Language", "en-US")
+	req.Header.Set("Referer", referer)
+
+	res, err := kc.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to poll the phone prompt")
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading phone prompt poll response")
+	}
+
+	// Google prefixes its JSON responses to stop them being evaluated as scripts
+	body = bytes.TrimPrefix(bytes.TrimSpace(body), []byte(")]}'"))
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return "", errors.Wrap(err, "error parsing phone prompt poll response")
+	}
+
+	return status.Status, nil
+}
+
+// isAuthMethodChallenge whether the challenge form action is one google_auth_method picks
+func isAuthMethodChallenge(authMethod string, action string) bool {
+	for _, challenge := range authMethodChallenges[authMethod] {
+		if strings.Contains(action, challenge) {
+			return true
+		}
+	}
+	return false
+}
+
 func (kc *Client) loadAlternateChallengePage(submitURL string, referer string, authForm url.Values, loginDetails *creds.LoginDetails) (*goquery.Document, error) {
 
 	req, err := http.NewRequest("POST", submitURL, strings.NewReader(authForm.Encode()))
@@ -506,7 +748,9 @@ func (kc *Client) loadAlternateChallengePage(submitURL string, referer string, a
 }
 
 func (kc *Client) loadChallengeEntryPage(doc *goquery.Document, submitURL string, loginDetails *creds.LoginDetails) (*goquery.Document, error) {
-	var challengeEntry string
+	var challengeEntry, preferredEntry string
+
+	kc.pickerVisited = true
 
 	doc.Find("form[data-challengeentry]").EachWithBreak(func(i int, s *goquery.Selection) bool {
 		action, ok := s.Attr("action")
@@ -514,18 +758,28 @@ func (kc *Client) loadChallengeEntryPage(doc *goquery.Document, submitURL string
 			return true
 		}
 
-		if strings.Contains(action, "challenge/totp/") ||
+		if kc.authMethod != "" && isAuthMethodChallenge(kc.authMethod, action) {
+			preferredEntry, _ = s.Attr("data-challengeentry")
+			return false
+		}
+
+		if challengeEntry == "" && (strings.Contains(action, "challenge/totp/") ||
 			strings.Contains(action, "challenge/ipp/") ||
 			strings.Contains(action, "challenge/az/") ||
-			strings.Contains(action, "challenge/skotp/") {
+			strings.Contains(action, "challenge/skotp/")) {
 
 			challengeEntry, _ = s.Attr("data-challengeentry")
-			return false
 		}
 
 		return true
 	})
 
+	if preferredEntry != "" {
+		challengeEntry = preferredEntry
+	} else if kc.authMethod != "" {
+		logger.Debugf("google_auth_method %s isn't offered, falling back to another challenge", kc.authMethod)
+	}
+
 	if challengeEntry == "" {
 		return nil, errors.New("unable to find supported second factor")
 	}
@@ -2,19 +2,23 @@ package googleapps
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/stretchr/testify/require"
 	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 	"github.com/versent/saml2aws/v2/pkg/provider"
+	"github.com/versent/saml2aws/v2/pkg/provider/okta"
 )
 
 func TestExtractInputByName(t *testing.T) {
@@ -277,3 +281,242 @@ func TestExtractDevicePushExtraNumber(t *testing.T) {
 		require.Equal(t, "", extractDevicePushExtraNumber(doc2))
 	}
 }
+
+// challengeServer serves the fixture of each path and records the forms posted to it
+func challengeServer(t *testing.T, pages map[string]string) (*httptest.Server, map[string]url.Values) {
+	posted := map[string]url.Values{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		require.Nil(t, err)
+		posted[r.URL.Path] = r.PostForm
+
+		filename, ok := pages[r.URL.Path]
+		require.True(t, ok, "unexpected request to %s", r.URL.Path)
+		data, err := os.ReadFile(filename)
+		require.Nil(t, err)
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, posted
+}
+
+func testClient() *Client {
+	opts := &provider.HTTPClientOptions{IsWithRetries: false}
+	return &Client{client: &provider.HTTPClient{Client: http.Client{}, Options: opts}}
+}
+
+func TestExtractWebAuthnRequest(t *testing.T) {
+	data, err := os.ReadFile("example/challenge-security-key.html")
+	require.Nil(t, err)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	request, err := extractWebAuthnRequest(doc)
+	require.Nil(t, err)
+	require.Equal(t, "Y2hhbGxlbmdlLWZyb20tZ29vZ2xl", request.Challenge)
+	require.Equal(t, "google.com", request.RPID)
+	require.Len(t, request.AllowCredentials, 2)
+	require.Equal(t, "a2V5LWhhbmRsZS0x", request.AllowCredentials[0].ID)
+	require.Equal(t, "discouraged", request.UserVerification)
+
+	data, err = os.ReadFile("example/challenge-passkey.html")
+	require.Nil(t, err)
+	doc, err = goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	request, err = extractWebAuthnRequest(doc)
+	require.Nil(t, err)
+	require.Empty(t, request.AllowCredentials)
+	require.Equal(t, "required", request.UserVerification)
+
+	// the U2F only and other challenge pages have no WebAuthn request
+	data, err = os.ReadFile("example/challenge-totp.html")
+	require.Nil(t, err)
+	doc, err = goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	request, err = extractWebAuthnRequest(doc)
+	require.Nil(t, err)
+	require.Nil(t, request)
+}
+
+func TestSecurityKeyChallengePage(t *testing.T) {
+	ts, posted := challengeServer(t, map[string]string{
+		"/":                      "example/challenge-security-key.html",
+		"/signin/challenge/sk/4": "example/challenge-totp.html",
+	})
+
+	var challenge *okta.WebAuthnChallenge
+	defer func(f func(*okta.WebAuthnChallenge) (*okta.WebAuthnAssertion, error)) { challengeWebAuthn = f }(challengeWebAuthn)
+	challengeWebAuthn = func(c *okta.WebAuthnChallenge) (*okta.WebAuthnAssertion, error) {
+		challenge = c
+		return &okta.WebAuthnAssertion{ClientDataJSON: "Y2xpZW50", AuthenticatorData: "YXV0aA", Signature: "c2ln", CredentialID: "a2V5LWhhbmRsZS0y"}, nil
+	}
+
+	kc := testClient()
+	loginDetails := &creds.LoginDetails{URL: ts.URL, Username: "test", Password: "test123"}
+
+	_, err := kc.loadChallengePage(ts.URL+"/", "https://accounts.google.com/signin/challenge/sl/password", url.Values{}, loginDetails)
+	require.Nil(t, err)
+
+	require.Equal(t, "Y2hhbGxlbmdlLWZyb20tZ29vZ2xl", challenge.Challenge)
+	require.Equal(t, ts.URL, challenge.Origin)
+	require.Equal(t, "google.com", challenge.RPID)
+	require.Equal(t, []string{"a2V5LWhhbmRsZS0x", "a2V5LWhhbmRsZS0y"}, challenge.CredentialIDs)
+	require.False(t, challenge.UserVerification)
+
+	form := posted["/signin/challenge/sk/4"]
+	require.NotNil(t, form)
+	require.Equal(t, "4", form.Get("challengeId"))
+	require.Equal(t, "on", form.Get("TrustDevice"))
+
+	credential := webAuthnCredential{}
+	require.Nil(t, json.Unmarshal([]byte(form.Get("id-assertion")), &credential))
+	require.Equal(t, "a2V5LWhhbmRsZS0y", credential.ID)
+	require.Equal(t, "public-key", credential.Type)
+	require.Equal(t, "Y2xpZW50", credential.Response.ClientDataJSON)
+	require.Equal(t, "YXV0aA", credential.Response.AuthenticatorData)
+	require.Equal(t, "c2ln", credential.Response.Signature)
+}
+
+func TestPasskeyChallengePageWithoutDevice(t *testing.T) {
+	ts, posted := challengeServer(t, map[string]string{
+		"/":                        "example/challenge-passkey.html",
+		"/signin/challenge/skip":   "example/challenge-selection.html",
+		"/signin/challenge/totp/3": "example/challenge-totp.html",
+		"/signin/challenge/totp/2": "example/challenge-totp.html",
+	})
+
+	var challenge *okta.WebAuthnChallenge
+	defer func(f func(*okta.WebAuthnChallenge) (*okta.WebAuthnAssertion, error)) { challengeWebAuthn = f }(challengeWebAuthn)
+	challengeWebAuthn = func(c *okta.WebAuthnChallenge) (*okta.WebAuthnAssertion, error) {
+		challenge = c
+		return nil, okta.ErrFIDO2NoDevice
+	}
+
+	kc := testClient()
+	loginDetails := &creds.LoginDetails{URL: ts.URL, Username: "test", Password: "test123", MFAToken: "123456"}
+
+	_, err := kc.loadChallengePage(ts.URL+"/", "https://accounts.google.com/signin/challenge/sl/password", url.Values{}, loginDetails)
+	require.Nil(t, err)
+
+	require.True(t, challenge.UserVerification)
+	require.Empty(t, challenge.CredentialIDs)
+
+	// without a key the login tries another way, the first challenge of the list saml2aws supports
+	require.NotNil(t, posted["/signin/challenge/skip"])
+	require.Equal(t, "3", posted["/signin/challenge/totp/3"].Get("challengeId"))
+	require.Equal(t, "123456", posted["/signin/challenge/totp/2"].Get("Pin"))
+}
+
+func TestDevicePushChallengePagePolling(t *testing.T) {
+	defer func(d time.Duration) { devicePushPollInterval = d }(devicePushPollInterval)
+	devicePushPollInterval = time.Millisecond
+
+	for _, tc := range []struct {
+		statuses []string
+		err      string
+	}{
+		{statuses: []string{"PENDING", "PENDING", "APPROVED"}},
+		{statuses: []string{"PENDING", "DENIED"}, err: "the sign in was denied on your phone"},
+	} {
+		polls := 0
+		var pollForm url.Values
+		var posted url.Values
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/":
+				data, err := os.ReadFile("example/challenge-dp-poll.html")
+				require.Nil(t, err)
+				_, _ = w.Write(data)
+			case "/signin/challenge/dp/poll":
+				pollForm = r.URL.Query()
+				_, _ = w.Write([]byte(")]}'\n{\"status\":\"" + tc.statuses[polls] + "\"}"))
+				polls++
+			case "/signin/challenge/dp/6":
+				require.Nil(t, r.ParseForm())
+				posted = r.PostForm
+			default:
+				require.Fail(t, "unexpected request", r.URL.Path)
+			}
+		}))
+
+		kc := testClient()
+		loginDetails := &creds.LoginDetails{URL: ts.URL, Username: "test", Password: "test123"}
+
+		_, err := kc.loadChallengePage(ts.URL+"/", "https://accounts.google.com/signin/challenge/sl/password", url.Values{}, loginDetails)
+		ts.Close()
+
+		require.Equal(t, len(tc.statuses), polls)
+		require.Equal(t, "6", pollForm.Get("challengeId"))
+		if tc.err != "" {
+			require.EqualError(t, err, tc.err)
+			require.Nil(t, posted)
+			continue
+		}
+		require.Nil(t, err)
+		require.Equal(t, "on", posted.Get("TrustDevice"))
+	}
+}
+
+func TestGoogleAuthMethod(t *testing.T) {
+	ts, posted := challengeServer(t, map[string]string{
+		"/":                         "example/challenge-totp.html",
+		"/signin/challenge/skip":    "example/challenge-selection.html",
+		"/signin/challenge/skotp/5": "example/challenge-totp.html",
+		"/signin/challenge/totp/2":  "example/challenge-totp.html",
+	})
+
+	kc := testClient()
+	kc.authMethod = "SECURITY_KEY_OTP"
+	loginDetails := &creds.LoginDetails{URL: ts.URL, Username: "test", Password: "test123", MFAToken: "123456"}
+
+	_, err := kc.loadChallengePage(ts.URL+"/", "https://accounts.google.com/signin/challenge/sl/password", url.Values{}, loginDetails)
+	require.Nil(t, err)
+
+	// Google started with TOTP, the login asked for the list and picked the security key code from it
+	require.NotNil(t, posted["/signin/challenge/skip"])
+	require.Equal(t, "5", posted["/signin/challenge/skotp/5"].Get("challengeId"))
+	require.Equal(t, "123456", posted["/signin/challenge/totp/2"].Get("Pin"))
+}
+
+func TestChallengeEntryPageAuthMethod(t *testing.T) {
+	data, err := os.ReadFile("example/challenge-selection.html")
+	require.Nil(t, err)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	var requested []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	// without google_auth_method the first of TOTP, SMS, Google Prompt and security key code is picked
+	for method, path := range map[string]string{
+		"":             "/signin/challenge/totp/3",
+		"SECURITY_KEY": "/signin/challenge/sk/2",
+		"SMS":          "/signin/challenge/ipp/4",
+		"PROMPT":       "/signin/challenge/dp/1",
+	} {
+		kc := testClient()
+		kc.authMethod = method
+		requested = nil
+
+		doc.Url, err = url.Parse(ts.URL + "/signin/challenge/skip")
+		require.Nil(t, err)
+
+		_, err = kc.loadChallengeEntryPage(doc, ts.URL, &creds.LoginDetails{})
+		require.Nil(t, err)
+		require.Equal(t, []string{path}, requested, method)
+	}
+}
+
+func TestNewUnsupportedGoogleAuthMethod(t *testing.T) {
+	_, err := New(&cfg.IDPAccount{GoogleAuthMethod: "PASSKEY"})
+	require.EqualError(t, err, "unsupported google_auth_method PASSKEY, expected one of TOTP, SMS, PROMPT, SECURITY_KEY, SECURITY_KEY_OTP")
+
+	kc, err := New(&cfg.IDPAccount{GoogleAuthMethod: "SECURITY_KEY"})
+	require.Nil(t, err)
+	require.Equal(t, "SECURITY_KEY", kc.authMethod)
+}
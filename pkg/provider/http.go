@@ -2,10 +2,12 @@ package provider
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"runtime"
 	"strconv"
 	"time"
@@ -16,6 +18,7 @@ import (
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/cookiejar"
 	"github.com/versent/saml2aws/v2/pkg/dump"
+	"golang.org/x/net/http/httpproxy"
 	"golang.org/x/net/publicsuffix"
 )
 
@@ -35,6 +38,8 @@ type HTTPClientOptions struct {
 	IsWithRetries bool //http retry feature switch
 	AttemptsCount uint
 	RetryDelay    time.Duration
+	Proxy         func(*http.Request) (*url.URL, error) // replaces the transport proxy when set
+	RootCAs       *x509.CertPool                        // replaces the CAs the transport trusts when set
 }
 
 // NewDefaultTransport configure a transport with the TLS skip verify option
@@ -54,7 +59,8 @@ func NewDefaultTransport(skipVerify bool) *http.Transport {
 	}
 }
 
-func BuildHttpClientOpts(account *cfg.IDPAccount) *HTTPClientOptions {
+// BuildHttpClientOpts the retry, proxy and CA options of the account, failing when its ca_cert_file can't be loaded
+func BuildHttpClientOpts(account *cfg.IDPAccount) (*HTTPClientOptions, error) {
 	opts := &HTTPClientOptions{}
 	atmt, atmtErr := strconv.ParseUint(account.HttpAttemptsCount, 10, 0)
 	if opts.IsWithRetries = atmtErr == nil; opts.IsWithRetries {
@@ -70,7 +76,50 @@ func BuildHttpClientOpts(account *cfg.IDPAccount) *HTTPClientOptions {
 		opts.RetryDelay = time.Duration(delay) * time.Second
 	}
 
-	return opts
+	if account.HttpProxy != "" || account.HttpsProxy != "" {
+		opts.Proxy = ProxyFromAccount(account)
+	}
+
+	rootCAs, err := account.CACertPool()
+	if err != nil {
+		return nil, err
+	}
+	opts.RootCAs = rootCAs
+
+	return opts, nil
+}
+
+// NewTLSConfig the TLS config of the account for transports not built by NewHTTPClient, with skip_verify and the
+// CAs of ca_cert_file
+func NewTLSConfig(account *cfg.IDPAccount) (*tls.Config, error) {
+	rootCAs, err := account.CACertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{InsecureSkipVerify: account.SkipVerify, RootCAs: rootCAs}, nil
+}
+
+// ProxyFromAccount select the proxy for a request using the account proxy settings,
+// falling back to HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment
+func ProxyFromAccount(account *cfg.IDPAccount) func(*http.Request) (*url.URL, error) {
+	if account.HttpProxy == "" && account.HttpsProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	conf := httpproxy.FromEnvironment()
+	if account.HttpProxy != "" {
+		conf.HTTPProxy = account.HttpProxy
+	}
+	if account.HttpsProxy != "" {
+		conf.HTTPSProxy = account.HttpsProxy
+	}
+
+	proxyFunc := conf.ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
 }
 
 // NewHTTPClient configure the default http client used by the providers
@@ -85,6 +134,21 @@ func NewHTTPClient(tr http.RoundTripper, opts *HTTPClientOptions) (*HTTPClient,
 		return nil, err
 	}
 
+	if opts != nil && opts.Proxy != nil {
+		if transport, ok := tr.(*http.Transport); ok {
+			transport.Proxy = opts.Proxy
+		}
+	}
+
+	if opts != nil && opts.RootCAs != nil {
+		if transport, ok := tr.(*http.Transport); ok {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			transport.TLSClientConfig.RootCAs = opts.RootCAs
+		}
+	}
+
 	client := http.Client{Transport: tr, Jar: jar}
 
 	return &HTTPClient{client, nil, opts}, nil
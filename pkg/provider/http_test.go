@@ -1,11 +1,15 @@
 package provider
 
 import (
+	"encoding/pem"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 )
 
 func TestClientDoGetOK(t *testing.T) {
@@ -72,3 +76,90 @@ func TestClientDoResponseCheck(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, 400, res.StatusCode)
 }
+
+func TestProxyFromAccount(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://env-proxy:3128")
+	t.Setenv("HTTPS_PROXY", "http://env-proxy:3128")
+	t.Setenv("NO_PROXY", "")
+
+	proxy := ProxyFromAccount(&cfg.IDPAccount{HttpsProxy: "http://account-proxy:8080"})
+
+	req, err := http.NewRequest("GET", "https://id.example.com", nil)
+	require.Nil(t, err)
+	u, err := proxy(req)
+	require.Nil(t, err)
+	require.Equal(t, "account-proxy:8080", u.Host)
+
+	// HTTP_PROXY is still used as the account only overrides https
+	req, err = http.NewRequest("GET", "http://id.example.com", nil)
+	require.Nil(t, err)
+	u, err = proxy(req)
+	require.Nil(t, err)
+	require.Equal(t, "env-proxy:3128", u.Host)
+}
+
+func TestNewHTTPClientAppliesProxy(t *testing.T) {
+	rt := NewDefaultTransport(false)
+	opts, err := BuildHttpClientOpts(&cfg.IDPAccount{HttpProxy: "http://account-proxy:8080"})
+	require.Nil(t, err)
+	_, err = NewHTTPClient(rt, opts)
+	require.Nil(t, err)
+
+	req, err := http.NewRequest("GET", "http://id.example.com", nil)
+	require.Nil(t, err)
+	u, err := rt.Proxy(req)
+	require.Nil(t, err)
+	require.Equal(t, "account-proxy:8080", u.Host)
+}
+
+func TestNewHTTPClientTrustsCACertFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	account := &cfg.IDPAccount{CACertFile: filepath.Join(t.TempDir(), "ca.pem")}
+	err := os.WriteFile(account.CACertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	require.Nil(t, err)
+
+	// the server's CA isn't trusted without ca_cert_file
+	opts, err := BuildHttpClientOpts(&cfg.IDPAccount{})
+	require.Nil(t, err)
+	hc, err := NewHTTPClient(NewDefaultTransport(false), opts)
+	require.Nil(t, err)
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.Nil(t, err)
+	_, err = hc.Do(req)
+	require.ErrorContains(t, err, "certificate")
+
+	opts, err = BuildHttpClientOpts(account)
+	require.Nil(t, err)
+	hc, err = NewHTTPClient(NewDefaultTransport(false), opts)
+	require.Nil(t, err)
+	resp, err := hc.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// transports built outside NewHTTPClient, like the NTLM ones, trust it too
+	tlsConfig, err := NewTLSConfig(account)
+	require.Nil(t, err)
+	resp, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}).Do(req)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestBuildHttpClientOptsFailsOnBadCACertFile(t *testing.T) {
+	missing := &cfg.IDPAccount{CACertFile: filepath.Join(t.TempDir(), "missing.pem")}
+
+	_, err := BuildHttpClientOpts(missing)
+	require.ErrorContains(t, err, "can't be read")
+
+	_, err = NewTLSConfig(missing)
+	require.ErrorContains(t, err, "can't be read")
+
+	garbage := &cfg.IDPAccount{CACertFile: filepath.Join(t.TempDir(), "garbage.pem")}
+	require.Nil(t, os.WriteFile(garbage.CACertFile, []byte("not a certificate"), 0600))
+
+	_, err = BuildHttpClientOpts(garbage)
+	require.ErrorContains(t, err, "no PEM certificates")
+}
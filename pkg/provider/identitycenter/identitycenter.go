@@ -0,0 +1,381 @@
+package identitycenter
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sso/ssoiface"
+	"github.com/aws/aws-sdk-go/service/ssooidc"
+	"github.com/aws/aws-sdk-go/service/ssooidc/ssooidciface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+// ProviderName constant for IAM Identity Center provider
+const ProviderName = "IdentityCenter"
+
+const (
+	// clientName the name saml2aws registers itself with as an OIDC client
+	clientName = "saml2aws"
+
+	deviceCodeGrantType   = "urn:ietf:params:oauth:grant-type:device_code"
+	refreshTokenGrantType = "refresh_token"
+
+	// tokenRefreshWindow cached tokens expiring within this are refreshed before they are used
+	tokenRefreshWindow = 5 * time.Minute
+)
+
+var logger = logrus.WithField("provider", "identitycenter")
+
+// defaultPollInterval the wait between checks for the device authorization when the server doesn't say
+var defaultPollInterval = 5 * time.Second
+
+// slowDownIncrement added to the wait between checks each time the server asks to slow down
+var slowDownIncrement = 5 * time.Second
+
+// sleep waits between checks for the device authorization, replaced in tests
+var sleep = time.Sleep
+
+// Client drives the IAM Identity Center device authorization flow and retrieves role credentials with
+// the resulting access token
+type Client struct {
+	idpAccount *cfg.IDPAccount
+	oidc       ssooidciface.SSOOIDCAPI
+	sso        ssoiface.SSOAPI
+	cacheDir   string
+}
+
+// Token an Identity Center access token along with the OIDC client registration used to get and refresh it
+type Token struct {
+	StartURL              string    `json:"startUrl"`
+	Region                string    `json:"region"`
+	AccessToken           string    `json:"accessToken"`
+	ExpiresAt             time.Time `json:"expiresAt"`
+	RefreshToken          string    `json:"refreshToken,omitempty"`
+	ClientID              string    `json:"clientId"`
+	ClientSecret          string    `json:"clientSecret"`
+	RegistrationExpiresAt time.Time `json:"registrationExpiresAt"`
+}
+
+// Role a role the user can get credentials for in one of their accounts
+type Role struct {
+	AccountID   string
+	AccountName string
+	RoleName    string
+}
+
+// New create a new IAM Identity Center client
+func New(idpAccount *cfg.IDPAccount) (*Client, error) {
+	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
+
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building http client")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:     aws.String(idpAccount.SSORegion),
+		HTTPClient: &client.Client,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating session")
+	}
+
+	cacheDir, err := TokenCacheDir()
+	if err != nil {
+		return nil, errors.Wrap(err, "error locating token cache")
+	}
+
+	return &Client{
+		idpAccount: idpAccount,
+		oidc:       ssooidc.New(sess),
+		sso:        sso.New(sess),
+		cacheDir:   cacheDir,
+	}, nil
+}
+
+// TokenCacheDir the directory access tokens are cached in, next to the saml2aws configuration
+func TokenCacheDir() (string, error) {
+	configPath, err := cfg.XDGConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(configPath), "identitycenter"), nil
+}
+
+// Validate the user signs in through the browser so only the start URL is needed
+func (c *Client) Validate(loginDetails *creds.LoginDetails) error {
+	if c.idpAccount.SSOStartURL == "" {
+		return errors.New("Empty sso_start_url")
+	}
+	return nil
+}
+
+// Authenticate Identity Center hands out role credentials directly rather than a SAML assertion, so
+// login uses Token, Roles and RoleCredentials instead
+func (c *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	return "", errors.New("IdentityCenter doesn't issue SAML assertions, use saml2aws login")
+}
+
+// Token returns an access token for the start URL, from the cache when it is still valid, refreshed
+// when it is about to expire and otherwise by asking the user to authorize this device
+func (c *Client) Token() (*Token, error) {
+	token, err := c.loadToken()
+	if err != nil {
+		logger.WithError(err).Debug("unable to load cached token")
+		token = nil
+	}
+
+	if token != nil && time.Until(token.ExpiresAt) > tokenRefreshWindow {
+		logger.WithField("expires", token.ExpiresAt).Debug("using cached token")
+		return token, nil
+	}
+
+	if token != nil && token.RefreshToken != "" && time.Now().Before(token.RegistrationExpiresAt) {
+		err = c.refreshToken(token)
+		if err == nil {
+			return token, c.saveToken(token)
+		}
+		logger.WithError(err).Debug("unable to refresh token")
+	}
+
+	if token == nil || !time.Now().Before(token.RegistrationExpiresAt) {
+		token, err = c.registerClient()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.authorizeDevice(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, c.saveToken(token)
+}
+
+func (c *Client) registerClient() (*Token, error) {
+	res, err := c.oidc.RegisterClient(&ssooidc.RegisterClientInput{
+		ClientName: aws.String(clientName),
+		ClientType: aws.String("public"),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error registering client")
+	}
+
+	return &Token{
+		StartURL:              c.idpAccount.SSOStartURL,
+		Region:                c.idpAccount.SSORegion,
+		ClientID:              aws.StringValue(res.ClientId),
+		ClientSecret:          aws.StringValue(res.ClientSecret),
+		RegistrationExpiresAt: time.Unix(aws.Int64Value(res.ClientSecretExpiresAt), 0),
+	}, nil
+}
+
+func (c *Client) authorizeDevice(token *Token) error {
+	auth, err := c.oidc.StartDeviceAuthorization(&ssooidc.StartDeviceAuthorizationInput{
+		ClientId:     aws.String(token.ClientID),
+		ClientSecret: aws.String(token.ClientSecret),
+		StartUrl:     aws.String(c.idpAccount.SSOStartURL),
+	})
+	if err != nil {
+		return errors.Wrap(err, "error starting device authorization")
+	}
+
+	log.Printf("Open %s in a browser and check it shows the code %s to sign in to IAM Identity Center ...", aws.StringValue(auth.VerificationUriComplete), aws.StringValue(auth.UserCode))
+
+	interval := time.Duration(aws.Int64Value(auth.Interval)) * time.Second
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	deadline := time.Now().Add(time.Duration(aws.Int64Value(auth.ExpiresIn)) * time.Second)
+
+	for {
+		sleep(interval)
+
+		res, err := c.oidc.CreateToken(&ssooidc.CreateTokenInput{
+			ClientId:     aws.String(token.ClientID),
+			ClientSecret: aws.String(token.ClientSecret),
+			DeviceCode:   auth.DeviceCode,
+			GrantType:    aws.String(deviceCodeGrantType),
+		})
+		if err == nil {
+			setAccessToken(token, res)
+			return nil
+		}
+
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) {
+			return errors.Wrap(err, "error creating token")
+		}
+		switch aerr.Code() {
+		case ssooidc.ErrCodeAuthorizationPendingException:
+		case ssooidc.ErrCodeSlowDownException:
+			interval += slowDownIncrement
+		default:
+			return errors.Wrap(err, "error creating token")
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("device authorization was not approved in time, run the login again")
+		}
+	}
+}
+
+func (c *Client) refreshToken(token *Token) error {
+	res, err := c.oidc.CreateToken(&ssooidc.CreateTokenInput{
+		ClientId:     aws.String(token.ClientID),
+		ClientSecret: aws.String(token.ClientSecret),
+		RefreshToken: aws.String(token.RefreshToken),
+		GrantType:    aws.String(refreshTokenGrantType),
+	})
+	if err != nil {
+		return errors.Wrap(err, "error refreshing token")
+	}
+
+	setAccessToken(token, res)
+	return nil
+}
+
+func setAccessToken(token *Token, res *ssooidc.CreateTokenOutput) {
+	token.AccessToken = aws.StringValue(res.AccessToken)
+	token.ExpiresAt = time.Now().Add(time.Duration(aws.Int64Value(res.ExpiresIn)) * time.Second)
+	// a refresh may not hand out a new refresh token, keep using the old one
+	if refreshToken := aws.StringValue(res.RefreshToken); refreshToken != "" {
+		token.RefreshToken = refreshToken
+	}
+}
+
+// Roles lists the roles the user can get credentials for across all of their accounts
+func (c *Client) Roles(accessToken string) ([]Role, error) {
+	accounts := []*sso.AccountInfo{}
+	err := c.sso.ListAccountsPages(&sso.ListAccountsInput{AccessToken: aws.String(accessToken)}, func(page *sso.ListAccountsOutput, _ bool) bool {
+		accounts = append(accounts, page.AccountList...)
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing accounts")
+	}
+
+	roles := []Role{}
+	for _, account := range accounts {
+		err := c.sso.ListAccountRolesPages(&sso.ListAccountRolesInput{
+			AccessToken: aws.String(accessToken),
+			AccountId:   account.AccountId,
+		}, func(page *sso.ListAccountRolesOutput, _ bool) bool {
+			for _, role := range page.RoleList {
+				roles = append(roles, Role{
+					AccountID:   aws.StringValue(account.AccountId),
+					AccountName: aws.StringValue(account.AccountName),
+					RoleName:    aws.StringValue(role.RoleName),
+				})
+			}
+			return true
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing roles in account %s", aws.StringValue(account.AccountId))
+		}
+	}
+
+	return roles, nil
+}
+
+// RoleCredentials gets credentials for the role, they last as long as its permission set's session duration
+func (c *Client) RoleCredentials(accessToken string, role Role) (*awsconfig.AWSCredentials, error) {
+	res, err := c.sso.GetRoleCredentials(&sso.GetRoleCredentialsInput{
+		AccessToken: aws.String(accessToken),
+		AccountId:   aws.String(role.AccountID),
+		RoleName:    aws.String(role.RoleName),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting credentials for role %s", role.RoleName)
+	}
+
+	return &awsconfig.AWSCredentials{
+		AWSAccessKey:     aws.StringValue(res.RoleCredentials.AccessKeyId),
+		AWSSecretKey:     aws.StringValue(res.RoleCredentials.SecretAccessKey),
+		AWSSessionToken:  aws.StringValue(res.RoleCredentials.SessionToken),
+		AWSSecurityToken: aws.StringValue(res.RoleCredentials.SessionToken),
+		PrincipalARN:     role.ARN(c.idpAccount.SSORegion),
+		Expires:          time.UnixMilli(aws.Int64Value(res.RoleCredentials.Expiration)).Local(),
+		Region:           c.idpAccount.Region,
+	}, nil
+}
+
+// ARN the IAM role behind the Identity Center role, in the partition of the region
+func (r Role) ARN(region string) string {
+	partition := "aws"
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		partition = "aws-us-gov"
+	case strings.HasPrefix(region, "cn-"):
+		partition = "aws-cn"
+	}
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, r.AccountID, r.RoleName)
+}
+
+// tokenCachePath tokens are cached per start URL, like the AWS CLI names its SSO cache files
+func (c *Client) tokenCachePath() string {
+	sum := sha1.Sum([]byte(c.idpAccount.SSOStartURL))
+	return filepath.Join(c.cacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *Client) loadToken() (*Token, error) {
+	data, err := os.ReadFile(c.tokenCachePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token := &Token{}
+	err = json.Unmarshal(data, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// the region is part of the registration, a changed sso_region needs a new one
+	if token.StartURL != c.idpAccount.SSOStartURL || token.Region != c.idpAccount.SSORegion {
+		return nil, nil
+	}
+	return token, nil
+}
+
+func (c *Client) saveToken(token *Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return errors.Wrap(err, "error encoding token")
+	}
+
+	err = os.MkdirAll(c.cacheDir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "error creating token cache")
+	}
+
+	err = os.WriteFile(c.tokenCachePath(), data, 0600)
+	if err != nil {
+		return errors.Wrap(err, "error saving token")
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package identitycenter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sso/ssoiface"
+	"github.com/aws/aws-sdk-go/service/ssooidc"
+	"github.com/aws/aws-sdk-go/service/ssooidc/ssooidciface"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+)
+
+type fakeOIDC struct {
+	ssooidciface.SSOOIDCAPI
+
+	registered  int
+	authorized  int
+	tokenInputs []*ssooidc.CreateTokenInput
+	tokenErrors []error
+}
+
+func (f *fakeOIDC) RegisterClient(input *ssooidc.RegisterClientInput) (*ssooidc.RegisterClientOutput, error) {
+	f.registered++
+	return &ssooidc.RegisterClientOutput{
+		ClientId:              aws.String("client-id"),
+		ClientSecret:          aws.String("client-secret"),
+		ClientSecretExpiresAt: aws.Int64(time.Now().Add(90 * 24 * time.Hour).Unix()),
+	}, nil
+}
+
+func (f *fakeOIDC) StartDeviceAuthorization(input *ssooidc.StartDeviceAuthorizationInput) (*ssooidc.StartDeviceAuthorizationOutput, error) {
+	f.authorized++
+	return &ssooidc.StartDeviceAuthorizationOutput{
+		DeviceCode:              aws.String("device-code"),
+		UserCode:                aws.String("ABCD-EFGH"),
+		VerificationUriComplete: aws.String("https://device.sso.us-east-1.amazonaws.com/?user_code=ABCD-EFGH"),
+		Interval:                aws.Int64(1),
+		ExpiresIn:               aws.Int64(600),
+	}, nil
+}
+
+func (f *fakeOIDC) CreateToken(input *ssooidc.CreateTokenInput) (*ssooidc.CreateTokenOutput, error) {
+	f.tokenInputs = append(f.tokenInputs, input)
+	if len(f.tokenErrors) > 0 {
+		err := f.tokenErrors[0]
+		f.tokenErrors = f.tokenErrors[1:]
+		return nil, err
+	}
+	return &ssooidc.CreateTokenOutput{
+		AccessToken:  aws.String("new-access-token"),
+		ExpiresIn:    aws.Int64(3600),
+		RefreshToken: aws.String("new-refresh-token"),
+	}, nil
+}
+
+type fakeSSO struct {
+	ssoiface.SSOAPI
+}
+
+func (f *fakeSSO) ListAccountsPages(input *sso.ListAccountsInput, fn func(*sso.ListAccountsOutput, bool) bool) error {
+	fn(&sso.ListAccountsOutput{AccountList: []*sso.AccountInfo{
+		{AccountId: aws.String("123456789012"), AccountName: aws.String("production")},
+	}}, false)
+	fn(&sso.ListAccountsOutput{AccountList: []*sso.AccountInfo{
+		{AccountId: aws.String("210987654321"), AccountName: aws.String("sandbox")},
+	}}, true)
+	return nil
+}
+
+func (f *fakeSSO) ListAccountRolesPages(input *sso.ListAccountRolesInput, fn func(*sso.ListAccountRolesOutput, bool) bool) error {
+	roles := map[string][]string{
+		"123456789012": {"ReadOnly", "Admin"},
+		"210987654321": {"Developer"},
+	}
+	page := &sso.ListAccountRolesOutput{}
+	for _, name := range roles[aws.StringValue(input.AccountId)] {
+		page.RoleList = append(page.RoleList, &sso.RoleInfo{AccountId: input.AccountId, RoleName: aws.String(name)})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeSSO) GetRoleCredentials(input *sso.GetRoleCredentialsInput) (*sso.GetRoleCredentialsOutput, error) {
+	return &sso.GetRoleCredentialsOutput{RoleCredentials: &sso.RoleCredentials{
+		AccessKeyId:     aws.String("AKIAEXAMPLE"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("session"),
+		Expiration:      aws.Int64(1700000000000),
+	}}, nil
+}
+
+func newTestClient(t *testing.T, oidc *fakeOIDC) *Client {
+	sleep = func(time.Duration) {}
+	return &Client{
+		idpAccount: &cfg.IDPAccount{SSOStartURL: "https://example.awsapps.com/start", SSORegion: "us-east-1"},
+		oidc:       oidc,
+		sso:        &fakeSSO{},
+		cacheDir:   t.TempDir(),
+	}
+}
+
+func TestTokenAuthorizesDevice(t *testing.T) {
+	var waits []time.Duration
+	oidc := &fakeOIDC{tokenErrors: []error{
+		awserr.New(ssooidc.ErrCodeAuthorizationPendingException, "pending", nil),
+		awserr.New(ssooidc.ErrCodeSlowDownException, "slow down", nil),
+	}}
+	client := newTestClient(t, oidc)
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	token, err := client.Token()
+	require.Nil(t, err)
+	require.Equal(t, "new-access-token", token.AccessToken)
+	require.Equal(t, 1, oidc.registered)
+	require.Equal(t, []time.Duration{time.Second, time.Second, 6 * time.Second}, waits)
+	require.Equal(t, deviceCodeGrantType, aws.StringValue(oidc.tokenInputs[0].GrantType))
+
+	// the token is cached for the next login
+	token, err = client.Token()
+	require.Nil(t, err)
+	require.Equal(t, "new-access-token", token.AccessToken)
+	require.Equal(t, 1, oidc.authorized)
+	require.Len(t, oidc.tokenInputs, 3)
+}
+
+func TestTokenDeviceAuthorizationDenied(t *testing.T) {
+	oidc := &fakeOIDC{tokenErrors: []error{
+		awserr.New(ssooidc.ErrCodeAccessDeniedException, "denied", nil),
+	}}
+	client := newTestClient(t, oidc)
+
+	_, err := client.Token()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error creating token")
+}
+
+func TestTokenRefreshesBeforeExpiry(t *testing.T) {
+	oidc := &fakeOIDC{}
+	client := newTestClient(t, oidc)
+
+	err := client.saveToken(&Token{
+		StartURL:              "https://example.awsapps.com/start",
+		Region:                "us-east-1",
+		AccessToken:           "old-access-token",
+		ExpiresAt:             time.Now().Add(time.Minute),
+		RefreshToken:          "old-refresh-token",
+		ClientID:              "client-id",
+		ClientSecret:          "client-secret",
+		RegistrationExpiresAt: time.Now().Add(time.Hour),
+	})
+	require.Nil(t, err)
+
+	token, err := client.Token()
+	require.Nil(t, err)
+	require.Equal(t, "new-access-token", token.AccessToken)
+	require.Equal(t, "new-refresh-token", token.RefreshToken)
+	require.Equal(t, 0, oidc.registered)
+	require.Equal(t, 0, oidc.authorized)
+	require.Equal(t, refreshTokenGrantType, aws.StringValue(oidc.tokenInputs[0].GrantType))
+	require.Equal(t, "old-refresh-token", aws.StringValue(oidc.tokenInputs[0].RefreshToken))
+
+	cached, err := client.loadToken()
+	require.Nil(t, err)
+	require.Equal(t, "new-access-token", cached.AccessToken)
+}
+
+func TestTokenIgnoresCacheOfOtherRegion(t *testing.T) {
+	oidc := &fakeOIDC{}
+	client := newTestClient(t, oidc)
+
+	err := client.saveToken(&Token{
+		StartURL:              "https://example.awsapps.com/start",
+		Region:                "eu-west-1",
+		AccessToken:           "old-access-token",
+		ExpiresAt:             time.Now().Add(time.Hour),
+		RegistrationExpiresAt: time.Now().Add(time.Hour),
+	})
+	require.Nil(t, err)
+
+	token, err := client.Token()
+	require.Nil(t, err)
+	require.Equal(t, "new-access-token", token.AccessToken)
+	require.Equal(t, 1, oidc.registered)
+}
+
+func TestRoles(t *testing.T) {
+	client := newTestClient(t, &fakeOIDC{})
+
+	roles, err := client.Roles("access-token")
+	require.Nil(t, err)
+	require.Equal(t, []Role{
+		{AccountID: "123456789012", AccountName: "production", RoleName: "ReadOnly"},
+		{AccountID: "123456789012", AccountName: "production", RoleName: "Admin"},
+		{AccountID: "210987654321", AccountName: "sandbox", RoleName: "Developer"},
+	}, roles)
+}
+
+func TestRoleCredentials(t *testing.T) {
+	client := newTestClient(t, &fakeOIDC{})
+
+	awsCreds, err := client.RoleCredentials("access-token", Role{AccountID: "123456789012", RoleName: "Admin"})
+	require.Nil(t, err)
+	require.Equal(t, "AKIAEXAMPLE", awsCreds.AWSAccessKey)
+	require.Equal(t, "session", awsCreds.AWSSessionToken)
+	require.Equal(t, "arn:aws:iam::123456789012:role/Admin", awsCreds.PrincipalARN)
+	require.True(t, awsCreds.Expires.Equal(time.Unix(1700000000, 0)))
+}
+
+func TestRoleARN(t *testing.T) {
+	role := Role{AccountID: "123456789012", RoleName: "Admin"}
+	require.Equal(t, "arn:aws:iam::123456789012:role/Admin", role.ARN("eu-west-1"))
+	require.Equal(t, "arn:aws-us-gov:iam::123456789012:role/Admin", role.ARN("us-gov-west-1"))
+	require.Equal(t, "arn:aws-cn:iam::123456789012:role/Admin", role.ARN("cn-north-1"))
+}
@@ -1,17 +1,13 @@
 package jumpcloud
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"html"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strings"
-	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/pkg/errors"
@@ -37,6 +33,11 @@ const (
 )
 
 var (
+	// errFactorNotEnrolled the factor asked for isn't set up for the user in JumpCloud
+	errFactorNotEnrolled = errors.New("MFA factor not enrolled in JumpCloud")
+	// errFactorUnsupported JumpCloud offers the factor but saml2aws can't verify it
+	errFactorUnsupported = errors.New("MFA factor not supported by saml2aws for JumpCloud")
+
 	supportedMfaOptions = map[string]string{
 		IdentifierTotpMfa:          "TOTP MFA authentication",
 		IdentifierDuoMfa:           "DUO MFA authentication",
@@ -81,7 +82,12 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -233,7 +239,7 @@ func (jc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 func (jc *Client) verifyMFA(jumpCloudOrgHost string, loginDetails *creds.LoginDetails, a AuthRequest, body []byte, xsrfToken string) (*http.Response, error) {
 	// Get the user's MFA token and re-build the body
 
-	option, err := jc.getUserOption(body)
+	option, err := jc.getUserOption(loginDetails.Asker(), body)
 	if err != nil {
 		return nil, err
 	}
@@ -245,7 +251,7 @@ func (jc *Client) verifyMFA(jumpCloudOrgHost string, loginDetails *creds.LoginDe
 		// Re-request with our OTP
 		a.OTP = loginDetails.MFAToken
 		if a.OTP == "" {
-			a.OTP = prompter.StringRequired("MFA Token")
+			a.OTP = loginDetails.Asker().StringRequired("MFA Token")
 		}
 		authBody, err := json.Marshal(a)
 		if err != nil {
@@ -265,357 +271,73 @@ func (jc *Client) verifyMFA(jumpCloudOrgHost string, loginDetails *creds.LoginDe
 		// Resubmit
 		return jc.client.Do(req)
 	case IdentifierU2F:
-		res, err := jc.client.Get(webauthnSubmitURL)
-		if err != nil {
-			return nil, errors.Wrap(err, "error submitting request for SAML value")
-		}
-		defer res.Body.Close()
-
-		respBody, err := io.ReadAll(res.Body)
-		if err != nil {
-			return nil, err
-		}
-		respStr := string(respBody)
-
-		challenge := gjson.Get(respStr, "publicKey.challenge").String()
-		allowCreds := gjson.Get(respStr, "publicKey.allowCredentials").Array()
-		if len(allowCreds) < 1 {
-			return nil, errors.New("unsupported case, we expect publicKey to be an array of at least one element")
-		}
-		credsMap := allowCreds[0].Map()
-		key, ok := credsMap["id"]
-		if !ok {
-			return nil, errors.New("can't find key handle or key id in the allowed credentials map")
-		}
-
-		fidoClient, err := NewFidoClient(
-			challenge,
-			gjson.Get(respStr, "publicKey.rpId").String(),
-			key.String(),
-			gjson.Get(respStr, "token").String(),
-			new(U2FDeviceFinder),
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		signedAssertion, err := fidoClient.ChallengeU2F()
-		if err != nil {
-			return nil, err
-		}
-
-		payload, err := json.Marshal(signedAssertion)
-		if err != nil {
-			return nil, err
-		}
-		req, err := http.NewRequest("POST", webauthnSubmitURL, strings.NewReader(string(payload)))
-		if err != nil {
-			return nil, errors.Wrap(err, "error building authentication request")
-		}
-
-		req.Header.Add("X-Xsrftoken", xsrfToken)
-		req.Header.Add("Accept", "application/json")
-		req.Header.Add("Content-Type", "application/json")
-		return jc.client.Do(req)
+		return jc.verifyWebAuthn(loginDetails, xsrfToken)
 
 	case IdentifierJumpCloudProtect:
 		return jc.jumpCloudProtectAuth(jumpCloudProtectSubmitURL, xsrfToken)
 	case IdentifierDuoMfa:
-		// Get Duo config
-		req, err := http.NewRequest("GET", duoAuthSubmitURL, nil)
-		if err != nil {
-			return nil, errors.Wrap(err, "error building MFA authentication request")
-		}
-		// Re-add the necessary headers to our remade auth request
-		req.Header.Add("X-Xsrftoken", xsrfToken)
-		req.Header.Add("Accept", "application/json")
-		req.Header.Add("Content-Type", "application/json")
-
-		res, err := jc.client.Do(req)
-		if err != nil {
-			return nil, errors.Wrap(err, "error retrieving Duo configuration")
-		}
-		defer res.Body.Close()
-		if res.StatusCode != 200 {
-			return nil, errors.New("error retrieving Duo configuration, non 200 status returned")
-		}
-		duoResp, err := io.ReadAll(res.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "error retrieving Duo configuration")
-		}
-		duoHost := gjson.GetBytes(duoResp, "api_host").String()
-		duoSignature := gjson.GetBytes(duoResp, "sig_request").String()
-		duoSignatures := strings.Split(duoSignature, ":")
-		duoToken := gjson.GetBytes(duoResp, "token").String()
-
-		duoSubmitURL := fmt.Sprintf("https://%s/frame/web/v1/auth", duoHost)
-
-		duoForm := url.Values{}
-		duoForm.Add("parent", "https://console.jumpcloud.com/duo2fa")
-		duoForm.Add("java_version", "")
-		duoForm.Add("java_version", "")
-		duoForm.Add("flash_version", "")
-		duoForm.Add("screen_resolution_width", "3008")
-		duoForm.Add("screen_resolution_height", "1692")
-		duoForm.Add("color_depth", "24")
-
-		req, err = http.NewRequest("POST", duoSubmitURL, strings.NewReader(duoForm.Encode()))
-		if err != nil {
-			return nil, errors.Wrap(err, "error building authentication request")
-		}
-		q := req.URL.Query()
-		q.Add("tx", duoSignatures[0])
-		req.URL.RawQuery = q.Encode()
-
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-		res, err = jc.client.Do(req)
-		if err != nil {
-			return nil, errors.Wrap(err, "error retrieving verify response")
-		}
-		defer res.Body.Close()
-
-		//try to extract sid
-		doc, err := goquery.NewDocumentFromReader(res.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "error parsing document")
-		}
-
-		duoSID, ok := doc.Find("input[name=\"sid\"]").Attr("value")
-		if !ok {
-			return nil, errors.Wrap(err, "unable to locate saml response")
-		}
-		duoSID = html.UnescapeString(duoSID)
-
-		//prompt for mfa type
-		//only supporting push or passcode for now
-		var token string
-
-		var duoMfaOptions = []string{
-			"Duo Push",
-			"Passcode",
-		}
-
-		duoMfaOption := 0
-
-		if loginDetails.DuoMFAOption == "Duo Push" {
-			duoMfaOption = 0
-		} else if loginDetails.DuoMFAOption == "Passcode" {
-			duoMfaOption = 1
-		} else {
-			duoMfaOption = prompter.Choose("Select a DUO MFA Option", duoMfaOptions)
-		}
-
-		if duoMfaOptions[duoMfaOption] == "Passcode" {
-			//get users DUO MFA Token
-			token = prompter.StringRequired("Enter passcode")
-		}
-
-		// send mfa auth request
-		duoSubmitURL = fmt.Sprintf("https://%s/frame/prompt", duoHost)
-
-		duoForm = url.Values{}
-		duoForm.Add("sid", duoSID)
-		duoForm.Add("device", "phone1")
-		duoForm.Add("factor", duoMfaOptions[duoMfaOption])
-		duoForm.Add("out_of_date", "false")
-		if duoMfaOptions[duoMfaOption] == "Passcode" {
-			duoForm.Add("passcode", token)
-		}
-
-		req, err = http.NewRequest("POST", duoSubmitURL, strings.NewReader(duoForm.Encode()))
-		if err != nil {
-			return nil, errors.Wrap(err, "error building authentication request")
-		}
-
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-		res, err = jc.client.Do(req)
-		if err != nil {
-			return nil, errors.Wrap(err, "error retrieving verify response")
-		}
-		defer res.Body.Close()
-
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "error retrieving body from response")
-		}
-
-		resp := string(body)
-
-		duoTxStat := gjson.Get(resp, "stat").String()
-		duoTxID := gjson.Get(resp, "response.txid").String()
-		if duoTxStat != "OK" {
-			return nil, errors.Wrap(err, "error authenticating mfa device")
-		}
-
-		// get duo cookie
-		duoSubmitURL = fmt.Sprintf("https://%s/frame/status", duoHost)
+		return jc.verifyDuo(loginDetails, xsrfToken)
+	}
 
-		duoForm = url.Values{}
-		duoForm.Add("sid", duoSID)
-		duoForm.Add("txid", duoTxID)
+	return &http.Response{}, errors.New("no MFA method provided")
+}
 
-		req, err = http.NewRequest("POST", duoSubmitURL, strings.NewReader(duoForm.Encode()))
-		if err != nil {
-			return nil, errors.Wrap(err, "error building authentication request")
-		}
+// getUserOption picks the factor to verify from those JumpCloud lists as enrolled for the user, the one the mfa
+// setting pins or, with Auto, the only one saml2aws supports or the one chosen at the prompt
+func (jc *Client) getUserOption(ask prompter.Asker, body []byte) (string, error) {
+	factors := gjson.GetBytes(body, "factors")
+	if !factors.Exists() {
+		return "", errors.New("JumpCloud asked for MFA without listing the factors enrolled")
+	}
 
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	var enrolled, unsupported []string
+	var mfaOptionsAvailableAtJumpCloud []string
+	var mfaDisplayOptions []string
 
-		res, err = jc.client.Do(req)
-		if err != nil {
-			return nil, errors.Wrap(err, "error retrieving verify response")
+	for _, option := range factors.Array() {
+		if option.Get("status").String() != "available" {
+			continue
 		}
-		defer res.Body.Close()
-
-		body, err = io.ReadAll(res.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "error retrieving body from response")
+		identifier := option.Get("type").String()
+		enrolled = append(enrolled, identifier)
+		if _, ok := supportedMfaOptions[identifier]; !ok {
+			unsupported = append(unsupported, identifier)
+			continue
 		}
+		mfaOptionsAvailableAtJumpCloud = append(mfaOptionsAvailableAtJumpCloud, identifier)
+		mfaDisplayOptions = append(mfaDisplayOptions, supportedMfaOptions[identifier])
+	}
 
-		resp = string(body)
-
-		duoTxResult := gjson.Get(resp, "response.result").String()
-		duoResultURL := gjson.Get(resp, "response.result_url").String()
-		newSID := gjson.Get(resp, "response.sid").String()
-		if newSID != "" {
-			duoSID = newSID
+	if jc.mfa != "" && jc.mfa != "Auto" {
+		pinned := strings.ToLower(jc.mfa)
+		if _, ok := supportedMfaOptions[pinned]; !ok {
+			return "", errors.Wrapf(errFactorUnsupported, "mfa %s", jc.mfa)
 		}
-
-		log.Println(gjson.Get(resp, "response.status").String())
-
-		if duoTxResult != "SUCCESS" {
-			//poll as this is likely a push request
-			for {
-				time.Sleep(3 * time.Second)
-
-				req, err = http.NewRequest("POST", duoSubmitURL, strings.NewReader(duoForm.Encode()))
-				if err != nil {
-					return nil, errors.Wrap(err, "error building authentication request")
-				}
-
-				req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-				res, err = jc.client.Do(req)
-				if err != nil {
-					return nil, errors.Wrap(err, "error retrieving verify response")
-				}
-				defer res.Body.Close()
-
-				body, err = io.ReadAll(res.Body)
-				if err != nil {
-					return nil, errors.Wrap(err, "error retrieving body from response")
-				}
-
-				resp := string(body)
-
-				duoTxResult = gjson.Get(resp, "response.result").String()
-				duoResultURL = gjson.Get(resp, "response.result_url").String()
-				newSID = gjson.Get(resp, "response.sid").String()
-				if newSID != "" {
-					duoSID = newSID
-				}
-
-				log.Println(gjson.Get(resp, "response.status").String())
-
-				if duoTxResult == "FAILURE" {
-					return nil, errors.Wrap(err, "failed to authenticate device")
-				}
-
-				if duoTxResult == "SUCCESS" {
-					break
-				}
+		for _, identifier := range mfaOptionsAvailableAtJumpCloud {
+			if identifier == pinned {
+				return identifier, nil
 			}
 		}
-
-		duoRequestURL := fmt.Sprintf("https://%s%s", duoHost, duoResultURL)
-
-		duoForm = url.Values{}
-		duoForm.Add("sid", duoSID)
-
-		req, err = http.NewRequest("POST", duoRequestURL, strings.NewReader(duoForm.Encode()))
-		if err != nil {
-			return nil, errors.Wrap(err, "error constructing request object to result url")
-		}
-
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-		res, err = jc.client.Do(req)
-		if err != nil {
-			return nil, errors.Wrap(err, "error retrieving duo result response")
-		}
-		defer res.Body.Close()
-
-		body, err = io.ReadAll(res.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "duoResultSubmit: error retrieving body from response")
-		}
-
-		resp = string(body)
-
-		duoTxStat = gjson.Get(resp, "stat").String()
-		if duoTxStat != "OK" {
-			message := gjson.Get(resp, "message").String()
-			return nil, fmt.Errorf("duoResultSubmit: %s %s", duoTxStat, message)
-		}
-
-		duoTxCookie := gjson.Get(resp, "response.cookie").String()
-		if duoTxCookie == "" {
-			return nil, errors.New("duoResultSubmit: Unable to get response.cookie")
-		}
-
-		jumpCloudJsonPayload := []byte(
-			fmt.Sprintf(`{"token":"%s","sig_response":"%s"}`,
-				duoToken,
-				fmt.Sprintf("%s:%s", duoTxCookie, duoSignatures[1])),
-		)
-
-		req, err = http.NewRequest("POST", duoAuthSubmitURL, bytes.NewBuffer(jumpCloudJsonPayload))
-		if err != nil {
-			return nil, errors.Wrap(err, "error building authentication request")
-		}
-
-		req.Header.Add("X-Xsrftoken", xsrfToken)
-		req.Header.Add("Accept", "application/json")
-		req.Header.Add("Content-Type", "application/json")
-
-		return jc.client.Do(req)
-	}
-
-	return &http.Response{}, errors.New("no MFA method provided")
-}
-
-func (jc *Client) getUserOption(body []byte) (string, error) {
-	mfaConfigData := gjson.GetBytes(body, "factors")
-	if mfaConfigData.Index == 0 {
-		log.Fatalln("Mfa Config option not found")
-		return "", errors.New("Mfa not configured")
+		return "", errors.Wrapf(errFactorNotEnrolled, "mfa %s, the factors enrolled are %s", jc.mfa, factorList(enrolled))
 	}
-	var mfaOptionsAvailableAtJumpCloud []string
-	var mfaDisplayOptions []string
 
-	for _, option := range mfaConfigData.Array() {
-		if option.Get("status").String() == "available" {
-			identifier := option.Get("type").String()
-			if _, ok := supportedMfaOptions[identifier]; ok {
-				// check if the option is supported and among jumpcloud options
-				if jc.mfa != "Auto" {
-					if strings.ToLower(jc.mfa) == identifier {
-						return identifier, nil
-					}
-				}
-				mfaOptionsAvailableAtJumpCloud = append(mfaOptionsAvailableAtJumpCloud, identifier)
-				mfaDisplayOptions = append(mfaDisplayOptions, supportedMfaOptions[identifier])
-			}
+	switch len(mfaOptionsAvailableAtJumpCloud) {
+	case 0:
+		if len(unsupported) > 0 {
+			return "", errors.Wrapf(errFactorUnsupported, "the factors enrolled are %s", factorList(unsupported))
 		}
-	}
-	if len(mfaOptionsAvailableAtJumpCloud) == 0 {
-		return "", errors.New("No MFA options available")
-	} else if len(mfaOptionsAvailableAtJumpCloud) == 1 {
+		return "", errors.Wrap(errFactorNotEnrolled, "no factor is enrolled")
+	case 1:
 		return mfaOptionsAvailableAtJumpCloud[0], nil
 	}
 
-	mfaOption := prompter.Choose("Select which MFA option to use", mfaDisplayOptions)
+	mfaOption := ask.Choose("Select which MFA option to use", mfaDisplayOptions)
 	return mfaOptionsAvailableAtJumpCloud[mfaOption], nil
 }
+
+func factorList(factors []string) string {
+	if len(factors) == 0 {
+		return "none"
+	}
+	return strings.Join(factors, ", ")
+}
@@ -0,0 +1,70 @@
+package jumpcloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/duo"
+)
+
+// verifyDuo answers the Duo iframe JumpCloud embeds and hands the signed Duo response back to JumpCloud
+func (jc *Client) verifyDuo(loginDetails *creds.LoginDetails, xsrfToken string) (*http.Response, error) {
+	// Get Duo config
+	req, err := http.NewRequest("GET", duoAuthSubmitURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building MFA authentication request")
+	}
+	// Re-add the necessary headers to our remade auth request
+	req.Header.Add("X-Xsrftoken", xsrfToken)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := jc.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving Duo configuration")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, errors.New("error retrieving Duo configuration, non 200 status returned")
+	}
+	duoResp, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving Duo configuration")
+	}
+	frame := &duo.Frame{
+		Host:       gjson.GetBytes(duoResp, "api_host").String(),
+		SigRequest: gjson.GetBytes(duoResp, "sig_request").String(),
+	}
+	duoToken := gjson.GetBytes(duoResp, "token").String()
+
+	prompt := duo.New(jc.client, duo.Options{
+		Factor:   loginDetails.DuoMFAOption,
+		Passcode: loginDetails.MFAToken,
+		Prompter: loginDetails.Prompter,
+	})
+	sigResponse, err := prompt.VerifyFrame(frame, "https://console.jumpcloud.com/duo2fa")
+	if err != nil {
+		return nil, errors.Wrap(err, "error when interacting with Duo iframe")
+	}
+
+	jumpCloudJsonPayload, err := json.Marshal(map[string]string{"token": duoToken, "sig_response": sigResponse})
+	if err != nil {
+		return nil, errors.Wrap(err, "error building Duo response")
+	}
+
+	req, err = http.NewRequest("POST", duoAuthSubmitURL, bytes.NewBuffer(jumpCloudJsonPayload))
+	if err != nil {
+		return nil, errors.Wrap(err, "error building authentication request")
+	}
+
+	req.Header.Add("X-Xsrftoken", xsrfToken)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	return jc.client.Do(req)
+}
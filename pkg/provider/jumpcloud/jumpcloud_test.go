@@ -0,0 +1,78 @@
+package jumpcloud
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+func TestGetUserOption(t *testing.T) {
+	duoAndTotp := []byte(`{"factors":[{"type":"duo","status":"available"},{"type":"totp","status":"available"},{"type":"webauthn","status":"unavailable"}]}`)
+
+	tests := []struct {
+		name   string
+		mfa    string
+		body   []byte
+		option string
+		err    error
+		msg    string
+	}{
+		{name: "only factor", mfa: "Auto", body: []byte(`{"factors":[{"type":"push","status":"available"}]}`), option: IdentifierJumpCloudProtect},
+		{name: "pinned duo", mfa: "DUO", body: duoAndTotp, option: IdentifierDuoMfa},
+		{name: "pinned totp", mfa: "TOTP", body: duoAndTotp, option: IdentifierTotpMfa},
+		{
+			name: "pinned factor not enrolled",
+			mfa:  "WEBAUTHN",
+			body: duoAndTotp,
+			err:  errFactorNotEnrolled,
+			msg:  "mfa WEBAUTHN, the factors enrolled are duo, totp: MFA factor not enrolled in JumpCloud",
+		},
+		{
+			name: "only unsupported factors",
+			mfa:  "Auto",
+			body: []byte(`{"factors":[{"type":"sms","status":"available"}]}`),
+			err:  errFactorUnsupported,
+			msg:  "the factors enrolled are sms: MFA factor not supported by saml2aws for JumpCloud",
+		},
+		{
+			name: "nothing enrolled",
+			mfa:  "Auto",
+			body: []byte(`{"factors":[{"type":"totp","status":"unavailable"}]}`),
+			err:  errFactorNotEnrolled,
+		},
+		{name: "factors missing", mfa: "Auto", body: []byte(`{}`), msg: "JumpCloud asked for MFA without listing the factors enrolled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jc := &Client{mfa: tt.mfa}
+			option, err := jc.getUserOption(prompter.Asker{}, tt.body)
+			if tt.err == nil && tt.msg == "" {
+				require.Nil(t, err)
+				require.Equal(t, tt.option, option)
+				return
+			}
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+			}
+			if tt.msg != "" {
+				require.EqualError(t, err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestGetUserOptionPrompts(t *testing.T) {
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Choose", "Select which MFA option to use", []string{"DUO MFA authentication", "TOTP MFA authentication"}).Return(1)
+
+	jc := &Client{mfa: "Auto"}
+	option, err := jc.getUserOption(prompter.Asker{}, []byte(`{"factors":[{"type":"duo","status":"available"},{"type":"totp","status":"available"}]}`))
+	require.Nil(t, err)
+	require.Equal(t, IdentifierTotpMfa, option)
+	pr.Mock.AssertExpectations(t)
+}
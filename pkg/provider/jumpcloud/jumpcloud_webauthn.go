@@ -2,12 +2,20 @@ package jumpcloud
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/marshallbrekka/go-u2fhost"
+	"github.com/tidwall/gjson"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider/okta"
 )
 
 const (
@@ -19,6 +27,10 @@ const (
 
 var (
 	errNoDeviceFound = fmt.Errorf("no U2F devices found. device might not be plugged in")
+
+	errNoSecurityKeyRegistered = errors.New("JumpCloud has no security key registered for WebAuthn, register one in the JumpCloud user console")
+
+	errUserVerificationUnsupported = errors.New("JumpCloud requires the security key to verify the user, which needs saml2aws built with FIDO2 support (-tags fido2)")
 )
 
 // FidoClient represents a challenge and the device used to respond
@@ -50,6 +62,126 @@ type PublicKeyResponse struct {
 	UserHandle        *string `json:"userHandle"`
 }
 
+// verifyWebAuthn signs the WebAuthn challenge of JumpCloud with a FIDO2 security key, or a U2F key when saml2aws
+// is built without FIDO2 support, and posts the assertion back
+func (jc *Client) verifyWebAuthn(loginDetails *creds.LoginDetails, xsrfToken string) (*http.Response, error) {
+	res, err := jc.client.Get(webauthnSubmitURL)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving WebAuthn challenge: %w", err)
+	}
+	defer res.Body.Close()
+
+	respBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := parseWebAuthnOptions(respBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload *JumpCloudResponse
+	authenticator, err := okta.NewFIDO2Authenticator()
+	if err == nil {
+		payload, err = fido2Response(loginDetails.Prompter, authenticator, options)
+	} else {
+		payload, err = u2fResponse(options)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", webauthnSubmitURL, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, fmt.Errorf("error building authentication request: %w", err)
+	}
+
+	ensureHeaders(xsrfToken, req)
+	return jc.client.Do(req)
+}
+
+// webAuthnOptions the publicKey options JumpCloud hands navigator.credentials.get, with the token the
+// assertion is posted back with
+type webAuthnOptions struct {
+	challenge        string
+	rpID             string
+	credentialIDs    []string
+	userVerification string
+	token            string
+}
+
+func parseWebAuthnOptions(body []byte) (*webAuthnOptions, error) {
+	options := &webAuthnOptions{
+		challenge:        gjson.GetBytes(body, "publicKey.challenge").String(),
+		rpID:             gjson.GetBytes(body, "publicKey.rpId").String(),
+		userVerification: gjson.GetBytes(body, "publicKey.userVerification").String(),
+		token:            gjson.GetBytes(body, "token").String(),
+	}
+	if options.challenge == "" {
+		return nil, errors.New("unable to find the WebAuthn challenge in the JumpCloud response")
+	}
+
+	for _, credential := range gjson.GetBytes(body, "publicKey.allowCredentials").Array() {
+		if id := credential.Get("id").String(); id != "" {
+			options.credentialIDs = append(options.credentialIDs, id)
+		}
+	}
+	if len(options.credentialIDs) == 0 {
+		return nil, errNoSecurityKeyRegistered
+	}
+
+	return options, nil
+}
+
+// fido2Response signs the challenge with a FIDO2 security key, which can verify the user with its PIN
+func fido2Response(prmpt prompter.Prompter, authenticator okta.FIDO2Authenticator, options *webAuthnOptions) (*JumpCloudResponse, error) {
+	assertion, err := okta.ChallengeWebAuthn(authenticator, &okta.WebAuthnChallenge{
+		Challenge:        options.challenge,
+		Origin:           jumpCloudOrigin,
+		RPID:             options.rpID,
+		CredentialIDs:    options.credentialIDs,
+		UserVerification: options.userVerification == "required",
+		Prompter:         prmpt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while getting WebAuthn challenge: %w", err)
+	}
+
+	return &JumpCloudResponse{
+		PublicKeyCredential: PublicKey{
+			Id:    assertion.CredentialID,
+			RawId: assertion.CredentialID,
+			Type:  "public-key",
+			Response: PublicKeyResponse{
+				ClientData:        assertion.ClientDataJSON,
+				AuthenticatorData: assertion.AuthenticatorData,
+				SignatureData:     assertion.Signature,
+			},
+		},
+		Token: options.token,
+	}, nil
+}
+
+// u2fResponse signs the challenge with a U2F security key holding the first of the allowed credentials
+func u2fResponse(options *webAuthnOptions) (*JumpCloudResponse, error) {
+	// U2F keys only test for presence
+	if options.userVerification == "required" {
+		return nil, errUserVerificationUnsupported
+	}
+
+	fidoClient, err := NewFidoClient(options.challenge, options.rpID, options.credentialIDs[0], options.token, new(U2FDeviceFinder))
+	if err != nil {
+		return nil, err
+	}
+
+	return fidoClient.ChallengeU2F()
+}
+
 // DeviceFinder is used to mock out finding devices
 type DeviceFinder interface {
 	findDevice() (u2fhost.Device, error)
@@ -83,3 +83,22 @@ func TestChallengeU2F(t *testing.T) {
 		})
 	}
 }
+
+func TestParseWebAuthnOptions(t *testing.T) {
+	options, err := parseWebAuthnOptions([]byte(`{"token":"tok","publicKey":{"challenge":"Y2hhbGxlbmdl","rpId":"jumpcloud.com","userVerification":"preferred","allowCredentials":[{"type":"public-key","id":"a2V5MQ"},{"type":"public-key","id":"a2V5Mg"}]}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "Y2hhbGxlbmdl", options.challenge)
+	assert.Equal(t, "jumpcloud.com", options.rpID)
+	assert.Equal(t, []string{"a2V5MQ", "a2V5Mg"}, options.credentialIDs)
+	assert.Equal(t, "tok", options.token)
+}
+
+func TestParseWebAuthnOptionsNoKeyRegistered(t *testing.T) {
+	_, err := parseWebAuthnOptions([]byte(`{"token":"tok","publicKey":{"challenge":"Y2hhbGxlbmdl","rpId":"jumpcloud.com","allowCredentials":[]}}`))
+	assert.Equal(t, errNoSecurityKeyRegistered, err)
+}
+
+func TestU2FResponseUserVerificationRequired(t *testing.T) {
+	_, err := u2fResponse(&webAuthnOptions{challenge: "Y2hhbGxlbmdl", credentialIDs: []string{"a2V5MQ"}, userVerification: "required"})
+	assert.Equal(t, errUserVerificationUnsupported, err)
+}
@@ -19,6 +19,8 @@ import (
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 	"github.com/versent/saml2aws/v2/pkg/provider"
+	"github.com/versent/saml2aws/v2/pkg/provider/aad"
+	"github.com/versent/saml2aws/v2/pkg/provider/adfs"
 	"github.com/versent/saml2aws/v2/pkg/provider/okta"
 )
 
@@ -30,22 +32,63 @@ type Client struct {
 
 	client             *provider.HTTPClient
 	authErrorValidator *authErrorValidator
+	idpAccount         *cfg.IDPAccount
+	broker             string
+	brokerProvider     string
+	otpElement         string
 }
 
 const (
 	DefaultAuthErrorElement = "span#input-error"
 	DefaultAuthErrorMessage = "Invalid username or password."
+
+	// DefaultOTPElement the one-time code input of the KeyCloak themes, totp before 8.0.1 and otp since
+	DefaultOTPElement = "input#totp, input#otp"
+
+	// the elements the KeyCloak themes show a rejected one-time code in, the newer theme first
+	otpErrorElements = "span#input-error-otp-code, span.kc-feedback-text"
+)
+
+// the kinds of IdP a kc_broker login can be handed on to
+const (
+	brokerProviderADFS    = "ADFS"
+	brokerProviderAzureAD = "AzureAD"
 )
 
+var brokerProviders = []string{brokerProviderADFS, brokerProviderAzureAD}
+
+// brokeredIdP logs into the IdP KeyCloak brokers the login to, from the login page KeyCloak redirected to
+type brokeredIdP interface {
+	AuthenticateBrokered(res *http.Response, loginDetails *creds.LoginDetails) (string, error)
+}
+
 type authErrorValidator struct {
 	httpMessageRE *regexp.Regexp
 	httpElement   string
 }
 
+var (
+	errNoAuthenticator = errors.New("no WebAuthn security key found, plug in the key registered with KeyCloak and login again")
+
+	errUserVerificationUnsupported = errors.New("KeyCloak requires the security key to verify the user, which needs saml2aws built with FIDO2 support (-tags fido2)")
+)
+
+// the KeyCloak realm setting for WebAuthn user verification requiring it, rather than preferring or discouraging it
+const userVerificationRequired = "required"
+
+// webauthnParameters what the webauthn-authenticate page hands navigator.credentials.get
+type webauthnParameters struct {
+	credentialIDs    []string
+	challenge        string
+	rpID             string
+	userVerification string
+}
+
 type authContext struct {
 	mfaToken                string
 	authenticatorIndex      uint
 	authenticatorIndexValid bool
+	ask                     prompter.Asker // asks the user through the prompter of the login
 }
 
 // New create a new KeyCloakClient
@@ -53,7 +96,12 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -63,12 +111,35 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 		return nil, errors.Wrap(err, "error customizing auth error validator")
 	}
 
+	if idpAccount.KCBrokerProvider != "" && !contains(brokerProviders, idpAccount.KCBrokerProvider) {
+		return nil, fmt.Errorf("unsupported kc_broker_provider %s, expected one of %s", idpAccount.KCBrokerProvider, strings.Join(brokerProviders, ", "))
+	}
+
 	return &Client{
 		client:             client,
 		authErrorValidator: authErrorValidator,
+		idpAccount:         idpAccount,
+		broker:             idpAccount.KCBroker,
+		brokerProvider:     idpAccount.KCBrokerProvider,
+		otpElement:         idpAccount.KCOTPElement,
 	}, nil
 }
 
+// LoginPageMarkers the login form, or with kc_broker the link to the identity provider it brokers to
+func (kc *Client) LoginPageMarkers() []provider.PageMarker {
+	if kc.broker != "" {
+		return []provider.PageMarker{{
+			Selector:    fmt.Sprintf(`a#social-%s, a[href*="/broker/%s/login"]`, kc.broker, kc.broker),
+			Description: fmt.Sprintf("link to the %s identity provider", kc.broker),
+		}}
+	}
+	return []provider.PageMarker{
+		{Selector: "form[action]", Description: "login form with an action"},
+		{Selector: "input[name=username]", Description: "username field"},
+		{Selector: "input[name=password]", Description: "password field"},
+	}
+}
+
 func CustomizeAuthErrorValidator(account *cfg.IDPAccount) (*authErrorValidator, error) {
 	customValidator := &authErrorValidator{}
 	var err error
@@ -92,7 +163,10 @@ func CustomizeAuthErrorValidator(account *cfg.IDPAccount) (*authErrorValidator,
 
 // Authenticate logs into KeyCloak and returns a SAML response
 func (kc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
-	return kc.doAuthenticate(&authContext{loginDetails.MFAToken, 0, true}, loginDetails)
+	if kc.broker != "" {
+		return kc.authenticateBroker(loginDetails)
+	}
+	return kc.doAuthenticate(&authContext{loginDetails.MFAToken, 0, true, loginDetails.Asker()}, loginDetails)
 }
 
 func (kc *Client) doAuthenticate(authCtx *authContext, loginDetails *creds.LoginDetails) (string, error) {
@@ -114,7 +188,7 @@ func (kc *Client) doAuthenticate(authCtx *authContext, loginDetails *creds.Login
 		return "", errors.Wrap(err, "error parsing document")
 	}
 
-	if containsTotpForm(doc) {
+	if containsTotpForm(doc, kc.otpElement) {
 		totpSubmitURL, err := extractSubmitURL(doc)
 		if err != nil {
 			return "", errors.Wrap(err, "unable to locate IDP totp form submit URL")
@@ -125,7 +199,7 @@ func (kc *Client) doAuthenticate(authCtx *authContext, loginDetails *creds.Login
 			return "", errors.Wrap(err, "error posting totp form")
 		}
 	} else if containsWebauthnForm(doc) {
-		credentialIDs, challenge, rpId, err := extractWebauthnParameters(doc)
+		params, err := extractWebauthnParameters(doc)
 		if err != nil {
 			return "", errors.Wrap(err, "could not extract Webauthn parameters")
 		}
@@ -135,7 +209,7 @@ func (kc *Client) doAuthenticate(authCtx *authContext, loginDetails *creds.Login
 			return "", errors.Wrap(err, "unable to locate IDP Webauthn form submit URL")
 		}
 
-		doc, err = kc.postWebauthnForm(webauthnSubmitURL, credentialIDs, challenge, rpId)
+		doc, err = kc.postWebauthnForm(authCtx, webauthnSubmitURL, params)
 		if err != nil {
 			return "", errors.Wrap(err, "error posting Webauthn form")
 		}
@@ -145,65 +219,324 @@ func (kc *Client) doAuthenticate(authCtx *authContext, loginDetails *creds.Login
 	if err != nil && authCtx.authenticatorIndexValid && passwordValid(doc, kc.authErrorValidator) {
 		return kc.doAuthenticate(authCtx, loginDetails)
 	}
+	// KeyCloak shows the one-time code form again when it rejects the code
+	if err != nil && containsTotpForm(doc, kc.otpElement) {
+		return "", kc.otpRejectedError(doc)
+	}
+	if err != nil && !passwordValid(doc, kc.authErrorValidator) {
+		return "", provider.InvalidCredentials("KeyCloak rejected the username or password")
+	}
 	return samlResponse, err
 }
 
-func extractWebauthnParameters(doc *goquery.Document) (credentialIDs []string, challenge string, rpID string, err error) {
+func extractWebauthnParameters(doc *goquery.Document) (*webauthnParameters, error) {
+	params := &webauthnParameters{}
+
 	doc.Find("input[name=authn_use_chk]").Each(func(i int, s *goquery.Selection) {
 		value, ok := s.Attr("value")
 		if !ok {
 			return
 		}
-		credentialIDs = append(credentialIDs, value)
+		params.credentialIDs = append(params.credentialIDs, value)
 	})
-	if len(credentialIDs) == 0 {
-		return nil, "", "", errors.New("no credentialID found on page")
+	if len(params.credentialIDs) == 0 {
+		return nil, errors.New("no credentialID found on page")
 	}
 
-	challengeRE, err := regexp.Compile(`let challenge = "(.+)";`)
+	doc.Find("script").Each(func(i int, s *goquery.Selection) {
+		content := s.Text()
+		challenge, ok := scriptValue(content, "challenge")
+		if !ok {
+			return
+		}
+		params.challenge = challenge
+		params.rpID, _ = scriptValue(content, "rpId")
+		params.userVerification, _ = scriptValue(content, "userVerification")
+	})
+	if params.challenge == "" {
+		return nil, errors.New("no challenge found on page")
+	}
+
+	return params, nil
+}
+
+// scriptValue finds a quoted value in the page's JavaScript, assigned with `let name = "value"` before KeyCloak 23
+// and as a `name : 'value'` property of the input to authenticateByWebAuthn since
+func scriptValue(content, name string) (string, bool) {
+	re := regexp.MustCompile(`(?:let\s+` + name + `\s*=|\b` + name + `\s*:)\s*["']([^"']*)["']`)
+	submatch := re.FindStringSubmatch(content)
+	if submatch == nil {
+		return "", false
+	}
+	return submatch[1], true
+}
+
+// authenticateBroker logs in through the IdP KeyCloak brokers to: it follows the kc_broker link on the KeyCloak
+// login page, signs into that IdP and hands the SAML response it issues back to the KeyCloak broker endpoint
+func (kc *Client) authenticateBroker(loginDetails *creds.LoginDetails) (string, error) {
+	doc, pageURL, err := kc.getLoginPage(loginDetails)
 	if err != nil {
-		return nil, "", "", errors.Wrap(err, "could not compile regular expression")
+		return "", errors.Wrap(err, "error retrieving login page from KeyCloak")
 	}
 
-	rpIDRE, err := regexp.Compile(`let rpId = "(.+)"`)
+	brokerURL, err := extractBrokerURL(doc, pageURL, kc.broker)
 	if err != nil {
-		return nil, "", "", errors.Wrap(err, "could not compile regular expression")
+		return "", err
 	}
-	doc.Find("script").Each(func(i int, s *goquery.Selection) {
-		content := s.Text()
-		challengeSubmatch := challengeRE.FindStringSubmatch(content)
-		if challengeSubmatch == nil {
-			return
+
+	endpointURL, err := brokerEndpointURL(brokerURL)
+	if err != nil {
+		return "", err
+	}
+
+	res, relayState, err := kc.followBrokerLink(brokerURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "error following the %s broker link from KeyCloak", kc.broker)
+	}
+
+	brokerProvider, err := detectBrokerProvider(kc.brokerProvider, res)
+	if err != nil {
+		return "", err
+	}
+
+	idp, err := kc.brokeredIdP(brokerProvider)
+	if err != nil {
+		return "", err
+	}
+
+	samlResponse, err := idp.AuthenticateBrokered(res, loginDetails)
+	if err != nil {
+		return "", errors.Wrapf(err, "error logging into %s IdP %s brokered by KeyCloak", brokerProvider, kc.broker)
+	}
+
+	doc, err = kc.postBrokerResponse(endpointURL, samlResponse, relayState)
+	if err != nil {
+		return "", errors.Wrapf(err, "error handing the %s SAML response back to KeyCloak", brokerProvider)
+	}
+
+	samlAssertion, err := extractSamlResponse(doc)
+	if err != nil {
+		return "", errors.Wrapf(err, "KeyCloak didn't return a SAML response after the %s login", brokerProvider)
+	}
+
+	return samlAssertion, nil
+}
+
+// extractBrokerURL finds the link KeyCloak renders on its login page for the identity provider with the alias
+func extractBrokerURL(doc *goquery.Document, pageURL *url.URL, alias string) (*url.URL, error) {
+	var href string
+	var aliases []string
+
+	doc.Find("a[href]").Each(func(i int, s *goquery.Selection) {
+		link, _ := s.Attr("href")
+		id, _ := s.Attr("id")
+		if strings.HasPrefix(id, "social-") {
+			aliases = append(aliases, strings.TrimPrefix(id, "social-"))
 		}
-		challenge = challengeSubmatch[1]
-		rpIDSubmatch := rpIDRE.FindStringSubmatch(content)
-		if rpIDSubmatch == nil {
-			return
+		if id == "social-"+alias || strings.Contains(link, "/broker/"+alias+"/login") {
+			href = link
 		}
-		rpID = rpIDSubmatch[1]
 	})
-	return credentialIDs, challenge, rpID, nil
+
+	if href == "" {
+		return nil, fmt.Errorf("no identity provider %s on the KeyCloak login page, expected one of %s", alias, strings.Join(aliases, ", "))
+	}
+
+	brokerURL, err := pageURL.Parse(href)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing the %s broker link", alias)
+	}
+
+	return brokerURL, nil
 }
 
-func (kc *Client) getLoginForm(loginDetails *creds.LoginDetails) (string, url.Values, error) {
+// brokerEndpointURL the broker endpoint the IdP posts its SAML response to, alongside the broker's login link
+// at /realms/{realm}/broker/{alias}/endpoint
+func brokerEndpointURL(brokerURL *url.URL) (string, error) {
+	if !strings.HasSuffix(brokerURL.Path, "/login") || !strings.Contains(brokerURL.Path, "/broker/") {
+		return "", fmt.Errorf("unexpected KeyCloak broker link %s", brokerURL.Path)
+	}
+
+	endpointURL := *brokerURL
+	endpointURL.Path = strings.TrimSuffix(brokerURL.Path, "/login") + "/endpoint"
+	endpointURL.RawQuery = ""
+
+	return endpointURL.String(), nil
+}
+
+// followBrokerLink follows the broker link to the login page of the IdP, posting the SAML request on when
+// KeyCloak uses the POST binding, and returns that page along with the RelayState the IdP sends back
+func (kc *Client) followBrokerLink(brokerURL *url.URL) (*http.Response, string, error) {
+	res, err := kc.client.Get(brokerURL.String())
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error retrieving broker link")
+	}
+
+	body, err := readBody(res)
+	if err != nil {
+		return nil, "", err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to build document from response")
+	}
+
+	var relayState string
+	if doc.Find("input[name=SAMLRequest]").Length() != 0 {
+		samlRequestForm := url.Values{}
+		doc.Find("input[name]").Each(func(i int, s *goquery.Selection) {
+			name, _ := s.Attr("name")
+			value, _ := s.Attr("value")
+			samlRequestForm.Add(name, value)
+		})
+		relayState = samlRequestForm.Get("RelayState")
+
+		samlRequestURL, err := extractSubmitURL(doc)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "unable to locate SAML request form submit URL")
+		}
+
+		req, err := http.NewRequest("POST", samlRequestURL, strings.NewReader(samlRequestForm.Encode()))
+		if err != nil {
+			return nil, "", errors.Wrap(err, "error building SAML request")
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+		res, err = kc.client.Do(req)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "error posting SAML request")
+		}
+	} else {
+		relayState = redirectRelayState(res)
+	}
+
+	if relayState == "" {
+		return nil, "", errors.New("KeyCloak didn't send a RelayState with the SAML request")
+	}
+
+	return res, relayState, nil
+}
+
+// redirectRelayState finds the RelayState KeyCloak sent with the redirect binding in the chain of redirects
+func redirectRelayState(res *http.Response) string {
+	for req := res.Request; req != nil; {
+		if relayState := req.URL.Query().Get("RelayState"); relayState != "" {
+			return relayState
+		}
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	return ""
+}
+
+// detectBrokerProvider the kind of IdP kc_broker is, as configured with kc_broker_provider or, failing that, told
+// from its login page
+func detectBrokerProvider(configured string, res *http.Response) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+
+	body, err := readBody(res)
+	if err != nil {
+		return "", err
+	}
+
+	pageURL := res.Request.URL
+	switch {
+	case strings.EqualFold(pageURL.Hostname(), "login.microsoftonline.com") || bytes.Contains(body, []byte("ConvergedSignIn")):
+		return brokerProviderAzureAD, nil
+	case strings.Contains(strings.ToLower(pageURL.Path), "/adfs/"):
+		return brokerProviderADFS, nil
+	}
+
+	return "", fmt.Errorf("unable to tell which kind of IdP the KeyCloak broker sent the login to at %s, set kc_broker_provider to one of %s", pageURL.Host, strings.Join(brokerProviders, ", "))
+}
+
+// brokeredIdP the client logging into the IdP, sharing the KeyCloak HTTP client so the cookies the IdP set on the
+// way to its login page are sent back
+func (kc *Client) brokeredIdP(brokerProvider string) (brokeredIdP, error) {
+	switch brokerProvider {
+	case brokerProviderADFS:
+		return adfs.NewBrokered(kc.idpAccount, kc.client), nil
+	case brokerProviderAzureAD:
+		return aad.NewBrokered(kc.idpAccount, kc.client)
+	}
+	return nil, fmt.Errorf("unsupported kc_broker_provider %s, expected one of %s", brokerProvider, strings.Join(brokerProviders, ", "))
+}
+
+// postBrokerResponse hands the SAML response issued by the IdP to the KeyCloak broker endpoint, which carries on
+// with the login
+func (kc *Client) postBrokerResponse(endpointURL, samlResponse, relayState string) (*goquery.Document, error) {
+	brokerForm := url.Values{}
+	brokerForm.Set("SAMLResponse", samlResponse)
+	brokerForm.Set("RelayState", relayState)
+
+	req, err := http.NewRequest("POST", endpointURL, strings.NewReader(brokerForm.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "error building broker response request")
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := kc.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error posting broker response")
+	}
+	defer res.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading broker response")
+	}
+
+	return doc, nil
+}
+
+// readBody reads the response body, leaving it in place to be read again
+func readBody(res *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving body")
+	}
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// getLoginPage retrieves the KeyCloak login page, returning it along with its URL
+func (kc *Client) getLoginPage(loginDetails *creds.LoginDetails) (*goquery.Document, *url.URL, error) {
 
 	res, err := kc.client.Get(loginDetails.URL)
 	if err != nil {
-		return "", nil, errors.Wrap(err, "error retrieving form")
+		return nil, nil, errors.Wrap(err, "error retrieving form")
 	}
+	defer res.Body.Close()
 
 	doc, err := goquery.NewDocumentFromReader(res.Body)
 	if err != nil {
-		return "", nil, errors.Wrap(err, "failed to build document from response")
+		return nil, nil, errors.Wrap(err, "failed to build document from response")
 	}
 
 	if res.StatusCode == http.StatusUnauthorized {
 		authSubmitURL, err := extractSubmitURL(doc)
 		if err != nil {
-			return "", nil, errors.Wrap(err, "unable to locate IDP authentication form submit URL")
+			return nil, nil, errors.Wrap(err, "unable to locate IDP authentication form submit URL")
 		}
 		loginDetails.URL = authSubmitURL
-		return kc.getLoginForm(loginDetails)
+		return kc.getLoginPage(loginDetails)
+	}
+
+	return doc, res.Request.URL, nil
+}
+
+func (kc *Client) getLoginForm(loginDetails *creds.LoginDetails) (string, url.Values, error) {
+
+	doc, _, err := kc.getLoginPage(loginDetails)
+	if err != nil {
+		return "", nil, err
 	}
 
 	authForm := url.Values{}
@@ -247,13 +580,22 @@ func (kc *Client) postTotpForm(authCtx *authContext, totpSubmitURL string, doc *
 	otpForm := url.Values{}
 
 	if authCtx.mfaToken == "" {
-		authCtx.mfaToken = prompter.RequestSecurityCode("000000")
+		authCtx.mfaToken = authCtx.ask.RequestSecurityCode("000000")
 	}
 
 	doc.Find("input").Each(func(i int, s *goquery.Selection) {
 		updateOTPFormData(authCtx, otpForm, s)
 	})
 
+	// customised themes can name the input anything
+	if kc.otpElement != "" {
+		doc.Find(kc.otpElement).Each(func(i int, s *goquery.Selection) {
+			if name, ok := s.Attr("name"); ok {
+				otpForm.Set(name, authCtx.mfaToken)
+			}
+		})
+	}
+
 	req, err := http.NewRequest("POST", totpSubmitURL, strings.NewReader(otpForm.Encode()))
 	if err != nil {
 		return nil, errors.Wrap(err, "error building MFA request")
@@ -279,26 +621,103 @@ func (kc *Client) postTotpForm(authCtx *authContext, totpSubmitURL string, doc *
 	return doc, nil
 }
 
-func (kc *Client) postWebauthnForm(webauthnSubmitURL string, credentialIDs []string, challenge, rpId string) (*goquery.Document, error) {
+func (kc *Client) postWebauthnForm(authCtx *authContext, webauthnSubmitURL string, params *webauthnParameters) (*goquery.Document, error) {
+	submitURL, err := url.Parse(webauthnSubmitURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing Webauthn form submit URL")
+	}
+
+	// KeyCloak leaves the RP ID empty unless the realm sets one, browsers then use the host of the page
+	if params.rpID == "" {
+		params.rpID = submitURL.Hostname()
+	}
+
+	var webauthnForm url.Values
+	authenticator, err := okta.NewFIDO2Authenticator()
+	if err == nil {
+		webauthnForm, err = fido2WebauthnForm(authCtx.ask, authenticator, submitURL.Scheme+"://"+submitURL.Host, params)
+	} else {
+		webauthnForm, err = u2fWebauthnForm(params)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", webauthnSubmitURL, strings.NewReader(webauthnForm.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "error building MFA request")
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := kc.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving content")
+	}
+
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading webauthn form response")
+	}
+
+	return doc, nil
+}
+
+// fido2WebauthnForm signs the challenge with a FIDO2 security key, which can verify the user with its PIN
+func fido2WebauthnForm(ask prompter.Asker, authenticator okta.FIDO2Authenticator, origin string, params *webauthnParameters) (url.Values, error) {
+	assertion, err := okta.ChallengeWebAuthn(authenticator, &okta.WebAuthnChallenge{
+		Challenge:        params.challenge,
+		Origin:           origin,
+		RPID:             params.rpID,
+		CredentialIDs:    params.credentialIDs,
+		UserVerification: params.userVerification == userVerificationRequired,
+		Prompter:         ask.Prompter,
+	})
+	if err == okta.ErrFIDO2NoDevice {
+		return nil, errNoAuthenticator
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error while getting Webauthn challenge")
+	}
+
 	webauthnForm := url.Values{}
+	webauthnForm.Set("clientDataJSON", assertion.ClientDataJSON)
+	webauthnForm.Set("authenticatorData", assertion.AuthenticatorData)
+	webauthnForm.Set("signature", assertion.Signature)
+	webauthnForm.Set("credentialId", assertion.CredentialID)
+	webauthnForm.Set("userHandle", "")
+	webauthnForm.Set("error", "")
+
+	return webauthnForm, nil
+}
+
+// u2fWebauthnForm signs the challenge with a U2F security key, trying each of the credentials in turn
+func u2fWebauthnForm(params *webauthnParameters) (url.Values, error) {
+	// U2F keys only test for presence
+	if params.userVerification == userVerificationRequired {
+		return nil, errUserVerificationUnsupported
+	}
 
 	var assertion *okta.SignedAssertion
 	var pickedCredentialID string
-	for i, credentialID := range credentialIDs {
+	for i, credentialID := range params.credentialIDs {
 		fidoClient, err := okta.NewFidoClient(
-			challenge,
-			rpId,
+			params.challenge,
+			params.rpID,
 			"",
 			credentialID,
 			"",
 			new(okta.U2FDeviceFinder),
 		)
+		if err == okta.ErrNoDeviceFound {
+			return nil, errNoAuthenticator
+		}
 		if err != nil {
 			return nil, errors.Wrap(err, "error connecting to Webauthn device")
 		}
 
 		assertion, err = fidoClient.ChallengeU2F()
-		if _, ok := err.(*u2fhost.BadKeyHandleError); ok && i < len(credentialIDs)-1 {
+		if _, ok := err.(*u2fhost.BadKeyHandleError); ok && i < len(params.credentialIDs)-1 {
 			log.Println("Device does not have key handle, trying next ...")
 			continue
 		}
@@ -320,6 +739,8 @@ func (kc *Client) postWebauthnForm(webauthnSubmitURL string, credentialIDs []str
 	if err != nil {
 		return nil, errors.Wrap(err, "unexpected format for Webauthn authenticator data")
 	}
+
+	webauthnForm := url.Values{}
 	webauthnForm.Set("clientDataJSON", assertion.ClientData)
 	webauthnForm.Set("authenticatorData", authenticatorData)
 	webauthnForm.Set("signature", signature)
@@ -327,24 +748,7 @@ func (kc *Client) postWebauthnForm(webauthnSubmitURL string, credentialIDs []str
 	webauthnForm.Set("userHandle", "")
 	webauthnForm.Set("error", "")
 
-	req, err := http.NewRequest("POST", webauthnSubmitURL, strings.NewReader(webauthnForm.Encode()))
-	if err != nil {
-		return nil, errors.Wrap(err, "error building MFA request")
-	}
-
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err := kc.client.Do(req)
-	if err != nil {
-		return nil, errors.Wrap(err, "error retrieving content")
-	}
-
-	doc, err := goquery.NewDocumentFromReader(res.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "error reading webauthn form response")
-	}
-
-	return doc, nil
+	return webauthnForm, nil
 }
 
 func reencodeAsURLEncoding(data string) (string, error) {
@@ -405,22 +809,37 @@ func passwordValid(doc *goquery.Document, authErrorValidator *authErrorValidator
 	return valid
 }
 
-func containsTotpForm(doc *goquery.Document) bool {
-	// search totp field at Keycloak < 8.0.1
-	totpIndex := doc.Find("input#totp").Index()
+// containsTotpForm whether the page asks for a one-time code, in the input kc_otp_element selects when set
+func containsTotpForm(doc *goquery.Document, otpElement string) bool {
+	if otpElement == "" {
+		otpElement = DefaultOTPElement
+	}
+	return doc.Find(otpElement).Length() > 0
+}
 
-	if totpIndex != -1 {
-		return true
+// otpRejectedError the error of a one-time code KeyCloak rejected, with the reason the realm gave in the
+// kc_auth_error_element or the one-time code error of the theme
+func (kc *Client) otpRejectedError(doc *goquery.Document) error {
+	selector := otpErrorElements
+	if kc.authErrorValidator != nil {
+		selector = kc.authErrorValidator.httpElement + ", " + selector
 	}
 
-	// search otp field at Keycloak >= 8.0.1
-	totpIndex = doc.Find("input#otp").Index()
+	var reason string
+	doc.Find(selector).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		reason = strings.TrimSpace(s.Text())
+		return reason == ""
+	})
 
-	return totpIndex != -1
+	if reason == "" {
+		return errors.New("KeyCloak rejected the one-time code")
+	}
+	return errors.Errorf("KeyCloak rejected the one-time code: %s", reason)
 }
 
 func containsWebauthnForm(doc *goquery.Document) bool {
-	return doc.Find("form#webauth").Index() != -1
+	// the authenticator list is what KeyCloak 20+ always renders, even with a customised form
+	return doc.Find("form#webauth").Index() != -1 || doc.Find("#kc-webauthn-authenticator").Index() != -1
 }
 
 func updateKeyCloakFormData(authForm url.Values, s *goquery.Selection, user *creds.LoginDetails) {
@@ -474,3 +893,12 @@ func updateOTPFormData(authCtx *authContext, otpForm url.Values, s *goquery.Sele
 func generateAuthenticatorElementId(authenticatorIndex uint) string {
 	return fmt.Sprintf("kc-otp-credential-%d", authenticatorIndex)
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -2,10 +2,13 @@ package keycloak
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/PuerkitoBio/goquery"
@@ -148,7 +151,7 @@ func TestClient_postTotpForm(t *testing.T) {
 
 	pr.Mock.On("RequestSecurityCode", "000000").Return("123456")
 
-	authCtx := &authContext{"", 0, true}
+	authCtx := &authContext{authenticatorIndexValid: true}
 	opts := &provider.HTTPClientOptions{IsWithRetries: false}
 	kc := Client{client: &provider.HTTPClient{Client: http.Client{}, Options: opts}}
 
@@ -178,7 +181,7 @@ func TestClient_postTotpFormWithProvidedMFAToken(t *testing.T) {
 	pr := &mocks.Prompter{}
 	prompter.SetPrompter(pr)
 
-	authCtx := &authContext{"123456", 0, true}
+	authCtx := &authContext{mfaToken: "123456", authenticatorIndexValid: true}
 	opts := &provider.HTTPClientOptions{IsWithRetries: false}
 	kc := Client{client: &provider.HTTPClient{Client: http.Client{}, Options: opts}}
 
@@ -207,7 +210,7 @@ func TestClient_postTotpFormWithMultipleAuthenticators(t *testing.T) {
 	pr := &mocks.Prompter{}
 	prompter.SetPrompter(pr)
 
-	authCtx := &authContext{"123456", 0, true}
+	authCtx := &authContext{mfaToken: "123456", authenticatorIndexValid: true}
 	opts := &provider.HTTPClientOptions{IsWithRetries: false}
 	kc := Client{client: &provider.HTTPClient{Client: http.Client{}, Options: opts}}
 
@@ -245,7 +248,86 @@ func TestClient_containsTotpForm(t *testing.T) {
 	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
 	require.Nil(t, err)
 
-	require.True(t, containsTotpForm(doc))
+	require.True(t, containsTotpForm(doc, ""))
+}
+
+func TestClient_containsTotpFormCustomElement(t *testing.T) {
+	data, err := os.ReadFile("example/mfapage-custom-theme.html")
+	require.Nil(t, err)
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	require.False(t, containsTotpForm(doc, ""))
+	require.True(t, containsTotpForm(doc, "input.code-input"))
+}
+
+func TestClient_postTotpFormCustomElement(t *testing.T) {
+	var posted url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		posted = r.PostForm
+		_, _ = w.Write([]byte("<html></html>"))
+	}))
+	defer ts.Close()
+
+	mfapage, err := os.ReadFile("example/mfapage-custom-theme.html")
+	require.Nil(t, err)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(mfapage))
+	require.Nil(t, err)
+
+	authCtx := &authContext{mfaToken: "123456", authenticatorIndexValid: true}
+	opts := &provider.HTTPClientOptions{IsWithRetries: false}
+	kc := Client{client: &provider.HTTPClient{Client: http.Client{}, Options: opts}, otpElement: "input.code-input"}
+
+	_, err = kc.postTotpForm(authCtx, ts.URL, doc)
+	require.Nil(t, err)
+	require.Equal(t, "123456", posted.Get("code"))
+}
+
+func TestClient_AuthenticateOTPRejected(t *testing.T) {
+	for _, tc := range []struct {
+		page       string
+		otpElement string
+		errElement string
+		err        string
+	}{
+		{page: "example/mfapage-invalid-code.html", err: "KeyCloak rejected the one-time code: Invalid authenticator code."},
+		{page: "example/mfapage-custom-theme.html", otpElement: "input.code-input", errElement: "p.login-error", err: "KeyCloak rejected the one-time code: That code didn't work, wait for a new one and try again."},
+		{page: "example/mfapage-custom-theme.html", otpElement: "input.code-input", err: "KeyCloak rejected the one-time code"},
+	} {
+		mfapage, err := os.ReadFile(tc.page)
+		require.Nil(t, err)
+
+		var otp string
+		var ts *httptest.Server
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Nil(t, r.ParseForm())
+			switch {
+			case r.URL.Path == "/realms/master/protocol/saml/clients/amazon-aws":
+				_, _ = fmt.Fprintf(w, `<html><body><form method="post" action="%s/login"><input name="username"/><input name="password"/></form></body></html>`, ts.URL)
+			case r.URL.Path == "/login":
+				_, _ = w.Write([]byte(strings.ReplaceAll(string(mfapage), "https://id.example.com", ts.URL)))
+			default:
+				otp = r.Form.Get("otp") + r.Form.Get("code")
+				_, _ = w.Write([]byte(strings.ReplaceAll(string(mfapage), "https://id.example.com", ts.URL)))
+			}
+		}))
+
+		idpAccount := cfg.NewIDPAccount()
+		idpAccount.KCOTPElement = tc.otpElement
+		idpAccount.KCAuthErrorElement = tc.errElement
+		kc, err := New(idpAccount)
+		require.Nil(t, err)
+
+		loginDetails := &creds.LoginDetails{URL: ts.URL + "/realms/master/protocol/saml/clients/amazon-aws", Username: "test", Password: "test123", MFAToken: "654321"}
+
+		_, err = kc.Authenticate(loginDetails)
+		ts.Close()
+
+		require.EqualError(t, err, tc.err)
+		require.Equal(t, "654321", otp)
+	}
 }
 
 func TestClient_extractWebauthnParameters(t *testing.T) {
@@ -255,13 +337,47 @@ func TestClient_extractWebauthnParameters(t *testing.T) {
 	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
 	require.Nil(t, err)
 
-	credentialIDs, challenge, rpID, err := extractWebauthnParameters(doc)
+	params, err := extractWebauthnParameters(doc)
 	require.Nil(t, err)
 
 	expectedCredentialIDs := []string{"pcFg5E6QIk0ZFfJxmf8cfUcb3hirl5Knl8aJ-mjC6MRjVu1dOiBBs51wtjS_O1eP2uiJfGiSL3D8R2cBLnoZyw", "pcFg5E6QIk0ZFfJxmf8efUcb3hirl5Knl8aJ-mjC6MRjVu1dOaBBs51wtjS_O1eP2uiJfGiSL3D8R2cBLnoZyw"}
-	require.Equal(t, expectedCredentialIDs, credentialIDs)
-	require.Equal(t, "J3NKWZPkSmqXuoKLtzzshg", challenge)
-	require.Equal(t, "localhost", rpID)
+	require.Equal(t, expectedCredentialIDs, params.credentialIDs)
+	require.Equal(t, "J3NKWZPkSmqXuoKLtzzshg", params.challenge)
+	require.Equal(t, "localhost", params.rpID)
+	require.Equal(t, "discouraged", params.userVerification)
+}
+
+func TestClient_extractWebauthnParametersModule(t *testing.T) {
+	data, err := os.ReadFile("example/webauthnPageModule.html")
+	require.Nil(t, err)
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	require.True(t, containsWebauthnForm(doc))
+	require.False(t, containsTotpForm(doc, ""))
+
+	params, err := extractWebauthnParameters(doc)
+	require.Nil(t, err)
+
+	require.Equal(t, []string{"pcFg5E6QIk0ZFfJxmf8cfUcb3hirl5Knl8aJ-mjC6MRjVu1dOiBBs51wtjS_O1eP2uiJfGiSL3D8R2cBLnoZyw"}, params.credentialIDs)
+	require.Equal(t, "yS2UgL0Hl0ABjaK9DW4ZqQ", params.challenge)
+	require.Equal(t, "", params.rpID)
+	require.Equal(t, userVerificationRequired, params.userVerification)
+}
+
+func TestClient_postWebauthnFormUserVerificationWithoutFIDO2(t *testing.T) {
+	kc := Client{}
+	params := &webauthnParameters{
+		credentialIDs:    []string{"pcFg5E6QIk0ZFfJxmf8cfUcb3hirl5Knl8aJ-mjC6MRjVu1dOiBBs51wtjS_O1eP2uiJfGiSL3D8R2cBLnoZyw"},
+		challenge:        "yS2UgL0Hl0ABjaK9DW4ZqQ",
+		userVerification: userVerificationRequired,
+	}
+
+	// the tests are built without libfido2, leaving U2F keys which can't verify the user
+	_, err := kc.postWebauthnForm(&authContext{}, "https://id.example.com:8443/realms/users/login-actions/authenticate", params)
+	require.Equal(t, errUserVerificationUnsupported, err)
+	require.Equal(t, "id.example.com", params.rpID)
 }
 
 func TestClient_CustomizeAuthErrorValidator_DefaultSetup(t *testing.T) {
@@ -371,3 +487,116 @@ func TestClient_passwordValid_CustomValidator(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, passwordValid(doc, authErrorValidator), false)
 }
+
+func TestClient_AuthenticateBroker(t *testing.T) {
+	loginPage, err := os.ReadFile("example/loginpage-broker.html")
+	require.Nil(t, err)
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		switch {
+		case r.URL.Path == "/auth/realms/master/protocol/saml/clients/amazon-aws":
+			_, _ = w.Write(loginPage)
+		case r.URL.Path == "/auth/realms/master/broker/corp-adfs/login":
+			require.Equal(t, "YzRkTGxiMXhvNzdG", r.Form.Get("session_code"))
+			_, _ = fmt.Fprintf(w, `<html><body onload="document.forms[0].submit()"><form method="post" action="%s/adfs/ls/"><input type="hidden" name="SAMLRequest" value="kc-request"/><input type="hidden" name="RelayState" value="relay-123"/></form></body></html>`, ts.URL)
+		case r.URL.Path == "/adfs/ls/" && r.Form.Get("SAMLRequest") != "":
+			require.Equal(t, "kc-request", r.Form.Get("SAMLRequest"))
+			_, _ = w.Write([]byte(`<html><body><form id="loginForm" method="post" action="/adfs/ls/?client-request-id=1"><input id="userNameInput" name="UserName" type="email"/><input id="passwordInput" name="Password" type="password"/><input id="optionForms" type="hidden" name="AuthMethod" value="FormsAuthentication"/></form></body></html>`))
+		case r.URL.Path == "/adfs/ls/":
+			require.Equal(t, "test", r.Form.Get("UserName"))
+			require.Equal(t, "test123", r.Form.Get("Password"))
+			_, _ = fmt.Fprintf(w, `<html><body><form method="post" action="%s/auth/realms/master/broker/corp-adfs/endpoint"><input type="hidden" name="SAMLResponse" value="adfs-response"/><input type="hidden" name="RelayState" value="relay-123"/></form></body></html>`, ts.URL)
+		case r.URL.Path == "/auth/realms/master/broker/corp-adfs/endpoint":
+			require.Equal(t, "adfs-response", r.Form.Get("SAMLResponse"))
+			require.Equal(t, "relay-123", r.Form.Get("RelayState"))
+			http.Redirect(w, r, "/auth/realms/master/login-actions/first-broker-login", http.StatusFound)
+		case r.URL.Path == "/auth/realms/master/login-actions/first-broker-login":
+			_, _ = w.Write([]byte(`<html><body><form method="post" action="https://signin.aws.amazon.com/saml"><input type="hidden" name="SAMLResponse" value="aws-response"/></form></body></html>`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	idpAccount := cfg.NewIDPAccount()
+	idpAccount.KCBroker = "corp-adfs"
+	idpAccount.KCBrokerProvider = "ADFS"
+	kc, err := New(idpAccount)
+	require.Nil(t, err)
+
+	loginDetails := &creds.LoginDetails{URL: ts.URL + "/auth/realms/master/protocol/saml/clients/amazon-aws", Username: "test", Password: "test123"}
+
+	samlResponse, err := kc.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.Equal(t, "aws-response", samlResponse)
+}
+
+func TestClient_extractBrokerURL(t *testing.T) {
+	data, err := os.ReadFile("example/loginpage-broker.html")
+	require.Nil(t, err)
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	pageURL, err := url.Parse("https://id.example.com/auth/realms/master/protocol/saml/clients/amazon-aws")
+	require.Nil(t, err)
+
+	brokerURL, err := extractBrokerURL(doc, pageURL, "corp-adfs")
+	require.Nil(t, err)
+	require.Equal(t, "https://id.example.com/auth/realms/master/broker/corp-adfs/login?client_id=urn%3Aamazon%3Awebservices&tab_id=Jq8cCQ5U9aw&session_code=YzRkTGxiMXhvNzdG", brokerURL.String())
+
+	endpointURL, err := brokerEndpointURL(brokerURL)
+	require.Nil(t, err)
+	require.Equal(t, "https://id.example.com/auth/realms/master/broker/corp-adfs/endpoint", endpointURL)
+
+	_, err = extractBrokerURL(doc, pageURL, "corp-okta")
+	require.EqualError(t, err, "no identity provider corp-okta on the KeyCloak login page, expected one of corp-google, corp-adfs")
+}
+
+func TestClient_detectBrokerProvider(t *testing.T) {
+	page := func(rawURL, body string) *http.Response {
+		req, err := http.NewRequest("GET", rawURL, nil)
+		require.Nil(t, err)
+		return &http.Response{Request: req, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	brokerProvider, err := detectBrokerProvider("", page("https://login.microsoftonline.com/tenant/saml2", "$Config={\"pgid\":\"ConvergedSignIn\"}"))
+	require.Nil(t, err)
+	require.Equal(t, brokerProviderAzureAD, brokerProvider)
+
+	brokerProvider, err = detectBrokerProvider("", page("https://fs.example.com/adfs/ls/?SAMLRequest=abc", "<form id=\"loginForm\"></form>"))
+	require.Nil(t, err)
+	require.Equal(t, brokerProviderADFS, brokerProvider)
+
+	// kc_broker_provider wins over what the page looks like
+	brokerProvider, err = detectBrokerProvider(brokerProviderADFS, page("https://sso.example.com/login", ""))
+	require.Nil(t, err)
+	require.Equal(t, brokerProviderADFS, brokerProvider)
+
+	_, err = detectBrokerProvider("", page("https://sso.example.com/login", ""))
+	require.EqualError(t, err, "unable to tell which kind of IdP the KeyCloak broker sent the login to at sso.example.com, set kc_broker_provider to one of ADFS, AzureAD")
+}
+
+func TestClient_redirectRelayState(t *testing.T) {
+	redirected, err := http.NewRequest("GET", "https://fs.example.com/adfs/ls/?SAMLRequest=abc&RelayState=relay-123", nil)
+	require.Nil(t, err)
+	final, err := http.NewRequest("GET", "https://fs.example.com/adfs/ls/?client-request-id=1", nil)
+	require.Nil(t, err)
+	final.Response = &http.Response{Request: redirected}
+
+	require.Equal(t, "relay-123", redirectRelayState(&http.Response{Request: final}))
+
+	final.Response = nil
+	require.Equal(t, "", redirectRelayState(&http.Response{Request: final}))
+}
+
+func TestNew_unsupportedBrokerProvider(t *testing.T) {
+	idpAccount := cfg.NewIDPAccount()
+	idpAccount.KCBroker = "corp-okta"
+	idpAccount.KCBrokerProvider = "Okta"
+
+	_, err := New(idpAccount)
+	require.EqualError(t, err, "unsupported kc_broker_provider Okta, expected one of ADFS, AzureAD")
+}
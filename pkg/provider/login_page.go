@@ -0,0 +1,38 @@
+package provider
+
+import (
+	"github.com/PuerkitoBio/goquery"
+)
+
+// PageMarker something a provider relies on finding on the login page of its IdP
+type PageMarker struct {
+	// Selector the goquery selector matching the marker
+	Selector string
+	// Description names the marker when the page doesn't have it
+	Description string
+}
+
+// LoginPageChecker implemented by providers that scrape the login page at the account URL, listing what they
+// expect to find on it so saml2aws doctor can warn when the IdP's HTML has changed
+type LoginPageChecker interface {
+	LoginPageMarkers() []PageMarker
+}
+
+// MissingMarkers the markers that match nothing in the document
+func MissingMarkers(doc *goquery.Document, markers []PageMarker) []PageMarker {
+	var missing []PageMarker
+	for _, marker := range markers {
+		if doc.Find(marker.Selector).Size() == 0 {
+			missing = append(missing, marker)
+		}
+	}
+	return missing
+}
+
+// UsernamePasswordMarkers the markers of a login page with a form posting a username and password, as the form
+// scraping providers expect
+var UsernamePasswordMarkers = []PageMarker{
+	{Selector: "form[action]", Description: "login form with an action"},
+	{Selector: "input[name*=user], input[name*=User], input[name*=email]", Description: "username field"},
+	{Selector: "input[type=password]", Description: "password field"},
+}
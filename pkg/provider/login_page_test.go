@@ -0,0 +1,23 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingMarkers(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<form action="/login" method="post">
+		<input type="text" name="j_username">
+		<input type="password" name="j_password">
+	</form>`))
+	require.Nil(t, err)
+	require.Empty(t, MissingMarkers(doc, UsernamePasswordMarkers))
+
+	// a sign in page moved to a script rendered app
+	doc, err = goquery.NewDocumentFromReader(strings.NewReader(`<div id="root"></div><script src="/app.js"></script>`))
+	require.Nil(t, err)
+	require.Equal(t, UsernamePasswordMarkers, MissingMarkers(doc, UsernamePasswordMarkers))
+}
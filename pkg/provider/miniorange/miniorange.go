@@ -0,0 +1,201 @@
+package miniorange
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/page"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+// ProviderName constant for miniOrange provider
+const ProviderName = "miniOrange"
+
+// maxPages the most pages followed before giving up
+const maxPages = 10
+
+var logger = logrus.WithField("provider", "miniorange")
+
+// emailAuthTypes the authType of the second factor pages that send the passcode by email, the others show it
+// in an authenticator app
+var emailAuthTypes = map[string]bool{
+	"EMAIL":          true,
+	"OTP_OVER_EMAIL": true,
+}
+
+// Client wrapper around miniOrange enabling authentication and retrieval of assertions
+type Client struct {
+	provider.ValidateBase
+
+	client     *provider.HTTPClient
+	idpAccount *cfg.IDPAccount
+}
+
+// New create a new miniOrange client
+func New(idpAccount *cfg.IDPAccount) (*Client, error) {
+	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
+
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building http client")
+	}
+
+	// assign a response validator to ensure all responses are either success or a redirect
+	client.CheckResponseStatus = provider.SuccessOrRedirectResponseValidator
+
+	return &Client{
+		client:     client,
+		idpAccount: idpAccount,
+	}, nil
+}
+
+// Authenticate logs in to miniOrange and returns the SAML assertion it posts to AWS
+func (mc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	req, err := http.NewRequest("GET", loginDetails.URL, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error building request")
+	}
+
+	// the passcode given on the command line is only good for the first second factor page
+	mfaToken := loginDetails.MFAToken
+
+	for i := 0; i < maxPages; i++ {
+		res, err := mc.client.Do(req)
+		if err != nil {
+			return "", errors.Wrap(err, "error retrieving page")
+		}
+
+		doc, err := goquery.NewDocumentFromReader(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return "", errors.Wrap(err, "failed to build document from response")
+		}
+		doc.Url = res.Request.URL
+
+		if samlResponse, ok := doc.Find("input[name=\"SAMLResponse\"]").Attr("value"); ok {
+			logger.WithField("type", "saml-response").Debug("doc detect")
+			return samlResponse, nil
+		}
+
+		// the login and passcode pages come back with an alert when what was posted is wrong
+		if message := errorMessage(doc); message != "" {
+			if docIsLogin(doc) && !docIsOTP(doc) {
+				return "", provider.InvalidCredentials("miniOrange login failed: %s", message)
+			}
+			return "", errors.Errorf("miniOrange login failed: %s", message)
+		}
+
+		switch {
+		case docIsOTP(doc):
+			logger.WithField("type", "otp").Debug("doc detect")
+			req, err = handleOTP(loginDetails.Asker(), doc, mfaToken)
+			mfaToken = ""
+		case docIsLogin(doc):
+			logger.WithField("type", "login").Debug("doc detect")
+			req, err = handleLogin(doc, loginDetails)
+		case docIsAutoSubmit(doc):
+			logger.WithField("type", "auto-submit").Debug("doc detect")
+			req, err = buildFormRequest(doc, "form")
+		default:
+			html, _ := doc.Selection.Html()
+			logger.WithField("doc", html).Debug("Unknown document type")
+			return "", errors.Errorf("unknown document type at %s", doc.Url)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "", errors.New("too many pages without reaching a SAML response")
+}
+
+func handleLogin(doc *goquery.Document, loginDetails *creds.LoginDetails) (*http.Request, error) {
+	form, err := page.NewFormFromDocument(doc, "form:has(input[name=\"username\"]), form:has(input[name=\"password\"])")
+	if err != nil {
+		return nil, errors.Wrap(err, "error extracting login form")
+	}
+
+	// the username and password may be asked for on one page or on two
+	if doc.Find("input[name=\"username\"]").Size() > 0 {
+		form.Values.Set("username", loginDetails.Username)
+	}
+	if doc.Find("input[name=\"password\"]").Size() > 0 {
+		form.Values.Set("password", loginDetails.Password)
+	}
+	form.URL = resolveURL(doc.Url, form.URL)
+
+	return form.BuildRequest()
+}
+
+// handleOTP answers the second factor page with the passcode sent by email or shown in the authenticator app
+func handleOTP(ask prompter.Asker, doc *goquery.Document, mfaToken string) (*http.Request, error) {
+	form, err := page.NewFormFromDocument(doc, "form:has(input[name=\"otpToken\"])")
+	if err != nil {
+		return nil, errors.Wrap(err, "error extracting passcode form")
+	}
+
+	if mfaToken == "" {
+		authType, _ := doc.Find("input[name=\"authType\"]").Attr("value")
+		if emailAuthTypes[strings.ToUpper(authType)] {
+			log.Println("miniOrange sent a one time passcode to your email.")
+		} else {
+			log.Println("Enter the passcode shown in your authenticator app.")
+		}
+		mfaToken = ask.RequestSecurityCode("000000")
+	}
+
+	form.Values.Set("otpToken", mfaToken)
+	form.URL = resolveURL(doc.Url, form.URL)
+
+	return form.BuildRequest()
+}
+
+func buildFormRequest(doc *goquery.Document, selector string) (*http.Request, error) {
+	form, err := page.NewFormFromDocument(doc, selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "error extracting form")
+	}
+	form.URL = resolveURL(doc.Url, form.URL)
+	return form.BuildRequest()
+}
+
+// resolveURL resolves a form action against the page it came from
+func resolveURL(base *url.URL, ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+func errorMessage(doc *goquery.Document) string {
+	return strings.TrimSpace(doc.Find(".alert-danger, #errorMsg").First().Text())
+}
+
+func docIsLogin(doc *goquery.Document) bool {
+	return doc.Find("form input[name=\"username\"], form input[name=\"password\"]").Size() > 0
+}
+
+func docIsOTP(doc *goquery.Document) bool {
+	return doc.Find("form input[name=\"otpToken\"]").Size() > 0
+}
+
+// docIsAutoSubmit a form of hidden fields the page's script posts straight away
+func docIsAutoSubmit(doc *goquery.Document) bool {
+	form := doc.Find("form").First()
+	method, _ := form.Attr("method")
+	return strings.EqualFold(method, "post") && form.Find("input:not([type=\"hidden\"]):not([type=\"submit\"])").Size() == 0
+}
@@ -0,0 +1,131 @@
+package miniorange
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+var docTests = []struct {
+	fn       func(*goquery.Document) bool
+	file     string
+	expected bool
+}{
+	{docIsLogin, "example/login.html", true},
+	{docIsLogin, "example/otp_email.html", false},
+	{docIsLogin, "example/saml_response.html", false},
+	{docIsOTP, "example/login.html", false},
+	{docIsOTP, "example/otp_email.html", true},
+	{docIsOTP, "example/otp_totp.html", true},
+	{docIsAutoSubmit, "example/login.html", false},
+	{docIsAutoSubmit, "example/otp_totp.html", false},
+	{docIsAutoSubmit, "example/saml_response.html", true},
+}
+
+func TestDocTypes(t *testing.T) {
+	for _, tt := range docTests {
+		data, err := os.ReadFile(tt.file)
+		require.Nil(t, err)
+
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+		require.Nil(t, err)
+
+		require.Equal(t, tt.expected, tt.fn(doc), "%s of %s", "doc type", tt.file)
+	}
+}
+
+// newMiniOrangeServer serves the recorded login pages, answering the login with loginPage and the passcode with
+// otpPage
+func newMiniOrangeServer(t *testing.T, loginPage, otpPage string) (*httptest.Server, map[string]url.Values) {
+	forms := map[string]url.Values{}
+
+	serve := func(file string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			require.Nil(t, r.ParseForm())
+			forms[r.URL.Path] = r.Form
+			http.ServeFile(w, r, file)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/moas/broker/login/saml/123456/amazon_web_services", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/moas/idp/login", http.StatusFound)
+	})
+	mux.Handle("/moas/idp/login", serve("example/login.html"))
+	mux.Handle("/moas/login", serve(loginPage))
+	mux.Handle("/moas/login/validateotp", serve(otpPage))
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, forms
+}
+
+func TestAuthenticateEmailOTP(t *testing.T) {
+	server, forms := newMiniOrangeServer(t, "example/otp_email.html", "example/saml_response.html")
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("RequestSecurityCode", "000000").Return("123456")
+
+	client, err := New(&cfg.IDPAccount{MFA: "Auto"})
+	require.Nil(t, err)
+
+	loginDetails := &creds.LoginDetails{URL: server.URL + "/moas/broker/login/saml/123456/amazon_web_services", Username: "user@example.com", Password: "secret"}
+	samlResponse, err := client.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.Equal(t, "PHNhbWxwOlJlc3BvbnNlPjwvc2FtbHA6UmVzcG9uc2U+", samlResponse)
+
+	require.Equal(t, "user@example.com", forms["/moas/login"].Get("username"))
+	require.Equal(t, "secret", forms["/moas/login"].Get("password"))
+	require.Equal(t, "123456", forms["/moas/login"].Get("customerId"))
+	require.Equal(t, "123456", forms["/moas/login/validateotp"].Get("otpToken"))
+	require.Equal(t, "email-tx", forms["/moas/login/validateotp"].Get("txId"))
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestAuthenticateTOTPFromFlag(t *testing.T) {
+	server, forms := newMiniOrangeServer(t, "example/otp_totp.html", "example/saml_response.html")
+
+	client, err := New(&cfg.IDPAccount{MFA: "Auto"})
+	require.Nil(t, err)
+
+	loginDetails := &creds.LoginDetails{URL: server.URL + "/moas/broker/login/saml/123456/amazon_web_services", Username: "user@example.com", Password: "secret", MFAToken: "654321"}
+	_, err = client.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.Equal(t, "654321", forms["/moas/login/validateotp"].Get("otpToken"))
+}
+
+func TestAuthenticateInvalidPassword(t *testing.T) {
+	server, _ := newMiniOrangeServer(t, "example/login_error.html", "example/saml_response.html")
+
+	client, err := New(&cfg.IDPAccount{MFA: "Auto"})
+	require.Nil(t, err)
+
+	loginDetails := &creds.LoginDetails{URL: server.URL + "/moas/broker/login/saml/123456/amazon_web_services", Username: "user@example.com", Password: "wrong"}
+	_, err = client.Authenticate(loginDetails)
+	require.EqualError(t, err, "miniOrange login failed: Invalid username or password.")
+	require.ErrorIs(t, err, provider.ErrInvalidCredentials)
+}
+
+func TestAuthenticateInvalidOTP(t *testing.T) {
+	server, _ := newMiniOrangeServer(t, "example/otp_totp.html", "example/otp_error.html")
+
+	client, err := New(&cfg.IDPAccount{MFA: "Auto"})
+	require.Nil(t, err)
+
+	loginDetails := &creds.LoginDetails{URL: server.URL + "/moas/broker/login/saml/123456/amazon_web_services", Username: "user@example.com", Password: "secret", MFAToken: "000000"}
+	_, err = client.Authenticate(loginDetails)
+	require.EqualError(t, err, "miniOrange login failed: Invalid OTP. Please try again.")
+	require.NotErrorIs(t, err, provider.ErrInvalidCredentials)
+}
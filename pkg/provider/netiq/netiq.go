@@ -2,6 +2,7 @@ package netiq
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -10,6 +11,7 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/page"
@@ -19,6 +21,19 @@ import (
 
 var logger = logrus.WithField("provider", "NetIQ")
 
+// The method classes of a NetIQ contract saml2aws can answer
+const (
+	MethodPassword = "NPassword"
+	MethodTOTP     = "TOTP"
+	MethodRADIUS   = "RADIUS"
+)
+
+var supportedMethods = map[string]bool{
+	MethodPassword: true,
+	MethodTOTP:     true,
+	MethodRADIUS:   true,
+}
+
 type Client struct {
 	provider.ValidateBase
 
@@ -29,7 +44,12 @@ type Client struct {
 // New creates a new external client
 func New(idpAccount *cfg.IDPAccount, mfa string) (*Client, error) {
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error building HTTP client")
 	}
@@ -52,6 +72,17 @@ func (nc *Client) follow(req *http.Request, loginDetails *creds.LoginDetails) (s
 	if err != nil {
 		return "", errors.Wrap(err, "Failed to perform http request to "+req.URL.String())
 	}
+	defer resp.Body.Close()
+
+	// contracts with several methods describe the step in JSON rather than a login page
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read response")
+		}
+		return nc.followJSON(string(body), resp.Request.URL, loginDetails)
+	}
+
 	doc, err := goquery.NewDocumentFromReader(resp.Body)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to build document from response")
@@ -61,7 +92,7 @@ func (nc *Client) follow(req *http.Request, loginDetails *creds.LoginDetails) (s
 	} else if resourcePath, isGetToContext := extractGetToContentUrl(doc); isGetToContext {
 		loginUrl, err := getLoginUrl(nc.MFA, loginDetails.URL, resourcePath)
 		if err != nil {
-			return "", errors.Wrap(err, "MFA option unsupported. Valid MFA options are: Auto or Privileged")
+			return "", errors.Wrap(err, "MFA option unsupported. Valid MFA options are: Auto, Privileged, TOTP or RADIUS")
 		}
 		newReq, err := buildGetToContentRequest(loginUrl + "&uiDestination=contentDiv")
 		if err != nil {
@@ -83,7 +114,7 @@ func (nc *Client) follow(req *http.Request, loginDetails *creds.LoginDetails) (s
 		}
 		return nc.follow(newReq, loginDetails)
 	} else if form, isIDPLoginRsa := extractIDPLoginRsa(doc); isIDPLoginRsa {
-		token := prompter.StringRequired("Enter concatenated pin and token")
+		token := loginDetails.Asker().StringRequired("Enter concatenated pin and token")
 		form.Values.Set("Ecom_User_ID", loginDetails.Username)
 		form.Values.Set("Ecom_Token", token)
 		newReq, err := form.BuildRequest()
@@ -96,6 +127,120 @@ func (nc *Client) follow(req *http.Request, loginDetails *creds.LoginDetails) (s
 	}
 }
 
+// followJSON answers a JSON step of the login: picks one of the methods offered, or answers a RADIUS challenge
+func (nc *Client) followJSON(body string, stepURL *url.URL, loginDetails *creds.LoginDetails) (string, error) {
+	logDocDetected("json", body)
+
+	if message := gjson.Get(body, "error").String(); message != "" {
+		return "", errors.Errorf("NetIQ rejected the login: %s", message)
+	}
+
+	form, err := jsonStepForm(body, stepURL, loginDetails.Username)
+	if err != nil {
+		return "", err
+	}
+
+	if challenge := gjson.Get(body, "challenge"); challenge.Exists() {
+		// RADIUS replies with a challenge, such as a code sent by SMS, until the server accepts the answers
+		message := challenge.Get("message").String()
+		if message == "" {
+			message = "Enter RADIUS challenge response"
+		}
+		form.Values.Set("methodClass", MethodRADIUS)
+		form.Values.Set("Ecom_Token", loginDetails.Asker().StringRequired(message))
+		form.Values.Set("radiusState", challenge.Get("state").String())
+		return nc.submit(form, loginDetails)
+	}
+
+	if !gjson.Get(body, "methods").Exists() {
+		return "", errors.New("NetIQ response offers neither methods nor a challenge")
+	}
+
+	var classes []string
+	for _, method := range gjson.Get(body, "methods.#.class").Array() {
+		classes = append(classes, method.String())
+	}
+	method, err := selectMethod(loginDetails.Asker(), nc.MFA, classes)
+	if err != nil {
+		return "", err
+	}
+
+	form.Values.Set("methodClass", method)
+	switch method {
+	case MethodPassword:
+		form.Values.Set("Ecom_Password", loginDetails.Password)
+	case MethodTOTP:
+		token := loginDetails.MFAToken
+		if token == "" {
+			token = loginDetails.Asker().RequestSecurityCode("000000")
+		}
+		form.Values.Set("Ecom_Token", token)
+	case MethodRADIUS:
+		form.Values.Set("Ecom_Token", loginDetails.Asker().StringRequired("Enter RADIUS passcode"))
+	}
+	return nc.submit(form, loginDetails)
+}
+
+func (nc *Client) submit(form *page.Form, loginDetails *creds.LoginDetails) (string, error) {
+	req, err := form.BuildRequest()
+	if err != nil {
+		return "", errors.Wrap(err, "Error building request")
+	}
+	return nc.follow(req, loginDetails)
+}
+
+// jsonStepForm the form answering a JSON step, posted to its action
+func jsonStepForm(body string, stepURL *url.URL, username string) (*page.Form, error) {
+	action, err := url.Parse(gjson.Get(body, "action").String())
+	if err != nil || action.String() == "" {
+		return nil, errors.New("NetIQ response has no action to post the answer to")
+	}
+
+	values := &url.Values{}
+	values.Set("option", "credential")
+	values.Set("Ecom_User_ID", username)
+	return &page.Form{
+		URL:    stepURL.ResolveReference(action).String(),
+		Method: "POST",
+		Values: values,
+	}, nil
+}
+
+// selectMethod the method class the MFA of the account names, the only method offered, or the one the user
+// picks, listing the offered classes when none of them can be used
+func selectMethod(ask prompter.Asker, mfa string, classes []string) (string, error) {
+	var supported []string
+	for _, class := range classes {
+		if supportedMethods[class] {
+			supported = append(supported, class)
+		}
+	}
+
+	switch mfa {
+	case MethodTOTP, MethodRADIUS:
+		for _, class := range supported {
+			if class == mfa {
+				return class, nil
+			}
+		}
+		// the password comes before the second factor
+		for _, class := range supported {
+			if class == MethodPassword {
+				return class, nil
+			}
+		}
+		return "", errors.Errorf("NetIQ didn't offer %s, the methods offered are: %s", mfa, strings.Join(classes, ", "))
+	}
+
+	switch len(supported) {
+	case 0:
+		return "", errors.Errorf("NetIQ offered unsupported methods: %s, saml2aws supports %s, %s and %s", strings.Join(classes, ", "), MethodPassword, MethodTOTP, MethodRADIUS)
+	case 1:
+		return supported[0], nil
+	}
+	return supported[ask.Choose("Select a NetIQ authentication method", supported)], nil
+}
+
 func isSAMLResponse(doc *goquery.Document) bool {
 	return doc.Find("input[name=\"SAMLResponse\"]").Size() == 1
 }
@@ -105,7 +250,7 @@ func extractSAMLAssertion(doc *goquery.Document) (string, error) {
 	if !ok {
 		return "", fmt.Errorf("no SAML assertion in response")
 	}
-	logDocDetected("samlResponse", samlAssertion)
+	logDocDetected("samlResponse", fmt.Sprintf("%d bytes", len(samlAssertion)))
 	return samlAssertion, nil
 }
 
@@ -192,7 +337,7 @@ func logDocDetected(docType string, data string) {
 
 func getLoginUrl(mfa string, baseUrl string, defaultResourcePath string) (string, error) {
 	var loginUrl string
-	if mfa == "Auto" {
+	if mfa == "Auto" || mfa == MethodTOTP || mfa == MethodRADIUS {
 		loginUrl = baseUrl + defaultResourcePath
 	} else if mfa == "Privileged" {
 		// Privileged account skip MFA and have different login URL
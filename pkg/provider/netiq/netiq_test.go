@@ -2,13 +2,19 @@ package netiq
 
 import (
 	"bytes"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"testing"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/page"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
 )
 
 func TestIsSAMLResponsePositive(t *testing.T) {
@@ -279,3 +285,112 @@ func TestUnsupportedMFA(t *testing.T) {
 	//then
 	require.EqualError(t, err, expectedErrorString)
 }
+
+// newMethodServer serves a contract that asks for the password, then offers TOTP and RADIUS, with RADIUS
+// replying with one challenge
+func newMethodServer(t *testing.T, forms *[]url.Values) *httptest.Server {
+	writeJSON := func(w http.ResponseWriter, body string) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		if r.Method == "POST" {
+			*forms = append(*forms, r.PostForm)
+		}
+
+		switch {
+		case r.Method == "GET":
+			writeJSON(w, `{"action": "/nidp/app/login?sid=1", "methods": [{"class": "NPassword"}]}`)
+		case r.PostForm.Get("methodClass") == "NPassword":
+			writeJSON(w, `{"action": "/nidp/app/login?sid=1", "methods": [{"class": "TOTP"}, {"class": "RADIUS"}, {"class": "Smartcard"}]}`)
+		case r.PostForm.Get("methodClass") == "RADIUS" && r.PostForm.Get("radiusState") == "":
+			writeJSON(w, `{"action": "/nidp/app/login?sid=1", "challenge": {"message": "Enter the code sent to your phone", "state": "state-1"}}`)
+		case r.PostForm.Get("Ecom_Token") == "wrong":
+			writeJSON(w, `{"error": "The code entered is incorrect"}`)
+		default:
+			_, _ = w.Write([]byte(`<html><body><form><input type="hidden" name="SAMLResponse" value="PHNhbWxwOlJlc3BvbnNlPjwvc2FtbHA6UmVzcG9uc2U+"></form></body></html>`))
+		}
+	}))
+}
+
+func TestAuthenticateTOTP(t *testing.T) {
+	var forms []url.Values
+	ts := newMethodServer(t, &forms)
+	defer ts.Close()
+
+	nc, err := New(&cfg.IDPAccount{}, "TOTP")
+	require.Nil(t, err)
+
+	samlAssertion, err := nc.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "user", Password: "secret", MFAToken: "123456"})
+	require.Nil(t, err)
+	require.Equal(t, "PHNhbWxwOlJlc3BvbnNlPjwvc2FtbHA6UmVzcG9uc2U+", samlAssertion)
+
+	require.Len(t, forms, 2)
+	require.Equal(t, "secret", forms[0].Get("Ecom_Password"))
+	require.Equal(t, "TOTP", forms[1].Get("methodClass"))
+	require.Equal(t, "123456", forms[1].Get("Ecom_Token"))
+	require.Equal(t, "user", forms[1].Get("Ecom_User_ID"))
+}
+
+func TestAuthenticateRADIUSChallenge(t *testing.T) {
+	var forms []url.Values
+	ts := newMethodServer(t, &forms)
+	defer ts.Close()
+
+	nc, err := New(&cfg.IDPAccount{}, "RADIUS")
+	require.Nil(t, err)
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("StringRequired", "Enter RADIUS passcode").Return("1234567890")
+	pr.Mock.On("StringRequired", "Enter the code sent to your phone").Return("4242")
+
+	samlAssertion, err := nc.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "user", Password: "secret"})
+	require.Nil(t, err)
+	require.Equal(t, "PHNhbWxwOlJlc3BvbnNlPjwvc2FtbHA6UmVzcG9uc2U+", samlAssertion)
+
+	require.Len(t, forms, 3)
+	require.Equal(t, "1234567890", forms[1].Get("Ecom_Token"))
+	require.Equal(t, "4242", forms[2].Get("Ecom_Token"))
+	require.Equal(t, "state-1", forms[2].Get("radiusState"))
+	pr.Mock.AssertExpectations(t)
+}
+
+func TestAuthenticateRejected(t *testing.T) {
+	var forms []url.Values
+	ts := newMethodServer(t, &forms)
+	defer ts.Close()
+
+	nc, err := New(&cfg.IDPAccount{}, "TOTP")
+	require.Nil(t, err)
+
+	_, err = nc.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "user", Password: "secret", MFAToken: "wrong"})
+	require.EqualError(t, err, "NetIQ rejected the login: The code entered is incorrect")
+}
+
+func TestSelectMethod(t *testing.T) {
+	method, err := selectMethod(prompter.Asker{}, "Auto", []string{"NPassword"})
+	require.Nil(t, err)
+	require.Equal(t, "NPassword", method)
+
+	method, err = selectMethod(prompter.Asker{}, "RADIUS", []string{"TOTP", "RADIUS"})
+	require.Nil(t, err)
+	require.Equal(t, "RADIUS", method)
+
+	_, err = selectMethod(prompter.Asker{}, "RADIUS", []string{"TOTP", "Smartcard"})
+	require.EqualError(t, err, "NetIQ didn't offer RADIUS, the methods offered are: TOTP, Smartcard")
+
+	_, err = selectMethod(prompter.Asker{}, "Auto", []string{"Smartcard", "FIDO2"})
+	require.EqualError(t, err, "NetIQ offered unsupported methods: Smartcard, FIDO2, saml2aws supports NPassword, TOTP and RADIUS")
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Choose", "Select a NetIQ authentication method", []string{"TOTP", "RADIUS"}).Return(1)
+
+	method, err = selectMethod(prompter.Asker{}, "Auto", []string{"TOTP", "Smartcard", "RADIUS"})
+	require.Nil(t, err)
+	require.Equal(t, "RADIUS", method)
+	pr.Mock.AssertExpectations(t)
+}
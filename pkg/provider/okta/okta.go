@@ -43,10 +43,41 @@ const (
 	IdentifierSymantecTotpMfa = "SYMANTEC TOKEN"
 	IdentifierFIDOWebAuthn    = "FIDO WEBAUTHN"
 	IdentifierYubiMfa         = "YUBICO TOKEN:HARDWARE"
+
+	// MfaWebAuthn selects the FIDO WebAuthn factor
+	MfaWebAuthn = "WEBAUTHN"
 )
 
 var logger = logrus.WithField("provider", "okta")
 
+const (
+	// DefaultPushPollInterval how often to check whether a push has been answered
+	DefaultPushPollInterval = 3 * time.Second
+
+	// DefaultPushTimeout how long to wait for a push to be answered, Okta expires it after 5 minutes
+	DefaultPushTimeout = 5 * time.Minute
+)
+
+var (
+	errMfaTimeout  = &MfaTimeoutError{}
+	errMfaRejected = errors.New("MFA rejected by user")
+
+	// errNoSecurityKey returned by the FIDO MFAs when no security key is plugged in
+	errNoSecurityKey = errors.New("no FIDO security key found, plug one in or configure mfa_fallback to use another MFA")
+)
+
+// MfaTimeoutError returned when the MFA wasn't answered in time, logging in again sends a new one
+type MfaTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *MfaTimeoutError) Error() string {
+	if e.Timeout == 0 {
+		return "User did not accept MFA in time"
+	}
+	return fmt.Sprintf("User did not accept MFA within %s", e.Timeout)
+}
+
 var (
 	supportedMfaOptions = map[string]string{
 		IdentifierDuoMfa:          "DUO MFA authentication",
@@ -67,9 +98,18 @@ type Client struct {
 
 	client          *provider.HTTPClient
 	mfa             string
+	mfaFallback     []string
 	targetURL       string
 	disableSessions bool
 	rememberDevice  bool
+
+	pushPollInterval time.Duration // zero uses DefaultPushPollInterval
+	pushTimeout      time.Duration // zero uses DefaultPushTimeout
+
+	deviceStatePath string // empty when the device token isn't kept between logins
+	deviceToken     string
+
+	ask prompter.Asker // asks the user through the prompter of the login being authenticated
 }
 
 // AuthRequest represents an mfa okta request
@@ -108,7 +148,12 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -135,12 +180,24 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 	logger.Debugf("okta | disableSessions: %v", disableSessions)
 	logger.Debugf("okta | rememberDevice: %v", rememberDevice)
 
+	var statePath string
+	if !idpAccount.DisableDeviceToken && idpAccount.Name != "" {
+		statePath, err = DeviceStatePath(idpAccount.Name)
+		if err != nil {
+			logger.WithError(err).Debug("unable to locate okta device state")
+		}
+	}
+
 	return &Client{
-		client:          client,
-		mfa:             idpAccount.MFA,
-		targetURL:       idpAccount.TargetURL,
-		disableSessions: disableSessions,
-		rememberDevice:  rememberDevice,
+		client:           client,
+		mfa:              idpAccount.MFA,
+		mfaFallback:      idpAccount.MFAFallbackMethods(),
+		targetURL:        idpAccount.TargetURL,
+		disableSessions:  disableSessions,
+		rememberDevice:   rememberDevice,
+		pushPollInterval: time.Duration(idpAccount.OktaPushPollInterval) * time.Second,
+		pushTimeout:      time.Duration(idpAccount.OktaPushTimeout) * time.Second,
+		deviceStatePath:  statePath,
 	}, nil
 }
 
@@ -299,7 +356,7 @@ func (oc *Client) authWithSession(loginDetails *creds.LoginDetails) (string, err
 	if err != nil {
 		modifiedLoginDetails := loginDetails
 		modifiedLoginDetails.OktaSessionCookie = ""
-		return oc.Authenticate(modifiedLoginDetails)
+		return oc.authenticate(modifiedLoginDetails)
 	}
 
 	req, err := http.NewRequest("GET", loginDetails.URL, nil)
@@ -331,7 +388,7 @@ func (oc *Client) authWithSession(loginDetails *creds.LoginDetails) (string, err
 			return "", errors.Wrap(err, "error retrieving saml response")
 		}
 		loginDetails.StateToken = stateToken
-		return oc.Authenticate(loginDetails)
+		return oc.authenticate(loginDetails)
 	}
 
 	return oc.follow(ctx, req, loginDetails)
@@ -388,6 +445,9 @@ func (oc *Client) setDeviceTokenCookie(loginDetails *creds.LoginDetails) error {
 		Expires: time.Now().Add(time.Hour * 24 * 30),                    // 30 Days -> this time might not matter as this cookie is set on every saml2aws login request
 		Value:   fmt.Sprintf("okta_%s_saml2aws", loginDetails.Username), // Okta recommends using an UUID but this should be unique enough. Also, this is key to remembering Okta MFA device
 	}
+	if oc.deviceToken != "" {
+		cookie.Value = oc.deviceToken // the device token Okta handed out on the last login
+	}
 	cookies = append(cookies, &cookie)
 	oc.client.Jar.SetCookies(baseURL, cookies)
 
@@ -437,6 +497,11 @@ func (oc *Client) primaryAuth(loginDetails *creds.LoginDetails) (string, string,
 
 	resp := string(body)
 
+	// E0000004 is Okta's "Authentication failed", anything else on a 401 isn't about the password
+	if res.StatusCode == http.StatusUnauthorized && gjson.Get(resp, "errorCode").String() == "E0000004" {
+		return "", "", "", provider.InvalidCredentials("Okta rejected the username or password")
+	}
+
 	authStatus := gjson.Get(resp, "status").String()
 	oktaSessionToken := gjson.Get(resp, "sessionToken").String()
 
@@ -445,6 +510,22 @@ func (oc *Client) primaryAuth(loginDetails *creds.LoginDetails) (string, string,
 
 // Authenticate logs into Okta and returns a SAML response
 func (oc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	oc.ask = loginDetails.Asker()
+
+	// Replay the device token and session of the last login, Okta skips MFA for a device it knows
+	oc.restoreDeviceState(loginDetails)
+
+	samlAssertion, err := oc.authenticate(loginDetails)
+	if err != nil {
+		return "", err
+	}
+
+	oc.storeDeviceState(loginDetails)
+
+	return samlAssertion, nil
+}
+
+func (oc *Client) authenticate(loginDetails *creds.LoginDetails) (string, error) {
 
 	// Set Okta device token
 	err := oc.setDeviceTokenCookie(loginDetails)
@@ -473,6 +554,11 @@ func (oc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 
 	oktaOrgHost := oktaURL.Host
 
+	// Identity Engine orgs don't take the classic authn API
+	if loginDetails.StateToken == "" && oc.usesIdentityEngine(oktaOrgHost) {
+		return oc.authenticateIdx(loginDetails)
+	}
+
 	authStatus, oktaSessionToken, primaryAuthResp, err := oc.primaryAuth(loginDetails)
 	if err != nil {
 		return "", err
@@ -566,7 +652,7 @@ func (oc *Client) follow(ctx context.Context, req *http.Request, loginDetails *c
 			return "", errors.Wrap(err, "failed to getStateToken")
 		}
 		loginDetails.StateToken = stateToken
-		return oc.Authenticate(loginDetails)
+		return oc.authenticate(loginDetails)
 	}
 
 	if handler == nil {
@@ -687,13 +773,93 @@ func findMfaOption(mfa string, mfaOptions []string, startAtIdx int) int {
 		if startAtIdx > idx {
 			continue
 		}
-		if strings.HasPrefix(strings.ToUpper(val), mfa) {
+		if strings.HasPrefix(strings.ToUpper(val), mfaOptionPrefix(mfa)) {
 			return idx
 		}
 	}
 	return 0
 }
 
+// verifyPush polls the push until it is answered, showing the number to pick when Okta Verify asks for one
+func verifyPush(oc *Client, mfaOption int, resp, body string) (string, error) {
+
+	pollInterval, timeout := oc.pushPollInterval, oc.pushTimeout
+	if pollInterval <= 0 {
+		pollInterval = DefaultPushPollInterval
+	}
+	if timeout <= 0 {
+		timeout = DefaultPushTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	shownAnswer := ""
+	showCorrectAnswer := func(body string) {
+		correctAnswer := gjson.Get(body, "_embedded.factor._embedded.challenge.correctAnswer").String()
+		if correctAnswer != "" && correctAnswer != shownAnswer {
+			log.Println("")
+			log.Printf("  ==> Select %s in Okta Verify", correctAnswer)
+			log.Println("")
+			shownAnswer = correctAnswer
+		}
+	}
+
+	showCorrectAnswer(body)
+	log.Println("Waiting for approval, please check your Okta Verify app ...")
+
+	// loop until success, error, or timeout
+	for {
+		// on 'success' status
+		if gjson.Get(body, "status").String() == "SUCCESS" {
+			log.Println(" Approved")
+			logger.Debugf("func verifyMfa | okta exiry: %s", gjson.Get(body, "expiresAt").String()) // DEBUG
+			return gjson.Get(body, "sessionToken").String(), nil
+		}
+
+		// otherwise probably still waiting
+		switch gjson.Get(body, "factorResult").String() {
+
+		case "WAITING":
+			if time.Now().Add(pollInterval).After(deadline) {
+				log.Println(" Timeout")
+				return "", &MfaTimeoutError{Timeout: timeout}
+			}
+			time.Sleep(pollInterval)
+			logger.Debug("Waiting for user to authorize login")
+			updatedContext, err := getMfaChallengeContext(oc, mfaOption, resp)
+			if err != nil {
+				return "", err
+			}
+			body = updatedContext.challengeResponseBody
+			if gjson.Get(body, "status").String() == "MFA_CHALLENGE" {
+				showCorrectAnswer(body)
+			}
+
+		case "TIMEOUT":
+			log.Println(" Timeout")
+			return "", errMfaTimeout
+
+		case "REJECTED":
+			log.Println(" Rejected")
+			return "", errMfaRejected
+
+		default:
+			log.Println(" Error")
+			return "", errors.New("Unsupported response from Okta, please raise ticket with saml2aws")
+
+		}
+
+	}
+}
+
+// mfaOptionPrefix the start of the MFA options the configured MFA picks, MFA=WEBAUTHN is a clearer name for
+// the FIDO WebAuthn factor
+func mfaOptionPrefix(mfa string) string {
+	if strings.ToUpper(mfa) == MfaWebAuthn {
+		return IdentifierFIDOWebAuthn
+	}
+	return mfa
+}
+
 func getMfaChallengeContext(oc *Client, mfaOption int, resp string) (*mfaChallengeContext, error) {
 	stateToken := gjson.Get(resp, "stateToken").String()
 	factorID := gjson.Get(resp, fmt.Sprintf("_embedded.factors.%d.id", mfaOption)).String()
@@ -724,7 +890,7 @@ func getMfaChallengeContext(oc *Client, mfaOption int, resp string) (*mfaChallen
 	// yay
 	switch mfa := mfaIdentifer; mfa {
 	case IdentifierYubiMfa:
-		verifyCode := prompter.Password("Press the button on your yubikey")
+		verifyCode := oc.ask.Password("Press the button on your yubikey")
 		verifyReq.PassCode = verifyCode
 	}
 
@@ -760,6 +926,41 @@ func getMfaChallengeContext(oc *Client, mfaOption int, resp string) (*mfaChallen
 }
 
 func verifyMfa(oc *Client, oktaOrgHost string, loginDetails *creds.LoginDetails, resp string) (string, error) {
+	if len(oc.mfaFallback) == 0 {
+		return verifyMfaMethod(oc, oktaOrgHost, loginDetails, resp)
+	}
+
+	// each attempt runs with oc.mfa set to the method being tried
+	configuredMfa := oc.mfa
+	defer func() { oc.mfa = configuredMfa }()
+
+	var err error
+	for _, mfa := range append([]string{configuredMfa}, oc.mfaFallback...) {
+		oc.mfa = mfa
+		log.Printf("Attempting %s MFA ...", mfa)
+
+		var sessionToken string
+		sessionToken, err = verifyMfaMethod(oc, oktaOrgHost, loginDetails, resp)
+		if err == nil {
+			return sessionToken, nil
+		}
+		if !canFallback(err) {
+			return "", err
+		}
+		logger.WithField("mfa", mfa).WithError(err).Debug("MFA failed, trying next method")
+	}
+
+	return "", errors.Wrap(err, "tried all MFA methods")
+}
+
+// canFallback whether the next of the mfa_fallback methods is tried after the error, which is when the MFA
+// timed out, was rejected or its security key isn't plugged in
+func canFallback(err error) bool {
+	var timeoutErr *MfaTimeoutError
+	return errors.As(err, &timeoutErr) || err == errMfaRejected || errors.Is(err, errNoSecurityKey)
+}
+
+func verifyMfaMethod(oc *Client, oktaOrgHost string, loginDetails *creds.LoginDetails, resp string) (string, error) {
 	stateToken := gjson.Get(resp, "stateToken").String()
 
 	// choose an mfa option if there are multiple enabled
@@ -786,13 +987,13 @@ func verifyMfa(oc *Client, oktaOrgHost string, loginDetails *creds.LoginDetails,
 		// Collect all options that match the chosen MFA
 		// It will be more than 1 when there's multiple MFA of the same type configured - e.g.: multiple FIDO methods
 		for _, option := range mfaOptions {
-			if strings.HasPrefix(strings.ToUpper(option), oc.mfa) {
+			if strings.HasPrefix(strings.ToUpper(option), mfaOptionPrefix(oc.mfa)) {
 				mfaOptionsMatches = append(mfaOptionsMatches, option)
 			}
 		}
 		// If multiple MFA of the same type are found, we prompt the user to pick which one to use
 		if len(mfaOptionsMatches) > 1 {
-			matchOptionIndex := prompter.Choose(fmt.Sprintf("Multiple %s MFA options found. Select which MFA option to use", oc.mfa), mfaOptionsMatches)
+			matchOptionIndex := oc.ask.Choose(fmt.Sprintf("Multiple %s MFA options found. Select which MFA option to use", oc.mfa), mfaOptionsMatches)
 			for i := range mfaOptions {
 				if mfaOptions[i] == mfaOptionsMatches[matchOptionIndex] {
 					mfaOption = i
@@ -802,7 +1003,7 @@ func verifyMfa(oc *Client, oktaOrgHost string, loginDetails *creds.LoginDetails,
 			mfaOption = findMfaOption(oc.mfa, mfaOptions, 0)
 		}
 	} else if len(mfaOptions) > 1 {
-		mfaOption = prompter.Choose("Select which MFA option to use", mfaOptions)
+		mfaOption = oc.ask.Choose("Select which MFA option to use", mfaOptions)
 	}
 
 	challengeContext, err := getMfaChallengeContext(oc, mfaOption, resp)
@@ -816,7 +1017,7 @@ func verifyMfa(oc *Client, oktaOrgHost string, loginDetails *creds.LoginDetails,
 	case IdentifierSmsMfa, IdentifierEmailMfa, IdentifierTotpMfa, IdentifierOktaTotpMfa, IdentifierSymantecTotpMfa:
 		var verifyCode = loginDetails.MFAToken
 		if verifyCode == "" {
-			verifyCode = prompter.RequestSecurityCode("000000")
+			verifyCode = oc.ask.RequestSecurityCode("000000")
 		}
 		tokenReq := VerifyRequest{StateToken: stateToken, PassCode: verifyCode, RememberDevice: strconv.FormatBool(oc.rememberDevice)}
 		tokenBody := new(bytes.Buffer)
@@ -841,52 +1042,7 @@ func verifyMfa(oc *Client, oktaOrgHost string, loginDetails *creds.LoginDetails,
 		return extractSessionToken(res.Body)
 
 	case IdentifierPushMfa:
-
-		log.Println("Waiting for approval, please check your Okta Verify app ...")
-
-		// loop until success, error, or timeout
-		body := challengeContext.challengeResponseBody
-		for {
-			// on 'success' status
-			if gjson.Get(body, "status").String() == "SUCCESS" {
-				log.Println(" Approved")
-				logger.Debugf("func verifyMfa | okta exiry: %s", gjson.Get(body, "expiresAt").String()) // DEBUG
-				return gjson.Get(body, "sessionToken").String(), nil
-			}
-
-			// otherwise probably still waiting
-			switch gjson.Get(body, "factorResult").String() {
-
-			case "WAITING":
-				time.Sleep(3 * time.Second)
-				logger.Debug("Waiting for user to authorize login")
-				updatedContext, err := getMfaChallengeContext(oc, mfaOption, resp)
-				if err != nil {
-					return "", err
-				}
-				body = updatedContext.challengeResponseBody
-				if gjson.Get(body, "status").String() == "MFA_CHALLENGE" {
-					correctAnswer := gjson.Get(body, "_embedded.factor._embedded.challenge.correctAnswer").String()
-					if correctAnswer != "" {
-						log.Printf("Correct Answer: %s", correctAnswer)
-					}
-				}
-
-			case "TIMEOUT":
-				log.Println(" Timeout")
-				return "", errors.New("User did not accept MFA in time")
-
-			case "REJECTED":
-				log.Println(" Rejected")
-				return "", errors.New("MFA rejected by user")
-
-			default:
-				log.Println(" Error")
-				return "", errors.New("Unsupported response from Okta, please raise ticket with saml2aws")
-
-			}
-
-		}
+		return verifyPush(oc, mfaOption, resp, challengeContext.challengeResponseBody)
 
 	case IdentifierDuoMfa:
 		duoHost := gjson.Get(challengeContext.challengeResponseBody, "_embedded.factor._embedded.verification.host").String()
@@ -991,7 +1147,7 @@ func verifyMfa(oc *Client, oktaOrgHost string, loginDetails *creds.LoginDetails,
 				}
 			}
 		} else {
-			duoMfaOption = prompter.Choose("Select a DUO MFA Option", duoMfaOptions)
+			duoMfaOption = oc.ask.Choose("Select a DUO MFA Option", duoMfaOptions)
 		}
 
 		if duoMfaOption == -1 {
@@ -1000,7 +1156,7 @@ func verifyMfa(oc *Client, oktaOrgHost string, loginDetails *creds.LoginDetails,
 
 		if duoMfaOptions[duoMfaOption] == "Passcode" {
 			//get users DUO MFA Token
-			token = prompter.StringRequired("Enter passcode")
+			token = oc.ask.StringRequired("Enter passcode")
 		}
 
 		// send mfa auth request
@@ -1340,7 +1496,19 @@ func fidoWebAuthn(oc *Client, oktaOrgHost string, challengeContext *mfaChallenge
 	challengeResponseBody := challengeContext.challengeResponseBody
 	lastMfaOption := mfaOption
 
-	for {
+	// prefer CTAP2 through libfido2 when saml2aws is built with it, it handles PINs and FIDO2 only keys
+	if authenticator, err := NewFIDO2Authenticator(); err == nil {
+		nonce := gjson.Get(challengeResponseBody, "_embedded.factor._embedded.challenge.challenge").String()
+		signedAssertion, err = ChallengeFIDO2(oc.ask, authenticator, nonce, oktaOrgHost, stateToken, webAuthnCredentialIDs(challengeResponseBody))
+		if err == ErrFIDO2NoDevice {
+			return "", errNoSecurityKey
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "failed to perform FIDO2 challenge")
+		}
+	}
+
+	for signedAssertion == nil {
 		nonce := gjson.Get(challengeResponseBody, "_embedded.factor._embedded.challenge.challenge").String()
 		credentialID := gjson.Get(challengeResponseBody, "_embedded.factor.profile.credentialId").String()
 		version := gjson.Get(challengeResponseBody, "_embedded.factor.profile.version").String()
@@ -1355,11 +1523,15 @@ func fidoWebAuthn(oc *Client, oktaOrgHost string, challengeContext *mfaChallenge
 		)
 		if err != nil {
 			// Try to authenticate with the system level Webauthn libraries
-			signedAssertion, err = ChallengeSystemWebAuthn(nonce, oktaOrgHost, stateToken)
-			if err == nil {
+			var systemErr error
+			signedAssertion, systemErr = ChallengeSystemWebAuthn(nonce, oktaOrgHost, stateToken)
+			if systemErr == nil {
 				break
 			}
-			return "", err
+			if err == ErrNoDeviceFound {
+				return "", errNoSecurityKey
+			}
+			return "", systemErr
 		}
 
 		signedAssertion, err = fidoClient.ChallengeU2F()
@@ -1413,6 +1585,16 @@ func fidoWebAuthn(oc *Client, oktaOrgHost string, challengeContext *mfaChallenge
 	return gjson.GetBytes(body, "sessionToken").String(), nil
 }
 
+// webAuthnCredentialIDs the credentials Okta accepts an assertion from, when several keys are enrolled the
+// challenge lists each of them
+func webAuthnCredentialIDs(challengeResponseBody string) []string {
+	var credentialIDs []string
+	for _, credentialID := range gjson.Get(challengeResponseBody, "_embedded.challengeFactors.#.profile.credentialId").Array() {
+		credentialIDs = append(credentialIDs, credentialID.String())
+	}
+	return append(credentialIDs, gjson.Get(challengeResponseBody, "_embedded.factor.profile.credentialId").String())
+}
+
 func verifyTrustedCert(oc *Client, doc *goquery.Document, duoHost string, duoSubmitURL string, q url.Values) (*goquery.Document, error) {
 	// If you enable DUO trusted cert validation, it requires an extra step before continuing.
 	// The way the validation process works is it attempts to send a request to a localhost:15310
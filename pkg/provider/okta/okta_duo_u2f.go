@@ -3,6 +3,7 @@ package okta
 import (
 	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/marshallbrekka/go-u2fhost"
@@ -35,7 +36,7 @@ func NewDUOU2FClient(challengeNonce, appID, version, keyHandle, stateToken strin
 	for retryCount < MaxOpenRetries {
 		device, err = deviceFinder.findDevice()
 		if err != nil {
-			if err == errNoDeviceFound {
+			if err == ErrNoDeviceFound {
 				return nil, err
 			}
 
@@ -92,14 +93,14 @@ func (d *DUOU2FClient) ChallengeU2F() (*ResponseData, error) {
 					SignatureData: response.SignatureData,
 					KeyHandle:     d.KeyHandle,
 				}
-				fmt.Printf("  ==> Touch accepted. Proceeding with authentication\n")
+				fmt.Fprintf(os.Stderr, "  ==> Touch accepted. Proceeding with authentication\n")
 				return responsePayload, nil
 			}
 
 			switch err.(type) {
 			case *u2fhost.TestOfUserPresenceRequiredError:
 				if !prompted {
-					fmt.Printf("\nTouch the flashing U2F device to authenticate...\n")
+					fmt.Fprintf(os.Stderr, "\nTouch the flashing U2F device to authenticate...\n")
 					prompted = true
 				}
 			default:
@@ -0,0 +1,239 @@
+package okta
+
+import (
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+// FIDO2Timeout how long to wait for the security key to be touched
+const FIDO2Timeout = 30 * time.Second
+
+var (
+	// ErrFIDO2Unsupported returned when saml2aws was built without libfido2, the U2F and system WebAuthn
+	// paths are used instead
+	ErrFIDO2Unsupported = errors.New("FIDO2 support not built in, rebuild saml2aws with -tags fido2 on Linux or macOS")
+
+	// ErrFIDO2NoDevice returned when no security key is plugged in
+	ErrFIDO2NoDevice = errors.New("no FIDO2 security key found, plug one in and try again")
+
+	errFIDO2Timeout = fmt.Errorf("security key was not touched within %s, run the login again and touch the key when it flashes", FIDO2Timeout)
+
+	errFIDO2NoCredentials = errors.New("none of the plugged in security keys is registered with Okta for this account, try another key or enroll this one")
+
+	// errFIDO2PinRequired returned by an authenticator asked for an assertion without the PIN it needs
+	errFIDO2PinRequired = errors.New("security key PIN required")
+
+	errFIDO2PinInvalid = errors.New("incorrect security key PIN")
+
+	errFIDO2PinBlocked = errors.New("security key PIN is blocked, reset the key or unplug it and try again")
+)
+
+// errWebAuthnNoCredentials errFIDO2NoCredentials for relying parties other than Okta
+var errWebAuthnNoCredentials = errors.New("none of the plugged in security keys is registered for this account, try another key or register this one")
+
+// fido2Request the credential assertion asked of the security key
+type fido2Request struct {
+	RPID           string
+	ClientDataHash []byte
+	CredentialIDs  [][]byte
+	PIN            string
+}
+
+// fido2Response the parts of the assertion Okta needs, the authenticator data is raw rather than CBOR encoded
+type fido2Response struct {
+	AuthenticatorData []byte
+	Signature         []byte
+	CredentialID      []byte
+}
+
+// FIDO2Authenticator is used to mock out the security key
+type FIDO2Authenticator interface {
+	GetAssertion(req *fido2Request) (*fido2Response, error)
+}
+
+// collectedClientData the clientDataJSON signed by the security key
+// https://www.w3.org/TR/webauthn-2/#dictdef-collectedclientdata
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// WebAuthnChallenge the WebAuthn assertion asked for by a relying party other than Okta, such as KeyCloak
+type WebAuthnChallenge struct {
+	Challenge        string            // base64url, as the relying party hands it to navigator.credentials.get
+	Origin           string            // scheme and host of the page asking, checked against the signed client data
+	RPID             string            // relying party ID the credentials are scoped to
+	CredentialIDs    []string          // base64url IDs of the allowed credentials, empty for discoverable ones
+	UserVerification bool              // whether the relying party requires the user to be verified, by PIN
+	Prompter         prompter.Prompter // asks for the PIN, the active prompter when nil
+}
+
+// WebAuthnAssertion the signed assertion, each field base64url encoded as the WebAuthn JavaScript posts it
+type WebAuthnAssertion struct {
+	ClientDataJSON    string
+	AuthenticatorData string
+	Signature         string
+	CredentialID      string
+}
+
+// buildClientDataJSON the client data for an assertion against the Okta org, Okta checks the origin so it
+// has to be the org rather than wherever the login started
+func buildClientDataJSON(challenge, oktaOrgHost string) ([]byte, error) {
+	return clientDataJSON(challenge, "https://"+oktaOrgHost)
+}
+
+func clientDataJSON(challenge, origin string) ([]byte, error) {
+	return json.Marshal(collectedClientData{
+		Type:      "webauthn.get",
+		Challenge: challenge,
+		Origin:    origin,
+	})
+}
+
+// decodeCredentialIDs decodes the base64url credential IDs Okta lists, dropping duplicates
+func decodeCredentialIDs(credentialIDs []string) ([][]byte, error) {
+	seen := map[string]bool{}
+	var decoded [][]byte
+	for _, credentialID := range credentialIDs {
+		credentialID = strings.TrimRight(credentialID, "=")
+		if credentialID == "" || seen[credentialID] {
+			continue
+		}
+		seen[credentialID] = true
+
+		id, err := b64.RawURLEncoding.DecodeString(credentialID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error decoding credential ID %s", credentialID)
+		}
+		decoded = append(decoded, id)
+	}
+	return decoded, nil
+}
+
+// cborByteString unwraps a CBOR encoded byte string, which is how libfido2 hands back the authenticator data
+func cborByteString(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0]>>5 != 2 {
+		return nil, errors.New("authenticator data is not a CBOR byte string")
+	}
+
+	length, header := uint64(data[0]&0x1f), 1
+	switch {
+	case length < 24:
+	case length == 24 && len(data) >= 2:
+		length, header = uint64(data[1]), 2
+	case length == 25 && len(data) >= 3:
+		length, header = uint64(data[1])<<8|uint64(data[2]), 3
+	default:
+		return nil, errors.New("unsupported CBOR byte string length")
+	}
+
+	if uint64(len(data)-header) != length {
+		return nil, errors.New("truncated CBOR byte string")
+	}
+
+	return data[header:], nil
+}
+
+// ChallengeFIDO2 asks a FIDO2 security key to sign the Okta WebAuthn challenge with one of the credentials
+// Okta allows, prompting for the PIN when the key wants one
+func ChallengeFIDO2(ask prompter.Asker, authenticator FIDO2Authenticator, challenge, oktaOrgHost, stateToken string, credentialIDs []string) (*SignedAssertion, error) {
+
+	clientData, err := buildClientDataJSON(challenge, oktaOrgHost)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building client data")
+	}
+	clientDataHash := sha256.Sum256(clientData)
+
+	allowed, err := decodeCredentialIDs(credentialIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &fido2Request{
+		RPID:           oktaOrgHost,
+		ClientDataHash: clientDataHash[:],
+		CredentialIDs:  allowed,
+	}
+
+	res, err := getFIDO2Assertion(ask, authenticator, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignedAssertion{
+		StateToken:        stateToken,
+		ClientData:        b64.StdEncoding.EncodeToString(clientData),
+		SignatureData:     b64.StdEncoding.EncodeToString(res.Signature),
+		AuthenticatorData: b64.StdEncoding.EncodeToString(res.AuthenticatorData),
+	}, nil
+}
+
+// ChallengeWebAuthn asks a FIDO2 security key to sign the WebAuthn challenge of a relying party other than Okta,
+// asking for the PIN up front when the relying party requires user verification
+func ChallengeWebAuthn(authenticator FIDO2Authenticator, challenge *WebAuthnChallenge) (*WebAuthnAssertion, error) {
+
+	clientData, err := clientDataJSON(strings.TrimRight(challenge.Challenge, "="), challenge.Origin)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building client data")
+	}
+	clientDataHash := sha256.Sum256(clientData)
+
+	allowed, err := decodeCredentialIDs(challenge.CredentialIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &fido2Request{
+		RPID:           challenge.RPID,
+		ClientDataHash: clientDataHash[:],
+		CredentialIDs:  allowed,
+	}
+	ask := prompter.Asker{Prompter: challenge.Prompter}
+	if challenge.UserVerification {
+		req.PIN = ask.Password("Security key PIN")
+	}
+
+	res, err := getFIDO2Assertion(ask, authenticator, req)
+	if err == errFIDO2NoCredentials {
+		return nil, errWebAuthnNoCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnAssertion{
+		ClientDataJSON:    b64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: b64.RawURLEncoding.EncodeToString(res.AuthenticatorData),
+		Signature:         b64.RawURLEncoding.EncodeToString(res.Signature),
+		CredentialID:      b64.RawURLEncoding.EncodeToString(res.CredentialID),
+	}, nil
+}
+
+// getFIDO2Assertion asks for the assertion, prompting for the PIN and asking again when the key wants one
+func getFIDO2Assertion(ask prompter.Asker, authenticator FIDO2Authenticator, req *fido2Request) (*fido2Response, error) {
+	log.Println("Touch the flashing security key to authenticate...")
+
+	res, err := authenticator.GetAssertion(req)
+	if err == errFIDO2PinRequired && req.PIN == "" {
+		req.PIN = ask.Password("Security key PIN")
+		log.Println("Touch the flashing security key to authenticate...")
+		res, err = authenticator.GetAssertion(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("  ==> Touch accepted. Proceeding with authentication")
+
+	return res, nil
+}
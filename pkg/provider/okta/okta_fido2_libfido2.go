@@ -0,0 +1,140 @@
+//go:build fido2 && cgo && (linux || darwin)
+// +build fido2
+// +build cgo
+// +build linux darwin
+
+package okta
+
+/*
+#cgo LDFLAGS: -lfido2
+
+#include <stdlib.h>
+#include <fido.h>
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+const maxFIDO2Devices = 64
+
+// libfido2Authenticator talks CTAP2 to the plugged in security keys through libfido2
+type libfido2Authenticator struct{}
+
+// NewFIDO2Authenticator returns the libfido2 backed authenticator
+func NewFIDO2Authenticator() (FIDO2Authenticator, error) {
+	C.fido_init(0)
+	return &libfido2Authenticator{}, nil
+}
+
+// GetAssertion asks each security key in turn, the first holding one of the allowed credentials signs
+func (*libfido2Authenticator) GetAssertion(req *fido2Request) (*fido2Response, error) {
+	devList := C.fido_dev_info_new(maxFIDO2Devices)
+	if devList == nil {
+		return nil, fmt.Errorf("unable to list FIDO2 devices")
+	}
+	defer C.fido_dev_info_free(&devList, maxFIDO2Devices)
+
+	var found C.size_t
+	if r := C.fido_dev_info_manifest(devList, maxFIDO2Devices, &found); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	if found == 0 {
+		return nil, ErrFIDO2NoDevice
+	}
+
+	err := errFIDO2NoCredentials
+	for i := C.size_t(0); i < found; i++ {
+		path := C.fido_dev_info_path(C.fido_dev_info_ptr(devList, i))
+
+		var res *fido2Response
+		res, err = getDeviceAssertion(path, req)
+		if err == errFIDO2NoCredentials {
+			continue
+		}
+		return res, err
+	}
+
+	return nil, err
+}
+
+func getDeviceAssertion(path *C.char, req *fido2Request) (*fido2Response, error) {
+	dev := C.fido_dev_new()
+	if dev == nil {
+		return nil, fmt.Errorf("unable to allocate FIDO2 device")
+	}
+	defer C.fido_dev_free(&dev)
+
+	if r := C.fido_dev_open(dev, path); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	defer C.fido_dev_close(dev)
+
+	C.fido_dev_set_timeout(dev, C.int(FIDO2Timeout.Milliseconds()))
+
+	assert := C.fido_assert_new()
+	if assert == nil {
+		return nil, fmt.Errorf("unable to allocate FIDO2 assertion")
+	}
+	defer C.fido_assert_free(&assert)
+
+	rpID := C.CString(req.RPID)
+	defer C.free(unsafe.Pointer(rpID))
+
+	if r := C.fido_assert_set_rp(assert, rpID); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	if r := C.fido_assert_set_clientdata_hash(assert, (*C.uchar)(unsafe.Pointer(&req.ClientDataHash[0])), C.size_t(len(req.ClientDataHash))); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	for _, credentialID := range req.CredentialIDs {
+		if r := C.fido_assert_allow_cred(assert, (*C.uchar)(unsafe.Pointer(&credentialID[0])), C.size_t(len(credentialID))); r != C.FIDO_OK {
+			return nil, fido2Error(r)
+		}
+	}
+	if r := C.fido_assert_set_up(assert, C.FIDO_OPT_TRUE); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+
+	var pin *C.char
+	if req.PIN != "" {
+		pin = C.CString(req.PIN)
+		defer C.free(unsafe.Pointer(pin))
+	}
+
+	if r := C.fido_dev_get_assert(dev, assert, pin); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	if C.fido_assert_count(assert) == 0 {
+		return nil, errFIDO2NoCredentials
+	}
+
+	authData, err := cborByteString(C.GoBytes(unsafe.Pointer(C.fido_assert_authdata_ptr(assert, 0)), C.int(C.fido_assert_authdata_len(assert, 0))))
+	if err != nil {
+		return nil, err
+	}
+
+	return &fido2Response{
+		AuthenticatorData: authData,
+		Signature:         C.GoBytes(unsafe.Pointer(C.fido_assert_sig_ptr(assert, 0)), C.int(C.fido_assert_sig_len(assert, 0))),
+		CredentialID:      C.GoBytes(unsafe.Pointer(C.fido_assert_id_ptr(assert, 0)), C.int(C.fido_assert_id_len(assert, 0))),
+	}, nil
+}
+
+// fido2Error maps the libfido2 errors a user can act on onto their messages
+func fido2Error(r C.int) error {
+	switch r {
+	case C.FIDO_ERR_NO_CREDENTIALS:
+		return errFIDO2NoCredentials
+	case C.FIDO_ERR_PIN_REQUIRED:
+		return errFIDO2PinRequired
+	case C.FIDO_ERR_PIN_INVALID:
+		return errFIDO2PinInvalid
+	case C.FIDO_ERR_PIN_BLOCKED, C.FIDO_ERR_PIN_AUTH_BLOCKED:
+		return errFIDO2PinBlocked
+	case C.FIDO_ERR_RX, C.FIDO_ERR_ACTION_TIMEOUT, C.FIDO_ERR_USER_ACTION_TIMEOUT:
+		return errFIDO2Timeout
+	}
+	return fmt.Errorf("FIDO2 security key error: %s", C.GoString(C.fido_strerr(r)))
+}
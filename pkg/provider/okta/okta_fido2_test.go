@@ -0,0 +1,149 @@
+package okta
+
+import (
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+type mockFIDO2Authenticator struct {
+	requests  []fido2Request
+	responses []error
+}
+
+func (m *mockFIDO2Authenticator) GetAssertion(req *fido2Request) (*fido2Response, error) {
+	m.requests = append(m.requests, *req)
+	err := m.responses[0]
+	m.responses = m.responses[1:]
+	if err != nil {
+		return nil, err
+	}
+	return &fido2Response{AuthenticatorData: []byte("authdata"), Signature: []byte("signature"), CredentialID: []byte("cred-1")}, nil
+}
+
+func TestBuildClientDataJSON(t *testing.T) {
+	clientData, err := buildClientDataJSON("Y2hhbGxlbmdl", "example.okta.com")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"type":"webauthn.get","challenge":"Y2hhbGxlbmdl","origin":"https://example.okta.com","crossOrigin":false}`, string(clientData))
+}
+
+func TestCborByteString(t *testing.T) {
+	data, err := cborByteString([]byte{0x43, 1, 2, 3})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, data)
+
+	long := make([]byte, 37)
+	data, err = cborByteString(append([]byte{0x58, 37}, long...))
+	assert.Nil(t, err)
+	assert.Equal(t, long, data)
+
+	_, err = cborByteString([]byte{0x58, 37, 1})
+	assert.EqualError(t, err, "truncated CBOR byte string")
+
+	_, err = cborByteString([]byte{0x63, 'a', 'b', 'c'})
+	assert.EqualError(t, err, "authenticator data is not a CBOR byte string")
+}
+
+func TestWebAuthnCredentialIDs(t *testing.T) {
+	credentialIDs := webAuthnCredentialIDs(`{
+		"_embedded": {
+			"challengeFactors": [
+				{"profile": {"credentialId": "Y3JlZC0x"}},
+				{"profile": {"credentialId": "Y3JlZC0y"}}
+			],
+			"factor": {"profile": {"credentialId": "Y3JlZC0x"}}
+		}
+	}`)
+
+	decoded, err := decodeCredentialIDs(credentialIDs)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("cred-1"), []byte("cred-2")}, decoded)
+}
+
+func TestChallengeFIDO2(t *testing.T) {
+	authenticator := &mockFIDO2Authenticator{responses: []error{nil}}
+
+	signedAssertion, err := ChallengeFIDO2(prompter.Asker{}, authenticator, "Y2hhbGxlbmdl", "example.okta.com", "TOKEN", []string{"Y3JlZC0x"})
+	assert.Nil(t, err)
+
+	clientData, _ := buildClientDataJSON("Y2hhbGxlbmdl", "example.okta.com")
+	clientDataHash := sha256.Sum256(clientData)
+
+	assert.Equal(t, []fido2Request{{RPID: "example.okta.com", ClientDataHash: clientDataHash[:], CredentialIDs: [][]byte{[]byte("cred-1")}}}, authenticator.requests)
+	assert.Equal(t, &SignedAssertion{
+		StateToken:        "TOKEN",
+		ClientData:        b64.StdEncoding.EncodeToString(clientData),
+		SignatureData:     b64.StdEncoding.EncodeToString([]byte("signature")),
+		AuthenticatorData: b64.StdEncoding.EncodeToString([]byte("authdata")),
+	}, signedAssertion)
+}
+
+func TestChallengeFIDO2PinRequired(t *testing.T) {
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Password", "Security key PIN").Return("1234")
+
+	authenticator := &mockFIDO2Authenticator{responses: []error{errFIDO2PinRequired, nil}}
+
+	_, err := ChallengeFIDO2(prompter.Asker{}, authenticator, "Y2hhbGxlbmdl", "example.okta.com", "TOKEN", []string{"Y3JlZC0x"})
+	assert.Nil(t, err)
+	assert.Len(t, authenticator.requests, 2)
+	assert.Equal(t, "", authenticator.requests[0].PIN)
+	assert.Equal(t, "1234", authenticator.requests[1].PIN)
+
+	authenticator = &mockFIDO2Authenticator{responses: []error{errFIDO2PinRequired, errFIDO2PinInvalid}}
+
+	_, err = ChallengeFIDO2(prompter.Asker{}, authenticator, "Y2hhbGxlbmdl", "example.okta.com", "TOKEN", []string{"Y3JlZC0x"})
+	assert.Equal(t, errFIDO2PinInvalid, err)
+}
+
+func TestChallengeWebAuthn(t *testing.T) {
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Password", "Security key PIN").Return("1234")
+
+	authenticator := &mockFIDO2Authenticator{responses: []error{nil}}
+
+	assertion, err := ChallengeWebAuthn(authenticator, &WebAuthnChallenge{
+		Challenge:        "Y2hhbGxlbmdl",
+		Origin:           "https://id.example.com:8443",
+		RPID:             "example.com",
+		CredentialIDs:    []string{"Y3JlZC0x"},
+		UserVerification: true,
+	})
+	assert.Nil(t, err)
+
+	clientData, _ := clientDataJSON("Y2hhbGxlbmdl", "https://id.example.com:8443")
+	clientDataHash := sha256.Sum256(clientData)
+
+	// user verification asks for the PIN before touching the key
+	assert.Equal(t, []fido2Request{{RPID: "example.com", ClientDataHash: clientDataHash[:], CredentialIDs: [][]byte{[]byte("cred-1")}, PIN: "1234"}}, authenticator.requests)
+	assert.Equal(t, &WebAuthnAssertion{
+		ClientDataJSON:    b64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: b64.RawURLEncoding.EncodeToString([]byte("authdata")),
+		Signature:         b64.RawURLEncoding.EncodeToString([]byte("signature")),
+		CredentialID:      "Y3JlZC0x",
+	}, assertion)
+
+	authenticator = &mockFIDO2Authenticator{responses: []error{errFIDO2NoCredentials}}
+
+	_, err = ChallengeWebAuthn(authenticator, &WebAuthnChallenge{Challenge: "Y2hhbGxlbmdl", Origin: "https://id.example.com", RPID: "id.example.com"})
+	assert.Equal(t, errWebAuthnNoCredentials, err)
+}
+
+func TestMfaOptionPrefix(t *testing.T) {
+	assert.Equal(t, IdentifierFIDOWebAuthn, mfaOptionPrefix("webauthn"))
+	assert.Equal(t, "FIDO", mfaOptionPrefix("FIDO"))
+	assert.Equal(t, 1, findMfaOption("WEBAUTHN", []string{"PUSH MFA authentication - id1", "FIDO WebAuthn MFA authentication - id2"}, 0))
+}
+
+func TestCanFallback(t *testing.T) {
+	assert.True(t, canFallback(&MfaTimeoutError{}))
+	assert.True(t, canFallback(errMfaRejected))
+	assert.True(t, canFallback(errNoSecurityKey))
+	assert.False(t, canFallback(errFIDO2PinInvalid))
+}
@@ -0,0 +1,9 @@
+//go:build !fido2 || !cgo || !(linux || darwin)
+// +build !fido2 !cgo !linux,!darwin
+
+package okta
+
+// NewFIDO2Authenticator returns ErrFIDO2Unsupported, saml2aws was built without libfido2
+func NewFIDO2Authenticator() (FIDO2Authenticator, error) {
+	return nil, ErrFIDO2Unsupported
+}
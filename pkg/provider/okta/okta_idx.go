@@ -0,0 +1,442 @@
+package okta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/marshallbrekka/go-u2fhost"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+// Okta Identity Engine (OIE) orgs replace the /api/v1/authn API with the interaction code flow, where each
+// response from /idp/idx lists the remediations that can move the login forward.
+// https://developer.okta.com/docs/concepts/interaction-code/
+
+const (
+	idxContentType = "application/ion+json; okta-version=1.0.0"
+
+	// idxMaxSteps bounds the remediations followed, polling for a push doesn't count
+	idxMaxSteps = 20
+)
+
+var (
+	errIdxLockedOut      = errors.New("the account is locked")
+	errIdxEnrollRequired = errors.New("the account has to enroll an MFA authenticator, sign in to Okta in a browser to set one up")
+)
+
+// idxMethodTypes maps the configured MFA onto the OIE authenticator method types that satisfy it
+var idxMethodTypes = map[string][]string{
+	"PUSH":                  {"push"},
+	"TOTP":                  {"totp", "otp"},
+	"OKTA":                  {"totp", "push"},
+	"SMS":                   {"sms"},
+	"EMAIL":                 {"email"},
+	"FIDO":                  {"webauthn"},
+	MfaWebAuthn:             {"webauthn"},
+	"YUBICO TOKEN:HARDWARE": {"otp"},
+	"SYMANTEC":              {"otp"},
+}
+
+// idxAuthenticatorOption one way of answering a select-authenticator-authenticate remediation
+type idxAuthenticatorOption struct {
+	label      string
+	id         string
+	methodType string
+}
+
+// usesIdentityEngine asks the org which authentication pipeline it runs, falling back to the classic
+// API when that can't be worked out
+func (oc *Client) usesIdentityEngine(oktaOrgHost string) bool {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/.well-known/okta-organization", oktaOrgHost), nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Add("Accept", "application/json")
+
+	res, err := oc.client.Do(req)
+	if err != nil {
+		logger.WithError(err).Debug("unable to detect the okta pipeline, using the classic API")
+		return false
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return false
+	}
+
+	pipeline := gjson.GetBytes(body, "pipeline").String()
+	logger.Debugf("okta | pipeline: %s", pipeline)
+
+	return pipeline == "idx"
+}
+
+// authenticateIdx logs into an Identity Engine org by answering remediations until Okta hands back the
+// success redirect, which leads on to the SAML response
+func (oc *Client) authenticateIdx(loginDetails *creds.LoginDetails) (string, error) {
+
+	oktaURL, err := url.Parse(loginDetails.URL)
+	if err != nil {
+		return "", errors.Wrap(err, "error building oktaURL")
+	}
+	oktaOrgHost := oktaURL.Host
+
+	req, err := http.NewRequest("GET", loginDetails.URL, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error building app request")
+	}
+
+	stateToken, err := oc.getStateToken(req, loginDetails)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to getStateToken")
+	}
+
+	resp, err := oc.idxPost(fmt.Sprintf("https://%s/idp/idx/introspect", oktaOrgHost), map[string]interface{}{"stateToken": stateToken})
+	if err != nil {
+		return "", errors.Wrap(err, "error introspecting state token")
+	}
+
+	passwordSent := false
+
+	for step := 0; step < idxMaxSteps; step++ {
+		if err := idxError(resp); err != nil {
+			return "", err
+		}
+
+		if successURL := gjson.Get(resp, "success.href").String(); successURL != "" {
+			req, err := http.NewRequest("GET", successURL, nil)
+			if err != nil {
+				return "", errors.Wrap(err, "error building success redirect request")
+			}
+			ctx := context.WithValue(context.Background(), ctxKey("login"), loginDetails)
+			return oc.follow(ctx, req, loginDetails)
+		}
+
+		stateHandle := gjson.Get(resp, "stateHandle").String()
+
+		switch {
+		case idxRemediation(resp, "select-authenticator-enroll").Exists(), idxRemediation(resp, "enroll-authenticator").Exists():
+			return "", errIdxEnrollRequired
+
+		case idxRemediation(resp, "identify").Exists():
+			remediation := idxRemediation(resp, "identify")
+			body := map[string]interface{}{"identifier": loginDetails.Username, "stateHandle": stateHandle}
+			// orgs that ask for the password up front take it with the username
+			if idxField(remediation, "credentials").Exists() {
+				body["credentials"] = map[string]string{"passcode": loginDetails.Password}
+				passwordSent = true
+			}
+			resp, err = oc.idxPost(remediation.Get("href").String(), body)
+
+		case idxRemediation(resp, "challenge-poll").Exists():
+			resp, err = oc.idxPoll(resp, stateHandle)
+
+		case idxRemediation(resp, "challenge-authenticator").Exists():
+			if gjson.Get(resp, "currentAuthenticatorEnrollment.value.type").String() == "password" {
+				passwordSent = true
+			}
+			resp, err = oc.idxChallenge(oktaOrgHost, loginDetails, resp, stateHandle)
+
+		case idxRemediation(resp, "select-authenticator-authenticate").Exists():
+			remediation := idxRemediation(resp, "select-authenticator-authenticate")
+			option, err := oc.selectIdxAuthenticator(remediation, !passwordSent)
+			if err != nil {
+				return "", err
+			}
+			resp, err = oc.idxPost(remediation.Get("href").String(), map[string]interface{}{
+				"authenticator": map[string]string{"id": option.id, "methodType": option.methodType},
+				"stateHandle":   stateHandle,
+			})
+			if err != nil {
+				return "", errors.Wrap(err, "error selecting authenticator")
+			}
+
+		default:
+			return "", fmt.Errorf("unsupported okta identity engine remediation: %s", strings.Join(idxRemediationNames(resp), ", "))
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "", errors.New("okta identity engine login did not complete")
+}
+
+// idxChallenge answers the challenge for the current authenticator
+func (oc *Client) idxChallenge(oktaOrgHost string, loginDetails *creds.LoginDetails, resp, stateHandle string) (string, error) {
+	remediation := idxRemediation(resp, "challenge-authenticator")
+	enrollment := gjson.Get(resp, "currentAuthenticatorEnrollment.value")
+
+	var credentials interface{}
+
+	switch enrollment.Get("type").String() {
+	case "password":
+		credentials = map[string]string{"passcode": loginDetails.Password}
+
+	case "security_key":
+		challenge := enrollment.Get("contextualData.challengeData.challenge").String()
+		credentialID := enrollment.Get("credentialId").String()
+
+		signedAssertion, err := idxWebAuthn(oc.ask, oktaOrgHost, challenge, credentialID, stateHandle)
+		if err != nil {
+			return "", err
+		}
+		credentials = map[string]string{
+			"clientData":        signedAssertion.ClientData,
+			"authenticatorData": signedAssertion.AuthenticatorData,
+			"signatureData":     signedAssertion.SignatureData,
+		}
+
+	default:
+		verifyCode := loginDetails.MFAToken
+		if verifyCode == "" {
+			verifyCode = oc.ask.RequestSecurityCode("000000")
+		}
+		credentials = map[string]string{"passcode": verifyCode}
+	}
+
+	resp, err := oc.idxPost(remediation.Get("href").String(), map[string]interface{}{
+		"credentials": credentials,
+		"stateHandle": stateHandle,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "error answering authenticator challenge")
+	}
+
+	return resp, nil
+}
+
+// idxPoll waits for a push to be answered, returning once the remediations move on
+func (oc *Client) idxPoll(resp, stateHandle string) (string, error) {
+	log.Println("Waiting for approval, please check your Okta Verify app ...")
+
+	timeout := oc.pushTimeout
+	if timeout <= 0 {
+		timeout = DefaultPushTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	shownAnswer := false
+	for idxRemediation(resp, "challenge-poll").Exists() {
+		if err := idxError(resp); err != nil {
+			return "", err
+		}
+
+		if correctAnswer := gjson.Get(resp, "currentAuthenticator.value.contextualData.correctAnswer").String(); correctAnswer != "" && !shownAnswer {
+			log.Printf("  ==> Select %s in Okta Verify", correctAnswer)
+			shownAnswer = true
+		}
+
+		remediation := idxRemediation(resp, "challenge-poll")
+
+		// the configured interval wins over the refresh Okta suggests
+		interval := oc.pushPollInterval
+		if refresh := remediation.Get("refresh").Int(); interval <= 0 && refresh > 0 {
+			interval = time.Duration(refresh) * time.Millisecond
+		}
+		if interval <= 0 {
+			interval = DefaultPushPollInterval
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return "", &MfaTimeoutError{Timeout: timeout}
+		}
+		time.Sleep(interval)
+
+		var err error
+		resp, err = oc.idxPost(remediation.Get("href").String(), map[string]interface{}{"stateHandle": stateHandle})
+		if err != nil {
+			return "", errors.Wrap(err, "error polling for approval")
+		}
+	}
+
+	return resp, nil
+}
+
+// selectIdxAuthenticator picks the authenticator to answer with, the password first when it hasn't been
+// given yet and otherwise the one matching the configured MFA, prompting when that leaves a choice
+func (oc *Client) selectIdxAuthenticator(remediation gjson.Result, wantPassword bool) (*idxAuthenticatorOption, error) {
+	var password *idxAuthenticatorOption
+	var options []*idxAuthenticatorOption
+
+	for _, option := range idxField(remediation, "authenticator").Get("options").Array() {
+		form := option.Get("value.form.value")
+		id := idxFormValue(form, "id").Get("value").String()
+		methodType := idxFormValue(form, "methodType")
+
+		// authenticators with several methods, such as Okta Verify, list them as options
+		methodTypes := []string{methodType.Get("value").String()}
+		if methodType.Get("options").Exists() {
+			methodTypes = nil
+			for _, method := range methodType.Get("options").Array() {
+				methodTypes = append(methodTypes, method.Get("value").String())
+			}
+		}
+
+		for _, method := range methodTypes {
+			o := &idxAuthenticatorOption{label: option.Get("label").String(), id: id, methodType: method}
+			if method == "password" {
+				password = o
+				continue
+			}
+			if method != "" && method != o.label {
+				o.label = fmt.Sprintf("%s (%s)", o.label, method)
+			}
+			options = append(options, o)
+		}
+	}
+
+	if wantPassword && password != nil {
+		return password, nil
+	}
+
+	var matches []*idxAuthenticatorOption
+	if methods, ok := idxMethodTypes[strings.ToUpper(oc.mfa)]; ok {
+		for _, o := range options {
+			for _, method := range methods {
+				if o.methodType == method {
+					matches = append(matches, o)
+				}
+			}
+		}
+	} else {
+		matches = options
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no okta authenticator matches MFA %s", oc.mfa)
+	case 1:
+		return matches[0], nil
+	}
+
+	labels := make([]string, len(matches))
+	for i, o := range matches {
+		labels[i] = o.label
+	}
+
+	return matches[oc.ask.Choose("Select which MFA option to use", labels)], nil
+}
+
+// idxWebAuthn signs the challenge with a FIDO2 security key when built with libfido2, otherwise with a U2F
+// device or the platform authenticator when there is none
+func idxWebAuthn(ask prompter.Asker, oktaOrgHost, challenge, credentialID, stateHandle string) (*SignedAssertion, error) {
+	if authenticator, err := NewFIDO2Authenticator(); err == nil {
+		signedAssertion, err := ChallengeFIDO2(ask, authenticator, challenge, oktaOrgHost, stateHandle, []string{credentialID})
+		if err == ErrFIDO2NoDevice {
+			return nil, errNoSecurityKey
+		}
+		return signedAssertion, err
+	}
+
+	fidoClient, err := NewFidoClient(challenge, oktaOrgHost, "", credentialID, stateHandle, new(U2FDeviceFinder))
+	if err != nil {
+		signedAssertion, systemErr := ChallengeSystemWebAuthn(challenge, oktaOrgHost, stateHandle)
+		if systemErr != nil && err == ErrNoDeviceFound {
+			return nil, errNoSecurityKey
+		}
+		return signedAssertion, systemErr
+	}
+
+	signedAssertion, err := fidoClient.ChallengeU2F()
+	if err != nil {
+		if _, ok := err.(*u2fhost.BadKeyHandleError); ok {
+			return nil, errors.Wrap(err, "the FIDO device is not enrolled for this account")
+		}
+		return nil, errors.Wrap(err, "failed to perform U2F challenge")
+	}
+
+	return signedAssertion, nil
+}
+
+// idxPost sends a remediation, error statuses are returned along with their body as Okta explains
+// rejected answers in the messages of the response
+func (oc *Client) idxPost(href string, body map[string]interface{}) (string, error) {
+	if href == "" {
+		return "", errors.New("okta identity engine remediation has no href")
+	}
+
+	payload := new(bytes.Buffer)
+	err := json.NewEncoder(payload).Encode(body)
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding remediation")
+	}
+
+	req, err := http.NewRequest("POST", href, payload)
+	if err != nil {
+		return "", errors.Wrap(err, "error building remediation request")
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", idxContentType)
+
+	res, err := oc.client.Do(req)
+	if res == nil {
+		return "", errors.Wrap(err, "error retrieving remediation response")
+	}
+	defer res.Body.Close()
+
+	respBody, readErr := io.ReadAll(res.Body)
+	if readErr != nil {
+		return "", errors.Wrap(readErr, "error retrieving body from response")
+	}
+
+	if err != nil && !gjson.GetBytes(respBody, "messages").Exists() {
+		return "", errors.Wrap(err, "error retrieving remediation response")
+	}
+
+	return string(respBody), nil
+}
+
+// idxError turns the error messages of a response into an error, telling a locked account apart
+func idxError(resp string) error {
+	var messages []string
+	for _, message := range gjson.Get(resp, "messages.value").Array() {
+		if message.Get("class").String() != "ERROR" {
+			continue
+		}
+		if strings.Contains(strings.ToLower(message.Get("i18n.key").String()), "locked") {
+			return errIdxLockedOut
+		}
+		messages = append(messages, message.Get("message").String())
+	}
+
+	if len(messages) == 0 {
+		if idxRemediation(resp, "unlock-account").Exists() && len(idxRemediationNames(resp)) == 1 {
+			return errIdxLockedOut
+		}
+		return nil
+	}
+
+	return fmt.Errorf("okta: %s", strings.Join(messages, " "))
+}
+
+func idxRemediation(resp, name string) gjson.Result {
+	return gjson.Get(resp, fmt.Sprintf(`remediation.value.#(name=="%s")`, name))
+}
+
+func idxRemediationNames(resp string) []string {
+	var names []string
+	for _, remediation := range gjson.Get(resp, "remediation.value").Array() {
+		names = append(names, remediation.Get("name").String())
+	}
+	return names
+}
+
+func idxField(remediation gjson.Result, name string) gjson.Result {
+	return remediation.Get(fmt.Sprintf(`value.#(name=="%s")`, name))
+}
+
+func idxFormValue(form gjson.Result, name string) gjson.Result {
+	return form.Get(fmt.Sprintf(`#(name=="%s")`, name))
+}
@@ -0,0 +1,167 @@
+package okta
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+const idxAuthenticatorOptions = `{
+	"name": "select-authenticator-authenticate",
+	"href": "%[1]s/idp/idx/challenge",
+	"value": [
+		{
+			"name": "authenticator",
+			"options": [
+				{
+					"label": "Password",
+					"value": {"form": {"value": [
+						{"name": "id", "value": "aut-password"},
+						{"name": "methodType", "value": "password"}
+					]}}
+				},
+				{
+					"label": "Okta Verify",
+					"value": {"form": {"value": [
+						{"name": "id", "value": "aut-okta-verify"},
+						{"name": "methodType", "options": [{"value": "totp"}, {"value": "push"}]}
+					]}}
+				}
+			]
+		},
+		{"name": "stateHandle"}
+	]
+}`
+
+func setupTestIdxServer(t *testing.T, pipeline string, answers map[string]string) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+
+		switch r.URL.Path {
+		case "/.well-known/okta-organization":
+			fmt.Fprintf(w, `{"id": "org", "pipeline": "%s"}`, pipeline)
+		case "/":
+			fmt.Fprint(w, `var stateToken = "TOKEN";`)
+		case "/idp/idx/introspect":
+			assert.Equal(t, "TOKEN", gjson.GetBytes(body, "stateToken").String())
+			fmt.Fprintf(w, `{"stateHandle": "HANDLE", "remediation": {"value": [{"name": "identify", "href": "%s/idp/idx/identify", "value": [{"name": "identifier"}]}]}}`, ts.URL)
+		case "/idp/idx/identify":
+			assert.Equal(t, "user@example.com", gjson.GetBytes(body, "identifier").String())
+			fmt.Fprintf(w, `{"stateHandle": "HANDLE", "remediation": {"value": [`+idxAuthenticatorOptions+`]}}`, ts.URL)
+		case "/idp/idx/challenge":
+			methodType := gjson.GetBytes(body, "authenticator.methodType").String()
+			enrollmentType := "password"
+			if methodType != "password" {
+				enrollmentType = "app"
+			}
+			fmt.Fprintf(w, `{"stateHandle": "HANDLE", "currentAuthenticatorEnrollment": {"value": {"type": "%s"}}, "remediation": {"value": [{"name": "challenge-authenticator", "href": "%s/idp/idx/challenge/answer"}]}}`, enrollmentType, ts.URL)
+		case "/idp/idx/challenge/answer":
+			passcode := gjson.GetBytes(body, "credentials.passcode").String()
+			next, ok := answers[passcode]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"messages": {"value": [{"message": "Invalid code. Try again.", "i18n": {"key": "api.authn.error.PASSCODE_INVALID"}, "class": "ERROR"}]}}`)
+				return
+			}
+			fmt.Fprintf(w, next, ts.URL)
+		case "/login/token/redirect":
+			fmt.Fprintf(w, `<form method="post" action="https://signin.aws.amazon.com/saml"><input type="hidden" name="SAMLResponse" value="%s"/></form>`, base64.StdEncoding.EncodeToString([]byte("<Response/>")))
+		default:
+			t.Errorf("unexpected request: %v", r.URL.String())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return ts
+}
+
+func TestUsesIdentityEngine(t *testing.T) {
+	for pipeline, expected := range map[string]bool{"idx": true, "v1": false} {
+		ts := setupTestIdxServer(t, pipeline, nil)
+
+		oc, _ := setupTestClient(t, ts, "Auto")
+		u, _ := url.Parse(ts.URL)
+		assert.Equal(t, expected, oc.usesIdentityEngine(u.Host), pipeline)
+
+		ts.Close()
+	}
+}
+
+func TestAuthenticateIdx(t *testing.T) {
+	ts := setupTestIdxServer(t, "idx", map[string]string{
+		"test123": `{"stateHandle": "HANDLE", "remediation": {"value": [` + idxAuthenticatorOptions + `]}}`,
+		"123456":  `{"stateHandle": "HANDLE", "success": {"name": "success-redirect", "href": "%s/login/token/redirect?stateToken=TOKEN"}}`,
+	})
+	defer ts.Close()
+
+	oc, loginDetails := setupTestClient(t, ts, "TOTP")
+	oc.targetURL = ""
+	loginDetails.MFAToken = "123456"
+
+	samlResponse, err := oc.Authenticate(loginDetails)
+	assert.Nil(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("<Response/>")), samlResponse)
+}
+
+func TestAuthenticateIdxInvalidCode(t *testing.T) {
+	ts := setupTestIdxServer(t, "idx", map[string]string{
+		"test123": `{"stateHandle": "HANDLE", "remediation": {"value": [` + idxAuthenticatorOptions + `]}}`,
+	})
+	defer ts.Close()
+
+	oc, loginDetails := setupTestClient(t, ts, "TOTP")
+	loginDetails.MFAToken = "654321"
+
+	_, err := oc.Authenticate(loginDetails)
+	assert.EqualError(t, err, "okta: Invalid code. Try again.")
+}
+
+func TestAuthenticateIdxLockedOut(t *testing.T) {
+	ts := setupTestIdxServer(t, "idx", map[string]string{
+		"test123": `{"stateHandle": "HANDLE", "messages": {"value": [{"message": "This account is locked.", "i18n": {"key": "oie.selfservice.unlock_user.locked.message"}, "class": "ERROR"}]}}`,
+	})
+	defer ts.Close()
+
+	oc, loginDetails := setupTestClient(t, ts, "TOTP")
+
+	_, err := oc.Authenticate(loginDetails)
+	assert.Equal(t, errIdxLockedOut, err)
+}
+
+func TestAuthenticateIdxEnrollRequired(t *testing.T) {
+	ts := setupTestIdxServer(t, "idx", map[string]string{
+		"test123": `{"stateHandle": "HANDLE", "remediation": {"value": [{"name": "select-authenticator-enroll", "href": "%s/idp/idx/credential/enroll"}]}}`,
+	})
+	defer ts.Close()
+
+	oc, loginDetails := setupTestClient(t, ts, "TOTP")
+
+	_, err := oc.Authenticate(loginDetails)
+	assert.Equal(t, errIdxEnrollRequired, err)
+}
+
+func TestSelectIdxAuthenticator(t *testing.T) {
+	remediation := gjson.Parse(fmt.Sprintf(idxAuthenticatorOptions, "https://example.okta.com"))
+
+	oc := &Client{mfa: "PUSH"}
+
+	option, err := oc.selectIdxAuthenticator(remediation, true)
+	assert.Nil(t, err)
+	assert.Equal(t, &idxAuthenticatorOption{label: "Password", id: "aut-password", methodType: "password"}, option)
+
+	option, err = oc.selectIdxAuthenticator(remediation, false)
+	assert.Nil(t, err)
+	assert.Equal(t, &idxAuthenticatorOption{label: "Okta Verify (push)", id: "aut-okta-verify", methodType: "push"}, option)
+
+	oc.mfa = "SMS"
+	_, err = oc.selectIdxAuthenticator(remediation, false)
+	assert.EqualError(t, err, "no okta authenticator matches MFA SMS")
+}
@@ -0,0 +1,149 @@
+package okta
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+)
+
+const (
+	// deviceTokenMaxAge how long a saved device token is replayed, matching the DT cookie Okta sets
+	deviceTokenMaxAge = 30 * 24 * time.Hour
+
+	deviceStateDirPermissions  = 0700
+	deviceStateFilePermissions = 0600
+)
+
+// deviceState the Okta cookies kept between logins, Okta only skips MFA for a device token it has seen before
+type deviceState struct {
+	DeviceToken        string    `json:"dt,omitempty"`
+	DeviceTokenExpires time.Time `json:"dt_expires,omitempty"`
+	SessionID          string    `json:"sid,omitempty"`
+}
+
+// DeviceStatePath the state file of an account, kept next to the configuration in the XDG config directory
+func DeviceStatePath(accountName string) (string, error) {
+	configPath, err := cfg.XDGConfigPath()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(configPath), "okta", url.PathEscape(accountName)+".json"), nil
+}
+
+// RenameDeviceState moves the state of a renamed account to its new name, there being none isn't an error
+func RenameDeviceState(oldName, newName string) error {
+	oldPath, err := DeviceStatePath(oldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := DeviceStatePath(newName)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(oldPath, newPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to rename okta device state")
+	}
+
+	return nil
+}
+
+// loadDeviceState reads the saved state, anything missing, unreadable or expired just means a full login
+func loadDeviceState(path string) *deviceState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.WithError(err).Debug("unable to read okta device state")
+		}
+		return nil
+	}
+
+	state := &deviceState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		logger.WithError(err).Debug("ignoring corrupt okta device state")
+		return nil
+	}
+
+	if !state.DeviceTokenExpires.IsZero() && time.Now().After(state.DeviceTokenExpires) {
+		logger.Debug("saved okta device token expired")
+		state.DeviceToken = ""
+	}
+
+	return state
+}
+
+// saveDeviceState writes the state readable by the user alone
+func saveDeviceState(path string, state *deviceState) error {
+	err := os.MkdirAll(filepath.Dir(path), deviceStateDirPermissions)
+	if err != nil {
+		return errors.Wrap(err, "unable to create okta device state directory")
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, deviceStateFilePermissions)
+	if err != nil {
+		return errors.Wrap(err, "unable to write okta device state")
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// restoreDeviceState replays the device token and session of the previous login
+func (oc *Client) restoreDeviceState(loginDetails *creds.LoginDetails) {
+	if oc.deviceStatePath == "" {
+		return
+	}
+
+	state := loadDeviceState(oc.deviceStatePath)
+	if state == nil {
+		return
+	}
+
+	oc.deviceToken = state.DeviceToken
+
+	// a session the keychain doesn't have, an invalid one falls back to a full login in authWithSession
+	if !oc.disableSessions && loginDetails.OktaSessionCookie == "" {
+		loginDetails.OktaSessionCookie = state.SessionID
+	}
+}
+
+// storeDeviceState saves the device token Okta knows the device by, and the session, after a login
+func (oc *Client) storeDeviceState(loginDetails *creds.LoginDetails) {
+	if oc.deviceStatePath == "" {
+		return
+	}
+
+	oktaURL, err := url.Parse(loginDetails.URL)
+	if err != nil {
+		return
+	}
+
+	state := &deviceState{}
+	for _, cookie := range oc.client.Jar.Cookies(&url.URL{Scheme: oktaURL.Scheme, Host: oktaURL.Host, Path: "/"}) {
+		if cookie.Name == "DT" {
+			state.DeviceToken = cookie.Value
+			state.DeviceTokenExpires = time.Now().Add(deviceTokenMaxAge)
+		}
+	}
+	if !oc.disableSessions {
+		state.SessionID = loginDetails.OktaSessionCookie
+	}
+
+	if err := saveDeviceState(oc.deviceStatePath, state); err != nil {
+		logger.WithError(err).Warn("unable to save okta device state, MFA will be asked for again")
+	}
+}
@@ -0,0 +1,79 @@
+package okta
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/provider"
+)
+
+func TestDeviceStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "okta", "account.json")
+
+	state := &deviceState{DeviceToken: "dt-123", DeviceTokenExpires: time.Now().Add(time.Hour), SessionID: "sid-456"}
+	err := saveDeviceState(path, state)
+	assert.Nil(t, err)
+
+	loaded := loadDeviceState(path)
+	assert.Equal(t, "dt-123", loaded.DeviceToken)
+	assert.Equal(t, "sid-456", loaded.SessionID)
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestLoadDeviceStateExpiredOrCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.Nil(t, loadDeviceState(filepath.Join(dir, "missing.json")))
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	assert.Nil(t, os.WriteFile(corrupt, []byte("{not json"), 0600))
+	assert.Nil(t, loadDeviceState(corrupt))
+
+	expired := filepath.Join(dir, "expired.json")
+	assert.Nil(t, saveDeviceState(expired, &deviceState{DeviceToken: "dt-123", DeviceTokenExpires: time.Now().Add(-time.Hour), SessionID: "sid-456"}))
+	loaded := loadDeviceState(expired)
+	assert.Equal(t, "", loaded.DeviceToken)
+	assert.Equal(t, "sid-456", loaded.SessionID)
+}
+
+func TestDeviceStateRestoreAndStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "account.json")
+	assert.Nil(t, saveDeviceState(path, &deviceState{DeviceToken: "dt-123", DeviceTokenExpires: time.Now().Add(time.Hour), SessionID: "sid-456"}))
+
+	client, _ := provider.NewHTTPClient(http.DefaultTransport, &provider.HTTPClientOptions{})
+	client.Jar, _ = cookiejar.New(nil)
+	oc := &Client{client: client, deviceStatePath: path}
+	loginDetails := &creds.LoginDetails{URL: "https://example.okta.com/home/amazon_aws/0oa/272", Username: "user@example.com"}
+
+	oc.restoreDeviceState(loginDetails)
+	assert.Equal(t, "sid-456", loginDetails.OktaSessionCookie)
+
+	assert.Nil(t, oc.setDeviceTokenCookie(loginDetails))
+	oktaURL, _ := url.Parse("https://example.okta.com/")
+	assert.Equal(t, []*http.Cookie{{Name: "DT", Value: "dt-123"}}, oc.client.Jar.Cookies(oktaURL))
+
+	oc.client.Jar.SetCookies(oktaURL, []*http.Cookie{{Name: "DT", Value: "dt-789", Secure: true}})
+	loginDetails.OktaSessionCookie = "sid-000"
+	oc.storeDeviceState(loginDetails)
+
+	loaded := loadDeviceState(path)
+	assert.Equal(t, "dt-789", loaded.DeviceToken)
+	assert.Equal(t, "sid-000", loaded.SessionID)
+
+	oc.disableSessions = true
+	oc.storeDeviceState(loginDetails)
+	assert.Equal(t, "", loadDeviceState(path).SessionID)
+}
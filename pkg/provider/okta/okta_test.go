@@ -15,6 +15,7 @@ import (
 	"strings"
 	"testing"
 	"testing/iotest"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/stretchr/testify/assert"
@@ -238,6 +239,7 @@ func TestVerifyMfa(t *testing.T) {
 
 	t.Run("Push", func(t *testing.T) {
 		oc, loginDetails := setupTestClient(t, ts, "PUSH")
+		oc.pushPollInterval = 10 * time.Millisecond
 
 		err := oc.setDeviceTokenCookie(loginDetails)
 		assert.Nil(t, err)
@@ -261,12 +263,55 @@ func TestVerifyMfa(t *testing.T) {
 		}`, ts.URL))
 		log.SetOutput(os.Stderr)
 		assert.Nil(t, err)
-		assert.Contains(t, out.String(), "Correct Answer: 92")
+		assert.Contains(t, out.String(), "Select 92 in Okta Verify")
+		assert.Equal(t, 1, strings.Count(out.String(), "Select 92 in Okta Verify"))
 
 		assert.Equal(t, context, "TOKEN_3")
 	})
 }
 
+func TestVerifyMfa_PushTimeout(t *testing.T) {
+	polls := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		_, err := w.Write([]byte(`{
+			"stateToken": "TOKEN_2",
+			"status": "MFA_CHALLENGE",
+			"factorResult": "WAITING"
+		}`))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	oc, _ := setupTestClient(t, ts, "PUSH")
+	oc.pushPollInterval = 10 * time.Millisecond
+	oc.pushTimeout = 35 * time.Millisecond
+
+	log.SetOutput(io.Discard)
+	_, err := verifyMfa(oc, "", &creds.LoginDetails{}, fmt.Sprintf(`{
+		"stateToken": "TOKEN_1",
+		"_embedded": {
+			"factors": [
+				{
+					"id": "PUSH",
+					"provider": "OKTA",
+					"factorType": "PUSH",
+					"_links": {
+						"verify": { "href": "%s/verify" }
+					}
+				}
+			]
+		}
+	}`, ts.URL))
+	log.SetOutput(os.Stderr)
+
+	var timeoutErr *MfaTimeoutError
+	assert.True(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, 35*time.Millisecond, timeoutErr.Timeout)
+	assert.EqualError(t, err, "User did not accept MFA within 35ms")
+	assert.GreaterOrEqual(t, polls, 2)
+}
+
 func TestVerifyMfa_Email(t *testing.T) {
 
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -315,6 +360,69 @@ func TestVerifyMfa_Email(t *testing.T) {
 	})
 }
 
+func TestVerifyMfa_Fallback(t *testing.T) {
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/verify/push":
+			_, err := w.Write([]byte(`{
+				"status": "MFA_CHALLENGE",
+				"factorResult": "TIMEOUT"
+			}`))
+			assert.Nil(t, err)
+		case "/verify/totp":
+			_, err := w.Write([]byte(`{
+				"sessionToken": "TOKEN_3",
+				"status": "SUCCESS"
+			}`))
+			assert.Nil(t, err)
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	oc, loginDetails := setupTestClient(t, ts, "PUSH")
+	oc.mfaFallback = []string{"TOTP"}
+
+	err := oc.setDeviceTokenCookie(loginDetails)
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	context, err := verifyMfa(oc, "", &creds.LoginDetails{
+		MFAToken: "123456",
+	}, fmt.Sprintf(`{
+		"stateToken": "TOKEN_1",
+		"_embedded": {
+			"factors": [
+				{
+					"id": "PUSH",
+					"provider": "OKTA",
+					"factorType": "PUSH",
+					"_links": {
+						"verify": { "href": "%s/verify/push" }
+					}
+				},
+				{
+					"id": "TOTP",
+					"provider": "GOOGLE",
+					"factorType": "token:software:totp",
+					"_links": {
+						"verify": { "href": "%s/verify/totp" }
+					}
+				}
+			]
+		}
+	}`, ts.URL, ts.URL))
+	log.SetOutput(os.Stderr)
+	assert.Nil(t, err)
+	assert.Equal(t, "TOKEN_3", context)
+	assert.Contains(t, out.String(), "Attempting PUSH MFA")
+	assert.Contains(t, out.String(), "Attempting TOTP MFA")
+	assert.Equal(t, "PUSH", oc.mfa)
+}
+
 func TestVerifyMfa_Duo(t *testing.T) {
 	t.Run("Duo Push", func(t *testing.T) {
 		ts := setupTestDuoHttpServer(t, "Duo Push")
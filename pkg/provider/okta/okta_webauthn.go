@@ -17,7 +17,8 @@ const (
 )
 
 var (
-	errNoDeviceFound = fmt.Errorf("no U2F devices found. device might not be plugged in")
+	// ErrNoDeviceFound returned when no U2F security key is plugged in
+	ErrNoDeviceFound = fmt.Errorf("no U2F devices found. device might not be plugged in")
 )
 
 // FidoClient represents a challenge and the device used to respond
@@ -57,7 +58,7 @@ func NewFidoClient(challengeNonce, appID, version, keyHandle, stateToken string,
 	for retryCount < MaxOpenRetries {
 		device, err = deviceFinder.findDevice()
 		if err != nil {
-			if err == errNoDeviceFound {
+			if err == ErrNoDeviceFound {
 				return FidoClient{}, err
 			}
 
@@ -144,7 +145,7 @@ func (*U2FDeviceFinder) findDevice() (u2fhost.Device, error) {
 
 	allDevices := u2fhost.Devices()
 	if len(allDevices) == 0 {
-		return nil, errNoDeviceFound
+		return nil, ErrNoDeviceFound
 	}
 
 	for i, device := range allDevices {
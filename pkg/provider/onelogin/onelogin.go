@@ -33,6 +33,13 @@ const (
 	MessagePending     = "Authentication pending"
 )
 
+// DefaultPushTimeout how long to wait for a OneLogin Protect approval when neither onelogin_push_timeout nor
+// timeout is set
+const DefaultPushTimeout = time.Minute
+
+// DefaultPushPollMax the longest wait between checks for a OneLogin Protect approval when mfa_poll_max isn't set
+const DefaultPushPollMax = 5 * time.Second
+
 // ProviderName constant holds the name of the OneLogin IDP.
 const ProviderName = "OneLogin"
 
@@ -46,6 +53,16 @@ var (
 		IdentifierYubiKey:            "YUBIKEY",
 		IdentifierDuoSecurity:        "DUO TOTP",
 	}
+
+	// otpMfaOptions the devices that take a code without a request to send one, offered when a push isn't approved
+	otpMfaOptions = map[string]bool{
+		IdentifierOneLoginProtectMfa: true,
+		IdentifierTotpMfa:            true,
+		IdentifierYubiKey:            true,
+		IdentifierDuoSecurity:        true,
+	}
+
+	errPushTimeout = errors.New("User did not accept MFA in time")
 )
 
 // Client is a wrapper representing a OneLogin SAML client.
@@ -60,6 +77,13 @@ type Client struct {
 	MFA string
 	// Subdomain is the organisation subdomain in OneLogin.
 	Subdomain string
+	// PushTimeout is how long to wait for a OneLogin Protect approval, zero uses DefaultPushTimeout.
+	PushTimeout time.Duration
+	// PushPollInterval is the time before the first check for a OneLogin Protect approval, zero uses a second.
+	// It doubles after each check up to PushPollMax.
+	PushPollInterval time.Duration
+	// PushPollMax is the longest time between checks for a OneLogin Protect approval, zero uses DefaultPushPollMax.
+	PushPollMax time.Duration
 }
 
 // AuthRequest represents an mfa OneLogin request.
@@ -83,11 +107,31 @@ type VerifyRequest struct {
 // New creates a new OneLogin client.
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
-	return &Client{AppID: idpAccount.AppID, Client: client, MFA: idpAccount.MFA, Subdomain: idpAccount.Subdomain}, nil
+	return &Client{
+		AppID:       idpAccount.AppID,
+		Client:      client,
+		MFA:         idpAccount.MFA,
+		Subdomain:   idpAccount.Subdomain,
+		PushTimeout: pushTimeout(idpAccount),
+		PushPollMax: time.Duration(idpAccount.MFAPollMax) * time.Second,
+	}, nil
+}
+
+// pushTimeout the onelogin_push_timeout in seconds, or else the timeout of the account in milliseconds
+func pushTimeout(idpAccount *cfg.IDPAccount) time.Duration {
+	if idpAccount.OneLoginPushTimeout > 0 {
+		return time.Duration(idpAccount.OneLoginPushTimeout) * time.Second
+	}
+	return time.Duration(idpAccount.Timeout) * time.Millisecond
 }
 
 // Authenticate logs into OneLogin and returns a SAML response.
@@ -159,7 +203,7 @@ func (c *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 		samlAssertion = authData.String()
 	case MessageMFARequired:
 		logger.Debug("Verifying MFA")
-		samlAssertion, err = verifyMFA(c, oauthToken, c.AppID, host, resp)
+		samlAssertion, err = verifyMFA(c, loginDetails.Asker(), oauthToken, c.AppID, host, resp)
 		if err != nil {
 			return "", errors.Wrap(err, "error verifying MFA")
 		}
@@ -206,7 +250,7 @@ func addContentHeaders(r *http.Request) {
 
 // verifyMFA is used to either prompt to user for one time password or request approval using push notification.
 // For more details check https://developers.onelogin.com/api-docs/2/saml-assertions/verify-factor
-func verifyMFA(oc *Client, oauthToken, appID, host, resp string) (string, error) {
+func verifyMFA(oc *Client, ask prompter.Asker, oauthToken, appID, host, resp string) (string, error) {
 	stateToken := gjson.Get(resp, "state_token").String()
 	// choose an mfa option if there are multiple enabled
 	var option int
@@ -233,7 +277,7 @@ func verifyMFA(oc *Client, oauthToken, appID, host, resp string) (string, error)
 		}
 	}
 	if !preselected && len(mfaOptions) > 1 {
-		option = prompter.Choose("Select which MFA option to use", mfaOptions)
+		option = ask.Choose("Select which MFA option to use", mfaOptions)
 	}
 
 	factorID := gjson.Get(resp, fmt.Sprintf("devices.%d.device_id", option)).String()
@@ -287,97 +331,170 @@ func verifyMFA(oc *Client, oauthToken, appID, host, resp string) (string, error)
 
 	switch mfaIdentifer {
 	case IdentifierSmsMfa, IdentifierTotpMfa, IdentifierYubiKey, IdentifierDuoSecurity:
-		verifyCode := prompter.StringRequired("Enter verification code")
-		var verifyBody bytes.Buffer
-		err := json.NewEncoder(&verifyBody).Encode(VerifyRequest{AppID: appID, DeviceID: mfaDeviceID, StateToken: stateToken, OTPToken: verifyCode})
-		if err != nil {
-			return "", errors.Wrap(err, "error encoding body")
-		}
-		req, err := http.NewRequest("POST", callbackURL, &verifyBody)
-		if err != nil {
-			return "", errors.Wrap(err, "error building token post request")
-		}
+		return verifyOTP(oc, ask, oauthToken, appID, callbackURL, mfaDeviceID, stateToken)
 
-		addContentHeaders(req)
-		addAuthHeader(req, oauthToken)
-		res, err := oc.Client.Do(req)
-		if err != nil {
-			return "", errors.Wrap(err, "error retrieving token post response")
+	case IdentifierOneLoginProtectMfa:
+		samlAssertion, err := verifyPush(oc, oauthToken, appID, callbackURL, mfaDeviceID, stateToken)
+		if err != errPushTimeout {
+			return samlAssertion, err
 		}
 
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			return "", errors.Wrap(err, "error retrieving body from response")
+		// offer a code from a registered device rather than failing the whole login
+		deviceID, ok := chooseOTPDevice(ask, resp)
+		if !ok {
+			return "", err
 		}
+		return verifyOTP(oc, ask, oauthToken, appID, callbackURL, deviceID, stateToken)
+	}
 
-		resp = string(body)
+	// catch all
+	return "", errors.New("no mfa options provided")
+}
 
-		message := gjson.Get(resp, "message").String()
-		if res.StatusCode != 200 || message != MessageSuccess {
-			return "", fmt.Errorf("HTTP %v: %s", res.StatusCode, message)
-		}
+// postVerify posts a verify factor request, building it each time as a request body can only be read once
+func postVerify(oc *Client, oauthToken, callbackURL string, verifyReq VerifyRequest) (int, string, error) {
+	var verifyBody bytes.Buffer
+	err := json.NewEncoder(&verifyBody).Encode(verifyReq)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "error encoding verify MFA request body")
+	}
 
-		return gjson.Get(resp, "data").String(), nil
+	req, err := http.NewRequest("POST", callbackURL, &verifyBody)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "error building token post request")
+	}
 
-	case IdentifierOneLoginProtectMfa:
-		// set the body payload to disable further push notifications (i.e. set do_not_notify to true)
-		// https://developers.onelogin.com/api-docs/2/saml-assertions/verify-factor
-		var verifyBody bytes.Buffer
-		err := json.NewEncoder(&verifyBody).Encode(VerifyRequest{AppID: appID, DeviceID: mfaDeviceID, DoNotNotify: true, StateToken: stateToken})
-		if err != nil {
-			return "", errors.New("error encoding verify MFA request body")
-		}
-		req, err := http.NewRequest("POST", callbackURL, &verifyBody)
-		if err != nil {
-			return "", errors.Wrap(err, "error building token post request")
-		}
+	addContentHeaders(req)
+	addAuthHeader(req, oauthToken)
+	res, err := oc.Client.Do(req)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "error retrieving verify response")
+	}
+	defer res.Body.Close()
 
-		addContentHeaders(req)
-		addAuthHeader(req, oauthToken)
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "error retrieving body from response")
+	}
 
-		log.Println("Waiting for approval, please check your OneLogin Protect app ...")
-		started := time.Now()
-		// loop until success, error, or timeout
-		for {
-			if time.Since(started) > time.Minute {
-				log.Println(" Timeout")
-				return "", errors.New("User did not accept MFA in time")
-			}
+	return res.StatusCode, string(body), nil
+}
 
-			logger.Debug("Verifying with OneLogin Protect")
-			res, err := oc.Client.Do(req)
-			if err != nil {
-				return "", errors.Wrap(err, "error retrieving verify response")
-			}
+// verifyOTP prompts for a code from the device and submits it
+func verifyOTP(oc *Client, ask prompter.Asker, oauthToken, appID, callbackURL, deviceID, stateToken string) (string, error) {
+	verifyCode := ask.StringRequired("Enter verification code")
 
-			body, err := io.ReadAll(res.Body)
-			if err != nil {
-				return "", errors.Wrap(err, "error retrieving body from response")
-			}
+	statusCode, resp, err := postVerify(oc, oauthToken, callbackURL, VerifyRequest{AppID: appID, DeviceID: deviceID, StateToken: stateToken, OTPToken: verifyCode})
+	if err != nil {
+		return "", err
+	}
 
-			message := gjson.Get(string(body), "message").String()
+	message := gjson.Get(resp, "message").String()
+	if statusCode != 200 || message != MessageSuccess {
+		return "", fmt.Errorf("HTTP %v: %s", statusCode, message)
+	}
 
-			// on 'error' status
-			if res.StatusCode != 200 {
-				return "", fmt.Errorf("HTTP %v: %s", res.StatusCode, message)
-			}
+	return gjson.Get(resp, "data").String(), nil
+}
 
-			switch true {
-			case strings.Contains(message, MessagePending):
-				time.Sleep(time.Second)
-				logger.Debug("Waiting for user to authorize login")
+// verifyPush polls until the OneLogin Protect push is approved, returning errPushTimeout when it isn't in time.
+// The wait between checks doubles up to PushPollMax, and doubles again whenever OneLogin throttles the checks.
+func verifyPush(oc *Client, oauthToken, appID, callbackURL, deviceID, stateToken string) (string, error) {
+	timeout := oc.PushTimeout
+	if timeout == 0 {
+		timeout = DefaultPushTimeout
+	}
+	pollInterval := oc.PushPollInterval
+	if pollInterval == 0 {
+		pollInterval = time.Second
+	}
+	pollMax := oc.PushPollMax
+	if pollMax == 0 {
+		pollMax = DefaultPushPollMax
+	}
 
-			case message == MessageSuccess:
-				log.Println(" Approved")
-				return gjson.Get(string(body), "data").String(), nil
+	// set the body payload to disable further push notifications (i.e. set do_not_notify to true)
+	// https://developers.onelogin.com/api-docs/2/saml-assertions/verify-factor
+	verifyReq := VerifyRequest{AppID: appID, DeviceID: deviceID, DoNotNotify: true, StateToken: stateToken}
 
-			default:
-				log.Println(" Error:")
-				return "", fmt.Errorf("HTTP %v: %s", res.StatusCode, message)
+	log.Println("Waiting for approval, please check your OneLogin Protect app ...")
+	deadline := time.Now().Add(timeout)
+	// loop until success, error, or timeout
+	for {
+		logger.Debug("Verifying with OneLogin Protect")
+		statusCode, resp, err := postVerify(oc, oauthToken, callbackURL, verifyReq)
+		if err != nil {
+			return "", err
+		}
+
+		message := gjson.Get(resp, "message").String()
+
+		pending := statusCode == http.StatusTooManyRequests || (statusCode == 200 && strings.Contains(message, MessagePending))
+		if pending && time.Now().After(deadline) {
+			log.Println(" Timeout")
+			return "", errPushTimeout
+		}
+
+		switch {
+		case statusCode == http.StatusTooManyRequests:
+			// throttled, so wait longer than pollMax allows before checking again
+			pollInterval *= 2
+			log.Printf("OneLogin is throttling the checks for approval, checking again in %v ...", pollInterval)
+			sleepUntil(pollInterval, deadline)
+
+		// on 'error' status
+		case statusCode != 200:
+			return "", fmt.Errorf("HTTP %v: %s", statusCode, message)
+
+		case strings.Contains(message, MessagePending):
+			logger.WithField("wait", pollInterval).Debug("Waiting for user to authorize login")
+			sleepUntil(pollInterval, deadline)
+			pollInterval *= 2
+			if pollInterval > pollMax {
+				pollInterval = pollMax
 			}
+
+		case message == MessageSuccess:
+			log.Println(" Approved")
+			return gjson.Get(resp, "data").String(), nil
+
+		default:
+			log.Println(" Error:")
+			return "", fmt.Errorf("HTTP %v: %s", statusCode, message)
 		}
 	}
+}
 
-	// catch all
-	return "", errors.New("no mfa options provided")
+// sleepUntil sleeps for wait, cut short so the last check for approval is made at the deadline
+func sleepUntil(wait time.Duration, deadline time.Time) {
+	if remaining := time.Until(deadline); remaining < wait {
+		wait = remaining
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// chooseOTPDevice asks which of the devices in the verify factor response to enter a code from
+func chooseOTPDevice(ask prompter.Asker, resp string) (string, bool) {
+	var labels, deviceIDs []string
+	for _, device := range gjson.Get(resp, "devices").Array() {
+		deviceType := device.Get("device_type").String()
+		if !otpMfaOptions[deviceType] {
+			continue
+		}
+		labels = append(labels, supportedMfaOptions[deviceType])
+		deviceIDs = append(deviceIDs, device.Get("device_id").String())
+	}
+
+	switch len(deviceIDs) {
+	case 0:
+		return "", false
+	case 1:
+		log.Printf("Push not approved, enter a code from %s instead.", labels[0])
+		return deviceIDs[0], true
+	}
+
+	option := ask.Choose("Push not approved, select a device to enter a code from", labels)
+	return deviceIDs[option], true
 }
@@ -1,10 +1,12 @@
 package onelogin_test
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/versent/saml2aws/v2/mocks"
@@ -138,3 +140,115 @@ func TestOneLoginMFA(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "saml1", resp)
 }
+
+func newPushServer(t *testing.T, approve bool, throttle int) (*httptest.Server, *[]onelogin.VerifyRequest) {
+	var verifyRequests []onelogin.VerifyRequest
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.String(), "/auth/oauth2/v2/token") {
+			_, err := w.Write([]byte(`{"access_token": "accesstoken1"}`))
+			assert.Nil(t, err)
+		} else if strings.HasPrefix(r.URL.String(), "/api/2/saml_assertion/verify_factor") {
+			var verifyReq onelogin.VerifyRequest
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&verifyReq))
+			verifyRequests = append(verifyRequests, verifyReq)
+
+			var err error
+			switch {
+			case verifyReq.DoNotNotify && throttle > 0:
+				throttle--
+				w.WriteHeader(http.StatusTooManyRequests)
+				_, err = w.Write([]byte(`{"status": {"error": true, "code": 429, "message": "Too Many Requests"}}`))
+			case verifyReq.OTPToken != "" || (approve && verifyReq.DoNotNotify):
+				_, err = w.Write([]byte(`{"message": "Success", "data": "saml1"}`))
+			case verifyReq.DoNotNotify:
+				_, err = w.Write([]byte(`{"message": "Authentication pending on OL Protect"}`))
+			default:
+				_, err = w.Write([]byte(`
+					{
+						"message": "Authentication pending on OL Protect",
+						"devices": [
+							{"device_id": 111, "device_type": "OneLogin Protect"},
+							{"device_id": 222, "device_type": "OneLogin SMS"},
+							{"device_id": 333, "device_type": "Google Authenticator"}
+						]
+					}
+					`))
+			}
+			assert.Nil(t, err)
+		} else if strings.HasPrefix(r.URL.String(), "/api/2/saml_assertion") {
+			_, err := w.Write([]byte(`
+				{
+					"message": "MFA is required for this user",
+					"state_token": "state1",
+					"devices": [{"device_id": 111, "device_type": "OneLogin Protect"}]
+				}
+				`))
+			assert.Nil(t, err)
+		} else {
+			t.Fatalf("unexpected %v", r)
+		}
+	}))
+	return svr, &verifyRequests
+}
+
+func newPushClient(t *testing.T, url string) (*onelogin.Client, *creds.LoginDetails) {
+	idpAccount := cfg.NewIDPAccount()
+	idpAccount.URL = url
+	idpAccount.MFA = "OLP"
+	idpAccount.Username = "user@example.com"
+	idpAccount.SkipVerify = true
+
+	oc, err := onelogin.New(idpAccount)
+	assert.Nil(t, err)
+	oc.PushTimeout = 50 * time.Millisecond
+	oc.PushPollInterval = 10 * time.Millisecond
+
+	return oc, &creds.LoginDetails{Username: idpAccount.Username, Password: "abc123", URL: idpAccount.URL}
+}
+
+func TestOneLoginPushApproved(t *testing.T) {
+	svr, verifyRequests := newPushServer(t, true, 0)
+	defer svr.Close()
+
+	oc, loginDetails := newPushClient(t, svr.URL)
+
+	resp, err := oc.Authenticate(loginDetails)
+	assert.Nil(t, err)
+	assert.Equal(t, "saml1", resp)
+	assert.Len(t, *verifyRequests, 2)
+	assert.True(t, (*verifyRequests)[1].DoNotNotify)
+}
+
+func TestOneLoginPushThrottled(t *testing.T) {
+	svr, verifyRequests := newPushServer(t, true, 2)
+	defer svr.Close()
+
+	oc, loginDetails := newPushClient(t, svr.URL)
+	oc.PushPollInterval = time.Millisecond
+	oc.PushTimeout = time.Second
+
+	resp, err := oc.Authenticate(loginDetails)
+	assert.Nil(t, err)
+	assert.Equal(t, "saml1", resp)
+	assert.Len(t, *verifyRequests, 4)
+}
+
+func TestOneLoginPushTimeoutFallsBackToOTP(t *testing.T) {
+	svr, verifyRequests := newPushServer(t, false, 0)
+	defer svr.Close()
+
+	oc, loginDetails := newPushClient(t, svr.URL)
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("Choose", "Push not approved, select a device to enter a code from", []string{"OLP", "TOTP"}).Return(1)
+	pr.Mock.On("StringRequired", "Enter verification code").Return("5309")
+
+	resp, err := oc.Authenticate(loginDetails)
+	assert.Nil(t, err)
+	assert.Equal(t, "saml1", resp)
+
+	last := (*verifyRequests)[len(*verifyRequests)-1]
+	assert.Equal(t, onelogin.VerifyRequest{DeviceID: "333", OTPToken: "5309", StateToken: "state1"}, last)
+	pr.AssertExpectations(t)
+}
@@ -8,6 +8,9 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
@@ -23,6 +26,15 @@ import (
 
 var logger = logrus.WithField("provider", "pingfed")
 
+// retryBaseDelay the first wait before retrying a gateway error, doubled for each attempt after
+var retryBaseDelay = 500 * time.Millisecond
+
+// swipePollInterval the wait between checks for a PingID push approval, until the server asks for another
+var swipePollInterval = 3 * time.Second
+
+// swipeReminderInterval how often the number to select is repeated while waiting for a PingID push approval
+var swipeReminderInterval = 30 * time.Second
+
 // Client wrapper around PingFed + PingId enabling authentication and retrieval of assertions
 type Client struct {
 	provider.ValidateBase
@@ -36,7 +48,12 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -45,6 +62,11 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 	// this is to avoid have explicit checks for every single response
 	client.CheckResponseStatus = provider.SuccessOrRedirectOrUnauthorizedResponseValidator
 
+	// timeout is in milliseconds as for the Browser provider
+	if idpAccount.Timeout > 0 {
+		client.Timeout = time.Duration(idpAccount.Timeout) * time.Millisecond
+	}
+
 	return &Client{
 		client:     client,
 		idpAccount: idpAccount,
@@ -53,6 +75,14 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 type ctxKey string
 
+// asker asks the user through the prompter of the login in the context
+func asker(ctx context.Context) prompter.Asker {
+	if loginDetails, ok := ctx.Value(ctxKey("login")).(*creds.LoginDetails); ok {
+		return loginDetails.Asker()
+	}
+	return prompter.Asker{}
+}
+
 // Authenticate Authenticate to PingFed and return the data from the body of the SAML assertion.
 func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
 	u := fmt.Sprintf("%s/idp/startSSO.ping?PartnerSpId=%s", loginDetails.URL, ac.idpAccount.AmazonWebservicesURN)
@@ -64,8 +94,46 @@ func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 	return ac.follow(ctx, req)
 }
 
+// do sends the request, retrying the gateway errors a load balancer in front of PingFederate returns while
+// it is briefly unavailable. Attempts and the longest delay come from the account http settings.
+func (ac *Client) do(req *http.Request) (*http.Response, error) {
+	attempts := uint(1)
+	maxDelay := provider.DefaultRetryDelay
+	if ac.client.Options != nil {
+		attempts = ac.client.Options.AttemptsCount
+		maxDelay = ac.client.Options.RetryDelay
+	}
+
+	delay := retryBaseDelay
+	for attempt := uint(1); ; attempt++ {
+		res, err := ac.client.Do(req)
+		if res == nil || !isGatewayError(res.StatusCode) || attempt >= attempts {
+			return res, err
+		}
+		res.Body.Close()
+
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		log.Printf("PingFederate returned %s, retrying in %s (attempt %d of %d) ...", res.Status, delay, attempt+1, attempts)
+		time.Sleep(delay)
+		delay *= 2
+
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "error rewinding request body")
+			}
+		}
+	}
+}
+
+func isGatewayError(statusCode int) bool {
+	return statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+}
+
 func (ac *Client) follow(ctx context.Context, req *http.Request) (string, error) {
-	res, err := ac.client.Do(req)
+	res, err := ac.do(req)
 	if err != nil {
 		return "", errors.Wrap(err, "error following")
 	}
@@ -101,6 +169,9 @@ func (ac *Client) follow(ctx context.Context, req *http.Request) (string, error)
 	} else if docIsOTP(doc) {
 		logger.WithField("type", "otp").Debug("doc detect")
 		handler = ac.handleOTP
+	} else if docIsDeviceSelection(doc) {
+		logger.WithField("type", "device-selection").Debug("doc detect")
+		handler = ac.handleDeviceSelection
 	} else if docIsSwipe(doc) {
 		logger.WithField("type", "swipe").Debug("doc detect")
 		handler = ac.handleSwipe
@@ -161,19 +232,39 @@ func (ac *Client) handleOTP(ctx context.Context, doc *goquery.Document, requestU
 		}
 	}
 
-	token := prompter.StringRequired("Enter passcode")
+	token := asker(ctx).StringRequired("Enter passcode")
 	form.Values.Set("otp", token)
 	req, err := form.BuildRequest()
 	return ctx, req, err
 }
 
-func (ac *Client) handleSwipe(ctx context.Context, doc *goquery.Document, _ *url.URL) (context.Context, *http.Request, error) {
+func (ac *Client) handleSwipe(ctx context.Context, doc *goquery.Document, requestURL *url.URL) (context.Context, *http.Request, error) {
 	form, err := page.NewFormFromDocument(doc, "#form1")
 	if err != nil {
 		return ctx, nil, errors.Wrap(err, "error extracting swipe status form")
 	}
 
-	if number := doc.Find("div.numbermatching").Text(); number != "" {
+	// the widget lists the user's devices when there are several, make sure the push goes to the right one
+	if _, chosen := ctx.Value(ctxKey("device")).(pingDevice); !chosen && docHasDevices(doc) {
+		device, err := ac.chooseDevice(ctx, doc)
+		if err != nil {
+			return ctx, nil, err
+		}
+		ctx = context.WithValue(ctx, ctxKey("device"), device)
+
+		if !device.Selected {
+			changeDevice, ok := doc.Find("a[href$=\"/pingid/ppm/devices\"]").Attr("href")
+			if !ok {
+				return ctx, nil, fmt.Errorf("no link to change the PingID device to %s", device.label())
+			}
+			log.Printf("Switching PingID device to %s ...\n", device.label())
+			req, err := http.NewRequest("GET", makeAbsoluteURL(changeDevice, baseURL(form.URL, requestURL)), nil)
+			return ctx, req, err
+		}
+	}
+
+	number := doc.Find("div.numbermatching").Text()
+	if number != "" {
 		log.Printf("Select %v in your PingID mobile app ...\n", number)
 	}
 
@@ -184,15 +275,33 @@ func (ac *Client) handleSwipe(ctx context.Context, doc *goquery.Document, _ *url
 		return ctx, nil, err
 	}
 
+	// stop polling on Ctrl-C, the in flight request is cancelled along with the wait
+	pollCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	req = req.WithContext(pollCtx)
+
+	interval := swipePollInterval
+	lastReminder := time.Now()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
 	for {
-		time.Sleep(3 * time.Second)
+		select {
+		case <-pollCtx.Done():
+			return ctx, nil, errors.New("PingID authentication cancelled")
+		case <-timer.C:
+		}
 
-		res, err := ac.client.Do(req)
+		res, err := ac.do(req)
 		if err != nil {
+			if pollCtx.Err() != nil {
+				return ctx, nil, errors.New("PingID authentication cancelled")
+			}
 			return ctx, nil, errors.Wrap(err, "error polling swipe status")
 		}
 
 		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
 		if err != nil {
 			return ctx, nil, errors.Wrap(err, "error parsing body from swipe status response")
 		}
@@ -203,12 +312,27 @@ func (ac *Client) handleSwipe(ctx context.Context, doc *goquery.Document, _ *url
 
 		//ASYNC_AUTH_WAIT indicates we keep going
 		//OK indicates someone swiped
-		//DEVICE_CLAIM_TIMEOUT indicates nobody swiped
-		//otherwise loop forever?
+		//DEVICE_CLAIM_TIMEOUT and TIMEOUT indicate nobody swiped
 
-		if pingfedMFAStatusResponse == "OK" || pingfedMFAStatusResponse == "DEVICE_CLAIM_TIMEOUT" || pingfedMFAStatusResponse == "TIMEOUT" {
+		if pingfedMFAStatusResponse == "OK" {
+			break
+		}
+		if pingfedMFAStatusResponse == "DEVICE_CLAIM_TIMEOUT" || pingfedMFAStatusResponse == "TIMEOUT" {
+			if useCode, ok := doc.Find("input#useCodeUrl").Attr("value"); ok && useCode != "" {
+				return ac.useCode(ctx, form, useCode, requestURL)
+			}
 			break
 		}
+
+		// the server slows the polling down when it is busy, pollingInterval is in milliseconds
+		if ms := gjson.Get(resp, "pollingInterval").Int(); ms > 0 {
+			interval = time.Duration(ms) * time.Millisecond
+		}
+		if number != "" && time.Since(lastReminder) >= swipeReminderInterval {
+			log.Printf("Still waiting, select %v in your PingID mobile app ...\n", number)
+			lastReminder = time.Now()
+		}
+		timer.Reset(interval)
 	}
 
 	// now build a request for getting response of MFA
@@ -220,6 +344,138 @@ func (ac *Client) handleSwipe(ctx context.Context, doc *goquery.Document, _ *url
 	return ctx, req, err
 }
 
+// useCode asks PingID for the passcode page once nobody answered the push in time, it is handled by handleOTP
+func (ac *Client) useCode(ctx context.Context, statusForm *page.Form, useCode string, requestURL *url.URL) (context.Context, *http.Request, error) {
+	log.Println("PingID push timed out, falling back to a passcode ...")
+
+	form := &page.Form{
+		URL:    makeAbsoluteURL(useCode, baseURL(statusForm.URL, requestURL)),
+		Method: "POST",
+		Values: &url.Values{},
+	}
+	form.Values.Set("csrfToken", statusForm.Values.Get("csrfToken"))
+	req, err := form.BuildRequest()
+	return ctx, req, err
+}
+
+func (ac *Client) handleDeviceSelection(ctx context.Context, doc *goquery.Document, requestURL *url.URL) (context.Context, *http.Request, error) {
+	form, err := page.NewFormFromDocument(doc, "#device-form")
+	if err != nil {
+		return ctx, nil, errors.Wrap(err, "error extracting device selection form")
+	}
+
+	// the device may already have been picked from the list on the swipe page
+	device, chosen := ctx.Value(ctxKey("device")).(pingDevice)
+	if !chosen {
+		device, err = ac.chooseDevice(ctx, doc)
+		if err != nil {
+			return ctx, nil, err
+		}
+		ctx = context.WithValue(ctx, ctxKey("device"), device)
+	}
+
+	form.Values.Set("deviceId", device.ID)
+	form.URL = makeAbsoluteURL(form.URL, baseURL(form.URL, requestURL))
+	req, err := form.BuildRequest()
+	return ctx, req, err
+}
+
+// chooseDevice picks the device to authenticate with from the ones listed in the page, ping_device pins it
+// and otherwise the user is asked when more than one is active
+func (ac *Client) chooseDevice(ctx context.Context, doc *goquery.Document) (pingDevice, error) {
+	devices, err := extractDevices(doc)
+	if err != nil {
+		return pingDevice{}, err
+	}
+
+	pinned := ""
+	if ac.idpAccount != nil {
+		pinned = ac.idpAccount.PingDevice
+	}
+	return selectDevice(asker(ctx), devices, pinned)
+}
+
+// pingDevice a device registered with PingID, as listed in the JSON payload of the PingID widget
+type pingDevice struct {
+	ID       string
+	Name     string
+	Nickname string
+	Active   bool
+	Selected bool
+}
+
+func (d pingDevice) label() string {
+	if d.Nickname == "" || d.Nickname == d.Name {
+		return d.Name
+	}
+	return fmt.Sprintf("%s (%s)", d.Nickname, d.Name)
+}
+
+func (d pingDevice) matches(name string) bool {
+	return strings.EqualFold(d.ID, name) || strings.EqualFold(d.Name, name) || strings.EqualFold(d.Nickname, name)
+}
+
+func extractDevices(doc *goquery.Document) ([]pingDevice, error) {
+	payload := doc.Find("script#devicesJson").Text()
+	if !gjson.Valid(payload) {
+		return nil, errors.New("error parsing PingID devices payload")
+	}
+
+	devices := []pingDevice{}
+	gjson.Get(payload, "devices").ForEach(func(_, d gjson.Result) bool {
+		active := d.Get("active")
+		devices = append(devices, pingDevice{
+			ID:       d.Get("id").String(),
+			Name:     d.Get("name").String(),
+			Nickname: d.Get("nickname").String(),
+			Active:   !active.Exists() || active.Bool(),
+			Selected: d.Get("selected").Bool(),
+		})
+		return true
+	})
+	return devices, nil
+}
+
+func selectDevice(ask prompter.Asker, devices []pingDevice, pinned string) (pingDevice, error) {
+	active := []pingDevice{}
+	for _, d := range devices {
+		if d.Active {
+			active = append(active, d)
+		}
+	}
+	if len(active) == 0 {
+		return pingDevice{}, errors.New("no active PingID devices to authenticate with")
+	}
+
+	labels := make([]string, len(active))
+	for i, d := range active {
+		labels[i] = d.label()
+	}
+
+	if pinned != "" {
+		for _, d := range active {
+			if d.matches(pinned) {
+				return d, nil
+			}
+		}
+		return pingDevice{}, fmt.Errorf("ping_device %q is not one of the active PingID devices: %s", pinned, strings.Join(labels, ", "))
+	}
+
+	if len(active) == 1 {
+		return active[0], nil
+	}
+	return active[ask.Choose("Select a PingID device", labels)], nil
+}
+
+// baseURL the scheme and host relative links in PingID pages resolve against, taken from the form action
+// when it is absolute and otherwise from the page
+func baseURL(action string, requestURL *url.URL) string {
+	if u, err := url.Parse(action); err == nil && u.IsAbs() {
+		return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+	}
+	return fmt.Sprintf("%s://%s", requestURL.Scheme, requestURL.Host)
+}
+
 func (ac *Client) handleRefresh(ctx context.Context, doc *goquery.Document, _ *url.URL) (context.Context, *http.Request, error) {
 	loginDetails, ok := ctx.Value(ctxKey("login")).(*creds.LoginDetails)
 	if !ok {
@@ -266,6 +522,14 @@ func docIsSwipe(doc *goquery.Document) bool {
 	return doc.Has("form#form1").Size() == 1 && doc.Has("form#reponseView").Size() == 1
 }
 
+func docIsDeviceSelection(doc *goquery.Document) bool {
+	return doc.Has("form#device-form").Size() == 1
+}
+
+func docHasDevices(doc *goquery.Document) bool {
+	return doc.Has("script#devicesJson").Size() == 1
+}
+
 func docIsFormRedirect(doc *goquery.Document) bool {
 	return doc.Has("input[name=\"ppm_request\"]").Size() == 1
 }
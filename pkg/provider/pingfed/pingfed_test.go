@@ -17,6 +17,7 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	"github.com/stretchr/testify/require"
 	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 	"github.com/versent/saml2aws/v2/pkg/provider"
@@ -63,6 +64,11 @@ var docTests = []struct {
 	{docIsWebAuthn, "example/swipe-number.html", false},
 	{docIsWebAuthn, "example/form-redirect.html", false},
 	{docIsWebAuthn, "example/webauthn.html", true},
+	{docIsDeviceSelection, "example/devices.html", true},
+	{docIsDeviceSelection, "example/swipe-devices.html", false},
+	{docIsDeviceSelection, "example/login.html", false},
+	{docIsSwipe, "example/swipe-devices.html", true},
+	{docIsSwipe, "example/devices.html", false},
 }
 
 func TestDocTypes(t *testing.T) {
@@ -196,6 +202,148 @@ func TestHandleSwipe(t *testing.T) {
 	})
 }
 
+func TestHandleSwipeFallsBackToPasscode(t *testing.T) {
+	swipePollInterval = time.Millisecond
+
+	polls := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pingid/ppm/auth/status":
+			polls++
+			status := "{\"status\":\"ASYNC_AUTH_WAIT\",\"pollingInterval\":5}"
+			if polls == 3 {
+				status = "{\"status\":\"DEVICE_CLAIM_TIMEOUT\"}"
+			}
+			_, err := w.Write([]byte(status))
+			require.Nil(t, err)
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	data, err := os.ReadFile("example/swipe-number.html")
+	require.Nil(t, err)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(bytes.ReplaceAll(data, []byte("https://authenticator.pingone.com"), []byte(ts.URL))))
+	require.Nil(t, err)
+
+	testTransport := http.DefaultTransport.(*http.Transport).Clone()
+	testTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	ac := Client{
+		client: &provider.HTTPClient{Client: http.Client{Transport: testTransport}, Options: &provider.HTTPClientOptions{IsWithRetries: false}},
+	}
+
+	_, req, err := ac.handleSwipe(context.Background(), doc, &url.URL{})
+	require.Nil(t, err)
+	require.Equal(t, 3, polls)
+	require.Equal(t, "POST", req.Method)
+	require.Equal(t, ts.URL+"/pingid/ppm/auth/usecode", req.URL.String())
+
+	b, err := io.ReadAll(req.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(b), "csrfToken=abdb4264-6aab-4e1a-a830-63c9188e2395")
+}
+
+func TestHandleSwipeCancelled(t *testing.T) {
+	swipePollInterval = time.Hour
+
+	data, err := os.ReadFile("example/swipe-number.html")
+	require.Nil(t, err)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ac := Client{client: &provider.HTTPClient{Options: &provider.HTTPClientOptions{IsWithRetries: false}}}
+	_, _, err = ac.handleSwipe(ctx, doc, &url.URL{})
+	require.EqualError(t, err, "PingID authentication cancelled")
+}
+
+func TestHandleSwipeChangesDevice(t *testing.T) {
+	data, err := os.ReadFile("example/swipe-devices.html")
+	require.Nil(t, err)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	ac := Client{idpAccount: &cfg.IDPAccount{PingDevice: "work phone"}}
+	ctx, req, err := ac.handleSwipe(context.Background(), doc, &url.URL{})
+	require.Nil(t, err)
+	require.Equal(t, "GET", req.Method)
+	require.Equal(t, "https://authenticator.pingone.com/pingid/ppm/devices", req.URL.String())
+
+	data, err = os.ReadFile("example/devices.html")
+	require.Nil(t, err)
+	doc, err = goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	// the device chosen on the swipe page is submitted without asking again
+	ac.idpAccount.PingDevice = ""
+	_, req, err = ac.handleDeviceSelection(ctx, doc, &url.URL{Scheme: "https", Host: "authenticator.pingone.com"})
+	require.Nil(t, err)
+	require.Equal(t, "https://authenticator.pingone.com/pingid/ppm/devices/select", req.URL.String())
+
+	b, err := io.ReadAll(req.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(b), "deviceId=c3e97f52")
+	require.Contains(t, string(b), "csrfToken=abdb4264-6aab-4e1a-a830-63c9188e2395")
+}
+
+func TestSelectDevice(t *testing.T) {
+	devices := []pingDevice{
+		{ID: "5f2c7a1e", Name: "iPhone 6", Nickname: "Old phone"},
+		{ID: "8d41b09c", Name: "iPhone X", Active: true, Selected: true},
+		{ID: "c3e97f52", Name: "Pixel 7", Nickname: "Work phone", Active: true},
+	}
+
+	t.Run("Pinned", func(t *testing.T) {
+		device, err := selectDevice(prompter.Asker{}, devices, "Pixel 7")
+		require.Nil(t, err)
+		require.Equal(t, "c3e97f52", device.ID)
+	})
+
+	t.Run("Pinned inactive", func(t *testing.T) {
+		_, err := selectDevice(prompter.Asker{}, devices, "Old phone")
+		require.EqualError(t, err, "ping_device \"Old phone\" is not one of the active PingID devices: iPhone X, Work phone (Pixel 7)")
+	})
+
+	t.Run("Prompted", func(t *testing.T) {
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("Choose", "Select a PingID device", []string{"iPhone X", "Work phone (Pixel 7)"}).Return(1)
+
+		device, err := selectDevice(prompter.Asker{}, devices, "")
+		require.Nil(t, err)
+		require.Equal(t, "c3e97f52", device.ID)
+	})
+
+	t.Run("Only active device", func(t *testing.T) {
+		device, err := selectDevice(prompter.Asker{}, devices[:2], "")
+		require.Nil(t, err)
+		require.Equal(t, "8d41b09c", device.ID)
+	})
+
+	t.Run("No active device", func(t *testing.T) {
+		_, err := selectDevice(prompter.Asker{}, devices[:1], "")
+		require.EqualError(t, err, "no active PingID devices to authenticate with")
+	})
+}
+
+func TestExtractDevices(t *testing.T) {
+	data, err := os.ReadFile("example/devices.html")
+	require.Nil(t, err)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	devices, err := extractDevices(doc)
+	require.Nil(t, err)
+	require.Equal(t, []pingDevice{
+		{ID: "5f2c7a1e", Name: "iPhone 6", Nickname: "Old phone"},
+		{ID: "8d41b09c", Name: "iPhone X", Active: true, Selected: true},
+		{ID: "c3e97f52", Name: "Pixel 7", Nickname: "Work phone", Active: true},
+	}, devices)
+}
+
 func TestHandleFormRedirect(t *testing.T) {
 	data, err := os.ReadFile("example/form-redirect.html")
 	require.Nil(t, err)
@@ -232,3 +380,77 @@ func TestHandleWebAuthn(t *testing.T) {
 	s := string(b[:])
 	require.Contains(t, s, "isWebAuthnSupportedByBrowser=false")
 }
+
+func TestDoRetriesGatewayErrors(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+
+	statuses := []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}
+	var bodies []string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		bodies = append(bodies, string(b))
+
+		status := statuses[0]
+		statuses = statuses[1:]
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	testTransport := http.DefaultTransport.(*http.Transport).Clone()
+	testTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	ac := Client{
+		client: &provider.HTTPClient{
+			Client:              http.Client{Transport: testTransport},
+			CheckResponseStatus: provider.SuccessOrRedirectOrUnauthorizedResponseValidator,
+			Options:             &provider.HTTPClientOptions{AttemptsCount: 3, RetryDelay: 2 * time.Millisecond},
+		},
+	}
+
+	req, err := http.NewRequest("POST", ts.URL, bytes.NewBufferString("pf.username=user"))
+	require.Nil(t, err)
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	res, err := ac.do(req)
+	log.SetOutput(os.Stderr)
+
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, []string{"pf.username=user", "pf.username=user", "pf.username=user"}, bodies)
+	require.Contains(t, out.String(), "retrying in 1ms (attempt 2 of 3)")
+	require.Contains(t, out.String(), "retrying in 2ms (attempt 3 of 3)")
+}
+
+func TestDoGivesUpOnGatewayErrors(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+
+	for status, expectedCalls := range map[int]int{http.StatusBadGateway: 2, http.StatusNotFound: 1} {
+		calls := 0
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(status)
+		}))
+
+		testTransport := http.DefaultTransport.(*http.Transport).Clone()
+		testTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		ac := Client{
+			client: &provider.HTTPClient{
+				Client:              http.Client{Transport: testTransport},
+				CheckResponseStatus: provider.SuccessOrRedirectOrUnauthorizedResponseValidator,
+				Options:             &provider.HTTPClientOptions{AttemptsCount: 2, RetryDelay: time.Millisecond},
+			},
+		}
+
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		require.Nil(t, err)
+
+		log.SetOutput(io.Discard)
+		_, err = ac.do(req)
+		log.SetOutput(os.Stderr)
+
+		require.Error(t, err)
+		require.Equal(t, expectedCalls, calls, status)
+		ts.Close()
+	}
+}
@@ -40,10 +40,16 @@ type Client struct {
 // New create a new PingFed client
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
+	tlsConfig, err := provider.NewTLSConfig(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Renegotiation = tls.RenegotiateFreelyAsClient
+
 	transport := &ntlmssp.Negotiator{
 		RoundTripper: &http.Transport{
-			Proxy:           http.ProxyFromEnvironment,
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: idpAccount.SkipVerify, Renegotiation: tls.RenegotiateFreelyAsClient},
+			Proxy:           provider.ProxyFromAccount(idpAccount),
+			TLSClientConfig: tlsConfig,
 		},
 	}
 
@@ -71,6 +77,14 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 type ctxKey string
 
+// asker asks the user through the prompter of the login in the context
+func asker(ctx context.Context) prompter.Asker {
+	if loginDetails, ok := ctx.Value(ctxKey("login")).(*creds.LoginDetails); ok {
+		return loginDetails.Asker()
+	}
+	return prompter.Asker{}
+}
+
 // Authenticate Authenticate to PingFed and return the data from the body of the SAML assertion.
 func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
 	ac.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
@@ -78,11 +92,16 @@ func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 		return nil
 	}
 
+	tlsConfig, err := provider.NewTLSConfig(ac.idpAccount)
+	if err != nil {
+		return "", err
+	}
+	tlsConfig.InsecureSkipVerify = true
+
 	ac.client.Transport = ntlmssp.Negotiator{
 		RoundTripper: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+			Proxy:           provider.ProxyFromAccount(ac.idpAccount),
+			TLSClientConfig: tlsConfig,
 		},
 	}
 
@@ -185,7 +204,7 @@ func (ac *Client) handleOTP(ctx context.Context, doc *goquery.Document) (context
 		return ctx, nil, errors.Wrap(err, "error extracting OTP form")
 	}
 
-	token := prompter.StringRequired("Enter passcode")
+	token := asker(ctx).StringRequired("Enter passcode")
 	form.Values.Set("otp", token)
 	req, err := form.BuildRequest()
 	return ctx, req, err
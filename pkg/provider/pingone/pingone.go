@@ -35,7 +35,12 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -52,6 +57,14 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 type ctxKey string
 
+// asker asks the user through the prompter of the login in the context
+func asker(ctx context.Context) prompter.Asker {
+	if loginDetails, ok := ctx.Value(ctxKey("login")).(*creds.LoginDetails); ok {
+		return loginDetails.Asker()
+	}
+	return prompter.Asker{}
+}
+
 // Authenticate Authenticate to PingOne and return the data from the body of the SAML assertion.
 func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
 	req, err := http.NewRequest("GET", loginDetails.URL, nil)
@@ -169,7 +182,7 @@ func (ac *Client) handleOTP(ctx context.Context, doc *goquery.Document, _ *http.
 		return ctx, nil, errors.Wrap(err, "error extracting OTP form")
 	}
 
-	token := prompter.StringRequired("Enter passcode")
+	token := asker(ctx).StringRequired("Enter passcode")
 	form.Values.Set("otp", token)
 	req, err := form.BuildRequest()
 	return ctx, req, err
@@ -255,7 +268,7 @@ func (ac *Client) handleFormSelectDevice(ctx context.Context, doc *goquery.Docum
 		deviceNameList[i] = key
 		i++
 	}
-	var chooseDevice = prompter.Choose("Select which MFA Device to use", deviceNameList)
+	var chooseDevice = asker(ctx).Choose("Select which MFA Device to use", deviceNameList)
 
 	form, err := page.NewFormFromDocument(doc, "")
 	if err != nil {
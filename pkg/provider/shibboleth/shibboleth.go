@@ -3,21 +3,15 @@ package shibboleth
 import (
 	"crypto/tls"
 	"fmt"
-	"html"
-	"io"
-	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
-	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/pkg/errors"
-	"github.com/tidwall/gjson"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
-	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/duo"
 	"github.com/versent/saml2aws/v2/pkg/provider"
 )
 
@@ -37,7 +31,12 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: idpAccount.SkipVerify, Renegotiation: tls.RenegotiateFreelyAsClient},
 	}
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -48,6 +47,11 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 	}, nil
 }
 
+// LoginPageMarkers the login form the username and password are posted to
+func (sc *Client) LoginPageMarkers() []provider.PageMarker {
+	return provider.UsernamePasswordMarkers
+}
+
 // Authenticate authenticate to Shibboleth and return the data from the body of the SAML assertion.
 func (sc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
 
@@ -98,20 +102,19 @@ func (sc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error)
 		return samlAssertion, errors.Wrap(err, "error retrieving login form results")
 	}
 
-	switch sc.idpAccount.MFA {
-	case "Auto":
-		b, _ := io.ReadAll(res.Body)
+	doc, err = documentFromResponse(res)
+	if err != nil {
+		return samlAssertion, err
+	}
 
-		mfaRes, err := verifyMfa(sc, loginDetails, loginDetails.URL, string(b))
+	if sc.idpAccount.MFA == "Auto" {
+		doc, err = sc.verifyDuo(doc, loginDetails)
 		if err != nil {
-			return mfaRes.Status, errors.Wrap(err, "error verifying MFA")
+			return samlAssertion, errors.Wrap(err, "error verifying MFA")
 		}
-
-		res = mfaRes
-
 	}
 
-	samlAssertion, err = extractSamlResponse(res)
+	samlAssertion, err = extractSamlResponse(doc)
 	if err != nil {
 		return samlAssertion, errors.Wrap(err, "error extracting SAMLResponse blob from final Shibboleth response")
 	}
@@ -143,21 +146,43 @@ func updateFormData(authForm url.Values, s *goquery.Selection, user *creds.Login
 	}
 }
 
-func verifyMfa(oc *Client, loginDetails *creds.LoginDetails, shibbolethHost string, resp string) (*http.Response, error) {
+// verifyDuo answers the Duo prompt the IdP shows after the password, the traditional iframe or the Universal
+// Prompt it redirects to, and returns the page the IdP continues with. Pages without Duo are returned as is.
+func (sc *Client) verifyDuo(doc *goquery.Document, loginDetails *creds.LoginDetails) (*goquery.Document, error) {
+	prompt := duo.New(sc.client, duo.Options{
+		Device:   sc.idpAccount.DuoDevice,
+		Factor:   loginDetails.DuoMFAOption,
+		Passcode: loginDetails.MFAToken,
+		Prompter: loginDetails.Prompter,
+	})
+
+	if duo.IsUniversalPrompt(doc) {
+		callback, err := prompt.VerifyUniversalPrompt(doc)
+		if err != nil {
+			return nil, errors.Wrap(err, "error when interacting with Duo Universal Prompt")
+		}
+		return sc.get(callback.URL)
+	}
 
-	duoHost, postAction, tx, app, csrfToken := parseTokens(resp)
+	frame, ok := duo.FrameFromDocument(doc)
+	if !ok {
+		return doc, nil
+	}
 
-	parent := fmt.Sprintf(shibbolethHost + postAction)
+	parent := resolveURL(doc.Url, frame.PostAction)
 
-	duoTxCookie, err := verifyDuoMfa(oc, loginDetails, duoHost, parent, tx)
+	sigResponse, err := prompt.VerifyFrame(frame, parent)
 	if err != nil {
 		return nil, errors.Wrap(err, "error when interacting with Duo iframe")
 	}
 
 	idpForm := url.Values{}
 	idpForm.Add("_eventId", "proceed")
-	idpForm.Add("sig_response", duoTxCookie+":"+app)
-	idpForm.Add("csrf_token", csrfToken)
+	idpForm.Add(frame.PostArgument, sigResponse)
+	// the CSRF token of Shibboleth v4, if present
+	if csrfToken, ok := doc.Find("input[name=\"csrf_token\"]").Attr("value"); ok {
+		idpForm.Add("csrf_token", csrfToken)
+	}
 
 	req, err := http.NewRequest("POST", parent, strings.NewReader(idpForm.Encode()))
 	if err != nil {
@@ -166,256 +191,47 @@ func verifyMfa(oc *Client, loginDetails *creds.LoginDetails, shibbolethHost stri
 
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	res, err := oc.client.Do(req)
+	res, err := sc.client.Do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "error retrieving verify response")
 	}
 
-	return res, nil
+	return documentFromResponse(res)
 }
 
-func verifyDuoMfa(oc *Client, loginDetails *creds.LoginDetails, duoHost string, parent string, tx string) (string, error) {
-	// initiate duo mfa to get sid
-	duoSubmitURL := fmt.Sprintf("https://%s/frame/web/v1/auth", duoHost)
-
-	duoForm := url.Values{}
-	duoForm.Add("parent", parent)
-	duoForm.Add("java_version", "")
-	duoForm.Add("java_version", "")
-	duoForm.Add("flash_version", "")
-	duoForm.Add("screen_resolution_width", "3008")
-	duoForm.Add("screen_resolution_height", "1692")
-	duoForm.Add("color_depth", "24")
-
-	req, err := http.NewRequest("POST", duoSubmitURL, strings.NewReader(duoForm.Encode()))
+func (sc *Client) get(u string) (*goquery.Document, error) {
+	res, err := sc.client.Get(u)
 	if err != nil {
-		return "", errors.Wrap(err, "error building authentication request")
+		return nil, errors.Wrap(err, "error retrieving Duo callback")
 	}
-	q := req.URL.Query()
-	q.Add("tx", tx)
-	req.URL.RawQuery = q.Encode()
 
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Accept-Language", "en-us,en;q=0.5")
+	return documentFromResponse(res)
+}
 
-	res, err := oc.client.Do(req)
-	if err != nil {
-		return "", errors.Wrap(err, "error retrieving verify response")
-	}
+func documentFromResponse(res *http.Response) (*goquery.Document, error) {
+	defer res.Body.Close()
 
-	// retrieve response from post
 	doc, err := goquery.NewDocumentFromReader(res.Body)
 	if err != nil {
-		return "", errors.Wrap(err, "error parsing document")
-	}
-
-	// Duo cookie is returned here if mfa bypassed - immediatly return it if found
-	duoTxCookie, ok := doc.Find("input[name=\"js_cookie\"]").Attr("value")
-	if ok {
-		if duoTxCookie == "" {
-			return "", errors.Wrap(err, "duoMfaBypass: invalid response cookie")
-		}
-		return duoTxCookie, nil
-	}
-
-	// Duo cookie not found - continue with full MFA transaction
-	duoSID, ok := doc.Find("input[name=\"sid\"]").Attr("value")
-	if !ok {
-		return "", errors.Wrap(err, "unable to locate saml response")
-	}
-	duoSID = html.UnescapeString(duoSID)
-
-	//prompt for mfa type
-	//supporting push, call, and passcode for now
-
-	var token string
-
-	var duoMfaOptions = []string{
-		"Duo Push",
-		"Phone Call",
-		"Passcode",
-	}
-
-	duoMfaOption := 0
-
-	if loginDetails.DuoMFAOption == "Duo Push" {
-		duoMfaOption = 0
-	} else if loginDetails.DuoMFAOption == "Phone Call" {
-		duoMfaOption = 1
-	} else if loginDetails.DuoMFAOption == "Passcode" {
-		duoMfaOption = 2
-	} else {
-		duoMfaOption = prompter.Choose("Select a DUO MFA Option", duoMfaOptions)
-	}
-
-	if duoMfaOptions[duoMfaOption] == "Passcode" {
-		//get users DUO MFA Token
-		token = prompter.StringRequired("Enter passcode")
-	}
-
-	// send mfa auth request
-	duoSubmitURL = fmt.Sprintf("https://%s/frame/prompt", duoHost)
-
-	duoForm = url.Values{}
-	duoForm.Add("sid", duoSID)
-	duoForm.Add("device", "phone1")
-	duoForm.Add("factor", duoMfaOptions[duoMfaOption])
-	duoForm.Add("out_of_date", "false")
-	if duoMfaOptions[duoMfaOption] == "Passcode" {
-		duoForm.Add("passcode", token)
-	}
-
-	req, err = http.NewRequest("POST", duoSubmitURL, strings.NewReader(duoForm.Encode()))
-	if err != nil {
-		return "", errors.Wrap(err, "error building authentication request")
-	}
-
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err = oc.client.Do(req)
-	if err != nil {
-		return "", errors.Wrap(err, "error retrieving verify response")
-	}
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return "", errors.Wrap(err, "error retrieving body from response")
-	}
-
-	resp := string(body)
-
-	duoTxStat := gjson.Get(resp, "stat").String()
-	duoTxID := gjson.Get(resp, "response.txid").String()
-	if duoTxStat != "OK" {
-		return "", errors.Wrap(err, "error authenticating mfa device")
-	}
-
-	// get duo cookie
-	duoSubmitURL = fmt.Sprintf("https://%s/frame/status", duoHost)
-
-	duoForm = url.Values{}
-	duoForm.Add("sid", duoSID)
-	duoForm.Add("txid", duoTxID)
-
-	req, err = http.NewRequest("POST", duoSubmitURL, strings.NewReader(duoForm.Encode()))
-	if err != nil {
-		return "", errors.Wrap(err, "error building authentication request")
-	}
-
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err = oc.client.Do(req)
-	if err != nil {
-		return "", errors.Wrap(err, "error retrieving verify response")
-	}
-
-	body, err = io.ReadAll(res.Body)
-	if err != nil {
-		return "", errors.Wrap(err, "error retrieving body from response")
-	}
-
-	resp = string(body)
-
-	duoTxResult := gjson.Get(resp, "response.result").String()
-	duoResultURL := gjson.Get(resp, "response.result_url").String()
-
-	log.Println(gjson.Get(resp, "response.status").String())
-
-	if duoTxResult != "SUCCESS" {
-		//poll as this is likely a push request
-		for {
-			time.Sleep(3 * time.Second)
-
-			req, err = http.NewRequest("POST", duoSubmitURL, strings.NewReader(duoForm.Encode()))
-			if err != nil {
-				return "", errors.Wrap(err, "error building authentication request")
-			}
-
-			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-			res, err = oc.client.Do(req)
-			if err != nil {
-				return "", errors.Wrap(err, "error retrieving verify response")
-			}
-
-			body, err = io.ReadAll(res.Body)
-			if err != nil {
-				return "", errors.Wrap(err, "error retrieving body from response")
-			}
-
-			resp := string(body)
-
-			duoTxResult = gjson.Get(resp, "response.result").String()
-			duoResultURL = gjson.Get(resp, "response.result_url").String()
-
-			log.Println(gjson.Get(resp, "response.status").String())
-
-			if duoTxResult == "FAILURE" {
-				return "", errors.Wrap(err, "failed to authenticate device")
-			}
-
-			if duoTxResult == "SUCCESS" {
-				break
-			}
-		}
-	}
-
-	duoRequestURL := fmt.Sprintf("https://%s%s", duoHost, duoResultURL)
-	req, err = http.NewRequest("POST", duoRequestURL, strings.NewReader(duoForm.Encode()))
-	if err != nil {
-		return "", errors.Wrap(err, "error constructing request object to result url")
-	}
-
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err = oc.client.Do(req)
-	if err != nil {
-		return "", errors.Wrap(err, "error retrieving duo result response")
-	}
-
-	body, err = io.ReadAll(res.Body)
-	if err != nil {
-		return "", errors.Wrap(err, "duoResultSubmit: error retrieving body from response")
-	}
-
-	resp = string(body)
-
-	duoTxCookie = gjson.Get(resp, "response.cookie").String()
-	if duoTxCookie == "" {
-		return "", errors.Wrap(err, "duoResultSubmit: Unable to get response.cookie")
+		return nil, errors.Wrap(err, "failed to build document from response")
 	}
-
-	return duoTxCookie, nil
+	doc.Url = res.Request.URL
+	return doc, nil
 }
 
-func parseTokens(blob string) (string, string, string, string, string) {
-	hostRgx := regexp.MustCompile(`data-host=\"(.*?)\"`)
-	sigRgx := regexp.MustCompile(`data-sig-request=\"(.*?)\"`)
-	dpaRgx := regexp.MustCompile(`data-post-action=\"(.*?)\"`)
-	csrfRgx := regexp.MustCompile(`name=\"csrf_token\" value=\"(.*?)\"`)
-
-	dataSigRequest := sigRgx.FindStringSubmatch(blob)
-	duoHost := hostRgx.FindStringSubmatch(blob)
-	postAction := dpaRgx.FindStringSubmatch(blob)
-
-	// extract the Shibboleth v4 CSRF token, if present
-	csrfToken := ""
-	csrfTokenMatch := csrfRgx.FindStringSubmatch(blob)
-	if len(csrfTokenMatch) != 0 {
-		csrfToken = csrfTokenMatch[1]
+// resolveURL resolves a form action against the page it came from
+func resolveURL(base *url.URL, ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
 	}
-
-	duoSignatures := strings.Split(dataSigRequest[1], ":")
-	return duoHost[1], postAction[1], duoSignatures[0], duoSignatures[1], csrfToken
+	return base.ResolveReference(u).String()
 }
 
-func extractSamlResponse(res *http.Response) (string, error) {
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return "", errors.Wrap(err, "extractSamlResponse: error retrieving body from response")
+func extractSamlResponse(doc *goquery.Document) (string, error) {
+	samlResponse, ok := doc.Find("input[name=\"SAMLResponse\"]").Attr("value")
+	if !ok {
+		return "", errors.New("unable to locate SAMLResponse in the Shibboleth response")
 	}
-
-	samlRgx := regexp.MustCompile(`name=\"SAMLResponse\" value=\"(.*?)\"/>`)
-	samlResponseValue := samlRgx.FindStringSubmatch(string(body))
-	return samlResponseValue[1], nil
+	return samlResponse, nil
 }
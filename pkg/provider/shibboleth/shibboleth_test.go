@@ -0,0 +1,127 @@
+package shibboleth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/duo"
+)
+
+const samlResponse = "PHNhbWxwOlJlc3BvbnNlPjwvc2FtbHA6UmVzcG9uc2U+"
+
+// idpServer serves a Shibboleth login guarded by Duo, with the Duo endpoints on the same host
+type idpServer struct {
+	*httptest.Server
+
+	forms map[string]url.Values
+}
+
+func newIdPServer(t *testing.T, universal bool) *idpServer {
+	is := &idpServer{forms: map[string]url.Values{}}
+
+	record := func(r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		is.forms[r.URL.Path] = r.Form
+	}
+	serveFile := func(file string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			record(r)
+			data, err := os.ReadFile(file)
+			require.Nil(t, err)
+			_, _ = w.Write([]byte(strings.ReplaceAll(string(data), "DUO_HOST", is.Listener.Addr().String())))
+		}
+	}
+	serveJSON := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			record(r)
+			_, _ = w.Write([]byte(body))
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/idp/profile/SAML2/Unsolicited/SSO", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("execution") {
+		case "":
+			serveFile("example/login.html")(w, r)
+		case "e1s1":
+			if universal {
+				record(r)
+				http.Redirect(w, r, "/frame/v4/auth/prompt?sid=prompt-sid", http.StatusFound)
+				return
+			}
+			serveFile("example/duo_frame.html")(w, r)
+		case "e1s2":
+			serveFile("example/saml_response.html")(w, r)
+		}
+	})
+
+	// the traditional prompt
+	mux.Handle("/frame/web/v1/auth", serveJSON(`<form><input type="hidden" name="sid" value="frame-sid"></form>`))
+	mux.Handle("/frame/prompt", serveJSON(`{"stat": "OK", "response": {"txid": "txid-example"}}`))
+	mux.Handle("/frame/status", serveJSON(`{"stat": "OK", "response": {"result": "SUCCESS", "result_url": "/frame/status/txid-example"}}`))
+	mux.Handle("/frame/status/txid-example", serveJSON(`{"stat": "OK", "response": {"cookie": "AUTH|frame-cookie"}}`))
+
+	// the Universal Prompt
+	mux.Handle("/frame/v4/auth/prompt", serveJSON(`<form><input type="hidden" name="sid" value="prompt-sid"><input type="hidden" name="_xsrf" value="prompt-xsrf"></form>`))
+	mux.Handle("/frame/v4/auth/prompt/data", serveJSON(`{"stat": "OK", "response": {"phones": [{"key": "DPPHONE1", "name": "iPhone"}], "auth_method_order": [{"factor": "Duo Push", "deviceKey": "DPPHONE1"}]}}`))
+	mux.Handle("/frame/v4/prompt", serveJSON(`{"stat": "OK", "response": {"txid": "txid-example"}}`))
+	mux.Handle("/frame/v4/status", serveJSON(`{"stat": "OK", "response": {"result": "SUCCESS", "status_code": "allow"}}`))
+	mux.HandleFunc("/frame/v4/oidc/exit", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		http.Redirect(w, r, is.URL+"/idp/profile/Authn/Duo/2FA/duo-callback?duo_code=code-example&state=state-example", http.StatusFound)
+	})
+	mux.HandleFunc("/idp/profile/Authn/Duo/2FA/duo-callback", serveFile("example/saml_response.html"))
+
+	is.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(is.Close)
+	return is
+}
+
+func newTestClient(t *testing.T) *Client {
+	duo.StatusPollInterval = 0
+
+	client, err := New(&cfg.IDPAccount{MFA: "Auto", SkipVerify: true, AmazonWebservicesURN: "urn:amazon:webservices"})
+	require.Nil(t, err)
+	return client
+}
+
+func TestAuthenticateDuoFrame(t *testing.T) {
+	is := newIdPServer(t, false)
+	client := newTestClient(t)
+
+	loginDetails := &creds.LoginDetails{URL: is.URL, Username: "user", Password: "secret", DuoMFAOption: "Duo Push"}
+	assertion, err := client.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.Equal(t, samlResponse, assertion)
+
+	login := is.forms["/idp/profile/SAML2/Unsolicited/SSO"]
+	require.Equal(t, "proceed", login.Get("_eventId"))
+	require.Equal(t, "AUTH|frame-cookie:APP|app-example", login.Get("sig_response"))
+	require.Equal(t, "_csrf-duo", login.Get("csrf_token"))
+
+	require.Equal(t, "TX|tx-example", is.forms["/frame/web/v1/auth"].Get("tx"))
+	require.Equal(t, is.URL+"/idp/profile/SAML2/Unsolicited/SSO?execution=e1s2", is.forms["/frame/web/v1/auth"].Get("parent"))
+	require.Equal(t, "Duo Push", is.forms["/frame/prompt"].Get("factor"))
+}
+
+func TestAuthenticateDuoUniversalPrompt(t *testing.T) {
+	is := newIdPServer(t, true)
+	client := newTestClient(t)
+
+	loginDetails := &creds.LoginDetails{URL: is.URL, Username: "user", Password: "secret"}
+	assertion, err := client.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.Equal(t, samlResponse, assertion)
+
+	require.Equal(t, "user", is.forms["/idp/profile/SAML2/Unsolicited/SSO"].Get("j_username"))
+	require.Equal(t, "DPPHONE1", is.forms["/frame/v4/prompt"].Get("device"))
+	require.Equal(t, "code-example", is.forms["/idp/profile/Authn/Duo/2FA/duo-callback"].Get("duo_code"))
+	require.Equal(t, "state-example", is.forms["/idp/profile/Authn/Duo/2FA/duo-callback"].Get("state"))
+}
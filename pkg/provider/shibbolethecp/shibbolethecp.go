@@ -5,9 +5,10 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
-	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"text/template"
 	"time"
 
@@ -17,7 +18,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
-	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/dump"
 	"github.com/versent/saml2aws/v2/pkg/provider"
 )
 
@@ -25,6 +26,12 @@ const SAML_SUCCESS = "urn:oasis:names:tc:SAML:2.0:status:Success"
 const SHIB_DUO_FACTOR = "X-Shibboleth-Duo-Factor"
 const SHIB_DUO_PASSCODE = "X-Shibboleth-Duo-Passcode"
 
+// defaultECPPath where Shibboleth serves the SAML2 ECP profile unless it is configured elsewhere
+const defaultECPPath = "/idp/profile/SAML2/SOAP/ECP"
+
+// errNotECP the IdP answered with something other than a SOAP envelope
+var errNotECP = errors.New("IDP response is not a SOAP envelope")
+
 // Client wrapper around shibbolethecp enabling authentication and retrieval of assertions
 type Client struct {
 	provider.ValidateBase
@@ -70,7 +77,12 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: idpAccount.SkipVerify, Renegotiation: tls.RenegotiateFreelyAsClient},
 	}
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	opts, err := provider.BuildHttpClientOpts(idpAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := provider.NewHTTPClient(tr, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
@@ -83,61 +95,99 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 // Authenticate authenticates to a Shibboleth ECP profile and return the data from the body of the SAML assertion.
 func (c *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	endpoint, err := ecpEndpoint(c.idpAccount.ECPURL, loginDetails.URL)
+	if err != nil {
+		return "", err
+	}
+
 	// Step 1: Request resource from IdP, indicate we are ECP capable
 	ar, err := authnRequest(c.idpAccount.AmazonWebservicesURN, c.idpAccount.TargetURL)
 	if err != nil {
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", loginDetails.URL, ar)
+	req, err := http.NewRequest("POST", endpoint, ar)
 	if err != nil {
-		return "", errors.Wrapf(err, "Error creating new http request for %s", loginDetails.URL)
+		return "", errors.Wrapf(err, "Error creating new http request for %s", endpoint)
 	}
 	req.Header.Set("Content-Type", "text/xml")
 	req.Header.Set("charset", "utf-8")
+	req.Header.Set("Accept", "text/html; application/vnd.paos+xml")
+	req.Header.Set("PAOS", `ver="urn:liberty:paos:2003-08";"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"`)
 	req.Header.Set(SHIB_DUO_FACTOR, c.idpAccount.MFA)
 	req.SetBasicAuth(loginDetails.Username, loginDetails.Password)
 
 	// if user chose passcode, then optionally prompt for the token and set the SHIB_DUO_PASSCODE header
 	if c.idpAccount.MFA == "passcode" {
 		if loginDetails.MFAToken == "" {
-			req.Header.Set(SHIB_DUO_PASSCODE, prompter.RequestSecurityCode("000000"))
+			req.Header.Set(SHIB_DUO_PASSCODE, loginDetails.Asker().RequestSecurityCode("000000"))
 		} else {
 			req.Header.Set(SHIB_DUO_PASSCODE, loginDetails.MFAToken)
 		}
 	}
 
 	res, err := c.client.Do(req)
-	defer func() {
-		_ = res.Body.Close()
-	}()
-
 	if err != nil {
 		return "", errors.Wrap(err, "Sending initial SOAP authnRequest")
 	}
+	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
-		return "", errors.Wrapf(err, "Response code from IDP at %s: %s", res.Status, res.Request.URL)
+	if res.StatusCode == http.StatusUnauthorized {
+		return "", provider.InvalidCredentials("the IdP at %s rejected the username or password", endpoint)
 	}
 
-	bodyBytes, _ := io.ReadAll(res.Body)
-	logger.Debugf("IDP Response: %s", bodyBytes)
-	res.Body = io.NopCloser(bytes.NewBuffer(bodyBytes)) // reset
+	bodyBytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "Reading IDP response")
+	}
+	if dump.ContentEnable() {
+		logger.Debugf("IDP Response: %s", bodyBytes)
+	}
 
 	// Step 2: Process the returned <AuthnRequest>
-	// check for SAML_SUCCESS in S:Body/saml2p:Response/saml2p:Status/saml2p:StatusCode/@Value
-	assertion, err := extractAssertion(res.Body)
-	logger.Debugf("err = %s", err)
+	// the IdP answers a SOAP fault or failed status with a 500, so the body is checked whatever the status
+	assertion, err := extractAssertion(bytes.NewReader(bodyBytes), acsURL(c.idpAccount.TargetURL))
+	if errors.Is(err, errNotECP) {
+		return "", errors.Errorf("the IdP didn't answer %s with a SOAP envelope (%s), it doesn't look to support the SAML2 ECP profile there. "+
+			"Set ecp_url to its ECP endpoint, usually https://<idp host>/idp/profile/SAML2/SOAP/ECP, or use the Shibboleth provider to log in through the login page", endpoint, res.Status)
+	}
 	if err != nil {
 		return "", err
 	}
 
-	logger.Debugf("SAML Assertion: %s", assertion)
+	if dump.ContentEnable() {
+		logger.Debugf("SAML Assertion: %s", assertion)
+	}
 
 	// saml2aws expects the assertion to be base64 encoded
 	return base64.StdEncoding.EncodeToString([]byte(assertion)), nil
 }
 
+// ecpEndpoint the ecp_url when set, otherwise the url, with the path Shibboleth serves ECP on by default added
+// when the url is just the host of the IdP
+func ecpEndpoint(ecpURL, loginURL string) (string, error) {
+	if ecpURL != "" {
+		return ecpURL, nil
+	}
+
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error parsing url %s", loginURL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = defaultECPPath
+	}
+	return u.String(), nil
+}
+
+// acsURL the assertion consumer service the AuthnRequest asks the IdP to address the response to
+func acsURL(target string) string {
+	if target == "" {
+		return "https://signin.aws.amazon.com/saml"
+	}
+	return target
+}
+
 // authnRequest creates a SOAP-XML AuthnRequest from EntityID
 func authnRequest(entityID string, target string) (io.Reader, error) {
 	// create authnRequest from template, due to fragility in xml/encoding when handling namespaces
@@ -145,13 +195,10 @@ func authnRequest(entityID string, target string) (io.Reader, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "Error parsing authnRequest template")
 	}
-	if target == "" {
-		target = "https://signin.aws.amazon.com/saml"
-	}
 	ard := authnRequestData{
 		ID:                          uuid.New().String(),
 		IssueInstant:                time.Now().Format(time.RFC3339),
-		AssertionConsumerServiceURL: target,
+		AssertionConsumerServiceURL: acsURL(target),
 		EntityID:                    entityID,
 	}
 
@@ -168,23 +215,32 @@ func authnRequest(entityID string, target string) (io.Reader, error) {
 	return bufr, nil
 }
 
-// extractAssertion extracts a SAML assertion from a SOAP response body
-func extractAssertion(body io.Reader) (string, error) {
+// extractAssertion extracts a SAML assertion from a SOAP response body, checking the IdP addressed it to the
+// assertion consumer service acs that was asked for before it is relayed to AWS
+func extractAssertion(body io.Reader, acs string) (string, error) {
 	// parse the response
 	doc := etree.NewDocument()
-	n, err := doc.ReadFrom(body)
-	if err != nil {
-		return "", errors.Wrap(err, "Unable to parse IDP response as XML using etree")
-	}
-	if n <= 0 {
-		return "", fmt.Errorf("etree ReadFrom() read %d bytes from IDP response", n)
+	if _, err := doc.ReadFrom(body); err != nil {
+		return "", errNotECP
 	}
 
 	// set the root
 	root := doc.Root()
+	if root == nil || root.Tag != "Envelope" {
+		return "", errNotECP
+	}
+
+	// the IdP reports a failed login, Duo included, as a SOAP fault
+	if fault := root.FindElement("//Fault"); fault != nil {
+		message := "unknown"
+		if faultString := fault.FindElement("faultstring"); faultString != nil {
+			message = strings.TrimSpace(faultString.Text())
+		}
+		return "", errors.Errorf("IDP returned a SOAP fault: %s", message)
+	}
 
 	// find status code
-	statusCodeElement := root.FindElement("//saml2p:StatusCode")
+	statusCodeElement := root.FindElement("//Status/StatusCode")
 	if statusCodeElement == nil {
 		return "", errors.New("Unable to find StatusCode element by XML path")
 	}
@@ -193,12 +249,25 @@ func extractAssertion(body io.Reader) (string, error) {
 	statusCode := statusCodeElement.SelectAttrValue("Value", "unknown")
 	logger.Debugf("SAML StatusCode Value = %s", statusCode)
 	if statusCode != SAML_SUCCESS {
+		if subCode := statusCodeElement.FindElement("StatusCode"); subCode != nil {
+			statusCode = subCode.SelectAttrValue("Value", statusCode)
+		}
+		if message := root.FindElement("//Status/StatusMessage"); message != nil {
+			return "", errors.Errorf("IDP response did not return success. StatusCode = %s: %s", statusCode, strings.TrimSpace(message.Text()))
+		}
 		return "", errors.Errorf("IDP response did not return success. StatusCode = %s", statusCode)
 	}
 
+	// the ECP profile has the client check the IdP means the response for the consumer the request named
+	if header := root.FindElement("Header/Response"); header != nil {
+		if consumer := header.SelectAttrValue("AssertionConsumerServiceURL", ""); consumer != acs {
+			return "", errors.Errorf("IDP addressed the response to %s rather than the requested %s", consumer, acs)
+		}
+	}
+
 	// Step 3: Extract the  SOAP-wrapped <Assertion> from IdP
 	// find the SAML Response element
-	responseElement := root.FindElement("//saml2p:Response")
+	responseElement := root.FindElement("Body/Response")
 	if responseElement == nil {
 		return "", errors.New("Unable to find Response element in IdP response by XML path")
 	}
@@ -1,14 +1,19 @@
 package shibbolethecp
 
 import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
-	"github.com/stretchr/testify/assert"
-
-	"os"
-
 	"github.com/beevik/etree"
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/provider"
 )
 
 func TestAuthnRequest(t *testing.T) {
@@ -36,7 +41,78 @@ func TestExtractAssertion(t *testing.T) {
 	data, err := os.Open("testdata/ecp_soap_response_success.xml")
 	assert.Nil(t, err)
 
-	assertion, err := extractAssertion(data)
+	assertion, err := extractAssertion(data, "https://signin.aws.amazon.com/saml")
+	assert.Nil(t, err)
+	assert.Contains(t, assertion, "<saml2p:Response")
+}
+
+func TestExtractAssertionFailures(t *testing.T) {
+	extract := func(file, acs string) error {
+		data, err := os.Open(file)
+		assert.Nil(t, err)
+		defer data.Close()
+
+		_, err = extractAssertion(data, acs)
+		return err
+	}
+
+	err := extract("testdata/ecp_soap_fault.xml", "https://signin.aws.amazon.com/saml")
+	assert.EqualError(t, err, "IDP returned a SOAP fault: An error occurred processing the Duo second factor: Login request denied.")
+
+	err = extract("testdata/ecp_soap_response_failure.xml", "https://signin.aws.amazon.com/saml")
+	assert.EqualError(t, err, "IDP response did not return success. StatusCode = urn:oasis:names:tc:SAML:2.0:status:RequestDenied: Unable to encrypt assertion")
+
+	err = extract("testdata/ecp_soap_response_success.xml", "https://signin.amazonaws-us-gov.com/saml")
+	assert.EqualError(t, err, "IDP addressed the response to https://signin.aws.amazon.com/saml rather than the requested https://signin.amazonaws-us-gov.com/saml")
+
+	_, err = extractAssertion(bytes.NewBufferString("<html><body><form id=\"login\"></form></body></html>"), "https://signin.aws.amazon.com/saml")
+	assert.True(t, errors.Is(err, errNotECP))
+}
+
+func TestEcpEndpoint(t *testing.T) {
+	endpoint, err := ecpEndpoint("", "https://idp.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://idp.example.com/idp/profile/SAML2/SOAP/ECP", endpoint)
+
+	endpoint, err = ecpEndpoint("", "https://idp.example.com/idp/profile/SAML2/SOAP/ECP")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://idp.example.com/idp/profile/SAML2/SOAP/ECP", endpoint)
+
+	endpoint, err = ecpEndpoint("https://ecp.example.com/ECP", "https://idp.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://ecp.example.com/ECP", endpoint)
+}
+
+func TestAuthenticate(t *testing.T) {
+	var paos, username string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paos = r.Header.Get("PAOS")
+		user, password, _ := r.BasicAuth()
+		username = user
+		switch {
+		case password != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path != defaultECPPath:
+			_, _ = w.Write([]byte("<html><body><form id=\"login\"></form></body></html>"))
+		default:
+			http.ServeFile(w, r, "testdata/ecp_soap_response_success.xml")
+		}
+	}))
+	defer ts.Close()
+
+	client, err := New(&cfg.IDPAccount{AmazonWebservicesURN: "urn:amazon:webservices"})
+	assert.Nil(t, err)
+
+	assertion, err := client.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "user", Password: "secret"})
 	assert.Nil(t, err)
 	assert.NotEmpty(t, assertion)
+	assert.Equal(t, "user", username)
+	assert.Contains(t, paos, "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp")
+
+	_, err = client.Authenticate(&creds.LoginDetails{URL: ts.URL, Username: "user", Password: "wrong"})
+	assert.True(t, errors.Is(err, provider.ErrInvalidCredentials))
+
+	_, err = client.Authenticate(&creds.LoginDetails{URL: ts.URL + "/idp/login", Username: "user", Password: "secret"})
+	assert.EqualError(t, err, "the IdP didn't answer "+ts.URL+"/idp/login with a SOAP envelope (200 OK), it doesn't look to support the SAML2 ECP profile there. "+
+		"Set ecp_url to its ECP endpoint, usually https://<idp host>/idp/profile/SAML2/SOAP/ECP, or use the Shibboleth provider to log in through the login page")
 }
@@ -0,0 +1,130 @@
+package samlcache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+)
+
+const (
+	// encryptedCachePrefix marks cache content encrypted with the key held in the keyring
+	encryptedCachePrefix = "saml2aws-encrypted:v1:"
+
+	cacheKeySize = 32
+)
+
+// ErrCacheKeyUnavailable returned when the SAML cache is encrypted but there is no keyring to hold the key
+var ErrCacheKeyUnavailable = errors.New("Encrypting the SAML cache requires a keychain")
+
+// cacheKeyURL the keyring entry holding the cache encryption key, one per account
+func cacheKeyURL(account string) string {
+	return "https://saml2aws.local/saml-cache/" + url.PathEscape(account)
+}
+
+// cacheKey loads the account's cache encryption key from the keyring, generating and storing a
+// new one if asked to
+func cacheKey(account string, create bool) ([]byte, error) {
+	if !credentials.SupportsStorage() {
+		return nil, ErrCacheKeyUnavailable
+	}
+
+	_, secret, err := credentials.CurrentHelper.Get(cacheKeyURL(account))
+	if err == nil {
+		key, err := b64.StdEncoding.DecodeString(secret)
+		if err == nil && len(key) == cacheKeySize {
+			return key, nil
+		}
+		logger.WithField("IdpAccount", account).Debug("Replacing malformed SAML cache key")
+	} else if !credentials.IsErrCredentialsNotFound(err) {
+		return nil, errors.Wrap(err, "Could not load the cache key from the keychain")
+	}
+
+	if !create {
+		return nil, errors.New("There is no cache key in the keychain")
+	}
+
+	key := make([]byte, cacheKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "Could not generate a cache key")
+	}
+
+	err = credentials.CurrentHelper.Add(&credentials.Credentials{
+		ServerURL: cacheKeyURL(account),
+		Username:  account,
+		Secret:    b64.StdEncoding.EncodeToString(key),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not store the cache key in the keychain")
+	}
+
+	return key, nil
+}
+
+// encryptCache seals the assertion with AES-GCM using the account's key, binding it to the account name
+func encryptCache(account string, plaintext []byte) (string, error) {
+	key, err := cacheKey(account, true)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "Could not generate a nonce")
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(account))
+
+	return encryptedCachePrefix + b64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptCache opens content written by encryptCache
+func decryptCache(account, content string) ([]byte, error) {
+	if !strings.HasPrefix(content, encryptedCachePrefix) {
+		return nil, errors.New("The cache file is not encrypted")
+	}
+
+	sealed, err := b64.StdEncoding.DecodeString(strings.TrimPrefix(content, encryptedCachePrefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not decode the encrypted cache")
+	}
+
+	key, err := cacheKey(account, false)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("The encrypted cache is truncated")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(account))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not decrypt the cache")
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not build the cache cipher")
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,124 @@
+package samlcache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/versent/saml2aws/v2/helper/credentials"
+)
+
+// memoryHelper a keychain held in memory
+type memoryHelper map[string]*credentials.Credentials
+
+func (h memoryHelper) Add(creds *credentials.Credentials) error {
+	h[creds.ServerURL] = creds
+	return nil
+}
+
+func (h memoryHelper) Delete(serverURL string) error {
+	if _, ok := h[serverURL]; !ok {
+		return credentials.ErrCredentialsNotFound
+	}
+	delete(h, serverURL)
+	return nil
+}
+
+func (h memoryHelper) Get(serverURL string) (string, string, error) {
+	creds, ok := h[serverURL]
+	if !ok {
+		return "", "", credentials.ErrCredentialsNotFound
+	}
+	return creds.Username, creds.Secret, nil
+}
+
+func (memoryHelper) SupportsCredentialStorage() bool {
+	return true
+}
+
+func useMemoryHelper(t *testing.T) memoryHelper {
+	helper := memoryHelper{}
+	oldCurrentHelper := credentials.CurrentHelper
+	credentials.CurrentHelper = helper
+	t.Cleanup(func() { credentials.CurrentHelper = oldCurrentHelper })
+	return helper
+}
+
+func TestEncryptedCache(t *testing.T) {
+
+	helper := useMemoryHelper(t)
+	cacheFile := filepath.Join(t.TempDir(), "cache_file")
+
+	p := SAMLCacheProvider{
+		Filename: cacheFile,
+		Account:  "encrypted",
+		Encrypt:  true,
+	}
+
+	err := p.WriteRaw("test_write_cache")
+	if err != nil {
+		t.Fatal("Could not write cache:", err)
+	}
+
+	content, err := os.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal("Could not read cache file:", err)
+	}
+
+	if strings.Contains(string(content), "test_write_cache") || !strings.HasPrefix(string(content), encryptedCachePrefix) {
+		t.Error("The cache file is not encrypted:", string(content))
+	}
+
+	output, err := p.ReadRaw()
+	if err != nil {
+		t.Error("Could not read cache:", err)
+	}
+
+	if output != "test_write_cache" {
+		t.Error("Cache file does not contain the right thing", output)
+	}
+
+	// the ciphertext is bound to the account
+	other := SAMLCacheProvider{Filename: cacheFile, Account: "other", Encrypt: true}
+	if _, err := other.ReadRaw(); err == nil {
+		t.Error("Another account should not be able to decrypt the cache")
+	}
+
+	// without the key the cache can't be read
+	delete(helper, cacheKeyURL("encrypted"))
+	if _, err := p.ReadRaw(); err == nil {
+		t.Error("The cache should not decrypt without its key")
+	}
+
+	if p.IsValid() {
+		t.Error("A cache that can't be decrypted should not be valid")
+	}
+
+}
+
+func TestEncryptedCacheRemove(t *testing.T) {
+
+	helper := useMemoryHelper(t)
+
+	p := SAMLCacheProvider{
+		Filename: filepath.Join(t.TempDir(), "cache_file"),
+		Account:  "encrypted",
+		Encrypt:  true,
+	}
+
+	err := p.WriteRaw("test_write_cache")
+	if err != nil {
+		t.Fatal("Could not write cache:", err)
+	}
+
+	err = p.Remove()
+	if err != nil {
+		t.Error("Could not remove cache:", err)
+	}
+
+	if _, ok := helper[cacheKeyURL("encrypted")]; ok {
+		t.Error("The cache key was not removed from the keychain")
+	}
+
+}
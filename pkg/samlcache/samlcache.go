@@ -13,6 +13,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	saml2aws "github.com/versent/saml2aws/v2"
+	"github.com/versent/saml2aws/v2/helper/credentials"
 )
 
 var (
@@ -33,6 +34,10 @@ const (
 type SAMLCacheProvider struct {
 	Filename string
 	Account  string
+	// Encrypt keeps the cache encrypted at rest with a key held in the keychain
+	Encrypt bool
+	// ClockSkew extends the validity of a cached assertion to tolerate the local clock running ahead of the IdP
+	ClockSkew time.Duration
 }
 
 func resolveSymlink(filename string) (string, error) {
@@ -65,13 +70,14 @@ func (p *SAMLCacheProvider) IsValid() bool {
 	}
 	logger = logger.WithField("Cache_file", cache_path)
 
-	raw, err := os.ReadFile(cache_path)
+	// an encrypted cache that can't be decrypted is invalid, which falls back to authenticating again
+	raw, err := p.ReadRaw()
 	if err != nil {
 		logger.Debug("Could not read cache content", err)
 		return false
 	}
 
-	data, err := b64.StdEncoding.DecodeString(string(raw))
+	data, err := b64.StdEncoding.DecodeString(raw)
 	if err != nil {
 		logger.Debug("Could not decode cache content", err)
 		return false
@@ -85,7 +91,17 @@ func (p *SAMLCacheProvider) IsValid() bool {
 
 	logger.Debug("MFA Token expiry date:", ValidUntil.Format(time.RFC3339))
 
-	return time.Now().Before(ValidUntil.Add(SAMLAssertionValidityJitter))
+	now := time.Now()
+	if now.Before(ValidUntil.Add(SAMLAssertionValidityJitter)) {
+		return true
+	}
+
+	if p.ClockSkew > 0 && now.Before(ValidUntil.Add(SAMLAssertionValidityJitter).Add(p.ClockSkew)) {
+		logger.Infof("Cached SAML assertion expired, accepted with %s of clock skew tolerance", p.ClockSkew)
+		return true
+	}
+
+	return false
 }
 
 func locateCacheFile(account string) (string, error) {
@@ -134,6 +150,14 @@ func (p *SAMLCacheProvider) ReadRaw() (string, error) {
 		return "", errors.Wrap(err, "Could not read the cache file path")
 	}
 
+	if p.Encrypt {
+		plaintext, err := decryptCache(p.Account, string(content))
+		if err != nil {
+			return "", errors.Wrap(err, "Could not decrypt the cache file")
+		}
+		return string(plaintext), nil
+	}
+
 	return string(content), nil
 }
 
@@ -155,10 +179,115 @@ func (p *SAMLCacheProvider) WriteRaw(samlAssertion string) error {
 	if err != nil {
 		return errors.Wrap(err, "Could not write the cache file directory")
 	}
-	err = os.WriteFile(cache_path, []byte(samlAssertion), SAMLCacheFilePermissions)
+	content := samlAssertion
+	if p.Encrypt {
+		content, err = encryptCache(p.Account, []byte(samlAssertion))
+		if err != nil {
+			return errors.Wrap(err, "Could not encrypt the cache")
+		}
+	}
+
+	err = os.WriteFile(cache_path, []byte(content), SAMLCacheFilePermissions)
 	if err != nil {
 		return errors.Wrap(err, "Could not write the cache file path")
 	}
 
 	return nil
 }
+
+// Exists reports whether there is a cache file for the account
+func (p *SAMLCacheProvider) Exists() bool {
+	cache_path, err := p.cachePath()
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(cache_path)
+	return err == nil
+}
+
+// Remove deletes the cache file for the account, a missing file is not an error
+func (p *SAMLCacheProvider) Remove() error {
+	cache_path, err := p.cachePath()
+	if err != nil {
+		return errors.Wrap(err, "Could not retrieve cache file path")
+	}
+
+	err = os.Remove(cache_path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Could not remove the cache file")
+	}
+
+	if p.Encrypt {
+		err = credentials.CurrentHelper.Delete(cacheKeyURL(p.Account))
+		if err != nil && !credentials.IsErrCredentialsNotFound(err) {
+			return errors.Wrap(err, "Could not remove the cache key from the keychain")
+		}
+	}
+
+	return nil
+}
+
+// Rename moves the cache file derived from the account name to the one derived from newAccount, a cache
+// file set explicitly with Filename doesn't depend on the account name and is left where it is
+func (p *SAMLCacheProvider) Rename(newAccount string) error {
+	if p.Encrypt {
+		return p.renameEncrypted(newAccount)
+	}
+
+	if p.Filename != "" {
+		p.Account = newAccount
+		return nil
+	}
+
+	old_path, err := locateCacheFile(p.Account)
+	if err != nil {
+		return errors.Wrap(err, "Could not retrieve cache file path")
+	}
+
+	new_path, err := locateCacheFile(newAccount)
+	if err != nil {
+		return errors.Wrap(err, "Could not retrieve cache file path")
+	}
+
+	err = os.Rename(old_path, new_path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Could not rename the cache file")
+	}
+
+	p.Account = newAccount
+
+	return nil
+}
+
+// renameEncrypted re-encrypts the cache for the new account as both the key and the ciphertext are bound to
+// the account name, a cache that can't be decrypted is dropped since it could never be read again
+func (p *SAMLCacheProvider) renameEncrypted(newAccount string) error {
+	if !p.Exists() {
+		p.Account = newAccount
+		return nil
+	}
+
+	samlAssertion, readErr := p.ReadRaw()
+
+	err := p.Remove()
+	if err != nil {
+		return err
+	}
+
+	p.Account = newAccount
+
+	if readErr != nil {
+		logger.WithField("IdpAccount", newAccount).Debug("Dropped a cache that could not be decrypted", readErr)
+		return nil
+	}
+
+	return p.WriteRaw(samlAssertion)
+}
+
+func (p *SAMLCacheProvider) cachePath() (string, error) {
+	if p.Filename != "" {
+		return p.Filename, nil
+	}
+	return locateCacheFile(p.Account)
+}
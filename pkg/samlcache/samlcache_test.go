@@ -7,6 +7,8 @@ import (
 	"testing"
 	"text/template"
 	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
 )
 
 func TestLocateCacheDefault(t *testing.T) {
@@ -84,6 +86,81 @@ func TestCanRead(t *testing.T) {
 
 }
 
+func TestCanRemove(t *testing.T) {
+
+	p := SAMLCacheProvider{
+		Filename: "testdir/cache_file",
+	}
+
+	err := p.WriteRaw("test_write_cache")
+	if err != nil {
+		t.Error("Could not write cache:", err)
+	}
+
+	if !p.Exists() {
+		t.Error("The cache file was not created")
+	}
+
+	err = p.Remove()
+	if err != nil {
+		t.Error("Could not remove cache:", err)
+	}
+
+	if p.Exists() {
+		t.Error("The cache file was not removed")
+	}
+
+	err = p.Remove()
+	if err != nil {
+		t.Error("Removing a missing cache should not fail:", err)
+	}
+
+	os.RemoveAll("testdir")
+
+}
+
+func TestCanRename(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	homedir.DisableCache = true
+	defer func() { homedir.DisableCache = false }()
+
+	p := SAMLCacheProvider{
+		Account: "before",
+	}
+
+	err := p.WriteRaw("test_write_cache")
+	if err != nil {
+		t.Error("Could not write cache:", err)
+	}
+
+	err = p.Rename("after")
+	if err != nil {
+		t.Error("Could not rename cache:", err)
+	}
+
+	if (&SAMLCacheProvider{Account: "before"}).Exists() {
+		t.Error("The old cache file was not moved")
+	}
+
+	output, err := p.ReadRaw()
+	if err != nil {
+		t.Error("Could not read renamed cache:", err)
+	}
+
+	if output != "test_write_cache" {
+		t.Error("Renamed cache file does not contain the right thing", output)
+	}
+
+	err = (&SAMLCacheProvider{Account: "missing"}).Rename("still_missing")
+	if err != nil {
+		t.Error("Renaming a missing cache should not fail:", err)
+	}
+
+}
+
 type AssertionTemplateData struct {
 	ExpiryRFC3339Time string
 }
@@ -206,3 +283,29 @@ func TestIsNotValid3(t *testing.T) {
 	}
 
 }
+
+func TestIsValidWithClockSkew(t *testing.T) {
+
+	// expired a minute ago by the local clock, within the tolerated skew
+	expiredAMinuteAgo := time.Now().Add(-1 * time.Minute)
+	tmpFile, err := templateAssertion(expiredAMinuteAgo)
+	defer os.Remove(tmpFile)
+	if err != nil {
+		t.Error(err)
+	}
+
+	p := SAMLCacheProvider{
+		Filename:  tmpFile,
+		ClockSkew: 2 * time.Minute,
+	}
+
+	if !p.IsValid() {
+		t.Error("Cache file should be valid within the clock skew!")
+	}
+
+	p.ClockSkew = 30 * time.Second
+	if p.IsValid() {
+		t.Error("Cache file expired beyond the clock skew and should be invalid!")
+	}
+
+}
@@ -0,0 +1,51 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Period the seconds each code is valid for, the default of RFC 6238 and what authenticator apps use
+const Period = 30
+
+// Digits the length of the codes
+const Digits = 6
+
+// NormalizeSecret cleans up a base32 seed as authenticator apps show it, in groups, lower case and with or
+// without padding
+func NormalizeSecret(secret string) string {
+	secret = strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	secret = strings.ReplaceAll(secret, "-", "")
+	return strings.TrimRight(secret, "=")
+}
+
+// Code the code for the 30 second window t falls in
+func Code(secret string, t time.Time) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(NormalizeSecret(secret))
+	if err != nil {
+		return "", errors.Wrap(err, "TOTP secret is not valid base32")
+	}
+	if len(key) == 0 {
+		return "", errors.New("TOTP secret is empty")
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/Period))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1000000), nil
+}
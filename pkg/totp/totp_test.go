@@ -0,0 +1,70 @@
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the SHA1 secret of the RFC 6238 test vectors, "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238Vectors(t *testing.T) {
+	// the RFC lists 8 digit codes, the last 6 are the 6 digit code
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		require.Nil(t, err)
+		require.Equal(t, tt.code, code, "code at %d", tt.unix)
+	}
+}
+
+func TestCodeWindow(t *testing.T) {
+	start, err := Code(rfcSecret, time.Unix(1111111110, 0))
+	require.Nil(t, err)
+	end, err := Code(rfcSecret, time.Unix(1111111139, 0))
+	require.Nil(t, err)
+	next, err := Code(rfcSecret, time.Unix(1111111140, 0))
+	require.Nil(t, err)
+
+	require.Equal(t, start, end)
+	require.NotEqual(t, start, next)
+}
+
+func TestCodeSecretFormats(t *testing.T) {
+	want, err := Code("JBSWY3DPEHPK3PXP", time.Unix(1700000000, 0))
+	require.Nil(t, err)
+
+	for _, secret := range []string{"jbswy3dpehpk3pxp", "JBSW Y3DP EHPK 3PXP", "JBSWY3DPEHPK3PXP======", "JBSWY3DPEHPK3PXP"} {
+		code, err := Code(secret, time.Unix(1700000000, 0))
+		require.Nil(t, err)
+		require.Equal(t, want, code, "code for %q", secret)
+	}
+
+	// a seed whose length needs padding
+	_, err = Code("GEZDGNBV", time.Unix(1700000000, 0))
+	require.Nil(t, err)
+	_, err = Code("GEZDGNBVGE", time.Unix(1700000000, 0))
+	require.Nil(t, err)
+	_, err = Code("GEZDGNBVGE======", time.Unix(1700000000, 0))
+	require.Nil(t, err)
+}
+
+func TestCodeInvalidSecret(t *testing.T) {
+	_, err := Code("not base32!", time.Now())
+	require.ErrorContains(t, err, "TOTP secret is not valid base32")
+
+	_, err = Code("  ", time.Now())
+	require.EqualError(t, err, "TOTP secret is empty")
+}
@@ -0,0 +1,135 @@
+package saml2aws
+
+import (
+	b64 "encoding/base64"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+)
+
+// AuthenticationResult the SAML assertion of a login along with what it says about the roles and session, so
+// callers don't parse the assertion again
+type AuthenticationResult struct {
+	// SAMLAssertion the base64 encoded SAMLResponse, as passed to AssumeRoleWithSAML
+	SAMLAssertion string
+	// Roles the AWS roles in the role attribute of the assertion
+	Roles []*AWSRole
+	// SessionNotOnOrAfter when the IdP ends the session, zero when the IdP doesn't say
+	SessionNotOnOrAfter time.Time
+	// SessionDurationAttribute the SessionDuration attribute in seconds, zero when the IdP doesn't set it
+	SessionDurationAttribute int64
+	// Audience the audience the assertion is restricted to, normally the SAML URN of AWS
+	Audience string
+	// NameID the NameID of the assertion's subject, the user the IdP logged in
+	NameID string
+	// SourceIdentity the SourceIdentity attribute, empty when the IdP doesn't set it
+	SourceIdentity string
+	// PrincipalTags the session tags of the PrincipalTag attributes by key
+	PrincipalTags map[string]string
+}
+
+// DetailedSAMLClient implemented by clients that know more of the login than the assertion they return
+type DetailedSAMLClient interface {
+	SAMLClient
+	AuthenticateDetailed(loginDetails *creds.LoginDetails) (*AuthenticationResult, error)
+}
+
+// AuthenticateDetailed authenticates with the client's AuthenticateDetailed when it is a DetailedSAMLClient, and
+// otherwise builds the result from the assertion Authenticate returns
+func AuthenticateDetailed(client SAMLClient, loginDetails *creds.LoginDetails, roleAttributeName string) (*AuthenticationResult, error) {
+	if detailed, ok := client.(DetailedSAMLClient); ok {
+		return detailed.AuthenticateDetailed(loginDetails)
+	}
+
+	samlAssertion, err := client.Authenticate(loginDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAuthenticationResult(samlAssertion, roleAttributeName)
+}
+
+// NewAuthenticationResult extracts the roles, session end and audience from a base64 encoded SAMLResponse, the
+// roles from roleAttributeName or the standard attribute when it is empty. An empty assertion gives a result
+// without any, leaving the caller to report the IdP didn't return one.
+func NewAuthenticationResult(samlAssertion, roleAttributeName string) (*AuthenticationResult, error) {
+	result := &AuthenticationResult{SAMLAssertion: samlAssertion}
+	if samlAssertion == "" {
+		return result, nil
+	}
+
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding SAML assertion")
+	}
+
+	roles, err := ExtractAwsRolesFromAttribute(data, roleAttributeName)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing AWS roles")
+	}
+
+	result.Roles, err = ParseAWSRoles(roles)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing AWS roles")
+	}
+
+	result.SessionDurationAttribute, err = ExtractSessionDuration(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing SessionDuration")
+	}
+
+	result.SessionNotOnOrAfter, err = ExtractSessionNotOnOrAfter(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing SessionNotOnOrAfter")
+	}
+
+	// AWS checks the audience itself, the IdPs that leave it out are left for it to reject
+	result.Audience, err = ExtractAudience(data)
+	if err != nil && !errors.Is(err, ErrMissingElement{Tag: audienceTag}) {
+		return nil, errors.Wrap(err, "error parsing audience")
+	}
+
+	result.NameID, err = ExtractNameID(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing NameID")
+	}
+
+	result.SourceIdentity, err = ExtractSourceIdentity(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing SourceIdentity")
+	}
+
+	result.PrincipalTags, err = ExtractPrincipalTags(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing PrincipalTag")
+	}
+
+	return result, nil
+}
+
+// SessionDuration the session duration to ask STS for, the requested one or the default when it is zero, cut
+// short to the SessionDuration attribute and so the credentials don't outlive the IdP session. STS won't go below
+// its minimum.
+func (r *AuthenticationResult) SessionDuration(requested int, now time.Time) int64 {
+	duration := int64(requested)
+	if duration <= 0 {
+		duration = cfg.DefaultSessionDuration
+	}
+	if r.SessionDurationAttribute > 0 && r.SessionDurationAttribute < duration {
+		duration = r.SessionDurationAttribute
+	}
+	if r.SessionNotOnOrAfter.IsZero() {
+		return duration
+	}
+
+	remaining := int64(r.SessionNotOnOrAfter.Sub(now) / time.Second)
+	if remaining >= duration {
+		return duration
+	}
+	if remaining < cfg.MinSessionDuration {
+		return cfg.MinSessionDuration
+	}
+	return remaining
+}
@@ -0,0 +1,113 @@
+package saml2aws
+
+import (
+	b64 "encoding/base64"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+)
+
+// assertionClient returns the assertion from Authenticate, and the result from AuthenticateDetailed when it
+// is wrapped in a detailedClient
+type assertionClient struct {
+	samlAssertion string
+}
+
+func (ac *assertionClient) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	return ac.samlAssertion, nil
+}
+
+func (ac *assertionClient) Validate(loginDetails *creds.LoginDetails) error {
+	return nil
+}
+
+type detailedClient struct {
+	assertionClient
+	result *AuthenticationResult
+}
+
+func (dc *detailedClient) AuthenticateDetailed(loginDetails *creds.LoginDetails) (*AuthenticationResult, error) {
+	return dc.result, nil
+}
+
+func readAssertion(t *testing.T, replacer *strings.Replacer) string {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+	return b64.StdEncoding.EncodeToString([]byte(replacer.Replace(string(data))))
+}
+
+func TestNewAuthenticationResult(t *testing.T) {
+	samlAssertion := readAssertion(t, strings.NewReplacer(`SessionIndex=`, `SessionNotOnOrAfter="2016-09-10T10:54:39Z" SessionIndex=`))
+
+	result, err := NewAuthenticationResult(samlAssertion, "")
+	assert.Nil(t, err)
+	assert.Equal(t, samlAssertion, result.SAMLAssertion)
+	assert.Len(t, result.Roles, 2)
+	assert.Equal(t, "urn:amazon:webservices", result.Audience)
+	assert.Equal(t, time.Date(2016, 9, 10, 10, 54, 39, 0, time.UTC), result.SessionNotOnOrAfter)
+	assert.Equal(t, int64(28800), result.SessionDurationAttribute)
+	assert.Equal(t, `EXAMPLE\wolfeidau`, result.NameID)
+	assert.Equal(t, "", result.SourceIdentity)
+	assert.Empty(t, result.PrincipalTags)
+
+	result, err = NewAuthenticationResult(readAssertion(t, strings.NewReplacer("https://aws.amazon.com/SAML/Attributes/RoleSessionName", "https://aws.amazon.com/SAML/Attributes/SourceIdentity")), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "wolfeidau@example.com", result.SourceIdentity)
+
+	result, err = NewAuthenticationResult(readAssertion(t, strings.NewReplacer("https://aws.amazon.com/SAML/Attributes/SessionDuration", "urn:example:duration")), "")
+	assert.Nil(t, err)
+	assert.True(t, result.SessionNotOnOrAfter.IsZero())
+	assert.Equal(t, int64(0), result.SessionDurationAttribute)
+
+	_, err = NewAuthenticationResult(readAssertion(t, strings.NewReplacer("28800", "eight hours")), "")
+	assert.ErrorContains(t, err, "error parsing SessionDuration")
+
+	result, err = NewAuthenticationResult("", "")
+	assert.Nil(t, err)
+	assert.Empty(t, result.Roles)
+
+	_, err = NewAuthenticationResult(readAssertion(t, strings.NewReplacer()), "urn:example:roles")
+	assert.EqualError(t, err, "error parsing AWS roles: no roles found in SAML attribute urn:example:roles, check the IdP maps the AWS roles to it")
+}
+
+func TestAuthenticateDetailed(t *testing.T) {
+	samlAssertion := readAssertion(t, strings.NewReplacer())
+
+	result, err := AuthenticateDetailed(&assertionClient{samlAssertion: samlAssertion}, &creds.LoginDetails{}, "")
+	assert.Nil(t, err)
+	assert.Len(t, result.Roles, 2)
+
+	// the client's own result is used as is
+	detailed := &AuthenticationResult{SAMLAssertion: samlAssertion, Audience: "urn:example:aws"}
+	result, err = AuthenticateDetailed(&detailedClient{assertionClient{samlAssertion: samlAssertion}, detailed}, &creds.LoginDetails{}, "")
+	assert.Nil(t, err)
+	assert.Same(t, detailed, result)
+}
+
+func TestAuthenticationResultSessionDuration(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	result := &AuthenticationResult{}
+	assert.Equal(t, int64(28800), result.SessionDuration(28800, now))
+	assert.Equal(t, int64(3600), result.SessionDuration(0, now))
+
+	result.SessionNotOnOrAfter = now.Add(2 * time.Hour)
+	assert.Equal(t, int64(3600), result.SessionDuration(3600, now))
+	assert.Equal(t, int64(7200), result.SessionDuration(28800, now))
+
+	// the SessionDuration attribute caps the requested duration but doesn't raise it
+	result = &AuthenticationResult{SessionDurationAttribute: 14400}
+	assert.Equal(t, int64(14400), result.SessionDuration(28800, now))
+	assert.Equal(t, int64(7200), result.SessionDuration(7200, now))
+
+	result.SessionNotOnOrAfter = now.Add(2 * time.Hour)
+	assert.Equal(t, int64(7200), result.SessionDuration(28800, now))
+
+	// STS won't issue a session shorter than 15 minutes
+	result.SessionNotOnOrAfter = now.Add(5 * time.Minute)
+	assert.Equal(t, int64(900), result.SessionDuration(3600, now))
+}
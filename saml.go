@@ -3,17 +3,33 @@ package saml2aws
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/beevik/etree"
 )
 
 const (
-	assertionTag          = "Assertion"
-	attributeStatementTag = "AttributeStatement"
-	attributeTag          = "Attribute"
-	attributeValueTag     = "AttributeValue"
-	responseTag           = "Response"
+	assertionTag           = "Assertion"
+	attributeStatementTag  = "AttributeStatement"
+	attributeTag           = "Attribute"
+	attributeValueTag      = "AttributeValue"
+	audienceRestrictionTag = "AudienceRestriction"
+	audienceTag            = "Audience"
+	authnStatementTag      = "AuthnStatement"
+	conditionsTag          = "Conditions"
+	nameIDTag              = "NameID"
+	responseTag            = "Response"
+	subjectTag             = "Subject"
+
+	// DefaultRoleAttributeName the SAML attribute AWS reads the role and principal pairs from
+	DefaultRoleAttributeName = "https://aws.amazon.com/SAML/Attributes/Role"
+
+	// SourceIdentityAttributeName the SAML attribute AWS sets the source identity of the role session from
+	SourceIdentityAttributeName = "https://aws.amazon.com/SAML/Attributes/SourceIdentity"
+
+	// PrincipalTagAttributePrefix the prefix of the SAML attributes AWS passes as session tags, followed by the key
+	PrincipalTagAttributePrefix = "https://aws.amazon.com/SAML/Attributes/PrincipalTag:"
 )
 
 // ErrMissingElement is the error type that indicates an element and/or attribute is
@@ -133,8 +149,113 @@ func ExtractMFATokenExpiryTime(data []byte) (time.Time, error) {
 	return time.Parse(time.RFC3339, ValidUntilString)
 }
 
+// ExtractSessionNotOnOrAfter returns when the IdP ends the session the assertion was issued in
+// This is done by looking at the AuthnStatement's SessionNotOnOrAfter attribute, zero if not set
+func ExtractSessionNotOnOrAfter(data []byte) (time.Time, error) {
+	var t time.Time
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return t, err
+	}
+
+	authnStatementElement := doc.FindElement(".//" + authnStatementTag)
+	if authnStatementElement == nil {
+		return t, nil
+	}
+
+	value := authnStatementElement.SelectAttrValue("SessionNotOnOrAfter", "")
+	if value == "" {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// ExtractAudience returns the audience the assertion is restricted to, normally the SAML URN of AWS
+func ExtractAudience(data []byte) (string, error) {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return "", err
+	}
+
+	audienceElement := doc.FindElement(".//" + audienceRestrictionTag + "/" + audienceTag)
+	if audienceElement == nil {
+		return "", ErrMissingElement{Tag: audienceTag}
+	}
+
+	return strings.TrimSpace(audienceElement.Text()), nil
+}
+
+// ExtractAssertionConditions returns the validity window of the assertion
+// This is done by looking at the Conditions' NotBefore and NotOnOrAfter attributes, either may be zero if not set
+func ExtractAssertionConditions(data []byte) (notBefore, notOnOrAfter time.Time, err error) {
+
+	doc := etree.NewDocument()
+	if err = doc.ReadFromBytes(data); err != nil {
+		return notBefore, notOnOrAfter, err
+	}
+
+	conditionsElement := doc.FindElement(".//Conditions")
+	if conditionsElement == nil {
+		return notBefore, notOnOrAfter, ErrMissingElement{Tag: conditionsTag}
+	}
+
+	if value := conditionsElement.SelectAttrValue("NotBefore", ""); value != "" {
+		notBefore, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return notBefore, notOnOrAfter, err
+		}
+	}
+
+	if value := conditionsElement.SelectAttrValue("NotOnOrAfter", ""); value != "" {
+		notOnOrAfter, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return notBefore, notOnOrAfter, err
+		}
+	}
+
+	return notBefore, notOnOrAfter, nil
+}
+
+// ValidateAssertionConditions checks now falls inside the validity window of the assertion widened by skew
+// on both sides, rescued reports the assertion is only valid because of the skew
+func ValidateAssertionConditions(data []byte, now time.Time, skew time.Duration) (rescued bool, err error) {
+	notBefore, notOnOrAfter, err := ExtractAssertionConditions(data)
+	if err != nil {
+		return false, err
+	}
+
+	if !notBefore.IsZero() && now.Before(notBefore) {
+		if now.Before(notBefore.Add(-skew)) {
+			return false, fmt.Errorf("assertion is not valid before %s", notBefore.Format(time.RFC3339))
+		}
+		rescued = true
+	}
+
+	if !notOnOrAfter.IsZero() && !now.Before(notOnOrAfter) {
+		if !now.Before(notOnOrAfter.Add(skew)) {
+			return false, fmt.Errorf("assertion expired at %s", notOnOrAfter.Format(time.RFC3339))
+		}
+		rescued = true
+	}
+
+	return rescued, nil
+}
+
 // ExtractAwsRoles given an assertion document extract the aws roles
 func ExtractAwsRoles(data []byte) ([]string, error) {
+	return ExtractAwsRolesFromAttribute(data, DefaultRoleAttributeName)
+}
+
+// ExtractAwsRolesFromAttribute given an assertion document extract the aws roles from the named attribute, for
+// IdPs that don't map them to the standard one. A custom attribute without any roles is an error naming it.
+func ExtractAwsRolesFromAttribute(data []byte, attributeName string) ([]string, error) {
+
+	if attributeName == "" {
+		attributeName = DefaultRoleAttributeName
+	}
 
 	awsroles := []string{}
 
@@ -162,7 +283,7 @@ func ExtractAwsRoles(data []byte) ([]string, error) {
 
 	attributes := attributeStatement.FindElements(childPath(assertionElement.Space, attributeTag))
 	for _, attribute := range attributes {
-		if attribute.SelectAttrValue("Name", "") != "https://aws.amazon.com/SAML/Attributes/Role" {
+		if attribute.SelectAttrValue("Name", "") != attributeName {
 			continue
 		}
 		atributeValues := attribute.FindElements(childPath(assertionElement.Space, attributeValueTag))
@@ -171,9 +292,91 @@ func ExtractAwsRoles(data []byte) ([]string, error) {
 		}
 	}
 
+	if len(awsroles) == 0 && attributeName != DefaultRoleAttributeName {
+		return nil, fmt.Errorf("no roles found in SAML attribute %s, check the IdP maps the AWS roles to it", attributeName)
+	}
+
 	return awsroles, nil
 }
 
+// ExtractSourceIdentity returns the SourceIdentity attribute of the assertion, empty when the IdP doesn't set it
+// see https://docs.aws.amazon.com/IAM/latest/UserGuide/id_credentials_temp_control-access_monitor.html
+func ExtractSourceIdentity(data []byte) (string, error) {
+	attributes, err := extractAttributes(data)
+	if err != nil {
+		return "", err
+	}
+
+	if values := attributes[SourceIdentityAttributeName]; len(values) > 0 {
+		return values[0], nil
+	}
+
+	return "", nil
+}
+
+// ExtractPrincipalTags returns the session tags of the PrincipalTag attributes of the assertion by key
+// see https://docs.aws.amazon.com/IAM/latest/UserGuide/id_session-tags.html#id_session-tags_adding-assume-role-saml
+func ExtractPrincipalTags(data []byte) (map[string]string, error) {
+	attributes, err := extractAttributes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	for name, values := range attributes {
+		if key := strings.TrimPrefix(name, PrincipalTagAttributePrefix); key != name && len(values) > 0 {
+			tags[key] = values[0]
+		}
+	}
+
+	return tags, nil
+}
+
+// ExtractNameID returns the NameID of the assertion's subject, the user the IdP logged in, empty when there isn't one
+func ExtractNameID(data []byte) (string, error) {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return "", err
+	}
+
+	nameIDElement := doc.FindElement(".//" + subjectTag + "/" + nameIDTag)
+	if nameIDElement == nil {
+		return "", nil
+	}
+
+	return strings.TrimSpace(nameIDElement.Text()), nil
+}
+
+// extractAttributes returns the values of each attribute of the assertion by name
+func extractAttributes(data []byte) (map[string][]string, error) {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, err
+	}
+
+	assertionElement := doc.FindElement(".//Assertion")
+	if assertionElement == nil {
+		return nil, ErrMissingAssertion
+	}
+
+	attributeStatement := assertionElement.FindElement(childPath(assertionElement.Space, attributeStatementTag))
+	if attributeStatement == nil {
+		return nil, ErrMissingElement{Tag: attributeStatementTag}
+	}
+
+	attributes := map[string][]string{}
+	for _, attribute := range attributeStatement.FindElements(childPath(assertionElement.Space, attributeTag)) {
+		name := attribute.SelectAttrValue("Name", "")
+		for _, attrValue := range attribute.FindElements(childPath(assertionElement.Space, attributeValueTag)) {
+			attributes[name] = append(attributes[name], strings.TrimSpace(attrValue.Text()))
+		}
+	}
+
+	return attributes, nil
+}
+
 func childPath(space, tag string) string {
 	if space == "" {
 		return "./" + tag
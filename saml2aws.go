@@ -9,14 +9,18 @@ import (
 	"github.com/versent/saml2aws/v2/pkg/provider/aad"
 	"github.com/versent/saml2aws/v2/pkg/provider/adfs"
 	"github.com/versent/saml2aws/v2/pkg/provider/adfs2"
+	"github.com/versent/saml2aws/v2/pkg/provider/adfswstrust"
 	"github.com/versent/saml2aws/v2/pkg/provider/akamai"
 	"github.com/versent/saml2aws/v2/pkg/provider/auth0"
 	"github.com/versent/saml2aws/v2/pkg/provider/authentik"
 	"github.com/versent/saml2aws/v2/pkg/provider/browser"
+	"github.com/versent/saml2aws/v2/pkg/provider/duosso"
 	"github.com/versent/saml2aws/v2/pkg/provider/f5apm"
 	"github.com/versent/saml2aws/v2/pkg/provider/googleapps"
+	"github.com/versent/saml2aws/v2/pkg/provider/identitycenter"
 	"github.com/versent/saml2aws/v2/pkg/provider/jumpcloud"
 	"github.com/versent/saml2aws/v2/pkg/provider/keycloak"
+	"github.com/versent/saml2aws/v2/pkg/provider/miniorange"
 	"github.com/versent/saml2aws/v2/pkg/provider/netiq"
 	"github.com/versent/saml2aws/v2/pkg/provider/okta"
 	"github.com/versent/saml2aws/v2/pkg/provider/onelogin"
@@ -33,25 +37,29 @@ type ProviderList map[string][]string
 
 // MFAsByProvider a list of providers with their respective supported MFAs
 var MFAsByProvider = ProviderList{
-	"AzureAD":       []string{"Auto", "PhoneAppOTP", "PhoneAppNotification", "OneWaySMS"},
-	"ADFS":          []string{"Auto", "VIP", "Azure", "Defender"},
-	"ADFS2":         []string{"Auto", "RSA"}, // nothing automatic about ADFS 2.x
-	"Ping":          []string{"Auto"},        // automatically detects PingID
-	"PingNTLM":      []string{"Auto"},        // automatically detects PingID
-	"PingOne":       []string{"Auto"},        // automatically detects PingID
-	"JumpCloud":     []string{"Auto", "TOTP", "WEBAUTHN", "DUO", "PUSH"},
-	"Okta":          []string{"Auto", "PUSH", "DUO", "SMS", "EMAIL", "TOTP", "OKTA", "FIDO", "YUBICO TOKEN:HARDWARE", "SYMANTEC"}, // automatically detects DUO, SMS, ToTP, and FIDO
-	"OneLogin":      []string{"Auto", "OLP", "SMS", "TOTP", "YUBIKEY", "DUO TOTP"},                                                // automatically detects OneLogin Protect, SMS and ToTP
-	"Authentik":     []string{"Auto"},
-	"KeyCloak":      []string{"Auto"}, // automatically detects ToTP
-	"GoogleApps":    []string{"Auto"}, // automatically detects ToTP
-	"Shibboleth":    []string{"Auto", "None"},
-	"F5APM":         []string{"Auto"},
-	"Akamai":        []string{"Auto", "DUO", "SMS", "EMAIL", "TOTP"},
-	"ShibbolethECP": []string{"auto", "phone", "push", "passcode"},
-	"NetIQ":         []string{"Auto", "Privileged"},
-	"Browser":       []string{"Auto"},
-	"Auth0":         []string{"Auto"},
+	"AzureAD":        []string{"Auto", "PhoneAppOTP", "PhoneAppNotification", "OneWaySMS"},
+	"ADFS":           []string{"Auto", "VIP", "Azure", "Defender"},
+	"ADFS2":          []string{"Auto", "RSA"}, // nothing automatic about ADFS 2.x
+	"ADFSWSTrust":    []string{"Auto"},        // WS-Trust only carries the username and password
+	"Ping":           []string{"Auto"},        // automatically detects PingID
+	"PingNTLM":       []string{"Auto"},        // automatically detects PingID
+	"PingOne":        []string{"Auto"},        // automatically detects PingID
+	"JumpCloud":      []string{"Auto", "TOTP", "WEBAUTHN", "DUO", "PUSH"},
+	"Okta":           []string{"Auto", "PUSH", "DUO", "SMS", "EMAIL", "TOTP", "OKTA", "FIDO", "WEBAUTHN", "YUBICO TOKEN:HARDWARE", "SYMANTEC"}, // automatically detects DUO, SMS, ToTP, and FIDO
+	"OneLogin":       []string{"Auto", "OLP", "SMS", "TOTP", "YUBIKEY", "DUO TOTP"},                                                            // automatically detects OneLogin Protect, SMS and ToTP
+	"Authentik":      []string{"Auto"},
+	"KeyCloak":       []string{"Auto", "TOTP"}, // automatically detects ToTP, TOTP generates the code from the configure-mfa secret
+	"GoogleApps":     []string{"Auto"},         // automatically detects ToTP
+	"Shibboleth":     []string{"Auto", "None"},
+	"F5APM":          []string{"Auto"},
+	"Akamai":         []string{"Auto", "DUO", "SMS", "EMAIL", "TOTP"},
+	"ShibbolethECP":  []string{"auto", "phone", "push", "passcode"},
+	"NetIQ":          []string{"Auto", "Privileged", "TOTP", "RADIUS"},
+	"Browser":        []string{"Auto"},
+	"Auth0":          []string{"Auto"},
+	"IdentityCenter": []string{"Auto"}, // the device authorization happens in the browser
+	"DuoSSO":         []string{"Auto", "PUSH", "CALL", "PASSCODE"},
+	"miniOrange":     []string{"Auto"}, // automatically detects email OTP and TOTP
 }
 
 // Names get a list of provider names
@@ -113,6 +121,11 @@ func NewSAMLClient(idpAccount *cfg.IDPAccount) (SAMLClient, error) {
 			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
 		}
 		return adfs2.New(idpAccount)
+	case adfswstrust.ProviderName:
+		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
+			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider, WS-Trust logs in with the username and password only, use the ADFS provider for MFA", idpAccount.MFA, idpAccount.Provider)
+		}
+		return adfswstrust.New(idpAccount)
 	case "Ping":
 		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
 			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
@@ -137,6 +150,11 @@ func NewSAMLClient(idpAccount *cfg.IDPAccount) (SAMLClient, error) {
 		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
 			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
 		}
+		for _, mfa := range idpAccount.MFAFallbackMethods() {
+			if invalidMFA(idpAccount.Provider, mfa) {
+				return nil, fmt.Errorf("Invalid MFA fallback type: %v for %v provider", mfa, idpAccount.Provider)
+			}
+		}
 		return okta.New(idpAccount)
 	case "OneLogin":
 		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
@@ -178,6 +196,16 @@ func NewSAMLClient(idpAccount *cfg.IDPAccount) (SAMLClient, error) {
 			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
 		}
 		return akamai.New(idpAccount)
+	case "DuoSSO":
+		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
+			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
+		}
+		return duosso.New(idpAccount)
+	case "miniOrange":
+		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
+			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
+		}
+		return miniorange.New(idpAccount)
 	case "Shell":
 		return shell.New(idpAccount)
 	case "NetIQ":
@@ -192,6 +220,8 @@ func NewSAMLClient(idpAccount *cfg.IDPAccount) (SAMLClient, error) {
 			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
 		}
 		return auth0.New(idpAccount)
+	case identitycenter.ProviderName:
+		return identitycenter.New(idpAccount)
 	default:
 		return nil, fmt.Errorf("Invalid provider: %v", idpAccount.Provider)
 	}
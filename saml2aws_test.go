@@ -12,7 +12,7 @@ import (
 func TestProviderList_Keys(t *testing.T) {
 	names := MFAsByProvider.Names()
 
-	require.Len(t, names, 19)
+	require.Len(t, names, 23)
 }
 
 func TestProviderList_Mfas(t *testing.T) {
@@ -49,6 +49,19 @@ func TestProviderAzureADMFA(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestProviderADFSWSTrustMFA(t *testing.T) {
+	account := &cfg.IDPAccount{
+		Provider: "ADFSWSTrust",
+		MFA:      "RSA",
+	}
+	_, err := NewSAMLClient(account)
+	assert.ErrorContains(t, err, "Invalid MFA type: RSA for ADFSWSTrust provider, WS-Trust logs in with the username and password only")
+
+	account.MFA = "Auto"
+	_, err = NewSAMLClient(account)
+	assert.Nil(t, err)
+}
+
 func TestProviderPingNTLMInvalidMFA(t *testing.T) {
 	account := &cfg.IDPAccount{
 		Provider: "PingNTLM",
@@ -68,3 +81,13 @@ func TestProviderPingNTLMMFA(t *testing.T) {
 	err = client.Validate(loginDetails)
 	assert.Nil(t, err)
 }
+
+func TestProviderOktaInvalidMFAFallback(t *testing.T) {
+	account := &cfg.IDPAccount{
+		Provider:    "Okta",
+		MFA:         "PUSH",
+		MFAFallback: "TOTP, CARRIER-PIGEON",
+	}
+	_, err := NewSAMLClient(account)
+	assert.ErrorContains(t, err, "Invalid MFA fallback type: CARRIER-PIGEON")
+}
@@ -2,6 +2,7 @@ package saml2aws
 
 import (
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,6 +26,23 @@ func TestExtractAwsRolesFail(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestExtractAwsRolesFromAttribute(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	roles, err := ExtractAwsRolesFromAttribute(data, "")
+	assert.Nil(t, err)
+	assert.Len(t, roles, 2)
+
+	custom := strings.ReplaceAll(string(data), DefaultRoleAttributeName, "urn:example:roles")
+	roles, err = ExtractAwsRolesFromAttribute([]byte(custom), "urn:example:roles")
+	assert.Nil(t, err)
+	assert.Len(t, roles, 2)
+
+	_, err = ExtractAwsRolesFromAttribute(data, "urn:example:roles")
+	assert.EqualError(t, err, "no roles found in SAML attribute urn:example:roles, check the IdP maps the AWS roles to it")
+}
+
 func TestExtractSessionDuration(t *testing.T) {
 	data, err := os.ReadFile("testdata/assertion.xml")
 	assert.Nil(t, err)
@@ -34,6 +52,17 @@ func TestExtractSessionDuration(t *testing.T) {
 	assert.Equal(t, int64(28800), duration)
 }
 
+func TestExtractSessionDurationMissing(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	data = []byte(strings.ReplaceAll(string(data), "https://aws.amazon.com/SAML/Attributes/SessionDuration", "urn:example:duration"))
+
+	duration, err := ExtractSessionDuration(data)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), duration)
+}
+
 func TestExtractSessionDurationFail(t *testing.T) {
 	data, err := os.ReadFile("testdata/notxml.xml")
 	assert.Nil(t, err)
@@ -95,3 +124,101 @@ func TestExtractMFATokenDuration2(t *testing.T) {
 	t.Log(err)
 	assert.NotNil(t, err)
 }
+
+func TestExtractAssertionConditions(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	notBefore, notOnOrAfter, err := ExtractAssertionConditions(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "2016-09-10T02:54:39Z", notBefore.Format(time.RFC3339))
+	assert.Equal(t, "2016-09-10T03:54:39Z", notOnOrAfter.Format(time.RFC3339))
+}
+
+func TestValidateAssertionConditions(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	notBefore := time.Date(2016, 9, 10, 2, 54, 39, 371000000, time.UTC)
+	notOnOrAfter := time.Date(2016, 9, 10, 3, 54, 39, 371000000, time.UTC)
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		skew    time.Duration
+		rescued bool
+		wantErr bool
+	}{
+		{name: "inside window", now: notBefore.Add(time.Minute)},
+		{name: "early strict", now: notBefore.Add(-time.Minute), wantErr: true},
+		{name: "early within skew", now: notBefore.Add(-time.Minute), skew: 2 * time.Minute, rescued: true},
+		{name: "early beyond skew", now: notBefore.Add(-3 * time.Minute), skew: 2 * time.Minute, wantErr: true},
+		{name: "expired strict", now: notOnOrAfter, wantErr: true},
+		{name: "expired within skew", now: notOnOrAfter.Add(time.Minute), skew: 2 * time.Minute, rescued: true},
+		{name: "expired beyond skew", now: notOnOrAfter.Add(3 * time.Minute), skew: 2 * time.Minute, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rescued, err := ValidateAssertionConditions(data, tt.now, tt.skew)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.rescued, rescued)
+		})
+	}
+}
+
+func TestExtractSourceIdentityAndPrincipalTags(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	sourceIdentity, err := ExtractSourceIdentity(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "", sourceIdentity)
+
+	tags, err := ExtractPrincipalTags(data)
+	assert.Nil(t, err)
+	assert.Empty(t, tags)
+
+	data = []byte(strings.Replace(string(data), "<AttributeStatement>", `<AttributeStatement>
+      <Attribute Name="https://aws.amazon.com/SAML/Attributes/SourceIdentity">
+        <AttributeValue>wolfeidau@example.com</AttributeValue>
+      </Attribute>
+      <Attribute Name="https://aws.amazon.com/SAML/Attributes/PrincipalTag:Department">
+        <AttributeValue> Engineering </AttributeValue>
+      </Attribute>
+      <Attribute Name="https://aws.amazon.com/SAML/Attributes/PrincipalTag:CostCenter">
+        <AttributeValue>12345</AttributeValue>
+      </Attribute>`, 1))
+
+	sourceIdentity, err = ExtractSourceIdentity(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "wolfeidau@example.com", sourceIdentity)
+
+	tags, err = ExtractPrincipalTags(data)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"Department": "Engineering", "CostCenter": "12345"}, tags)
+
+	data, err = os.ReadFile("testdata/notxml.xml")
+	assert.Nil(t, err)
+	_, err = ExtractSourceIdentity(data)
+	assert.Error(t, err)
+}
+
+func TestExtractNameID(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	nameID, err := ExtractNameID(data)
+	assert.Nil(t, err)
+	assert.Equal(t, `EXAMPLE\wolfeidau`, nameID)
+
+	data, err = os.ReadFile("testdata/assertion_pingfed.xml")
+	assert.Nil(t, err)
+
+	nameID, err = ExtractNameID(data)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, nameID)
+}